@@ -35,6 +35,7 @@ import (
 // to run with a set of individual commands as goroutines
 // (rather than the simple commandline mode that runs a single command)
 type ServerConfig struct {
+	Defaults        map[string]interface{}                     `json:"defaults,omitempty"`
 	KafkaBridges    map[string]*kldkafka.KafkaBridgeConf       `json:"kafka"`
 	WebhooksBridges map[string]*kldwebhooks.WebhooksBridgeConf `json:"webhooks"`
 }
@@ -104,6 +105,7 @@ func readServerConfig() (serverConfig *ServerConfig, err error) {
 		err = fmt.Errorf("Failed to read %s: %s", serverCmdConfig.Filename, err)
 		return
 	}
+	var genericPayload map[string]interface{}
 	if strings.ToLower(serverCmdConfig.Type) == "yaml" {
 		// Convert to JSON first
 		yamlGenericPayload := make(map[interface{}]interface{})
@@ -111,19 +113,109 @@ func readServerConfig() (serverConfig *ServerConfig, err error) {
 			err = fmt.Errorf("Unable to parse %s as YAML: %s", serverCmdConfig.Filename, err)
 			return
 		}
-		genericPayload := dyno.ConvertMapI2MapS(yamlGenericPayload).(map[string]interface{})
-		// Reseialize back to JSON
-		confBytes, _ = json.Marshal(&genericPayload)
+		genericPayload = dyno.ConvertMapI2MapS(yamlGenericPayload).(map[string]interface{})
+	} else if err = json.Unmarshal(confBytes, &genericPayload); err != nil {
+		err = fmt.Errorf("Unable to parse %s as JSON: %s", serverCmdConfig.Filename, err)
+		return
 	}
+	applyBridgeDefaults(genericPayload)
+	// Reseialize back to JSON
+	confBytes, _ = json.Marshal(&genericPayload)
 	serverConfig = &ServerConfig{}
 	err = json.Unmarshal(confBytes, serverConfig)
 	if err != nil {
 		err = fmt.Errorf("Failed to process YAML config from %s: %s", serverCmdConfig.Filename, err)
 		return
 	}
+	err = linkWebhooksBridges(serverConfig)
 	return
 }
 
+// linkWebhooksBridges points each webhooks bridge that names a Kafka bridge at
+// the topics of that bridge, so requests received over HTTP are processed
+// alongside those sent directly to Kafka, by the same bridge with the same
+// signing and nonce state. The webhooks bridge keeps its own consumer group
+// and client ID for reading the replies into its receipt store, and its own
+// partitioner for the requests
+func linkWebhooksBridges(serverConfig *ServerConfig) error {
+	for name, conf := range serverConfig.WebhooksBridges {
+		if conf.KafkaBridge == "" {
+			continue
+		}
+		kafkaBridge, exists := serverConfig.KafkaBridges[conf.KafkaBridge]
+		if !exists {
+			return fmt.Errorf("Webhooks bridge '%s' refers to Kafka bridge '%s', which is not defined", name, conf.KafkaBridge)
+		}
+		log.Debugf("Linking webhooks bridge '%s' to Kafka bridge '%s'", name, conf.KafkaBridge)
+		consumerGroup, clientID, partitioner := conf.Kafka.ConsumerGroup, conf.Kafka.ClientID, conf.Kafka.Partitioner
+		conf.Kafka = kafkaBridge.Kafka
+		conf.Kafka.TopicIn = kafkaBridge.Kafka.TopicOut
+		conf.Kafka.TopicOut = kafkaBridge.Kafka.TopicIn
+		conf.Kafka.ClientID = clientID
+		conf.Kafka.Partitioner = partitioner
+		conf.Kafka.ConsumerGroup = consumerGroup
+		if consumerGroup == "" {
+			conf.Kafka.ConsumerGroup = name
+		}
+	}
+	return nil
+}
+
+// applyBridgeDefaults deep-merges the top-level defaults block into each of
+// the Kafka bridge definitions. Fields set on a bridge always win, and
+// nested objects are merged field-by-field.
+func applyBridgeDefaults(genericPayload map[string]interface{}) {
+	defaults, ok := genericPayload["defaults"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	kafkaBridges, _ := genericPayload["kafka"].(map[string]interface{})
+	for name, bridge := range kafkaBridges {
+		bridgeMap, ok := bridge.(map[string]interface{})
+		if !ok {
+			// Leave it to the JSON parse to report the bad type
+			continue
+		}
+		log.Debugf("Applying defaults to Kafka bridge '%s'", name)
+		mergeDefaults(bridgeMap, defaults)
+	}
+}
+
+func mergeDefaults(target, defaults map[string]interface{}) {
+	for key, defVal := range defaults {
+		existing, exists := target[key]
+		if !exists {
+			target[key] = copyGeneric(defVal)
+			continue
+		}
+		existingMap, isMap := existing.(map[string]interface{})
+		defMap, defIsMap := defVal.(map[string]interface{})
+		if isMap && defIsMap {
+			mergeDefaults(existingMap, defMap)
+		}
+	}
+}
+
+// copyGeneric ensures bridges do not share nested maps/arrays from the defaults
+func copyGeneric(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, entry := range v {
+			copied[key] = copyGeneric(entry)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, entry := range v {
+			copied[i] = copyGeneric(entry)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
 func startServer() (err error) {
 	serverConfig, err := readServerConfig()
 	if err != nil {
@@ -176,3 +176,148 @@ func TestExecuteServerWithBadYAML(t *testing.T) {
 
 	assert.Equal(1, osExit)
 }
+
+func TestReadServerConfigWithDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"defaults:\n"+
+			"  maxInFlight: 25\n"+
+			"  maxTXWaitTime: 60\n"+
+			"  kafka:\n"+
+			"    brokers:\n"+
+			"    - broker1\n"+
+			"    topicOut: replies\n"+
+			"  rpc:\n"+
+			"    url: http://ethereum1\n"+
+			"kafka:\n"+
+			"  kbridge1:\n"+
+			"    kafka:\n"+
+			"      topicIn: in1\n"+
+			"  kbridge2:\n"+
+			"    maxInFlight: 5\n"+
+			"    kafka:\n"+
+			"      topicIn: in2\n"+
+			"      topicOut: out2\n"+
+			"    rpc:\n"+
+			"      url: http://ethereum2\n"), 0644)
+
+	serverCmdConfig.Filename = exampleConfYAML.Name()
+	serverCmdConfig.Type = "yaml"
+	serverConfig, err := readServerConfig()
+	assert.NoError(err)
+
+	kb1 := serverConfig.KafkaBridges["kbridge1"]
+	assert.Equal(25, kb1.MaxInFlight)
+	assert.Equal(60, kb1.MaxTXWaitTime)
+	assert.Equal([]string{"broker1"}, kb1.Kafka.Brokers)
+	assert.Equal("in1", kb1.Kafka.TopicIn)
+	assert.Equal("replies", kb1.Kafka.TopicOut)
+	assert.Equal("http://ethereum1", kb1.RPC.URL)
+
+	kb2 := serverConfig.KafkaBridges["kbridge2"]
+	assert.Equal(5, kb2.MaxInFlight)
+	assert.Equal(60, kb2.MaxTXWaitTime)
+	assert.Equal([]string{"broker1"}, kb2.Kafka.Brokers)
+	assert.Equal("in2", kb2.Kafka.TopicIn)
+	assert.Equal("out2", kb2.Kafka.TopicOut)
+	assert.Equal("http://ethereum2", kb2.RPC.URL)
+}
+
+func TestReadServerConfigWithDefaultsJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfJSON, _ := ioutil.TempFile("", "testJSON")
+	defer syscall.Unlink(exampleConfJSON.Name())
+	ioutil.WriteFile(exampleConfJSON.Name(), []byte(
+		"{\"defaults\":{\"maxInFlight\":25},\"kafka\":{\"kbridge1\":{}}}"), 0644)
+
+	serverCmdConfig.Filename = exampleConfJSON.Name()
+	serverCmdConfig.Type = "json"
+	serverConfig, err := readServerConfig()
+	assert.NoError(err)
+	assert.Equal(25, serverConfig.KafkaBridges["kbridge1"].MaxInFlight)
+}
+
+func TestReadServerConfigBadJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfJSON, _ := ioutil.TempFile("", "testJSON")
+	defer syscall.Unlink(exampleConfJSON.Name())
+	ioutil.WriteFile(exampleConfJSON.Name(), []byte("!json"), 0644)
+
+	serverCmdConfig.Filename = exampleConfJSON.Name()
+	serverCmdConfig.Type = "json"
+	_, err := readServerConfig()
+	assert.Regexp("Unable to parse .* as JSON", err.Error())
+}
+
+func TestReadServerConfigLinkedWebhooksBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"kafka:\n"+
+			"  kbridge1:\n"+
+			"    kafka:\n"+
+			"      brokers:\n"+
+			"      - broker1\n"+
+			"      topicIn: requests\n"+
+			"      topicOut: replies\n"+
+			"      consumerGroup: kbridge1-cg\n"+
+			"      sasl:\n"+
+			"        username: user1\n"+
+			"    rpc:\n"+
+			"      url: http://ethereum1\n"+
+			"webhooks:\n"+
+			"  wbridge1:\n"+
+			"    kafkaBridge: kbridge1\n"+
+			"    http:\n"+
+			"      port: 1234\n"+
+			"  wbridge2:\n"+
+			"    kafkaBridge: kbridge1\n"+
+			"    kafka:\n"+
+			"      consumerGroup: wbridge2-cg\n"+
+			"      clientID: wbridge2\n"), 0644)
+
+	serverCmdConfig.Filename = exampleConfYAML.Name()
+	serverCmdConfig.Type = "yaml"
+	serverConfig, err := readServerConfig()
+	assert.NoError(err)
+
+	wb1 := serverConfig.WebhooksBridges["wbridge1"]
+	assert.Equal([]string{"broker1"}, wb1.Kafka.Brokers)
+	assert.Equal("user1", wb1.Kafka.SASL.Username)
+	assert.Equal("requests", wb1.Kafka.TopicOut)
+	assert.Equal("replies", wb1.Kafka.TopicIn)
+	assert.Equal("wbridge1", wb1.Kafka.ConsumerGroup)
+	assert.Equal("", wb1.Kafka.ClientID)
+
+	wb2 := serverConfig.WebhooksBridges["wbridge2"]
+	assert.Equal("requests", wb2.Kafka.TopicOut)
+	assert.Equal("wbridge2-cg", wb2.Kafka.ConsumerGroup)
+	assert.Equal("wbridge2", wb2.Kafka.ClientID)
+
+	// The Kafka bridge itself is unchanged
+	assert.Equal("requests", serverConfig.KafkaBridges["kbridge1"].Kafka.TopicIn)
+	assert.Equal("kbridge1-cg", serverConfig.KafkaBridges["kbridge1"].Kafka.ConsumerGroup)
+}
+
+func TestReadServerConfigLinkedWebhooksBridgeMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleConfYAML, _ := ioutil.TempFile("", "testYAML")
+	defer syscall.Unlink(exampleConfYAML.Name())
+	ioutil.WriteFile(exampleConfYAML.Name(), []byte(
+		"webhooks:\n"+
+			"  wbridge1:\n"+
+			"    kafkaBridge: kbridge1\n"), 0644)
+
+	serverCmdConfig.Filename = exampleConfYAML.Name()
+	serverCmdConfig.Type = "yaml"
+	_, err := readServerConfig()
+	assert.EqualError(err, "Webhooks bridge 'wbridge1' refers to Kafka bridge 'kbridge1', which is not defined")
+}
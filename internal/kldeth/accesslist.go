@@ -0,0 +1,83 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessTuple is an address and set of storage keys in an EIP-2930 access list
+type AccessTuple struct {
+	Address     common.Address `json:"address"`
+	StorageKeys []common.Hash  `json:"storageKeys"`
+}
+
+// AccessList is an EIP-2930 access list, as passed over JSON/RPC
+type AccessList []AccessTuple
+
+type createAccessListResult struct {
+	AccessList AccessList     `json:"accessList"`
+	GasUsed    hexutil.Uint64 `json:"gasUsed"`
+	Error      string         `json:"error,omitempty"`
+}
+
+// parseAccessList validates an access list supplied on a message,
+// checking each address and that every storage key is exactly 32 bytes
+func parseAccessList(msgAccessList []kldmessages.AccessTuple) (accessList AccessList, err error) {
+	if msgAccessList == nil {
+		return
+	}
+	accessList = make(AccessList, len(msgAccessList))
+	for i, msgTuple := range msgAccessList {
+		if accessList[i].Address, err = kldutils.StrToAddress(fmt.Sprintf("accessList[%d].address", i), msgTuple.Address); err != nil {
+			return
+		}
+		accessList[i].StorageKeys = make([]common.Hash, len(msgTuple.StorageKeys))
+		for j, msgKey := range msgTuple.StorageKeys {
+			keyBytes, decodeErr := hexutil.Decode(msgKey)
+			if decodeErr != nil || len(keyBytes) != common.HashLength {
+				err = fmt.Errorf("Supplied value for 'accessList[%d].storageKeys[%d]' is not a 32 byte hex string", i, j)
+				return
+			}
+			accessList[i].StorageKeys[j] = common.BytesToHash(keyBytes)
+		}
+	}
+	return
+}
+
+// createAccessList asks the node to generate an access list for the transaction,
+// by simulating it with eth_createAccessList
+func (tx *Txn) createAccessList(ctx context.Context, rpc RPCClient, args *sendTxArgs) (AccessList, error) {
+	start := time.Now()
+
+	var result createAccessListResult
+	if err := rpc.CallContext(ctx, &result, "eth_createAccessList", args, "pending"); err != nil {
+		return nil, fmt.Errorf("Failed to create access list: %s", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("Failed to create access list: %s", result.Error)
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_createAccessList(%s)=%d entries gasUsed=%d [%.2fs]", tx.From.Hex(), len(result.AccessList), result.GasUsed, callTime.Seconds())
+	return result.AccessList, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testStorageKey = "0x0000000000000000000000000000000000000000000000000000000000000007"
+
+func newAccessListTestMsg() *kldmessages.SendTransaction {
+	var msg kldmessages.SendTransaction
+	msg.Parameters = []interface{}{}
+	msg.MethodName = "testFunc"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Gas = "456"
+	return &msg
+}
+
+func TestSendTxnWithAccessList(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := newAccessListTestMsg()
+	msg.AccessList = []kldmessages.AccessTuple{
+		{
+			Address:     "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+			StorageKeys: []string{testStorageKey},
+		},
+	}
+	tx, err := NewSendTxn(msg)
+	assert.Nil(err)
+
+	rpc := testRPCClient{}
+	tx.Send(&rpc)
+	assert.Equal("eth_sendTransaction", rpc.capturedMethod)
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	accessList := jsonSent["accessList"].([]interface{})
+	assert.Equal(1, len(accessList))
+	tuple := accessList[0].(map[string]interface{})
+	assert.Equal("0x2b8c0ecc76d0759a8f50b2e14a6881367d805832", tuple["address"])
+	assert.Equal([]interface{}{testStorageKey}, tuple["storageKeys"])
+}
+
+func TestSendTxnWithoutAccessList(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := NewSendTxn(newAccessListTestMsg())
+	assert.Nil(err)
+
+	rpc := testRPCClient{}
+	tx.Send(&rpc)
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	_, exists := jsonSent["accessList"]
+	assert.False(exists)
+}
+
+func TestSendTxnAccessListBadAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := newAccessListTestMsg()
+	msg.AccessList = []kldmessages.AccessTuple{
+		{Address: "badness"},
+	}
+	_, err := NewSendTxn(msg)
+	assert.Regexp("Supplied value for 'accessList\\[0\\].address' is not a valid hex address", err.Error())
+}
+
+func TestSendTxnAccessListBadStorageKey(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := newAccessListTestMsg()
+	msg.AccessList = []kldmessages.AccessTuple{
+		{
+			Address:     "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+			StorageKeys: []string{testStorageKey, "0x07"},
+		},
+	}
+	_, err := NewSendTxn(msg)
+	assert.Regexp("'accessList\\[0\\].storageKeys\\[1\\]' is not a 32 byte hex string", err.Error())
+}
+
+func TestSendTxnCreateAccessListErr(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := newAccessListTestMsg()
+	msg.CreateAccessList = true
+	tx, err := NewSendTxn(msg)
+	assert.Nil(err)
+
+	rpc := testRPCClient{mockError: fmt.Errorf("pop")}
+	err = tx.Send(&rpc)
+	assert.Equal("eth_createAccessList", rpc.capturedMethod)
+	assert.Equal("pending", rpc.capturedArgs[1])
+	assert.Regexp("Failed to create access list: pop", err.Error())
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// errorSelector is the function selector of Error(string), used by solidity
+// to encode the reason passed to revert/require
+var errorSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+
+// RevertError is returned when a transaction reverts in simulation, with the
+// reason decoded from the revert data when possible
+type RevertError struct {
+	reason string
+	detail *kldmessages.RevertError
+}
+
+func (e *RevertError) Error() string {
+	return fmt.Sprintf("Transaction reverted in simulation: %s", e.reason)
+}
+
+// RevertDetail returns the revert data, and the custom error decoded from it if
+// it matched the ABI. Nil for standard revert strings, which are in the message
+func (e *RevertError) RevertDetail() *kldmessages.RevertError {
+	return e.detail
+}
+
+// Simulate runs the transaction with eth_call against the pending block,
+// without submitting it, and returns an error with the decoded revert
+// reason if it would fail
+func (tx *Txn) Simulate(rpc RPCClient) error {
+	_, err := tx.Call(rpc)
+	return err
+}
+
+// Call runs the transaction with eth_call against the pending block, and
+// returns its output, or an error with the decoded revert reason if it fails.
+// Any state overrides are passed to the node as the third parameter
+func (tx *Txn) Call(rpc RPCClient) (hexutil.Bytes, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var result hexutil.Bytes
+	var err error
+	if len(tx.StateOverrides) > 0 {
+		err = rpc.CallContext(ctx, &result, "eth_call", tx.txArgs(), "pending", tx.StateOverrides)
+	} else {
+		err = rpc.CallContext(ctx, &result, "eth_call", tx.txArgs(), "pending")
+	}
+	callTime := time.Now().Sub(start)
+	if err != nil {
+		if len(tx.StateOverrides) > 0 && isStateOverridesUnsupported(err) {
+			err = fmt.Errorf("The node does not support 'stateOverrides' for simulation: %s", err)
+		}
+		log.Warnf("eth_call(%s) failed: %s [%.2fs]", tx.From.Hex(), err, callTime.Seconds())
+		return nil, err
+	}
+	// The node returns the revert output as the result, rather than an error.
+	// Nodes that instead return an error with the output as its data cannot be
+	// decoded, as the data of an error is not available from the RPC client
+	if revertErr := tx.decodeRevert(result); revertErr != nil {
+		log.Warnf("eth_call(%s) reverted: %s [%.2fs]", tx.From.Hex(), revertErr.reason, callTime.Seconds())
+		return nil, revertErr
+	}
+	log.Debugf("eth_call(%s) succeeded [%.2fs]", tx.From.Hex(), callTime.Seconds())
+	return result, nil
+}
+
+// estimateGasArgs leaves out the gas limit of the transaction, which is
+// not set when estimating, so the node estimates up to its own cap
+type estimateGasArgs struct {
+	sendTxArgs
+	Gas *hexutil.Uint64 `json:"gas,omitempty"`
+}
+
+// EstimateGas asks the node for the gas limit the transaction needs, with eth_estimateGas
+func (tx *Txn) EstimateGas(rpc RPCClient) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var gas hexutil.Uint64
+	if err := rpc.CallContext(ctx, &gas, "eth_estimateGas", &estimateGasArgs{sendTxArgs: tx.txArgs()}); err != nil {
+		return 0, fmt.Errorf("Failed to estimate gas: %s", err)
+	}
+	return uint64(gas), nil
+}
+
+// decodeRevert decodes revert data that is a standard revert string, or one of
+// the custom errors in the ABI. Returns nil if the data is neither
+func (tx *Txn) decodeRevert(data []byte) *RevertError {
+	if reason, isRevert := decodeRevertReason(data); isRevert {
+		return &RevertError{reason: reason}
+	}
+	if len(data) < 4 {
+		return nil
+	}
+	for _, errorABI := range tx.ErrorABIs {
+		if !bytes.Equal(data[0:4], errorABI.Id()) {
+			continue
+		}
+		detail := &kldmessages.RevertError{Name: errorABI.Name, Data: hexutil.Encode(data)}
+		values, err := errorABI.Inputs.UnpackValues(data[4:])
+		if err != nil {
+			return &RevertError{reason: fmt.Sprintf("%s(<unable to decode parameters>)", errorABI.Name), detail: detail}
+		}
+		detail.Params = make(map[string]interface{}, len(values))
+		paramStrs := make([]string, len(values))
+		for i, value := range values {
+			name := errorABI.Inputs[i].Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			detail.Params[name] = formatABIValue(value)
+			paramStrs[i] = fmt.Sprintf("%s=%v", name, detail.Params[name])
+		}
+		return &RevertError{reason: fmt.Sprintf("%s(%s)", errorABI.Name, strings.Join(paramStrs, ", ")), detail: detail}
+	}
+	return nil
+}
+
+// genErrorABIs builds the definitions of the custom errors supplied with a message.
+// The selector of an error is calculated in the same way as a method
+func genErrorABIs(msgErrors []kldmessages.ABIError) (errorABIs []*abi.Method, err error) {
+	for i, msgError := range msgErrors {
+		errorABI := &abi.Method{Name: msgError.Name}
+		for j, msgInput := range msgError.Inputs {
+			var arg abi.Argument
+			arg.Name = msgInput.Name
+			if arg.Type, err = abi.NewType(msgInput.Type); err != nil {
+				return nil, fmt.Errorf("ABI error %d input %d: Unable to map %s to etherueum type: %s", i, j, msgInput.Name, err)
+			}
+			errorABI.Inputs = append(errorABI.Inputs, arg)
+		}
+		errorABIs = append(errorABIs, errorABI)
+	}
+	return
+}
+
+// decodeRevertReason extracts the string from Error(string) revert data
+func decodeRevertReason(data []byte) (string, bool) {
+	if len(data) < len(errorSelector) || !bytes.Equal(data[0:len(errorSelector)], errorSelector) {
+		return "", false
+	}
+	stringType, _ := abi.NewType("string")
+	var reason string
+	if err := (abi.Arguments{{Type: stringType}}).Unpack(&reason, data[len(errorSelector):]); err != nil {
+		return "<unable to decode revert reason>", true
+	}
+	return reason, true
+}
+
+// CallMethod calls a method of a contract that takes no parameters with eth_call
+// against the latest block, and returns the values it outputs
+func CallMethod(rpc RPCClient, to common.Address, method *abi.Method) ([]interface{}, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	args := map[string]interface{}{
+		"to":   to,
+		"data": hexutil.Bytes(method.Id()),
+	}
+	var result hexutil.Bytes
+	if err := rpc.CallContext(ctx, &result, "eth_call", args, "latest"); err != nil {
+		return nil, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_call(%s,%s)=%s [%.2fs]", to.Hex(), method.Sig(), result, callTime.Seconds())
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%s on %s returned no data", method.Sig(), to.Hex())
+	}
+	values, err := method.Outputs.UnpackValues(result)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode the output of %s on %s: %s", method.Sig(), to.Hex(), err)
+	}
+	return values, nil
+}
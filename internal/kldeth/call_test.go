@@ -0,0 +1,256 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+// Error(string) encoding of "not allowed"
+const testRevertData = "0x08c379a0" +
+	"0000000000000000000000000000000000000000000000000000000000000020" +
+	"000000000000000000000000000000000000000000000000000000000000000b" +
+	"6e6f7420616c6c6f776564000000000000000000000000000000000000000000"
+
+func newTestCallTxn() *Txn {
+	return &Txn{
+		From:  common.HexToAddress("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"),
+		EthTX: types.NewTransaction(0, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), nil, 0, nil, nil),
+	}
+}
+
+func TestSimulateOK(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testRPCClient{}
+	err := newTestCallTxn().Simulate(&r)
+
+	assert.Nil(err)
+	assert.Equal("eth_call", r.capturedMethod)
+	assert.Equal("pending", r.capturedArgs[1])
+}
+
+func TestSimulateRevertResult(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"` + testRevertData + `"`}
+	err := newTestCallTxn().Simulate(r)
+
+	assert.Equal("Transaction reverted in simulation: not allowed", err.Error())
+}
+
+func TestSimulateRevertErrorFromNode(t *testing.T) {
+	assert := assert.New(t)
+
+	// The RPC client does not expose the data of an error, so only the message is reported
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Set("Content-Type", "application/json")
+		res.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":3,"message":"execution reverted","data":"` + testRevertData + `"}}`))
+	}))
+	defer svr.Close()
+	r, _ := rpc.DialHTTP(svr.URL)
+	err := newTestCallTxn().Simulate(r)
+
+	assert.EqualError(err, "execution reverted")
+	_, isRevert := err.(*RevertError)
+	assert.False(isRevert)
+}
+
+func TestSimulateRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testRPCClient{mockError: fmt.Errorf("pop")}
+	err := newTestCallTxn().Simulate(&r)
+
+	assert.Equal("pop", err.Error())
+}
+
+func TestDecodeRevertReason(t *testing.T) {
+	assert := assert.New(t)
+
+	reason, isRevert := decodeRevertReason(common.FromHex(testRevertData))
+	assert.True(isRevert)
+	assert.Equal("not allowed", reason)
+
+	_, isRevert = decodeRevertReason(common.FromHex("0x0000"))
+	assert.False(isRevert)
+
+	reason, isRevert = decodeRevertReason(common.FromHex("0x08c379a0ffff"))
+	assert.True(isRevert)
+	assert.Equal("<unable to decode revert reason>", reason)
+}
+
+func newTestCustomErrorTxn() *Txn {
+	tx := newTestCallTxn()
+	tx.ErrorABIs, _ = genErrorABIs([]kldmessages.ABIError{
+		{
+			Name: "InsufficientBalance",
+			Inputs: []kldmessages.ABIParam{
+				{Name: "available", Type: "uint256"},
+				{Name: "required", Type: "uint256"},
+			},
+		},
+	})
+	return tx
+}
+
+func testCustomErrorData(tx *Txn) string {
+	data, _ := tx.ErrorABIs[0].Inputs.Pack(big.NewInt(10), big.NewInt(20))
+	return hexutil.Encode(append(tx.ErrorABIs[0].Id(), data...))
+}
+
+func TestSimulateRevertWithCustomError(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestCustomErrorTxn()
+	revertData := testCustomErrorData(tx)
+	assert.Equal(crypto.Keccak256([]byte("InsufficientBalance(uint256,uint256)"))[0:4], common.FromHex(revertData)[0:4])
+	r := &testTxnByHashRPC{result: `"` + revertData + `"`}
+	err := tx.Simulate(r)
+
+	assert.Equal("Transaction reverted in simulation: InsufficientBalance(available=10, required=20)", err.Error())
+	detail := err.(kldmessages.ErrorWithRevert).RevertDetail()
+	assert.Equal("InsufficientBalance", detail.Name)
+	assert.Equal(map[string]interface{}{"available": "10", "required": "20"}, detail.Params)
+	assert.Equal(revertData, detail.Data)
+}
+
+func TestSimulateRevertWithCustomErrorBadParams(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestCustomErrorTxn()
+	revertData := hexutil.Encode(tx.ErrorABIs[0].Id())
+	r := &testTxnByHashRPC{result: `"` + revertData + `"`}
+	err := tx.Simulate(r)
+
+	assert.Equal("Transaction reverted in simulation: InsufficientBalance(<unable to decode parameters>)", err.Error())
+	assert.Equal(revertData, err.(*RevertError).RevertDetail().Data)
+}
+
+func TestSimulateUnknownErrorIsResult(t *testing.T) {
+	assert := assert.New(t)
+
+	// Output that matches no error in the ABI is the return value of the call
+	r := &testTxnByHashRPC{result: `"0x12345678"`}
+	err := newTestCustomErrorTxn().Simulate(r)
+
+	assert.NoError(err)
+}
+
+func TestCallReturnsOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"0x12345678"`}
+	output, err := newTestCustomErrorTxn().Call(r)
+
+	assert.NoError(err)
+	assert.Equal("0x12345678", output.String())
+}
+
+func TestEstimateGas(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"0x5208"`}
+	gas, err := newTestCallTxn().EstimateGas(r)
+
+	assert.NoError(err)
+	assert.Equal(uint64(21000), gas)
+}
+
+func TestEstimateGasFails(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testRPCClient{mockError: fmt.Errorf("execution reverted")}
+	_, err := newTestCallTxn().EstimateGas(&r)
+
+	assert.EqualError(err, "Failed to estimate gas: execution reverted")
+	assert.Equal("eth_estimateGas", r.capturedMethod)
+	argsJSON, _ := json.Marshal(r.capturedArgs[0])
+	assert.NotContains(string(argsJSON), `"gas"`)
+}
+
+func TestSimulateRevertStringHasNoDetail(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"` + testRevertData + `"`}
+	err := newTestCustomErrorTxn().Simulate(r)
+
+	assert.Nil(err.(*RevertError).RevertDetail())
+}
+
+func TestGenErrorABIsBadType(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := newAccessListTestMsg()
+	msg.Errors = []kldmessages.ABIError{
+		{Name: "Bad", Inputs: []kldmessages.ABIParam{{Name: "x", Type: "badness"}}},
+	}
+	_, err := NewSendTxn(msg)
+	assert.Regexp("ABI error 0 input 0: Unable to map x to etherueum type", err.Error())
+}
+
+func newTestGasPriceMethod() *abi.Method {
+	uint256Type, _ := abi.NewType("uint256")
+	return &abi.Method{Name: "gasPrice", Const: true, Outputs: abi.Arguments{{Type: uint256Type}}}
+}
+
+func TestCallMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"0x000000000000000000000000000000000000000000000000000000003b9aca00"`}
+	values, err := CallMethod(r, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), newTestGasPriceMethod())
+	assert.NoError(err)
+	assert.Equal(big.NewInt(1000000000), values[0])
+}
+
+func TestCallMethodNoData(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"0x"`}
+	_, err := CallMethod(r, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), newTestGasPriceMethod())
+	assert.EqualError(err, "gasPrice() on 0x2b8c0ECc76d0759a8F50b2E14A6881367D805832 returned no data")
+}
+
+func TestCallMethodBadOutput(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTxnByHashRPC{result: `"0x1234"`}
+	_, err := CallMethod(r, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), newTestGasPriceMethod())
+	assert.Regexp("Failed to decode the output of gasPrice\\(\\) on 0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", err)
+}
+
+func TestCallMethodRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	r := testRPCClient{mockError: fmt.Errorf("pop")}
+	_, err := CallMethod(&r, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), newTestGasPriceMethod())
+	assert.EqualError(err, "pop")
+	assert.Equal("eth_call", r.capturedMethod)
+	assert.Equal("latest", r.capturedArgs[1])
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"fmt"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetChainID(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+
+	r := testRPCClient{}
+
+	chainID, err := GetChainID(&r)
+
+	assert.Equal(nil, err)
+	assert.Equal(int64(0), chainID.Int64())
+	assert.Equal("eth_chainId", r.capturedMethod)
+}
+
+func TestGetChainIDErr(t *testing.T) {
+	log.SetLevel(log.DebugLevel)
+	assert := assert.New(t)
+
+	r := testRPCClient{mockError: fmt.Errorf("pop")}
+
+	_, err := GetChainID(&r)
+
+	assert.Equal("pop", err.Error())
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// GetBalance returns the balance of an address in wei, at the given block
+func GetBalance(rpc RPCClient, addr *common.Address, blockNumber string) (*big.Int, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var balance hexutil.Big
+	if err := rpc.CallContext(ctx, &balance, "eth_getBalance", addr, blockNumber); err != nil {
+		return nil, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_getBalance(%x,%s)=%s [%.2fs]", addr, blockNumber, balance.ToInt().Text(10), callTime.Seconds())
+	return balance.ToInt(), nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// HasCode checks whether there is contract bytecode deployed at an address,
+// in the latest block
+func HasCode(rpc RPCClient, addr *common.Address) (bool, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var code hexutil.Bytes
+	if err := rpc.CallContext(ctx, &code, "eth_getCode", addr, "latest"); err != nil {
+		return false, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_getCode(%x)=%d bytes [%.2fs]", addr, len(code), callTime.Seconds())
+	return len(code) > 0, nil
+}
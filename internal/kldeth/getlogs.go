@@ -0,0 +1,248 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// logsLimitErrors are fragments of the errors nodes return when an eth_getLogs
+// query has too many results, or spans too many blocks, to be answered
+var logsLimitErrors = []string{
+	"query returned more than",
+	"limit exceeded",
+	"too many",
+	"range too large",
+	"range is too large",
+	"response size exceeded",
+}
+
+type getLogsArgs struct {
+	Address   common.Address  `json:"address"`
+	Topics    [][]common.Hash `json:"topics"`
+	FromBlock hexutil.Uint64  `json:"fromBlock"`
+	ToBlock   hexutil.Uint64  `json:"toBlock"`
+}
+
+// EventLog is a log emitted for an event, with its decoded parameters
+type EventLog struct {
+	types.Log
+	Data map[string]interface{}
+}
+
+// NewEventABI builds the ABI definition of an event from its web3 form
+func NewEventABI(msgEvent *kldmessages.ABIEvent) (event *abi.Event, err error) {
+	if msgEvent.Name == "" {
+		return nil, fmt.Errorf("Event missing - must provide an ABI in 'event'")
+	}
+	if msgEvent.Anonymous {
+		return nil, fmt.Errorf("Anonymous event '%s' cannot be queried by signature", msgEvent.Name)
+	}
+	event = &abi.Event{Name: msgEvent.Name}
+	for i, msgInput := range msgEvent.Inputs {
+		arg := abi.Argument{Name: msgInput.Name, Indexed: msgInput.Indexed}
+		if arg.Type, err = abi.NewType(msgInput.Type); err != nil {
+			return nil, fmt.Errorf("ABI event input %d: Unable to map %s to etherueum type: %s", i, msgInput.Name, err)
+		}
+		event.Inputs = append(event.Inputs, arg)
+	}
+	return event, nil
+}
+
+// ParseEventSignature builds the ABI definition of an event from its signature,
+// such as Failed(address indexed,string). The parameters are unnamed, so decode
+// to their index
+func ParseEventSignature(sig string) (*abi.Event, error) {
+	openParen := strings.Index(sig, "(")
+	if openParen <= 0 || !strings.HasSuffix(sig, ")") {
+		return nil, fmt.Errorf("Invalid event signature '%s' (must be of the form Name(type1,type2 indexed))", sig)
+	}
+	event := &abi.Event{Name: strings.TrimSpace(sig[0:openParen])}
+	params := strings.TrimSpace(sig[openParen+1 : len(sig)-1])
+	if params == "" {
+		return event, nil
+	}
+	for i, param := range strings.Split(params, ",") {
+		fields := strings.Fields(param)
+		if len(fields) == 0 || len(fields) > 2 || (len(fields) == 2 && fields[1] != "indexed") {
+			return nil, fmt.Errorf("Invalid parameter %d '%s' in event signature '%s'", i, strings.TrimSpace(param), sig)
+		}
+		arg := abi.Argument{Indexed: len(fields) == 2}
+		var err error
+		if arg.Type, err = abi.NewType(fields[0]); err != nil {
+			return nil, fmt.Errorf("Invalid parameter %d '%s' in event signature '%s': %s", i, fields[0], sig, err)
+		}
+		event.Inputs = append(event.Inputs, arg)
+	}
+	return event, nil
+}
+
+// GetEvents queries the logs emitted for an event by a contract over a range of blocks,
+// and decodes them. The range is split when the node reports the result is too large
+func GetEvents(rpc RPCClient, addr *common.Address, event *abi.Event, fromBlock, toBlock uint64) ([]*EventLog, error) {
+	logs, err := getLogsSplitting(rpc, &getLogsArgs{
+		Address:   *addr,
+		Topics:    [][]common.Hash{{event.Id()}},
+		FromBlock: hexutil.Uint64(fromBlock),
+		ToBlock:   hexutil.Uint64(toBlock),
+	})
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*EventLog, 0, len(logs))
+	for _, l := range logs {
+		data, err := decodeEventLog(event, &l)
+		if err != nil {
+			// Another event can share the signature, with different parameters indexed
+			log.Warnf("Skipping log %d in TX %s that does not match event '%s': %s", l.Index, l.TxHash.Hex(), event.Name, err)
+			continue
+		}
+		events = append(events, &EventLog{Log: l, Data: data})
+	}
+	return events, nil
+}
+
+func getLogsSplitting(rpc RPCClient, args *getLogsArgs) ([]types.Log, error) {
+	logs, err := getLogs(rpc, args)
+	if err == nil || args.FromBlock >= args.ToBlock || !isLogsLimitError(err) {
+		return logs, err
+	}
+	mid := args.FromBlock + (args.ToBlock-args.FromBlock)/2
+	log.Infof("eth_getLogs(%d-%d) result too large, splitting at block %d: %s", args.FromBlock, args.ToBlock, mid, err)
+	firstArgs, secondArgs := *args, *args
+	firstArgs.ToBlock = mid
+	secondArgs.FromBlock = mid + 1
+	if logs, err = getLogsSplitting(rpc, &firstArgs); err != nil {
+		return nil, err
+	}
+	secondLogs, err := getLogsSplitting(rpc, &secondArgs)
+	if err != nil {
+		return nil, err
+	}
+	return append(logs, secondLogs...), nil
+}
+
+func getLogs(rpc RPCClient, args *getLogsArgs) ([]types.Log, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var logs []types.Log
+	if err := rpc.CallContext(ctx, &logs, "eth_getLogs", args); err != nil {
+		return nil, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_getLogs(%x,%d-%d)=%d logs [%.2fs]", args.Address, args.FromBlock, args.ToBlock, len(logs), callTime.Seconds())
+	return logs, nil
+}
+
+func isLogsLimitError(err error) bool {
+	errStr := strings.ToLower(err.Error())
+	for _, limitErr := range logsLimitErrors {
+		if strings.Contains(errStr, limitErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeEventLog decodes the indexed parameters from the topics of a log, and
+// the others from its data. Indexed parameters of dynamic types are only
+// available as the hash of their value
+func decodeEventLog(event *abi.Event, l *types.Log) (map[string]interface{}, error) {
+	nonIndexedValues, err := event.Inputs.NonIndexed().UnpackValues(l.Data)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{}, len(event.Inputs))
+	topicIdx, dataIdx := 1, 0
+	for i, input := range event.Inputs {
+		name := input.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if !input.Indexed {
+			data[name] = formatABIValue(nonIndexedValues[dataIdx])
+			dataIdx++
+			continue
+		}
+		if topicIdx >= len(l.Topics) {
+			return nil, fmt.Errorf("Missing topic for indexed parameter '%s'", name)
+		}
+		topic := l.Topics[topicIdx]
+		topicIdx++
+		switch input.Type.T {
+		case abi.IntTy, abi.UintTy, abi.BoolTy, abi.AddressTy, abi.FixedBytesTy:
+			values, err := abi.Arguments{{Type: input.Type}}.UnpackValues(topic.Bytes())
+			if err != nil {
+				return nil, err
+			}
+			data[name] = formatABIValue(values[0])
+		default:
+			data[name] = topic.Hex()
+		}
+	}
+	if topicIdx != len(l.Topics) {
+		return nil, fmt.Errorf("Log has %d topics, but the event has %d indexed parameters", len(l.Topics), topicIdx-1)
+	}
+	return data, nil
+}
+
+// formatABIValue converts a decoded value to a JSON friendly form. Integers are
+// decimal strings, as they can be larger than a JSON number can safely hold,
+// and bytes are hex strings
+func formatABIValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *big.Int:
+		return v.Text(10)
+	case common.Address:
+		return v.Hex()
+	case []byte:
+		return hexutil.Encode(v)
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(rv.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(rv.Uint(), 10)
+	case reflect.Array, reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			return hexutil.Encode(b)
+		}
+		values := make([]interface{}, rv.Len())
+		for i := 0; i < rv.Len(); i++ {
+			values[i] = formatABIValue(rv.Index(i).Interface())
+		}
+		return values
+	}
+	return value
+}
@@ -0,0 +1,233 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+var testEventAddr = common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")
+
+// testLogsRPC returns a log for each block in the range queried, up to a
+// maximum range after which it returns a result limit error
+type testLogsRPC struct {
+	maxRange   uint64
+	mockError  error
+	event      *abi.Event
+	queries    [][2]uint64
+	extraTopic bool
+}
+
+func (r *testLogsRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method != "eth_getLogs" {
+		panic(fmt.Errorf("method unknown to test: %s", method))
+	}
+	if r.mockError != nil {
+		return r.mockError
+	}
+	filter := args[0].(*getLogsArgs)
+	r.queries = append(r.queries, [2]uint64{uint64(filter.FromBlock), uint64(filter.ToBlock)})
+	if r.maxRange > 0 && uint64(filter.ToBlock-filter.FromBlock) >= r.maxRange {
+		return fmt.Errorf("query returned more than 10000 results")
+	}
+	var logs []types.Log
+	for block := uint64(filter.FromBlock); block <= uint64(filter.ToBlock); block++ {
+		logs = append(logs, testTransferLog(r.event, block, r.extraTopic))
+	}
+	*(result.(*[]types.Log)) = logs
+	return nil
+}
+
+func testTransferEvent() *abi.Event {
+	event, _ := NewEventABI(&kldmessages.ABIEvent{
+		Name: "Transfer",
+		Inputs: []kldmessages.ABIEventParam{
+			{Name: "from", Type: "address", Indexed: true},
+			{Name: "ref", Type: "string", Indexed: true},
+			{Name: "value", Type: "uint256"},
+			{Name: "memo", Type: "bytes32"},
+		},
+	})
+	return event
+}
+
+func testTransferLog(event *abi.Event, block uint64, extraTopic bool) types.Log {
+	data, _ := event.Inputs.NonIndexed().Pack(big.NewInt(int64(block*100)), [32]byte{0x01, 0x02})
+	l := types.Log{
+		Address: testEventAddr,
+		Topics: []common.Hash{
+			event.Id(),
+			common.BytesToHash(common.HexToAddress("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c").Bytes()),
+			common.HexToHash("0x1234"),
+		},
+		Data:        data,
+		BlockNumber: block,
+		TxHash:      common.HexToHash("0xabcd"),
+	}
+	if extraTopic {
+		l.Topics = append(l.Topics, common.HexToHash("0x5678"))
+	}
+	return l
+}
+
+func TestNewEventABI(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	assert.Equal("Transfer", event.Name)
+	assert.Equal(4, len(event.Inputs))
+	assert.True(event.Inputs[0].Indexed)
+	assert.False(event.Inputs[2].Indexed)
+	assert.Equal(common.BytesToHash(crypto.Keccak256([]byte("Transfer(address,string,uint256,bytes32)"))), event.Id())
+}
+
+func TestNewEventABIMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewEventABI(&kldmessages.ABIEvent{})
+	assert.EqualError(err, "Event missing - must provide an ABI in 'event'")
+}
+
+func TestNewEventABIAnonymous(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewEventABI(&kldmessages.ABIEvent{Name: "Anon", Anonymous: true})
+	assert.EqualError(err, "Anonymous event 'Anon' cannot be queried by signature")
+}
+
+func TestNewEventABIBadType(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewEventABI(&kldmessages.ABIEvent{
+		Name:   "Bad",
+		Inputs: []kldmessages.ABIEventParam{{Name: "x", Type: "badness"}},
+	})
+	assert.Regexp("ABI event input 0: Unable to map x to etherueum type", err.Error())
+}
+
+func TestParseEventSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := ParseEventSignature("Failed(address indexed, uint256)")
+	assert.NoError(err)
+	assert.Equal("Failed", event.Name)
+	assert.Equal(2, len(event.Inputs))
+	assert.True(event.Inputs[0].Indexed)
+	assert.False(event.Inputs[1].Indexed)
+	assert.Equal(common.BytesToHash(crypto.Keccak256([]byte("Failed(address,uint256)"))), event.Id())
+
+	event, err = ParseEventSignature("Failed()")
+	assert.NoError(err)
+	assert.Empty(event.Inputs)
+}
+
+func TestParseEventSignatureInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ParseEventSignature("Failed")
+	assert.EqualError(err, "Invalid event signature 'Failed' (must be of the form Name(type1,type2 indexed))")
+	_, err = ParseEventSignature("(uint256)")
+	assert.Regexp("Invalid event signature", err.Error())
+	_, err = ParseEventSignature("Failed(uint256 notindexed)")
+	assert.EqualError(err, "Invalid parameter 0 'uint256 notindexed' in event signature 'Failed(uint256 notindexed)'")
+	_, err = ParseEventSignature("Failed(uint256,)")
+	assert.EqualError(err, "Invalid parameter 1 '' in event signature 'Failed(uint256,)'")
+	_, err = ParseEventSignature("Failed(badness)")
+	assert.Regexp("Invalid parameter 0 'badness' in event signature 'Failed\\(badness\\)'", err.Error())
+}
+
+func TestGetEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	r := &testLogsRPC{event: event}
+	events, err := GetEvents(r, &testEventAddr, event, 10, 11)
+	assert.NoError(err)
+
+	assert.Equal(2, len(events))
+	assert.Equal(uint64(10), events[0].BlockNumber)
+	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", events[0].Data["from"])
+	assert.Equal(common.HexToHash("0x1234").Hex(), events[0].Data["ref"])
+	assert.Equal("1000", events[0].Data["value"])
+	assert.Equal("0x0102000000000000000000000000000000000000000000000000000000000000", events[0].Data["memo"])
+	assert.Equal("1100", events[1].Data["value"])
+
+	jsonBytes, _ := json.Marshal(r.queries)
+	assert.Equal("[[10,11]]", string(jsonBytes))
+}
+
+func TestGetEventsSplitsRange(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	r := &testLogsRPC{event: event, maxRange: 2}
+	events, err := GetEvents(r, &testEventAddr, event, 0, 7)
+	assert.NoError(err)
+
+	assert.Equal(8, len(events))
+	for i, e := range events {
+		assert.Equal(uint64(i), e.BlockNumber)
+	}
+	assert.Equal([][2]uint64{{0, 7}, {0, 3}, {0, 1}, {2, 3}, {4, 7}, {4, 5}, {6, 7}}, r.queries)
+}
+
+func TestGetEventsErr(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	r := &testLogsRPC{event: event, mockError: fmt.Errorf("pop")}
+	_, err := GetEvents(r, &testEventAddr, event, 0, 7)
+	assert.EqualError(err, "pop")
+}
+
+func TestGetEventsSingleBlockLimitErr(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	r := &testLogsRPC{event: event, mockError: fmt.Errorf("query returned more than 10000 results")}
+	_, err := GetEvents(r, &testEventAddr, event, 5, 5)
+	assert.EqualError(err, "query returned more than 10000 results")
+}
+
+func TestGetEventsSkipsMismatchedTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	event := testTransferEvent()
+	r := &testLogsRPC{event: event, extraTopic: true}
+	events, err := GetEvents(r, &testEventAddr, event, 1, 1)
+	assert.NoError(err)
+	assert.Empty(events)
+}
+
+func TestFormatABIValue(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("12", formatABIValue(uint8(12)))
+	assert.Equal("-12", formatABIValue(int64(-12)))
+	assert.Equal(true, formatABIValue(true))
+	assert.Equal("0x0102", formatABIValue([]byte{0x01, 0x02}))
+	assert.Equal([]interface{}{"1", "2"}, formatABIValue([]*big.Int{big.NewInt(1), big.NewInt(2)}))
+}
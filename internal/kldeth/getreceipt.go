@@ -16,8 +16,13 @@ package kldeth
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -36,3 +41,61 @@ func (tx *Txn) GetTXReceipt(rpc RPCClient) (bool, error) {
 	log.Debugf("eth_getTransactionReceipt(%x,latest)=%t [%.2fs]", tx.Hash, isMined, callTime.Seconds())
 	return isMined, nil
 }
+
+// GetTXReceipts gets the receipts for a list of transactions in a single batch
+// request, if the client supports batches, or otherwise one at a time.
+// Returns whether each transaction is mined, and any error getting its receipt.
+// A receipt that is not yet available does not affect the others
+func GetTXReceipts(rpcClient RPCClient, txns []*Txn) ([]bool, []error) {
+	mined := make([]bool, len(txns))
+	errs := make([]error, len(txns))
+	batchRPC, ok := rpcClient.(BatchRPCClient)
+	if !ok {
+		for i, tx := range txns {
+			mined[i], errs[i] = tx.GetTXReceipt(rpcClient)
+		}
+		return mined, errs
+	}
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	batch := make([]rpc.BatchElem, len(txns))
+	for i, tx := range txns {
+		batch[i] = rpc.BatchElem{
+			Method: "eth_getTransactionReceipt",
+			Args:   []interface{}{tx.Hash},
+			Result: &tx.Receipt,
+		}
+	}
+	if err := batchRPC.BatchCallContext(ctx, batch); err != nil {
+		for i := range txns {
+			errs[i] = err
+		}
+		return mined, errs
+	}
+	for i, tx := range txns {
+		if errs[i] = batch[i].Error; errs[i] == nil {
+			mined[i] = tx.Receipt.BlockNumber != nil && tx.Receipt.BlockNumber.ToInt().Uint64() > 0
+		}
+	}
+	log.Debugf("eth_getTransactionReceipt batch of %d [%.2fs]", len(txns), time.Now().Sub(start).Seconds())
+	return mined, errs
+}
+
+// ReceiptEvent finds the first log for an event emitted by a contract in the
+// receipt, and decodes it. Returns a nil log if the contract did not emit the event
+func (tx *Txn) ReceiptEvent(addr common.Address, event *abi.Event) (*TxnLog, map[string]interface{}, error) {
+	for _, l := range tx.Receipt.Logs {
+		if l.Address != addr || len(l.Topics) == 0 || l.Topics[0] != event.Id() {
+			continue
+		}
+		data, err := decodeEventLog(event, &types.Log{Topics: l.Topics, Data: l.Data})
+		if err != nil {
+			return l, nil, fmt.Errorf("Failed to decode event '%s': %s", event.Name, err)
+		}
+		return l, data, nil
+	}
+	return nil, nil, nil
+}
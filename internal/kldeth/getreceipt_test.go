@@ -15,9 +15,15 @@
 package kldeth
 
 import (
+	"context"
+	"fmt"
+	"math/big"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -58,3 +64,99 @@ func TestGetTXReceiptNotMined(t *testing.T) {
 	assert.Equal("eth_getTransactionReceipt", r.capturedMethod)
 	assert.Equal(false, isMined)
 }
+
+func TestReceiptEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	event, err := ParseEventSignature("Failed(address indexed,uint256)")
+	assert.NoError(err)
+	contract := common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")
+	account := common.HexToAddress("0xBa25be62a5C55d4ad1d5520268806A8730A4DE5E")
+	tx := Txn{}
+	tx.Receipt.Logs = []*TxnLog{
+		{Address: account, Topics: []common.Hash{event.Id()}},
+		{Address: contract, Topics: []common.Hash{common.HexToHash("0x1234")}},
+		{Address: contract, Topics: []common.Hash{event.Id(), account.Hash()}, Data: common.LeftPadBytes([]byte{42}, 32)},
+	}
+
+	l, data, err := tx.ReceiptEvent(contract, event)
+	assert.NoError(err)
+	assert.Equal(tx.Receipt.Logs[2], l)
+	assert.Equal(map[string]interface{}{"0": account.Hex(), "1": "42"}, data)
+
+	l, _, err = tx.ReceiptEvent(account, &abi.Event{Name: "Other"})
+	assert.NoError(err)
+	assert.Nil(l)
+
+	tx.Receipt.Logs[2].Data = []byte{}
+	l, _, err = tx.ReceiptEvent(contract, event)
+	assert.NotNil(l)
+	assert.Regexp("Failed to decode event 'Failed'", err.Error())
+}
+
+// testBatchRPCClient returns a receipt for the hashes in its map, an error for
+// the hash in errHash, and no result for any other hash
+type testBatchRPCClient struct {
+	testRPCClient
+	blockNumbers map[string]int64
+	errHash      string
+	batchErr     error
+	batches      [][]rpc.BatchElem
+}
+
+func (r *testBatchRPCClient) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	r.batches = append(r.batches, b)
+	if r.batchErr != nil {
+		return r.batchErr
+	}
+	for i := range b {
+		hash := b[i].Args[0].(string)
+		if hash == r.errHash {
+			b[i].Error = fmt.Errorf("pop")
+		} else if blockNumber, ok := r.blockNumbers[hash]; ok {
+			bn := hexutil.Big(*big.NewInt(blockNumber))
+			b[i].Result.(*TxnReceipt).BlockNumber = &bn
+		}
+	}
+	return nil
+}
+
+func TestGetTXReceiptsBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testBatchRPCClient{
+		blockNumbers: map[string]int64{"0x1": 10},
+		errHash:      "0x3",
+	}
+	txns := []*Txn{{Hash: "0x1"}, {Hash: "0x2"}, {Hash: "0x3"}}
+	mined, errs := GetTXReceipts(r, txns)
+	assert.Equal([]bool{true, false, false}, mined)
+	assert.NoError(errs[0])
+	assert.NoError(errs[1])
+	assert.EqualError(errs[2], "pop")
+	assert.Equal(1, len(r.batches))
+	assert.Equal(3, len(r.batches[0]))
+	assert.Equal("eth_getTransactionReceipt", r.batches[0][0].Method)
+	assert.Equal(int64(10), txns[0].Receipt.BlockNumber.ToInt().Int64())
+	assert.Empty(r.capturedMethod)
+}
+
+func TestGetTXReceiptsBatchErr(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testBatchRPCClient{batchErr: fmt.Errorf("pop")}
+	mined, errs := GetTXReceipts(r, []*Txn{{Hash: "0x1"}, {Hash: "0x2"}})
+	assert.Equal([]bool{false, false}, mined)
+	assert.EqualError(errs[0], "pop")
+	assert.EqualError(errs[1], "pop")
+}
+
+func TestGetTXReceiptsNoBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testRPCClient{}
+	mined, errs := GetTXReceipts(r, []*Txn{{Hash: "0x1"}})
+	assert.Equal([]bool{false}, mined)
+	assert.NoError(errs[0])
+	assert.Equal("eth_getTransactionReceipt", r.capturedMethod)
+}
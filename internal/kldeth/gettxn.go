@@ -0,0 +1,136 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeTxn is the transaction returned by eth_getTransactionByHash. The block
+// fields are nil while the transaction is pending, and To is nil for a deployment
+type NodeTxn struct {
+	BlockHash        *common.Hash    `json:"blockHash"`
+	BlockNumber      *hexutil.Big    `json:"blockNumber"`
+	TransactionIndex *hexutil.Uint64 `json:"transactionIndex"`
+	From             common.Address  `json:"from"`
+	To               *common.Address `json:"to"`
+	Nonce            hexutil.Uint64  `json:"nonce"`
+	Value            *hexutil.Big    `json:"value"`
+	Gas              hexutil.Uint64  `json:"gas"`
+	GasPrice         *hexutil.Big    `json:"gasPrice"`
+	Input            hexutil.Bytes   `json:"input"`
+}
+
+// IsKnownToNode checks whether the node still has the transaction, either
+// pending in its pool or mined. Transactions that have been replaced, or
+// evicted from the pool, are no longer returned by eth_getTransactionByHash
+func (tx *Txn) IsKnownToNode(rpc RPCClient) (bool, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var result json.RawMessage
+	if err := rpc.CallContext(ctx, &result, "eth_getTransactionByHash", tx.Hash); err != nil {
+		return false, err
+	}
+	callTime := time.Now().Sub(start)
+	isKnown := len(result) > 0 && string(result) != "null"
+	log.Debugf("eth_getTransactionByHash(%s)=%t [%.2fs]", tx.Hash, isKnown, callTime.Seconds())
+	return isKnown, nil
+}
+
+// GetFromNode gets the transaction from the node, including the nonce the node
+// assigned to it. Returns nil if the node does not have the transaction
+func (tx *Txn) GetFromNode(rpc RPCClient) (*NodeTxn, error) {
+	return GetTransactionByHash(rpc, tx.Hash)
+}
+
+// GetTransactionByHash gets a transaction from the node, pending or mined.
+// Returns nil if the node does not have the transaction
+func GetTransactionByHash(rpc RPCClient, hash string) (*NodeTxn, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var result *NodeTxn
+	if err := rpc.CallContext(ctx, &result, "eth_getTransactionByHash", hash); err != nil {
+		return nil, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("eth_getTransactionByHash(%s)=%t [%.2fs]", hash, result != nil, callTime.Seconds())
+	return result, nil
+}
+
+// NewMethodABIs builds the definitions of the functions in a web3 ABI, to decode
+// transaction input. Other entries, such as events and constructors, are skipped
+func NewMethodABIs(msgMethods []kldmessages.ABIMethod) ([]*abi.Method, error) {
+	methods := make([]*abi.Method, 0, len(msgMethods))
+	for i := range msgMethods {
+		if msgMethods[i].Type != "" && msgMethods[i].Type != "function" {
+			continue
+		}
+		method, err := genMethodABI(&msgMethods[i])
+		if err != nil {
+			return nil, fmt.Errorf("ABI entry %d: %s", i, err)
+		}
+		methods = append(methods, method)
+	}
+	return methods, nil
+}
+
+// DecodeTxnInput decodes the input of a transaction as a call to the method with
+// a matching selector. Returns nil if no method matches, so only the raw input is known
+func DecodeTxnInput(methods []*abi.Method, input []byte) *kldmessages.DecodedInput {
+	if len(input) < 4 {
+		return nil
+	}
+	for _, method := range methods {
+		if !bytes.Equal(input[0:4], method.Id()) {
+			continue
+		}
+		values, err := method.Inputs.UnpackValues(input[4:])
+		if err != nil {
+			log.Warnf("Transaction input matches the selector of %s, but cannot be decoded: %s", method.Sig(), err)
+			continue
+		}
+		decoded := &kldmessages.DecodedInput{
+			Method:    method.Name,
+			Signature: method.Sig(),
+			Params:    make(map[string]interface{}, len(values)),
+		}
+		for i, value := range values {
+			name := method.Inputs[i].Name
+			if name == "" {
+				name = strconv.Itoa(i)
+			}
+			decoded.Params[name] = formatABIValue(value)
+		}
+		return decoded
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTxnByHashRPC struct {
+	result string
+}
+
+func (r *testTxnByHashRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	return json.Unmarshal([]byte(r.result), result)
+}
+
+func TestIsKnownToNode(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := Txn{Hash: "0x3abf6cecd6fcf761b73ba24c099686273d2be6d4aac5d6eccbf49d49ba397b09"}
+	isKnown, err := tx.IsKnownToNode(&testTxnByHashRPC{result: `{"hash":"0x3abf6cecd6fcf761b73ba24c099686273d2be6d4aac5d6eccbf49d49ba397b09"}`})
+	assert.Nil(err)
+	assert.True(isKnown)
+
+	isKnown, err = tx.IsKnownToNode(&testTxnByHashRPC{result: "null"})
+	assert.Nil(err)
+	assert.False(isKnown)
+}
+
+func TestIsKnownToNodeErr(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := Txn{}
+	r := testRPCClient{mockError: fmt.Errorf("pop")}
+	_, err := tx.IsKnownToNode(&r)
+	assert.EqualError(err, "pop")
+	assert.Equal("eth_getTransactionByHash", r.capturedMethod)
+}
+
+func TestGetFromNode(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := Txn{Hash: "0x3abf6cecd6fcf761b73ba24c099686273d2be6d4aac5d6eccbf49d49ba397b09"}
+	nodeTX, err := tx.GetFromNode(&testTxnByHashRPC{result: `{"nonce":"0x7b","blockNumber":null}`})
+	assert.Nil(err)
+	assert.Equal(uint64(123), uint64(nodeTX.Nonce))
+	assert.Nil(nodeTX.BlockNumber)
+
+	nodeTX, err = tx.GetFromNode(&testTxnByHashRPC{result: `{"nonce":"0x7b","blockNumber":"0x10"}`})
+	assert.Nil(err)
+	assert.Equal(int64(16), nodeTX.BlockNumber.ToInt().Int64())
+
+	nodeTX, err = tx.GetFromNode(&testTxnByHashRPC{result: "null"})
+	assert.Nil(err)
+	assert.Nil(nodeTX)
+}
+
+func TestGetFromNodeErr(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := Txn{}
+	r := testRPCClient{mockError: fmt.Errorf("pop")}
+	_, err := tx.GetFromNode(&r)
+	assert.EqualError(err, "pop")
+	assert.Equal("eth_getTransactionByHash", r.capturedMethod)
+}
+
+func TestGetTransactionByHash(t *testing.T) {
+	assert := assert.New(t)
+
+	nodeTX, err := GetTransactionByHash(&testTxnByHashRPC{result: `{` +
+		`"blockHash":"0x1fc3c9bd9cd8d5fa2bd9fbcbb7ad2fdb4cd82edbea1d8ce1ecb56a9ae8e2e0f3","blockNumber":"0x10",` +
+		`"transactionIndex":"0x1","from":"0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1","to":null,` +
+		`"nonce":"0x7b","value":"0x64","gas":"0x5208","gasPrice":"0x3e8","input":"0x6080"}`},
+		"0x3abf6cecd6fcf761b73ba24c099686273d2be6d4aac5d6eccbf49d49ba397b09")
+	assert.Nil(err)
+	assert.Equal("0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", nodeTX.From.Hex())
+	assert.Nil(nodeTX.To)
+	assert.Equal(uint64(1), uint64(*nodeTX.TransactionIndex))
+	assert.Equal(int64(100), nodeTX.Value.ToInt().Int64())
+	assert.Equal([]byte{0x60, 0x80}, []byte(nodeTX.Input))
+}
+
+func TestNewMethodABIs(t *testing.T) {
+	assert := assert.New(t)
+
+	methods, err := NewMethodABIs([]kldmessages.ABIMethod{
+		{Type: "constructor", Inputs: []kldmessages.ABIParam{{Name: "x", Type: "badness"}}},
+		{Name: "get"},
+		{Type: "function", Name: "set", Inputs: []kldmessages.ABIParam{{Name: "value", Type: "uint256"}}},
+	})
+	assert.Nil(err)
+	assert.Equal(2, len(methods))
+	assert.Equal("set(uint256)", methods[1].Sig())
+
+	_, err = NewMethodABIs([]kldmessages.ABIMethod{
+		{Name: "get"},
+		{Name: "set", Inputs: []kldmessages.ABIParam{{Name: "value", Type: "badness"}}},
+	})
+	assert.Regexp("ABI entry 1: ABI input 0: Unable to map value to etherueum type", err.Error())
+}
+
+func TestDecodeTxnInput(t *testing.T) {
+	assert := assert.New(t)
+
+	methods, _ := NewMethodABIs([]kldmessages.ABIMethod{
+		{Name: "get"},
+		{Name: "transfer", Inputs: []kldmessages.ABIParam{{Name: "to", Type: "address"}, {Type: "uint256"}}},
+	})
+	to := common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")
+	input := crypto.Keccak256([]byte("transfer(address,uint256)"))[0:4]
+	input = append(input, common.LeftPadBytes(to.Bytes(), 32)...)
+	input = append(input, common.LeftPadBytes([]byte{0x30, 0x39}, 32)...)
+
+	decoded := DecodeTxnInput(methods, input)
+	assert.Equal("transfer", decoded.Method)
+	assert.Equal("transfer(address,uint256)", decoded.Signature)
+	assert.Equal(to.Hex(), decoded.Params["to"])
+	assert.Equal("12345", decoded.Params["1"])
+
+	// Matching selector, but truncated parameters
+	assert.Nil(DecodeTxnInput(methods, input[0:36]))
+	// No matching selector
+	assert.Nil(DecodeTxnInput(methods, []byte{0x01, 0x02, 0x03, 0x04}))
+	// No selector
+	assert.Nil(DecodeTxnInput(methods, []byte{}))
+}
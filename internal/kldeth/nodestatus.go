@@ -0,0 +1,61 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// NodeStatus is a summary of the state of the node, for monitoring
+type NodeStatus struct {
+	BlockNumber uint64 `json:"blockNumber"`
+	PeerCount   uint64 `json:"peerCount"`
+	Syncing     bool   `json:"syncing"`
+}
+
+// GetNodeStatus gets the block height, peer count and sync state of the node
+func GetNodeStatus(rpc RPCClient) (*NodeStatus, error) {
+	blockNumber, err := GetBlockNumber(rpc)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var peerCount hexutil.Uint64
+	if err := rpc.CallContext(ctx, &peerCount, "net_peerCount"); err != nil {
+		return nil, err
+	}
+	// eth_syncing returns false, or an object describing the sync progress
+	var syncing json.RawMessage
+	if err := rpc.CallContext(ctx, &syncing, "eth_syncing"); err != nil {
+		return nil, err
+	}
+	status := &NodeStatus{
+		BlockNumber: blockNumber,
+		PeerCount:   uint64(peerCount),
+		Syncing:     len(syncing) > 0 && string(syncing) != "false",
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("net_peerCount()=%d eth_syncing()=%t [%.2fs]", status.PeerCount, status.Syncing, callTime.Seconds())
+	return status, nil
+}
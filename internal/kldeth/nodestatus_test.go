@@ -0,0 +1,70 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testNodeStatusRPC struct {
+	results   map[string]string
+	errMethod string
+}
+
+func (r *testNodeStatusRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	if method == r.errMethod {
+		return fmt.Errorf("pop")
+	}
+	return json.Unmarshal([]byte(r.results[method]), result)
+}
+
+func TestGetNodeStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testNodeStatusRPC{results: map[string]string{
+		"eth_blockNumber": `"0x3039"`,
+		"net_peerCount":   `"0x5"`,
+		"eth_syncing":     `false`,
+	}}
+	status, err := GetNodeStatus(r)
+	assert.NoError(err)
+	assert.Equal(&NodeStatus{BlockNumber: 12345, PeerCount: 5, Syncing: false}, status)
+
+	r.results["eth_syncing"] = `{"currentBlock":"0x3039","highestBlock":"0x4000"}`
+	status, err = GetNodeStatus(r)
+	assert.NoError(err)
+	assert.True(status.Syncing)
+}
+
+func TestGetNodeStatusErrs(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, method := range []string{"eth_blockNumber", "net_peerCount", "eth_syncing"} {
+		r := &testNodeStatusRPC{
+			results: map[string]string{
+				"eth_blockNumber": `"0x1"`,
+				"net_peerCount":   `"0x1"`,
+			},
+			errMethod: method,
+		}
+		_, err := GetNodeStatus(r)
+		assert.EqualError(err, "pop", method)
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// NewRawTxn decodes a transaction that has been signed by the client, recovering
+// the sender from the signature. The bridge cannot change anything about it,
+// so we just submit the supplied bytes and track it to completion
+func NewRawTxn(msg *kldmessages.SendRawTransaction) (tx *Txn, err error) {
+	raw, err := hexutil.Decode(msg.RawTransaction)
+	if err != nil {
+		return nil, fmt.Errorf("Supplied value for 'rawTransaction' is not valid 0x prefixed hex: %s", err)
+	}
+	var ethTX types.Transaction
+	if err = rlp.DecodeBytes(raw, &ethTX); err != nil {
+		return nil, fmt.Errorf("Supplied value for 'rawTransaction' is not an RLP encoded transaction: %s", err)
+	}
+	var signer types.Signer = types.HomesteadSigner{}
+	if ethTX.Protected() {
+		signer = types.NewEIP155Signer(ethTX.ChainId())
+	}
+	tx = &Txn{
+		EthTX: &ethTX,
+		RawTX: raw,
+	}
+	if tx.From, err = types.Sender(signer, &ethTX); err != nil {
+		return nil, fmt.Errorf("Unable to recover the sender of 'rawTransaction': %s", err)
+	}
+	log.Debugf("TX:%s From='%s' Nonce=%d (pre-signed)", ethTX.Hash().Hex(), tx.From.Hex(), ethTX.Nonce())
+	return tx, nil
+}
+
+// sendRawTxn submits a transaction that was signed by the client
+func (tx *Txn) sendRawTxn(ctx context.Context, rpc RPCClient) (string, error) {
+	var txHash string
+	err := rpc.CallContext(ctx, &txHash, "eth_sendRawTransaction", hexutil.Encode(tx.RawTX))
+	return txHash, err
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+// Signed with EIP-155 for chain ID 12345, with nonce 5
+const testRawTX = "0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1"
+
+func TestSendRawTxn(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, err := NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: testRawTX})
+	assert.Nil(err)
+	assert.Equal("0x2c7536E3605D9C16a7a3D7b1898e529396a65c23", tx.From.Hex())
+	assert.Equal(uint64(5), tx.EthTX.Nonce())
+	assert.Equal("0x3abf6cecd6fcf761b73ba24c099686273d2be6d4aac5d6eccbf49d49ba397b09", tx.EthTX.Hash().Hex())
+
+	rpc := testRPCClient{}
+	err = tx.Send(&rpc)
+	assert.Nil(err)
+	assert.Equal("eth_sendRawTransaction", rpc.capturedMethod)
+	assert.Equal([]interface{}{testRawTX}, rpc.capturedArgs)
+}
+
+func TestSendRawTxnBadHex(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: "f861"})
+	assert.Regexp("Supplied value for 'rawTransaction' is not valid 0x prefixed hex", err.Error())
+}
+
+func TestSendRawTxnBadRLP(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: "0x1234"})
+	assert.Regexp("Supplied value for 'rawTransaction' is not an RLP encoded transaction", err.Error())
+}
+
+func TestSendRawTxnBadSignature(t *testing.T) {
+	assert := assert.New(t)
+
+	// Transaction with a zero signature
+	_, err := NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: "0xdf0580825208942b8c0ecc76d0759a8f50b2e14a6881367d80583280801b8080"})
+	assert.Regexp("Unable to recover the sender of 'rawTransaction'", err.Error())
+}
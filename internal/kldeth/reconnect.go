@@ -0,0 +1,196 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ClosableRPCClient is a connection to a node, that is closed when it is replaced
+type ClosableRPCClient interface {
+	RPCClient
+	Close()
+}
+
+// reconnectingRPC wraps the connection to a node, replacing it with a new one
+// when calls fail to reach the node. Calls wait while the node is reconnected,
+// up to the maximum wait, then are retried on the new connection
+type reconnectingRPC struct {
+	desc         string
+	dial         func() (ClosableRPCClient, error)
+	maxWait      time.Duration
+	lock         sync.Mutex
+	client       ClosableRPCClient
+	reconnecting chan struct{}
+}
+
+// NewReconnectingRPC wraps a connection to a node, redialing it with backoff
+// when it fails. Calls that could not have reached the node are retried once
+// it is reconnected, for up to maxWait. Transactions are only resent if the
+// node refused the connection, so they cannot be submitted twice
+func NewReconnectingRPC(desc string, client ClosableRPCClient, dial func() (ClosableRPCClient, error), maxWait time.Duration) BatchRPCClient {
+	return &reconnectingRPC{
+		desc:    desc,
+		dial:    dial,
+		maxWait: maxWait,
+		client:  client,
+	}
+}
+
+// CallContext makes the call on the current connection, waiting for the node
+// to be reconnected and retrying the call if it fails to reach the node
+func (r *reconnectingRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	deadline := time.Now().Add(r.maxWait)
+	resend := method != "eth_sendTransaction" && method != "eth_sendRawTransaction"
+	for {
+		client, err := r.connected(ctx, deadline)
+		if err != nil {
+			return err
+		}
+		err = client.CallContext(ctx, result, method, args...)
+		if !r.retry(ctx, client, err, deadline, resend) {
+			return err
+		}
+	}
+}
+
+// BatchCallContext sends the batch on the current connection, in the same way
+// as CallContext. Batches are only used for queries, so are always retried
+func (r *reconnectingRPC) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	deadline := time.Now().Add(r.maxWait)
+	for {
+		client, err := r.connected(ctx, deadline)
+		if err != nil {
+			return err
+		}
+		batchRPC, ok := client.(BatchRPCClient)
+		if !ok {
+			for idx := range b {
+				b[idx].Error = r.CallContext(ctx, b[idx].Result, b[idx].Method, b[idx].Args...)
+			}
+			return nil
+		}
+		err = batchRPC.BatchCallContext(ctx, b)
+		if !r.retry(ctx, client, err, deadline, true) {
+			return err
+		}
+	}
+}
+
+// connected returns the current connection, waiting if the node is being reconnected
+func (r *reconnectingRPC) connected(ctx context.Context, deadline time.Time) (ClosableRPCClient, error) {
+	r.lock.Lock()
+	client, reconnecting := r.client, r.reconnecting
+	r.lock.Unlock()
+	if reconnecting == nil {
+		return client, nil
+	}
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+	select {
+	case <-reconnecting:
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		return r.client, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%s not reconnected after %s", r.desc, r.maxWait)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%s not reconnected: %s", r.desc, ctx.Err())
+	}
+}
+
+// retry checks whether a call failed to reach the node, starting a reconnection
+// if so, and whether the call should be retried once it is reconnected
+func (r *reconnectingRPC) retry(ctx context.Context, client ClosableRPCClient, err error, deadline time.Time, resend bool) bool {
+	// A call that timed out or was cancelled says nothing about the connection
+	if err == nil || ctx.Err() != nil || !isConnectionError(err) {
+		return false
+	}
+	r.disconnected(client, err)
+	if time.Now().After(deadline) {
+		return false
+	}
+	return resend || isDialError(err)
+}
+
+// disconnected starts reconnecting the node, unless the connection that failed
+// has already been replaced, or is already being replaced
+func (r *reconnectingRPC) disconnected(client ClosableRPCClient, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if client != r.client || r.reconnecting != nil {
+		return
+	}
+	log.Warnf("%s disconnected: %s", r.desc, err)
+	r.reconnecting = make(chan struct{})
+	go r.reconnect()
+}
+
+// reconnect dials the node with backoff until it answers a request, as HTTP
+// connections are lazy, then replaces the connection that failed
+func (r *reconnectingRPC) reconnect() {
+	delay := kldutils.RetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		client, err := r.dial()
+		if err == nil {
+			if _, err = GetBlockNumber(client); err == nil {
+				log.Infof("%s reconnected after %d attempts", r.desc, attempt)
+				r.lock.Lock()
+				r.client.Close()
+				r.client = client
+				close(r.reconnecting)
+				r.reconnecting = nil
+				r.lock.Unlock()
+				return
+			}
+			client.Close()
+		}
+		log.Infof("%s not reconnected (attempt %d): %s - retrying in %.1fs", r.desc, attempt, err, delay.Seconds())
+		time.Sleep(delay)
+		if delay *= 2; delay > kldutils.RetryMaxDelay {
+			delay = kldutils.RetryMaxDelay
+		}
+	}
+}
+
+// isConnectionError checks if a call failed because of the connection to the
+// node, rather than being rejected by the node
+func isConnectionError(err error) bool {
+	if err == rpc.ErrClientQuit || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetErr := err.(net.Error)
+	return isNetErr
+}
+
+// isDialError checks if a call failed to connect to the node, so the node
+// cannot have received it
+func isDialError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
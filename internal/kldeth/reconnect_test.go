@@ -0,0 +1,203 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+var testReadError = &net.OpError{Op: "read", Net: "tcp", Err: fmt.Errorf("connection reset by peer")}
+var testDialError = &url.Error{Op: "Post", URL: "http://localhost:8545", Err: &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("connection refused")}}
+
+type testReconnectClient struct {
+	lock   sync.Mutex
+	errs   []error
+	calls  []string
+	closed bool
+}
+
+func (c *testReconnectClient) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls = append(c.calls, method)
+	if len(c.errs) > 0 {
+		err := c.errs[0]
+		c.errs = c.errs[1:]
+		return err
+	}
+	return nil
+}
+
+func (c *testReconnectClient) Close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closed = true
+}
+
+type testBatchReconnectClient struct {
+	testReconnectClient
+	batchErr error
+}
+
+func (c *testBatchReconnectClient) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.calls = append(c.calls, "batch")
+	err := c.batchErr
+	c.batchErr = nil
+	return err
+}
+
+func newTestReconnectingRPC(client ClosableRPCClient, maxWait time.Duration, clients ...ClosableRPCClient) (*reconnectingRPC, *int) {
+	dials := 0
+	r := NewReconnectingRPC("test node", client, func() (ClosableRPCClient, error) {
+		dials++
+		return clients[dials-1], nil
+	}, maxWait).(*reconnectingRPC)
+	return r, &dials
+}
+
+func TestReconnectingRPCRetriesCall(t *testing.T) {
+	assert := assert.New(t)
+
+	client1 := &testReconnectClient{errs: []error{testReadError}}
+	client2 := &testReconnectClient{}
+	r, dials := newTestReconnectingRPC(client1, 5*time.Second, client2)
+
+	err := r.CallContext(context.Background(), nil, "eth_getTransactionReceipt")
+	assert.NoError(err)
+	assert.Equal(1, *dials)
+	assert.True(client1.closed)
+	assert.Equal([]string{"eth_getTransactionReceipt"}, client1.calls)
+	assert.Equal([]string{"eth_blockNumber", "eth_getTransactionReceipt"}, client2.calls)
+	assert.Nil(r.reconnecting)
+}
+
+func TestReconnectingRPCDoesNotResendTransactions(t *testing.T) {
+	assert := assert.New(t)
+
+	client1 := &testReconnectClient{errs: []error{testReadError}}
+	client2 := &testReconnectClient{errs: []error{nil, testDialError}}
+	client3 := &testReconnectClient{}
+	r, dials := newTestReconnectingRPC(client1, 5*time.Second, client2, client3)
+
+	// The node might have received the transaction, so it is not sent again
+	err := r.CallContext(context.Background(), nil, "eth_sendTransaction")
+	assert.Equal(testReadError, err)
+
+	// Unless the connection was refused
+	err = r.CallContext(context.Background(), nil, "eth_sendTransaction")
+	assert.NoError(err)
+	assert.Equal(2, *dials)
+	assert.Equal([]string{"eth_blockNumber", "eth_sendTransaction"}, client2.calls)
+	assert.Equal([]string{"eth_blockNumber", "eth_sendTransaction"}, client3.calls)
+}
+
+func TestReconnectingRPCNodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	client := &testReconnectClient{errs: []error{fmt.Errorf("pop")}}
+	r, dials := newTestReconnectingRPC(client, 5*time.Second)
+
+	err := r.CallContext(context.Background(), nil, "eth_call")
+	assert.EqualError(err, "pop")
+	assert.Equal(0, *dials)
+	assert.False(client.closed)
+}
+
+func TestReconnectingRPCWaitExpires(t *testing.T) {
+	assert := assert.New(t)
+
+	client1 := &testReconnectClient{errs: []error{testReadError}}
+	client2 := &testReconnectClient{}
+	dialed := make(chan struct{})
+	r := NewReconnectingRPC("test node", client1, func() (ClosableRPCClient, error) {
+		<-dialed
+		return client2, nil
+	}, 50*time.Millisecond).(*reconnectingRPC)
+
+	err := r.CallContext(context.Background(), nil, "eth_call")
+	assert.EqualError(err, "test node not reconnected after 50ms")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.connected(ctx, time.Now().Add(time.Second))
+	assert.EqualError(err, "test node not reconnected: context canceled")
+
+	close(dialed)
+	client, err := r.connected(context.Background(), time.Now().Add(5*time.Second))
+	assert.NoError(err)
+	assert.Equal(client2, client)
+}
+
+func TestReconnectingRPCDialFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	client1 := &testReconnectClient{errs: []error{io.EOF}}
+	client2 := &testReconnectClient{errs: []error{testDialError}}
+	client3 := &testReconnectClient{}
+	r, dials := newTestReconnectingRPC(client1, 5*time.Second, client2, client3)
+
+	err := r.CallContext(context.Background(), nil, "eth_call")
+	assert.NoError(err)
+	assert.Equal(2, *dials)
+	assert.True(client2.closed)
+	assert.Equal([]string{"eth_blockNumber", "eth_call"}, client3.calls)
+}
+
+func TestReconnectingRPCBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	client1 := &testBatchReconnectClient{batchErr: rpc.ErrClientQuit}
+	client2 := &testBatchReconnectClient{}
+	r, _ := newTestReconnectingRPC(client1, 5*time.Second, client2)
+
+	err := r.BatchCallContext(context.Background(), []rpc.BatchElem{{Method: "eth_getTransactionReceipt"}})
+	assert.NoError(err)
+	assert.Equal([]string{"batch"}, client1.calls)
+	assert.Equal([]string{"eth_blockNumber", "batch"}, client2.calls)
+
+	// Clients without batch support make each call in turn
+	client3 := &testReconnectClient{errs: []error{fmt.Errorf("pop")}}
+	r, _ = newTestReconnectingRPC(client3, 5*time.Second)
+	batch := []rpc.BatchElem{{Method: "eth_getTransactionReceipt"}, {Method: "eth_getTransactionReceipt"}}
+	err = r.BatchCallContext(context.Background(), batch)
+	assert.NoError(err)
+	assert.EqualError(batch[0].Error, "pop")
+	assert.NoError(batch[1].Error)
+}
+
+func TestIsConnectionError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isConnectionError(testReadError))
+	assert.True(isConnectionError(testDialError))
+	assert.True(isConnectionError(io.ErrUnexpectedEOF))
+	assert.False(isConnectionError(fmt.Errorf("nonce too low")))
+
+	assert.True(isDialError(testDialError))
+	assert.True(isDialError(testDialError.Err))
+	assert.False(isDialError(testReadError))
+}
@@ -16,9 +16,18 @@ package kldeth
 
 import (
 	"context"
+
+	"github.com/ethereum/go-ethereum/rpc"
 )
 
 // RPCClient refers to the functions from the ethereum RPC client that we use
 type RPCClient interface {
 	CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error
 }
+
+// BatchRPCClient is implemented by clients that can send several calls in a
+// single JSON/RPC batch request
+type BatchRPCClient interface {
+	RPCClient
+	BatchCallContext(ctx context.Context, b []rpc.BatchElem) error
+}
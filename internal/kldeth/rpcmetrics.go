@@ -0,0 +1,71 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
+)
+
+// NewRPCLatencyHistogram creates the histogram used to record JSON/RPC call latencies, by method
+func NewRPCLatencyHistogram() *kldmetrics.HistogramVec {
+	return kldmetrics.NewHistogramVec(
+		"ethconnect_rpc_call_duration_seconds",
+		"Latency of JSON/RPC calls to the Ethereum node, including failed calls",
+		"method",
+		kldmetrics.DefaultLatencyBuckets,
+	)
+}
+
+// instrumentedRPC wraps an RPCClient to record the latency of every call
+type instrumentedRPC struct {
+	rpc     RPCClient
+	latency *kldmetrics.HistogramVec
+}
+
+// NewInstrumentedRPC wraps an RPCClient, so the latency of every call is recorded
+// in the supplied histogram against the name of the JSON/RPC method
+func NewInstrumentedRPC(rpc RPCClient, latency *kldmetrics.HistogramVec) RPCClient {
+	return &instrumentedRPC{
+		rpc:     rpc,
+		latency: latency,
+	}
+}
+
+func (i *instrumentedRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	start := time.Now()
+	err := i.rpc.CallContext(ctx, result, method, args...)
+	i.latency.WithLabel(method).Observe(time.Since(start).Seconds())
+	return err
+}
+
+// BatchCallContext sends the calls as a batch if the wrapped client supports it,
+// recording the latency of the batch, or otherwise makes each call in turn
+func (i *instrumentedRPC) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	batchRPC, ok := i.rpc.(BatchRPCClient)
+	if !ok {
+		for idx := range b {
+			b[idx].Error = i.CallContext(ctx, b[idx].Result, b[idx].Method, b[idx].Args...)
+		}
+		return nil
+	}
+	start := time.Now()
+	err := batchRPC.BatchCallContext(ctx, b)
+	i.latency.WithLabel("batch").Observe(time.Since(start).Seconds())
+	return err
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstrumentedRPCRecordsLatency(t *testing.T) {
+	assert := assert.New(t)
+
+	latency := NewRPCLatencyHistogram()
+	testRPC := &testRPCClient{}
+	rpc := NewInstrumentedRPC(testRPC, latency)
+
+	var result string
+	err := rpc.CallContext(context.Background(), &result, "eth_chainId")
+	assert.Nil(err)
+	assert.Equal("eth_chainId", testRPC.capturedMethod)
+	assert.Equal(uint64(1), latency.WithLabel("eth_chainId").Count())
+	assert.Equal(uint64(0), latency.WithLabel("eth_sendTransaction").Count())
+}
+
+func TestInstrumentedRPCRecordsFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	latency := NewRPCLatencyHistogram()
+	rpc := NewInstrumentedRPC(&testRPCClient{mockError: fmt.Errorf("pop")}, latency)
+
+	err := rpc.CallContext(context.Background(), nil, "eth_call", "arg1")
+	assert.EqualError(err, "pop")
+	assert.Equal(uint64(1), latency.WithLabel("eth_call").Count())
+}
+
+func TestInstrumentedRPCBatch(t *testing.T) {
+	assert := assert.New(t)
+
+	latency := NewRPCLatencyHistogram()
+	batchRPC := &testBatchRPCClient{}
+	instrumented := NewInstrumentedRPC(batchRPC, latency).(BatchRPCClient)
+
+	err := instrumented.BatchCallContext(context.Background(), []rpc.BatchElem{{Method: "eth_getTransactionReceipt", Args: []interface{}{"0x1"}, Result: &TxnReceipt{}}})
+	assert.NoError(err)
+	assert.Equal(1, len(batchRPC.batches))
+	assert.Equal(uint64(1), latency.WithLabel("batch").Count())
+}
+
+func TestInstrumentedRPCBatchUnsupported(t *testing.T) {
+	assert := assert.New(t)
+
+	latency := NewRPCLatencyHistogram()
+	instrumented := NewInstrumentedRPC(&testRPCClient{mockError: fmt.Errorf("pop")}, latency).(BatchRPCClient)
+
+	batch := []rpc.BatchElem{{Method: "eth_getTransactionReceipt"}, {Method: "eth_getTransactionReceipt"}}
+	err := instrumented.BatchCallContext(context.Background(), batch)
+	assert.NoError(err)
+	assert.EqualError(batch[0].Error, "pop")
+	assert.EqualError(batch[1].Error, "pop")
+	assert.Equal(uint64(2), latency.WithLabel("eth_getTransactionReceipt").Count())
+}
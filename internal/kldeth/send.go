@@ -16,9 +16,11 @@ package kldeth
 
 import (
 	"context"
+	"strconv"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -30,11 +32,11 @@ func (tx *Txn) Send(rpc RPCClient) error {
 	defer cancel()
 
 	var err error
-	// if tx.From == "" {
-	// 	tx.Hash, err = w.signAndSendTxn(ctx, tx)
-	// } else {
-	tx.Hash, err = tx.sendUnsignedTxn(ctx, rpc)
-	// }
+	if tx.RawTX != nil {
+		tx.Hash, err = tx.sendRawTxn(ctx, rpc)
+	} else {
+		tx.Hash, err = tx.sendUnsignedTxn(ctx, rpc)
+	}
 	callTime := time.Now().Sub(start)
 	if err != nil {
 		log.Warnf("TX:%s Failed to send: %s [%.2fs]", tx.Hash, err, callTime.Seconds())
@@ -52,6 +54,8 @@ type sendTxArgs struct {
 	GasPrice hexutil.Big     `json:"gasPrice"`
 	Value    hexutil.Big     `json:"value"`
 	Data     *hexutil.Bytes  `json:"data"`
+	// EIP-2930 access list, which the node uses to build a typed transaction
+	AccessList AccessList `json:"accessList,omitempty"`
 	// EEA spec extensions
 	PrivateFrom string   `json:"privateFrom,omitempty"`
 	PrivateFor  []string `json:"privateFor,omitempty"`
@@ -59,6 +63,24 @@ type sendTxArgs struct {
 
 // sendUnsignedTxn sends a transaction for internal signing by the node
 func (tx *Txn) sendUnsignedTxn(ctx context.Context, rpc RPCClient) (string, error) {
+	args := tx.txArgs()
+	// If requested, and no access list was supplied explicitly,
+	// ask the node to generate one by simulating the transaction
+	args.AccessList = tx.AccessList
+	if tx.GenerateAccessList && args.AccessList == nil {
+		accessList, err := tx.createAccessList(ctx, rpc, &args)
+		if err != nil {
+			return "", err
+		}
+		args.AccessList = accessList
+	}
+	var txHash string
+	err := rpc.CallContext(ctx, &txHash, "eth_sendTransaction", args)
+	return txHash, err
+}
+
+// txArgs builds the JSON/RPC arguments for the transaction
+func (tx *Txn) txArgs() sendTxArgs {
 	data := hexutil.Bytes(tx.EthTX.Data())
 	var nonce *hexutil.Uint64
 	if !tx.NodeAssignNonce {
@@ -81,7 +103,26 @@ func (tx *Txn) sendUnsignedTxn(ctx context.Context, rpc RPCClient) (string, erro
 	if to != nil {
 		args.To = to.Hex()
 	}
-	var txHash string
-	err := rpc.CallContext(ctx, &txHash, "eth_sendTransaction", args)
-	return txHash, err
+	return args
+}
+
+// Details returns the fields of the transaction as submitted, for inclusion in
+// the reply. For node-signed transactions this is what was passed to
+// eth_sendTransaction, and for signed transactions what was in the signed RLP
+func (tx *Txn) Details() *kldmessages.TransactionDetails {
+	details := &kldmessages.TransactionDetails{
+		From:     tx.From.Hex(),
+		Gas:      strconv.FormatUint(tx.EthTX.Gas(), 10),
+		GasPrice: tx.EthTX.GasPrice().Text(10),
+		Value:    tx.EthTX.Value().Text(10),
+		Data:     hexutil.Encode(tx.EthTX.Data()),
+		Signed:   tx.RawTX != nil,
+	}
+	if to := tx.EthTX.To(); to != nil {
+		details.To = to.Hex()
+	}
+	if !tx.NodeAssignNonce {
+		details.Nonce = strconv.FormatUint(tx.EthTX.Nonce(), 10)
+	}
+	return details
 }
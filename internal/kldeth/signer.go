@@ -0,0 +1,85 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Signer signs transactions in the bridge, for accounts whose keys are not
+// held by the node
+type Signer interface {
+	Address() common.Address
+	SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error)
+}
+
+type keyFileSigner struct {
+	key     *ecdsa.PrivateKey
+	address common.Address
+}
+
+// NewKeyFileSigner loads a hex encoded private key from a file, to sign
+// transactions for the account of that key
+func NewKeyFileSigner(file string) (Signer, error) {
+	key, err := crypto.LoadECDSA(file)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load signing key from %s: %s", file, err)
+	}
+	return &keyFileSigner{
+		key:     key,
+		address: crypto.PubkeyToAddress(key.PublicKey),
+	}, nil
+}
+
+func (s *keyFileSigner) Address() common.Address {
+	return s.address
+}
+
+func (s *keyFileSigner) SignTx(tx *types.Transaction, chainID *big.Int) (*types.Transaction, error) {
+	return types.SignTx(tx, types.NewEIP155Signer(chainID), s.key)
+}
+
+// SignLocally signs the transaction with an EIP-155 signature for the chain,
+// so it is submitted with eth_sendRawTransaction instead of being signed by the node
+func (tx *Txn) SignLocally(signer Signer, chainID *big.Int) error {
+	if tx.NodeAssignNonce {
+		return fmt.Errorf("A nonce must be assigned to sign a transaction locally")
+	}
+	if tx.AccessList != nil || tx.GenerateAccessList {
+		return fmt.Errorf("Access lists are not supported for locally signed transactions")
+	}
+	if signer.Address() != tx.From {
+		return fmt.Errorf("Signer for %s cannot sign transactions from %s", signer.Address().Hex(), tx.From.Hex())
+	}
+	signedTX, err := signer.SignTx(tx.EthTX, chainID)
+	if err != nil {
+		return fmt.Errorf("Failed to sign transaction: %s", err)
+	}
+	if tx.RawTX, err = rlp.EncodeToBytes(signedTX); err != nil {
+		return fmt.Errorf("Failed to encode signed transaction: %s", err)
+	}
+	tx.EthTX = signedTX
+	tx.Signer = signer
+	log.Debugf("TX:%s From='%s' Nonce=%d (signed locally)", signedTX.Hash().Hex(), tx.From.Hex(), signedTX.Nonce())
+	return nil
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSigningKey = "8f2a55949038a9610f50fb23b5883af3b4ecb3c3bb792cbcefbd1542c692be63"
+
+func newTestKeyFileSigner(assert *assert.Assertions) Signer {
+	f, _ := ioutil.TempFile("", "ethconnect-key")
+	f.WriteString(testSigningKey)
+	f.Close()
+	defer os.Remove(f.Name())
+	signer, err := NewKeyFileSigner(f.Name())
+	assert.NoError(err)
+	return signer
+}
+
+func newTestLocalTxn(from common.Address) *Txn {
+	return &Txn{
+		From:  from,
+		EthTX: types.NewTransaction(5, common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"), big.NewInt(10), 21000, big.NewInt(100), []byte{0x01}),
+	}
+}
+
+func TestSignLocally(t *testing.T) {
+	assert := assert.New(t)
+
+	signer := newTestKeyFileSigner(assert)
+	key, _ := crypto.HexToECDSA(testSigningKey)
+	assert.Equal(crypto.PubkeyToAddress(key.PublicKey), signer.Address())
+
+	tx := newTestLocalTxn(signer.Address())
+	err := tx.SignLocally(signer, big.NewInt(12345))
+	assert.NoError(err)
+	assert.Equal(signer, tx.Signer)
+
+	var decoded types.Transaction
+	assert.NoError(rlp.DecodeBytes(tx.RawTX, &decoded))
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(12345)), &decoded)
+	assert.NoError(err)
+	assert.Equal(signer.Address(), sender)
+	assert.Equal(uint64(5), decoded.Nonce())
+
+	rpc := testRPCClient{}
+	tx.Send(&rpc)
+	assert.Equal("eth_sendRawTransaction", rpc.capturedMethod)
+	assert.Equal(hexutil.Encode(tx.RawTX), rpc.capturedArgs[0])
+}
+
+func TestSignLocallyReplacement(t *testing.T) {
+	assert := assert.New(t)
+
+	signer := newTestKeyFileSigner(assert)
+	tx := newTestLocalTxn(signer.Address())
+	assert.NoError(tx.SignLocally(signer, big.NewInt(12345)))
+
+	replacement, err := tx.NewReplacement(5, big.NewInt(110))
+	assert.NoError(err)
+	assert.NotNil(replacement.RawTX)
+	assert.Equal(int64(110), replacement.EthTX.GasPrice().Int64())
+	assert.Equal(int64(12345), replacement.EthTX.ChainId().Int64())
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(12345)), replacement.EthTX)
+	assert.NoError(err)
+	assert.Equal(signer.Address(), sender)
+}
+
+func TestSignLocallyErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	signer := newTestKeyFileSigner(assert)
+
+	tx := newTestLocalTxn(signer.Address())
+	tx.NodeAssignNonce = true
+	assert.EqualError(tx.SignLocally(signer, big.NewInt(1)), "A nonce must be assigned to sign a transaction locally")
+
+	tx = newTestLocalTxn(signer.Address())
+	tx.GenerateAccessList = true
+	assert.EqualError(tx.SignLocally(signer, big.NewInt(1)), "Access lists are not supported for locally signed transactions")
+
+	tx = newTestLocalTxn(common.HexToAddress("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"))
+	assert.Regexp("Signer for 0x.* cannot sign transactions from 0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", tx.SignLocally(signer, big.NewInt(1)).Error())
+}
+
+func TestNewKeyFileSignerMissing(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewKeyFileSigner("/does/not/exist")
+	assert.Regexp("Failed to load signing key from /does/not/exist", err.Error())
+}
@@ -0,0 +1,134 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+)
+
+// stateOverridesUnsupportedErrors are fragments of the errors nodes return when
+// they do not accept the state override parameter of eth_call
+var stateOverridesUnsupportedErrors = []string{
+	"too many arguments",
+	"invalid argument 2",
+	"Invalid params",
+}
+
+// StateOverride replaces parts of the state of an account for an eth_call,
+// in the form accepted by Geth and Quorum
+type StateOverride struct {
+	Balance   *hexutil.Big                `json:"balance,omitempty"`
+	Nonce     *hexutil.Uint64             `json:"nonce,omitempty"`
+	Code      *hexutil.Bytes              `json:"code,omitempty"`
+	State     map[common.Hash]common.Hash `json:"state,omitempty"`
+	StateDiff map[common.Hash]common.Hash `json:"stateDiff,omitempty"`
+}
+
+// StateOverrides is the set of state overrides for an eth_call, by account
+type StateOverrides map[common.Address]*StateOverride
+
+// parseStateOverrides validates the state overrides supplied on a message
+func parseStateOverrides(msgOverrides map[string]kldmessages.StateOverride) (overrides StateOverrides, err error) {
+	if len(msgOverrides) == 0 {
+		return
+	}
+	overrides = make(StateOverrides, len(msgOverrides))
+	for strAddr, msgOverride := range msgOverrides {
+		var addr common.Address
+		if addr, err = kldutils.StrToAddress("stateOverrides", strAddr); err != nil {
+			return
+		}
+		if overrides[addr], err = parseStateOverride(strAddr, &msgOverride); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func parseStateOverride(strAddr string, msgOverride *kldmessages.StateOverride) (*StateOverride, error) {
+	override := &StateOverride{}
+	if msgOverride.Balance != "" {
+		balance, ok := new(big.Int).SetString(msgOverride.Balance, 0)
+		if !ok || balance.Sign() < 0 {
+			return nil, fmt.Errorf("Supplied value for 'stateOverrides[%s].balance' is not a valid number", strAddr)
+		}
+		override.Balance = (*hexutil.Big)(balance)
+	}
+	if msgOverride.Nonce != "" {
+		nonce, err := strconv.ParseUint(msgOverride.Nonce, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Supplied value for 'stateOverrides[%s].nonce' is not a valid number", strAddr)
+		}
+		override.Nonce = (*hexutil.Uint64)(&nonce)
+	}
+	if msgOverride.Code != "" {
+		code, err := hexutil.Decode(msgOverride.Code)
+		if err != nil {
+			return nil, fmt.Errorf("Supplied value for 'stateOverrides[%s].code' is not a valid hex string", strAddr)
+		}
+		override.Code = (*hexutil.Bytes)(&code)
+	}
+	if msgOverride.State != nil && msgOverride.StateDiff != nil {
+		return nil, fmt.Errorf("Supply either 'state' or 'stateDiff' for 'stateOverrides[%s]', but not both", strAddr)
+	}
+	var err error
+	if override.State, err = parseStorageOverrides(fmt.Sprintf("stateOverrides[%s].state", strAddr), msgOverride.State); err != nil {
+		return nil, err
+	}
+	if override.StateDiff, err = parseStorageOverrides(fmt.Sprintf("stateOverrides[%s].stateDiff", strAddr), msgOverride.StateDiff); err != nil {
+		return nil, err
+	}
+	return override, nil
+}
+
+// parseStorageOverrides checks every storage key and value is exactly 32 bytes
+func parseStorageOverrides(desc string, msgStorage map[string]string) (map[common.Hash]common.Hash, error) {
+	if msgStorage == nil {
+		return nil, nil
+	}
+	storage := make(map[common.Hash]common.Hash, len(msgStorage))
+	for msgKey, msgValue := range msgStorage {
+		keyBytes, err := hexutil.Decode(msgKey)
+		if err != nil || len(keyBytes) != common.HashLength {
+			return nil, fmt.Errorf("Supplied key '%s' in '%s' is not a 32 byte hex string", msgKey, desc)
+		}
+		valueBytes, err := hexutil.Decode(msgValue)
+		if err != nil || len(valueBytes) != common.HashLength {
+			return nil, fmt.Errorf("Supplied value for '%s[%s]' is not a 32 byte hex string", desc, msgKey)
+		}
+		storage[common.BytesToHash(keyBytes)] = common.BytesToHash(valueBytes)
+	}
+	return storage, nil
+}
+
+// isStateOverridesUnsupported checks if an eth_call with state overrides
+// failed because the node does not support them
+func isStateOverridesUnsupported(err error) bool {
+	errStr := err.Error()
+	for _, unsupportedErr := range stateOverridesUnsupportedErrors {
+		if strings.Contains(errStr, unsupportedErr) {
+			return true
+		}
+	}
+	return false
+}
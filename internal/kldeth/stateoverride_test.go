@@ -0,0 +1,112 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testOverrideAddr = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+
+func TestParseStateOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	overrides, err := parseStateOverrides(map[string]kldmessages.StateOverride{
+		testOverrideAddr: {
+			Balance: "1000000000000000000",
+			Nonce:   "0x5",
+			Code:    "0x6080",
+			State:   map[string]string{testStorageKey: testStorageKey},
+		},
+	})
+	assert.NoError(err)
+
+	jsonBytes, _ := json.Marshal(overrides)
+	assert.JSONEq(`{
+		"0x2b8c0ecc76d0759a8f50b2e14a6881367d805832": {
+			"balance": "0xde0b6b3a7640000",
+			"nonce": "0x5",
+			"code": "0x6080",
+			"state": {"`+testStorageKey+`": "`+testStorageKey+`"}
+		}
+	}`, string(jsonBytes))
+}
+
+func TestParseStateOverridesEmpty(t *testing.T) {
+	assert := assert.New(t)
+
+	overrides, err := parseStateOverrides(nil)
+	assert.NoError(err)
+	assert.Nil(overrides)
+}
+
+func TestParseStateOverridesErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	badOverride := func(override kldmessages.StateOverride) error {
+		_, err := parseStateOverrides(map[string]kldmessages.StateOverride{testOverrideAddr: override})
+		return err
+	}
+
+	_, err := parseStateOverrides(map[string]kldmessages.StateOverride{"badness": {}})
+	assert.Regexp("Supplied value for 'stateOverrides' is not a valid hex address", err.Error())
+	assert.Regexp("'stateOverrides\\[.*\\].balance' is not a valid number", badOverride(kldmessages.StateOverride{Balance: "-1"}).Error())
+	assert.Regexp("'stateOverrides\\[.*\\].nonce' is not a valid number", badOverride(kldmessages.StateOverride{Nonce: "abc"}).Error())
+	assert.Regexp("'stateOverrides\\[.*\\].code' is not a valid hex string", badOverride(kldmessages.StateOverride{Code: "zzz"}).Error())
+	assert.Regexp("Supply either 'state' or 'stateDiff'", badOverride(kldmessages.StateOverride{
+		State:     map[string]string{},
+		StateDiff: map[string]string{},
+	}).Error())
+	assert.Regexp("Supplied key '0x07' in 'stateOverrides\\[.*\\].state' is not a 32 byte hex string", badOverride(kldmessages.StateOverride{
+		State: map[string]string{"0x07": testStorageKey},
+	}).Error())
+	assert.Regexp("Supplied value for 'stateOverrides\\[.*\\].stateDiff\\[.*\\]' is not a 32 byte hex string", badOverride(kldmessages.StateOverride{
+		StateDiff: map[string]string{testStorageKey: "0x07"},
+	}).Error())
+}
+
+func TestSimulateWithStateOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestCallTxn()
+	tx.StateOverrides, _ = parseStateOverrides(map[string]kldmessages.StateOverride{
+		testOverrideAddr: {Balance: "100"},
+	})
+	r := testRPCClient{}
+	err := tx.Simulate(&r)
+
+	assert.Nil(err)
+	assert.Equal("eth_call", r.capturedMethod)
+	assert.Equal(3, len(r.capturedArgs))
+	assert.Equal(tx.StateOverrides, r.capturedArgs[2])
+}
+
+func TestSimulateStateOverridesUnsupported(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestCallTxn()
+	tx.StateOverrides, _ = parseStateOverrides(map[string]kldmessages.StateOverride{
+		testOverrideAddr: {Balance: "100"},
+	})
+	r := testRPCClient{mockError: fmt.Errorf("too many arguments, want at most 2")}
+	err := tx.Simulate(&r)
+
+	assert.Equal("The node does not support 'stateOverrides' for simulation: too many arguments, want at most 2", err.Error())
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// traceCallUnsupportedErrors are fragments of the errors nodes return when
+// the debug_traceCall method is not available, or the debug API is not enabled
+var traceCallUnsupportedErrors = []string{
+	"method not found",
+	"does not exist/is not available",
+	"not supported",
+}
+
+// callTrace is a call frame in the output of the callTracer
+type callTrace struct {
+	Type    string         `json:"type"`
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Gas     hexutil.Uint64 `json:"gas"`
+	GasUsed hexutil.Uint64 `json:"gasUsed"`
+	Error   string         `json:"error"`
+	Calls   []*callTrace   `json:"calls"`
+}
+
+// structLogTrace is the output of the default struct logger, with the
+// memory, stack and storage of each step disabled
+type structLogTrace struct {
+	Gas        uint64 `json:"gas"`
+	Failed     bool   `json:"failed"`
+	StructLogs []struct {
+		Op      string `json:"op"`
+		GasCost uint64 `json:"gasCost"`
+	} `json:"structLogs"`
+}
+
+// TraceCall runs the transaction with debug_traceCall against the pending block,
+// without submitting it, and returns a profile of the gas it used by call
+// frame or by opcode. Any state overrides are passed to the node in the
+// trace config
+func (tx *Txn) TraceCall(rpc RPCClient, profile string) (*kldmessages.GasProfile, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	config := map[string]interface{}{}
+	if len(tx.StateOverrides) > 0 {
+		config["stateOverrides"] = tx.StateOverrides
+	}
+	reply := &kldmessages.GasProfile{Profile: profile}
+	var err error
+	switch profile {
+	case kldmessages.GasProfileCalls:
+		config["tracer"] = "callTracer"
+		var trace callTrace
+		if err = rpc.CallContext(ctx, &trace, "debug_traceCall", tx.txArgs(), "pending", config); err == nil {
+			reply.GasUsed = strconv.FormatUint(uint64(trace.GasUsed), 10)
+			reply.Failed = trace.Error != ""
+			reply.Error = trace.Error
+			reply.Calls = trace.callFrameGas()
+		}
+	case kldmessages.GasProfileOpcodes:
+		config["disableStack"] = true
+		config["disableStorage"] = true
+		config["disableMemory"] = true
+		var trace structLogTrace
+		if err = rpc.CallContext(ctx, &trace, "debug_traceCall", tx.txArgs(), "pending", config); err == nil {
+			reply.GasUsed = strconv.FormatUint(trace.Gas, 10)
+			reply.Failed = trace.Failed
+			reply.Opcodes = trace.opcodeGas()
+		}
+	default:
+		return nil, fmt.Errorf("Unknown gas profile '%s' (must be '%s' or '%s')", profile, kldmessages.GasProfileCalls, kldmessages.GasProfileOpcodes)
+	}
+	callTime := time.Now().Sub(start)
+	if err != nil {
+		if isTraceCallUnsupported(err) {
+			err = fmt.Errorf("The node does not support debug_traceCall for tracing transactions: %s", err)
+		}
+		log.Warnf("debug_traceCall(%s) failed: %s [%.2fs]", tx.From.Hex(), err, callTime.Seconds())
+		return nil, err
+	}
+	log.Debugf("debug_traceCall(%s) gasUsed=%s failed=%t [%.2fs]", tx.From.Hex(), reply.GasUsed, reply.Failed, callTime.Seconds())
+	return reply, nil
+}
+
+// callFrameGas converts a call frame of the trace, and the frames it called
+func (c *callTrace) callFrameGas() *kldmessages.CallFrameGas {
+	frame := &kldmessages.CallFrameGas{
+		Type:    c.Type,
+		From:    c.From,
+		To:      c.To,
+		Gas:     strconv.FormatUint(uint64(c.Gas), 10),
+		GasUsed: strconv.FormatUint(uint64(c.GasUsed), 10),
+		Error:   c.Error,
+	}
+	for _, call := range c.Calls {
+		frame.Calls = append(frame.Calls, call.callFrameGas())
+	}
+	return frame
+}
+
+// opcodeGas totals the gas charged for each opcode over the steps of the trace.
+// The cost of a CALL-family opcode includes the gas it makes available to the
+// callee, so the gas of the steps in nested calls is also counted there
+func (t *structLogTrace) opcodeGas() []*kldmessages.OpcodeGas {
+	byOp := make(map[string]*kldmessages.OpcodeGas)
+	totals := make(map[string]uint64)
+	var opcodes []*kldmessages.OpcodeGas
+	for _, step := range t.StructLogs {
+		opcode, exists := byOp[step.Op]
+		if !exists {
+			opcode = &kldmessages.OpcodeGas{Op: step.Op}
+			byOp[step.Op] = opcode
+			opcodes = append(opcodes, opcode)
+		}
+		opcode.Count++
+		totals[step.Op] += step.GasCost
+	}
+	for _, opcode := range opcodes {
+		opcode.Gas = strconv.FormatUint(totals[opcode.Op], 10)
+	}
+	sort.SliceStable(opcodes, func(i, j int) bool {
+		return totals[opcodes[i].Op] > totals[opcodes[j].Op]
+	})
+	return opcodes
+}
+
+// isTraceCallUnsupported checks if debug_traceCall failed because the node
+// does not provide it, rather than because of the transaction
+func isTraceCallUnsupported(err error) bool {
+	errStr := strings.ToLower(err.Error())
+	for _, unsupportedErr := range traceCallUnsupportedErrors {
+		if strings.Contains(errStr, unsupportedErr) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+type testTraceCallRPC struct {
+	result       string
+	err          error
+	capturedArgs []interface{}
+}
+
+func (r *testTraceCallRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
+	r.capturedArgs = args
+	if r.err != nil {
+		return r.err
+	}
+	return json.Unmarshal([]byte(r.result), result)
+}
+
+func TestTraceCallCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTraceCallRPC{result: `{"type":"CALL","from":"0xaa983ad2a0e0ed8ac639277f37be42f2a5d2618c","to":"0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",` +
+		`"gas":"0x7530","gasUsed":"0x61a8","calls":[{"type":"STATICCALL","from":"0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",` +
+		`"to":"0x0000000000000000000000000000000000000001","gas":"0x3e8","gasUsed":"0xbb8","error":"out of gas"}]}`}
+	profile, err := newTestCallTxn().TraceCall(r, kldmessages.GasProfileCalls)
+	assert.NoError(err)
+	assert.Equal("pending", r.capturedArgs[1])
+	assert.Equal(map[string]interface{}{"tracer": "callTracer"}, r.capturedArgs[2])
+	assert.Equal("25000", profile.GasUsed)
+	assert.False(profile.Failed)
+	assert.Equal("30000", profile.Calls.Gas)
+	assert.Equal(1, len(profile.Calls.Calls))
+	assert.Equal("STATICCALL", profile.Calls.Calls[0].Type)
+	assert.Equal("3000", profile.Calls.Calls[0].GasUsed)
+	assert.Equal("out of gas", profile.Calls.Calls[0].Error)
+	assert.Nil(profile.Opcodes)
+}
+
+func TestTraceCallOpcodes(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testTraceCallRPC{result: `{"gas":21100,"failed":true,"returnValue":"","structLogs":[` +
+		`{"pc":0,"op":"PUSH1","gas":100,"gasCost":3,"depth":1},` +
+		`{"pc":2,"op":"SSTORE","gas":97,"gasCost":20000,"depth":1},` +
+		`{"pc":3,"op":"PUSH1","gas":20097,"gasCost":3,"depth":1},` +
+		`{"pc":5,"op":"REVERT","gas":20094,"gasCost":0,"depth":1}]}`}
+	profile, err := newTestCallTxn().TraceCall(r, kldmessages.GasProfileOpcodes)
+	assert.NoError(err)
+	assert.Equal(true, r.capturedArgs[2].(map[string]interface{})["disableMemory"])
+	assert.Equal("21100", profile.GasUsed)
+	assert.True(profile.Failed)
+	assert.Nil(profile.Calls)
+	assert.Equal([]*kldmessages.OpcodeGas{
+		{Op: "SSTORE", Count: 1, Gas: "20000"},
+		{Op: "PUSH1", Count: 2, Gas: "6"},
+		{Op: "REVERT", Count: 1, Gas: "0"},
+	}, profile.Opcodes)
+}
+
+func TestTraceCallStateOverrides(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := newTestCallTxn()
+	tx.StateOverrides, _ = parseStateOverrides(map[string]kldmessages.StateOverride{
+		"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832": {Balance: "100"},
+	})
+	r := &testTraceCallRPC{result: `{"type":"CALL","gas":"0x0","gasUsed":"0x0"}`}
+	_, err := tx.TraceCall(r, kldmessages.GasProfileCalls)
+	assert.NoError(err)
+	assert.Equal(tx.StateOverrides, r.capturedArgs[2].(map[string]interface{})["stateOverrides"])
+}
+
+func TestTraceCallErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newTestCallTxn().TraceCall(&testTraceCallRPC{}, "storage")
+	assert.EqualError(err, "Unknown gas profile 'storage' (must be 'calls' or 'opcodes')")
+
+	_, err = newTestCallTxn().TraceCall(&testTraceCallRPC{err: fmt.Errorf("the method debug_traceCall does not exist/is not available")}, kldmessages.GasProfileCalls)
+	assert.EqualError(err, "The node does not support debug_traceCall for tracing transactions: the method debug_traceCall does not exist/is not available")
+
+	_, err = newTestCallTxn().TraceCall(&testTraceCallRPC{err: fmt.Errorf("Method not found")}, kldmessages.GasProfileOpcodes)
+	assert.Regexp("does not support debug_traceCall", err)
+
+	_, err = newTestCallTxn().TraceCall(&testTraceCallRPC{err: fmt.Errorf("pop")}, kldmessages.GasProfileCalls)
+	assert.EqualError(err, "pop")
+}
@@ -15,6 +15,7 @@
 package kldeth
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/big"
@@ -36,11 +37,17 @@ import (
 // Txn wraps an ethereum transaction, along with the logic to send it over
 // JSON/RPC to a node
 type Txn struct {
-	NodeAssignNonce bool
-	From            common.Address
-	EthTX           *types.Transaction
-	Hash            string
-	Receipt         TxnReceipt
+	NodeAssignNonce    bool
+	From               common.Address
+	EthTX              *types.Transaction
+	RawTX              []byte // pre-signed by the client, or signed locally, if set
+	Signer             Signer // set if signed locally
+	AccessList         AccessList
+	GenerateAccessList bool
+	ErrorABIs          []*abi.Method  // custom errors, to decode reverts in simulation
+	StateOverrides     StateOverrides // applied in simulation only
+	Hash               string
+	Receipt            TxnReceipt
 }
 
 // TxnReceipt is the receipt obtained over JSON/RPC from the ethereum client
@@ -55,6 +62,14 @@ type TxnReceipt struct {
 	Status            *hexutil.Big    `json:"status"`
 	To                *common.Address `json:"to"`
 	TransactionIndex  *hexutil.Uint   `json:"transactionIndex"`
+	Logs              []*TxnLog       `json:"logs"`
+}
+
+// TxnLog is a log emitted by a transaction, as included in its receipt
+type TxnLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
 }
 
 // NewContractDeployTxn builds a new ethereum transaction from the supplied
@@ -87,10 +102,69 @@ func NewContractDeployTxn(msg *kldmessages.DeployContract) (pTX *Txn, err error)
 	data := append(compiledSolidity.Compiled, packedCall...)
 
 	// Generate the ethereum transaction
-	err = pTX.genEthTransaction(msg.From, "", msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data)
+	if err = pTX.genEthTransaction(msg.From, "", msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data); err != nil {
+		return
+	}
+	pTX.GenerateAccessList = msg.CreateAccessList
+	if pTX.ErrorABIs, err = genErrorABIs(msg.Errors); err != nil {
+		return
+	}
+	if pTX.StateOverrides, err = parseStateOverrides(msg.StateOverrides); err != nil {
+		return
+	}
+	pTX.AccessList, err = parseAccessList(msg.AccessList)
 	return
 }
 
+// NewReplacement builds a transaction to replace this one, with the same nonce
+// and content but a different gas price. Transactions pre-signed by the client
+// cannot be replaced, as we would need to sign the replacement. Locally signed
+// transactions are replaced with one signed by the same signer
+func (tx *Txn) NewReplacement(nonce uint64, gasPrice *big.Int) (*Txn, error) {
+	if tx.RawTX != nil && tx.Signer == nil {
+		return nil, fmt.Errorf("Pre-signed transactions cannot be replaced")
+	}
+	var ethTX *types.Transaction
+	if to := tx.EthTX.To(); to != nil {
+		ethTX = types.NewTransaction(nonce, *to, tx.EthTX.Value(), tx.EthTX.Gas(), gasPrice, tx.EthTX.Data())
+	} else {
+		ethTX = types.NewContractCreation(nonce, tx.EthTX.Value(), tx.EthTX.Gas(), gasPrice, tx.EthTX.Data())
+	}
+	replacement := &Txn{
+		From:       tx.From,
+		EthTX:      ethTX,
+		AccessList: tx.AccessList,
+		ErrorABIs:  tx.ErrorABIs,
+	}
+	if tx.Signer != nil {
+		if err := replacement.SignLocally(tx.Signer, tx.EthTX.ChainId()); err != nil {
+			return nil, err
+		}
+	}
+	return replacement, nil
+}
+
+// MethodSelector returns the 4 byte selector of the method a transaction calls,
+// as lower case hex with a 0x prefix. Empty for contract deployments, and
+// transactions without enough data for a selector
+func (tx *Txn) MethodSelector() string {
+	data := tx.EthTX.Data()
+	if tx.EthTX.To() == nil || len(data) < 4 {
+		return ""
+	}
+	return "0x" + hex.EncodeToString(data[0:4])
+}
+
+// SetGas changes the gas limit of a transaction that has not been signed
+func (tx *Txn) SetGas(gas uint64) {
+	etx := tx.EthTX
+	if to := etx.To(); to != nil {
+		tx.EthTX = types.NewTransaction(etx.Nonce(), *to, etx.Value(), gas, etx.GasPrice(), etx.Data())
+	} else {
+		tx.EthTX = types.NewContractCreation(etx.Nonce(), etx.Value(), gas, etx.GasPrice(), etx.Data())
+	}
+}
+
 // NewSendTxn builds a new ethereum transaction from the supplied
 // SendTranasction message
 func NewSendTxn(msg *kldmessages.SendTransaction) (pTX *Txn, err error) {
@@ -98,6 +172,16 @@ func NewSendTxn(msg *kldmessages.SendTransaction) (pTX *Txn, err error) {
 	var tx Txn
 	pTX = &tx
 
+	// Pre-encoded call data is passed through as-is, without ABI encoding
+	if msg.RawData != "" {
+		var data []byte
+		if data, err = rawDataToBytes(msg); err != nil {
+			return
+		}
+		err = pTX.genSendTxn(msg, data)
+		return
+	}
+
 	var methodABI *abi.Method
 	if msg.Method.Name == "" {
 		if msg.MethodName != "" {
@@ -131,11 +215,39 @@ func NewSendTxn(msg *kldmessages.SendTransaction) (pTX *Txn, err error) {
 	log.Infof("Method Name=%s ID=%x PackedArgs=%x", msg.Method.Name, methodID, packedArgs)
 	packedCall := append(methodID, packedArgs...)
 
-	// Generate the ethereum transaction
-	err = pTX.genEthTransaction(msg.From, msg.To, msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, packedCall)
+	err = pTX.genSendTxn(msg, packedCall)
+	return
+}
+
+// genSendTxn generates the ethereum transaction for a SendTransaction message
+func (tx *Txn) genSendTxn(msg *kldmessages.SendTransaction, data []byte) (err error) {
+	if err = tx.genEthTransaction(msg.From, msg.To, msg.Nonce, msg.Value, msg.Gas, msg.GasPrice, data); err != nil {
+		return
+	}
+	tx.GenerateAccessList = msg.CreateAccessList
+	if tx.ErrorABIs, err = genErrorABIs(msg.Errors); err != nil {
+		return
+	}
+	if tx.StateOverrides, err = parseStateOverrides(msg.StateOverrides); err != nil {
+		return
+	}
+	tx.AccessList, err = parseAccessList(msg.AccessList)
 	return
 }
 
+// rawDataToBytes validates and decodes the 'rawData' of a message, which
+// cannot be combined with any of the fields used for ABI encoding
+func rawDataToBytes(msg *kldmessages.SendTransaction) ([]byte, error) {
+	if msg.Method.Name != "" || msg.MethodName != "" || len(msg.Parameters) > 0 {
+		return nil, fmt.Errorf("Supply either 'rawData', or a method with params, but not both")
+	}
+	data, err := hex.DecodeString(strings.TrimPrefix(msg.RawData, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("Supplied value for 'rawData' is not valid hex: %s", err)
+	}
+	return data, nil
+}
+
 func genMethodABI(jsonABI *kldmessages.ABIMethod) (method *abi.Method, err error) {
 	method = &abi.Method{}
 	method.Name = jsonABI.Name
@@ -186,15 +298,18 @@ func (tx *Txn) genEthTransaction(msgFrom, msgTo string, msgNonce, msgValue, msgG
 		}
 	}
 
-	gas, err := msgGas.Int64()
-	if err != nil {
-		err = fmt.Errorf("Converting supplied 'gas' to integer: %s", err)
-		return
+	// Zero if not supplied, for the caller to set a default
+	var gas int64
+	if msgGas != "" {
+		if gas, err = msgGas.Int64(); err != nil {
+			err = fmt.Errorf("Converting supplied 'gas' to integer: %s", err)
+			return
+		}
 	}
 
 	gasPrice := big.NewInt(0)
 	if msgGasPrice.String() != "" {
-		if _, ok := value.SetString(msgGasPrice.String(), 10); !ok {
+		if _, ok := gasPrice.SetString(msgGasPrice.String(), 10); !ok {
 			err = fmt.Errorf("Converting supplied 'gasPrice' to big integer")
 			return
 		}
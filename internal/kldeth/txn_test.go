@@ -16,11 +16,14 @@ package kldeth
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"math/big"
 	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -68,8 +71,8 @@ func TestNewContractDeployTxnSimpleStorage(t *testing.T) {
 	assert.Equal("0x7b", jsonSent["nonce"])
 	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", jsonSent["from"])
 	assert.Equal("0x1c8", jsonSent["gas"])
-	assert.Equal("0x0", jsonSent["gasPrice"])
-	assert.Equal("0x315", jsonSent["value"])
+	assert.Equal("0x315", jsonSent["gasPrice"])
+	assert.Equal("0x0", jsonSent["value"])
 	// The bytecode has the packed parameters appended to the end
 	assert.Regexp(".+00000000000000000000000000000000000000000000000000000000000f423f$", jsonSent["data"])
 
@@ -120,6 +123,35 @@ func TestNewContractDeployBadGas(t *testing.T) {
 	assert.Regexp("Converting supplied 'gas' to integer", err.Error())
 }
 
+func TestMethodSelectorAndSetGas(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.Nonce = "123"
+	msg.Value = "111"
+	msg.GasPrice = "789"
+	msg.RawData = "0xF8A8FD6D0000"
+	tx, err := NewSendTxn(&msg)
+	assert.NoError(err)
+	assert.Equal(uint64(0), tx.EthTX.Gas())
+	assert.Equal("0xf8a8fd6d", tx.MethodSelector())
+
+	tx.SetGas(50000)
+	assert.Equal(uint64(50000), tx.EthTX.Gas())
+	assert.Equal(uint64(123), tx.EthTX.Nonce())
+	assert.Equal("111", tx.EthTX.Value().String())
+	assert.Equal("789", tx.EthTX.GasPrice().String())
+	assert.Equal(msg.To, tx.EthTX.To().Hex())
+	assert.Equal("f8a8fd6d0000", hex.EncodeToString(tx.EthTX.Data()))
+
+	msg.RawData = "0x1234"
+	tx, err = NewSendTxn(&msg)
+	assert.NoError(err)
+	assert.Equal("", tx.MethodSelector())
+}
+
 func TestNewContractDeployBadGasPrice(t *testing.T) {
 	assert := assert.New(t)
 
@@ -366,7 +398,7 @@ func TestSendTxnABIParam(t *testing.T) {
 	tx, err := NewSendTxn(&msg)
 	assert.Nil(err)
 	msgBytes, _ := json.Marshal(&msg)
-	log.Infof(string(msgBytes))
+	log.Info(string(msgBytes))
 
 	rpc := testRPCClient{}
 
@@ -378,8 +410,8 @@ func TestSendTxnABIParam(t *testing.T) {
 	assert.Equal("0x7b", jsonSent["nonce"])
 	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", jsonSent["from"])
 	assert.Equal("0x1c8", jsonSent["gas"])
-	assert.Equal("0x0", jsonSent["gasPrice"])
-	assert.Equal("0x315", jsonSent["value"])
+	assert.Equal("0x315", jsonSent["gasPrice"])
+	assert.Equal("0x0", jsonSent["value"])
 	assert.Regexp("0xe5537abb000000000000000000000000000000000000000000000000000000000000007b000000000000000000000000000000000000000000000000000000000000007b0000000000000000000000000000000000000000000000000000000000000080000000000000000000000000aa983ad2a0e0ed8ac639277f37be42f2a5d2618c00000000000000000000000000000000000000000000000000000000000000036162630000000000000000000000000000000000000000000000000000000000", jsonSent["data"])
 }
 
@@ -419,7 +451,7 @@ func TestSendTxnInlineParam(t *testing.T) {
 	tx, err := NewSendTxn(&msg)
 	assert.Nil(err)
 	msgBytes, _ := json.Marshal(&msg)
-	log.Infof(string(msgBytes))
+	log.Info(string(msgBytes))
 
 	rpc := testRPCClient{}
 
@@ -431,8 +463,8 @@ func TestSendTxnInlineParam(t *testing.T) {
 	assert.Equal("0x7b", jsonSent["nonce"])
 	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", jsonSent["from"])
 	assert.Equal("0x1c8", jsonSent["gas"])
-	assert.Equal("0x0", jsonSent["gasPrice"])
-	assert.Equal("0x315", jsonSent["value"])
+	assert.Equal("0x315", jsonSent["gasPrice"])
+	assert.Equal("0x0", jsonSent["value"])
 	assert.Regexp("0xe5537abb000000000000000000000000000000000000000000000000000000000000007b000000000000000000000000000000000000000000000000000000000000007b0000000000000000000000000000000000000000000000000000000000000080000000000000000000000000aa983ad2a0e0ed8ac639277f37be42f2a5d2618c00000000000000000000000000000000000000000000000000000000000000036162630000000000000000000000000000000000000000000000000000000000", jsonSent["data"])
 }
 
@@ -471,7 +503,7 @@ func TestSendTxnNodeAssignNonce(t *testing.T) {
 	tx, err := NewSendTxn(&msg)
 	assert.Nil(err)
 	msgBytes, _ := json.Marshal(&msg)
-	log.Infof(string(msgBytes))
+	log.Info(string(msgBytes))
 
 	rpc := testRPCClient{}
 
@@ -484,8 +516,8 @@ func TestSendTxnNodeAssignNonce(t *testing.T) {
 	assert.Equal(nil, jsonSent["nonce"])
 	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", jsonSent["from"])
 	assert.Equal("0x1c8", jsonSent["gas"])
-	assert.Equal("0x0", jsonSent["gasPrice"])
-	assert.Equal("0x315", jsonSent["value"])
+	assert.Equal("0x315", jsonSent["gasPrice"])
+	assert.Equal("0x0", jsonSent["value"])
 	assert.Regexp("0xe5537abb000000000000000000000000000000000000000000000000000000000000007b000000000000000000000000000000000000000000000000000000000000007b0000000000000000000000000000000000000000000000000000000000000080000000000000000000000000aa983ad2a0e0ed8ac639277f37be42f2a5d2618c00000000000000000000000000000000000000000000000000000000000000036162630000000000000000000000000000000000000000000000000000000000", jsonSent["data"])
 }
 func TestSendTxnInlineBadParamType(t *testing.T) {
@@ -749,3 +781,95 @@ func TestSendTxnPackError(t *testing.T) {
 	_, err := NewSendTxn(&msg)
 	assert.Regexp("cannot use \\[0\\]uint8 as type \\[1\\]uint8 as argument", err.Error())
 }
+
+func TestSendTxnRawData(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	msg.RawData = "0xe5537abb000000000000000000000000000000000000000000000000000000000000007b"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Nonce = "123"
+	msg.Value = "100"
+	msg.Gas = "456"
+	tx, err := NewSendTxn(&msg)
+	assert.Nil(err)
+
+	rpc := testRPCClient{}
+
+	tx.Send(&rpc)
+	assert.Equal("eth_sendTransaction", rpc.capturedMethod)
+	jsonBytesSent, _ := json.Marshal(rpc.capturedArgs[0])
+	var jsonSent map[string]interface{}
+	json.Unmarshal(jsonBytesSent, &jsonSent)
+	assert.Equal("0x64", jsonSent["value"])
+	assert.Equal(msg.RawData, jsonSent["data"])
+}
+
+func TestSendTxnRawDataWithMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	msg.RawData = "0xe5537abb"
+	msg.MethodName = "testFunc"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Gas = "456"
+	_, err := NewSendTxn(&msg)
+	assert.Regexp("Supply either 'rawData', or a method with params, but not both", err.Error())
+}
+
+func TestSendTxnRawDataBadHex(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	msg.RawData = "0xzzzz"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Gas = "456"
+	_, err := NewSendTxn(&msg)
+	assert.Regexp("Supplied value for 'rawData' is not valid hex", err.Error())
+}
+
+func TestNewReplacement(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	msg.Parameters = []interface{}{}
+	msg.MethodName = "testFunc"
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.From = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg.Value = "10"
+	msg.Gas = "456"
+	msg.GasPrice = "100"
+	tx, err := NewSendTxn(&msg)
+	assert.Nil(err)
+
+	replacement, err := tx.NewReplacement(123, big.NewInt(110))
+	assert.Nil(err)
+	assert.Equal(tx.From, replacement.From)
+	assert.Equal(uint64(123), replacement.EthTX.Nonce())
+	assert.Equal(int64(110), replacement.EthTX.GasPrice().Int64())
+	assert.Equal(tx.EthTX.To(), replacement.EthTX.To())
+	assert.Equal(tx.EthTX.Value(), replacement.EthTX.Value())
+	assert.Equal(tx.EthTX.Gas(), replacement.EthTX.Gas())
+	assert.Equal(tx.EthTX.Data(), replacement.EthTX.Data())
+}
+
+func TestNewReplacementContractDeploy(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := &Txn{EthTX: types.NewContractCreation(1, big.NewInt(0), 456, big.NewInt(100), []byte{0x01})}
+	replacement, err := tx.NewReplacement(1, big.NewInt(200))
+	assert.Nil(err)
+	assert.Nil(replacement.EthTX.To())
+	assert.Equal([]byte{0x01}, replacement.EthTX.Data())
+}
+
+func TestNewReplacementRawTX(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := &Txn{RawTX: []byte{0x01}}
+	_, err := tx.NewReplacement(1, big.NewInt(200))
+	assert.EqualError(err, "Pre-signed transactions cannot be replaced")
+}
@@ -0,0 +1,46 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	log "github.com/sirupsen/logrus"
+)
+
+// TxPoolStatus is the number of transactions in the transaction pool of the node
+type TxPoolStatus struct {
+	Pending hexutil.Uint64 `json:"pending"`
+	Queued  hexutil.Uint64 `json:"queued"`
+}
+
+// GetTxPoolStatus gets the number of pending and queued transactions in the
+// transaction pool, which requires the txpool API to be enabled on the node
+func GetTxPoolStatus(rpc RPCClient) (*TxPoolStatus, error) {
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var status TxPoolStatus
+	if err := rpc.CallContext(ctx, &status, "txpool_status"); err != nil {
+		return nil, err
+	}
+	callTime := time.Now().Sub(start)
+	log.Debugf("txpool_status()=pending:%d,queued:%d [%.2fs]", status.Pending, status.Queued, callTime.Seconds())
+	return &status, nil
+}
@@ -0,0 +1,41 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldeth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetTxPoolStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testNodeStatusRPC{results: map[string]string{
+		"txpool_status": `{"pending":"0x10","queued":"0x2"}`,
+	}}
+	status, err := GetTxPoolStatus(r)
+	assert.NoError(err)
+	assert.Equal(uint64(16), uint64(status.Pending))
+	assert.Equal(uint64(2), uint64(status.Queued))
+}
+
+func TestGetTxPoolStatusErr(t *testing.T) {
+	assert := assert.New(t)
+
+	r := &testNodeStatusRPC{errMethod: "txpool_status"}
+	_, err := GetTxPoolStatus(r)
+	assert.EqualError(err, "pop")
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+)
+
+const adminAssignmentPath = "/admin/assignment"
+
+const (
+	// AssignmentJoining is the state of the consumer before its first rebalance completes
+	AssignmentJoining = "joining"
+	// AssignmentRebalancing is the state of the consumer while the group rebalances
+	AssignmentRebalancing = "rebalancing"
+	// AssignmentAssigned is the state of the consumer once the group has rebalanced
+	AssignmentAssigned = "assigned"
+	// AssignmentFailed is the state of the consumer after a rebalance fails
+	AssignmentFailed = "failed"
+)
+
+// ConsumerAssignment describes the topic partitions currently assigned to this
+// member of the consumer group. The group member ID is not exposed by the
+// consumer, so the client ID identifies the member
+type ConsumerAssignment struct {
+	ConsumerGroup string             `json:"consumerGroup"`
+	ClientID      string             `json:"clientID"`
+	State         string             `json:"state"`
+	Partitions    map[string][]int32 `json:"partitions"`
+	Rebalances    int                `json:"rebalances"`
+	LastRebalance *time.Time         `json:"lastRebalance,omitempty"`
+}
+
+// consumerAssignment tracks the assignment from the rebalance notifications of the consumer
+type consumerAssignment struct {
+	lock       sync.Mutex
+	assignment ConsumerAssignment
+}
+
+func newConsumerAssignment() *consumerAssignment {
+	return &consumerAssignment{
+		assignment: ConsumerAssignment{
+			State:      AssignmentJoining,
+			Partitions: map[string][]int32{},
+		},
+	}
+}
+
+// connected records the consumer group, and the client ID which is generated
+// if not configured
+func (a *consumerAssignment) connected(consumerGroup, clientID string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.assignment.ConsumerGroup = consumerGroup
+	a.assignment.ClientID = clientID
+}
+
+// rebalanced updates the assignment from a notification. The consumer releases
+// its partitions before each rebalance, so none are assigned until it completes
+func (a *consumerAssignment) rebalanced(ntf *cluster.Notification) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.assignment.Partitions = map[string][]int32{}
+	switch ntf.Type {
+	case cluster.RebalanceStart:
+		a.assignment.State = AssignmentRebalancing
+		return
+	case cluster.RebalanceError:
+		a.assignment.State = AssignmentFailed
+	default:
+		a.assignment.State = AssignmentAssigned
+		a.assignment.Partitions = copyPartitions(ntf.Current)
+	}
+	now := time.Now().UTC()
+	a.assignment.LastRebalance = &now
+	a.assignment.Rebalances++
+}
+
+func copyPartitions(partitions map[string][]int32) map[string][]int32 {
+	copied := make(map[string][]int32, len(partitions))
+	for topic, topicPartitions := range partitions {
+		copied[topic] = append([]int32{}, topicPartitions...)
+	}
+	return copied
+}
+
+// get returns a copy of the current assignment
+func (a *consumerAssignment) get() *ConsumerAssignment {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	assignment := a.assignment
+	assignment.Partitions = copyPartitions(a.assignment.Partitions)
+	return &assignment
+}
+
+// adminAssignmentHandler accepts GET requests to /admin/assignment, returning
+// the partitions assigned to this bridge, to check how they are distributed
+// across the bridges in the consumer group when scaling
+func (k *KafkaBridge) adminAssignmentHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.Header().Set("Allow", "GET")
+		res.WriteHeader(405)
+		return
+	}
+	if !kldutils.AdminAuthorized(res, req, k.conf.AdminToken) {
+		return
+	}
+	kldutils.AdminReply(res, 200, k.kafka.Assignment())
+}
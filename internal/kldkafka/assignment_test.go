@@ -0,0 +1,106 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	cluster "github.com/bsm/sarama-cluster"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerAssignmentRebalances(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newConsumerAssignment()
+	a.connected("group1", "client1")
+	assignment := a.get()
+	assert.Equal("group1", assignment.ConsumerGroup)
+	assert.Equal("client1", assignment.ClientID)
+	assert.Equal(AssignmentJoining, assignment.State)
+	assert.Nil(assignment.LastRebalance)
+
+	current := map[string][]int32{"in-topic": {0, 2}}
+	a.rebalanced(&cluster.Notification{Type: cluster.RebalanceStart})
+	assert.Equal(AssignmentRebalancing, a.get().State)
+	a.rebalanced(&cluster.Notification{Type: cluster.RebalanceOK, Current: current})
+	assignment = a.get()
+	assert.Equal(AssignmentAssigned, assignment.State)
+	assert.Equal(map[string][]int32{"in-topic": {0, 2}}, assignment.Partitions)
+	assert.Equal(1, assignment.Rebalances)
+	assert.NotNil(assignment.LastRebalance)
+
+	// The assignment returned is a copy
+	current["in-topic"][0] = 1
+	assignment.Partitions["in-topic"][1] = 3
+	assert.Equal(map[string][]int32{"in-topic": {0, 2}}, a.get().Partitions)
+
+	// Partitions are released while rebalancing, and remain so if it fails
+	a.rebalanced(&cluster.Notification{Type: cluster.RebalanceStart, Current: current})
+	assert.Empty(a.get().Partitions)
+	a.rebalanced(&cluster.Notification{Type: cluster.RebalanceError, Current: current})
+	assignment = a.get()
+	assert.Equal(AssignmentFailed, assignment.State)
+	assert.Empty(assignment.Partitions)
+	assert.Equal(2, assignment.Rebalances)
+}
+
+func TestConsumerAssignmentFromNotifications(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	k, wg, err := startTestKafkaCommon(assert, append(kcMinWorkingArgs, "-i", "client1"), f)
+	if err != nil {
+		return
+	}
+
+	f.Consumer.MockNotifications <- &cluster.Notification{Type: cluster.RebalanceOK, Current: map[string][]int32{"in-topic": {1}}}
+	for k.Assignment().State != AssignmentAssigned {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assignment := k.Assignment()
+	assert.Equal("test-group", assignment.ConsumerGroup)
+	assert.Equal("client1", assignment.ClientID)
+	assert.Equal(map[string][]int32{"in-topic": {1}}, assignment.Partitions)
+
+	// Shut down
+	k.signals <- os.Interrupt
+	wg.Wait()
+}
+
+func TestAdminAssignmentHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.AdminToken = "secret"
+
+	res := httptest.NewRecorder()
+	k.adminAssignmentHandler(res, httptest.NewRequest("POST", "/admin/assignment", nil))
+	assert.Equal(405, res.Code)
+
+	res = httptest.NewRecorder()
+	k.adminAssignmentHandler(res, httptest.NewRequest("GET", "/admin/assignment", nil))
+	assert.Equal(401, res.Code)
+
+	req := httptest.NewRequest("GET", "/admin/assignment", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminAssignmentHandler(res, req)
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"consumerGroup":"","clientID":"","state":"joining","partitions":{},"rebalances":0}`, res.Body.String())
+}
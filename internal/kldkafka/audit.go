@@ -0,0 +1,305 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// AuditEventSubmitted is recorded when a transaction is sent to the node
+	AuditEventSubmitted = "submitted"
+	// AuditEventReplaced is recorded when a pending transaction is replaced with a higher gas price
+	AuditEventReplaced = "replaced"
+	// AuditEventReply is recorded when the final reply is sent for a transaction request
+	AuditEventReply = "reply"
+	// DefaultAuditMaxSize is the size in MB an audit file can grow to before it is rotated
+	DefaultAuditMaxSize = 100
+	// DefaultAuditMaxFiles is the number of rotated audit files that are kept
+	DefaultAuditMaxFiles = 5
+)
+
+// auditMsgTypes are the requests that submit transactions, so are audited
+var auditMsgTypes = map[string]bool{
+	kldmessages.MsgTypeDeployContract:     true,
+	kldmessages.MsgTypeSendTransaction:    true,
+	kldmessages.MsgTypeSendRawTransaction: true,
+	kldmessages.MsgTypeReplaceTransaction: true,
+}
+
+// AuditConf configures the audit trail of transactions, written as JSON lines
+// to a file and/or a Kafka topic, independently of the operational logs
+type AuditConf struct {
+	File     string `json:"file,omitempty"`
+	MaxSize  int    `json:"maxSize,omitempty"` // MB
+	MaxFiles int    `json:"maxFiles,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// auditRecord is an entry in the audit trail. Who submitted the transaction is
+// identified by the account and tenant headers of the request
+type auditRecord struct {
+	Time                    string          `json:"time"`
+	Event                   string          `json:"event"`
+	RequestID               string          `json:"requestId,omitempty"`
+	MsgType                 string          `json:"msgType"`
+	Account                 string          `json:"account,omitempty"`
+	Tenant                  string          `json:"tenant,omitempty"`
+	Chain                   string          `json:"chain,omitempty"`
+	From                    string          `json:"from,omitempty"`
+	To                      string          `json:"to,omitempty"`
+	Method                  string          `json:"method,omitempty"`
+	Params                  json.RawMessage `json:"params,omitempty"`
+	Nonce                   string          `json:"nonce,omitempty"`
+	GasPrice                string          `json:"gasPrice,omitempty"`
+	TransactionHash         string          `json:"transactionHash,omitempty"`
+	OriginalTransactionHash string          `json:"originalTransactionHash,omitempty"`
+	Status                  string          `json:"status,omitempty"`
+	ErrorCode               int             `json:"errorCode,omitempty"`
+	Error                   string          `json:"error,omitempty"`
+}
+
+// auditRequest is the subset of a transaction request recorded in the audit trail
+type auditRequest struct {
+	From       string                `json:"from"`
+	To         string                `json:"to"`
+	Method     kldmessages.ABIMethod `json:"method"`
+	MethodName string                `json:"methodName"`
+	Template   string                `json:"template"`
+	Params     json.RawMessage       `json:"params"`
+}
+
+// auditMetadata marks audit records in the producer loops, as unlike
+// replies they are not tied to a message in-flight
+type auditMetadata struct {
+	reqID string
+}
+
+// auditLog writes the audit trail. It is shared by the bridge, which records
+// the replies, and the processors, which record the transactions they submit
+type auditLog struct {
+	lock         sync.Mutex
+	file         *auditFile
+	topic        string
+	producer     KafkaProducer
+	redactFields []string
+}
+
+func newAuditLog() *auditLog {
+	return &auditLog{}
+}
+
+// init validates the configuration, and opens the audit file if there is one
+func (a *auditLog) init(conf *AuditConf, redactFields []string) (err error) {
+	if conf.MaxSize < 0 || conf.MaxFiles < 0 {
+		return fmt.Errorf("Audit file maximum size and files must not be negative")
+	}
+	if conf.Topic != "" && !kafkaTopicName.MatchString(conf.Topic) {
+		return fmt.Errorf("Invalid audit topic '%s'", conf.Topic)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if conf.File != "" {
+		maxSize := conf.MaxSize
+		if maxSize == 0 {
+			maxSize = DefaultAuditMaxSize
+		}
+		maxFiles := conf.MaxFiles
+		if maxFiles == 0 {
+			maxFiles = DefaultAuditMaxFiles
+		}
+		if a.file, err = openAuditFile(conf.File, int64(maxSize)*1024*1024, maxFiles); err != nil {
+			return
+		}
+	}
+	a.topic = conf.Topic
+	a.redactFields = redactFields
+	return nil
+}
+
+// setProducer supplies the producer used to send audit records to the audit topic
+func (a *auditLog) setProducer(producer KafkaProducer) {
+	a.lock.Lock()
+	a.producer = producer
+	a.lock.Unlock()
+}
+
+func (a *auditLog) enabled(msgContext MsgContext) bool {
+	return a != nil && (a.file != nil || a.topic != "") && auditMsgTypes[msgContext.Headers().MsgType]
+}
+
+// newRecord builds an audit record with the details of the request, redacting
+// the configured sensitive fields from the params
+func (a *auditLog) newRecord(event string, msgContext MsgContext) *auditRecord {
+	headers := msgContext.Headers()
+	record := &auditRecord{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Event:     event,
+		RequestID: headers.ID,
+		MsgType:   headers.MsgType,
+		Account:   headers.Account,
+		Tenant:    headers.Tenant,
+		Chain:     headers.Chain,
+	}
+	var req auditRequest
+	if err := msgContext.Unmarshal(&req); err == nil {
+		record.From = req.From
+		record.To = req.To
+		record.Method = req.Method.Name
+		if record.Method == "" {
+			record.Method = req.MethodName
+		}
+		if record.Method == "" && req.Template != "" {
+			record.Method = "template:" + req.Template
+		}
+		if len(req.Params) > 0 {
+			record.Params = json.RawMessage(kldutils.RedactJSON(req.Params, a.redactFields))
+		}
+	}
+	return record
+}
+
+// recordTX records a transaction sent to the node, using the details of the
+// transaction itself over those in the request
+func (a *auditLog) recordTX(event string, msgContext MsgContext, tx *kldeth.Txn, originalTXHash string) {
+	if !a.enabled(msgContext) {
+		return
+	}
+	record := a.newRecord(event, msgContext)
+	record.From = tx.From.Hex()
+	if to := tx.EthTX.To(); to != nil {
+		record.To = to.Hex()
+	}
+	record.Nonce = fmt.Sprintf("%d", tx.EthTX.Nonce())
+	record.GasPrice = tx.EthTX.GasPrice().Text(10)
+	record.TransactionHash = tx.Hash
+	record.OriginalTransactionHash = originalTXHash
+	a.write(record)
+}
+
+// recordReply records the final reply to a transaction request, with its outcome
+func (a *auditLog) recordReply(c *msgContext, replyMessage kldmessages.ReplyWithHeaders) {
+	if !a.enabled(c) {
+		return
+	}
+	record := a.newRecord(AuditEventReply, c)
+	record.Status = c.replyType
+	switch reply := replyMessage.(type) {
+	case *kldmessages.TransactionReceipt:
+		if reply.TransactionHash != nil {
+			record.TransactionHash = reply.TransactionHash.Hex()
+		}
+	case *kldmessages.TransactionReplaced:
+		record.TransactionHash = reply.TransactionHash
+		record.OriginalTransactionHash = reply.OriginalTransactionHash
+	case *kldmessages.ErrorReply:
+		record.TransactionHash = reply.TXHash
+		record.ErrorCode = c.errorStatus
+		record.Error = reply.ErrorMessage
+	}
+	a.write(record)
+}
+
+// write sends a record to each of the configured sinks. Failures are logged,
+// as they must not affect the processing of the request. The lock is released
+// before sending to the producer, which blocks while its input is full
+func (a *auditLog) write(record *auditRecord) {
+	recordBytes, _ := json.Marshal(record)
+	a.lock.Lock()
+	if a.file != nil {
+		if err := a.file.write(append(recordBytes, '\n')); err != nil {
+			log.Errorf("Failed to write audit record for request %s to %s: %s", record.RequestID, a.file.path, err)
+		}
+	}
+	producer := a.producer
+	a.lock.Unlock()
+	if a.topic != "" {
+		if producer == nil {
+			log.Errorf("Failed to send audit record for request %s: Kafka producer not started", record.RequestID)
+			return
+		}
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic:     a.topic,
+			Key:       sarama.StringEncoder(record.RequestID),
+			Partition: autoPartition,
+			Value:     sarama.ByteEncoder(recordBytes),
+			Metadata:  &auditMetadata{reqID: record.RequestID},
+		}
+	}
+}
+
+// auditFile is an append-only file of audit records, rotated when it reaches
+// the maximum size to path.1, path.2 and so on, keeping up to maxFiles of them
+type auditFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func openAuditFile(path string, maxSize int64, maxFiles int) (*auditFile, error) {
+	f := &auditFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *auditFile) open() (err error) {
+	if f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+		return fmt.Errorf("Failed to open audit file %s: %s", f.path, err)
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		f.file.Close()
+		return fmt.Errorf("Failed to open audit file %s: %s", f.path, err)
+	}
+	f.size = info.Size()
+	return nil
+}
+
+func (f *auditFile) write(recordBytes []byte) error {
+	if f.size > 0 && f.size+int64(len(recordBytes)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(recordBytes)
+	f.size += int64(n)
+	return err
+}
+
+func (f *auditFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		log.Errorf("Failed to rotate audit file %s: %s", f.path, err)
+	}
+	return f.open()
+}
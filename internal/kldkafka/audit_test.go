@@ -0,0 +1,171 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditRecords(assert *assert.Assertions, file string) []*auditRecord {
+	b, err := ioutil.ReadFile(file)
+	assert.NoError(err)
+	var records []*auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var record auditRecord
+		assert.NoError(json.Unmarshal([]byte(line), &record))
+		records = append(records, &record)
+	}
+	return records
+}
+
+func TestAuditInitBadConf(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAuditLog()
+	assert.EqualError(a.init(&AuditConf{MaxSize: -1}, nil), "Audit file maximum size and files must not be negative")
+	assert.EqualError(a.init(&AuditConf{Topic: "bad topic"}, nil), "Invalid audit topic 'bad topic'")
+	assert.Regexp("Failed to open audit file", a.init(&AuditConf{File: "/nonexistent/audit.log"}, nil))
+}
+
+func TestAuditDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAuditLog()
+	assert.NoError(a.init(&AuditConf{}, nil))
+	assert.False(a.enabled(&testMsgContext{jsonMsg: goodSendTxnJSON}))
+}
+
+func TestAuditFileRotate(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "ethconnect-audit")
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "audit.log")
+
+	f, err := openAuditFile(file, 10, 2)
+	assert.NoError(err)
+	for _, record := range []string{"record1\n", "record2\n", "record3\n", "record4\n"} {
+		assert.NoError(f.write([]byte(record)))
+	}
+	f.file.Close()
+
+	b, _ := ioutil.ReadFile(file)
+	assert.Equal("record4\n", string(b))
+	b, _ = ioutil.ReadFile(file + ".1")
+	assert.Equal("record3\n", string(b))
+	b, _ = ioutil.ReadFile(file + ".2")
+	assert.Equal("record2\n", string(b))
+	_, err = os.Stat(file + ".3")
+	assert.True(os.IsNotExist(err))
+
+	// Appends to the existing file on restart
+	f, err = openAuditFile(file, 100, 2)
+	assert.NoError(err)
+	assert.NoError(f.write([]byte("record5\n")))
+	f.file.Close()
+	b, _ = ioutil.ReadFile(file)
+	assert.Equal("record4\nrecord5\n", string(b))
+}
+
+func TestAuditRecordRedactsParams(t *testing.T) {
+	assert := assert.New(t)
+
+	a := newAuditLog()
+	assert.NoError(a.init(&AuditConf{Topic: "audit"}, []string{"password"}))
+	record := a.newRecord(AuditEventSubmitted, &testMsgContext{
+		jsonMsg: `{"headers":{"type":"SendTransaction","id":"req1","account":"user1"},` +
+			`"from":"` + testFromAddr + `","methodName":"set","params":[{"password":"secret","value":1}]}`,
+	})
+	assert.Equal("req1", record.RequestID)
+	assert.Equal("user1", record.Account)
+	assert.Equal("set", record.Method)
+	assert.Equal(`[{"password":"***","value":1}]`, string(record.Params))
+}
+
+func TestAuditSendTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "ethconnect-audit")
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "audit.log")
+
+	txHash := "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.auditLog.init(&AuditConf{File: file}, nil))
+	testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	testRPC := goodMessageRPC()
+	testRPC.ethSendTransactionResult = txHash
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	txnWG := &msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg
+	txnWG.Wait()
+	msgProcessor.auditLog.file.file.Close()
+
+	records := readAuditRecords(assert, file)
+	assert.Equal(1, len(records))
+	assert.Equal(AuditEventSubmitted, records[0].Event)
+	assert.Equal("SendTransaction", records[0].MsgType)
+	assert.Equal(testFromAddr, records[0].From)
+	assert.Equal("test", records[0].Method)
+	assert.Equal(txHash, records[0].TransactionHash)
+	assert.NotEmpty(records[0].Nonce)
+	assert.NotEmpty(records[0].GasPrice)
+}
+
+func TestAuditReplyToTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	assert.NoError(k.auditLog.init(&AuditConf{Topic: "audit"}, nil))
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value: []byte(`{"headers":{"type":"SendTransaction","id":"req1"}}`),
+	}
+	msgContext1 := <-processor.messages
+	go msgContext1.SendErrorReplyWithTX(500, fmt.Errorf("pop"), "0x12345")
+
+	auditKafkaMsg := <-mockProducer.MockInput
+	assert.Equal("audit", auditKafkaMsg.Topic)
+	assert.IsType(&auditMetadata{}, auditKafkaMsg.Metadata)
+	auditBytes, _ := auditKafkaMsg.Value.Encode()
+	var record auditRecord
+	assert.NoError(json.Unmarshal(auditBytes, &record))
+	assert.Equal(AuditEventReply, record.Event)
+	assert.Equal("req1", record.RequestID)
+	assert.Equal(kldmessages.MsgTypeError, record.Status)
+	assert.Equal(500, record.ErrorCode)
+	assert.Equal("pop", record.Error)
+	assert.Equal("0x12345", record.TransactionHash)
+	mockProducer.MockSuccesses <- auditKafkaMsg
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+	assert.Empty(k.inFlight)
+}
@@ -0,0 +1,535 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+var avroPrimitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+// avroSchema is a parsed Avro schema, for the binary encoding of values in the
+// generic form produced by encoding/json. Logical types use their underlying type,
+// and bytes/fixed values are represented as 0x prefixed hex strings, as binary
+// data is not valid as a JSON string
+type avroSchema struct {
+	typeName string
+	name     string // full name of a record, enum or fixed
+	fields   []*avroField
+	symbols  []string
+	items    *avroSchema // the items of an array, or values of a map
+	branches []*avroSchema
+	size     int
+}
+
+type avroField struct {
+	name       string
+	schema     *avroSchema
+	hasDefault bool
+	defaultVal interface{}
+}
+
+// avroParser tracks the named types defined so far, which can be referenced by
+// later parts of the schema (including recursively from their own fields)
+type avroParser struct {
+	named map[string]*avroSchema
+}
+
+// parseAvroSchema parses an Avro schema in its JSON form
+func parseAvroSchema(schemaJSON string) (*avroSchema, error) {
+	var def interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &def); err != nil {
+		return nil, fmt.Errorf("Invalid Avro schema: %s", err)
+	}
+	p := &avroParser{named: make(map[string]*avroSchema)}
+	return p.parse(def, "")
+}
+
+func (p *avroParser) parse(def interface{}, namespace string) (*avroSchema, error) {
+	switch d := def.(type) {
+	case string:
+		if avroPrimitives[d] {
+			return &avroSchema{typeName: d}, nil
+		}
+		if named := p.lookup(d, namespace); named != nil {
+			return named, nil
+		}
+		return nil, fmt.Errorf("Unknown Avro type '%s'", d)
+	case []interface{}:
+		union := &avroSchema{typeName: "union"}
+		for _, branchDef := range d {
+			branch, err := p.parse(branchDef, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if branch.typeName == "union" {
+				return nil, fmt.Errorf("Avro unions cannot contain other unions")
+			}
+			union.branches = append(union.branches, branch)
+		}
+		if len(union.branches) == 0 {
+			return nil, fmt.Errorf("Avro unions must have at least one type")
+		}
+		return union, nil
+	case map[string]interface{}:
+		typeName, isString := d["type"].(string)
+		if !isString {
+			return p.parse(d["type"], namespace)
+		}
+		switch typeName {
+		case "record", "error":
+			return p.parseRecord(d, namespace)
+		case "enum":
+			return p.parseEnum(d, namespace)
+		case "fixed":
+			return p.parseFixed(d, namespace)
+		case "array", "map":
+			itemsKey := "items"
+			if typeName == "map" {
+				itemsKey = "values"
+			}
+			items, err := p.parse(d[itemsKey], namespace)
+			if err != nil {
+				return nil, err
+			}
+			return &avroSchema{typeName: typeName, items: items}, nil
+		default:
+			// A primitive type with attributes, such as a logicalType
+			return p.parse(typeName, namespace)
+		}
+	}
+	return nil, fmt.Errorf("Invalid Avro schema: %v", def)
+}
+
+// define registers a named type, returning the namespace for the types inside it
+func (p *avroParser) define(d map[string]interface{}, typeName, namespace string) (*avroSchema, string, error) {
+	name, _ := d["name"].(string)
+	if name == "" {
+		return nil, "", fmt.Errorf("Avro %s must have a name", typeName)
+	}
+	if ns, ok := d["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	fullName := name
+	if !strings.Contains(name, ".") && namespace != "" {
+		fullName = namespace + "." + name
+	}
+	if _, exists := p.named[fullName]; exists {
+		return nil, "", fmt.Errorf("Avro type '%s' is defined more than once", fullName)
+	}
+	schema := &avroSchema{typeName: typeName, name: fullName}
+	p.named[fullName] = schema
+	namespace = ""
+	if idx := strings.LastIndex(fullName, "."); idx >= 0 {
+		namespace = fullName[:idx]
+	}
+	return schema, namespace, nil
+}
+
+func (p *avroParser) lookup(name, namespace string) *avroSchema {
+	if !strings.Contains(name, ".") && namespace != "" {
+		if named, ok := p.named[namespace+"."+name]; ok {
+			return named
+		}
+	}
+	return p.named[name]
+}
+
+func (p *avroParser) parseRecord(d map[string]interface{}, namespace string) (*avroSchema, error) {
+	schema, namespace, err := p.define(d, "record", namespace)
+	if err != nil {
+		return nil, err
+	}
+	fieldDefs, ok := d["fields"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Avro record '%s' must have a list of fields", schema.name)
+	}
+	for _, fd := range fieldDefs {
+		fieldDef, _ := fd.(map[string]interface{})
+		fieldName, _ := fieldDef["name"].(string)
+		if fieldName == "" {
+			return nil, fmt.Errorf("Avro record '%s' has a field without a name", schema.name)
+		}
+		fieldSchema, err := p.parse(fieldDef["type"], namespace)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", schema.name, fieldName, err)
+		}
+		field := &avroField{name: fieldName, schema: fieldSchema}
+		field.defaultVal, field.hasDefault = fieldDef["default"]
+		schema.fields = append(schema.fields, field)
+	}
+	return schema, nil
+}
+
+func (p *avroParser) parseEnum(d map[string]interface{}, namespace string) (*avroSchema, error) {
+	schema, _, err := p.define(d, "enum", namespace)
+	if err != nil {
+		return nil, err
+	}
+	symbols, _ := d["symbols"].([]interface{})
+	for _, s := range symbols {
+		symbol, ok := s.(string)
+		if !ok {
+			return nil, fmt.Errorf("Avro enum '%s' has a symbol that is not a string", schema.name)
+		}
+		schema.symbols = append(schema.symbols, symbol)
+	}
+	if len(schema.symbols) == 0 {
+		return nil, fmt.Errorf("Avro enum '%s' must have symbols", schema.name)
+	}
+	return schema, nil
+}
+
+func (p *avroParser) parseFixed(d map[string]interface{}, namespace string) (*avroSchema, error) {
+	schema, _, err := p.define(d, "fixed", namespace)
+	if err != nil {
+		return nil, err
+	}
+	size, ok := d["size"].(float64)
+	if !ok || size < 0 || size != math.Trunc(size) {
+		return nil, fmt.Errorf("Avro fixed '%s' must have a non-negative integer size", schema.name)
+	}
+	schema.size = int(size)
+	return schema, nil
+}
+
+// avroReader decodes Avro binary data
+type avroReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *avroReader) readLong() (int64, error) {
+	v, n := binary.Varint(r.buf[r.pos:])
+	if n <= 0 {
+		return 0, fmt.Errorf("Invalid Avro data at offset %d", r.pos)
+	}
+	r.pos += n
+	return v, nil
+}
+
+func (r *avroReader) readFixed(size int) ([]byte, error) {
+	if size < 0 || size > len(r.buf)-r.pos {
+		return nil, fmt.Errorf("Avro data is too short at offset %d", r.pos)
+	}
+	b := r.buf[r.pos : r.pos+size]
+	r.pos += size
+	return b, nil
+}
+
+func (r *avroReader) readBytes() ([]byte, error) {
+	size, err := r.readLong()
+	if err != nil {
+		return nil, err
+	}
+	if size > int64(len(r.buf)) {
+		return nil, fmt.Errorf("Avro data is too short at offset %d", r.pos)
+	}
+	return r.readFixed(int(size))
+}
+
+// readBlocks reads the blocks of an array or map, calling fn for each item
+func (r *avroReader) readBlocks(fn func() error) error {
+	for {
+		count, err := r.readLong()
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return nil
+		}
+		if count < 0 {
+			// A negative count is followed by the size of the block in bytes
+			count = -count
+			if _, err = r.readLong(); err != nil {
+				return err
+			}
+		}
+		for i := int64(0); i < count; i++ {
+			if err = fn(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decodeAvro decodes a complete Avro binary value into its generic form
+func decodeAvro(schema *avroSchema, data []byte) (interface{}, error) {
+	r := &avroReader{buf: data}
+	val, err := r.read(schema)
+	if err == nil && r.pos != len(data) {
+		err = fmt.Errorf("Avro data has %d unexpected trailing bytes", len(data)-r.pos)
+	}
+	return val, err
+}
+
+func (r *avroReader) read(schema *avroSchema) (interface{}, error) {
+	switch schema.typeName {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := r.readFixed(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		v, err := r.readLong()
+		if err == nil && schema.typeName == "int" && (v < math.MinInt32 || v > math.MaxInt32) {
+			err = fmt.Errorf("Avro int %d is out of range", v)
+		}
+		return v, err
+	case "float":
+		b, err := r.readFixed(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := r.readFixed(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "string":
+		b, err := r.readBytes()
+		return string(b), err
+	case "bytes":
+		b, err := r.readBytes()
+		if err != nil {
+			return nil, err
+		}
+		return hexutil.Encode(b), nil
+	case "fixed":
+		b, err := r.readFixed(schema.size)
+		if err != nil {
+			return nil, err
+		}
+		return hexutil.Encode(b), nil
+	case "enum":
+		idx, err := r.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= int64(len(schema.symbols)) {
+			return nil, fmt.Errorf("Avro enum '%s' has no symbol %d", schema.name, idx)
+		}
+		return schema.symbols[idx], nil
+	case "union":
+		idx, err := r.readLong()
+		if err != nil {
+			return nil, err
+		}
+		if idx < 0 || idx >= int64(len(schema.branches)) {
+			return nil, fmt.Errorf("Avro union has no type %d", idx)
+		}
+		return r.read(schema.branches[idx])
+	case "array":
+		arr := []interface{}{}
+		err := r.readBlocks(func() error {
+			item, err := r.read(schema.items)
+			arr = append(arr, item)
+			return err
+		})
+		return arr, err
+	case "map":
+		m := make(map[string]interface{})
+		err := r.readBlocks(func() error {
+			key, err := r.readBytes()
+			if err != nil {
+				return err
+			}
+			m[string(key)], err = r.read(schema.items)
+			return err
+		})
+		return m, err
+	default: // record
+		m := make(map[string]interface{}, len(schema.fields))
+		for _, field := range schema.fields {
+			val, err := r.read(field.schema)
+			if err != nil {
+				return nil, err
+			}
+			m[field.name] = val
+		}
+		return m, nil
+	}
+}
+
+// encodeAvro encodes a value in its generic form into Avro binary. Fields of
+// records that are missing from the value use the default from the schema,
+// or null, and values that are not in the schema are not encoded
+func encodeAvro(schema *avroSchema, val interface{}) ([]byte, error) {
+	return appendAvro(nil, schema, val, "$")
+}
+
+func appendAvro(buf []byte, schema *avroSchema, val interface{}, path string) ([]byte, error) {
+	switch schema.typeName {
+	case "null":
+		if val != nil {
+			return nil, fmt.Errorf("%s: must be null", path)
+		}
+		return buf, nil
+	case "boolean":
+		b, ok := val.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a boolean", path)
+		}
+		if b {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case "int", "long":
+		v, ok := avroInteger(val)
+		if !ok || (schema.typeName == "int" && (v < math.MinInt32 || v > math.MaxInt32)) {
+			return nil, fmt.Errorf("%s: must be an Avro %s", path, schema.typeName)
+		}
+		return binary.AppendVarint(buf, v), nil
+	case "float", "double":
+		v, ok := avroNumber(val)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a number", path)
+		}
+		if schema.typeName == "float" {
+			return binary.LittleEndian.AppendUint32(buf, math.Float32bits(float32(v))), nil
+		}
+		return binary.LittleEndian.AppendUint64(buf, math.Float64bits(v)), nil
+	case "string":
+		s, ok := val.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s: must be a string", path)
+		}
+		return append(binary.AppendVarint(buf, int64(len(s))), s...), nil
+	case "bytes":
+		s, _ := val.(string)
+		b, err := hexutil.Decode(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: must be a hex string", path)
+		}
+		return append(binary.AppendVarint(buf, int64(len(b))), b...), nil
+	case "fixed":
+		s, _ := val.(string)
+		b, err := hexutil.Decode(s)
+		if err != nil || len(b) != schema.size {
+			return nil, fmt.Errorf("%s: must be a hex string of %d bytes", path, schema.size)
+		}
+		return append(buf, b...), nil
+	case "enum":
+		s, _ := val.(string)
+		for i, symbol := range schema.symbols {
+			if s == symbol {
+				return binary.AppendVarint(buf, int64(i)), nil
+			}
+		}
+		return nil, fmt.Errorf("%s: must be one of the symbols of Avro enum '%s'", path, schema.name)
+	case "union":
+		// The first type in the union that the value can be encoded as is used
+		for i, branch := range schema.branches {
+			if branchBuf, err := appendAvro(binary.AppendVarint(nil, int64(i)), branch, val, path); err == nil {
+				return append(buf, branchBuf...), nil
+			}
+		}
+		return nil, fmt.Errorf("%s: does not match any type in the Avro union", path)
+	case "array":
+		arr, ok := val.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an array", path)
+		}
+		var err error
+		if len(arr) > 0 {
+			buf = binary.AppendVarint(buf, int64(len(arr)))
+			for i, item := range arr {
+				if buf, err = appendAvro(buf, schema.items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(buf, 0), nil
+	case "map":
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an object", path)
+		}
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var err error
+		if len(keys) > 0 {
+			buf = binary.AppendVarint(buf, int64(len(keys)))
+			for _, key := range keys {
+				buf = append(binary.AppendVarint(buf, int64(len(key))), key...)
+				if buf, err = appendAvro(buf, schema.items, m[key], path+"."+key); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(buf, 0), nil
+	default: // record
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: must be an object", path)
+		}
+		var err error
+		for _, field := range schema.fields {
+			fieldVal, exists := m[field.name]
+			if !exists && field.hasDefault {
+				fieldVal = field.defaultVal
+			}
+			if buf, err = appendAvro(buf, field.schema, fieldVal, path+"."+field.name); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+}
+
+// avroInteger accepts integers from JSON, including defaults in the schema
+func avroInteger(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return i, err == nil
+	case float64:
+		return int64(v), v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+func avroNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testAvroSchema = `{
+	"type": "record",
+	"name": "Request",
+	"namespace": "io.kaleido",
+	"fields": [
+		{"name": "headers", "type": {
+			"type": "record",
+			"name": "Headers",
+			"fields": [
+				{"name": "type", "type": {"type": "enum", "name": "MsgType", "symbols": ["SendTransaction", "DeployContract"]}},
+				{"name": "id", "type": ["null", "string"], "default": null}
+			]
+		}},
+		{"name": "from", "type": "string"},
+		{"name": "nonce", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "gas", "type": "int", "default": 21000},
+		{"name": "params", "type": {"type": "array", "items": ["string", "double", "boolean"]}},
+		{"name": "ctx", "type": {"type": "map", "values": "float"}},
+		{"name": "salt", "type": {"type": "fixed", "name": "Salt", "size": 2}},
+		{"name": "data", "type": "bytes"},
+		{"name": "next", "type": ["null", "Headers"]}
+	]
+}`
+
+func decodeTestJSON(jsonStr string) interface{} {
+	var val interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(jsonStr)))
+	decoder.UseNumber()
+	decoder.Decode(&val)
+	return val
+}
+
+func TestAvroRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, err := parseAvroSchema(testAvroSchema)
+	assert.NoError(err)
+
+	avroBytes, err := encodeAvro(schema, decodeTestJSON(`{
+		"headers": {"type": "DeployContract"},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1",
+		"nonce": -12345678901,
+		"params": ["a", 1.5, true],
+		"ctx": {"b": 0.5, "a": 2},
+		"salt": "0xab01",
+		"data": "0x",
+		"next": {"type": "SendTransaction", "id": "abc"},
+		"ignored": "value"
+	}`))
+	assert.NoError(err)
+
+	val, err := decodeAvro(schema, avroBytes)
+	assert.NoError(err)
+	jsonBytes, _ := json.Marshal(val)
+	assert.JSONEq(`{
+		"headers": {"type": "DeployContract", "id": null},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1",
+		"nonce": -12345678901,
+		"gas": 21000,
+		"params": ["a", 1.5, true],
+		"ctx": {"a": 2, "b": 0.5},
+		"salt": "0xab01",
+		"data": "0x",
+		"next": {"type": "SendTransaction", "id": "abc"}
+	}`, string(jsonBytes))
+}
+
+func TestAvroEncoding(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, err := parseAvroSchema(`{"type":"record","name":"r","fields":[
+		{"name":"a","type":"long"},
+		{"name":"b","type":"string"},
+		{"name":"c","type":{"type":"array","items":"int"}}
+	]}`)
+	assert.NoError(err)
+	avroBytes, err := encodeAvro(schema, decodeTestJSON(`{"a":-2,"b":"hi","c":[64]}`))
+	assert.NoError(err)
+	assert.Equal([]byte{0x03, 0x04, 'h', 'i', 0x02, 0x80, 0x01, 0x00}, avroBytes)
+}
+
+func TestAvroBytesAsHex(t *testing.T) {
+	assert := assert.New(t)
+
+	// Binary data that is not valid UTF-8 survives the conversion to JSON
+	schema := mustParseAvroSchema(`"bytes"`)
+	avroBytes, err := encodeAvro(schema, "0xff00")
+	assert.NoError(err)
+	assert.Equal([]byte{0x04, 0xff, 0x00}, avroBytes)
+	val, err := decodeAvro(schema, avroBytes)
+	assert.NoError(err)
+	assert.Equal("0xff00", val)
+}
+
+func TestAvroDecodeBlockWithSize(t *testing.T) {
+	assert := assert.New(t)
+
+	schema, _ := parseAvroSchema(`{"type":"array","items":"boolean"}`)
+	// A count of -2 is followed by the block size, then the items
+	val, err := decodeAvro(schema, []byte{0x03, 0x04, 0x01, 0x00, 0x02, 0x01, 0x00})
+	assert.NoError(err)
+	assert.Equal([]interface{}{true, false, true}, val)
+}
+
+func TestAvroParseErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for schema, expected := range map[string]string{
+		`!json`:                         "Invalid Avro schema",
+		`"unknown"`:                     "Unknown Avro type 'unknown'",
+		`[]`:                            "at least one type",
+		`["null", ["string"]]`:          "cannot contain other unions",
+		`{"type":"record","fields":[]}`: "Avro record must have a name",
+		`{"type":"record","name":"r"}`:  "must have a list of fields",
+		`{"type":"record","name":"r","fields":[{"type":"int"}]}`:                      "field without a name",
+		`{"type":"record","name":"r","fields":[{"name":"a","type":"x"}]}`:             "r.a: Unknown Avro type 'x'",
+		`{"type":"enum","name":"e","symbols":[]}`:                                     "must have symbols",
+		`{"type":"enum","name":"e","symbols":[1]}`:                                    "symbol that is not a string",
+		`{"type":"fixed","name":"f","size":1.5}`:                                      "non-negative integer size",
+		`{"type":"array","items":"x"}`:                                                "Unknown Avro type 'x'",
+		`[{"type":"fixed","name":"f","size":1},{"type":"fixed","name":"f","size":2}]`: "defined more than once",
+		`123`: "Invalid Avro schema: 123",
+	} {
+		_, err := parseAvroSchema(schema)
+		if assert.Error(err, schema) {
+			assert.Contains(err.Error(), expected, schema)
+		}
+	}
+}
+
+func TestAvroDecodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for schema, data := range map[string][]byte{
+		`"string"`: {0x04, 'a'},
+		`"long"`:   {0x80},
+		`"int"`:    {0x80, 0x80, 0x80, 0x80, 0x10},
+		`"double"`: {0x00},
+		`"null"`:   {0x00},
+		`{"type":"enum","name":"e","symbols":["a"]}`: {0x02},
+		`["null","int"]`:                {0x04},
+		`{"type":"map","values":"int"}`: {0x02, 0x02, 'a'},
+	} {
+		_, err := decodeAvro(mustParseAvroSchema(schema), data)
+		assert.Error(err, schema)
+	}
+}
+
+func TestAvroEncodeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for schema, expected := range map[string]string{
+		`"null"`:                               "$: must be null",
+		`"int"`:                                "$: must be an Avro int",
+		`"double"`:                             "$: must be a number",
+		`"string"`:                             "$: must be a string",
+		`{"type":"fixed","name":"f","size":3}`: "$: must be a hex string of 3 bytes",
+		`"bytes"`:                              "$: must be a hex string",
+		`{"type":"enum","name":"e","symbols":["a"]}`: "$: must be one of the symbols of Avro enum 'e'",
+		`["null","int"]`:                 "$: does not match any type in the Avro union",
+		`{"type":"array","items":"int"}`: "$: must be an array",
+		`{"type":"map","values":"int"}`:  "$: must be an object",
+		`{"type":"record","name":"r","fields":[{"name":"a","type":"int"}]}`: "$: must be an object",
+	} {
+		_, err := encodeAvro(mustParseAvroSchema(schema), true)
+		assert.EqualError(err, expected, schema)
+	}
+
+	_, err := encodeAvro(mustParseAvroSchema(`"boolean"`), "true")
+	assert.EqualError(err, "$: must be a boolean")
+
+	_, err = encodeAvro(mustParseAvroSchema(`{"type":"record","name":"r","fields":[{"name":"a","type":{"type":"map","values":"int"}}]}`),
+		decodeTestJSON(`{"a":{"b":1,"c":3000000000}}`))
+	assert.EqualError(err, "$.a.c: must be an Avro int")
+}
+
+func mustParseAvroSchema(schemaJSON string) *avroSchema {
+	schema, err := parseAvroSchema(schemaJSON)
+	if err != nil {
+		panic(err)
+	}
+	return schema
+}
@@ -19,6 +19,7 @@ import (
 
 	"github.com/Shopify/sarama"
 	cluster "github.com/bsm/sarama-cluster"
+	log "github.com/sirupsen/logrus"
 )
 
 // KafkaGoRoutines defines goroutines for processing Kafka messages from KafkaCommon
@@ -26,6 +27,7 @@ type KafkaGoRoutines interface {
 	ConsumerMessagesLoop(consumer KafkaConsumer, producer KafkaProducer, wg *sync.WaitGroup)
 	ProducerErrorLoop(consumer KafkaConsumer, producer KafkaProducer, wg *sync.WaitGroup)
 	ProducerSuccessLoop(consumer KafkaConsumer, producer KafkaProducer, wg *sync.WaitGroup)
+	ConsumerStopping()
 }
 
 // KafkaProducer provides the interface passed from KafkaCommon to produce messages (subset of sarama)
@@ -43,6 +45,21 @@ type KafkaConsumer interface {
 	Notifications() <-chan *cluster.Notification
 	Errors() <-chan error
 	MarkOffset(*sarama.ConsumerMessage, string)
+	CommitOffsets() error
+	HighWaterMarks() map[string]map[int32]int64
+}
+
+// immediateCommitConsumer commits the offset to Kafka every time it is marked,
+// rather than leaving it to be committed at the next interval
+type immediateCommitConsumer struct {
+	KafkaConsumer
+}
+
+func (c *immediateCommitConsumer) MarkOffset(msg *sarama.ConsumerMessage, metadata string) {
+	c.KafkaConsumer.MarkOffset(msg, metadata)
+	if err := c.KafkaConsumer.CommitOffsets(); err != nil {
+		log.Errorf("Failed to commit offset %d for partition %d: %s", msg.Offset, msg.Partition, err)
+	}
 }
 
 // KafkaFactory builds new clients
@@ -125,6 +125,9 @@ type MockKafkaConsumer struct {
 	MockNotifications  chan *cluster.Notification
 	MockErrors         chan error
 	OffsetsByPartition map[int32]int64
+	Commits            int
+	CommitErr          error
+	MockHighWaterMarks map[string]map[int32]int64
 }
 
 // Close - mock
@@ -161,3 +164,14 @@ func (c *MockKafkaConsumer) MarkOffset(msg *sarama.ConsumerMessage, metadata str
 	c.OffsetsByPartition[msg.Partition] = msg.Offset
 	return
 }
+
+// CommitOffsets - mock
+func (c *MockKafkaConsumer) CommitOffsets() error {
+	c.Commits++
+	return c.CommitErr
+}
+
+// HighWaterMarks - mock
+func (c *MockKafkaConsumer) HighWaterMarks() map[string]map[int32]int64 {
+	return c.MockHighWaterMarks
+}
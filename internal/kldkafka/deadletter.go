@@ -0,0 +1,216 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// deadLetterStatus is the status of the error reply for a dead-lettered message
+const deadLetterStatus = 500
+
+// DeadLetterConf configures dead-lettering of messages that repeatedly fail to
+// complete processing, and so would be redelivered by Kafka forever
+type DeadLetterConf struct {
+	After int    `json:"after,omitempty"`
+	File  string `json:"file,omitempty"`
+	Topic string `json:"topic,omitempty"`
+}
+
+// processingFailures is the record of the attempts to process a message that
+// failed, as the bridge exited with an error before the reply was sent
+type processingFailures struct {
+	Attempts int      `json:"attempts"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// deadLetters tracks the failed processing attempts of messages by their request
+// offset. A failure is persisted to a file before the bridge exits, so survives
+// the restart. Only messages that have failed are tracked, so the file is not
+// written while messages are processed successfully, or when the bridge is stopped
+type deadLetters struct {
+	lock        sync.Mutex
+	persistLock sync.Mutex
+	persisting  sync.WaitGroup
+	after       int
+	file        string
+	topic       string
+	failures    map[string]*processingFailures
+}
+
+// deadLetterError is the error for a message that is dead-lettered
+type deadLetterError struct {
+	failures *processingFailures
+}
+
+func (e *deadLetterError) Error() string {
+	return fmt.Sprintf("Message dead-lettered after %d failed processing attempts", e.failures.Attempts)
+}
+
+// FailureHistory returns the errors recorded for the failed attempts
+func (e *deadLetterError) FailureHistory() []string {
+	return e.failures.Errors
+}
+
+func newDeadLetters() *deadLetters {
+	return &deadLetters{
+		failures: make(map[string]*processingFailures),
+	}
+}
+
+// init loads the attempts persisted by a previous run of the bridge
+func (d *deadLetters) init(conf *DeadLetterConf) error {
+	if conf.After < 0 {
+		return fmt.Errorf("Dead-letter attempts %d must not be negative", conf.After)
+	}
+	if conf.Topic != "" && !kafkaTopicName.MatchString(conf.Topic) {
+		return fmt.Errorf("Invalid dead-letter topic '%s'", conf.Topic)
+	}
+	if conf.After > 0 && conf.File == "" {
+		return fmt.Errorf("A dead-letter file is required to count processing attempts across restarts")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.after = conf.After
+	d.file = conf.File
+	d.topic = conf.Topic
+	if d.after == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to read dead-letter file '%s': %s", d.file, err)
+	}
+	if err = json.Unmarshal(b, &d.failures); err != nil {
+		return fmt.Errorf("Failed to parse dead-letter file '%s': %s", d.file, err)
+	}
+	if d.failures == nil {
+		d.failures = make(map[string]*processingFailures)
+	}
+	log.Infof("Loaded %d messages with failed processing attempts from '%s'", len(d.failures), d.file)
+	return nil
+}
+
+// reachedLimit returns the failures of a message that has already failed
+// processing the maximum number of times, so must be dead-lettered instead
+// of processed. Returns nil for any other message
+func (d *deadLetters) reachedLimit(reqOffset string) *processingFailures {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.after == 0 {
+		return nil
+	}
+	if failures, exists := d.failures[reqOffset]; exists && failures.Attempts >= d.after {
+		return failures
+	}
+	return nil
+}
+
+// recordError counts a failed attempt to process a message, with its error.
+// It is called as the bridge exits, so the failure is persisted before returning
+func (d *deadLetters) recordError(reqOffset string, err interface{}) {
+	d.lock.Lock()
+	if d.after == 0 {
+		d.lock.Unlock()
+		return
+	}
+	failures, exists := d.failures[reqOffset]
+	if !exists {
+		failures = &processingFailures{}
+		d.failures[reqOffset] = failures
+	}
+	failures.Attempts++
+	failures.Errors = append(failures.Errors, fmt.Sprintf("%s: %v", time.Now().UTC().Format(time.RFC3339), err))
+	d.lock.Unlock()
+	if err := d.persist(); err != nil {
+		log.Errorf("%s", err)
+	}
+}
+
+// complete removes the record of a message once its offset can be committed.
+// The caller holds the inFlightCond mutex, so the file is written in the background.
+// If the bridge exits first the record is left in the file, but is never used, as
+// the message is not redelivered
+func (d *deadLetters) complete(reqOffset string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, exists := d.failures[reqOffset]; !exists {
+		return
+	}
+	delete(d.failures, reqOffset)
+	d.persisting.Add(1)
+	go func() {
+		defer d.persisting.Done()
+		if err := d.persist(); err != nil {
+			log.Errorf("%s", err)
+		}
+	}()
+}
+
+// persist writes the failures to a temporary file, then renames it over the
+// dead-letter file, so a crash cannot leave a partially written file. The failures
+// are copied under the persistLock, so the last write always has the latest state
+func (d *deadLetters) persist() error {
+	d.persistLock.Lock()
+	defer d.persistLock.Unlock()
+	d.lock.Lock()
+	b, _ := json.Marshal(d.failures)
+	d.lock.Unlock()
+	tmpFile := d.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, b, 0640); err != nil {
+		return fmt.Errorf("Failed to write dead-letter file '%s': %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, d.file); err != nil {
+		return fmt.Errorf("Failed to write dead-letter file '%s': %s", d.file, err)
+	}
+	return nil
+}
+
+// dispatchMessage passes a message to the processor, after any request hook.
+// A message that has reached the limit of failed attempts is dead-lettered
+// instead. If processing panics, the panic is recorded as a failed attempt for
+// the message before the bridge exits
+func (k *KafkaBridge) dispatchMessage(msgCtx *msgContext) {
+	if failures := k.deadLetters.reachedLimit(msgCtx.reqOffset); failures != nil {
+		log.Errorf("Dead-lettering message after %d failed processing attempts: %s", failures.Attempts, msgCtx)
+		msgCtx.deadLetter = true
+		msgCtx.SendErrorReply(deadLetterStatus, &deadLetterError{failures: failures})
+		return
+	}
+	if status, err := k.applyRequestHook(msgCtx); err != nil {
+		if _, failed := err.(*requestHookError); failed {
+			log.Errorf("Message %s not processed, as the consumer is stopping: %s", msgCtx, err)
+			return
+		}
+		msgCtx.SendErrorReply(status, err)
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			k.deadLetters.recordError(msgCtx.reqOffset, r)
+			panic(r)
+		}
+	}()
+	k.processor.OnMessage(msgCtx)
+}
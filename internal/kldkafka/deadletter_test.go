@@ -0,0 +1,162 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+type panicKafkaMsgProcessor struct {
+	testKafkaMsgProcessor
+}
+
+func (p *panicKafkaMsgProcessor) OnMessage(msg MsgContext) {
+	panic(fmt.Errorf("pop"))
+}
+
+func tempDeadLetterFile() (string, func()) {
+	dir, _ := ioutil.TempDir("", "deadletter")
+	return path.Join(dir, "deadletters.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestDeadLettersInitErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.EqualError(newDeadLetters().init(&DeadLetterConf{After: -1}), "Dead-letter attempts -1 must not be negative")
+	assert.EqualError(newDeadLetters().init(&DeadLetterConf{Topic: "bad/topic"}), "Invalid dead-letter topic 'bad/topic'")
+	assert.EqualError(newDeadLetters().init(&DeadLetterConf{After: 1}), "A dead-letter file is required to count processing attempts across restarts")
+
+	file, cleanup := tempDeadLetterFile()
+	defer cleanup()
+	ioutil.WriteFile(file, []byte("!json"), 0644)
+	assert.Regexp("Failed to parse dead-letter file", newDeadLetters().init(&DeadLetterConf{After: 1, File: file}).Error())
+	assert.Regexp("Failed to read dead-letter file", newDeadLetters().init(&DeadLetterConf{After: 1, File: path.Dir(file)}).Error())
+}
+
+func TestDeadLettersAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	file, cleanup := tempDeadLetterFile()
+	defer cleanup()
+	d := newDeadLetters()
+	assert.NoError(d.init(&DeadLetterConf{After: 2, File: file}))
+
+	// Only failures are recorded, so nothing is written for a message that completes
+	assert.Nil(d.reachedLimit("topic:0:1"))
+	d.complete("topic:0:1")
+	_, err := os.Stat(file)
+	assert.True(os.IsNotExist(err))
+
+	d.recordError("topic:0:1", "pop")
+
+	// The failures survive a restart
+	d = newDeadLetters()
+	assert.NoError(d.init(&DeadLetterConf{After: 2, File: file}))
+	assert.Equal(1, d.failures["topic:0:1"].Attempts)
+	assert.Regexp("pop", d.failures["topic:0:1"].Errors[0])
+	assert.Nil(d.reachedLimit("topic:0:1"))
+	d.recordError("topic:0:1", "bang")
+	failures := d.reachedLimit("topic:0:1")
+	assert.Equal(2, failures.Attempts)
+	assert.Regexp("bang", failures.Errors[1])
+
+	d.complete("topic:0:1")
+	d.complete("topic:0:2")
+	d.persisting.Wait()
+	b, _ := ioutil.ReadFile(file)
+	assert.Equal("{}", string(b))
+}
+
+func TestDeadLettersDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newDeadLetters()
+	assert.NoError(d.init(&DeadLetterConf{}))
+	d.recordError("topic:0:1", "pop")
+	assert.Nil(d.reachedLimit("topic:0:1"))
+	assert.Empty(d.failures)
+}
+
+func TestDeadLettersPersistFails(t *testing.T) {
+	assert := assert.New(t)
+
+	d := newDeadLetters()
+	assert.NoError(d.init(&DeadLetterConf{After: 1, File: "/nonexistent/deadletters.json"}))
+	d.recordError("topic:0:1", "pop")
+	assert.Regexp("Failed to write dead-letter file", d.persist().Error())
+	assert.Equal(1, d.reachedLimit("topic:0:1").Attempts)
+}
+
+func TestDispatchMessageRecordsPanic(t *testing.T) {
+	assert := assert.New(t)
+
+	file, cleanup := tempDeadLetterFile()
+	defer cleanup()
+	k, _ := newTestKafkaBridge()
+	k.processor = &panicKafkaMsgProcessor{}
+	assert.NoError(k.deadLetters.init(&DeadLetterConf{After: 1, File: file}))
+
+	assert.Panics(func() {
+		k.dispatchMessage(&msgContext{reqOffset: "topic:0:1"})
+	})
+	assert.Equal(1, k.deadLetters.failures["topic:0:1"].Attempts)
+	assert.Regexp("pop", k.deadLetters.failures["topic:0:1"].Errors[0])
+}
+
+func TestDeadLetterMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	file, cleanup := tempDeadLetterFile()
+	defer cleanup()
+	ioutil.WriteFile(file, []byte(`{":0:0":{"attempts":1,"errors":["pop"]}}`), 0644)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.DeadLetter = DeadLetterConf{After: 1, File: file, Topic: "deadletters"}
+	assert.NoError(k.deadLetters.init(&k.conf.DeadLetter))
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestDeadLetterMessage"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	assert.Equal("deadletters", replyKafkaMsg.Topic)
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Equal("Message dead-lettered after 1 failed processing attempts", errorReply.ErrorMessage)
+	assert.Equal([]string{"pop"}, errorReply.FailureHistory)
+	assert.Equal(string(msg1bytes), errorReply.OriginalMessage)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(0, len(processor.messages))
+	assert.Empty(k.deadLetters.failures)
+	k.deadLetters.persisting.Wait()
+	b, _ := ioutil.ReadFile(file)
+	assert.Equal("{}", string(b))
+}
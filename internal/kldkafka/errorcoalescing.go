@@ -0,0 +1,204 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultErrorCoalescingWindow is the number of seconds errors with the same status code are coalesced over
+	DefaultErrorCoalescingWindow = 10
+	// maxErrorSummaryRequests limits the request IDs listed in an error summary
+	maxErrorSummaryRequests = 1000
+)
+
+// ErrorCoalescingConf configures coalescing of repeated error replies, so a
+// widespread failure such as a node outage does not flood the reply topic
+type ErrorCoalescingConf struct {
+	Enabled bool `json:"enabled"`
+	Window  int  `json:"window,omitempty"` // seconds
+}
+
+// errorSummaryMetadata marks error summaries in the producer loops, as unlike
+// replies they are not tied to a message in-flight
+type errorSummaryMetadata struct {
+	code int
+}
+
+// errorCoalescer tracks a window for each error status code, started by the
+// first error reply with that code, which is sent as normal. The error replies
+// for the rest of the window are not sent, and their messages complete as if
+// they were. Instead a summary is sent to the error topic when the window ends
+type errorCoalescer struct {
+	lock       sync.Mutex
+	window     time.Duration
+	topic      string
+	markReply  func(msg *sarama.ProducerMessage)
+	consumer   KafkaConsumer
+	producer   KafkaProducer
+	summaries  map[int]*kldmessages.ErrorSummary
+	windowsEnd map[int]*time.Timer
+	stopped    bool
+}
+
+// newErrorCoalescer validates the configuration. Returns nil if coalescing is not enabled
+func newErrorCoalescer(conf *ErrorCoalescingConf) (*errorCoalescer, error) {
+	if conf.Window < 0 {
+		return nil, fmt.Errorf("Error coalescing window %d must not be negative", conf.Window)
+	}
+	if !conf.Enabled {
+		if conf.Window > 0 {
+			log.Warnf("Error coalescing window %d has no effect unless error coalescing is enabled", conf.Window)
+		}
+		return nil, nil
+	}
+	window := conf.Window
+	if window == 0 {
+		window = DefaultErrorCoalescingWindow
+	}
+	return &errorCoalescer{
+		window:     time.Duration(window) * time.Second,
+		summaries:  make(map[int]*kldmessages.ErrorSummary),
+		windowsEnd: make(map[int]*time.Timer),
+	}, nil
+}
+
+// setClients supplies the consumer used to complete the messages with coalesced
+// replies, and the producer used to send the summaries
+func (e *errorCoalescer) setClients(consumer KafkaConsumer, producer KafkaProducer) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	e.consumer = consumer
+	e.producer = producer
+	e.lock.Unlock()
+}
+
+// coalesce returns true if the reply for a message is an error to add to the
+// summary for its status code, rather than send
+func (e *errorCoalescer) coalesce(c *msgContext, replyMessage kldmessages.ReplyWithHeaders) bool {
+	if e == nil || c.replyType != kldmessages.MsgTypeError || c.deadLetter {
+		return false
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stopped || e.consumer == nil {
+		return false
+	}
+	code := c.errorStatus
+	summary, inWindow := e.summaries[code]
+	if !inWindow {
+		e.summaries[code] = nil
+		e.windowsEnd[code] = time.AfterFunc(e.window, func() { e.endWindow(code) })
+		return false
+	}
+	if summary == nil {
+		summary = &kldmessages.ErrorSummary{
+			ErrorCode:   code,
+			WindowStart: time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		summary.Headers.MsgType = kldmessages.MsgTypeErrorSummary
+		e.summaries[code] = summary
+	}
+	if errReply, ok := replyMessage.(*kldmessages.ErrorReply); ok {
+		summary.ErrorMessage = errReply.ErrorMessage
+	}
+	summary.Count++
+	if len(summary.RequestIDs) < maxErrorSummaryRequests {
+		summary.RequestIDs = append(summary.RequestIDs, c.requestCommon.Headers.ID)
+	}
+	log.Infof("Coalescing error reply %d into summary: %s", code, c)
+	return true
+}
+
+// endWindow sends the summary for a status code, if any errors were coalesced,
+// so the next error with that code is sent and starts a new window
+func (e *errorCoalescer) endWindow(code int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if summary := e.summaries[code]; summary != nil && !e.stopped {
+		e.sendSummary(summary)
+	}
+	delete(e.summaries, code)
+	delete(e.windowsEnd, code)
+}
+
+// stop sends the summaries for all the open windows, as the bridge is shutting
+// down. No more errors are coalesced after this
+func (e *errorCoalescer) stop() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	for code, summary := range e.summaries {
+		e.windowsEnd[code].Stop()
+		if summary != nil {
+			e.sendSummary(summary)
+		}
+	}
+	e.summaries = make(map[int]*kldmessages.ErrorSummary)
+	e.windowsEnd = make(map[int]*time.Timer)
+	e.stopped = true
+}
+
+// sendSummary sends a summary to the error topic
+// * Caller holds the lock *
+func (e *errorCoalescer) sendSummary(summary *kldmessages.ErrorSummary) {
+	summary.Headers.ID = kldutils.UUIDv4()
+	summary.WindowEnd = time.Now().UTC().Format(time.RFC3339Nano)
+	summaryBytes, _ := json.Marshal(summary)
+	log.Warnf("Sending summary of %d coalesced error replies with code %d", summary.Count, summary.ErrorCode)
+	msg := &sarama.ProducerMessage{
+		Topic:     e.topic,
+		Key:       sarama.StringEncoder(strconv.Itoa(summary.ErrorCode)),
+		Partition: autoPartition,
+		Value:     sarama.ByteEncoder(summaryBytes),
+		Metadata:  &errorSummaryMetadata{code: summary.ErrorCode},
+	}
+	e.markReply(msg)
+	e.producer.Input() <- msg
+}
+
+// completeCoalesced completes a message with a coalesced error reply, in the
+// same way as when a reply is confirmed by the producer
+func (k *KafkaBridge) completeCoalesced(c *msgContext) {
+	consumer := k.errorCoalescer.consumer
+	k.inFlightCond.L.Lock()
+	defer k.inFlightCond.L.Unlock()
+	if _, ok := k.inFlight[c.reqOffset]; ok {
+		k.addCompleted(c)
+		if c.offsetHeld {
+			c.heldConsumer = consumer
+		} else {
+			k.setInFlightComplete(c, consumer)
+			k.inFlightCond.Broadcast()
+		}
+	} else if directMsg, ok := k.directReplies[c.reqOffset]; ok {
+		delete(k.directReplies, c.reqOffset)
+		k.setDirectReplyComplete(directMsg, consumer)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewErrorCoalescer(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := newErrorCoalescer(&ErrorCoalescingConf{Window: 5})
+	assert.NoError(err)
+	assert.Nil(e)
+
+	_, err = newErrorCoalescer(&ErrorCoalescingConf{Enabled: true, Window: -1})
+	assert.EqualError(err, "Error coalescing window -1 must not be negative")
+
+	e, err = newErrorCoalescer(&ErrorCoalescingConf{Enabled: true})
+	assert.NoError(err)
+	assert.Equal(DefaultErrorCoalescingWindow*time.Second, e.window)
+}
+
+func TestExecuteBridgeWithErrorCoalescing(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--coalesce-errors", "--coalesce-errors-window", "30", "--error-topic-out", "errors"))
+	kafkaCmd.Execute()
+	assert.Equal(30*time.Second, k.errorCoalescer.window)
+	assert.Equal("errors", k.errorCoalescer.topic)
+}
+
+func TestErrorCoalescing(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.errorCoalescer, _ = newErrorCoalescer(&ErrorCoalescingConf{Enabled: true, Window: 60})
+	k.errorCoalescer.topic = "error-topic"
+	k.errorCoalescer.markReply = k.markReply
+	k, _, mockConsumer, mockProducer, wg := startMocks(k)
+
+	// Messages that cannot be parsed fail with a 400, and the first is replied to
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Topic: "in-topic", Partition: 3, Offset: 10, Value: []byte("!json")}
+	replyKafkaMsg := <-mockProducer.MockInput
+	assert.Equal("in-topic:3:10", replyKafkaMsg.Metadata)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Topic: "in-topic", Partition: 3, Offset: 11, Value: []byte("!json")}
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Topic: "in-topic", Partition: 3, Offset: 12, Value: []byte("!json")}
+	for coalesced := 0; coalesced < 2; time.Sleep(1 * time.Millisecond) {
+		k.errorCoalescer.lock.Lock()
+		if summary := k.errorCoalescer.summaries[400]; summary != nil {
+			coalesced = summary.Count
+		}
+		k.errorCoalescer.lock.Unlock()
+	}
+	// The coalesced errors wait for the first to complete, to commit in order
+	assert.Equal(int64(0), mockConsumer.OffsetsByPartition[3])
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	// The summary is sent at the end of the window
+	go k.errorCoalescer.endWindow(400)
+	summaryKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- summaryKafkaMsg
+	assert.Equal("error-topic", summaryKafkaMsg.Topic)
+	summaryBytes, _ := summaryKafkaMsg.Value.Encode()
+	var summary kldmessages.ErrorSummary
+	json.Unmarshal(summaryBytes, &summary)
+	assert.Equal(kldmessages.MsgTypeErrorSummary, summary.Headers.MsgType)
+	assert.Equal(400, summary.ErrorCode)
+	assert.Equal(2, summary.Count)
+	assert.Equal(2, len(summary.RequestIDs))
+	assert.Regexp("invalid character", summary.ErrorMessage)
+	assert.NotEmpty(summary.WindowStart)
+	assert.NotEmpty(summary.WindowEnd)
+
+	k.ConsumerStopping()
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(12), mockConsumer.OffsetsByPartition[3])
+	assert.Equal(uint64(3), k.msgErrors.Total())
+}
+
+func TestErrorCoalescingStop(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	e, _ := newErrorCoalescer(&ErrorCoalescingConf{Enabled: true, Window: 60})
+	e.topic = "reply-topic"
+	e.markReply = k.markReply
+	mockProducer := &MockKafkaProducer{MockInput: make(chan *sarama.ProducerMessage, 1)}
+	e.setClients(&MockKafkaConsumer{}, mockProducer)
+
+	for i := 0; i < 3; i++ {
+		c := &msgContext{replyType: kldmessages.MsgTypeError, errorStatus: 503}
+		coalesced := e.coalesce(c, kldmessages.NewErrorReply(fmt.Errorf("pop"), []byte{}))
+		assert.Equal(i > 0, coalesced)
+	}
+	// Dead-lettered messages are always replied to
+	assert.False(e.coalesce(&msgContext{replyType: kldmessages.MsgTypeError, errorStatus: 503, deadLetter: true}, nil))
+
+	// Stopping sends the open summaries, and no more errors are coalesced
+	e.stop()
+	summaryKafkaMsg := <-mockProducer.MockInput
+	assert.Equal(&errorSummaryMetadata{code: 503}, summaryKafkaMsg.Metadata)
+	assert.False(e.coalesce(&msgContext{replyType: kldmessages.MsgTypeError, errorStatus: 503}, nil))
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// failureEventStatus is the status of the error reply for a transaction that
+// was mined successfully, but emitted a failure event
+const failureEventStatus = 422
+
+// failureEvents are the events that contracts emit to report a logical failure,
+// without reverting the transaction. They are configured by contract address, or
+// by method selector for the method the transaction calls
+type failureEvents struct {
+	byAddress  map[common.Address]*abi.Event
+	bySelector map[string]*abi.Event
+}
+
+func newFailureEvents() *failureEvents {
+	return &failureEvents{
+		byAddress:  make(map[common.Address]*abi.Event),
+		bySelector: make(map[string]*abi.Event),
+	}
+}
+
+// init parses the event signatures, keyed by address or 4 byte method selector
+func (f *failureEvents) init(conf map[string]string) error {
+	for key, sig := range conf {
+		event, err := kldeth.ParseEventSignature(sig)
+		if err != nil {
+			return err
+		}
+		keyBytes, err := hex.DecodeString(strings.TrimPrefix(key, "0x"))
+		switch {
+		case err == nil && len(keyBytes) == 4:
+			f.bySelector["0x"+hex.EncodeToString(keyBytes)] = event
+		case err == nil && len(keyBytes) == common.AddressLength:
+			f.byAddress[common.BytesToAddress(keyBytes)] = event
+		default:
+			return fmt.Errorf("Failure event key '%s' must be a contract address or a 4 byte method selector in hex", key)
+		}
+	}
+	return nil
+}
+
+// eventFor returns the failure event for the contract a transaction is sent to,
+// or for the method it calls, with the contract taking precedence
+func (f *failureEvents) eventFor(tx *kldeth.Txn) *abi.Event {
+	to := tx.EthTX.To()
+	if to == nil {
+		return nil
+	}
+	if event, exists := f.byAddress[*to]; exists {
+		return event
+	}
+	return f.bySelector[tx.MethodSelector()]
+}
+
+// failureEventError is the error for a transaction that emitted a failure event
+type failureEventError struct {
+	detail *kldmessages.FailureEvent
+}
+
+func (e *failureEventError) Error() string {
+	return fmt.Sprintf("Transaction was mined, but emitted failure event '%s'", e.detail.Name)
+}
+
+// FailureEventDetail returns the decoded parameters of the failure event
+func (e *failureEventError) FailureEventDetail() *kldmessages.FailureEvent {
+	return e.detail
+}
+
+// checkFailureEvent returns an error if a successful transaction emitted the
+// failure event configured for it, from the contract it was sent to
+func (p *msgProcessor) checkFailureEvent(tx *kldeth.Txn) error {
+	event := p.failureEvents.eventFor(tx)
+	if event == nil {
+		return nil
+	}
+	l, params, err := tx.ReceiptEvent(*tx.EthTX.To(), event)
+	if l == nil {
+		return nil
+	}
+	if err != nil {
+		// The event was emitted, so the transaction still failed
+		params = map[string]interface{}{}
+		log.Warnf("TX:%s %s", tx.Hash, err)
+	}
+	detail := &kldmessages.FailureEvent{
+		Name:   event.Name,
+		Params: params,
+	}
+	if tx.Receipt.BlockNumber != nil {
+		detail.BlockNumber = tx.Receipt.BlockNumber.ToInt().Text(10)
+	}
+	return &failureEventError{detail: detail}
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testFailureEventContract = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+
+var testFailureEventTxnJSON = "{" +
+	"  \"headers\":{\"type\": \"SendTransaction\"}," +
+	"  \"from\":\"" + testFromAddr + "\"," +
+	"  \"to\":\"" + testFailureEventContract + "\"," +
+	"  \"gas\":\"123\"," +
+	"  \"method\":{\"name\":\"test\"}" +
+	"}"
+
+func TestFailureEventsInit(t *testing.T) {
+	assert := assert.New(t)
+
+	f := newFailureEvents()
+	err := f.init(map[string]string{
+		"0xA9059CBB":             "TransferFailed(address indexed,string)",
+		testFailureEventContract: "Failed(uint256)",
+	})
+	assert.NoError(err)
+	assert.Equal("TransferFailed", f.bySelector["0xa9059cbb"].Name)
+	assert.Equal("Failed", f.byAddress[common.HexToAddress(testFailureEventContract)].Name)
+}
+
+func TestFailureEventsInitErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	err := newFailureEvents().init(map[string]string{"0xa9059cbb": "Failed"})
+	assert.Regexp("Invalid event signature 'Failed'", err.Error())
+	err = newFailureEvents().init(map[string]string{"0x1234": "Failed()"})
+	assert.EqualError(err, "Failure event key '0x1234' must be a contract address or a 4 byte method selector in hex")
+	err = newFailureEvents().init(map[string]string{"badness": "Failed()"})
+	assert.Regexp("Failure event key 'badness'", err.Error())
+}
+
+func TestFailureEventsEventFor(t *testing.T) {
+	assert := assert.New(t)
+
+	var msg kldmessages.SendTransaction
+	assert.NoError(json.Unmarshal([]byte(testFailureEventTxnJSON), &msg))
+	msg.Nonce = "0"
+	tx, err := kldeth.NewSendTxn(&msg)
+	assert.NoError(err)
+
+	f := newFailureEvents()
+	assert.NoError(f.init(map[string]string{tx.MethodSelector(): "BySelector()"}))
+	assert.Equal("BySelector", f.eventFor(tx).Name)
+	assert.NoError(f.init(map[string]string{testFailureEventContract: "ByAddress()"}))
+	assert.Equal("ByAddress", f.eventFor(tx).Name)
+}
+
+func TestOnSendTransactionMessageFailureEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.failureEvents.init(map[string]string{testFailureEventContract: "Failed(address indexed,uint256)"}))
+	event := msgProcessor.failureEvents.byAddress[common.HexToAddress(testFailureEventContract)]
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testFailureEventTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethGetTransactionReceiptResult.Logs = []*kldeth.TxnLog{{
+		Address: common.HexToAddress(testFailureEventContract),
+		Topics:  []common.Hash{event.Id(), common.HexToAddress(testFromAddr).Hash()},
+		Data:    common.LeftPadBytes([]byte{42}, 32),
+	}}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg.Wait()
+
+	assert.Empty(testMsgContext.replies)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(failureEventStatus, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Transaction was mined, but emitted failure event 'Failed'")
+	assert.Equal(testRPC.ethSendTransactionResult, testMsgContext.errorRepies[0].txHash)
+	reply := kldmessages.NewErrorReply(testMsgContext.errorRepies[0].err, []byte{})
+	assert.Equal("Failed", reply.FailureEvent.Name)
+	assert.Equal("12345", reply.FailureEvent.BlockNumber)
+	assert.Equal(map[string]interface{}{"0": common.HexToAddress(testFromAddr).Hex(), "1": "42"}, reply.FailureEvent.Params)
+}
+
+func TestOnSendTransactionMessageFailureEventNotEmitted(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.failureEvents.init(map[string]string{testFailureEventContract: "Failed(uint256)"}))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testFailureEventTxnJSON
+	msgProcessor.Init(goodMessageRPC(), 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg.Wait()
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.Equal(kldmessages.MsgTypeTransactionSuccess, testMsgContext.replies[0].ReplyHeaders().MsgType)
+}
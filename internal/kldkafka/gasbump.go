@@ -0,0 +1,121 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultGasBumpMaxAttempts is the number of times the gas price of a transaction
+	// is bumped, if gas bumping is enabled without a maximum
+	DefaultGasBumpMaxAttempts = 5
+)
+
+// validateGasBump checks the automatic gas price bumping configuration, and applies
+// the defaults. Bumping is disabled unless an interval is set
+func (k *KafkaBridge) validateGasBump() error {
+	gasBump := &k.conf.GasBump
+	if gasBump.Interval < 0 || gasBump.Percent < 0 || gasBump.MaxAttempts < 0 {
+		return fmt.Errorf("Gas bump interval, percentage and attempts must not be negative")
+	}
+	if gasBump.Percent == 0 {
+		gasBump.Percent = replacementGasPriceBump
+	} else if gasBump.Percent < replacementGasPriceBump {
+		log.Warnf("Gas bump of %d%% is below the %d%% minimum geth accepts for a replacement", gasBump.Percent, replacementGasPriceBump)
+	}
+	if gasBump.MaxAttempts == 0 {
+		gasBump.MaxAttempts = DefaultGasBumpMaxAttempts
+	}
+	if gasBump.MaxGasPrice != "" {
+		if maxGasPrice, ok := new(big.Int).SetString(gasBump.MaxGasPrice, 10); !ok || maxGasPrice.Sign() <= 0 {
+			return fmt.Errorf("Maximum gas bump price '%s' must be a positive integer (wei)", gasBump.MaxGasPrice)
+		}
+	}
+	return nil
+}
+
+// bumpedGasPrice returns the gas price for the next bump of a transaction, limited
+// to the maximum gas price. Returns nil if the gas price cannot be increased further
+func (p *msgProcessor) bumpedGasPrice(oldGasPrice *big.Int) *big.Int {
+	gasPrice := new(big.Int).Mul(oldGasPrice, big.NewInt(int64(100+p.conf.GasBump.Percent)))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	if p.conf.GasBump.MaxGasPrice != "" {
+		maxGasPrice, _ := new(big.Int).SetString(p.conf.GasBump.MaxGasPrice, 10)
+		if gasPrice.Cmp(maxGasPrice) > 0 {
+			gasPrice = maxGasPrice
+		}
+	}
+	if gasPrice.Cmp(oldGasPrice) <= 0 {
+		return nil
+	}
+	return gasPrice
+}
+
+// checkGasBump replaces a transaction that has been pending for longer than the gas
+// bump interval, with the same nonce and a higher gas price. The replacement is
+// tracked in the same way as one submitted with ReplaceTransaction.
+// Only called on the goroutine tracking the transaction
+func (p *msgProcessor) checkGasBump(iTX *inflightTxn) {
+	interval := time.Duration(p.conf.GasBump.Interval) * time.Second
+	if interval <= 0 || iTX.gasBumpsDone || time.Now().Sub(iTX.lastSubmitted) < interval {
+		return
+	}
+	tx := iTX.latestTX()
+	if tx.RawTX != nil && tx.Signer == nil {
+		// Pre-signed transactions cannot be replaced
+		iTX.gasBumpsDone = true
+		return
+	}
+	if iTX.gasBumps >= p.conf.GasBump.MaxAttempts {
+		log.Warnf("Gas price bumped the maximum of %d times: %s", iTX.gasBumps, iTX)
+		iTX.gasBumpsDone = true
+		return
+	}
+	gasPrice := p.bumpedGasPrice(tx.EthTX.GasPrice())
+	if gasPrice == nil {
+		log.Warnf("Gas price %s is at the maximum for gas bumps: %s", tx.EthTX.GasPrice().Text(10), iTX)
+		iTX.gasBumpsDone = true
+		return
+	}
+	// Whatever the outcome, we wait another interval before the next attempt
+	iTX.lastSubmitted = time.Now()
+
+	// Check it's still pending, and get the nonce in case it was assigned by the node
+	nodeTX, err := tx.GetFromNode(p.rpc)
+	if err != nil || nodeTX == nil || nodeTX.BlockNumber != nil {
+		log.Infof("Transaction not pending on the node, so gas price not bumped (err=%v): %s", err, iTX)
+		return
+	}
+	replacement, err := tx.NewReplacement(uint64(nodeTX.Nonce), gasPrice)
+	if err == nil {
+		err = p.waitSubmitRate()
+	}
+	if err == nil {
+		err = replacement.Send(p.rpc)
+	}
+	if err != nil {
+		log.Warnf("Failed to bump gas price to %s: %s: %s", gasPrice.Text(10), iTX, err)
+		return
+	}
+	iTX.gasBumps++
+	p.auditLog.recordTX(AuditEventReplaced, iTX.msgContext, replacement, tx.Hash)
+	log.Infof("Bumped gas price to %s (bumps=%d) with replacement %s: %s", gasPrice.Text(10), iTX.gasBumps, replacement.Hash, iTX)
+	iTX.addReplacement(replacement)
+}
@@ -0,0 +1,167 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newGasBumpTestProcessor(assert *assert.Assertions) (*msgProcessor, *inflightTxn, *testRPC) {
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.GasBump.Interval = 10
+	msgProcessor.conf.GasBump.Percent = 20
+	msgProcessor.conf.GasBump.MaxAttempts = DefaultGasBumpMaxAttempts
+	inflight := newReplaceTestInflight(assert, msgProcessor)
+	inflight.lastSubmitted = time.Now().Add(-11 * time.Second)
+	testRPC := &testRPC{
+		ethSendTransactionResult:      "0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89",
+		ethGetTransactionByHashKnown:  1000,
+		ethGetTransactionByHashResult: `{"nonce":"0x7b","blockNumber":null}`,
+	}
+	msgProcessor.Init(testRPC, 1)
+	return msgProcessor, inflight, testRPC
+}
+
+func TestCheckGasBump(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, testRPC := newGasBumpTestProcessor(assert)
+	msgProcessor.checkGasBump(inflight)
+
+	assert.Equal([]string{"eth_getTransactionByHash", "eth_sendTransaction"}, testRPC.calls)
+	assert.Equal(1, inflight.gasBumps)
+	replacement := inflight.latestTX()
+	assert.Equal(uint64(123), replacement.EthTX.Nonce())
+	assert.Equal("1200", replacement.EthTX.GasPrice().Text(10))
+
+	// Not bumped again until another interval has passed
+	inflight.applyReplacements()
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal(1, inflight.gasBumps)
+	assert.Equal(2, len(testRPC.calls))
+
+	inflight.lastSubmitted = time.Now().Add(-11 * time.Second)
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal(2, inflight.gasBumps)
+	assert.Equal("1440", inflight.latestTX().EthTX.GasPrice().Text(10))
+}
+
+func TestCheckGasBumpMaxGasPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, _ := newGasBumpTestProcessor(assert)
+	msgProcessor.conf.GasBump.MaxGasPrice = "1100"
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal("1100", inflight.latestTX().EthTX.GasPrice().Text(10))
+
+	inflight.applyReplacements()
+	inflight.lastSubmitted = time.Now().Add(-11 * time.Second)
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal(1, inflight.gasBumps)
+	assert.True(inflight.gasBumpsDone)
+}
+
+func TestCheckGasBumpMaxAttempts(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, testRPC := newGasBumpTestProcessor(assert)
+	msgProcessor.conf.GasBump.MaxAttempts = 1
+	inflight.gasBumps = 1
+	msgProcessor.checkGasBump(inflight)
+	assert.True(inflight.gasBumpsDone)
+	assert.Empty(testRPC.calls)
+}
+
+func TestCheckGasBumpNotPending(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, testRPC := newGasBumpTestProcessor(assert)
+	testRPC.ethGetTransactionByHashResult = `{"nonce":"0x7b","blockNumber":"0x10"}`
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal([]string{"eth_getTransactionByHash"}, testRPC.calls)
+	assert.Equal(0, inflight.gasBumps)
+	assert.False(inflight.gasBumpsDone)
+}
+
+func TestCheckGasBumpSendFails(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, testRPC := newGasBumpTestProcessor(assert)
+	testRPC.ethSendTransactionErr = fmt.Errorf("pop")
+	msgProcessor.checkGasBump(inflight)
+	assert.Equal(0, inflight.gasBumps)
+	assert.Equal(inflight.tx, inflight.latestTX())
+}
+
+func TestCheckGasBumpPreSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor, inflight, testRPC := newGasBumpTestProcessor(assert)
+	rawTX, err := kldeth.NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: "0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1"})
+	assert.NoError(err)
+	inflight.tx = rawTX
+	msgProcessor.checkGasBump(inflight)
+	assert.True(inflight.gasBumpsDone)
+	assert.Empty(testRPC.calls)
+}
+
+func TestGasBumpReply(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.GasBump.Interval = 10
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	msgProcessor.Init(goodMessageRPC(), 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	reply := testMsgContext.replies[0].(*kldmessages.TransactionReceipt)
+	assert.Equal(0, reply.GasBumps)
+	assert.Equal("0", reply.GasPrice)
+}
+
+func TestExecuteBridgeWithBadGasBump(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--gas-bump-interval", "-1"))
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Gas bump interval, percentage and attempts must not be negative")
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--gas-bump-interval", "30", "--gas-bump-max-price", "lots"))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "Maximum gas bump price 'lots' must be a positive integer (wei)")
+}
+
+func TestExecuteBridgeGasBumpDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--gas-bump-interval", "30"))
+	kafkaCmd.Execute()
+	assert.Equal(30, k.conf.GasBump.Interval)
+	assert.Equal(10, k.conf.GasBump.Percent)
+	assert.Equal(DefaultGasBumpMaxAttempts, k.conf.GasBump.MaxAttempts)
+}
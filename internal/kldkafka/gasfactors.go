@@ -0,0 +1,77 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+)
+
+// gasFactors are the multipliers applied to the gas estimated by the node, to
+// leave headroom for contracts that need more gas than estimation suggests.
+// A contract address can have its own factor, in place of the global one
+type gasFactors struct {
+	global    float64
+	byAddress map[common.Address]float64
+}
+
+func newGasFactors() *gasFactors {
+	return &gasFactors{
+		global:    1,
+		byAddress: make(map[common.Address]float64),
+	}
+}
+
+// init validates the global factor, where zero means no headroom,
+// and the factors keyed by contract address
+func (g *gasFactors) init(global float64, byAddress map[string]float64) error {
+	if global != 0 {
+		if global < 1 {
+			return fmt.Errorf("Gas estimation factor %g must not be less than 1", global)
+		}
+		g.global = global
+	}
+	for addr, factor := range byAddress {
+		addrBytes, err := hex.DecodeString(strings.TrimPrefix(addr, "0x"))
+		if err != nil || len(addrBytes) != common.AddressLength {
+			return fmt.Errorf("Contract gas factor key '%s' must be a contract address in hex", addr)
+		}
+		if factor < 1 {
+			return fmt.Errorf("Gas estimation factor %g for contract %s must not be less than 1", factor, addr)
+		}
+		g.byAddress[common.BytesToAddress(addrBytes)] = factor
+	}
+	return nil
+}
+
+// factorFor returns the factor for the contract a transaction is sent to,
+// falling back to the global factor
+func (g *gasFactors) factorFor(tx *kldeth.Txn) float64 {
+	if to := tx.EthTX.To(); to != nil {
+		if factor, exists := g.byAddress[*to]; exists {
+			return factor
+		}
+	}
+	return g.global
+}
+
+// apply multiplies the estimated gas for a transaction by its factor
+func (g *gasFactors) apply(tx *kldeth.Txn, estimated uint64) uint64 {
+	return uint64(float64(estimated) * g.factorFor(tx))
+}
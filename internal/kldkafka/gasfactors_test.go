@@ -0,0 +1,48 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGasFactorContract = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+
+func TestGasFactorsInit(t *testing.T) {
+	assert := assert.New(t)
+
+	g := newGasFactors()
+	assert.NoError(g.init(0, nil))
+	assert.Equal(1.0, g.global)
+
+	g = newGasFactors()
+	assert.NoError(g.init(1.2, map[string]float64{testGasFactorContract: 2}))
+	assert.Equal(1.2, g.global)
+	assert.Equal(2.0, g.byAddress[common.HexToAddress(testGasFactorContract)])
+}
+
+func TestGasFactorsInitErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	err := newGasFactors().init(0.5, nil)
+	assert.EqualError(err, "Gas estimation factor 0.5 must not be less than 1")
+	err = newGasFactors().init(0, map[string]float64{"0x1234": 2})
+	assert.EqualError(err, "Contract gas factor key '0x1234' must be a contract address in hex")
+	err = newGasFactors().init(0, map[string]float64{testGasFactorContract: 0.9})
+	assert.EqualError(err, "Gas estimation factor 0.9 for contract "+testGasFactorContract+" must not be less than 1")
+}
@@ -0,0 +1,205 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultGasOracleRefresh is the number of seconds the gas price read from the oracle contract is cached
+	DefaultGasOracleRefresh = 30
+	// DefaultGasOracleOutput is the type of the value returned by the oracle method
+	DefaultGasOracleOutput = "uint256"
+)
+
+// gasOracleMethod matches the name of the oracle method, with optional empty parentheses
+var gasOracleMethod = regexp.MustCompile(`^([a-zA-Z_$][a-zA-Z0-9_$]*)(\(\))?$`)
+
+// GasOracleConf configures an on-chain oracle contract to read the gas price of
+// transactions from, for chains where gas pricing is governed by a contract
+type GasOracleConf struct {
+	Address     string   `json:"address,omitempty"`
+	Method      string   `json:"method,omitempty"`
+	Outputs     []string `json:"outputs,omitempty"`
+	OutputIndex int      `json:"outputIndex"`
+	Refresh     int      `json:"refresh"` // seconds
+}
+
+// gasOracle reads the gas price from a method of the oracle contract with
+// eth_call, caching it for the refresh interval. The method takes no parameters,
+// and the gas price is the output at outputIndex, which must be an integer
+type gasOracle struct {
+	lock        sync.Mutex
+	address     *common.Address // nil if there is no oracle
+	method      *abi.Method
+	outputIndex int
+	refresh     time.Duration
+	price       *big.Int
+	expiry      time.Time
+}
+
+func newGasOracle() *gasOracle {
+	return &gasOracle{}
+}
+
+// init validates the configuration of the oracle
+func (o *gasOracle) init(conf *GasOracleConf) error {
+	if conf.Address == "" {
+		return nil
+	}
+	address, err := kldutils.StrToAddress("gas oracle address", conf.Address)
+	if err != nil {
+		return err
+	}
+	match := gasOracleMethod.FindStringSubmatch(conf.Method)
+	if match == nil {
+		return fmt.Errorf("Invalid gas oracle method '%s' (must be the name of a method without parameters, such as 'gasPrice()')", conf.Method)
+	}
+	method := &abi.Method{Name: match[1], Const: true}
+	outputs := conf.Outputs
+	if len(outputs) == 0 {
+		outputs = []string{DefaultGasOracleOutput}
+	}
+	for i, output := range outputs {
+		outputType, err := abi.NewType(output)
+		if err != nil {
+			return fmt.Errorf("Invalid gas oracle output %d '%s': %s", i, output, err)
+		}
+		method.Outputs = append(method.Outputs, abi.Argument{Type: outputType})
+	}
+	if conf.OutputIndex < 0 || conf.OutputIndex >= len(outputs) {
+		return fmt.Errorf("Gas oracle output index %d is out of range for %d outputs", conf.OutputIndex, len(outputs))
+	}
+	if t := method.Outputs[conf.OutputIndex].Type.T; t != abi.UintTy && t != abi.IntTy {
+		return fmt.Errorf("Gas oracle output %d '%s' must be an integer type", conf.OutputIndex, outputs[conf.OutputIndex])
+	}
+	refresh := conf.Refresh
+	if refresh <= 0 {
+		refresh = DefaultGasOracleRefresh
+	}
+
+	o.lock.Lock()
+	o.address = &address
+	o.method = method
+	o.outputIndex = conf.OutputIndex
+	o.refresh = time.Duration(refresh) * time.Second
+	o.lock.Unlock()
+	return nil
+}
+
+// forChain returns an oracle with the same configuration, and its own cache,
+// for one of the additional chains
+func (o *gasOracle) forChain() *gasOracle {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return &gasOracle{
+		address:     o.address,
+		method:      o.method,
+		outputIndex: o.outputIndex,
+		refresh:     o.refresh,
+	}
+}
+
+func (o *gasOracle) configured() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.address != nil
+}
+
+// gasPrice returns the cached gas price, calling the oracle if it has expired.
+// The last gas price read is used if the call fails, so a transient failure of
+// the node does not fail every transaction
+func (o *gasOracle) gasPrice(rpc kldeth.RPCClient) (*big.Int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.price != nil && time.Now().Before(o.expiry) {
+		return o.price, nil
+	}
+	price, err := o.callOracle(rpc)
+	if err != nil {
+		if o.price == nil {
+			return nil, fmt.Errorf("Failed to read the gas price from oracle contract %s: %s", o.address.Hex(), err)
+		}
+		log.Warnf("Failed to read the gas price from oracle contract %s, so using the last gas price %s: %s", o.address.Hex(), o.price.Text(10), err)
+		return o.price, nil
+	}
+	log.Debugf("Gas price from oracle contract %s: %s", o.address.Hex(), price.Text(10))
+	o.price = price
+	o.expiry = time.Now().Add(o.refresh)
+	return o.price, nil
+}
+
+func (o *gasOracle) callOracle(rpc kldeth.RPCClient) (*big.Int, error) {
+	values, err := kldeth.CallMethod(rpc, *o.address, o.method)
+	if err != nil {
+		return nil, err
+	}
+	var price *big.Int
+	switch v := values[o.outputIndex].(type) {
+	case *big.Int:
+		price = v
+	case uint8:
+		price = new(big.Int).SetUint64(uint64(v))
+	case uint16:
+		price = new(big.Int).SetUint64(uint64(v))
+	case uint32:
+		price = new(big.Int).SetUint64(uint64(v))
+	case uint64:
+		price = new(big.Int).SetUint64(v)
+	case int8:
+		price = big.NewInt(int64(v))
+	case int16:
+		price = big.NewInt(int64(v))
+	case int32:
+		price = big.NewInt(int64(v))
+	case int64:
+		price = big.NewInt(v)
+	default:
+		return nil, fmt.Errorf("Unexpected output type %T", v)
+	}
+	if price.Sign() < 0 {
+		return nil, fmt.Errorf("Negative gas price %s", price.Text(10))
+	}
+	return price, nil
+}
+
+// defaultGasPrice returns the gas price for transactions that do not specify one,
+// from the oracle contract if there is one, otherwise the static gas price.
+// Chains with detected gas pricing choose the gas price by their pricing
+func (p *msgProcessor) defaultGasPrice() (json.Number, error) {
+	if p.gasPricing != nil {
+		return p.detectedGasPrice()
+	}
+	if !p.gasOracle.configured() {
+		return json.Number(p.conf.StaticGasPrice), nil
+	}
+	price, err := p.gasOracle.gasPrice(p.rpc)
+	if err != nil {
+		return "", err
+	}
+	return json.Number(price.Text(10)), nil
+}
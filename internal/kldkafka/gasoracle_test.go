@@ -0,0 +1,162 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+)
+
+const testGasOracleAddr = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+
+// uint256 of 1000000000, then 2000000000
+var testGasOracleResult = hexutil.MustDecode("0x" +
+	"000000000000000000000000000000000000000000000000000000003b9aca00" +
+	"0000000000000000000000000000000000000000000000000000000077359400")
+
+func TestGasOracleInit(t *testing.T) {
+	assert := assert.New(t)
+
+	o := newGasOracle()
+	assert.NoError(o.init(&GasOracleConf{}))
+	assert.False(o.configured())
+
+	assert.NoError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice()"}))
+	assert.True(o.configured())
+	assert.Equal("gasPrice()", o.method.Sig())
+	assert.Equal(1, len(o.method.Outputs))
+	assert.Equal(DefaultGasOracleRefresh, int(o.refresh.Seconds()))
+
+	chainOracle := o.forChain()
+	assert.True(chainOracle.configured())
+	assert.Equal(o.method, chainOracle.method)
+}
+
+func TestGasOracleInitBadConf(t *testing.T) {
+	assert := assert.New(t)
+
+	o := newGasOracle()
+	assert.Regexp("gas oracle address", o.init(&GasOracleConf{Address: "bad"}))
+	assert.EqualError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice(uint256)"}),
+		"Invalid gas oracle method 'gasPrice(uint256)' (must be the name of a method without parameters, such as 'gasPrice()')")
+	assert.Regexp("Invalid gas oracle output 0 'bad'", o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice", Outputs: []string{"bad"}}))
+	assert.EqualError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice", OutputIndex: 1}),
+		"Gas oracle output index 1 is out of range for 1 outputs")
+	assert.EqualError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice", Outputs: []string{"string"}}),
+		"Gas oracle output 0 'string' must be an integer type")
+	assert.False(o.configured())
+}
+
+func TestGasOracleGasPriceCached(t *testing.T) {
+	assert := assert.New(t)
+
+	o := newGasOracle()
+	assert.NoError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "prices", Outputs: []string{"uint256", "uint64"}, OutputIndex: 1}))
+	rpc := &testRPC{ethCallResult: testGasOracleResult}
+
+	price, err := o.gasPrice(rpc)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(2000000000), price)
+	price, err = o.gasPrice(rpc)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(2000000000), price)
+	assert.Equal([]string{"eth_call"}, rpc.calls)
+}
+
+func TestGasOracleGasPriceFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	o := newGasOracle()
+	assert.NoError(o.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice"}))
+	rpc := &testRPC{ethCallErr: fmt.Errorf("pop")}
+
+	_, err := o.gasPrice(rpc)
+	assert.EqualError(err, "Failed to read the gas price from oracle contract "+testGasOracleAddr+": pop")
+
+	// The last gas price is used once it has expired, if the oracle cannot be read
+	rpc.ethCallErr = nil
+	rpc.ethCallResult = testGasOracleResult[0:32]
+	price, err := o.gasPrice(rpc)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(1000000000), price)
+	o.expiry = time.Now()
+	rpc.ethCallErr = fmt.Errorf("pop")
+	price, err = o.gasPrice(rpc)
+	assert.NoError(err)
+	assert.Equal(big.NewInt(1000000000), price)
+	assert.Equal(3, len(rpc.calls))
+}
+
+func TestOnSendTransactionMessageGasOracle(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.gasOracle.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice"}))
+	testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	testRPC := goodMessageRPC()
+	testRPC.ethCallResult = testGasOracleResult[0:32]
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(big.NewInt(1000000000), inflight.tx.EthTX.GasPrice())
+	assert.Equal("eth_call", testRPC.calls[0])
+}
+
+func TestOnSendTransactionMessageGasOracleFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.gasOracle.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice"}))
+	testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	testRPC := goodMessageRPC()
+	testRPC.ethCallErr = fmt.Errorf("pop")
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Failed to read the gas price from oracle contract", testMsgContext.errorRepies[0].err)
+	assert.Empty(msgProcessor.inflightTxns[strings.ToLower(testFromAddr)])
+}
+
+func TestExecuteBridgeWithGasOracleAndStaticGasPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--gas-price", "1", "--gas-oracle-address", testGasOracleAddr, "--gas-oracle-method", "gasPrice"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "A static gas price and a gas oracle cannot both be configured")
+}
+
+func TestExecuteBridgeWithBadGasOracle(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--gas-oracle-address", testGasOracleAddr, "--gas-oracle-outputs", "uint256,uint256", "--gas-oracle-output-index", "2"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Invalid gas oracle method ''", err)
+}
@@ -0,0 +1,130 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// GasPricingFree is detected on chains where the node suggests a gas price of zero
+	GasPricingFree = "free"
+	// GasPricingPriced is detected on chains where the node suggests a gas price above zero
+	GasPricingPriced = "priced"
+)
+
+// nodeGasPriceRefresh is how long the gas price suggested by the node is cached
+const nodeGasPriceRefresh = DefaultGasOracleRefresh * time.Second
+
+// gasPricing is the pricing detected for a chain when connecting to its node.
+// On a priced chain, the gas price suggested by the node is cached for
+// transactions that do not have a gas price from the request or configuration
+type gasPricing struct {
+	lock   sync.Mutex
+	mode   string
+	price  *big.Int
+	expiry time.Time
+}
+
+// DetectGasPricing detects whether each chain is free or priced, from the gas
+// price suggested by its node, returning the pricing of the default chain
+func (p *msgProcessor) DetectGasPricing() (string, error) {
+	if err := p.detectGasPricing("default chain"); err != nil {
+		return "", err
+	}
+	p.chainsLock.RLock()
+	chains := make(map[string]*msgProcessor, len(p.chains))
+	for name, cp := range p.chains {
+		chains[name] = cp
+	}
+	p.chainsLock.RUnlock()
+	for name, cp := range chains {
+		if err := cp.detectGasPricing(fmt.Sprintf("chain '%s'", name)); err != nil {
+			return "", err
+		}
+	}
+	return p.gasPricing.mode, nil
+}
+
+func (p *msgProcessor) detectGasPricing(desc string) error {
+	price, err := kldeth.GetGasPrice(p.rpc)
+	if err != nil {
+		return fmt.Errorf("Unable to detect the gas pricing of the %s: %s", desc, err)
+	}
+	pricing := &gasPricing{
+		mode:   GasPricingFree,
+		price:  price,
+		expiry: time.Now().Add(nodeGasPriceRefresh),
+	}
+	staticGasPrice, _ := new(big.Int).SetString(p.conf.StaticGasPrice, 10)
+	if price.Sign() == 0 {
+		log.Infof("Detected free gas pricing on the %s: transactions without a gas price are sent with a gas price of zero", desc)
+		if (staticGasPrice != nil && staticGasPrice.Sign() > 0) || p.gasOracle.configured() {
+			log.Warnf("The configured gas price is ignored on the %s, as it is free", desc)
+		}
+	} else {
+		pricing.mode = GasPricingPriced
+		log.Infof("Detected priced gas on the %s: the node suggests a gas price of %s", desc, price.Text(10))
+		if staticGasPrice != nil && staticGasPrice.Sign() == 0 {
+			log.Warnf("The configured gas price of zero is ignored on the %s, as it is priced", desc)
+		}
+	}
+	p.gasPricing = pricing
+	return nil
+}
+
+// detectedGasPrice returns the gas price for transactions that do not specify
+// one on a chain with detected pricing. Free chains always use zero. Priced chains
+// use the configured gas price if above zero, then the oracle, then the gas price
+// suggested by the node
+func (p *msgProcessor) detectedGasPrice() (json.Number, error) {
+	if p.gasPricing.mode == GasPricingFree {
+		return "0", nil
+	}
+	if staticGasPrice, ok := new(big.Int).SetString(p.conf.StaticGasPrice, 10); ok && staticGasPrice.Sign() > 0 {
+		return json.Number(p.conf.StaticGasPrice), nil
+	}
+	if p.gasOracle.configured() {
+		price, err := p.gasOracle.gasPrice(p.rpc)
+		if err != nil {
+			return "", err
+		}
+		return json.Number(price.Text(10)), nil
+	}
+	return json.Number(p.gasPricing.nodeGasPrice(p.rpc).Text(10)), nil
+}
+
+// nodeGasPrice returns the cached gas price suggested by the node, refreshing it
+// if it has expired. The last gas price is used if the node fails to return one
+func (g *gasPricing) nodeGasPrice(rpc kldeth.RPCClient) *big.Int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if time.Now().After(g.expiry) {
+		if price, err := kldeth.GetGasPrice(rpc); err != nil {
+			log.Warnf("Failed to refresh the gas price from the node, using %s: %s", g.price.Text(10), err)
+		} else if price.Sign() > 0 {
+			g.price = price
+		}
+		g.expiry = time.Now().Add(nodeGasPriceRefresh)
+	}
+	return g.price
+}
@@ -0,0 +1,147 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetectGasPricingFree(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StaticGasPrice = "1000"
+	msgProcessor.Init(&testRPC{}, 1)
+	msgProcessor.conf.Chains = map[string]*ChainConf{"chain1": {URL: "http://chain1"}}
+	chainRPC := &testRPC{ethGasPriceResult: hexutil.Big(*big.NewInt(2000))}
+	assert.NoError(msgProcessor.InitChain("chain1", chainRPC))
+
+	mode, err := msgProcessor.DetectGasPricing()
+	assert.NoError(err)
+	assert.Equal(GasPricingFree, mode)
+	assert.Equal(GasPricingPriced, msgProcessor.chains["chain1"].gasPricing.mode)
+
+	// The configured gas price is not used on a free chain
+	gasPrice, err := msgProcessor.defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("0"), gasPrice)
+	gasPrice, err = msgProcessor.chains["chain1"].defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("1000"), gasPrice)
+}
+
+func TestDetectGasPricingPriced(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StaticGasPrice = "0"
+	rpc := &testRPC{ethGasPriceResult: hexutil.Big(*big.NewInt(2000))}
+	msgProcessor.Init(rpc, 1)
+
+	mode, err := msgProcessor.DetectGasPricing()
+	assert.NoError(err)
+	assert.Equal(GasPricingPriced, mode)
+
+	// A gas price of zero is not sent to a priced chain, and the node gas price is cached
+	gasPrice, err := msgProcessor.defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("2000"), gasPrice)
+	assert.Equal([]string{"eth_gasPrice"}, rpc.calls)
+
+	// The last gas price is used if it cannot be refreshed
+	msgProcessor.gasPricing.expiry = time.Now()
+	rpc.ethGasPriceErr = fmt.Errorf("pop")
+	gasPrice, err = msgProcessor.defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("2000"), gasPrice)
+
+	msgProcessor.gasPricing.expiry = time.Now()
+	rpc.ethGasPriceErr = nil
+	rpc.ethGasPriceResult = hexutil.Big(*big.NewInt(3000))
+	gasPrice, err = msgProcessor.defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("3000"), gasPrice)
+	assert.Equal(3, len(rpc.calls))
+}
+
+func TestDetectGasPricingPricedOracle(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.gasOracle.init(&GasOracleConf{Address: testGasOracleAddr, Method: "gasPrice"}))
+	rpc := &testRPC{ethGasPriceResult: hexutil.Big(*big.NewInt(2000)), ethCallResult: testGasOracleResult[0:32]}
+	msgProcessor.Init(rpc, 1)
+
+	_, err := msgProcessor.DetectGasPricing()
+	assert.NoError(err)
+	gasPrice, err := msgProcessor.defaultGasPrice()
+	assert.NoError(err)
+	assert.Equal(json.Number("1000000000"), gasPrice)
+}
+
+func TestDetectGasPricingErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.Init(&testRPC{ethGasPriceErr: fmt.Errorf("pop")}, 1)
+	_, err := msgProcessor.DetectGasPricing()
+	assert.EqualError(err, "Unable to detect the gas pricing of the default chain: pop")
+
+	msgProcessor = newMsgProcessor()
+	msgProcessor.Init(&testRPC{}, 1)
+	msgProcessor.conf.Chains = map[string]*ChainConf{"chain1": {URL: "http://chain1"}}
+	assert.NoError(msgProcessor.InitChain("chain1", &testRPC{ethGasPriceErr: fmt.Errorf("pop")}))
+	_, err = msgProcessor.DetectGasPricing()
+	assert.EqualError(err, "Unable to detect the gas pricing of the chain 'chain1': pop")
+}
+
+func TestOnSendTransactionMessageDetectedGasPricing(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	testRPC := goodMessageRPC()
+	testRPC.ethGasPriceResult = hexutil.Big(*big.NewInt(2000))
+	msgProcessor.Init(testRPC, 1)
+	_, err := msgProcessor.DetectGasPricing()
+	assert.NoError(err)
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(big.NewInt(2000), inflight.tx.EthTX.GasPrice())
+}
+
+func TestReadyzGasPricing(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.statusRPC = &testRPC{ethBlockNumberResult: 12345}
+	k.gasPricing = GasPricingPriced
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"ready":true,"gasPricing":"priced"}`, res.Body.String())
+}
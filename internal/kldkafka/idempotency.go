@@ -0,0 +1,101 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkIdempotencyKey looks for an earlier message with the same idempotency key
+// as this one, scoped to the tenant. If the earlier message has been replied to
+// successfully, the reply is returned to send instead of processing this one.
+// While the earlier message is still being processed we cannot know its result,
+// so this one is rejected. Otherwise this message becomes the active one for the key
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) checkIdempotencyKey(ctx *msgContext) (*completedMsg, error) {
+	headers := &ctx.requestCommon.Headers
+	if k.conf.IdempotencyTTL <= 0 || headers.IdempotencyKey == "" {
+		return nil, nil
+	}
+	key := fmt.Sprintf("%s/%s", headers.Tenant, headers.IdempotencyKey)
+	k.expireIdempotent()
+	if cached, exists := k.idempotent[key]; exists {
+		return cached, nil
+	}
+	if active, exists := k.idempotentActive[key]; exists {
+		// The reply of a completed message is safe to read under the lock, and a
+		// message with a held offset has already sent its reply
+		replied := active.complete || active.heldConsumer != nil
+		if !replied {
+			return nil, fmt.Errorf("A message with idempotency key '%s' is already being processed", headers.IdempotencyKey)
+		}
+		if active.errorStatus == 0 {
+			return k.newCompletedMsg(active, k.conf.IdempotencyTTL), nil
+		}
+	}
+	ctx.idempotencyKey = key
+	k.idempotentActive[key] = ctx
+	return nil, nil
+}
+
+// addIdempotent caches the reply of a message with an idempotency key, once the
+// message leaves the inFlight map. Error replies are not cached, so a failed
+// operation can be retried with the same key
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) addIdempotent(ctx *msgContext) {
+	if ctx.idempotencyKey == "" {
+		return
+	}
+	if k.idempotentActive[ctx.idempotencyKey] == ctx {
+		delete(k.idempotentActive, ctx.idempotencyKey)
+	}
+	if ctx.errorStatus != 0 {
+		return
+	}
+	completed := k.newCompletedMsg(ctx, k.conf.IdempotencyTTL)
+	completed.idempotencyKey = ctx.idempotencyKey
+	k.idempotent[ctx.idempotencyKey] = completed
+	k.idempotentLRU = append(k.idempotentLRU, completed)
+}
+
+// expireIdempotent removes cached replies that are older than the TTL.
+// As the TTL is fixed, the list is always in expiry order.
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) expireIdempotent() {
+	now := time.Now()
+	var i int
+	for i = 0; i < len(k.idempotentLRU) && now.After(k.idempotentLRU[i].expiry); i++ {
+		if k.idempotent[k.idempotentLRU[i].idempotencyKey] == k.idempotentLRU[i] {
+			delete(k.idempotent, k.idempotentLRU[i].idempotencyKey)
+		}
+	}
+	k.idempotentLRU = k.idempotentLRU[i:]
+}
+
+// replyIdempotent replies to a duplicate of a message with an idempotency key, with
+// the reply to the earlier message. The reply is copied and sent as a reply to this
+// message, so has its own ID, and the request ID, offset and key of this message
+func (c *msgContext) replyIdempotent() {
+	original := reflect.ValueOf(c.idemReply.replyMessage).Elem()
+	replyCopy := reflect.New(original.Type())
+	replyCopy.Elem().Set(original)
+	log.Infof("Sending the reply to %s again: %s", c.idemReply.reqOffset, c)
+	c.Reply(replyCopy.Interface().(kldmessages.ReplyWithHeaders))
+}
@@ -0,0 +1,191 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestIdempotentMsg(id, tenant, idempotencyKey string) []byte {
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = "TestIdempotency"
+	msg.Headers.ID = id
+	msg.Headers.Tenant = tenant
+	msg.Headers.IdempotencyKey = idempotencyKey
+	msgBytes, _ := json.Marshal(&msg)
+	return msgBytes
+}
+
+func TestIdempotencyKeyDuplicateGetsCachedReply(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.IdempotencyTTL = 60
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 200, Value: newTestIdempotentMsg("request1", "", "order1")}
+	msgContext1 := <-processor.messages
+	go func() {
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	// Wait for the reply to be confirmed, which caches it
+	for cached := false; !cached; {
+		k.inFlightCond.L.Lock()
+		cached = len(k.idempotent) == 1
+		k.inFlightCond.L.Unlock()
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// A different message with the same key gets the same reply, without processing,
+	// but with the headers and key of the duplicate
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 201, Value: newTestIdempotentMsg("request2", "", "order1")}
+	duplicateKafkaMsg := <-mockProducer.MockInput
+	duplicateBytes, _ := duplicateKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- duplicateKafkaMsg
+	var reply, duplicate kldmessages.ReplyCommon
+	json.Unmarshal(replyBytes, &reply)
+	json.Unmarshal(duplicateBytes, &duplicate)
+	assert.Equal("TestReply", duplicate.Headers.MsgType)
+	assert.Equal("request1", reply.Headers.ReqID)
+	assert.Equal("request2", duplicate.Headers.ReqID)
+	assert.Equal(":2:201", duplicate.Headers.ReqOffset)
+	assert.NotEqual(reply.Headers.ID, duplicate.Headers.ID)
+	assert.Equal(sarama.StringEncoder("request1"), replyKafkaMsg.Key)
+	assert.Equal(sarama.StringEncoder("request2"), duplicateKafkaMsg.Key)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(201), mockConsumer.OffsetsByPartition[2])
+	assert.Equal(0, len(processor.messages))
+	assert.Equal(1, len(k.idempotent))
+	assert.Empty(k.idempotentActive)
+}
+
+func TestIdempotencyKeyInProgressRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.IdempotencyTTL = 60
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 200, Value: newTestIdempotentMsg("request1", "", "order1")}
+	msgContext1 := <-processor.messages
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 201, Value: newTestIdempotentMsg("request2", "", "order1")}
+	errorKafkaMsg := <-mockProducer.MockInput
+	errorBytes, _ := errorKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- errorKafkaMsg
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(errorBytes, &errorReply)
+	assert.Equal("A message with idempotency key 'order1' is already being processed", errorReply.ErrorMessage)
+
+	go func() {
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(201), mockConsumer.OffsetsByPartition[2])
+	assert.Equal(1, len(k.idempotent))
+	assert.Empty(k.idempotentActive)
+}
+
+func TestCheckIdempotencyKey(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	newCtx := func(offset, tenant string) *msgContext {
+		ctx := &msgContext{reqOffset: offset}
+		json.Unmarshal(newTestIdempotentMsg("", tenant, "order1"), &ctx.requestCommon)
+		return ctx
+	}
+
+	// Disabled by default
+	cached, err := k.checkIdempotencyKey(newCtx("t:0:1", ""))
+	assert.NoError(err)
+	assert.Nil(cached)
+	assert.Empty(k.idempotentActive)
+
+	k.conf.IdempotencyTTL = 60
+	ctx1 := newCtx("t:0:1", "")
+	cached, err = k.checkIdempotencyKey(ctx1)
+	assert.NoError(err)
+	assert.Nil(cached)
+
+	// An error reply is not cached, so a retry is processed
+	ctx1.complete = true
+	ctx1.errorStatus = 500
+	ctx2 := newCtx("t:0:2", "")
+	cached, err = k.checkIdempotencyKey(ctx2)
+	assert.NoError(err)
+	assert.Nil(cached)
+	k.addIdempotent(ctx1)
+	assert.Empty(k.idempotent)
+	assert.Equal(ctx2, k.idempotentActive["/order1"])
+
+	// A reply from a message that is complete, but still in-flight, is re-sent
+	ctx2.complete = true
+	ctx2.replyBytes = []byte("reply2")
+	cached, err = k.checkIdempotencyKey(newCtx("t:0:3", ""))
+	assert.NoError(err)
+	assert.Equal([]byte("reply2"), cached.replyBytes)
+
+	k.addIdempotent(ctx2)
+	assert.Empty(k.idempotentActive)
+	cached, err = k.checkIdempotencyKey(newCtx("t:0:4", ""))
+	assert.NoError(err)
+	assert.Equal("t:0:2", cached.reqOffset)
+
+	// Keys are scoped to the tenant
+	cached, err = k.checkIdempotencyKey(newCtx("t:0:5", "tenant1"))
+	assert.NoError(err)
+	assert.Nil(cached)
+
+	k.idempotentLRU[0].expiry = time.Now().Add(-1 * time.Second)
+	cached, err = k.checkIdempotencyKey(newCtx("t:0:6", ""))
+	assert.NoError(err)
+	assert.Nil(cached)
+	assert.Empty(k.idempotent)
+	assert.Empty(k.idempotentLRU)
+}
+
+func TestExecuteBridgeWithNegativeIdempotencyTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--idempotency-ttl", "-1"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Idempotency TTL -1 must not be negative")
+}
@@ -15,41 +15,237 @@
 package kldkafka
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
 	"github.com/kaleido-io/ethconnect/internal/kldutils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+const (
+	// OversizeRepliesTruncate drops optional content from replies that exceed MaxReplySize
+	OversizeRepliesTruncate = "truncate"
+	// OversizeRepliesError replaces replies that exceed MaxReplySize with an error
+	OversizeRepliesError = "error"
+	// ReplyFieldNamingCamel sends reply fields named as in the message definitions (default)
+	ReplyFieldNamingCamel = "camelCase"
+	// ReplyFieldNamingSnake converts all reply field names to snake_case
+	ReplyFieldNamingSnake = "snake_case"
+	// StatusFormatNumeric sends the status of receipts as a numeric string, such as "1" (default)
+	StatusFormatNumeric = "numeric"
+	// StatusFormatBool sends the status of receipts as true or false
+	StatusFormatBool = "bool"
+	// StatusFormatBoth sends the numeric status, with the boolean status in statusBool
+	StatusFormatBoth = "both"
+)
+
+// replyAddressFields are the fields of replies that hold an address. Parameters decoded
+// from the ABI (event data and revert params) are already in the checksum format
+var replyAddressFields = []string{"from", "to", "contractAddress", "address"}
+
 // KafkaBridgeConf defines the YAML config structure for a webhooks bridge instance
 type KafkaBridgeConf struct {
-	Kafka         KafkaCommonConf `json:"kafka"`
-	MaxInFlight   int             `json:"maxInFlight"`
-	MaxTXWaitTime int             `json:"maxTXWaitTime"`
-	PredictNonces bool            `json:"alwaysManageNonce"`
-	RPC           struct {
-		URL string `json:"url"`
+	Kafka                 KafkaCommonConf       `json:"kafka"`
+	MaxInFlight           int                   `json:"maxInFlight"`
+	MaxInFlightBytes      int                   `json:"maxInFlightBytes,omitempty"`
+	MaxConcurrentSubmits  int                   `json:"maxConcurrentSubmits"`
+	PriorityOrdering      bool                  `json:"priorityOrdering"`
+	SubmitRate            float64               `json:"submitRate"`
+	SubmitBurst           int                   `json:"submitBurst"`
+	ReceiptPollInterval   int                   `json:"receiptPollInterval,omitempty"` // ms
+	ReceiptBatchSize      int                   `json:"receiptBatchSize,omitempty"`
+	MaxTXWaitTime         int                   `json:"maxTXWaitTime"`
+	TXBlockDeadline       int                   `json:"txBlockDeadline"`
+	Confirmations         int                   `json:"confirmations"`
+	MaxConfirmations      int                   `json:"maxConfirmations,omitempty"`
+	CommitConfirmations   int                   `json:"commitConfirmations"`
+	DetectDroppedTXs      bool                  `json:"detectDroppedTXs"`
+	PredictNonces         bool                  `json:"alwaysManageNonce"`
+	NonceRefreshAccounts  []string              `json:"nonceRefreshAccounts,omitempty"`
+	RedeliveryGracePeriod int                   `json:"redeliveryGracePeriod"`
+	RedeliveryStore       string                `json:"redeliveryStore,omitempty"`
+	IdempotencyTTL        int                   `json:"idempotencyTTL,omitempty"`
+	MaxMessageAge         int                   `json:"maxMessageAge"`
+	MaxGasLimit           int64                 `json:"maxGasLimit"`
+	MinGasLimit           int64                 `json:"minGasLimit"`
+	MaxCalldataSize       int                   `json:"maxCalldataSize,omitempty"`
+	MethodGas             map[string]int        `json:"methodGas,omitempty"`
+	DefaultGas            int64                 `json:"defaultGas,omitempty"`
+	GasEstimationFactor   float64               `json:"gasEstimationFactor,omitempty"`
+	ContractGasFactors    map[string]float64    `json:"contractGasFactors,omitempty"`
+	FailureEvents         map[string]string     `json:"failureEvents,omitempty"`
+	StaticGasPrice        string                `json:"staticGasPrice,omitempty"`
+	DetectGasPricing      bool                  `json:"detectGasPricing"`
+	SimulateBeforeSend    bool                  `json:"simulateBeforeSend"`
+	AllowTracing          bool                  `json:"allowTracing"`
+	CheckContractCode     bool                  `json:"checkContractCode"`
+	CheckBalance          bool                  `json:"checkBalance"`
+	StrictFrom            bool                  `json:"strictFrom"`
+	ContractCodeCacheTTL  int                   `json:"contractCodeCacheTTL"`
+	Tenants               []string              `json:"tenants,omitempty"`
+	Filters               []string              `json:"filters,omitempty"`
+	MaxInFlightPerTenant  int                   `json:"maxInFlightPerTenant"`
+	MaxQueuedPerAccount   int                   `json:"maxQueuedPerAccount"`
+	DirectParseErrors     bool                  `json:"directParseErrors"`
+	MaxReplySize          int                   `json:"maxReplySize"`
+	OversizeReplies       string                `json:"oversizeReplies,omitempty"`
+	ReplyFieldNaming      string                `json:"replyFieldNaming,omitempty"`
+	ChecksumAddresses     bool                  `json:"checksumAddresses"`
+	ReplyLoad             bool                  `json:"replyLoad"`
+	StatusFormat          string                `json:"statusFormat,omitempty"`
+	ReplyEnvelope         string                `json:"replyEnvelope,omitempty"`
+	ReplyEncryption       ReplyEncryptionConf   `json:"replyEncryption"`
+	ReplyTopic            ReplyTopicConf        `json:"replyTopic"`
+	ErrorTopicOut         string                `json:"errorTopicOut,omitempty"`
+	SingleTopic           bool                  `json:"singleTopic"`
+	SchemaRegistry        SchemaRegistryConf    `json:"schemaRegistry"`
+	CloudEventsSource     string                `json:"cloudEventsSource,omitempty"`
+	LogFullPayloads       bool                  `json:"logFullPayloads"`
+	RedactFields          []string              `json:"redactFields,omitempty"`
+	Audit                 AuditConf             `json:"audit"`
+	DeadLetter            DeadLetterConf        `json:"deadLetter"`
+	GasOracle             GasOracleConf         `json:"gasOracle"`
+	TxTemplatesFile       string                `json:"txTemplatesFile,omitempty"`
+	RequestSchemaFile     string                `json:"requestSchemaFile,omitempty"`
+	RequestHook           RequestHookConf       `json:"requestHook"`
+	ErrorCoalescing       ErrorCoalescingConf   `json:"errorCoalescing"`
+	LocalSigners          map[string]string     `json:"localSigners,omitempty"`
+	Chains                map[string]*ChainConf `json:"chains,omitempty"`
+	AdminToken            string                `json:"adminToken,omitempty"`
+	KafkaHeaders          struct {
+		Context []string `json:"context,omitempty"`
+		Reply   []string `json:"reply,omitempty"`
+		// Kafka header name, to the path of a field in the reply such as headers.type
+		ReplyFields map[string]string `json:"replyFields,omitempty"`
+		// Kafka header name, to the path of a field in the request such as order.id
+		RequestFields map[string]string `json:"requestFields,omitempty"`
+		// Kafka header with the key for the reply, instead of the account or ID
+		Key         string `json:"key,omitempty"`
+		KeyRequired bool   `json:"keyRequired,omitempty"`
+	} `json:"kafkaHeaders"`
+	RPC struct {
+		URL             string             `json:"url"`
+		ExpectedChainID int64              `json:"expectedChainID,omitempty"`
+		TLS             kldutils.TLSConfig `json:"tls"`
+		ReconnectWait   int                `json:"reconnectWait,omitempty"`
 	} `json:"rpc"`
+	Metrics struct {
+		LocalAddr string `json:"localAddr,omitempty"`
+		Port      int    `json:"port,omitempty"`
+	} `json:"metrics"`
+	Tombstones struct {
+		Enabled    bool     `json:"enabled"`
+		ReplyTypes []string `json:"replyTypes,omitempty"`
+	} `json:"tombstones"`
+	Readyz struct {
+		NodeStatus bool `json:"nodeStatus"`
+		CacheTTL   int  `json:"cacheTTL"`
+	} `json:"readyz"`
+	TxPool struct {
+		MaxPending int `json:"maxPending"`
+		MaxQueued  int `json:"maxQueued"`
+		CacheTTL   int `json:"cacheTTL"` // milliseconds
+	} `json:"txPool"`
+	GasBump struct {
+		Interval    int    `json:"interval"` // seconds
+		Percent     int    `json:"percent"`
+		MaxGasPrice string `json:"maxGasPrice,omitempty"`
+		MaxAttempts int    `json:"maxAttempts"`
+	} `json:"gasBump"`
+}
+
+// ChainConf configures a chain that messages can be routed to with the chain header,
+// in addition to the default chain of the RPC configuration
+type ChainConf struct {
+	URL             string            `json:"url"`
+	ExpectedChainID int64             `json:"expectedChainID,omitempty"`
+	LocalSigners    map[string]string `json:"localSigners,omitempty"`
 }
 
 // KafkaBridge receives messages from Kafka and dispatches them to go-ethereum over JSON/RPC
 type KafkaBridge struct {
-	printYAML    *bool
-	conf         KafkaBridgeConf
-	kafka        KafkaCommon
-	rpc          *rpc.Client
-	processor    MsgProcessor
-	inFlight     map[string]*msgContext
-	inFlightCond *sync.Cond
+	printYAML        *bool
+	conf             KafkaBridgeConf
+	kafka            KafkaCommon
+	rpc              *rpc.Client
+	rpcHTTPClient    *http.Client
+	rpcLatency       *kldmetrics.HistogramVec
+	droppedTXs       *kldmetrics.Counter
+	msgsTotal        *kldmetrics.CounterVec
+	replyLoad        *replyLoad
+	pause            *consumerPause
+	msgErrors        *kldmetrics.CounterVec
+	metricsSrv       *http.Server
+	chainID          *big.Int
+	gasPricing       string // detected at connect, if configured. Guarded by readyz.lock
+	processor        MsgProcessor
+	inFlight         map[string]*msgContext
+	inFlightCond     *sync.Cond
+	inFlightBytes    int
+	inFlightByTenant map[string]int
+	completed        map[string]*completedMsg
+	completedLRU     []*completedMsg
+	idempotent       map[string]*completedMsg
+	idempotentLRU    []*completedMsg
+	idempotentActive map[string]*msgContext
+	directReplies    map[string]*sarama.ConsumerMessage
+	directAcks       map[string]*sarama.ConsumerMessage
+	producerClosing  bool // no more tombstones are sent once set
+	replyEnvelope    ReplyEnvelope
+	replyEncryption  *replyEncryption
+	replyTopics      *replyTopics
+	schemaRegistry   *schemaRegistry
+	txTemplates      *txTemplates
+	localSigners     *localSigners
+	requestSchema    *requestSchema
+	requestHook      *requestHook
+	errorCoalescer   *errorCoalescer
+	auditLog         *auditLog
+	gasOracle        *gasOracle
+	failureEvents    *failureEvents
+	gasFactors       *gasFactors
+	deadLetters      *deadLetters
+	redeliveryStore  *redeliveryStore
+	statusRPC        kldeth.RPCClient // guarded by readyz.lock
+	readyz           readyzCache
+	msgFilter        *msgFilter
+	chainURLs        map[string]string
+	gasFactorFlags   map[string]string
+}
+
+// completedMsg is a record of a reply we have already sent, kept for the
+// redelivery grace period after the message leaves the inFlight map
+type completedMsg struct {
+	reqOffset         string
+	key               string
+	replyTopic        string
+	replyBytes        []byte
+	replyFieldHeaders []sarama.RecordHeader
+	replyPartition    int32
+	replyMessage      kldmessages.ReplyWithHeaders // re-sent with the headers of a duplicate with the same idempotency key
+	tombstoneKey      string
+	idempotencyKey    string
+	expiry            time.Time
 }
 
 // Conf gets the config for this bridge
@@ -67,18 +263,232 @@ func (k *KafkaBridge) ValidateConf() (err error) {
 	if k.conf.RPC.URL == "" {
 		return fmt.Errorf("No JSON/RPC URL set for ethereum node")
 	}
+	if err = k.validateChains(); err != nil {
+		return
+	}
+	if k.rpcHTTPClient, err = newRPCHTTPClient(&k.conf.RPC.TLS); err != nil {
+		return
+	}
 	if k.conf.MaxTXWaitTime < 10 {
 		if k.conf.MaxTXWaitTime > 0 {
 			log.Warnf("Maximum wait time increased from %d to minimum of 10 seconds", k.conf.MaxTXWaitTime)
 		}
 		k.conf.MaxTXWaitTime = 10
 	}
+	if k.conf.TXBlockDeadline < 0 {
+		return fmt.Errorf("Transaction block deadline cannot be negative")
+	}
+	if k.conf.Confirmations < 0 {
+		return fmt.Errorf("Confirmations cannot be negative")
+	}
+	if k.conf.MaxConfirmations < 0 {
+		return fmt.Errorf("Maximum confirmations %d must not be negative", k.conf.MaxConfirmations)
+	} else if k.conf.MaxConfirmations > 0 && k.conf.MaxConfirmations < k.conf.Confirmations {
+		return fmt.Errorf("Maximum confirmations %d must not be below the default confirmations %d", k.conf.MaxConfirmations, k.conf.Confirmations)
+	}
+	for i, account := range k.conf.NonceRefreshAccounts {
+		address, err := kldutils.StrToAddress("nonce refresh account", account)
+		if err != nil {
+			return err
+		}
+		k.conf.NonceRefreshAccounts[i] = strings.ToLower(address.Hex())
+	}
+	if k.conf.CommitConfirmations < 0 {
+		return fmt.Errorf("Offset commit confirmations cannot be negative")
+	} else if k.conf.CommitConfirmations > 0 && k.conf.CommitConfirmations <= k.conf.Confirmations {
+		log.Warnf("Offset commit confirmations %d has no effect at or below the reply confirmations %d", k.conf.CommitConfirmations, k.conf.Confirmations)
+	}
 	if k.conf.MaxInFlight == 0 {
 		k.conf.MaxInFlight = 10
 	}
+	if k.conf.MaxInFlightBytes < 0 {
+		return fmt.Errorf("Maximum in-flight bytes %d must not be negative", k.conf.MaxInFlightBytes)
+	}
+	if k.conf.MaxConcurrentSubmits > k.conf.MaxInFlight {
+		log.Warnf("Maximum concurrent submits %d has no effect above the maximum in-flight %d", k.conf.MaxConcurrentSubmits, k.conf.MaxInFlight)
+	}
+	if k.conf.PriorityOrdering && k.conf.MaxConcurrentSubmits <= 0 {
+		log.Warnf("Priority ordering only changes the order messages are dispatched in, without a maximum of concurrent submits")
+	}
+	if k.conf.SubmitRate < 0 || k.conf.SubmitBurst < 0 {
+		return fmt.Errorf("Submit rate and burst must not be negative")
+	} else if k.conf.SubmitBurst == 0 {
+		k.conf.SubmitBurst = 1
+	}
+	if k.conf.ReceiptPollInterval < 0 || k.conf.ReceiptBatchSize < 0 {
+		return fmt.Errorf("Receipt poll interval and batch size must not be negative")
+	}
+	if k.conf.RPC.ReconnectWait < 0 {
+		return fmt.Errorf("JSON/RPC reconnect wait %d must not be negative", k.conf.RPC.ReconnectWait)
+	}
+	if k.conf.IdempotencyTTL < 0 {
+		return fmt.Errorf("Idempotency TTL %d must not be negative", k.conf.IdempotencyTTL)
+	}
+	if k.conf.KafkaHeaders.KeyRequired && k.conf.KafkaHeaders.Key == "" {
+		return fmt.Errorf("A key header must be configured for it to be required")
+	}
+	if k.conf.MaxGasLimit > 0 && k.conf.MinGasLimit > k.conf.MaxGasLimit {
+		return fmt.Errorf("Minimum gas limit %d is greater than the maximum gas limit %d", k.conf.MinGasLimit, k.conf.MaxGasLimit)
+	}
+	if k.conf.DefaultGas < 0 {
+		return fmt.Errorf("Default gas %d must not be negative", k.conf.DefaultGas)
+	}
+	if err = k.validateMethodGas(); err != nil {
+		return
+	}
+	if err = k.validateGasBump(); err != nil {
+		return
+	}
+	if k.conf.Readyz.CacheTTL < 0 {
+		return fmt.Errorf("Readiness cache TTL %d must not be negative", k.conf.Readyz.CacheTTL)
+	} else if k.conf.Readyz.CacheTTL == 0 {
+		k.conf.Readyz.CacheTTL = 5
+	}
+	if k.conf.TxPool.MaxPending < 0 || k.conf.TxPool.MaxQueued < 0 {
+		return fmt.Errorf("Transaction pool limits must not be negative")
+	}
+	if k.conf.TxPool.CacheTTL < 0 {
+		return fmt.Errorf("Transaction pool cache TTL %d must not be negative", k.conf.TxPool.CacheTTL)
+	} else if k.conf.TxPool.CacheTTL == 0 {
+		k.conf.TxPool.CacheTTL = 1000
+	}
+	if k.conf.ContractCodeCacheTTL < 0 {
+		return fmt.Errorf("Contract code cache TTL %d must not be negative", k.conf.ContractCodeCacheTTL)
+	} else if k.conf.ContractCodeCacheTTL == 0 {
+		k.conf.ContractCodeCacheTTL = 300
+	}
+	if k.conf.ReplyFieldNaming == "" {
+		k.conf.ReplyFieldNaming = ReplyFieldNamingCamel
+	} else if k.conf.ReplyFieldNaming != ReplyFieldNamingCamel && k.conf.ReplyFieldNaming != ReplyFieldNamingSnake {
+		return fmt.Errorf("Invalid reply field naming '%s' (must be '%s' or '%s')", k.conf.ReplyFieldNaming, ReplyFieldNamingCamel, ReplyFieldNamingSnake)
+	}
+	switch k.conf.StatusFormat {
+	case "":
+		k.conf.StatusFormat = StatusFormatNumeric
+	case StatusFormatNumeric, StatusFormatBool, StatusFormatBoth:
+	default:
+		return fmt.Errorf("Invalid status format '%s' (must be '%s', '%s' or '%s')", k.conf.StatusFormat, StatusFormatNumeric, StatusFormatBool, StatusFormatBoth)
+	}
+	if k.conf.ReplyEnvelope == "" {
+		k.conf.ReplyEnvelope = ReplyEnvelopeNative
+	} else if k.conf.ReplyEnvelope != ReplyEnvelopeNative && k.conf.ReplyEnvelope != ReplyEnvelopeCloudEvents {
+		return fmt.Errorf("Invalid reply envelope '%s' (must be '%s' or '%s')", k.conf.ReplyEnvelope, ReplyEnvelopeNative, ReplyEnvelopeCloudEvents)
+	}
+	k.replyEnvelope = NewReplyEnvelope(&k.conf)
+	if k.replyTopics, err = newReplyTopics(&k.conf.ReplyTopic); err != nil {
+		return
+	}
+	if k.msgFilter, err = newMsgFilter(k.conf.Filters); err != nil {
+		return
+	}
+	if k.conf.ErrorTopicOut != "" && !kafkaTopicName.MatchString(k.conf.ErrorTopicOut) {
+		return fmt.Errorf("Invalid error topic '%s'", k.conf.ErrorTopicOut)
+	}
+	if err = k.validateTopics(); err != nil {
+		return
+	}
+	if k.schemaRegistry, err = newSchemaRegistry(&k.conf.SchemaRegistry); err != nil {
+		return
+	}
+	if k.replyEncryption, err = newReplyEncryption(&k.conf.ReplyEncryption); err != nil {
+		return
+	}
+	if k.replyEncryption != nil && k.conf.SchemaRegistry.AvroReplies {
+		return fmt.Errorf("Reply fields cannot be encrypted in Avro replies, as the encrypted fields do not match the reply schemas")
+	}
+	if k.conf.TxTemplatesFile != "" {
+		if err = k.txTemplates.load(k.conf.TxTemplatesFile); err != nil {
+			return
+		}
+	}
+	if err = k.localSigners.load(k.conf.LocalSigners); err != nil {
+		return
+	}
+	if err = k.auditLog.init(&k.conf.Audit, k.conf.RedactFields); err != nil {
+		return
+	}
+	if err = k.deadLetters.init(&k.conf.DeadLetter); err != nil {
+		return
+	}
+	if err = k.loadRedeliveryStore(); err != nil {
+		return
+	}
+	if k.conf.RequestSchemaFile != "" {
+		if err = k.requestSchema.load(k.conf.RequestSchemaFile); err != nil {
+			return
+		}
+	}
+	if k.requestHook, err = newRequestHook(&k.conf.RequestHook); err != nil {
+		return
+	}
+	if k.errorCoalescer, err = newErrorCoalescer(&k.conf.ErrorCoalescing); err != nil {
+		return
+	} else if k.errorCoalescer != nil {
+		k.errorCoalescer.topic = k.conf.ErrorTopicOut
+		if k.errorCoalescer.topic == "" {
+			k.errorCoalescer.topic = k.kafka.Conf().TopicOut
+		}
+		k.errorCoalescer.markReply = k.markReply
+	}
+	if k.conf.StaticGasPrice != "" {
+		if gasPrice, ok := new(big.Int).SetString(k.conf.StaticGasPrice, 10); !ok || gasPrice.Sign() < 0 {
+			return fmt.Errorf("Static gas price '%s' must be a non-negative integer (wei)", k.conf.StaticGasPrice)
+		}
+		if k.conf.GasOracle.Address != "" {
+			return fmt.Errorf("A static gas price and a gas oracle cannot both be configured")
+		}
+	}
+	if err = k.gasOracle.init(&k.conf.GasOracle); err != nil {
+		return
+	}
+	if err = k.failureEvents.init(k.conf.FailureEvents); err != nil {
+		return
+	}
+	if err = k.validateGasFactors(); err != nil {
+		return
+	}
+	if k.conf.OversizeReplies == "" {
+		k.conf.OversizeReplies = OversizeRepliesTruncate
+	} else if k.conf.OversizeReplies != OversizeRepliesTruncate && k.conf.OversizeReplies != OversizeRepliesError {
+		return fmt.Errorf("Invalid oversize replies strategy '%s' (must be '%s' or '%s')", k.conf.OversizeReplies, OversizeRepliesTruncate, OversizeRepliesError)
+	}
 	return
 }
 
+// validateMethodGas checks the configured method selectors and gas limits,
+// and normalizes the selectors to lower case hex with a 0x prefix
+func (k *KafkaBridge) validateMethodGas() error {
+	methodGas := make(map[string]int, len(k.conf.MethodGas))
+	for selector, gas := range k.conf.MethodGas {
+		selectorBytes, err := hex.DecodeString(strings.TrimPrefix(selector, "0x"))
+		if err != nil || len(selectorBytes) != 4 {
+			return fmt.Errorf("Method selector '%s' must be 4 bytes of hex", selector)
+		}
+		if gas <= 0 {
+			return fmt.Errorf("Gas %d for method %s must be positive", gas, selector)
+		}
+		methodGas["0x"+hex.EncodeToString(selectorBytes)] = gas
+	}
+	k.conf.MethodGas = methodGas
+	return nil
+}
+
+// validateGasFactors adds the contract gas factors configured on the command line,
+// and checks the factors applied to estimated gas
+func (k *KafkaBridge) validateGasFactors() error {
+	for addr, factorStr := range k.gasFactorFlags {
+		factor, err := strconv.ParseFloat(factorStr, 64)
+		if err != nil {
+			return fmt.Errorf("Gas estimation factor '%s' for contract %s must be a number", factorStr, addr)
+		}
+		if k.conf.ContractGasFactors == nil {
+			k.conf.ContractGasFactors = make(map[string]float64)
+		}
+		k.conf.ContractGasFactors[addr] = factor
+	}
+	return k.gasFactors.init(k.conf.GasEstimationFactor, k.conf.ContractGasFactors)
+}
+
 // CobraInit retruns a cobra command to configure this KafkaBridge
 func (k *KafkaBridge) CobraInit() (cmd *cobra.Command) {
 	cmd = &cobra.Command{
@@ -98,10 +508,117 @@ func (k *KafkaBridge) CobraInit() (cmd *cobra.Command) {
 		},
 	}
 	k.kafka.CobraInit(cmd)
+	defRPCTLSInsecure, _ := strconv.ParseBool(os.Getenv("ETH_RPC_TLS_INSECURE"))
 	cmd.Flags().IntVarP(&k.conf.MaxInFlight, "maxinflight", "m", kldutils.DefInt("KAFKA_MAX_INFLIGHT", 0), "Maximum messages to hold in-flight")
+	cmd.Flags().IntVar(&k.conf.MaxInFlightBytes, "maxinflight-bytes", kldutils.DefInt("KAFKA_MAX_INFLIGHT_BYTES", 0), "Maximum total size in bytes of the messages to hold in-flight (default=unlimited)")
+	cmd.Flags().IntVar(&k.conf.MaxConcurrentSubmits, "max-concurrent-submits", kldutils.DefInt("KAFKA_MAX_CONCURRENT_SUBMITS", 0), "Maximum transactions to concurrently submit and track against the node (default=MaxInFlight)")
+	cmd.Flags().BoolVar(&k.conf.PriorityOrdering, "priority-ordering", false, "Dispatch high priority messages, and give them the next submit slot, ahead of those waiting from other accounts")
+	cmd.Flags().Float64Var(&k.conf.SubmitRate, "submit-rate", kldutils.DefFloat("KAFKA_SUBMIT_RATE", 0), "Maximum transactions per second to submit to the node, waiting up to tx-timeout to send each one (0=unlimited)")
+	cmd.Flags().IntVar(&k.conf.SubmitBurst, "submit-burst", kldutils.DefInt("KAFKA_SUBMIT_BURST", 0), "Transactions that can be submitted at once, before the submit rate applies (default=1)")
+	cmd.Flags().IntVar(&k.conf.ReceiptPollInterval, "receipt-poll-interval", kldutils.DefInt("ETH_RECEIPT_POLL_INTERVAL", 0), "Poll for the receipts of all in-flight transactions together at this interval, in batch requests (ms, default=poll for each transaction)")
+	cmd.Flags().IntVar(&k.conf.ReceiptBatchSize, "receipt-batch-size", kldutils.DefInt("ETH_RECEIPT_BATCH_SIZE", 0), "Maximum receipts to fetch in a single batch request, with receipt-poll-interval (default=100)")
 	cmd.Flags().StringVarP(&k.conf.RPC.URL, "rpc-url", "r", os.Getenv("ETH_RPC_URL"), "JSON/RPC URL for Ethereum node")
+	cmd.Flags().StringVar(&k.conf.RPC.TLS.ClientCertsFile, "rpc-tls-clientcerts", os.Getenv("ETH_RPC_TLS_CLIENT_CERT"), "A client certificate file, for mutual TLS auth with the Ethereum node (reloaded when changed)")
+	cmd.Flags().StringVar(&k.conf.RPC.TLS.ClientKeyFile, "rpc-tls-clientkey", os.Getenv("ETH_RPC_TLS_CLIENT_KEY"), "A client private key file, for mutual TLS auth with the Ethereum node (reloaded when changed)")
+	cmd.Flags().StringVar(&k.conf.RPC.TLS.CACertsFile, "rpc-tls-cacerts", os.Getenv("ETH_RPC_TLS_CA_CERTS"), "CA certificates file for HTTPS connections to the Ethereum node (or host CAs will be used)")
+	cmd.Flags().BoolVar(&k.conf.RPC.TLS.InsecureSkipVerify, "rpc-tls-insecure", defRPCTLSInsecure, "Disable verification of the TLS certificate chain of the Ethereum node")
+	cmd.Flags().Int64Var(&k.conf.RPC.ExpectedChainID, "chain-id", int64(kldutils.DefInt("ETH_CHAIN_ID", 0)), "Refuse to start unless the node reports this chain ID")
+	cmd.Flags().IntVar(&k.conf.RPC.ReconnectWait, "rpc-reconnect-wait", kldutils.DefInt("ETH_RPC_RECONNECT_WAIT", 0), "Reconnect to the Ethereum node when calls fail to reach it, holding calls for up to this long to retry them (seconds, 0=disabled)")
+	cmd.Flags().StringToStringVar(&k.chainURLs, "chain", nil, "Additional chain to route messages to with the chain header, as name=rpc-url (repeatable)")
 	cmd.Flags().IntVarP(&k.conf.MaxTXWaitTime, "tx-timeout", "x", kldutils.DefInt("ETH_TX_TIMEOUT", 0), "Maximum wait time for an individual transaction (seconds)")
+	cmd.Flags().IntVar(&k.conf.TXBlockDeadline, "tx-block-deadline", kldutils.DefInt("ETH_TX_BLOCK_DEADLINE", 0), "Blocks after submission to wait for a transaction to be mined, in place of tx-timeout (0=disabled)")
+	cmd.Flags().IntVar(&k.conf.Confirmations, "confirmations", kldutils.DefInt("ETH_CONFIRMATIONS", 0), "Blocks to wait for on top of the block containing a transaction, before replying with the receipt")
+	cmd.Flags().IntVar(&k.conf.MaxConfirmations, "max-confirmations", kldutils.DefInt("ETH_MAX_CONFIRMATIONS", 0), "Maximum confirmations a message can request in its headers (0=no maximum)")
+	cmd.Flags().IntVar(&k.conf.CommitConfirmations, "commit-confirmations", kldutils.DefInt("ETH_COMMIT_CONFIRMATIONS", 0), "Blocks to wait for on top of the block containing a transaction, before committing the offset of the request (0=on reply)")
+	cmd.Flags().BoolVar(&k.conf.DetectDroppedTXs, "detect-dropped", false, "Check the node still has pending transactions while waiting for receipts, and reply when they are dropped")
 	cmd.Flags().BoolVarP(&k.conf.PredictNonces, "predict-nonces", "P", false, "Predict the next nonce before sending (default=false for node-signed txns)")
+	cmd.Flags().StringArrayVar(&k.conf.NonceRefreshAccounts, "nonce-refresh-account", nil, "Account also used outside the bridge, for which the pending transaction count is queried from the node before every transaction it sends (repeatable)")
+	cmd.Flags().Int64Var(&k.conf.MaxGasLimit, "max-gas", int64(kldutils.DefInt("ETH_MAX_GAS", 0)), "Maximum gas limit allowed on a transaction (0=no limit)")
+	cmd.Flags().StringToStringVar(&k.conf.FailureEvents, "failure-event", nil, "Event that reports a logical failure of a transaction that is mined successfully, as address=signature or selector=signature, such as 0xa9059cbb='Failed(address indexed,string)' (repeatable)")
+	cmd.Flags().Int64Var(&k.conf.DefaultGas, "default-gas", int64(kldutils.DefInt("ETH_DEFAULT_GAS", 0)), "Gas limit to use when the request does not supply gas, and gas estimation fails (0=fail the request)")
+	cmd.Flags().Float64Var(&k.conf.GasEstimationFactor, "gas-estimation-factor", kldutils.DefFloat("ETH_GAS_ESTIMATION_FACTOR", 0), "Multiplier applied to the gas estimated by the node, to leave headroom (default=1)")
+	cmd.Flags().StringToStringVar(&k.gasFactorFlags, "contract-gas-factor", nil, "Multiplier applied to the gas estimated for transactions to a contract, in place of gas-estimation-factor, as address=factor (repeatable)")
+	cmd.Flags().StringToIntVar(&k.conf.MethodGas, "method-gas", nil, "Gas limit to use for a method when the request does not supply gas, as selector=gas with the 4 byte hex method selector (repeatable)")
+	cmd.Flags().Int64Var(&k.conf.MinGasLimit, "min-gas", int64(kldutils.DefInt("ETH_MIN_GAS", 0)), "Minimum gas limit allowed on a transaction")
+	cmd.Flags().IntVar(&k.conf.MaxCalldataSize, "max-calldata", kldutils.DefInt("ETH_MAX_CALLDATA", 0), "Maximum calldata size of a transaction, above which it is rejected or split if the message allows (bytes, 0=no limit)")
+	cmd.Flags().StringVar(&k.conf.StaticGasPrice, "gas-price", os.Getenv("ETH_GAS_PRICE"), "Gas price (wei) for all transactions that do not specify one (0 is allowed)")
+	cmd.Flags().BoolVar(&k.conf.DetectGasPricing, "detect-gas-pricing", false, "Detect whether each chain is free or priced from the gas price of its node, to send transactions without a gas price with zero on free chains, and the node gas price on priced chains")
+	cmd.Flags().StringVar(&k.conf.GasOracle.Address, "gas-oracle-address", os.Getenv("ETH_GAS_ORACLE_ADDRESS"), "Address of an oracle contract to read the gas price from, for transactions that do not specify one")
+	cmd.Flags().StringVar(&k.conf.GasOracle.Method, "gas-oracle-method", os.Getenv("ETH_GAS_ORACLE_METHOD"), "Method of the gas oracle contract that returns the gas price, without parameters such as 'gasPrice()'")
+	cmd.Flags().StringSliceVar(&k.conf.GasOracle.Outputs, "gas-oracle-outputs", nil, "Types of the values returned by the gas oracle method (default=uint256)")
+	cmd.Flags().IntVar(&k.conf.GasOracle.OutputIndex, "gas-oracle-output-index", kldutils.DefInt("ETH_GAS_ORACLE_OUTPUT_INDEX", 0), "Index of the gas price (wei) in the values returned by the gas oracle method")
+	cmd.Flags().IntVar(&k.conf.GasOracle.Refresh, "gas-oracle-refresh", kldutils.DefInt("ETH_GAS_ORACLE_REFRESH", 0), "Time to cache the gas price read from the gas oracle (seconds, default=30)")
+	cmd.Flags().IntVar(&k.conf.GasBump.Interval, "gas-bump-interval", kldutils.DefInt("ETH_GAS_BUMP_INTERVAL", 0), "Replace transactions pending for this long with a higher gas price (seconds, default=disabled)")
+	cmd.Flags().IntVar(&k.conf.GasBump.Percent, "gas-bump-percent", kldutils.DefInt("ETH_GAS_BUMP_PERCENT", 0), "Percentage to increase the gas price by on each bump (default=10)")
+	cmd.Flags().StringVar(&k.conf.GasBump.MaxGasPrice, "gas-bump-max-price", os.Getenv("ETH_GAS_BUMP_MAX_PRICE"), "Maximum gas price (wei) a transaction can be bumped to")
+	cmd.Flags().IntVar(&k.conf.GasBump.MaxAttempts, "gas-bump-max-attempts", kldutils.DefInt("ETH_GAS_BUMP_MAX_ATTEMPTS", 0), "Maximum number of gas price bumps for a transaction (default=5)")
+	cmd.Flags().BoolVar(&k.conf.SimulateBeforeSend, "simulate", false, "Simulate transactions with eth_call before sending, unless overridden in the message headers")
+	cmd.Flags().BoolVar(&k.conf.AllowTracing, "allow-tracing", false, "Allow TraceTransaction messages, that profile the gas of a transaction with debug_traceCall on the node")
+	cmd.Flags().BoolVar(&k.conf.StrictFrom, "strict-from", false, "Reject pre-signed transactions that are not signed by the account in 'from', instead of logging a warning")
+	cmd.Flags().BoolVar(&k.conf.CheckContractCode, "check-contract-code", false, "Check with eth_getCode that transactions are sent to an address with contract code")
+	cmd.Flags().BoolVar(&k.conf.CheckBalance, "check-balance", false, "Check with eth_getBalance that the sender can pay for the gas and value of each transaction before sending it")
+	cmd.Flags().IntVar(&k.conf.ContractCodeCacheTTL, "contract-code-ttl", kldutils.DefInt("ETH_CONTRACT_CODE_TTL", 0), "Time to cache the result of a successful contract code check for an address (seconds, default=300)")
+	cmd.Flags().StringVar(&k.conf.Metrics.LocalAddr, "metrics-addr", os.Getenv("KAFKA_METRICS_ADDR"), "Local address for the Prometheus metrics endpoint")
+	cmd.Flags().IntVar(&k.conf.Metrics.Port, "metrics-port", kldutils.DefInt("KAFKA_METRICS_PORT", 0), "Port for the Prometheus metrics endpoint (0=disabled)")
+	cmd.Flags().BoolVar(&k.conf.Readyz.NodeStatus, "readyz-node-status", false, "Include the block height, peer count and sync state of the node in the /readyz response on the metrics port")
+	cmd.Flags().IntVar(&k.conf.TxPool.MaxPending, "txpool-max-pending", kldutils.DefInt("ETH_TXPOOL_MAX_PENDING", 0), "Reject transactions while the node has more pending transactions than this in its transaction pool (0=no limit)")
+	cmd.Flags().IntVar(&k.conf.TxPool.MaxQueued, "txpool-max-queued", kldutils.DefInt("ETH_TXPOOL_MAX_QUEUED", 0), "Reject transactions while the node has more queued transactions than this in its transaction pool (0=no limit)")
+	cmd.Flags().IntVar(&k.conf.TxPool.CacheTTL, "txpool-cache-ttl", kldutils.DefInt("ETH_TXPOOL_CACHE_TTL", 0), "Time to cache the transaction pool status of the node (milliseconds, default=1000)")
+	cmd.Flags().IntVar(&k.conf.Readyz.CacheTTL, "readyz-cache-ttl", kldutils.DefInt("KAFKA_READYZ_CACHE_TTL", 0), "Time to cache the node status for /readyz (seconds, default=5)")
+	cmd.Flags().StringVar(&k.conf.AdminToken, "admin-token", os.Getenv("KAFKA_ADMIN_TOKEN"), "Bearer token required for the admin endpoints on the metrics port, which are disabled if not set")
+	cmd.Flags().BoolVar(&k.conf.DirectParseErrors, "direct-parse-errors", false, "Reply to unparsable messages without holding them in-flight")
+	cmd.Flags().IntVar(&k.conf.MaxReplySize, "max-reply-size", kldutils.DefInt("KAFKA_MAX_REPLY_SIZE", 0), "Maximum size of a reply message in bytes (0=no limit)")
+	cmd.Flags().StringVar(&k.conf.OversizeReplies, "oversize-replies", os.Getenv("KAFKA_OVERSIZE_REPLIES"), "Handling of replies over the maximum size: truncate/error (default=truncate)")
+	cmd.Flags().StringVar(&k.conf.ReplyFieldNaming, "reply-field-naming", os.Getenv("KAFKA_REPLY_FIELD_NAMING"), "Naming convention for reply fields: camelCase/snake_case (default=camelCase)")
+	cmd.Flags().BoolVar(&k.conf.ChecksumAddresses, "checksum-addresses", false, "Send the addresses in replies in the EIP-55 mixed case checksum format")
+	cmd.Flags().BoolVar(&k.conf.ReplyLoad, "reply-load", false, "Report the in-flight messages, consumer lag and processing rate of the bridge in the headers of replies")
+	cmd.Flags().StringVar(&k.conf.StatusFormat, "status-format", os.Getenv("KAFKA_STATUS_FORMAT"), "Format of the status of transaction receipts in replies: numeric/bool/both (default=numeric)")
+	cmd.Flags().StringVar(&k.conf.ReplyEnvelope, "reply-envelope", os.Getenv("KAFKA_REPLY_ENVELOPE"), "Envelope format for replies: native/cloudevents (default=native)")
+	cmd.Flags().StringArrayVar(&k.conf.ReplyEncryption.Fields, "encrypt-reply-field", nil, "Dot separated path of a reply field to encrypt, such as events.data (repeatable)")
+	cmd.Flags().StringVar(&k.conf.ReplyEncryption.KeyFile, "encrypt-reply-key-file", os.Getenv("KAFKA_ENCRYPT_REPLY_KEY_FILE"), "File containing the hex encoded 256 bit AES key to encrypt reply fields with")
+	cmd.Flags().StringVar(&k.conf.ReplyEncryption.KeyID, "encrypt-reply-key-id", os.Getenv("KAFKA_ENCRYPT_REPLY_KEY_ID"), "Key ID to include with encrypted reply fields, to identify the key to decrypt them with")
+	cmd.Flags().StringVar(&k.conf.CloudEventsSource, "cloudevents-source", os.Getenv("KAFKA_CLOUDEVENTS_SOURCE"), "Source of CloudEvents replies (default=/ethconnect)")
+	cmd.Flags().StringVar(&k.conf.ReplyTopic.Template, "reply-topic-template", os.Getenv("KAFKA_REPLY_TOPIC_TEMPLATE"), "Template for the topic of each reply, using the request headers {account} and {tenant} (default=topic-out)")
+	cmd.Flags().StringVar(&k.conf.ReplyTopic.Allowed, "reply-topic-allowed", os.Getenv("KAFKA_REPLY_TOPIC_ALLOWED"), "Regular expression that topics from the reply topic template must match")
+	cmd.Flags().IntVar(&k.conf.ReplyTopic.MaxTopics, "reply-topic-max", kldutils.DefInt("KAFKA_REPLY_TOPIC_MAX", 0), "Maximum number of topics to send replies to from the reply topic template (default=100)")
+	cmd.Flags().StringVar(&k.conf.ErrorTopicOut, "error-topic-out", os.Getenv("KAFKA_ERROR_TOPIC_OUT"), "Topic to send error replies to, instead of the reply topic (default=topic-out)")
+	cmd.Flags().BoolVar(&k.conf.SingleTopic, "single-topic", false, "Allow replies to be sent to the request topic, tagged with a Kafka header so the bridge skips them")
+	cmd.Flags().StringVar(&k.conf.SchemaRegistry.URL, "schema-registry-url", os.Getenv("KAFKA_SCHEMA_REGISTRY_URL"), "URL of a Confluent compatible schema registry, to decode Avro requests")
+	cmd.Flags().BoolVar(&k.conf.SchemaRegistry.AvroReplies, "avro-replies", false, "Encode replies with Avro, using the latest schema in the schema registry for the reply subject")
+	cmd.Flags().StringVar(&k.conf.SchemaRegistry.ReplySubject, "avro-reply-subject", os.Getenv("KAFKA_AVRO_REPLY_SUBJECT"), "Schema registry subject for Avro replies, using the reply {topic} and {type} (default={topic}-value)")
+	cmd.Flags().StringVar(&k.conf.TxTemplatesFile, "tx-templates", os.Getenv("KAFKA_TX_TEMPLATES"), "YAML or JSON file of named transaction templates, reloaded on SIGHUP")
+	cmd.Flags().StringVar(&k.conf.RequestSchemaFile, "request-schema", os.Getenv("KAFKA_REQUEST_SCHEMA"), "YAML or JSON file containing a JSON Schema that every request must conform to, reloaded on SIGHUP")
+	cmd.Flags().StringVar(&k.conf.RequestHook.URL, "request-hook-url", os.Getenv("KAFKA_REQUEST_HOOK_URL"), "URL to POST each request to before processing, to enrich or authorize it")
+	cmd.Flags().IntVar(&k.conf.RequestHook.Timeout, "request-hook-timeout", kldutils.DefInt("KAFKA_REQUEST_HOOK_TIMEOUT", 0), "Time to wait for the request hook to respond (seconds, default=10)")
+	cmd.Flags().BoolVar(&k.conf.RequestHook.FailOpen, "request-hook-fail-open", false, "Process requests unmodified if the request hook cannot be called, instead of failing them")
+	cmd.Flags().BoolVar(&k.conf.ErrorCoalescing.Enabled, "coalesce-errors", false, "Replace repeated error replies with the same status code with a summary, sent at the end of each window")
+	cmd.Flags().IntVar(&k.conf.ErrorCoalescing.Window, "coalesce-errors-window", kldutils.DefInt("KAFKA_COALESCE_ERRORS_WINDOW", 0), "Time to coalesce error replies with the same status code over, after the first is sent (seconds, default=10)")
+	cmd.Flags().BoolVar(&k.conf.LogFullPayloads, "log-full-payloads", false, "Log the full request and reply payloads at debug level")
+	cmd.Flags().StringArrayVar(&k.conf.RedactFields, "redact-field", nil, "JSON field to redact when logging full payloads, or in the audit trail (repeatable)")
+	cmd.Flags().StringVar(&k.conf.Audit.File, "audit-file", os.Getenv("KAFKA_AUDIT_FILE"), "File to write the audit trail of transactions to, as JSON lines")
+	cmd.Flags().IntVar(&k.conf.Audit.MaxSize, "audit-max-size", kldutils.DefInt("KAFKA_AUDIT_MAX_SIZE", 0), "Size the audit file can grow to before it is rotated (MB, default=100)")
+	cmd.Flags().IntVar(&k.conf.Audit.MaxFiles, "audit-max-files", kldutils.DefInt("KAFKA_AUDIT_MAX_FILES", 0), "Number of rotated audit files to keep (default=5)")
+	cmd.Flags().StringVar(&k.conf.Audit.Topic, "audit-topic", os.Getenv("KAFKA_AUDIT_TOPIC"), "Topic to send the audit trail of transactions to")
+	cmd.Flags().IntVar(&k.conf.DeadLetter.After, "dead-letter-after", kldutils.DefInt("KAFKA_DEAD_LETTER_AFTER", 0), "Dead-letter a message after this many processing attempts fail to complete (default=never)")
+	cmd.Flags().StringVar(&k.conf.DeadLetter.File, "dead-letter-file", os.Getenv("KAFKA_DEAD_LETTER_FILE"), "File to persist the processing attempts of in-flight messages to, for dead-lettering")
+	cmd.Flags().StringVar(&k.conf.DeadLetter.Topic, "dead-letter-topic", os.Getenv("KAFKA_DEAD_LETTER_TOPIC"), "Topic to send dead-lettered messages to (default=error-topic-out)")
+	cmd.Flags().StringArrayVar(&k.conf.KafkaHeaders.Context, "context-header", nil, "Kafka message header to merge into the request context (repeatable)")
+	cmd.Flags().StringVar(&k.conf.KafkaHeaders.Key, "key-header", os.Getenv("KAFKA_KEY_HEADER"), "Kafka message header to use as the key of the reply, when present on the request (default=account or ID)")
+	cmd.Flags().BoolVar(&k.conf.KafkaHeaders.KeyRequired, "key-header-required", false, "Reject requests without the key-header Kafka message header")
+	cmd.Flags().StringArrayVar(&k.conf.KafkaHeaders.Reply, "reply-header", nil, "Kafka message header to copy from the request to the reply (repeatable)")
+	cmd.Flags().StringToStringVar(&k.conf.KafkaHeaders.ReplyFields, "reply-field-header", nil, "Kafka message header to set from a field of the reply, as header=field.path (repeatable)")
+	cmd.Flags().StringToStringVar(&k.conf.KafkaHeaders.RequestFields, "request-field-header", nil, "Kafka message header to set on the reply from a field of the request, as header=field.path (repeatable)")
+	cmd.Flags().StringToStringVar(&k.conf.LocalSigners, "local-signer", nil, "Account to sign transactions for in the bridge, instead of the node, as address=keyfile with a hex private key (repeatable)")
+	cmd.Flags().BoolVar(&k.conf.Tombstones.Enabled, "tombstones", false, "Send a tombstone keyed by the request ID to the reply topic after each reply is delivered")
+	cmd.Flags().StringArrayVar(&k.conf.Tombstones.ReplyTypes, "tombstone-reply-type", nil, "Only send tombstones after replies of this type (repeatable, default=all)")
+	cmd.Flags().StringArrayVar(&k.conf.Tenants, "tenants", nil, "Tenants allowed to submit messages (default=any)")
+	cmd.Flags().StringArrayVar(&k.conf.Filters, "filter", nil, "Condition on the request headers for messages to process, such as 'type in [SendTransaction]' - others are skipped without a reply (repeatable, default=all messages)")
+	cmd.Flags().IntVar(&k.conf.MaxInFlightPerTenant, "maxinflight-tenant", kldutils.DefInt("KAFKA_MAX_INFLIGHT_TENANT", 0), "Maximum messages to hold in-flight for an individual tenant, beyond which its messages are rejected with a 429 error reply")
+	cmd.Flags().IntVar(&k.conf.MaxQueuedPerAccount, "maxqueued-account", kldutils.DefInt("KAFKA_MAX_QUEUED_ACCOUNT", 0), "Maximum transactions in-flight for an individual account, before rejecting new ones (0=unlimited)")
+	cmd.Flags().IntVar(&k.conf.MaxMessageAge, "max-message-age", kldutils.DefInt("KAFKA_MAX_MESSAGE_AGE", 0), "Maximum age of a message, after which it is rejected without being processed (seconds, 0=no limit)")
+	cmd.Flags().IntVar(&k.conf.IdempotencyTTL, "idempotency-ttl", kldutils.DefInt("KAFKA_IDEMPOTENCY_TTL", 0), "Time to cache replies by the idempotencyKey header, to re-send for duplicate requests (seconds, 0=disabled)")
+	cmd.Flags().IntVarP(&k.conf.RedeliveryGracePeriod, "redelivery-grace", "G", kldutils.DefInt("KAFKA_REDELIVERY_GRACE", 0), "Time to cache completed replies, to re-send on Kafka redelivery (seconds)")
+	cmd.Flags().StringVar(&k.conf.RedeliveryStore, "redelivery-store", os.Getenv("KAFKA_REDELIVERY_STORE"), "File to persist completed replies to, so redeliveries are recognized across restarts within the redelivery grace period")
 	return
 }
 
@@ -109,6 +626,8 @@ func (k *KafkaBridge) CobraInit() (cmd *cobra.Command) {
 type MsgContext interface {
 	// Get the headers of the message
 	Headers() *kldmessages.CommonHeaders
+	// Get a Kafka header supplied on the message, outside of the JSON payload
+	KafkaHeader(key string) string
 	// Unmarshal the supplied message into a give type
 	Unmarshal(msg interface{}) error
 	// Send an error reply
@@ -118,6 +637,10 @@ type MsgContext interface {
 	// Send a reply that can be marshaled into bytes.
 	// Sets all the common headers on behalf of the caller, based on the request context
 	Reply(replyMsg kldmessages.ReplyWithHeaders)
+	// Prevent the offset being committed when the reply is sent, until ReleaseOffset is called
+	HoldOffset()
+	// Allow the offset of a message with a held offset to be committed, once the reply is sent
+	ReleaseOffset()
 	// Get a string summary
 	String() string
 }
@@ -132,16 +655,33 @@ type msgContext struct {
 	bridge         *KafkaBridge
 	complete       bool
 	replyType      string
+	errorStatus    int
+	replyTopic     string
 	replyTime      time.Time
 	replyBytes     []byte
+	replyMessage   kldmessages.ReplyWithHeaders
 	replyPartition int32
 	replyOffset    int64
+	cachedReply    *completedMsg
+	idemReply      *completedMsg // the reply to an earlier message with the same idempotency key
+	idempotencyKey string
+	tenantCounted  bool
+	size           int
+	offsetHeld     bool
+	filtered       bool
+	deadLetter     bool
+	// Set when the reply is sent for a message with a held offset
+	heldConsumer KafkaConsumer
+	// Kafka headers set from fields of the request and of the reply
+	requestFieldHeaders []sarama.RecordHeader
+	replyFieldHeaders   []sarama.RecordHeader
 }
 
 // addInflightMsg creates a msgContext wrapper around a message with all the
-// relevant context, and adds it to the inFlight map
+// relevant context, and adds it to the inFlight map. Any error decoding the
+// message from Avro is returned once it is in-flight, so it can be replied to
 // * Caller holds the inFlightCond mutex, and has already checked for capacity *
-func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer KafkaProducer) (pCtx *msgContext, err error) {
+func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer KafkaProducer, decodeErr error) (pCtx *msgContext, err error) {
 	ctx := msgContext{
 		timeReceived: time.Now(),
 		reqOffset:    fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset),
@@ -158,12 +698,31 @@ func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer Kafka
 		return nil, nil
 	}
 
+	// If the message completed recently, we've got a redelivery after we already
+	// sent the reply. We must not process it again, so we re-send the same reply.
+	k.expireCompleted()
+	if completed, recentlyCompleted := k.completed[ctx.reqOffset]; recentlyCompleted {
+		ctx.cachedReply = completed
+		ctx.key = completed.key
+		pCtx = &ctx
+		k.addInFlightBytes(pCtx)
+		k.inFlight[ctx.reqOffset] = pCtx
+		log.Infof("Message redelivered after completion: %s", pCtx)
+		return
+	}
+
 	// Add it to our inflight map - from this point on we need to ensure we remove it, to avoid leaks.
 	// Messages are only removed from the inflight map when a response is sent, so it
 	// is very important that the consumer of the wrapped context object calls Reply
 	pCtx = &ctx
+	k.addInFlightBytes(pCtx)
 	k.inFlight[ctx.reqOffset] = pCtx
 	log.Infof("Message now in-flight: %s", pCtx)
+	if err = decodeErr; err != nil {
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	}
+	k.logPayload("Request", pCtx, msg.Value)
 	// Attempt to process the headers from the original message,
 	// which could fail. In which case we still have a msgContext inflight
 	// that needs Reply (and offset commit). So our caller must
@@ -176,12 +735,45 @@ func (k *KafkaBridge) addInflightMsg(msg *sarama.ConsumerMessage, producer Kafka
 	if headers.ID == "" {
 		headers.ID = kldutils.UUIDv4()
 	}
-	// Use the account as the partitioning key, or fallback to the ID, which we ensure is non-null
-	if headers.Account != "" {
+	ctx.mergeContextHeaders()
+	if err = k.checkTenant(headers.Tenant); err != nil {
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	}
+	if err = k.checkMessageAge(headers, msg); err != nil {
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	}
+	if err = k.requestSchema.validate(msg.Value); err != nil {
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	}
+	keyHeader := k.conf.KafkaHeaders.Key
+	if keyHeader != "" && k.conf.KafkaHeaders.KeyRequired && ctx.KafkaHeader(keyHeader) == "" {
+		err = fmt.Errorf("Missing Kafka header '%s' for the reply key", keyHeader)
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	}
+	// Use the configured Kafka header as the partitioning key if present, then the
+	// account, or fallback to the ID, which we ensure is non-null
+	if keyHeader != "" && ctx.KafkaHeader(keyHeader) != "" {
+		ctx.key = ctx.KafkaHeader(keyHeader)
+	} else if headers.Account != "" {
 		ctx.key = headers.Account
 	} else {
 		ctx.key = headers.ID
 	}
+	// A duplicate of a message with the same idempotency key gets the same reply
+	if ctx.idemReply, err = k.checkIdempotencyKey(pCtx); err != nil {
+		log.Errorf("Rejected message %s: %s", pCtx, err)
+		return
+	} else if ctx.idemReply != nil {
+		log.Infof("Message is a duplicate of a completed message with idempotency key '%s': %s", headers.IdempotencyKey, pCtx)
+		return
+	}
+	// Count the message against its tenant's limit, which was checked before it was added
+	k.inFlightByTenant[headers.Tenant]++
+	ctx.tenantCounted = true
 	return
 }
 
@@ -231,20 +823,237 @@ func (k *KafkaBridge) setInFlightComplete(ctx *msgContext, consumer KafkaConsume
 		// Remove all the ready-to-acks from the in-flight list
 		for i := 0; i < len(readyToAck); i++ {
 			delete(k.inFlight, readyToAck[i].reqOffset)
+			k.deadLetters.complete(readyToAck[i].reqOffset)
+			k.inFlightBytes -= readyToAck[i].size
+			k.removeTenantInFlight(readyToAck[i])
+			k.addIdempotent(readyToAck[i])
 		}
 		// Update the offset
 		highestOffset := readyToAck[len(readyToAck)-1].saramaMsg
 		log.Infof("Marking offset %d:%d", highestOffset.Offset, highestOffset.Partition)
 		consumer.MarkOffset(highestOffset, "")
+		k.markDirectAcks(highestOffset, consumer)
 	}
 
 	return
 }
 
+// addInFlightBytes records the size of a message entering the inFlight map.
+// The size is recorded before any decoding, as that is what was read from Kafka
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) addInFlightBytes(ctx *msgContext) {
+	ctx.size = len(ctx.saramaMsg.Value)
+	k.inFlightBytes += ctx.size
+}
+
+// inFlightBytesExceeded returns true if adding a message would take the in-flight
+// messages over the byte budget. A message is always admitted when nothing else
+// is in-flight, so a single message larger than the budget cannot block the loop
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) inFlightBytesExceeded(msg *sarama.ConsumerMessage) bool {
+	return k.conf.MaxInFlightBytes > 0 && len(k.inFlight) > 0 &&
+		k.inFlightBytes+len(msg.Value) > k.conf.MaxInFlightBytes
+}
+
+// removeTenantInFlight updates the per-tenant count for a message leaving the inFlight map
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) removeTenantInFlight(ctx *msgContext) {
+	if !ctx.tenantCounted {
+		return
+	}
+	tenant := ctx.requestCommon.Headers.Tenant
+	if k.inFlightByTenant[tenant] <= 1 {
+		delete(k.inFlightByTenant, tenant)
+	} else {
+		k.inFlightByTenant[tenant]--
+	}
+}
+
+// checkTenantInFlight rejects a new message for a tenant that already has the maximum
+// messages in-flight. This is checked before the message is added to the inFlight map,
+// so a tenant at its limit does not hold up the consumer for the other tenants.
+// Redeliveries are not checked, as they are not counted again. The headers of
+// a rejected message are returned for the reply
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) checkTenantInFlight(msg *sarama.ConsumerMessage, decodeErr error) (*kldmessages.RequestCommon, error) {
+	if k.conf.MaxInFlightPerTenant <= 0 || decodeErr != nil {
+		return nil, nil
+	}
+	reqOffset := fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
+	if _, inFlight := k.inFlight[reqOffset]; inFlight {
+		return nil, nil
+	}
+	if _, completed := k.completed[reqOffset]; completed {
+		return nil, nil
+	}
+	var requestCommon kldmessages.RequestCommon
+	if err := json.Unmarshal(msg.Value, &requestCommon); err != nil {
+		// Rejected once it is in-flight
+		return nil, nil
+	}
+	tenant := requestCommon.Headers.Tenant
+	if k.inFlightByTenant[tenant] >= k.conf.MaxInFlightPerTenant {
+		log.Infof("Too many messages in-flight for tenant '%s': In-flight=%d Max=%d", tenant, k.inFlightByTenant[tenant], k.conf.MaxInFlightPerTenant)
+		return &requestCommon, fmt.Errorf("Too many messages in-flight for tenant '%s' (maximum %d)", tenant, k.conf.MaxInFlightPerTenant)
+	}
+	return nil, nil
+}
+
+// checkTenant validates the tenant on a message against the configured list
+func (k *KafkaBridge) checkTenant(tenant string) error {
+	if len(k.conf.Tenants) == 0 {
+		return nil
+	}
+	for _, allowed := range k.conf.Tenants {
+		if tenant == allowed {
+			return nil
+		}
+	}
+	if tenant == "" {
+		return fmt.Errorf("No tenant specified in headers")
+	}
+	return fmt.Errorf("Unknown tenant '%s'", tenant)
+}
+
+// checkMessageAge rejects messages older than the configured maximum age, so a
+// backlog that built up during an outage is not submitted long after it was sent.
+// The timestamp in the headers takes precedence over the Kafka message timestamp
+func (k *KafkaBridge) checkMessageAge(headers *kldmessages.CommonHeaders, msg *sarama.ConsumerMessage) error {
+	if k.conf.MaxMessageAge <= 0 {
+		return nil
+	}
+	sent := msg.Timestamp
+	if headers.Timestamp != "" {
+		var err error
+		if sent, err = time.Parse(time.RFC3339, headers.Timestamp); err != nil {
+			return fmt.Errorf("Invalid 'timestamp' in headers (must be RFC3339): %s", headers.Timestamp)
+		}
+	}
+	if sent.IsZero() {
+		return nil
+	}
+	if age := time.Now().Sub(sent); age > time.Duration(k.conf.MaxMessageAge)*time.Second {
+		return fmt.Errorf("Message expired - sent %.0fs ago, which exceeds the maximum message age of %ds", age.Seconds(), k.conf.MaxMessageAge)
+	}
+	return nil
+}
+
+// addCompleted records the reply sent for a message, if a redelivery grace period is
+// configured. A redelivery of the message is recognized by the in-flight map until
+// its offset is committed, then by the completed messages for the grace period.
+// Persisting the reply as soon as it is sent means that is also true after a restart
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) addCompleted(ctx *msgContext) {
+	// Filtered messages have no reply, and are filtered again if redelivered
+	if k.conf.RedeliveryGracePeriod <= 0 || ctx.filtered {
+		return
+	}
+	completed := k.newCompletedMsg(ctx, k.conf.RedeliveryGracePeriod)
+	k.completed[ctx.reqOffset] = completed
+	k.completedLRU = append(k.completedLRU, completed)
+	if k.redeliveryStore != nil {
+		k.redeliveryStore.add(completed, k.completedLRU)
+	}
+}
+
+// newCompletedMsg records the reply sent for a message, to re-send within the TTL (seconds)
+func (k *KafkaBridge) newCompletedMsg(ctx *msgContext, ttl int) *completedMsg {
+	return &completedMsg{
+		reqOffset:         ctx.reqOffset,
+		key:               ctx.key,
+		replyTopic:        ctx.replyTopic,
+		replyBytes:        ctx.replyBytes,
+		replyFieldHeaders: ctx.replyFieldHeaders,
+		replyPartition:    ctx.replyPartition,
+		replyMessage:      ctx.replyMessage,
+		tombstoneKey:      k.tombstoneKey(ctx),
+		expiry:            time.Now().Add(time.Duration(ttl) * time.Second),
+	}
+}
+
+// expireCompleted removes completed messages that are outside of the grace period.
+// As the grace period is fixed, the list is always in expiry order.
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) expireCompleted() {
+	now := time.Now()
+	var i int
+	for i = 0; i < len(k.completedLRU) && now.After(k.completedLRU[i].expiry); i++ {
+		// Only remove the map entry if it has not been replaced by a later completion
+		if k.completed[k.completedLRU[i].reqOffset] == k.completedLRU[i] {
+			delete(k.completed, k.completedLRU[i].reqOffset)
+		}
+	}
+	k.completedLRU = k.completedLRU[i:]
+}
+
+// logPayload logs a complete request or reply payload at debug level, if configured,
+// with the values of any sensitive fields redacted
+func (k *KafkaBridge) logPayload(desc string, ctx *msgContext, payload []byte) {
+	if k.conf.LogFullPayloads && log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("%s payload %s: %s", desc, ctx.reqOffset, kldutils.RedactJSON(payload, k.conf.RedactFields))
+	}
+}
+
 func (c *msgContext) Headers() *kldmessages.CommonHeaders {
 	return &c.requestCommon.Headers
 }
 
+func (c *msgContext) KafkaHeader(key string) string {
+	for _, header := range c.saramaMsg.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+// mergeContextHeaders merges the configured Kafka headers into the request context,
+// without overriding any values supplied in the JSON payload
+func (c *msgContext) mergeContextHeaders() {
+	headers := &c.requestCommon.Headers
+	for _, key := range c.bridge.conf.KafkaHeaders.Context {
+		val := c.KafkaHeader(key)
+		if val == "" {
+			continue
+		}
+		if headers.Context == nil {
+			headers.Context = make(map[string]interface{})
+		}
+		ctxMap, isMap := headers.Context.(map[string]interface{})
+		if !isMap {
+			log.Warnf("Unable to merge Kafka header '%s' into non-object context: %s", key, c)
+			return
+		}
+		if _, exists := ctxMap[key]; !exists {
+			ctxMap[key] = val
+		}
+	}
+}
+
+// replyProducerMessage builds the message to send to Kafka with the reply,
+// copying across any of the configured Kafka headers
+func (c *msgContext) replyProducerMessage() *sarama.ProducerMessage {
+	msg := &sarama.ProducerMessage{
+		Topic:     c.replyTopic,
+		Key:       sarama.StringEncoder(c.key),
+		Partition: c.replyPartition,
+		Metadata:  c.reqOffset,
+		Value:     c,
+	}
+	for _, key := range c.bridge.conf.KafkaHeaders.Reply {
+		if val := c.KafkaHeader(key); val != "" {
+			msg.Headers = append(msg.Headers, sarama.RecordHeader{
+				Key:   []byte(key),
+				Value: []byte(val),
+			})
+		}
+	}
+	msg.Headers = append(msg.Headers, c.requestFieldHeaders...)
+	msg.Headers = append(msg.Headers, c.replyFieldHeaders...)
+	c.bridge.markReply(msg)
+	return msg
+}
+
 func (c *msgContext) Unmarshal(msg interface{}) (err error) {
 	if err = json.Unmarshal(c.saramaMsg.Value, msg); err != nil {
 		log.Errorf("Failed to parse message: %s - Message=%s", err, string(c.saramaMsg.Value))
@@ -258,6 +1067,7 @@ func (c *msgContext) SendErrorReply(status int, err error) {
 
 func (c *msgContext) SendErrorReplyWithTX(status int, err error, txHash string) {
 	log.Warnf("Failed to process message %s: %s", c, err)
+	c.errorStatus = status
 	errMsg := kldmessages.NewErrorReply(err, c.saramaMsg.Value)
 	errMsg.TXHash = txHash
 	c.Reply(errMsg)
@@ -265,31 +1075,260 @@ func (c *msgContext) SendErrorReplyWithTX(status int, err error, txHash string)
 
 func (c *msgContext) Reply(replyMessage kldmessages.ReplyWithHeaders) {
 
+	// A message with a held offset can be replied to again, such as when we time out
+	// waiting for confirmations to commit it. It must then not complete until this
+	// reply is sent too
+	c.bridge.inFlightCond.L.Lock()
+	c.heldConsumer = nil
+	c.bridge.inFlightCond.L.Unlock()
+
 	replyHeaders := replyMessage.ReplyHeaders()
 	c.replyType = replyHeaders.MsgType
 	replyHeaders.ID = kldutils.UUIDv4()
 	replyHeaders.Context = c.requestCommon.Headers.Context
+	replyHeaders.Tenant = c.requestCommon.Headers.Tenant
 	replyHeaders.ReqID = c.requestCommon.Headers.ID
 	replyHeaders.ReqOffset = c.reqOffset
 	replyHeaders.ReqOffset = c.reqOffset
 	replyHeaders.Received = c.timeReceived.Format(time.RFC3339)
 	c.replyTime = time.Now()
 	replyHeaders.Elapsed = c.replyTime.Sub(c.timeReceived).Seconds()
-	c.replyBytes, _ = json.Marshal(replyMessage)
-	log.Infof("Sending reply: %s", c)
-	c.producer.Input() <- &sarama.ProducerMessage{
-		Topic:    c.bridge.kafka.Conf().TopicOut,
-		Key:      sarama.StringEncoder(c.key),
-		Metadata: c.reqOffset,
-		Value:    c,
+	if c.bridge.conf.ReplyLoad {
+		replyHeaders.Load = c.bridge.bridgeLoad()
+	}
+	c.replyTopic = c.bridge.replyTopicFor(c)
+	c.requestFieldHeaders = fieldHeaders(c.bridge.conf.KafkaHeaders.RequestFields, c.saramaMsg.Value)
+	c.replyMessage = replyMessage
+	c.replyBytes = c.marshalReply(replyMessage)
+	c.limitReplySize(replyMessage)
+	c.bridge.countReply(c)
+	c.bridge.auditLog.recordReply(c, replyMessage)
+	if c.bridge.errorCoalescer.coalesce(c, replyMessage) {
+		c.bridge.completeCoalesced(c)
+		return
 	}
+	log.Infof("Sending reply: %s", c)
+	c.bridge.logPayload("Reply", c, c.replyBytes)
+	c.producer.Input() <- c.replyProducerMessage()
 	return
 }
 
+// HoldOffset keeps the message in-flight after the reply is sent, so its offset
+// (and those after it in the partition) are not committed until ReleaseOffset
+func (c *msgContext) HoldOffset() {
+	c.bridge.inFlightCond.L.Lock()
+	c.offsetHeld = true
+	c.bridge.inFlightCond.L.Unlock()
+}
+
+// ReleaseOffset completes a message with a held offset, if the reply has been sent.
+// Otherwise it completes as normal when the reply is sent
+func (c *msgContext) ReleaseOffset() {
+	k := c.bridge
+	k.inFlightCond.L.Lock()
+	defer k.inFlightCond.L.Unlock()
+	c.offsetHeld = false
+	if c.heldConsumer != nil {
+		log.Infof("Releasing offset: %s", c)
+		k.setInFlightComplete(c, c.heldConsumer)
+		k.inFlightCond.Broadcast()
+	}
+}
+
+// limitReplySize checks the serialized reply against the configured maximum size.
+// An oversized reply would be rejected by Kafka, and fail the producer.
+// So we first try to truncate it (if allowed), and if that is not enough we
+// replace it with a small error reply that can be correlated to the request.
+func (c *msgContext) limitReplySize(replyMessage kldmessages.ReplyWithHeaders) {
+	maxSize := c.bridge.conf.MaxReplySize
+	if maxSize <= 0 || len(c.replyBytes) <= maxSize {
+		return
+	}
+	origSize := len(c.replyBytes)
+	replyHeaders := replyMessage.ReplyHeaders()
+
+	if c.bridge.conf.OversizeReplies != OversizeRepliesError {
+		truncator, ok := replyMessage.(kldmessages.ReplyTruncator)
+		for ok && truncator.TruncateReply() {
+			replyHeaders.Truncated = true
+			c.replyBytes = c.marshalReply(replyMessage)
+			if len(c.replyBytes) <= maxSize {
+				log.Warnf("Truncated reply from %d to %d bytes: %s", origSize, len(c.replyBytes), c)
+				return
+			}
+		}
+	}
+
+	var errMsg kldmessages.ErrorReply
+	errMsg.Headers = *replyHeaders
+	errMsg.Headers.MsgType = kldmessages.MsgTypeError
+	errMsg.Headers.Truncated = false
+	errMsg.ErrorMessage = fmt.Sprintf("Reply of type '%s' (%d bytes) exceeds the maximum reply size of %d bytes", c.replyType, origSize, maxSize)
+	switch reply := replyMessage.(type) {
+	case *kldmessages.TransactionReceipt:
+		if reply.TransactionHash != nil {
+			errMsg.TXHash = reply.TransactionHash.Hex()
+		}
+	case *kldmessages.ErrorReply:
+		errMsg.TXHash = reply.TXHash
+	}
+	log.Errorf("%s: %s", errMsg.ErrorMessage, c)
+	c.replyType = kldmessages.MsgTypeError
+	c.replyTopic = c.bridge.replyTopicFor(c)
+	c.replyMessage = &errMsg
+	c.replyBytes = c.marshalReply(&errMsg)
+}
+
+// receiptStatusJSON renders the numeric status of a receipt in the configured
+// format. Receipts without a status, from before the Byzantium fork, are unchanged
+func receiptStatusJSON(replyBytes []byte, statusFormat string) ([]byte, error) {
+	if statusFormat != StatusFormatBool && statusFormat != StatusFormatBoth {
+		return replyBytes, nil
+	}
+	var reply map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(replyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&reply); err != nil {
+		return nil, err
+	}
+	status, _ := reply["status"].(string)
+	if status == "" {
+		return replyBytes, nil
+	}
+	success := status != "0"
+	if statusFormat == StatusFormatBool {
+		reply["status"] = success
+	} else {
+		reply["statusBool"] = success
+	}
+	return json.Marshal(reply)
+}
+
+// marshalReply serializes a reply, applying the configured field naming and envelope.
+// The Kafka headers from reply fields are set from the reply that is marshaled last,
+// as that is the one that is sent
+func (c *msgContext) marshalReply(replyMessage kldmessages.ReplyWithHeaders) []byte {
+	replyBytes, _ := json.Marshal(replyMessage)
+	if _, isReceipt := replyMessage.(*kldmessages.TransactionReceipt); isReceipt {
+		if statusBytes, err := receiptStatusJSON(replyBytes, c.bridge.conf.StatusFormat); err == nil {
+			replyBytes = statusBytes
+		}
+	}
+	if c.bridge.conf.ChecksumAddresses {
+		// Skipping the application context, and the decoded event data and revert params
+		if checksumBytes, err := kldutils.ChecksumJSONAddresses(replyBytes, replyAddressFields, "ctx", "data", "params"); err == nil {
+			replyBytes = checksumBytes
+		}
+	}
+	if c.bridge.replyEncryption != nil {
+		// Before the Kafka headers are set from reply fields, so they cannot expose the values
+		if encryptedBytes, err := c.bridge.replyEncryption.encrypt(replyBytes); err == nil {
+			replyBytes = encryptedBytes
+		} else {
+			// The fields must never be sent in the clear
+			log.Errorf("Failed to encrypt reply fields: %s", err)
+			var errMsg kldmessages.ErrorReply
+			errMsg.Headers = *replyMessage.ReplyHeaders()
+			errMsg.Headers.MsgType = kldmessages.MsgTypeError
+			errMsg.ErrorMessage = "Failed to encrypt reply fields"
+			replyBytes, _ = json.Marshal(&errMsg)
+		}
+	}
+	c.replyFieldHeaders = fieldHeaders(c.bridge.conf.KafkaHeaders.ReplyFields, replyBytes)
+	c.replyPartition = c.bridge.replyPartition(replyBytes)
+	if c.bridge.conf.ReplyFieldNaming == ReplyFieldNamingSnake {
+		// The context is supplied by the application, so is returned exactly as sent
+		if snakeBytes, err := kldutils.SnakeCaseJSONKeys(replyBytes, "ctx"); err == nil {
+			replyBytes = snakeBytes
+		}
+	}
+	if wrappedBytes, err := c.bridge.replyEnvelope.Wrap(replyMessage.ReplyHeaders(), replyBytes); err == nil {
+		replyBytes = wrappedBytes
+	} else {
+		log.Errorf("Failed to wrap reply in envelope: %s", err)
+	}
+	if c.bridge.schemaRegistry != nil && c.bridge.conf.SchemaRegistry.AvroReplies {
+		if avroBytes, err := c.bridge.schemaRegistry.encodeReply(c.replyTopic, replyMessage.ReplyHeaders().MsgType, replyBytes); err == nil {
+			replyBytes = avroBytes
+		} else {
+			log.Errorf("Failed to encode reply with Avro: %s", err)
+		}
+	}
+	return replyBytes
+}
+
+// fieldHeaders builds the configured Kafka headers from fields of a serialized
+// request or reply, so consumers can route replies without parsing them. The paths
+// use the native field names, and headers are omitted for fields that are not set
+func fieldHeaders(fields map[string]string, msgBytes []byte) (headers []sarama.RecordHeader) {
+	if len(fields) == 0 {
+		return nil
+	}
+	var msg interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msgBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg); err != nil {
+		return nil
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if val, ok := fieldValue(msg, fields[key]); ok {
+			headers = append(headers, sarama.RecordHeader{
+				Key:   []byte(key),
+				Value: []byte(val),
+			})
+		}
+	}
+	return headers
+}
+
+// fieldValue finds a field in a message by its dot separated path, returning
+// strings as they are and any other values as JSON
+func fieldValue(msg interface{}, path string) (string, bool) {
+	val := msg
+	for _, name := range strings.Split(path, ".") {
+		obj, isObj := val.(map[string]interface{})
+		if !isObj {
+			return "", false
+		}
+		if val = obj[name]; val == nil {
+			return "", false
+		}
+	}
+	if str, isStr := val.(string); isStr {
+		return str, true
+	}
+	valBytes, _ := json.Marshal(val)
+	return string(valBytes), true
+}
+
+// resendCachedReply re-sends the reply we sent for a previous delivery of the same message
+func (c *msgContext) resendCachedReply() {
+	c.replyTopic = c.cachedReply.replyTopic
+	c.replyBytes = c.cachedReply.replyBytes
+	c.requestFieldHeaders = fieldHeaders(c.bridge.conf.KafkaHeaders.RequestFields, c.saramaMsg.Value)
+	c.replyFieldHeaders = c.cachedReply.replyFieldHeaders
+	c.replyPartition = c.cachedReply.replyPartition
+	c.replyTime = time.Now()
+	c.replyType = "cached"
+	log.Infof("Re-sending reply: %s", c)
+	c.producer.Input() <- c.replyProducerMessage()
+}
+
 func (c *msgContext) String() string {
 	retval := fmt.Sprintf("MsgContext[%s:%s reqOffset=%s complete=%t received=%s",
 		c.requestCommon.Headers.MsgType, c.requestCommon.Headers.ID,
 		c.reqOffset, c.complete, c.timeReceived.Format(time.RFC3339))
+	if c.requestCommon.Headers.Tenant != "" {
+		retval += fmt.Sprintf(" tenant=%s", c.requestCommon.Headers.Tenant)
+	}
+	if c.requestCommon.Headers.Priority != "" {
+		retval += fmt.Sprintf(" priority=%s", c.requestCommon.Headers.Priority)
+	}
 	if c.replyType != "" {
 		retval += fmt.Sprintf(" replied=%s replyType=%s",
 			c.replyTime.Format(time.RFC3339), c.replyType)
@@ -312,45 +1351,278 @@ func (c msgContext) Encode() ([]byte, error) {
 func NewKafkaBridge(printYAML *bool) *KafkaBridge {
 	mp := newMsgProcessor()
 	k := &KafkaBridge{
-		printYAML:    printYAML,
-		processor:    mp,
-		inFlight:     make(map[string]*msgContext),
-		inFlightCond: sync.NewCond(&sync.Mutex{}),
+		printYAML:        printYAML,
+		processor:        mp,
+		inFlight:         make(map[string]*msgContext),
+		inFlightCond:     sync.NewCond(&sync.Mutex{}),
+		completed:        make(map[string]*completedMsg),
+		idempotent:       make(map[string]*completedMsg),
+		idempotentActive: make(map[string]*msgContext),
+		inFlightByTenant: make(map[string]int),
+		directReplies:    make(map[string]*sarama.ConsumerMessage),
+		directAcks:       make(map[string]*sarama.ConsumerMessage),
+		rpcLatency:       kldeth.NewRPCLatencyHistogram(),
+		droppedTXs:       mp.droppedTXs,
+		msgsTotal:        kldmetrics.NewCounterVec("ethconnect_messages_total", "Messages replied to, by request and reply type", "msgType", "replyType"),
+		msgErrors:        kldmetrics.NewCounterVec("ethconnect_message_errors_total", "Error replies, by request type, status code and reason", "msgType", "code", "reason"),
+		replyLoad:        newReplyLoad(),
+		pause:            mp.pause,
+		replyEnvelope:    &nativeReplyEnvelope{},
+		txTemplates:      mp.txTemplates,
+		localSigners:     mp.localSigners,
+		requestSchema:    newRequestSchema(),
+		auditLog:         mp.auditLog,
+		deadLetters:      newDeadLetters(),
+		gasOracle:        mp.gasOracle,
+		failureEvents:    mp.failureEvents,
+		gasFactors:       mp.gasFactors,
 	}
 	mp.conf = &k.conf // Inherit our configuration in the processor
 	k.kafka = NewKafkaCommon(&SaramaKafkaFactory{}, &k.conf.Kafka, k)
 	return k
 }
 
+// RegisterHandler adds the handler for a message type, replacing any existing
+// handler. Should be called before the bridge is started
+func (k *KafkaBridge) RegisterHandler(msgType string, handler MsgHandler) {
+	k.processor.RegisterHandler(msgType, handler)
+}
+
 // ConsumerMessagesLoop - goroutine to process messages
 func (k *KafkaBridge) ConsumerMessagesLoop(consumer KafkaConsumer, producer KafkaProducer, wg *sync.WaitGroup) {
 	log.Debugf("Kafka consumer loop started")
-	for msg := range consumer.Messages() {
-		k.inFlightCond.L.Lock()
-		log.Infof("Kafka consumer received message: Partition=%d Offset=%d", msg.Partition, msg.Offset)
+	k.auditLog.setProducer(producer)
+	k.errorCoalescer.setClients(consumer, producer)
+	for k.pause.wait() {
+		msg, ok := <-consumer.Messages()
+		if !ok {
+			break
+		}
+		for _, readyMsg := range k.readyMessagesByPriority(msg, consumer) {
+			if k.conf.ReplyLoad {
+				k.replyLoad.consumedMsg(consumer, readyMsg)
+			}
+			if k.isReply(readyMsg) || k.isFiltered(readyMsg) {
+				k.skipFiltered(readyMsg, consumer)
+			} else {
+				k.processConsumerMessage(readyMsg, producer)
+			}
+		}
+	}
+	wg.Done()
+}
 
-		// We cannot build up an infinite number of messages in memory
-		for len(k.inFlight) >= k.conf.MaxInFlight {
-			log.Infof("Too many messages in-flight: In-flight=%d Max=%d", len(k.inFlight), k.conf.MaxInFlight)
-			k.inFlightCond.Wait()
+// readyMessagesByPriority returns the supplied message, along with any others
+// that are already waiting on the consumer, with high priority messages first.
+// This is only done with PriorityOrdering, as reading ahead means parsing each
+// message an extra time. We only read ahead as far as we have in-flight capacity,
+// and only reorder messages that have already arrived. Messages are only reordered
+// within their own partition, as that is the order offsets are committed in, so
+// priority is not guaranteed across partitions. As dispatched messages are processed
+// concurrently, this only holds up normal messages behind high priority ones
+// where they wait for a slot under MaxConcurrentSubmits.
+func (k *KafkaBridge) readyMessagesByPriority(msg *sarama.ConsumerMessage, consumer KafkaConsumer) []*sarama.ConsumerMessage {
+	ready := []*sarama.ConsumerMessage{msg}
+	if !k.conf.PriorityOrdering {
+		return ready
+	}
+
+	k.inFlightCond.L.Lock()
+	capacity := k.conf.MaxInFlight - len(k.inFlight)
+	k.inFlightCond.L.Unlock()
+
+readAhead:
+	for len(ready) < capacity {
+		select {
+		case nextMsg, ok := <-consumer.Messages():
+			if !ok {
+				break readAhead
+			}
+			ready = append(ready, nextMsg)
+		default:
+			break readAhead
 		}
-		// addInflightMsg always adds the message, even if it cannot
-		// be parsed
-		msgCtx, err := k.addInflightMsg(msg, producer)
-		// Unlock before any further processing
+	}
+	if len(ready) == 1 {
+		return ready
+	}
+
+	readyHeaders := make(map[*sarama.ConsumerMessage]*kldmessages.CommonHeaders, len(ready))
+	byPartition := make(map[int32][]*sarama.ConsumerMessage)
+	for _, readyMsg := range ready {
+		// Any failure to decode an Avro request is reported when it is processed
+		k.decodeRequest(readyMsg)
+		var requestCommon kldmessages.RequestCommon
+		json.Unmarshal(readyMsg.Value, &requestCommon)
+		readyHeaders[readyMsg] = &requestCommon.Headers
+		byPartition[readyMsg.Partition] = append(byPartition[readyMsg.Partition], readyMsg)
+	}
+	for partition, partitionMsgs := range byPartition {
+		byPartition[partition] = orderByPriority(partitionMsgs, readyHeaders)
+	}
+	// Each partition keeps the positions its messages were read in
+	sorted := make([]*sarama.ConsumerMessage, 0, len(ready))
+	for _, readyMsg := range ready {
+		partitionMsgs := byPartition[readyMsg.Partition]
+		sorted = append(sorted, partitionMsgs[0])
+		byPartition[readyMsg.Partition] = partitionMsgs[1:]
+	}
+	return sorted
+}
+
+// orderByPriority orders the ready messages of a partition with high priority
+// messages first. A message never overtakes an earlier one from the same account,
+// or with the same key, as those must be processed in order. For transactions
+// this is the order their nonces are assigned in
+func orderByPriority(msgs []*sarama.ConsumerMessage, readyHeaders map[*sarama.ConsumerMessage]*kldmessages.CommonHeaders) []*sarama.ConsumerMessage {
+	ordered := make([]*sarama.ConsumerMessage, 0, len(msgs))
+	for len(msgs) > 0 {
+		next := 0
+		accounts := make(map[string]bool)
+		keys := make(map[string]bool)
+		for i, msg := range msgs {
+			headers := readyHeaders[msg]
+			account := strings.ToLower(headers.Account)
+			if headers.Priority == kldmessages.PriorityHigh && !accounts[account] && !keys[string(msg.Key)] {
+				next = i
+				break
+			}
+			if account != "" {
+				accounts[account] = true
+			}
+			if len(msg.Key) > 0 {
+				keys[string(msg.Key)] = true
+			}
+		}
+		ordered = append(ordered, msgs[next])
+		msgs = append(msgs[:next:next], msgs[next+1:]...)
+	}
+	return ordered
+}
+
+// processConsumerMessage adds an individual message to the inFlight map, and
+// dispatches it to the processor
+func (k *KafkaBridge) processConsumerMessage(msg *sarama.ConsumerMessage, producer KafkaProducer) {
+	log.Infof("Kafka consumer received message: Partition=%d Offset=%d", msg.Partition, msg.Offset)
+	// Decoding can call the schema registry, so is done before we take the lock
+	decodeErr := k.decodeRequest(msg)
+	if _, unavailable := decodeErr.(*registryUnavailableError); unavailable {
+		log.Errorf("Message %d:%d not processed, as the consumer is stopping: %s", msg.Partition, msg.Offset, decodeErr)
+		return
+	}
+	if k.conf.DirectParseErrors {
+		if decodeErr != nil {
+			log.Errorf("Failed to decode message: %s", decodeErr)
+			k.sendDirectErrorReply(msg, producer, nil, 400, decodeErr)
+			return
+		}
+		var requestCommon kldmessages.RequestCommon
+		if err := json.Unmarshal(msg.Value, &requestCommon); err != nil {
+			log.Errorf("Failed to unmarshal message headers: %s - Message=%s", err, string(msg.Value))
+			k.sendDirectErrorReply(msg, producer, nil, 400, err)
+			return
+		}
+	}
+
+	k.inFlightCond.L.Lock()
+
+	// We cannot build up an infinite number of messages in memory
+	for len(k.inFlight) >= k.conf.MaxInFlight || k.inFlightBytesExceeded(msg) {
+		log.Infof("Too many messages in-flight: In-flight=%d Max=%d Bytes=%d MaxBytes=%d", len(k.inFlight), k.conf.MaxInFlight, k.inFlightBytes, k.conf.MaxInFlightBytes)
+		k.inFlightCond.Wait()
+	}
+	// A tenant over its own limit is rejected with a direct reply, so it can retry later
+	if requestCommon, err := k.checkTenantInFlight(msg, decodeErr); err != nil {
 		k.inFlightCond.L.Unlock()
-		if msgCtx == nil {
-			// This was a dup
-		} else if err == nil {
-			// Dispatch for processing if we parsed the message successfully
-			k.processor.OnMessage(msgCtx)
-		} else {
-			// Dispatch a generic 'bad data' reply
-			errMsg := kldmessages.NewErrorReply(err, msg.Value)
-			msgCtx.Reply(errMsg)
+		k.sendDirectErrorReply(msg, producer, requestCommon, 429, err)
+		return
+	}
+	// addInflightMsg always adds the message, even if it cannot
+	// be parsed
+	msgCtx, err := k.addInflightMsg(msg, producer, decodeErr)
+	// Unlock before any further processing
+	k.inFlightCond.L.Unlock()
+	if msgCtx == nil {
+		// This was a dup
+	} else if msgCtx.cachedReply != nil {
+		// This was a redelivery of a message we already replied to
+		msgCtx.resendCachedReply()
+	} else if msgCtx.idemReply != nil {
+		// This was a duplicate of another message we already replied to
+		msgCtx.replyIdempotent()
+	} else if err == nil {
+		// Dispatch for processing if we parsed the message successfully
+		k.dispatchMessage(msgCtx)
+	} else {
+		// Dispatch a generic 'bad data' reply
+		msgCtx.SendErrorReply(400, err)
+	}
+}
+
+// sendDirectErrorReply sends an error reply for a message that we never add to
+// the inFlight map. The offset is marked when the reply is confirmed. The headers
+// of the request are included in the reply, if it could be parsed
+func (k *KafkaBridge) sendDirectErrorReply(msg *sarama.ConsumerMessage, producer KafkaProducer, requestCommon *kldmessages.RequestCommon, status int, err error) {
+	ctx := &msgContext{
+		timeReceived: time.Now(),
+		reqOffset:    fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset),
+		saramaMsg:    msg,
+		bridge:       k,
+		producer:     producer,
+		key:          kldutils.UUIDv4(),
+	}
+	if requestCommon != nil {
+		ctx.requestCommon = *requestCommon
+	}
+	k.inFlightCond.L.Lock()
+	k.directReplies[ctx.reqOffset] = msg
+	k.inFlightCond.L.Unlock()
+	ctx.SendErrorReply(status, err)
+}
+
+// setDirectReplyComplete marks the offset for a direct reply, as long as
+// there is nothing earlier in the same partition still in-flight.
+// If there is, the offset is recorded, and marked when that completes.
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) setDirectReplyComplete(msg *sarama.ConsumerMessage, consumer KafkaConsumer) {
+	if inflight := k.earlierInFlight(msg); inflight != nil {
+		log.Debugf("Direct reply %d:%d waiting for in-flight %d:%d", msg.Partition, msg.Offset, inflight.saramaMsg.Partition, inflight.saramaMsg.Offset)
+		k.directAcks[fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)] = msg
+		return
+	}
+	log.Infof("Marking offset %d:%d", msg.Offset, msg.Partition)
+	consumer.MarkOffset(msg, "")
+}
+
+// earlierInFlight returns a message still in-flight before the supplied one in the same partition, if any
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) earlierInFlight(msg *sarama.ConsumerMessage) *msgContext {
+	for _, inflight := range k.inFlight {
+		if inflight.saramaMsg.Partition == msg.Partition && inflight.saramaMsg.Offset < msg.Offset {
+			return inflight
 		}
 	}
-	wg.Done()
+	return nil
+}
+
+// markDirectAcks marks the offsets of direct replies that were waiting in the same
+// partition as a newly marked offset, once nothing earlier is still in-flight
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) markDirectAcks(marked *sarama.ConsumerMessage, consumer KafkaConsumer) {
+	var highest *sarama.ConsumerMessage
+	for reqOffset, msg := range k.directAcks {
+		if msg.Partition != marked.Partition || k.earlierInFlight(msg) != nil {
+			continue
+		}
+		delete(k.directAcks, reqOffset)
+		if msg.Offset > marked.Offset && (highest == nil || msg.Offset > highest.Offset) {
+			highest = msg
+		}
+	}
+	if highest != nil {
+		log.Infof("Marking offset %d:%d", highest.Offset, highest.Partition)
+		consumer.MarkOffset(highest, "")
+	}
 }
 
 // ProducerErrorLoop - goroutine to process producer errors
@@ -358,7 +1630,20 @@ func (k *KafkaBridge) ProducerErrorLoop(consumer KafkaConsumer, producer KafkaPr
 	log.Debugf("Kafka producer error loop started")
 	defer wg.Done()
 	for err := range producer.Errors() {
-		k.inFlightCond.L.Lock()
+		// The reply was already delivered before we sent a tombstone,
+		// so failing to send one does not affect the request
+		if tombstone, ok := err.Msg.Metadata.(*tombstoneMetadata); ok {
+			log.Errorf("Kafka producer failed to send tombstone for request %s: %s", tombstone.reqID, err)
+			continue
+		}
+		if audit, ok := err.Msg.Metadata.(*auditMetadata); ok {
+			log.Errorf("Kafka producer failed to send audit record for request %s: %s", audit.reqID, err)
+			continue
+		}
+		if summary, ok := err.Msg.Metadata.(*errorSummaryMetadata); ok {
+			log.Errorf("Kafka producer failed to send summary of error replies with code %d: %s", summary.code, err)
+			continue
+		}
 		// If we fail to send a reply, this is significant. We have a request in flight
 		// and we have probably already sent the message.
 		// Currently we panic, on the basis that we will be restarted by Docker
@@ -366,6 +1651,8 @@ func (k *KafkaBridge) ProducerErrorLoop(consumer KafkaConsumer, producer KafkaPr
 		// producer and attempting to resend the message a number of times -
 		// keeping a retry counter on the msgContext object
 		reqOffset := err.Msg.Metadata.(string)
+		k.deadLetters.recordError(reqOffset, err)
+		k.inFlightCond.L.Lock()
 		ctx := k.inFlight[reqOffset]
 		log.Errorf("Kafka producer failed for reply %s to reqOffset %s: %s", ctx, reqOffset, err)
 		panic(err)
@@ -378,14 +1665,38 @@ func (k *KafkaBridge) ProducerSuccessLoop(consumer KafkaConsumer, producer Kafka
 	log.Debugf("Kafka producer successes loop started")
 	defer wg.Done()
 	for msg := range producer.Successes() {
+		if tombstone, ok := msg.Metadata.(*tombstoneMetadata); ok {
+			log.Debugf("Tombstone sent for request %s", tombstone.reqID)
+			continue
+		}
+		if _, ok := msg.Metadata.(*auditMetadata); ok {
+			continue
+		}
+		if _, ok := msg.Metadata.(*errorSummaryMetadata); ok {
+			continue
+		}
 		k.inFlightCond.L.Lock()
 		reqOffset := msg.Metadata.(string)
 		if ctx, ok := k.inFlight[reqOffset]; ok {
 			log.Infof("Reply sent: %s", ctx)
-			// While still holding the lock, add this to the completed list
-			k.setInFlightComplete(ctx, consumer)
-			// We've reduced the in-flight count - wake any waiting consumer go func
-			k.inFlightCond.Broadcast()
+			// Recorded now, rather than when the offset is committed, as that can be
+			// held up by earlier messages in the partition
+			k.addCompleted(ctx)
+			k.sendTombstone(ctx, producer)
+			if ctx.offsetHeld {
+				// The message completes when the processor releases the offset
+				log.Infof("Holding offset after reply: %s", ctx)
+				ctx.heldConsumer = consumer
+			} else {
+				// While still holding the lock, add this to the completed list
+				k.setInFlightComplete(ctx, consumer)
+				// We've reduced the in-flight count - wake any waiting consumer go func
+				k.inFlightCond.Broadcast()
+			}
+		} else if directMsg, ok := k.directReplies[reqOffset]; ok {
+			log.Infof("Direct reply sent: %s", reqOffset)
+			delete(k.directReplies, reqOffset)
+			k.setDirectReplyComplete(directMsg, consumer)
 		} else {
 			// This should never happen. Represents a logic bug that must be diagnosed.
 			err := fmt.Errorf("Received confirmation for message not in in-flight map: %s", reqOffset)
@@ -395,18 +1706,335 @@ func (k *KafkaBridge) ProducerSuccessLoop(consumer KafkaConsumer, producer Kafka
 	}
 }
 
+// newRPCHTTPClient creates the HTTP client for HTTPS connections to the nodes,
+// when TLS options are configured for them. The client certificate is reloaded
+// when its files change, and is used for each new connection. As idle connections
+// are closed after a timeout, a rotated certificate is picked up without a restart
+func newRPCHTTPClient(tlsConf *kldutils.TLSConfig) (*http.Client, error) {
+	// Any of the options enables TLS, without changing the configuration we were given
+	enabledConf := *tlsConf
+	enabledConf.Enabled = tlsConf.Enabled || tlsConf.ClientCertsFile != "" || tlsConf.ClientKeyFile != "" ||
+		tlsConf.CACertsFile != "" || tlsConf.InsecureSkipVerify
+	tlsConfig, err := kldutils.CreateTLSConfiguration(&enabledConf)
+	if err != nil || tlsConfig == nil {
+		return nil, err
+	}
+	// The same settings as http.DefaultTransport, other than the TLS configuration
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		TLSClientConfig:       tlsConfig,
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// dialNode connects to a JSON/RPC node, using the configured TLS options for HTTPS
+func (k *KafkaBridge) dialNode(url string) (*rpc.Client, error) {
+	if k.rpcHTTPClient != nil && strings.HasPrefix(strings.ToLower(url), "https://") {
+		return rpc.DialHTTPWithClient(url, k.rpcHTTPClient)
+	}
+	return rpc.Dial(url)
+}
+
+// reconnectingRPC wraps the connection to a node so it is redialed when calls
+// fail to reach the node, if a reconnect wait is configured
+func (k *KafkaBridge) reconnectingRPC(desc, url string, client *rpc.Client) kldeth.RPCClient {
+	if k.conf.RPC.ReconnectWait <= 0 {
+		return client
+	}
+	dial := func() (kldeth.ClosableRPCClient, error) {
+		client, err := k.dialNode(url)
+		if err != nil {
+			return nil, err
+		}
+		return client, nil
+	}
+	return kldeth.NewReconnectingRPC(desc, client, dial, time.Duration(k.conf.RPC.ReconnectWait)*time.Second)
+}
+
+// dialRPC connects to the JSON/RPC node. When waiting for the node on startup,
+// a request is made to check the node is ready, as HTTP connections are lazy
+func (k *KafkaBridge) dialRPC() (err error) {
+	if k.rpc, err = k.dialNode(k.conf.RPC.URL); err != nil {
+		return fmt.Errorf("JSON/RPC connection to %s failed: %s", k.conf.RPC.URL, err)
+	}
+	if k.conf.Kafka.StartupWait > 0 {
+		if _, err = kldeth.GetBlockNumber(k.rpc); err != nil {
+			return fmt.Errorf("JSON/RPC request to %s failed: %s", k.conf.RPC.URL, err)
+		}
+	}
+	return nil
+}
+
 func (k *KafkaBridge) connect() (err error) {
-	// Connect the client
-	if k.rpc, err = rpc.Dial(k.conf.RPC.URL); err != nil {
-		err = fmt.Errorf("JSON/RPC connection to %s failed: %s", k.conf.RPC.URL, err)
+	// Connect the client, waiting for the node to be ready if configured
+	startupWait := time.Duration(k.conf.Kafka.StartupWait) * time.Second
+	if err = kldutils.RetryUntil("JSON/RPC node", startupWait, k.dialRPC); err != nil {
 		return
 	}
-	k.processor.Init(k.rpc, k.conf.MaxTXWaitTime)
+	instrumentedRPC := kldeth.NewInstrumentedRPC(k.reconnectingRPC("JSON/RPC node", k.conf.RPC.URL, k.rpc), k.rpcLatency)
+	k.processor.Init(instrumentedRPC, k.conf.MaxTXWaitTime)
 	log.Debug("JSON/RPC connected. URL=", k.conf.RPC.URL)
 
+	if err = k.detectChainID(instrumentedRPC); err != nil {
+		return
+	}
+	for name := range k.conf.Chains {
+		if err = k.connectChain(name, startupWait); err != nil {
+			return
+		}
+	}
+	var gasPricing string
+	if k.conf.DetectGasPricing {
+		if gasPricing, err = k.processor.DetectGasPricing(); err != nil {
+			return
+		}
+	}
+	k.setConnected(instrumentedRPC, gasPricing)
 	return
 }
 
+// connectChain connects to the node for one of the additional chains, checks
+// it is on the chain ID we expect if configured, and adds it to the processor
+func (k *KafkaBridge) connectChain(name string, startupWait time.Duration) error {
+	chain := k.conf.Chains[name]
+	var client *rpc.Client
+	err := kldutils.RetryUntil("JSON/RPC node for chain "+name, startupWait, func() (err error) {
+		if client, err = k.dialNode(chain.URL); err != nil {
+			return fmt.Errorf("JSON/RPC connection to %s for chain '%s' failed: %s", chain.URL, name, err)
+		}
+		if startupWait > 0 {
+			if _, err = kldeth.GetBlockNumber(client); err != nil {
+				return fmt.Errorf("JSON/RPC request to %s for chain '%s' failed: %s", chain.URL, name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	instrumentedRPC := kldeth.NewInstrumentedRPC(k.reconnectingRPC("JSON/RPC node for chain "+name, chain.URL, client), k.rpcLatency)
+	if chain.ExpectedChainID != 0 {
+		chainID, err := kldeth.GetChainID(instrumentedRPC)
+		if err != nil {
+			return fmt.Errorf("Unable to verify chain ID %d of node for chain '%s': %s", chain.ExpectedChainID, name, err)
+		}
+		if !chainID.IsInt64() || chainID.Int64() != chain.ExpectedChainID {
+			return fmt.Errorf("Node for chain '%s' is on chain ID %s, but chain ID %d is expected", name, chainID.Text(10), chain.ExpectedChainID)
+		}
+	}
+	log.Infof("JSON/RPC connected for chain '%s'. URL=%s", name, chain.URL)
+	return k.processor.InitChain(name, instrumentedRPC)
+}
+
+// validateChains adds the chains configured on the command line, and checks each has a URL
+func (k *KafkaBridge) validateChains() error {
+	for name, url := range k.chainURLs {
+		if k.conf.Chains == nil {
+			k.conf.Chains = make(map[string]*ChainConf)
+		}
+		if chain, exists := k.conf.Chains[name]; exists {
+			chain.URL = url
+		} else {
+			k.conf.Chains[name] = &ChainConf{URL: url}
+		}
+	}
+	for name, chain := range k.conf.Chains {
+		if name == "" {
+			return fmt.Errorf("Chain names must not be empty")
+		}
+		if chain == nil || chain.URL == "" {
+			return fmt.Errorf("No JSON/RPC URL set for chain '%s'", name)
+		}
+	}
+	return nil
+}
+
+// metricsMsgType limits the msgType label of our metrics to the request types
+// the processor has a handler registered for, so unexpected values from clients
+// cannot create unlimited series
+func (k *KafkaBridge) metricsMsgType(msgType string) string {
+	if k.processor.HasHandler(msgType) {
+		return msgType
+	}
+	return "other"
+}
+
+// metricsErrorReasons classifies common node errors for the reason label
+// of the error metric, by a lower case substring of the error message
+var metricsErrorReasons = []struct {
+	substring string
+	reason    string
+}{
+	{"nonce too low", "NONCE_TOO_LOW"},
+	{"nonce too high", "NONCE_TOO_HIGH"},
+	{"insufficient funds", "INSUFFICIENT_FUNDS"},
+	{"underpriced", "UNDERPRICED"},
+	{"intrinsic gas too low", "INTRINSIC_GAS_TOO_LOW"},
+	{"exceeds block gas limit", "GAS_LIMIT_EXCEEDED"},
+	{"already known", "ALREADY_KNOWN"},
+	{"known transaction", "ALREADY_KNOWN"},
+	{"reverted", "REVERTED"},
+	{"timed out", "TIMEOUT"},
+}
+
+// metricsErrorReason returns the reason label for an error reply, which is
+// "other" for any error we do not classify
+func metricsErrorReason(replyMessage kldmessages.ReplyWithHeaders) string {
+	errMsg, ok := replyMessage.(*kldmessages.ErrorReply)
+	if !ok {
+		return "other"
+	}
+	if errMsg.Revert != nil {
+		return "REVERTED"
+	}
+	lowerMsg := strings.ToLower(errMsg.ErrorMessage)
+	for _, r := range metricsErrorReasons {
+		if strings.Contains(lowerMsg, r.substring) {
+			return r.reason
+		}
+	}
+	return "other"
+}
+
+// countReply updates the message metrics for a reply that is about to be sent
+func (k *KafkaBridge) countReply(c *msgContext) {
+	msgType := k.metricsMsgType(c.requestCommon.Headers.MsgType)
+	k.msgsTotal.WithLabels(msgType, c.replyType).Inc()
+	if c.replyType == kldmessages.MsgTypeError {
+		code := "unknown"
+		if c.errorStatus > 0 {
+			code = strconv.Itoa(c.errorStatus)
+		}
+		k.msgErrors.WithLabels(msgType, code, metricsErrorReason(c.replyMessage)).Inc()
+	}
+}
+
+// metricsHandler serves our metrics in the Prometheus text format
+func (k *KafkaBridge) metricsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	err := k.rpcLatency.WritePrometheus(res)
+	if err == nil {
+		err = k.droppedTXs.WritePrometheus(res)
+	}
+	if err == nil {
+		err = k.msgsTotal.WritePrometheus(res)
+	}
+	if err == nil {
+		err = k.msgErrors.WritePrometheus(res)
+	}
+	if err == nil {
+		err = k.kafka.ConsumerErrors().WritePrometheus(res)
+	}
+	if err == nil {
+		err = k.pause.writePrometheus(res)
+	}
+	if err != nil {
+		log.Errorf("Failed to write metrics: %s", err)
+	}
+}
+
+// adminLogLevelHandler accepts PUT requests to change the log level at runtime
+func (k *KafkaBridge) adminLogLevelHandler() http.HandlerFunc {
+	setLevel := kldutils.LogLevelHandler(k.conf.AdminToken)
+	return func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != "PUT" {
+			res.Header().Set("Allow", "PUT")
+			res.WriteHeader(405)
+			return
+		}
+		setLevel(res, req)
+	}
+}
+
+// startMetricsServer listens for Prometheus scrapes, if a metrics port is configured
+func (k *KafkaBridge) startMetricsServer() {
+	if k.conf.Metrics.Port <= 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", k.metricsHandler)
+	mux.HandleFunc("/readyz", k.readyzHandler)
+	if k.conf.AdminToken != "" {
+		mux.Handle("/admin/loglevel", k.adminLogLevelHandler())
+		mux.HandleFunc(adminNoncesPath, k.adminNonceResetHandler)
+		mux.HandleFunc(adminAssignmentPath, k.adminAssignmentHandler)
+		mux.HandleFunc(adminPausePath, k.adminPauseHandler)
+		mux.HandleFunc(adminResumePath, k.adminResumeHandler)
+	}
+	k.metricsSrv = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", k.conf.Metrics.LocalAddr, k.conf.Metrics.Port),
+		Handler: mux,
+	}
+	go func(srv *http.Server) {
+		log.Infof("Metrics listening on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics listening ended with: %s", err)
+		}
+	}(k.metricsSrv)
+}
+
+// ChainID returns the chain ID detected from the node at startup, or nil if unknown
+func (k *KafkaBridge) ChainID() *big.Int {
+	return k.chainID
+}
+
+// detectChainID queries and caches the chain ID of the node, and checks it
+// is the one we expect if configured. Nodes that do not support eth_chainId
+// are only an error if we have been told to check.
+func (k *KafkaBridge) detectChainID(rpc kldeth.RPCClient) (err error) {
+	expected := k.conf.RPC.ExpectedChainID
+	if k.chainID, err = kldeth.GetChainID(rpc); err != nil {
+		if expected != 0 {
+			return fmt.Errorf("Unable to verify chain ID %d of node: %s", expected, err)
+		}
+		log.Warnf("Unable to detect chain ID of node: %s", err)
+		return nil
+	}
+	log.Infof("Connected to chain ID %s", k.chainID.Text(10))
+	if expected != 0 && (!k.chainID.IsInt64() || k.chainID.Int64() != expected) {
+		return fmt.Errorf("Node is on chain ID %s, but chain ID %d is expected", k.chainID.Text(10), expected)
+	}
+	return nil
+}
+
+// reloadOnSIGHUP reloads the transaction templates, request schema and Avro reply
+// schemas each time the process receives a SIGHUP, until the returned function is called
+func (k *KafkaBridge) reloadOnSIGHUP() func() {
+	if k.conf.TxTemplatesFile == "" && k.conf.RequestSchemaFile == "" && k.schemaRegistry == nil {
+		return func() {}
+	}
+	hup := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				log.Infof("Received SIGHUP - reloading transaction templates and request schemas")
+				k.txTemplates.reload()
+				k.requestSchema.reload()
+				if k.schemaRegistry != nil {
+					k.schemaRegistry.reload()
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(hup)
+		close(done)
+	}
+}
+
 // Start kicks off the bridge
 func (k *KafkaBridge) Start() (err error) {
 
@@ -421,7 +2049,18 @@ func (k *KafkaBridge) Start() (err error) {
 		return
 	}
 
+	k.startMetricsServer()
+	stopReload := k.reloadOnSIGHUP()
+
 	// Defer to KafkaCommon processing
 	err = k.kafka.Start()
+
+	stopReload()
+
+	if k.metricsSrv != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		k.metricsSrv.Shutdown(ctx)
+	}
 	return
 }
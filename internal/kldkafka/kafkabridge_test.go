@@ -15,16 +15,25 @@
 package kldkafka
 
 import (
+	"bytes"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
@@ -70,20 +79,54 @@ func (k *testKafkaCommon) Producer() KafkaProducer {
 	return nil
 }
 
+func (k *testKafkaCommon) ConsumerErrors() *kldmetrics.CounterVec {
+	return newConsumerErrorsCounter()
+}
+
+func (k *testKafkaCommon) Assignment() *ConsumerAssignment {
+	return newConsumerAssignment().get()
+}
+
 type testKafkaMsgProcessor struct {
 	messages chan MsgContext
 	rpc      kldeth.RPCClient
+	handlers map[string]MsgHandler
 }
 
 func (p *testKafkaMsgProcessor) Init(rpc kldeth.RPCClient, maxTXWaitTime int) {
 	p.rpc = rpc
 }
 
+func (p *testKafkaMsgProcessor) InitChain(name string, rpc kldeth.RPCClient) error {
+	return nil
+}
+
+func (p *testKafkaMsgProcessor) ResetNonce(account, chain string) (int, error) {
+	return 0, nil
+}
+
+func (p *testKafkaMsgProcessor) DetectGasPricing() (string, error) {
+	return GasPricingFree, nil
+}
+
 func (p *testKafkaMsgProcessor) OnMessage(msg MsgContext) {
 	log.Infof("Dispatched message context to processor: %s", msg)
 	p.messages <- msg
 	return
 }
+
+func (p *testKafkaMsgProcessor) RegisterHandler(msgType string, handler MsgHandler) {
+	if p.handlers == nil {
+		p.handlers = make(map[string]MsgHandler)
+	}
+	p.handlers[msgType] = handler
+}
+
+func (p *testKafkaMsgProcessor) HasHandler(msgType string) bool {
+	_, exists := p.handlers[msgType]
+	return exists
+}
+
 func TestNewKafkaBridge(t *testing.T) {
 	assert := assert.New(t)
 
@@ -109,6 +152,14 @@ func newTestKafkaBridge() (k *KafkaBridge, kafkaCmd *cobra.Command) {
 	kafkaCmd = k.CobraInit()
 	return k, kafkaCmd
 }
+func TestRegisterHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.RegisterHandler("Custom", func(msgContext MsgContext) error { return nil })
+	assert.Contains(k.processor.(*testKafkaMsgProcessor).handlers, "Custom")
+}
+
 func TestExecuteBridgeWithIncompleteArgs(t *testing.T) {
 	assert := assert.New(t)
 
@@ -127,6 +178,328 @@ func TestExecuteBridgeWithIncompleteArgs(t *testing.T) {
 	assert.Equal(10, k.conf.MaxTXWaitTime)
 }
 
+func TestExecuteBridgeWithBadStaticGasPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--gas-price", "-1"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Equal("Static gas price '-1' must be a non-negative integer (wei)", err.Error())
+}
+
+func TestExecuteBridgeWithBadContractCodeTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--contract-code-ttl", "-1"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Equal("Contract code cache TTL -1 must not be negative", err.Error())
+}
+
+func TestExecuteBridgeWithTxPoolLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--txpool-max-pending", "5000", "--txpool-max-queued", "1000"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal(5000, k.conf.TxPool.MaxPending)
+	assert.Equal(1000, k.conf.TxPool.MaxQueued)
+	assert.Equal(1000, k.conf.TxPool.CacheTTL)
+}
+
+func TestExecuteBridgeWithBadTxPoolLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, []string{"--txpool-max-queued", "-1"}...))
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Transaction pool limits must not be negative")
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, []string{"--txpool-cache-ttl", "-1"}...))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "Transaction pool cache TTL -1 must not be negative")
+}
+
+func TestExecuteBridgeWithBadReadyzCacheTTL(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--readyz-cache-ttl", "-1"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Equal("Readiness cache TTL -1 must not be negative", err.Error())
+}
+
+func TestExecuteBridgeWithBadGasLimits(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--min-gas", "2000", "--max-gas", "1000"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Equal("Minimum gas limit 2000 is greater than the maximum gas limit 1000", err.Error())
+}
+
+func TestExecuteBridgeWithBadDefaultGas(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--default-gas", "-1"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Default gas -1 must not be negative")
+}
+
+func TestExecuteBridgeWithMethodGas(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--method-gas", "F8A8FD6D=50000", "--method-gas", "0x60fe47b1=30000"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal(map[string]int{"0xf8a8fd6d": 50000, "0x60fe47b1": 30000}, k.conf.MethodGas)
+}
+
+func TestExecuteBridgeWithGasFactors(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{
+		"--gas-estimation-factor", "1.2",
+		"--contract-gas-factor", "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832=1.5",
+	}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal(map[string]float64{"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832": 1.5}, k.conf.ContractGasFactors)
+	assert.Equal(1.2, k.gasFactors.global)
+	assert.Equal(1.5, k.gasFactors.byAddress[common.HexToAddress("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832")])
+}
+
+func TestExecuteBridgeWithBadGasFactors(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"--gas-estimation-factor", "0.8"}, "Gas estimation factor 0.8 must not be less than 1"},
+		{[]string{"--contract-gas-factor", "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832=lots"}, "Gas estimation factor 'lots' for contract 0x2b8c0ECc76d0759a8F50b2E14A6881367D805832 must be a number"},
+	} {
+		_, kafkaCmd := newTestKafkaBridge()
+		kafkaCmd.SetArgs(append(kbMinWorkingArgs, test.args...))
+		err := kafkaCmd.Execute()
+		assert.EqualError(err, test.expected)
+	}
+}
+
+func TestExecuteBridgeWithBadMethodGas(t *testing.T) {
+	assert := assert.New(t)
+
+	for args, expected := range map[string]string{
+		"0xf8a8fd=50000":   "Method selector '0xf8a8fd' must be 4 bytes of hex",
+		"transfer=50000":   "Method selector 'transfer' must be 4 bytes of hex",
+		"0xf8a8fd6d=0":     "Gas 0 for method 0xf8a8fd6d must be positive",
+		"0xf8a8fd6d=-1000": "Gas -1000 for method 0xf8a8fd6d must be positive",
+	} {
+		_, kafkaCmd := newTestKafkaBridge()
+		kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--method-gas", args))
+		err := kafkaCmd.Execute()
+		assert.EqualError(err, expected)
+	}
+}
+
+func TestExecuteBridgeWithSubmitRate(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--submit-rate", "2.5"))
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal(2.5, k.conf.SubmitRate)
+	assert.Equal(1, k.conf.SubmitBurst)
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--submit-rate", "-1"))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "Submit rate and burst must not be negative")
+}
+
+func TestExecuteBridgeWithReceiptPollInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--receipt-poll-interval", "500", "--receipt-batch-size", "20"))
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal(500, k.conf.ReceiptPollInterval)
+	assert.Equal(20, k.conf.ReceiptBatchSize)
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--receipt-batch-size", "-1"))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "Receipt poll interval and batch size must not be negative")
+}
+
+func TestExecuteBridgeWithRPCReconnectWait(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	err := kafkaCmd.ParseFlags([]string{"--rpc-reconnect-wait", "60"})
+	assert.NoError(err)
+	assert.Equal(60, k.conf.RPC.ReconnectWait)
+	client, _ := rpc.Dial("http://localhost:8545")
+	_, isBatch := k.reconnectingRPC("JSON/RPC node", "http://localhost:8545", client).(kldeth.BatchRPCClient)
+	assert.True(isBatch)
+
+	k.conf.RPC.ReconnectWait = 0
+	assert.Equal(client, k.reconnectingRPC("JSON/RPC node", "http://localhost:8545", client))
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--rpc-reconnect-wait", "-1"))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "JSON/RPC reconnect wait -1 must not be negative")
+}
+
+func TestExecuteBridgeWithNegativeMaxInFlightBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--maxinflight-bytes", "-1"))
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Maximum in-flight bytes -1 must not be negative")
+}
+
+func TestExecuteBridgeWithBadMaxConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--max-confirmations", "-1"))
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Maximum confirmations -1 must not be negative")
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--confirmations", "6", "--max-confirmations", "3"))
+	err = kafkaCmd.Execute()
+	assert.EqualError(err, "Maximum confirmations 3 must not be below the default confirmations 6")
+}
+
+func TestExecuteBridgeWithNonceRefreshAccounts(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--nonce-refresh-account", "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"))
+	kafkaCmd.Execute()
+	assert.Equal([]string{"0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"}, k.conf.NonceRefreshAccounts)
+
+	_, kafkaCmd = newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--nonce-refresh-account", "bad"))
+	err := kafkaCmd.Execute()
+	assert.Regexp("Supplied value for 'nonce refresh account' is not a valid hex address", err.Error())
+}
+
+func TestExecuteBridgeWithBadErrorTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--error-topic-out", "errors/topic"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Invalid error topic 'errors/topic'")
+}
+
+func TestExecuteBridgeWithBadOversizeReplies(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--oversize-replies", "badness"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Invalid oversize replies strategy 'badness'", err.Error())
+}
+
+func TestExecuteBridgeWithBadReplyFieldNaming(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--reply-field-naming", "kebab-case"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Invalid reply field naming 'kebab-case'", err.Error())
+}
+
+func TestExecuteBridgeWithBadStatusFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--status-format", "hex"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Invalid status format 'hex' (must be 'numeric', 'bool' or 'both')")
+}
+
+func TestExecuteBridgeWithBadReplyEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--reply-envelope", "xml"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Equal("Invalid reply envelope 'xml' (must be 'native' or 'cloudevents')", err.Error())
+}
+
+func TestExecuteBridgeWithBadTxTemplates(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--tx-templates", "/does/not/exist"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Failed to read transaction templates from /does/not/exist", err.Error())
+}
+
+func TestExecuteBridgeWithBadRequestSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--request-schema", "/does/not/exist"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Failed to read request schema from /does/not/exist", err.Error())
+}
+
+func TestExecuteBridgeWithBadLocalSigner(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--local-signer", testFromAddr + "=/does/not/exist"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.Regexp("Failed to load signing key from /does/not/exist", err.Error())
+}
+
 func TestExecuteBridgeWithIncompleteKafkaArgs(t *testing.T) {
 	assert := assert.New(t)
 
@@ -191,49 +564,333 @@ func TestExecuteWithBadRPCURL(t *testing.T) {
 
 }
 
-func setupMocks() (*KafkaBridge, *testKafkaMsgProcessor, *MockKafkaConsumer, *MockKafkaProducer, *sync.WaitGroup) {
+func TestExecuteWithUnavailableRPCStartupWait(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(503)
+	}))
+	defer svr.Close()
+
 	k, _ := newTestKafkaBridge()
-	k.conf.MaxInFlight = 10
-	f := NewMockKafkaFactory()
-	mockConsumer, _ := f.NewConsumer(k.kafka)
-	mockProducer, _ := f.NewProducer(k.kafka)
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	go k.ConsumerMessagesLoop(mockConsumer, mockProducer, wg)
-	go k.ProducerSuccessLoop(mockConsumer, mockProducer, wg)
-	processor := k.processor.(*testKafkaMsgProcessor)
-	return k, processor, mockConsumer.(*MockKafkaConsumer), mockProducer.(*MockKafkaProducer), wg
+	k.conf.RPC.URL = svr.URL
+	k.conf.Kafka.StartupWait = 1
+	err := k.connect()
+
+	assert.Regexp("JSON/RPC node not ready after 1s: JSON/RPC request to .* failed", err.Error())
 }
 
-func TestSingleMessageWithReply(t *testing.T) {
+func TestExecuteBridgeWithChains(t *testing.T) {
 	assert := assert.New(t)
 
-	_, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--chain", "chain2=https://chain2.example.com"}...)
 
-	// Send a minimal test message
-	msg1 := kldmessages.RequestCommon{}
-	msg1.Headers.MsgType = "TestSingleMessageWithReply"
-	msg1Ctx := struct {
-		Some string `json:"some"`
-	}{
-		Some: "data",
-	}
-	msg1.Headers.Context = &msg1Ctx
-	msg1.Headers.Account = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
-	msg1bytes, err := json.Marshal(&msg1)
-	log.Infof("Sent message: %s", string(msg1bytes))
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.NoError(err)
+	assert.Equal("https://chain2.example.com", k.conf.Chains["chain2"].URL)
+}
 
-	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
-		Topic:     "in-topic",
-		Partition: 5,
-		Offset:    500,
-		Value:     msg1bytes,
-	}
+func TestExecuteBridgeWithChainNoURL(t *testing.T) {
+	assert := assert.New(t)
 
-	// Get the message via the processor
-	msgContext1 := <-processor.messages
-	assert.NotEmpty(msgContext1.Headers().ID) // Generated one as not supplied
-	assert.Equal(msg1.Headers.MsgType, msgContext1.Headers().MsgType)
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--chain", "chain2="}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "No JSON/RPC URL set for chain 'chain2'")
+}
+
+func TestConnectChainIDMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var rpcReq struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(req.Body).Decode(&rpcReq)
+		res.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(res, `{"jsonrpc":"2.0","id":%s,"result":"0xd431"}`, rpcReq.ID)
+	}))
+	defer svr.Close()
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Chains = map[string]*ChainConf{"chain2": {URL: svr.URL, ExpectedChainID: 12345}}
+	err := k.connectChain("chain2", 0)
+	assert.EqualError(err, "Node for chain 'chain2' is on chain ID 54321, but chain ID 12345 is expected")
+
+	k.conf.Chains["chain2"].ExpectedChainID = 54321
+	err = k.connectChain("chain2", 0)
+	assert.NoError(err)
+}
+
+func TestConnectChainRPCTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	svr := httptest.NewTLSServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		var rpcReq struct {
+			ID json.RawMessage `json:"id"`
+		}
+		json.NewDecoder(req.Body).Decode(&rpcReq)
+		res.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(res, `{"jsonrpc":"2.0","id":%s,"result":"0xd431"}`, rpcReq.ID)
+	}))
+	defer svr.Close()
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Chains = map[string]*ChainConf{"chain2": {URL: svr.URL, ExpectedChainID: 54321}}
+	err := k.connectChain("chain2", 0)
+	assert.Regexp("certificate", err)
+
+	var rpcHTTPClient *http.Client
+	rpcHTTPClient, err = newRPCHTTPClient(&k.conf.RPC.TLS)
+	assert.NoError(err)
+	assert.Nil(rpcHTTPClient)
+
+	k.conf.RPC.TLS.InsecureSkipVerify = true
+	k.rpcHTTPClient, err = newRPCHTTPClient(&k.conf.RPC.TLS)
+	assert.NoError(err)
+	assert.False(k.conf.RPC.TLS.Enabled)
+	err = k.connectChain("chain2", 0)
+	assert.NoError(err)
+}
+
+func TestExecuteBridgeWithBadRPCTLS(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--rpc-tls-clientcerts", "cert.pem"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "Client private key and certificate must both be provided for mutual auth")
+}
+
+func TestDetectChainID(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.RPC.ExpectedChainID = 12345
+	rpc := &testRPC{}
+	rpc.ethChainIDResult.ToInt().SetInt64(12345)
+	err := k.detectChainID(rpc)
+
+	assert.NoError(err)
+	assert.Equal(int64(12345), k.ChainID().Int64())
+	assert.EqualValues([]string{"eth_chainId"}, rpc.calls)
+}
+
+func TestDetectChainIDMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.RPC.ExpectedChainID = 12345
+	rpc := &testRPC{}
+	rpc.ethChainIDResult.ToInt().SetInt64(54321)
+	err := k.detectChainID(rpc)
+
+	assert.EqualError(err, "Node is on chain ID 54321, but chain ID 12345 is expected")
+}
+
+func TestDetectChainIDUnsupportedNoCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	rpc := &testRPC{ethChainIDErr: fmt.Errorf("pop")}
+	err := k.detectChainID(rpc)
+
+	assert.NoError(err)
+	assert.Nil(k.ChainID())
+}
+
+func TestDetectChainIDUnsupportedWithCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.RPC.ExpectedChainID = 12345
+	rpc := &testRPC{ethChainIDErr: fmt.Errorf("pop")}
+	err := k.detectChainID(rpc)
+
+	assert.EqualError(err, "Unable to verify chain ID 12345 of node: pop")
+}
+
+func TestMetricsHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	rpc := kldeth.NewInstrumentedRPC(&testRPC{}, k.rpcLatency)
+	k.detectChainID(rpc)
+
+	res := httptest.NewRecorder()
+	k.metricsHandler(res, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(200, res.Code)
+	assert.Contains(res.Body.String(), "# TYPE ethconnect_rpc_call_duration_seconds histogram\n")
+	assert.Contains(res.Body.String(), "ethconnect_rpc_call_duration_seconds_count{method=\"eth_chainId\"} 1\n")
+	assert.Contains(res.Body.String(), "ethconnect_transactions_dropped_total 0\n")
+}
+
+func TestMessageMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	processor.RegisterHandler(kldmessages.MsgTypeSendTransaction, func(MsgContext) error { return nil })
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = kldmessages.MsgTypeSendTransaction
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes, Offset: 1}
+	msgContext1 := <-processor.messages
+	go msgContext1.SendErrorReply(500, fmt.Errorf("nonce too low"))
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	msg2 := kldmessages.RequestCommon{}
+	msg2.Headers.MsgType = "SomethingElse"
+	msg2bytes, _ := json.Marshal(&msg2)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg2bytes, Offset: 2}
+	msgContext2 := <-processor.messages
+	receipt := &kldmessages.TransactionReceipt{}
+	receipt.Headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+	go msgContext2.Reply(receipt)
+	replyKafkaMsg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	res := httptest.NewRecorder()
+	k.metricsHandler(res, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(res.Body.String(), "ethconnect_messages_total{msgType=\"SendTransaction\",replyType=\"Error\"} 1\n")
+	assert.Contains(res.Body.String(), "ethconnect_messages_total{msgType=\"other\",replyType=\"TransactionSuccess\"} 1\n")
+	assert.Contains(res.Body.String(), "ethconnect_message_errors_total{msgType=\"SendTransaction\",code=\"500\",reason=\"NONCE_TOO_LOW\"} 1\n")
+}
+
+func TestMetricsMsgType(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	k := NewKafkaBridge(&printYAML)
+	k.processor.RegisterHandler("Custom", func(MsgContext) error { return nil })
+
+	assert.Equal(kldmessages.MsgTypeTraceTransaction, k.metricsMsgType(kldmessages.MsgTypeTraceTransaction))
+	assert.Equal(kldmessages.MsgTypeSimulateTransaction, k.metricsMsgType(kldmessages.MsgTypeSimulateTransaction))
+	assert.Equal("Custom", k.metricsMsgType("Custom"))
+	assert.Equal("other", k.metricsMsgType("SomethingElse"))
+}
+
+func TestMetricsErrorReason(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("NONCE_TOO_LOW", metricsErrorReason(kldmessages.NewErrorReply(fmt.Errorf("Nonce too low"), []byte{})))
+	assert.Equal("UNDERPRICED", metricsErrorReason(kldmessages.NewErrorReply(fmt.Errorf("replacement transaction underpriced"), []byte{})))
+	assert.Equal("INSUFFICIENT_FUNDS", metricsErrorReason(kldmessages.NewErrorReply(fmt.Errorf("insufficient funds for gas * price + value"), []byte{})))
+	revert := kldmessages.NewErrorReply(fmt.Errorf("pop"), []byte{})
+	revert.Revert = &kldmessages.RevertError{}
+	assert.Equal("REVERTED", metricsErrorReason(revert))
+	assert.Equal("other", metricsErrorReason(kldmessages.NewErrorReply(fmt.Errorf("pop"), []byte{})))
+	assert.Equal("other", metricsErrorReason(&kldmessages.TransactionReceipt{}))
+}
+
+func TestAdminLogLevelHandler(t *testing.T) {
+	assert := assert.New(t)
+	defer log.SetLevel(log.GetLevel())
+
+	k, _ := newTestKafkaBridge()
+	k.conf.AdminToken = "secret"
+
+	res := httptest.NewRecorder()
+	k.adminLogLevelHandler()(res, httptest.NewRequest("GET", "/admin/loglevel", nil))
+	assert.Equal(405, res.Code)
+
+	req := httptest.NewRequest("PUT", "/admin/loglevel", bytes.NewReader([]byte(`{"level":"error"}`)))
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminLogLevelHandler()(res, req)
+	assert.Equal(200, res.Code)
+	assert.Equal(log.ErrorLevel, log.GetLevel())
+}
+
+func setupMocks() (*KafkaBridge, *testKafkaMsgProcessor, *MockKafkaConsumer, *MockKafkaProducer, *sync.WaitGroup) {
+	k, _ := newTestKafkaBridge()
+	return startMocks(k)
+}
+
+// startMocks starts the consumer and producer loops of a bridge against mocks
+func startMocks(k *KafkaBridge) (*KafkaBridge, *testKafkaMsgProcessor, *MockKafkaConsumer, *MockKafkaProducer, *sync.WaitGroup) {
+	k.conf.MaxInFlight = 10
+	f := NewMockKafkaFactory()
+	mockConsumer, _ := f.NewConsumer(k.kafka)
+	mockProducer, _ := f.NewProducer(k.kafka)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go k.ConsumerMessagesLoop(mockConsumer, mockProducer, wg)
+	go k.ProducerSuccessLoop(mockConsumer, mockProducer, wg)
+	processor := k.processor.(*testKafkaMsgProcessor)
+	return k, processor, mockConsumer.(*MockKafkaConsumer), mockProducer.(*MockKafkaProducer), wg
+}
+
+func TestLogPayload(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	ctx := &msgContext{reqOffset: "in-topic:5:500"}
+	payload := []byte(`{"headers":{"type":"SendTransaction"},"privateKey":"secret"}`)
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	defer log.SetLevel(log.GetLevel())
+	log.SetLevel(log.DebugLevel)
+
+	k.logPayload("Request", ctx, payload)
+	assert.Empty(logged.String())
+
+	k.conf.LogFullPayloads = true
+	k.conf.RedactFields = []string{"privateKey"}
+	k.logPayload("Request", ctx, payload)
+	assert.Contains(logged.String(), "Request payload in-topic:5:500")
+	assert.Contains(logged.String(), `\"privateKey\":\"***\"`)
+	assert.NotContains(logged.String(), "secret")
+
+	logged.Reset()
+	log.SetLevel(log.InfoLevel)
+	k.logPayload("Request", ctx, payload)
+	assert.Empty(logged.String())
+}
+
+func TestSingleMessageWithReply(t *testing.T) {
+	assert := assert.New(t)
+
+	_, processor, mockConsumer, mockProducer, wg := setupMocks()
+
+	// Send a minimal test message
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestSingleMessageWithReply"
+	msg1Ctx := struct {
+		Some string `json:"some"`
+	}{
+		Some: "data",
+	}
+	msg1.Headers.Context = &msg1Ctx
+	msg1.Headers.Account = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg1bytes, err := json.Marshal(&msg1)
+	log.Infof("Sent message: %s", string(msg1bytes))
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Topic:     "in-topic",
+		Partition: 5,
+		Offset:    500,
+		Value:     msg1bytes,
+	}
+
+	// Get the message via the processor
+	msgContext1 := <-processor.messages
+	assert.NotEmpty(msgContext1.Headers().ID) // Generated one as not supplied
+	assert.Equal(msg1.Headers.MsgType, msgContext1.Headers().MsgType)
 	assert.Equal("data", msgContext1.Headers().Context.(map[string]interface{})["some"])
 	assert.Equal(len(msgContext1.(*msgContext).replyBytes), msgContext1.(*msgContext).Length())
 	var msgUnmarshaled kldmessages.RequestCommon
@@ -396,74 +1053,1094 @@ func TestMoreMessagesThanMaxInFlight(t *testing.T) {
 
 }
 
-func TestAddInflightMessageBadMessage(t *testing.T) {
+func TestRedeliveryWithinGracePeriod(t *testing.T) {
 	assert := assert.New(t)
 
-	_, _, mockConsumer, mockProducer, wg := setupMocks()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.RedeliveryGracePeriod = 60
 
-	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
-		Value:     []byte("badness"),
-		Partition: 64,
-		Offset:    int64(42),
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestRedeliveryWithinGracePeriod"
+	msg1.Headers.Account = "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"
+	msg1bytes, _ := json.Marshal(&msg1)
+	consumerMsg := &sarama.ConsumerMessage{
+		Topic:     "in-topic",
+		Partition: 5,
+		Offset:    500,
+		Value:     msg1bytes,
 	}
+	mockConsumer.MockMessages <- consumerMsg
 
-	// Drain the producer
-	msg := <-mockProducer.MockInput
-	mockProducer.MockSuccesses <- msg
+	// Reply to the first delivery
+	msgContext1 := <-processor.messages
+	go func() {
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	// Wait for the reply to be confirmed, so the redelivery is not treated
+	// as a duplicate of the message still in-flight
+	for completed := false; !completed; {
+		k.inFlightCond.L.Lock()
+		_, completed = k.completed["in-topic:5:500"]
+		k.inFlightCond.L.Unlock()
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Redeliver the same offset - the processor must not see it,
+	// and we get the same reply again
+	mockConsumer.MockMessages <- consumerMsg
+	var redeliveryKafkaMsg *sarama.ProducerMessage
+	select {
+	case redeliveryKafkaMsg = <-mockProducer.MockInput:
+	case <-time.After(5 * time.Second):
+		assert.FailNow("No reply to the redelivered message")
+	}
+	redeliveryBytes, _ := redeliveryKafkaMsg.Value.Encode()
+	mockProducer.MockSuccesses <- redeliveryKafkaMsg
+	assert.Equal(replyBytes, redeliveryBytes)
+	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", string(redeliveryKafkaMsg.Key.(sarama.StringEncoder)))
 
 	// Shut down
 	mockProducer.AsyncClose()
 	mockConsumer.Close()
 	wg.Wait()
 
-	// Check we acknowledge all offsets
-	assert.Equal(int64(42), mockConsumer.OffsetsByPartition[64])
-
+	assert.Equal(int64(500), mockConsumer.OffsetsByPartition[5])
+	assert.Equal(0, len(processor.messages))
+	assert.Equal(1, len(k.completed))
 }
 
-func TestProducerErrorLoopPanics(t *testing.T) {
+func TestHeldOffsetReleasedAfterReply(t *testing.T) {
 	assert := assert.New(t)
 
-	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
 
-	wg.Add(2)
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestHeldOffsetReleasedAfterReply"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 3, Offset: 300, Value: msg1bytes}
+
+	msgContext1 := <-processor.messages
+	msgContext1.HoldOffset()
 	go func() {
-		mockProducer.MockErrors <- &sarama.ProducerError{
-			Err: fmt.Errorf("pop"),
-			Msg: &sarama.ProducerMessage{},
-		}
-		wg.Done()
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
 	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
 
-	assert.Panics(func() {
-		k.ProducerErrorLoop(nil, mockProducer, wg)
-	})
+	// Wait for the reply to be confirmed, which must not commit the offset
+	for replied := false; !replied; {
+		k.inFlightCond.L.Lock()
+		replied = msgContext1.(*msgContext).heldConsumer != nil
+		k.inFlightCond.L.Unlock()
+		time.Sleep(1 * time.Millisecond)
+	}
+	k.inFlightCond.L.Lock()
+	_, committed := mockConsumer.OffsetsByPartition[3]
+	assert.False(committed)
+	assert.Equal(1, len(k.inFlight))
+	k.inFlightCond.L.Unlock()
+
+	msgContext1.ReleaseOffset()
+	k.inFlightCond.L.Lock()
+	assert.Equal(int64(300), mockConsumer.OffsetsByPartition[3])
+	assert.Equal(0, len(k.inFlight))
+	k.inFlightCond.L.Unlock()
 
 	mockProducer.AsyncClose()
 	mockConsumer.Close()
 	wg.Wait()
-
 }
 
-func TestProducerSuccessLoopPanicsMsgNotInflight(t *testing.T) {
+func TestHeldOffsetReleasedBeforeReply(t *testing.T) {
 	assert := assert.New(t)
 
-	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
 
-	wg.Add(2)
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestHeldOffsetReleasedBeforeReply"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 3, Offset: 301, Value: msg1bytes}
+
+	msgContext1 := <-processor.messages
+	msgContext1.HoldOffset()
+	msgContext1.ReleaseOffset()
 	go func() {
-		mockProducer.MockSuccesses <- &sarama.ProducerMessage{
-			Metadata: "badness",
-		}
-		wg.Done()
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
 	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
 
-	assert.Panics(func() {
-		k.ProducerSuccessLoop(nil, mockProducer, wg)
-	})
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(301), mockConsumer.OffsetsByPartition[3])
+	assert.Equal(0, len(k.inFlight))
+}
+
+func TestCompletedExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.RedeliveryGracePeriod = 1
+	ctx1 := &msgContext{reqOffset: "t:0:1"}
+	ctx2 := &msgContext{reqOffset: "t:0:2"}
+	k.addCompleted(ctx1)
+	k.addCompleted(ctx2)
+	k.completedLRU[0].expiry = time.Now().Add(-1 * time.Second)
+	k.expireCompleted()
+	assert.Equal(1, len(k.completed))
+	assert.Equal(1, len(k.completedLRU))
+	assert.NotNil(k.completed["t:0:2"])
+
+	k.conf.RedeliveryGracePeriod = 0
+	k.addCompleted(&msgContext{reqOffset: "t:0:3"})
+	assert.Equal(1, len(k.completed))
+}
+
+func TestUnknownTenantRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.Tenants = []string{"tenant1"}
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestUnknownTenantRejected"
+	msg1.Headers.Tenant = "tenant2"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Equal("Unknown tenant 'tenant2'", errorReply.ErrorMessage)
+	assert.Equal("tenant2", errorReply.Headers.Tenant)
 
 	mockProducer.AsyncClose()
 	mockConsumer.Close()
 	wg.Wait()
+}
 
+func TestExpiredMessageRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.MaxMessageAge = 60
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestExpiredMessageRejected"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Partition: 2,
+		Offset:    20,
+		Value:     msg1bytes,
+		Timestamp: time.Now().Add(-2 * time.Minute),
+	}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Regexp("Message expired - sent 1[12][0-9]s ago, which exceeds the maximum message age of 60s", errorReply.ErrorMessage)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(20), mockConsumer.OffsetsByPartition[2])
+	assert.Equal(0, len(processor.messages))
+}
+
+func TestRequestSchemaRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	file := writeTestRequestSchema(testRequestSchemaYAML)
+	defer os.Remove(file)
+	assert.NoError(k.requestSchema.load(file))
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "SendTransaction"
+	msg1.Headers.ID = "request1"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Equal("Request failed schema validation: $.from: is required", errorReply.ErrorMessage)
+	assert.Equal("request1", errorReply.Headers.ReqID)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(0, len(processor.messages))
+}
+
+func TestCheckMessageAge(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	headers := &kldmessages.CommonHeaders{}
+	oldMsg := &sarama.ConsumerMessage{Timestamp: time.Now().Add(-2 * time.Minute)}
+
+	// Disabled by default
+	assert.NoError(k.checkMessageAge(headers, oldMsg))
+
+	k.conf.MaxMessageAge = 60
+	assert.Regexp("Message expired", k.checkMessageAge(headers, oldMsg).Error())
+	assert.NoError(k.checkMessageAge(headers, &sarama.ConsumerMessage{Timestamp: time.Now()}))
+
+	// No Kafka timestamp, on brokers before 0.10
+	assert.NoError(k.checkMessageAge(headers, &sarama.ConsumerMessage{}))
+
+	// The timestamp in the headers takes precedence
+	headers.Timestamp = time.Now().Format(time.RFC3339)
+	assert.NoError(k.checkMessageAge(headers, oldMsg))
+	headers.Timestamp = time.Now().Add(-1 * time.Hour).Format(time.RFC3339)
+	assert.Regexp("Message expired", k.checkMessageAge(headers, &sarama.ConsumerMessage{}).Error())
+	headers.Timestamp = "yesterday"
+	assert.EqualError(k.checkMessageAge(headers, oldMsg), "Invalid 'timestamp' in headers (must be RFC3339): yesterday")
+}
+
+func TestMaxInFlightPerTenant(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.Tenants = []string{"tenant1", "tenant2"}
+	k.conf.MaxInFlightPerTenant = 1
+
+	go func() {
+		for i, tenant := range []string{"tenant1", "tenant1", "tenant2"} {
+			msg := kldmessages.RequestCommon{}
+			msg.Headers.MsgType = "TestMaxInFlightPerTenant"
+			msg.Headers.ID = fmt.Sprintf("msg%d", i)
+			msg.Headers.Tenant = tenant
+			msgBytes, _ := json.Marshal(&msg)
+			mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msgBytes, Partition: 0, Offset: int64(i)}
+		}
+	}()
+
+	// The second message for tenant1 is rejected, without holding up tenant2
+	msgContext0 := <-processor.messages
+	assert.Equal("msg0", msgContext0.Headers().ID)
+	rejectMsg := <-mockProducer.MockInput
+	rejectBytes, _ := rejectMsg.Value.Encode()
+	mockProducer.MockSuccesses <- rejectMsg
+	var reply kldmessages.ErrorReply
+	json.Unmarshal(rejectBytes, &reply)
+	assert.Equal("Too many messages in-flight for tenant 'tenant1' (maximum 1)", reply.ErrorMessage)
+	assert.Equal("msg1", reply.Headers.ReqID)
+	assert.Equal("tenant1", reply.Headers.Tenant)
+	assert.Equal(429, rejectMsg.Value.(*msgContext).errorStatus)
+	msgContext2 := <-processor.messages
+	assert.Equal("msg2", msgContext2.Headers().ID)
+	k.inFlightCond.L.Lock()
+	assert.Equal(1, k.inFlightByTenant["tenant1"])
+	assert.Equal(1, k.inFlightByTenant["tenant2"])
+	k.inFlightCond.L.Unlock()
+
+	for _, msgContext := range []MsgContext{msgContext0, msgContext2} {
+		go msgContext.Reply(&kldmessages.ReplyCommon{})
+		msg := <-mockProducer.MockInput
+		mockProducer.MockSuccesses <- msg
+	}
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+	assert.Equal(int64(2), mockConsumer.OffsetsByPartition[0])
+	assert.Empty(k.inFlightByTenant)
+}
+
+func TestMaxInFlightBytes(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	var msgs [][]byte
+	for i := 0; i < 2; i++ {
+		msg := kldmessages.RequestCommon{}
+		msg.Headers.MsgType = "TestMaxInFlightBytes"
+		msg.Headers.ID = fmt.Sprintf("msg%d", i)
+		msgBytes, _ := json.Marshal(&msg)
+		msgs = append(msgs, msgBytes)
+	}
+	k.conf.MaxInFlightBytes = len(msgs[0]) + 1
+
+	go func() {
+		for i, msgBytes := range msgs {
+			mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msgBytes, Partition: 0, Offset: int64(i)}
+		}
+	}()
+
+	// The second message must wait for the first to complete, as together they exceed the budget
+	msgContext0 := <-processor.messages
+	assert.Equal("msg0", msgContext0.Headers().ID)
+	select {
+	case <-processor.messages:
+		assert.Fail("Second message admitted over the byte budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	k.inFlightCond.L.Lock()
+	assert.Equal(len(msgs[0]), k.inFlightBytes)
+	k.inFlightCond.L.Unlock()
+
+	go func() {
+		msgContext0.Reply(&kldmessages.ReplyCommon{})
+	}()
+	msg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- msg
+
+	msgContext1 := <-processor.messages
+	assert.Equal("msg1", msgContext1.Headers().ID)
+	k.inFlightCond.L.Lock()
+	assert.Equal(len(msgs[1]), k.inFlightBytes)
+	k.inFlightCond.L.Unlock()
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestInFlightBytesExceeded(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	msg := &sarama.ConsumerMessage{Value: []byte("0123456789")}
+	assert.False(k.inFlightBytesExceeded(msg))
+
+	// A message larger than the budget is admitted when nothing else is in-flight
+	k.conf.MaxInFlightBytes = 5
+	assert.False(k.inFlightBytesExceeded(msg))
+	k.inFlight["topic:0:0"] = &msgContext{size: 1}
+	k.inFlightBytes = 1
+	assert.True(k.inFlightBytesExceeded(msg))
+}
+
+func TestKafkaHeadersToContextAndReply(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.Context = []string{"x-route", "x-missing"}
+	k.conf.KafkaHeaders.Reply = []string{"x-route"}
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestKafkaHeadersToContextAndReply"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value: msg1bytes,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("x-route"), Value: []byte("route1")},
+			{Key: []byte("x-other"), Value: []byte("other1")},
+		},
+	}
+
+	msgContext1 := <-processor.messages
+	assert.Equal("route1", msgContext1.KafkaHeader("x-route"))
+	assert.Equal("", msgContext1.KafkaHeader("x-missing"))
+	ctxMap := msgContext1.Headers().Context.(map[string]interface{})
+	assert.Equal("route1", ctxMap["x-route"])
+	assert.Equal(1, len(ctxMap))
+
+	go func() {
+		msgContext1.Reply(&kldmessages.ReplyCommon{})
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal([]sarama.RecordHeader{
+		{Key: []byte("x-route"), Value: []byte("route1")},
+	}, replyKafkaMsg.Headers)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestKafkaHeadersFromReplyFields(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.Reply = []string{"x-route"}
+	k.conf.KafkaHeaders.ReplyFields = map[string]string{
+		"reqId":   "headers.requestId",
+		"msgType": "headers.type",
+		"elapsed": "headers.timeElapsed",
+		"missing": "headers.nothing.here",
+	}
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestKafkaHeadersFromReplyFields"
+	msg1.Headers.ID = "req1"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value: msg1bytes,
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("x-route"), Value: []byte("route1")},
+		},
+	}
+
+	msgContext1 := <-processor.messages
+	go func() {
+		reply := &kldmessages.ReplyCommon{}
+		reply.Headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+		msgContext1.Reply(reply)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	assert.Equal(4, len(replyKafkaMsg.Headers))
+	assert.Equal("x-route", string(replyKafkaMsg.Headers[0].Key))
+	assert.Equal("elapsed", string(replyKafkaMsg.Headers[1].Key))
+	assert.Regexp("^[0-9.e-]+$", string(replyKafkaMsg.Headers[1].Value))
+	assert.Equal(sarama.RecordHeader{Key: []byte("msgType"), Value: []byte("TransactionSuccess")}, replyKafkaMsg.Headers[2])
+	assert.Equal(sarama.RecordHeader{Key: []byte("reqId"), Value: []byte("req1")}, replyKafkaMsg.Headers[3])
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestKafkaHeadersFromRequestFields(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.RequestFields = map[string]string{
+		"orderId": "order.id",
+		"lines":   "order.lines",
+		"missing": "order.nothing.here",
+	}
+	k.conf.KafkaHeaders.ReplyFields = map[string]string{"msgType": "headers.type"}
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value: []byte(`{"headers":{"type":"TestKafkaHeadersFromRequestFields"},"order":{"id":"order1","lines":3}}`),
+	}
+
+	msgContext1 := <-processor.messages
+	go func() {
+		msgContext1.SendErrorReply(400, fmt.Errorf("pop"))
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	assert.Equal([]sarama.RecordHeader{
+		{Key: []byte("lines"), Value: []byte("3")},
+		{Key: []byte("orderId"), Value: []byte("order1")},
+		{Key: []byte("msgType"), Value: []byte("Error")},
+	}, replyKafkaMsg.Headers)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestChecksumAddressesReply(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.ChecksumAddresses = true
+	k.conf.KafkaHeaders.ReplyFields = map[string]string{"from": "from"}
+	ctx := &msgContext{bridge: k}
+
+	from := common.HexToAddress(testFromAddr)
+	receipt := &kldmessages.TransactionReceipt{From: &from}
+	receipt.Headers.Context = map[string]interface{}{"to": strings.ToLower(testFromAddr)}
+	receipt.Transaction = &kldmessages.TransactionDetails{To: strings.ToLower(testFromAddr)}
+	replyBytes := ctx.marshalReply(receipt)
+
+	var reply map[string]interface{}
+	json.Unmarshal(replyBytes, &reply)
+	assert.Equal(testFromAddr, reply["from"])
+	assert.Nil(reply["to"])
+	assert.Equal(testFromAddr, reply["transaction"].(map[string]interface{})["to"])
+	assert.Equal(strings.ToLower(testFromAddr), reply["headers"].(map[string]interface{})["ctx"].(map[string]interface{})["to"])
+	assert.Equal([]sarama.RecordHeader{{Key: []byte("from"), Value: []byte(testFromAddr)}}, ctx.replyFieldHeaders)
+
+	// Off by default, with addresses as the node returns them
+	k.conf.ChecksumAddresses = false
+	json.Unmarshal(ctx.marshalReply(receipt), &reply)
+	assert.Equal(strings.ToLower(testFromAddr), reply["from"])
+}
+
+func TestReplyFieldHeadersSnakeCase(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.ReplyFieldNaming = ReplyFieldNamingSnake
+	k.conf.KafkaHeaders.ReplyFields = map[string]string{"reqId": "headers.requestId"}
+	ctx := &msgContext{bridge: k}
+
+	receipt := &kldmessages.TransactionReceipt{}
+	receipt.Headers.ReqID = "req1"
+	ctx.marshalReply(receipt)
+
+	assert.Equal([]sarama.RecordHeader{{Key: []byte("reqId"), Value: []byte("req1")}}, ctx.replyFieldHeaders)
+}
+
+func TestKafkaHeadersNonObjectContext(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.Context = []string{"x-route"}
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value: []byte("{\"headers\":{\"type\":\"test\",\"ctx\":\"a string\"}}"),
+		Headers: []*sarama.RecordHeader{
+			{Key: []byte("x-route"), Value: []byte("route1")},
+		},
+	}
+
+	msgContext1 := <-processor.messages
+	assert.Equal("a string", msgContext1.Headers().Context)
+
+	go func() {
+		msgContext1.Reply(&kldmessages.ReplyCommon{})
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Nil(replyKafkaMsg.Headers)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestDirectParseErrorReply(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.DirectParseErrors = true
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value:     []byte("badness"),
+		Partition: 64,
+		Offset:    int64(42),
+	}
+
+	msg := <-mockProducer.MockInput
+	k.inFlightCond.L.Lock()
+	assert.Equal(0, len(k.inFlight))
+	k.inFlightCond.L.Unlock()
+	mockProducer.MockSuccesses <- msg
+
+	replyBytes, _ := msg.Value.Encode()
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Equal("badness", errorReply.OriginalMessage)
+	assert.Equal(":64:42", errorReply.Headers.ReqOffset)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(42), mockConsumer.OffsetsByPartition[64])
+	assert.Equal(0, len(k.directReplies))
+}
+
+func TestDirectParseErrorReplyBehindInFlight(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.DirectParseErrors = true
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestDirectParseErrorReplyBehindInFlight"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes, Partition: 0, Offset: 10}
+	msgContext1 := <-processor.messages
+
+	// The bad message cannot be marked while offset 10 is in-flight
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte("badness"), Partition: 0, Offset: 11}
+	msg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- msg
+	k.inFlightCond.L.Lock()
+	for len(k.directReplies) > 0 {
+		k.inFlightCond.L.Unlock()
+		time.Sleep(1 * time.Millisecond)
+		k.inFlightCond.L.Lock()
+	}
+	_, marked := mockConsumer.OffsetsByPartition[0]
+	assert.False(marked)
+	k.inFlightCond.L.Unlock()
+
+	go func() {
+		msgContext1.Reply(&kldmessages.ReplyCommon{})
+	}()
+	msg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- msg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	// The bad message is marked once offset 10 completes
+	assert.Equal(int64(11), mockConsumer.OffsetsByPartition[0])
+	assert.Empty(k.directAcks)
+}
+
+func TestOversizeReplyTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxReplySize = 500
+	k.conf.OversizeReplies = OversizeRepliesTruncate
+	ctx := &msgContext{bridge: k, replyType: kldmessages.MsgTypeError}
+
+	errMsg := kldmessages.NewErrorReply(fmt.Errorf("pop"), []byte(strings.Repeat("x", 1000)))
+	ctx.replyBytes, _ = json.Marshal(errMsg)
+	ctx.limitReplySize(errMsg)
+
+	var reply kldmessages.ErrorReply
+	json.Unmarshal(ctx.replyBytes, &reply)
+	assert.True(len(ctx.replyBytes) <= 500)
+	assert.True(reply.Headers.Truncated)
+	assert.Equal("pop", reply.ErrorMessage)
+	assert.Empty(reply.OriginalMessage)
+}
+
+func TestOversizeReplyError(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxReplySize = 50
+	k.conf.OversizeReplies = OversizeRepliesError
+	ctx := &msgContext{bridge: k, replyType: kldmessages.MsgTypeTransactionSuccess}
+
+	txHash := common.HexToHash("0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b")
+	receipt := &kldmessages.TransactionReceipt{TransactionHash: &txHash}
+	receipt.Headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+	receipt.Headers.ReqID = "req1"
+	ctx.replyBytes, _ = json.Marshal(receipt)
+	ctx.limitReplySize(receipt)
+
+	var reply kldmessages.ErrorReply
+	json.Unmarshal(ctx.replyBytes, &reply)
+	assert.Equal(kldmessages.MsgTypeError, ctx.replyType)
+	assert.Equal(kldmessages.MsgTypeError, reply.Headers.MsgType)
+	assert.Equal("req1", reply.Headers.ReqID)
+	assert.Equal(txHash.Hex(), reply.TXHash)
+	assert.Regexp("Reply of type 'TransactionSuccess' \\(\\d+ bytes\\) exceeds the maximum reply size of 50 bytes", reply.ErrorMessage)
+}
+
+func TestOversizeReceiptTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxReplySize = 1000
+	k.conf.OversizeReplies = OversizeRepliesTruncate
+	ctx := &msgContext{bridge: k, replyType: kldmessages.MsgTypeTransactionSuccess}
+
+	receipt := &kldmessages.TransactionReceipt{Transaction: &kldmessages.TransactionDetails{Data: "0x" + strings.Repeat("00", 1000)}}
+	receipt.Headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+	ctx.replyBytes, _ = json.Marshal(receipt)
+	ctx.limitReplySize(receipt)
+
+	var reply kldmessages.TransactionReceipt
+	json.Unmarshal(ctx.replyBytes, &reply)
+	assert.Equal(kldmessages.MsgTypeTransactionSuccess, ctx.replyType)
+	assert.True(reply.Headers.Truncated)
+	assert.Nil(reply.Transaction)
+}
+
+func TestOversizeEventsTruncated(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxReplySize = 2000
+	ctx := &msgContext{bridge: k, replyType: kldmessages.MsgTypeEvents}
+
+	events := &kldmessages.Events{}
+	events.Headers.MsgType = kldmessages.MsgTypeEvents
+	for i := 0; i < 100; i++ {
+		events.Events = append(events.Events, &kldmessages.Event{LogIndex: strconv.Itoa(i)})
+	}
+	ctx.replyBytes, _ = json.Marshal(events)
+	ctx.limitReplySize(events)
+
+	var reply kldmessages.Events
+	json.Unmarshal(ctx.replyBytes, &reply)
+	assert.True(len(ctx.replyBytes) <= 2000)
+	assert.True(reply.Headers.Truncated)
+	assert.NotEmpty(reply.Events)
+	assert.True(len(reply.Events) < 100)
+	assert.Equal("0", reply.Events[0].LogIndex)
+}
+
+func TestReplyUnderMaxSizeUnchanged(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxReplySize = 500
+	ctx := &msgContext{bridge: k}
+
+	errMsg := kldmessages.NewErrorReply(fmt.Errorf("pop"), []byte("small"))
+	ctx.replyBytes, _ = json.Marshal(errMsg)
+	origBytes := ctx.replyBytes
+	ctx.limitReplySize(errMsg)
+	assert.Equal(origBytes, ctx.replyBytes)
+}
+
+func TestMarshalReplySnakeCase(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.ReplyFieldNaming = ReplyFieldNamingSnake
+	ctx := &msgContext{bridge: k}
+
+	txHash := common.HexToHash("0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b")
+	receipt := &kldmessages.TransactionReceipt{TransactionHash: &txHash, BlockNumberStr: "12345"}
+	receipt.Headers.ReqID = "req1"
+	receipt.Headers.Context = map[string]interface{}{"appField": "value"}
+
+	var reply map[string]interface{}
+	json.Unmarshal(ctx.marshalReply(receipt), &reply)
+	assert.Equal(txHash.Hex(), reply["transaction_hash"])
+	assert.Equal("12345", reply["block_number"])
+	assert.Equal("req1", reply["headers"].(map[string]interface{})["request_id"])
+	assert.Equal("value", reply["headers"].(map[string]interface{})["ctx"].(map[string]interface{})["appField"])
+	_, hasCamel := reply["transactionHash"]
+	assert.False(hasCamel)
+}
+
+func TestMarshalReplyCamelCaseDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	ctx := &msgContext{bridge: k}
+
+	receipt := &kldmessages.TransactionReceipt{BlockNumberStr: "12345"}
+	expected, _ := json.Marshal(receipt)
+	assert.Equal(expected, ctx.marshalReply(receipt))
+}
+
+func TestMarshalReplyStatusFormat(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	ctx := &msgContext{bridge: k}
+	success := &kldmessages.TransactionReceipt{StatusStr: "1"}
+	failure := &kldmessages.TransactionReceipt{StatusStr: "0"}
+
+	var reply map[string]interface{}
+	k.conf.StatusFormat = StatusFormatNumeric
+	json.Unmarshal(ctx.marshalReply(success), &reply)
+	assert.Equal("1", reply["status"])
+	_, hasBool := reply["statusBool"]
+	assert.False(hasBool)
+
+	k.conf.StatusFormat = StatusFormatBool
+	reply = nil
+	json.Unmarshal(ctx.marshalReply(success), &reply)
+	assert.Equal(true, reply["status"])
+	reply = nil
+	json.Unmarshal(ctx.marshalReply(failure), &reply)
+	assert.Equal(false, reply["status"])
+
+	k.conf.StatusFormat = StatusFormatBoth
+	reply = nil
+	json.Unmarshal(ctx.marshalReply(failure), &reply)
+	assert.Equal("0", reply["status"])
+	assert.Equal(false, reply["statusBool"])
+
+	// Receipts without a status are unchanged
+	noStatus := &kldmessages.TransactionReceipt{}
+	expected, _ := json.Marshal(noStatus)
+	assert.Equal(expected, ctx.marshalReply(noStatus))
+}
+
+func TestMarshalReplyCloudEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.ReplyEnvelope = ReplyEnvelopeCloudEvents
+	k.conf.ReplyFieldNaming = ReplyFieldNamingSnake
+	k.replyEnvelope = NewReplyEnvelope(&k.conf)
+	ctx := &msgContext{bridge: k}
+
+	receipt := &kldmessages.TransactionReceipt{BlockNumberStr: "12345"}
+	receipt.Headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+
+	var event map[string]interface{}
+	json.Unmarshal(ctx.marshalReply(receipt), &event)
+	assert.Equal("io.kaleido.ethconnect.TransactionSuccess", event["type"])
+	assert.Equal("12345", event["data"].(map[string]interface{})["block_number"])
+}
+
+func testPriorityMsg(id, priority string) *sarama.ConsumerMessage {
+	return testPriorityAccountMsg(id, priority, "")
+}
+
+func testPriorityAccountMsg(id, priority, account string) *sarama.ConsumerMessage {
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = "TestPriority"
+	msg.Headers.ID = id
+	msg.Headers.Priority = priority
+	msg.Headers.Account = account
+	msgBytes, _ := json.Marshal(&msg)
+	return &sarama.ConsumerMessage{Value: msgBytes}
+}
+
+func TestReadyMessagesByPriority(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxInFlight = 10
+	k.conf.PriorityOrdering = true
+	mockConsumer := &MockKafkaConsumer{MockMessages: make(chan *sarama.ConsumerMessage, 10)}
+
+	msg0 := testPriorityMsg("msg0", "")
+	msg1 := testPriorityMsg("msg1", "")
+	msg2 := testPriorityMsg("msg2", kldmessages.PriorityHigh)
+	msg3 := &sarama.ConsumerMessage{Value: []byte("badness")}
+	msg4 := testPriorityMsg("msg4", kldmessages.PriorityHigh)
+	mockConsumer.MockMessages <- msg1
+	mockConsumer.MockMessages <- msg2
+	mockConsumer.MockMessages <- msg3
+	mockConsumer.MockMessages <- msg4
+
+	ready := k.readyMessagesByPriority(msg0, mockConsumer)
+	assert.Equal([]*sarama.ConsumerMessage{msg2, msg4, msg0, msg1, msg3}, ready)
+}
+
+func TestReadyMessagesByPriorityWithinPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxInFlight = 10
+	k.conf.PriorityOrdering = true
+	mockConsumer := &MockKafkaConsumer{MockMessages: make(chan *sarama.ConsumerMessage, 10)}
+
+	msg0 := testPriorityMsg("msg0", "")
+	msg1 := testPriorityMsg("msg1", "")
+	msg1.Partition = 1
+	msg2 := testPriorityMsg("msg2", "")
+	msg3 := testPriorityMsg("msg3", kldmessages.PriorityHigh)
+	msg3.Partition = 1
+	msg4 := testPriorityMsg("msg4", kldmessages.PriorityHigh)
+	mockConsumer.MockMessages <- msg1
+	mockConsumer.MockMessages <- msg2
+	mockConsumer.MockMessages <- msg3
+	mockConsumer.MockMessages <- msg4
+
+	// msg3 does not overtake msg0 or msg2, as they are on another partition
+	ready := k.readyMessagesByPriority(msg0, mockConsumer)
+	assert.Equal([]*sarama.ConsumerMessage{msg4, msg3, msg0, msg1, msg2}, ready)
+}
+
+func TestReadyMessagesByPrioritySameAccountOrKey(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxInFlight = 10
+	k.conf.PriorityOrdering = true
+	mockConsumer := &MockKafkaConsumer{MockMessages: make(chan *sarama.ConsumerMessage, 10)}
+
+	msg0 := testPriorityAccountMsg("msg0", "", "0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c")
+	msg1 := testPriorityMsg("msg1", "")
+	msg1.Key = []byte("key1")
+	msg2 := testPriorityAccountMsg("msg2", kldmessages.PriorityHigh, "0xaa983ad2a0e0ed8ac639277f37be42f2a5d2618c")
+	msg3 := testPriorityMsg("msg3", kldmessages.PriorityHigh)
+	msg3.Key = []byte("key1")
+	msg4 := testPriorityMsg("msg4", kldmessages.PriorityHigh)
+	mockConsumer.MockMessages <- msg1
+	mockConsumer.MockMessages <- msg2
+	mockConsumer.MockMessages <- msg3
+	mockConsumer.MockMessages <- msg4
+
+	// msg2 stays behind msg0 from the same account, and msg3 behind msg1 with the same key
+	ready := k.readyMessagesByPriority(msg0, mockConsumer)
+	assert.Equal([]*sarama.ConsumerMessage{msg4, msg0, msg2, msg1, msg3}, ready)
+}
+
+func TestReadyMessagesByPriorityDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxInFlight = 10
+	mockConsumer := &MockKafkaConsumer{MockMessages: make(chan *sarama.ConsumerMessage, 10)}
+
+	msg0 := testPriorityMsg("msg0", "")
+	msg1 := testPriorityMsg("msg1", kldmessages.PriorityHigh)
+	mockConsumer.MockMessages <- msg1
+
+	// Without priority ordering, we do not read ahead
+	ready := k.readyMessagesByPriority(msg0, mockConsumer)
+	assert.Equal([]*sarama.ConsumerMessage{msg0}, ready)
+	assert.Equal(1, len(mockConsumer.MockMessages))
+}
+
+func TestReadyMessagesByPriorityLimitedByCapacity(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.MaxInFlight = 3
+	k.conf.PriorityOrdering = true
+	k.inFlight["in-flight"] = &msgContext{}
+	mockConsumer := &MockKafkaConsumer{MockMessages: make(chan *sarama.ConsumerMessage, 10)}
+
+	msg0 := testPriorityMsg("msg0", "")
+	msg1 := testPriorityMsg("msg1", "")
+	msg2 := testPriorityMsg("msg2", kldmessages.PriorityHigh)
+	mockConsumer.MockMessages <- msg1
+	mockConsumer.MockMessages <- msg2
+
+	ready := k.readyMessagesByPriority(msg0, mockConsumer)
+	assert.Equal([]*sarama.ConsumerMessage{msg0, msg1}, ready)
+	assert.Equal(1, len(mockConsumer.MockMessages))
+}
+
+func TestAddInflightMessageBadMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, mockConsumer, mockProducer, wg := setupMocks()
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value:     []byte("badness"),
+		Partition: 64,
+		Offset:    int64(42),
+	}
+
+	// Drain the producer
+	msg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- msg
+
+	// Shut down
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	// Check we acknowledge all offsets
+	assert.Equal(int64(42), mockConsumer.OffsetsByPartition[64])
+
+}
+
+func TestProducerErrorLoopPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+
+	wg.Add(2)
+	go func() {
+		mockProducer.MockErrors <- &sarama.ProducerError{
+			Err: fmt.Errorf("pop"),
+			Msg: &sarama.ProducerMessage{},
+		}
+		wg.Done()
+	}()
+
+	assert.Panics(func() {
+		k.ProducerErrorLoop(nil, mockProducer, wg)
+	})
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+}
+
+func TestProducerSuccessLoopPanicsMsgNotInflight(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+
+	wg.Add(2)
+	go func() {
+		mockProducer.MockSuccesses <- &sarama.ProducerMessage{
+			Metadata: "badness",
+		}
+		wg.Done()
+	}()
+
+	assert.Panics(func() {
+		k.ProducerSuccessLoop(nil, mockProducer, wg)
+	})
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+}
+
+func TestReplyKeyFromKafkaHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.Key = "x-key"
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestReplyKeyFromKafkaHeader"
+	msg1.Headers.Account = "account1"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value:   msg1bytes,
+		Offset:  0,
+		Headers: []*sarama.RecordHeader{{Key: []byte("x-key"), Value: []byte("key1")}},
+	}
+	msgContext1 := <-processor.messages
+	go msgContext1.Reply(&kldmessages.ReplyCommon{})
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal("key1", string(replyKafkaMsg.Key.(sarama.StringEncoder)))
+
+	// Falls back to the account without the header
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes, Offset: 1}
+	msgContext2 := <-processor.messages
+	go msgContext2.Reply(&kldmessages.ReplyCommon{})
+	replyKafkaMsg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal("account1", string(replyKafkaMsg.Key.(sarama.StringEncoder)))
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestMissingKeyHeaderRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.KafkaHeaders.Key = "x-key"
+	k.conf.KafkaHeaders.KeyRequired = true
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestMissingKeyHeaderRejected"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	var errorReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errorReply)
+	assert.Equal("Missing Kafka header 'x-key' for the reply key", errorReply.ErrorMessage)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestExecuteBridgeWithKeyHeaderRequiredWithoutKeyHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	testArgs := append(kbMinWorkingArgs, []string{"--key-header-required"}...)
+
+	kafkaCmd.SetArgs(testArgs)
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "A key header must be configured for it to be required")
 }
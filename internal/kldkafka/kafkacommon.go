@@ -27,11 +27,36 @@ import (
 	"github.com/Shopify/sarama"
 	cluster "github.com/bsm/sarama-cluster"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
 	"github.com/kaleido-io/ethconnect/internal/kldutils"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+const (
+	// OffsetCommitInterval commits the marked consumer offsets periodically (default)
+	OffsetCommitInterval = "interval"
+	// OffsetCommitImmediate commits the consumer offset each time it is marked
+	OffsetCommitImmediate = "immediate"
+	// ConsumerFatalErrorsAuth shuts down the bridge on authentication and authorization errors (default)
+	ConsumerFatalErrorsAuth = "auth"
+	// ConsumerFatalErrorsAll shuts down the bridge on any consumer error
+	ConsumerFatalErrorsAll = "all"
+	// ConsumerFatalErrorsNone logs consumer errors, and relies on the consumer to recover
+	ConsumerFatalErrorsNone = "none"
+)
+
+// consumerAuthErrors are the Kafka errors the consumer cannot recover from by
+// retrying, as the credentials or ACLs need to be fixed
+var consumerAuthErrors = []sarama.KError{
+	sarama.ErrTopicAuthorizationFailed,
+	sarama.ErrGroupAuthorizationFailed,
+	sarama.ErrClusterAuthorizationFailed,
+	sarama.ErrSASLAuthenticationFailed,
+	sarama.ErrUnsupportedSASLMechanism,
+	sarama.ErrIllegalSASLState,
+}
+
 // KafkaCommonConf - Common configuration for Kafka
 type KafkaCommonConf struct {
 	Brokers       []string `json:"brokers"`
@@ -39,11 +64,25 @@ type KafkaCommonConf struct {
 	ConsumerGroup string   `json:"consumerGroup"`
 	TopicIn       string   `json:"topicIn"`
 	TopicOut      string   `json:"topicOut"`
+	Version       string   `json:"version,omitempty"`
 	SASL          struct {
 		Username string
 		Password string
 	} `json:"sasl"`
-	TLS kldutils.TLSConfig `json:"tls"`
+	TLS   kldutils.TLSConfig `json:"tls"`
+	Fetch struct {
+		Min     int32 `json:"min,omitempty"`
+		Default int32 `json:"default,omitempty"`
+		Max     int32 `json:"max,omitempty"`
+	} `json:"fetch"`
+	IdempotentReplies bool `json:"idempotentReplies"`
+	StartupWait       int  `json:"startupWait"`
+	OffsetCommit      struct {
+		Mode     string `json:"mode,omitempty"`
+		Interval int    `json:"interval,omitempty"` // milliseconds
+	} `json:"offsetCommit"`
+	ConsumerFatalErrors string          `json:"consumerFatalErrors,omitempty"`
+	Partitioner         PartitionerConf `json:"partitioner"`
 }
 
 // KafkaCommon is the base interface for bridges that interact with Kafka
@@ -53,6 +92,8 @@ type KafkaCommon interface {
 	Start() error
 	Conf() *KafkaCommonConf
 	Producer() KafkaProducer
+	ConsumerErrors() *kldmetrics.CounterVec
+	Assignment() *ConsumerAssignment
 }
 
 // NewKafkaCommon constructs a new KafkaCommon instance
@@ -61,6 +102,9 @@ func NewKafkaCommon(kf KafkaFactory, conf *KafkaCommonConf, kafkaGoRoutines Kafk
 		factory:         kf,
 		kafkaGoRoutines: kafkaGoRoutines,
 		conf:            conf,
+		consumerErrors:  newConsumerErrorsCounter(),
+		assignment:      newConsumerAssignment(),
+		fatal:           make(chan error, 1),
 	}
 	return
 }
@@ -79,6 +123,13 @@ type kafkaCommon struct {
 	producerWG      sync.WaitGroup
 	kafkaGoRoutines KafkaGoRoutines
 	saramaLogger    saramaLogger
+	consumerErrors  *kldmetrics.CounterVec
+	assignment      *consumerAssignment
+	fatal           chan error
+}
+
+func newConsumerErrorsCounter() *kldmetrics.CounterVec {
+	return kldmetrics.NewCounterVec("ethconnect_kafka_consumer_errors_total", "Errors from the Kafka consumer, by where they occurred", "source")
 }
 
 func (k *kafkaCommon) Conf() *KafkaCommonConf {
@@ -89,6 +140,15 @@ func (k *kafkaCommon) Producer() KafkaProducer {
 	return k.producer
 }
 
+// Assignment returns the partitions currently assigned to the consumer
+func (k *kafkaCommon) Assignment() *ConsumerAssignment {
+	return k.assignment.get()
+}
+
+func (k *kafkaCommon) ConsumerErrors() *kldmetrics.CounterVec {
+	return k.consumerErrors
+}
+
 // ValidateConf performs common Cobra PreRunE logic for Kafka related commands
 func (k *kafkaCommon) ValidateConf() (err error) {
 	if k.conf.TopicOut == "" {
@@ -104,9 +164,101 @@ func (k *kafkaCommon) ValidateConf() (err error) {
 		err = fmt.Errorf("Username and Password must both be provided for SASL")
 		return
 	}
+	if k.conf.Version != "" {
+		if _, err = sarama.ParseKafkaVersion(k.conf.Version); err != nil {
+			err = fmt.Errorf("Invalid Kafka version '%s': %s", k.conf.Version, err)
+			return
+		}
+	}
+	if k.conf.StartupWait < 0 {
+		return fmt.Errorf("Startup wait %d must not be negative", k.conf.StartupWait)
+	}
+	if err = k.validateIdempotentConf(); err != nil {
+		return
+	}
+	if err = k.validateOffsetCommitConf(); err != nil {
+		return
+	}
+	if err = k.validateConsumerFatalErrors(); err != nil {
+		return
+	}
+	if err = k.validatePartitionerConf(); err != nil {
+		return
+	}
+	err = k.validateFetchConf()
 	return
 }
 
+// validateOffsetCommitConf checks the offset commit mode, and that an interval
+// is only set for interval based commits
+func (k *kafkaCommon) validateOffsetCommitConf() error {
+	offsetCommit := &k.conf.OffsetCommit
+	if offsetCommit.Mode == "" {
+		offsetCommit.Mode = OffsetCommitInterval
+	} else if offsetCommit.Mode != OffsetCommitInterval && offsetCommit.Mode != OffsetCommitImmediate {
+		return fmt.Errorf("Invalid offset commit mode '%s' (must be '%s' or '%s')", offsetCommit.Mode, OffsetCommitInterval, OffsetCommitImmediate)
+	}
+	if offsetCommit.Interval < 0 {
+		return fmt.Errorf("Offset commit interval %d must not be negative", offsetCommit.Interval)
+	}
+	if offsetCommit.Interval > 0 && offsetCommit.Mode == OffsetCommitImmediate {
+		log.Warnf("Offset commit interval has no effect with '%s' offset commits", OffsetCommitImmediate)
+	}
+	return nil
+}
+
+// validateConsumerFatalErrors checks which consumer errors shut down the bridge
+func (k *kafkaCommon) validateConsumerFatalErrors() error {
+	switch k.conf.ConsumerFatalErrors {
+	case "":
+		k.conf.ConsumerFatalErrors = ConsumerFatalErrorsAuth
+	case ConsumerFatalErrorsAuth, ConsumerFatalErrorsAll, ConsumerFatalErrorsNone:
+	default:
+		return fmt.Errorf("Invalid consumer fatal errors '%s' (must be '%s', '%s' or '%s')", k.conf.ConsumerFatalErrors, ConsumerFatalErrorsAuth, ConsumerFatalErrorsAll, ConsumerFatalErrorsNone)
+	}
+	return nil
+}
+
+// validateIdempotentConf checks the Kafka version supports an idempotent producer,
+// defaulting the version to the minimum that does if none is set
+func (k *kafkaCommon) validateIdempotentConf() error {
+	if !k.conf.IdempotentReplies {
+		return nil
+	}
+	if k.conf.Version == "" {
+		log.Infof("Kafka version %s selected for idempotent producer", sarama.V0_11_0_0)
+		k.conf.Version = sarama.V0_11_0_0.String()
+		return nil
+	}
+	version, _ := sarama.ParseKafkaVersion(k.conf.Version)
+	if !version.IsAtLeast(sarama.V0_11_0_0) {
+		return fmt.Errorf("Kafka version %s or higher is required for idempotent replies", sarama.V0_11_0_0)
+	}
+	return nil
+}
+
+// validateFetchConf checks the consumer fetch sizes are consistent.
+// Zero means use the sarama default, and for the maximum means no limit.
+func (k *kafkaCommon) validateFetchConf() error {
+	fetch := &k.conf.Fetch
+	if fetch.Min < 0 || fetch.Default < 0 || fetch.Max < 0 {
+		return fmt.Errorf("Consumer fetch sizes cannot be negative")
+	}
+	if fetch.Default > 0 && fetch.Min > fetch.Default {
+		return fmt.Errorf("Consumer minimum fetch size %d is greater than the default fetch size %d", fetch.Min, fetch.Default)
+	}
+	if fetch.Max > 0 && (fetch.Min > fetch.Max || fetch.Default > fetch.Max) {
+		return fmt.Errorf("Consumer fetch sizes min=%d default=%d must not be greater than the maximum fetch size %d", fetch.Min, fetch.Default, fetch.Max)
+	}
+	if fetch.Default > 0 && fetch.Default < 1024 {
+		log.Warnf("Consumer default fetch size of %d bytes will require many broker round-trips", fetch.Default)
+	}
+	if fetch.Min > 1024*1024 {
+		log.Warnf("Consumer minimum fetch size of %d bytes might delay messages on low volume topics", fetch.Min)
+	}
+	return nil
+}
+
 // CobraInit performs common Cobra init for Kafka related commands
 func (k *kafkaCommon) CobraInit(cmd *cobra.Command) {
 	defBrokerList := strings.Split(os.Getenv("KAFKA_BROKERS"), ",")
@@ -124,6 +276,17 @@ func (k *kafkaCommon) CobraInit(cmd *cobra.Command) {
 	cmd.Flags().BoolVarP(&k.conf.TLS.InsecureSkipVerify, "tls-insecure", "z", defTLSinsecure, "Disable verification of TLS certificate chain")
 	cmd.Flags().StringVarP(&k.conf.SASL.Username, "sasl-username", "u", os.Getenv("KAFKA_SASL_USERNAME"), "Username for SASL authentication")
 	cmd.Flags().StringVarP(&k.conf.SASL.Password, "sasl-password", "p", os.Getenv("KAFKA_SASL_PASSWORD"), "Password for SASL authentication")
+	cmd.Flags().Int32Var(&k.conf.Fetch.Min, "fetch-min", int32(kldutils.DefInt("KAFKA_FETCH_MIN", 0)), "Minimum bytes to fetch in a consumer request (default=1)")
+	cmd.Flags().Int32Var(&k.conf.Fetch.Default, "fetch-default", int32(kldutils.DefInt("KAFKA_FETCH_DEFAULT", 0)), "Default bytes to fetch in a consumer request (default=1MB)")
+	cmd.Flags().Int32Var(&k.conf.Fetch.Max, "fetch-max", int32(kldutils.DefInt("KAFKA_FETCH_MAX", 0)), "Maximum bytes to fetch in a consumer request (default=no limit)")
+	cmd.Flags().BoolVar(&k.conf.IdempotentReplies, "idempotent-replies", false, "Use an idempotent Kafka producer, so retries cannot duplicate messages (requires Kafka 0.11.0.0 or higher)")
+	cmd.Flags().IntVar(&k.conf.StartupWait, "startup-wait", kldutils.DefInt("KAFKA_STARTUP_WAIT", 0), "Maximum time to retry connecting to dependencies on startup, before exiting (seconds)")
+	cmd.Flags().StringVar(&k.conf.OffsetCommit.Mode, "offset-commit", os.Getenv("KAFKA_OFFSET_COMMIT"), "Commit consumer offsets at an interval, or immediately when marked (interval/immediate, default=interval)")
+	cmd.Flags().IntVar(&k.conf.OffsetCommit.Interval, "offset-commit-interval", kldutils.DefInt("KAFKA_OFFSET_COMMIT_INTERVAL", 0), "Interval between consumer offset commits (milliseconds, default=1000)")
+	cmd.Flags().StringVar(&k.conf.ConsumerFatalErrors, "consumer-fatal-errors", os.Getenv("KAFKA_CONSUMER_FATAL_ERRORS"), "Consumer errors that shut down the bridge, so it can be restarted (auth/all/none, default=auth)")
+	cmd.Flags().StringVar(&k.conf.Partitioner.Type, "partitioner", os.Getenv("KAFKA_PARTITIONER"), "How messages are assigned to partitions (hash/reference/crc32/random/roundrobin/manual, default=hash)")
+	cmd.Flags().StringVar(&k.conf.Partitioner.Field, "partitioner-field", os.Getenv("KAFKA_PARTITIONER_FIELD"), "Reply field holding the partition for the manual partitioner, as field.path")
+	cmd.Flags().StringVar(&k.conf.Version, "kafka-version", os.Getenv("KAFKA_VERSION"), "Kafka protocol version (0.11.0.0 or higher is required for message headers)")
 	return
 }
 
@@ -164,19 +327,49 @@ func (k *kafkaCommon) connect() (err error) {
 	clientConf.Producer.Return.Errors = true
 	clientConf.Producer.RequiredAcks = sarama.WaitForLocal
 	clientConf.Producer.Flush.Frequency = 500 * time.Millisecond
+	clientConf.Producer.Partitioner = newPartitioner(k.conf.Partitioner.Type)
+	if k.conf.IdempotentReplies {
+		// The broker can only de-duplicate retries if they cannot be re-ordered,
+		// and every replica has acknowledged the original
+		clientConf.Producer.Idempotent = true
+		clientConf.Producer.RequiredAcks = sarama.WaitForAll
+		clientConf.Net.MaxOpenRequests = 1
+	}
 	clientConf.Metadata.Retry.Backoff = 2 * time.Second
 	clientConf.Consumer.Return.Errors = true
+	if k.conf.OffsetCommit.Interval > 0 {
+		clientConf.Consumer.Offsets.CommitInterval = time.Duration(k.conf.OffsetCommit.Interval) * time.Millisecond
+	}
+	if k.conf.Fetch.Min > 0 {
+		clientConf.Consumer.Fetch.Min = k.conf.Fetch.Min
+	}
+	if k.conf.Fetch.Default > 0 {
+		clientConf.Consumer.Fetch.Default = k.conf.Fetch.Default
+	}
+	if k.conf.Fetch.Max > 0 {
+		clientConf.Consumer.Fetch.Max = k.conf.Fetch.Max
+	}
 	clientConf.Group.Return.Notifications = true
 	clientConf.Net.TLS.Enable = (tlsConfig != nil)
 	clientConf.Net.TLS.Config = tlsConfig
+	if k.conf.Version != "" {
+		if clientConf.Version, err = sarama.ParseKafkaVersion(k.conf.Version); err != nil {
+			return
+		}
+	}
 	clientConf.ClientID = k.conf.ClientID
 	if clientConf.ClientID == "" {
 		clientConf.ClientID = kldutils.UUIDv4()
 	}
 	log.Debugf("Kafka ClientID: %s", clientConf.ClientID)
+	k.assignment.connected(k.conf.ConsumerGroup, clientConf.ClientID)
 
 	log.Debugf("Kafka Bootstrap brokers: %s", k.conf.Brokers)
-	if k.client, err = k.factory.NewClient(k, clientConf); err != nil {
+	startupWait := time.Duration(k.conf.StartupWait) * time.Second
+	if err = kldutils.RetryUntil("Kafka brokers", startupWait, func() (err error) {
+		k.client, err = k.factory.NewClient(k, clientConf)
+		return
+	}); err != nil {
 		log.Errorf("Failed to create Kafka client: %s", err)
 		return
 	}
@@ -216,21 +409,20 @@ func (k *kafkaCommon) createConsumer() (err error) {
 		log.Errorf("Failed to create Kafka consumer: %s", err)
 		return
 	}
+	if k.conf.OffsetCommit.Mode == OffsetCommitImmediate {
+		k.consumer = &immediateCommitConsumer{KafkaConsumer: k.consumer}
+	}
 	return
 }
 
 func (k *kafkaCommon) startConsumer() (err error) {
 
 	k.consumerWG.Add(3)
-	go func() {
-		for err := range k.consumer.Errors() {
-			log.Error("Kafka consumer failed:", err)
-		}
-		k.consumerWG.Done()
-	}()
+	go k.ConsumerErrorLoop(k.consumer, k.producer, &k.consumerWG)
 	go func() {
 		for ntf := range k.consumer.Notifications() {
 			log.Debugf("Kafka consumer rebalanced. Current=%+v", ntf.Current)
+			k.assignment.rebalanced(ntf)
 		}
 		k.consumerWG.Done()
 	}()
@@ -240,6 +432,62 @@ func (k *kafkaCommon) startConsumer() (err error) {
 	return
 }
 
+// consumerErrorSource describes where a consumer error occurred, for metrics.
+// sarama-cluster reports the group operation that failed, and sarama the partition
+func consumerErrorSource(err error) string {
+	switch e := err.(type) {
+	case *cluster.Error:
+		return e.Ctx
+	case *sarama.ConsumerError:
+		return "partition"
+	}
+	return "other"
+}
+
+// isConsumerAuthError checks if a consumer error is an authentication or
+// authorization failure. sarama-cluster does not expose the cause of the errors
+// it wraps, so those are matched on the message of the Kafka error
+func isConsumerAuthError(err error) bool {
+	if ce, ok := err.(*sarama.ConsumerError); ok {
+		err = ce.Err
+	}
+	for _, authErr := range consumerAuthErrors {
+		if err == authErr || err.Error() == authErr.Error() {
+			return true
+		}
+	}
+	return false
+}
+
+// ConsumerErrorLoop - goroutine to process consumer errors. Errors the consumer
+// cannot recover from are fatal, shutting down the bridge so it exits with the error
+func (k *kafkaCommon) ConsumerErrorLoop(consumer KafkaConsumer, producer KafkaProducer, wg *sync.WaitGroup) {
+	log.Debugf("Kafka consumer error loop started")
+	defer wg.Done()
+	for err := range consumer.Errors() {
+		k.consumerErrors.WithLabels(consumerErrorSource(err)).Inc()
+		mode := k.conf.ConsumerFatalErrors
+		if mode == ConsumerFatalErrorsAll || (mode == ConsumerFatalErrorsAuth && isConsumerAuthError(err)) {
+			log.Errorf("Kafka consumer failed with fatal error: %s", err)
+			select {
+			case k.fatal <- err:
+			default: // already shutting down
+			}
+		} else {
+			log.Errorf("Kafka consumer failed: %s", err)
+		}
+	}
+}
+
+// shutdown closes the producer and consumer, and waits for their goroutines
+func (k *kafkaCommon) shutdown() {
+	k.kafkaGoRoutines.ConsumerStopping()
+	k.producer.AsyncClose()
+	k.consumer.Close()
+	k.producerWG.Wait()
+	k.consumerWG.Wait()
+}
+
 // Start kicks off the bridge
 func (k *kafkaCommon) Start() (err error) {
 
@@ -264,13 +512,16 @@ func (k *kafkaCommon) Start() (err error) {
 	for {
 		select {
 		case <-k.signals:
-			k.producer.AsyncClose()
-			k.consumer.Close()
-			k.producerWG.Wait()
-			k.consumerWG.Wait()
+			k.shutdown()
 
 			log.Infof("Kafka Bridge complete")
 			return
+		case fatalErr := <-k.fatal:
+			k.shutdown()
+
+			log.Errorf("Kafka Bridge stopped after fatal consumer error")
+			err = fmt.Errorf("Kafka consumer failed: %s", fatalErr)
+			return
 		}
 	}
 }
@@ -56,6 +56,8 @@ func (g *testKafkaGoRoutines) ProducerSuccessLoop(consumer KafkaConsumer, produc
 	wg.Done()
 }
 
+func (g *testKafkaGoRoutines) ConsumerStopping() {}
+
 var kcMinWorkingArgs = []string{
 	"-t", "in-topic",
 	"-T", "out-topic",
@@ -155,6 +157,26 @@ func TestExecuteWithNewClientError(t *testing.T) {
 
 }
 
+func TestExecuteWithNewClientErrorStartupWait(t *testing.T) {
+	assert := assert.New(t)
+
+	testArgs := append(kcMinWorkingArgs, []string{"--startup-wait", "1"}...)
+	_, err := execKafkaCommonWithArgs(assert, testArgs, NewErrorMockKafkaFactory(
+		fmt.Errorf("pop"), nil, nil,
+	))
+
+	assert.EqualError(err, "Kafka brokers not ready after 1s: pop")
+}
+
+func TestExecuteWithBadStartupWait(t *testing.T) {
+	assert := assert.New(t)
+
+	testArgs := append(kcMinWorkingArgs, []string{"--startup-wait", "-1"}...)
+	_, err := execKafkaCommonWithArgs(assert, testArgs, NewMockKafkaFactory())
+
+	assert.EqualError(err, "Startup wait -1 must not be negative")
+}
+
 func TestExecuteWithNewProducerError(t *testing.T) {
 	assert := assert.New(t)
 
@@ -195,6 +217,137 @@ func TestExecuteWithNoTLS(t *testing.T) {
 
 }
 
+func TestExecuteWithKafkaVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--kafka-version", "1.0.0"), f)
+
+	assert.Equal(nil, err)
+	assert.Equal(sarama.V1_0_0_0, f.ClientConf.Version)
+}
+
+func TestExecuteWithBadKafkaVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--kafka-version", "badness"), f)
+
+	assert.Regexp("Invalid Kafka version 'badness'", err.Error())
+}
+
+func TestExecuteWithFetchSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs,
+		"--fetch-min", "1024",
+		"--fetch-default", "65536",
+		"--fetch-max", "1048576",
+	), f)
+
+	assert.Equal(nil, err)
+	assert.Equal(int32(1024), f.ClientConf.Consumer.Fetch.Min)
+	assert.Equal(int32(65536), f.ClientConf.Consumer.Fetch.Default)
+	assert.Equal(int32(1048576), f.ClientConf.Consumer.Fetch.Max)
+}
+
+func TestExecuteWithDefaultFetchSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, kcMinWorkingArgs, f)
+
+	assert.Equal(nil, err)
+	assert.Equal(int32(1), f.ClientConf.Consumer.Fetch.Min)
+	assert.Equal(int32(1024*1024), f.ClientConf.Consumer.Fetch.Default)
+	assert.Equal(int32(0), f.ClientConf.Consumer.Fetch.Max)
+}
+
+func TestExecuteWithBadFetchSizes(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--fetch-min", "2048", "--fetch-default", "1024"), f)
+	assert.Regexp("Consumer minimum fetch size 2048 is greater than the default fetch size 1024", err.Error())
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--fetch-default", "4096", "--fetch-max", "2048"), f)
+	assert.Regexp("must not be greater than the maximum fetch size 2048", err.Error())
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--fetch-max", "-1"), f)
+	assert.Regexp("Consumer fetch sizes cannot be negative", err.Error())
+}
+
+func TestExecuteWithOffsetCommitInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	k, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--offset-commit-interval", "5000"), f)
+
+	assert.Equal(nil, err)
+	assert.Equal(OffsetCommitInterval, k.conf.OffsetCommit.Mode)
+	assert.Equal(5*time.Second, f.ClientConf.Consumer.Offsets.CommitInterval)
+	assert.Equal(f.Consumer, k.consumer)
+}
+
+func TestExecuteWithOffsetCommitImmediate(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	k, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--offset-commit", "immediate"), f)
+
+	assert.Equal(nil, err)
+	assert.Equal(time.Second, f.ClientConf.Consumer.Offsets.CommitInterval)
+	assert.IsType(&immediateCommitConsumer{}, k.consumer)
+
+	k.consumer.MarkOffset(&sarama.ConsumerMessage{Partition: 1, Offset: 10}, "")
+	assert.Equal(int64(10), f.Consumer.OffsetsByPartition[1])
+	assert.Equal(1, f.Consumer.Commits)
+
+	// Failures are logged, and the offset will be committed with the next one
+	f.Consumer.CommitErr = fmt.Errorf("pop")
+	k.consumer.MarkOffset(&sarama.ConsumerMessage{Partition: 1, Offset: 11}, "")
+	assert.Equal(int64(11), f.Consumer.OffsetsByPartition[1])
+	assert.Equal(2, f.Consumer.Commits)
+}
+
+func TestExecuteWithBadOffsetCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--offset-commit", "sometimes"), f)
+	assert.Equal("Invalid offset commit mode 'sometimes' (must be 'interval' or 'immediate')", err.Error())
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--offset-commit-interval", "-1"), f)
+	assert.Equal("Offset commit interval -1 must not be negative", err.Error())
+}
+
+func TestExecuteWithIdempotentReplies(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--idempotent-replies"), f)
+
+	assert.Equal(nil, err)
+	assert.Equal(true, f.ClientConf.Producer.Idempotent)
+	assert.Equal(sarama.WaitForAll, f.ClientConf.Producer.RequiredAcks)
+	assert.Equal(1, f.ClientConf.Net.MaxOpenRequests)
+	assert.Equal(sarama.V0_11_0_0, f.ClientConf.Version)
+	assert.Nil(f.ClientConf.Validate())
+}
+
+func TestExecuteWithIdempotentRepliesOldVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--idempotent-replies", "--kafka-version", "0.10.2.0"), f)
+
+	assert.Regexp("Kafka version 0.11.0.0 or higher is required for idempotent replies", err.Error())
+}
+
 func TestExecuteWithSASL(t *testing.T) {
 	assert := assert.New(t)
 
@@ -355,10 +508,90 @@ func TestConsumerErrorLoopLogsAndContinues(t *testing.T) {
 	}
 
 	f.Consumer.MockErrors <- fmt.Errorf("fizzle")
+	f.Consumer.MockErrors <- &sarama.ConsumerError{Topic: "in-topic", Partition: 1, Err: sarama.ErrOffsetOutOfRange}
 
 	// Shut down
 	k.signals <- os.Interrupt
 	wg.Wait()
+
+	assert.Equal(uint64(1), k.consumerErrors.WithLabels("other").Value())
+	assert.Equal(uint64(1), k.consumerErrors.WithLabels("partition").Value())
+}
+
+func TestConsumerErrorLoopFatalAuthError(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaCommon(kcMinWorkingArgs)
+	f := NewMockKafkaFactory()
+	k.factory = f
+	done := make(chan error)
+	go func() {
+		done <- kafkaCmd.Execute()
+	}()
+	for k.signals == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.Consumer.MockErrors <- &sarama.ConsumerError{Topic: "in-topic", Partition: 0, Err: sarama.ErrTopicAuthorizationFailed}
+
+	err := <-done
+	assert.Regexp("Kafka consumer failed: .*not authorized to access this topic", err.Error())
+	assert.True(f.Producer.Closed)
+}
+
+func TestConsumerErrorLoopFatalAll(t *testing.T) {
+	assert := assert.New(t)
+
+	k, kafkaCmd := newTestKafkaCommon(append(kcMinWorkingArgs, "--consumer-fatal-errors", "all"))
+	f := NewMockKafkaFactory()
+	k.factory = f
+	done := make(chan error)
+	go func() {
+		done <- kafkaCmd.Execute()
+	}()
+	for k.signals == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.Consumer.MockErrors <- fmt.Errorf("fizzle")
+
+	err := <-done
+	assert.EqualError(err, "Kafka consumer failed: fizzle")
+}
+
+func TestConsumerErrorLoopFatalNone(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	k, wg, err := startTestKafkaCommon(assert, append(kcMinWorkingArgs, "--consumer-fatal-errors", "none"), f)
+	if err != nil {
+		return
+	}
+
+	f.Consumer.MockErrors <- sarama.ErrSASLAuthenticationFailed
+
+	k.signals <- os.Interrupt
+	wg.Wait()
+	assert.Equal(uint64(1), k.consumerErrors.WithLabels("other").Value())
+}
+
+func TestExecuteWithBadConsumerFatalErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--consumer-fatal-errors", "some"), NewMockKafkaFactory())
+	assert.EqualError(err, "Invalid consumer fatal errors 'some' (must be 'auth', 'all' or 'none')")
+}
+
+func TestIsConsumerAuthError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(isConsumerAuthError(sarama.ErrGroupAuthorizationFailed))
+	assert.True(isConsumerAuthError(&sarama.ConsumerError{Err: sarama.ErrClusterAuthorizationFailed}))
+	// Wrapped errors that hide the cause are matched on the message
+	assert.True(isConsumerAuthError(fmt.Errorf("%s", sarama.ErrSASLAuthenticationFailed)))
+	assert.False(isConsumerAuthError(sarama.ErrNotCoordinatorForConsumer))
+	assert.False(isConsumerAuthError(fmt.Errorf("pop")))
+	assert.Equal("commit", consumerErrorSource(&cluster.Error{Ctx: "commit"}))
 }
 
 func TestConsumerNotificationsLoop(t *testing.T) {
@@ -0,0 +1,86 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// localSigners holds the signers for accounts that are signed in the bridge,
+// rather than by the node. Transactions from all other accounts are sent to
+// the node to sign with eth_sendTransaction
+type localSigners struct {
+	signers     map[string]kldeth.Signer // keyed by lower case address
+	chainIDLock sync.Mutex
+	chainID     *big.Int
+}
+
+func newLocalSigners() *localSigners {
+	return &localSigners{
+		signers: make(map[string]kldeth.Signer),
+	}
+}
+
+// load creates a signer for each account, from the key file configured for it
+func (l *localSigners) load(keyFiles map[string]string) error {
+	for account, keyFile := range keyFiles {
+		address, err := kldutils.StrToAddress("local signer account", account)
+		if err != nil {
+			return err
+		}
+		signer, err := kldeth.NewKeyFileSigner(keyFile)
+		if err != nil {
+			return err
+		}
+		if signer.Address() != address {
+			return fmt.Errorf("Signing key in %s is for account %s, not %s", keyFile, signer.Address().Hex(), address.Hex())
+		}
+		l.signers[strings.ToLower(address.Hex())] = signer
+	}
+	if len(l.signers) > 0 {
+		log.Infof("Loaded local signers for %d accounts", len(l.signers))
+	}
+	return nil
+}
+
+// signerFor returns the local signer for the account, or nil if the node signs for it
+func (l *localSigners) signerFor(from string) kldeth.Signer {
+	return l.signers[from]
+}
+
+// getChainID returns the chain ID to sign for, which is the configured chain ID if
+// set, or otherwise queried from the node the first time it is needed
+func (l *localSigners) getChainID(rpc kldeth.RPCClient, expectedChainID int64) (*big.Int, error) {
+	if expectedChainID != 0 {
+		return big.NewInt(expectedChainID), nil
+	}
+	l.chainIDLock.Lock()
+	defer l.chainIDLock.Unlock()
+	if l.chainID == nil {
+		chainID, err := kldeth.GetChainID(rpc)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to determine the chain ID to sign transactions for: %s", err)
+		}
+		l.chainID = chainID
+	}
+	return l.chainID, nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSigningKey = "8f2a55949038a9610f50fb23b5883af3b4ecb3c3bb792cbcefbd1542c692be63"
+
+func writeTestSigningKey() (keyFile string, address string) {
+	f, _ := ioutil.TempFile("", "ethconnect-key")
+	f.WriteString(testSigningKey)
+	f.Close()
+	key, _ := crypto.HexToECDSA(testSigningKey)
+	return f.Name(), crypto.PubkeyToAddress(key.PublicKey).Hex()
+}
+
+func TestLocalSignersLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, address := writeTestSigningKey()
+	defer os.Remove(keyFile)
+	signers := newLocalSigners()
+	err := signers.load(map[string]string{address: keyFile})
+	assert.NoError(err)
+	assert.NotNil(signers.signerFor(strings.ToLower(address)))
+	assert.Nil(signers.signerFor(strings.ToLower(testFromAddr)))
+}
+
+func TestLocalSignersLoadErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, _ := writeTestSigningKey()
+	defer os.Remove(keyFile)
+
+	err := newLocalSigners().load(map[string]string{"badness": keyFile})
+	assert.Regexp("Supplied value for 'local signer account' is not a valid hex address", err.Error())
+
+	err = newLocalSigners().load(map[string]string{testFromAddr: "/does/not/exist"})
+	assert.Regexp("Failed to load signing key from /does/not/exist", err.Error())
+
+	err = newLocalSigners().load(map[string]string{testFromAddr: keyFile})
+	assert.Regexp("Signing key in .* is for account 0x.*, not "+testFromAddr, err.Error())
+}
+
+func TestLocalSignersChainID(t *testing.T) {
+	assert := assert.New(t)
+
+	signers := newLocalSigners()
+	chainID, err := signers.getChainID(&testRPC{}, 12345)
+	assert.NoError(err)
+	assert.Equal(int64(12345), chainID.Int64())
+
+	rpc := &testRPC{ethChainIDResult: hexutil.Big(*big.NewInt(54321))}
+	chainID, err = signers.getChainID(rpc, 0)
+	assert.NoError(err)
+	assert.Equal(int64(54321), chainID.Int64())
+	chainID, err = signers.getChainID(rpc, 0)
+	assert.Equal(int64(54321), chainID.Int64())
+	assert.Equal([]string{"eth_chainId"}, rpc.calls)
+
+	_, err = newLocalSigners().getChainID(&testRPC{ethChainIDErr: fmt.Errorf("pop")}, 0)
+	assert.EqualError(err, "Unable to determine the chain ID to sign transactions for: pop")
+}
+
+func TestOnSendTransactionMessageLocallySigned(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, address := writeTestSigningKey()
+	defer os.Remove(keyFile)
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.RPC.ExpectedChainID = 12345
+	assert.NoError(msgProcessor.localSigners.load(map[string]string{address: keyFile}))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + address + "\"," +
+		"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionResult:     "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+		ethSendTransactionErr:        fmt.Errorf("pop"),
+		ethGetTransactionCountResult: 10,
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	// The nonce is always assigned by the bridge, and the node is not asked to sign
+	assert.Equal([]string{"eth_getTransactionCount", "eth_sendRawTransaction"}, testRPC.calls)
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "pop")
+}
+
+func TestOnSendTransactionMessageLocallySignedNoChainID(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, address := writeTestSigningKey()
+	defer os.Remove(keyFile)
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.localSigners.load(map[string]string{address: keyFile}))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + address + "\"," +
+		"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+		"  \"gas\":\"123\"," +
+		"  \"nonce\":\"1\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{ethChainIDErr: fmt.Errorf("pop")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Unable to determine the chain ID", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnSendTransactionMessageNodeSigned(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, address := writeTestSigningKey()
+	defer os.Remove(keyFile)
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.localSigners.load(map[string]string{address: keyFile}))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{ethSendTransactionErr: fmt.Errorf("pop")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestInitChainLocalSigners(t *testing.T) {
+	assert := assert.New(t)
+
+	keyFile, address := writeTestSigningKey()
+	defer os.Remove(keyFile)
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Chains = map[string]*ChainConf{
+		"chain2": {URL: "http://chain2:8545", ExpectedChainID: 12345, LocalSigners: map[string]string{address: keyFile}},
+		"chain3": {URL: "http://chain3:8545", LocalSigners: map[string]string{testFromAddr: keyFile}},
+	}
+	msgProcessor.Init(&testRPC{}, 1)
+	assert.NoError(msgProcessor.InitChain("chain2", &testRPC{}))
+	err := msgProcessor.InitChain("chain3", &testRPC{})
+	assert.Regexp("Chain 'chain3': Signing key in .* is for account 0x.*, not "+testFromAddr, err.Error())
+
+	// The signer is only used on the chain it is configured for
+	chainProcessor := msgProcessor.chains["chain2"]
+	assert.NotNil(chainProcessor.localSigners.signerFor(strings.ToLower(address)))
+	assert.Nil(msgProcessor.localSigners.signerFor(strings.ToLower(address)))
+	assert.Equal(int64(12345), chainProcessor.expectedChainID())
+}
@@ -0,0 +1,153 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+var filterCompare = regexp.MustCompile(`^(\w+)\s*(==|!=)\s*(\S.*)$`)
+var filterList = regexp.MustCompile(`^(\w+)\s+(in|not\s+in)\s*\[(.*)\]$`)
+
+// filterHeaders are the request headers a filter can match, by their JSON names
+var filterHeaders = map[string]func(*kldmessages.CommonHeaders) string{
+	"type":     func(h *kldmessages.CommonHeaders) string { return h.MsgType },
+	"id":       func(h *kldmessages.CommonHeaders) string { return h.ID },
+	"account":  func(h *kldmessages.CommonHeaders) string { return h.Account },
+	"tenant":   func(h *kldmessages.CommonHeaders) string { return h.Tenant },
+	"priority": func(h *kldmessages.CommonHeaders) string { return h.Priority },
+	"chain":    func(h *kldmessages.CommonHeaders) string { return h.Chain },
+}
+
+// filterCondition matches a header against a set of values, or everything
+// except those values if negated
+type filterCondition struct {
+	header string
+	values map[string]bool
+	negate bool
+}
+
+// msgFilter selects the messages processed by the bridge, with conditions
+// on the request headers that must all match
+type msgFilter struct {
+	conditions []*filterCondition
+}
+
+// newMsgFilter parses the filter expressions. Returns nil if there are none,
+// so every message is processed
+func newMsgFilter(exprs []string) (*msgFilter, error) {
+	if len(exprs) == 0 {
+		return nil, nil
+	}
+	f := &msgFilter{}
+	for _, expr := range exprs {
+		condition, err := parseFilterCondition(strings.TrimSpace(expr))
+		if err != nil {
+			return nil, err
+		}
+		f.conditions = append(f.conditions, condition)
+	}
+	return f, nil
+}
+
+func parseFilterCondition(expr string) (*filterCondition, error) {
+	condition := &filterCondition{values: make(map[string]bool)}
+	var values []string
+	if match := filterCompare.FindStringSubmatch(expr); match != nil {
+		condition.header = match[1]
+		condition.negate = match[2] == "!="
+		values = []string{match[3]}
+	} else if match := filterList.FindStringSubmatch(expr); match != nil {
+		condition.header = match[1]
+		condition.negate = match[2] != "in"
+		values = strings.Split(match[3], ",")
+	} else {
+		return nil, fmt.Errorf("Invalid filter '%s' (must be 'header == value', 'header != value', 'header in [values]' or 'header not in [values]')", expr)
+	}
+	if _, known := filterHeaders[condition.header]; !known {
+		headers := make([]string, 0, len(filterHeaders))
+		for header := range filterHeaders {
+			headers = append(headers, header)
+		}
+		sort.Strings(headers)
+		return nil, fmt.Errorf("Invalid filter '%s': unknown header '%s' (must be one of %s)", expr, condition.header, strings.Join(headers, ", "))
+	}
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			condition.values[value] = true
+		}
+	}
+	if len(condition.values) == 0 {
+		return nil, fmt.Errorf("Invalid filter '%s': no values", expr)
+	}
+	return condition, nil
+}
+
+// matches returns true if the headers meet all the conditions of the filter
+func (f *msgFilter) matches(headers *kldmessages.CommonHeaders) bool {
+	for _, condition := range f.conditions {
+		value := filterHeaders[condition.header](headers)
+		if condition.values[value] == condition.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// isFiltered returns true for a message that does not match the filter, so is skipped.
+// Messages that cannot be parsed are not filtered, so they get an error reply as usual
+func (k *KafkaBridge) isFiltered(msg *sarama.ConsumerMessage) bool {
+	if k.msgFilter == nil {
+		return false
+	}
+	if err := k.decodeRequest(msg); err != nil {
+		return false
+	}
+	var requestCommon kldmessages.RequestCommon
+	if err := json.Unmarshal(msg.Value, &requestCommon); err != nil {
+		return false
+	}
+	return !k.msgFilter.matches(&requestCommon.Headers)
+}
+
+// skipFiltered completes a filtered message, or our own reply in single topic mode,
+// without a reply. It is called in turn with the other messages read with it, so it
+// is in-flight before any later message can complete, and offsets are committed in order
+func (k *KafkaBridge) skipFiltered(msg *sarama.ConsumerMessage, consumer KafkaConsumer) {
+	k.inFlightCond.L.Lock()
+	defer k.inFlightCond.L.Unlock()
+	ctx := &msgContext{
+		timeReceived: time.Now(),
+		reqOffset:    fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset),
+		saramaMsg:    msg,
+		bridge:       k,
+		filtered:     true,
+	}
+	if _, alreadyInflight := k.inFlight[ctx.reqOffset]; alreadyInflight {
+		return
+	}
+	log.Infof("Skipping message without a reply: Partition=%d Offset=%d", msg.Partition, msg.Offset)
+	k.inFlight[ctx.reqOffset] = ctx
+	k.setInFlightComplete(ctx, consumer)
+}
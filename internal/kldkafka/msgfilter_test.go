@@ -0,0 +1,107 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgFilterMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	filter, err := newMsgFilter([]string{
+		"type in [SendTransaction, DeployContract]",
+		" tenant == tenant1 ",
+		"account not in [0x1,0x2]",
+		"chain != chain2",
+	})
+	assert.NoError(err)
+
+	headers := &kldmessages.CommonHeaders{MsgType: "SendTransaction", Tenant: "tenant1", Account: "0x3"}
+	assert.True(filter.matches(headers))
+	headers.Chain = "chain2"
+	assert.False(filter.matches(headers))
+	headers.Chain = ""
+	headers.Account = "0x2"
+	assert.False(filter.matches(headers))
+	headers.Account = ""
+	headers.Tenant = "tenant2"
+	assert.False(filter.matches(headers))
+	headers.Tenant = "tenant1"
+	headers.MsgType = "GetBalance"
+	assert.False(filter.matches(headers))
+
+	filter, err = newMsgFilter(nil)
+	assert.NoError(err)
+	assert.Nil(filter)
+}
+
+func TestMsgFilterInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	for expr, expected := range map[string]string{
+		"type = SendTransaction":     "Invalid filter 'type = SendTransaction' \\(must be",
+		"type in SendTransaction":    "Invalid filter 'type in SendTransaction' \\(must be",
+		"msgType == SendTransaction": "unknown header 'msgType' \\(must be one of account, chain, id, priority, tenant, type\\)",
+		"type in [ , ]":              "Invalid filter 'type in \\[ , \\]': no values",
+	} {
+		_, err := newMsgFilter([]string{expr})
+		assert.Regexp(expected, err.Error(), expr)
+	}
+}
+
+func TestExecuteBridgeWithBadFilter(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--filter", "badness"))
+	err := kafkaCmd.Execute()
+	assert.Regexp("Invalid filter 'badness'", err.Error())
+}
+
+func TestFilteredMessagesSkipped(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.msgFilter, _ = newMsgFilter([]string{"type == Wanted"})
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"Wanted"}}`), Offset: 0}
+	msgContext1 := <-processor.messages
+
+	// Skipped without a reply, but not committed while an earlier message is in-flight
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"Unwanted"}}`), Offset: 1}
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"Wanted"}}`), Offset: 2}
+	msgContext3 := <-processor.messages
+	assert.Equal(":0:2", msgContext3.(*msgContext).reqOffset)
+	_, marked := mockConsumer.OffsetsByPartition[0]
+	assert.False(marked)
+
+	for _, msgContext := range []MsgContext{msgContext1, msgContext3} {
+		go msgContext.Reply(&kldmessages.ReplyCommon{})
+		replyKafkaMsg := <-mockProducer.MockInput
+		mockProducer.MockSuccesses <- replyKafkaMsg
+	}
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(2), mockConsumer.OffsetsByPartition[0])
+	assert.Empty(k.inFlight)
+}
@@ -17,33 +17,98 @@ package kldkafka
 import (
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/params"
 
 	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
 	"github.com/kaleido-io/ethconnect/internal/kldutils"
 	log "github.com/sirupsen/logrus"
 )
 
+// replacementGasPriceBump is the default percentage increase in gas price for
+// ReplaceTransaction, which is the minimum accepted by geth
+const replacementGasPriceBump = 10
+
 // MsgProcessor interface is called for each message, as is responsible
 // for tracking all in-flight messages
 type MsgProcessor interface {
 	OnMessage(MsgContext)
 	Init(kldeth.RPCClient, int)
+	InitChain(name string, rpc kldeth.RPCClient) error
+	RegisterHandler(msgType string, handler MsgHandler)
+	HasHandler(msgType string) bool
+	ResetNonce(account, chain string) (int, error)
+	DetectGasPricing() (string, error)
 }
 
+// MsgHandler processes a message of the type it is registered for. It must
+// ensure a reply is sent, unless it returns an error (such as failing to
+// unmarshal the message) which is sent as an error reply
+type MsgHandler func(msgContext MsgContext) error
+
 type inflightTxn struct {
 	from            string // normalized to 0x prefix and lower case
 	nodeAssignNonce bool
 	nonce           int64
 	msgContext      MsgContext
 	tx              *kldeth.Txn
+	deadlineBlock   uint64 // zero if using the wall-clock timeout
+	confirmations   int    // before the receipt reply, from the message headers or the bridge default
+	minedBlockHash  *common.Hash
+	seenByNode      bool
+	nonceReset      bool // ignored when predicting nonces, after an operator reset
 	wg              sync.WaitGroup
+	// Replacements submitted by ReplaceTransaction, that the goroutine tracking
+	// this transaction has not yet switched to
+	replacementsLock sync.Mutex
+	replacements     []*kldeth.Txn
+	// Transactions replaced with the same nonce, that might still be mined
+	replacedTXs []*kldeth.Txn
+	// Automatic gas price bumping, from when the latest transaction was submitted
+	lastSubmitted time.Time
+	gasBumps      int
+	gasBumpsDone  bool
+}
+
+// latestTX returns the most recently submitted transaction for the request
+func (i *inflightTxn) latestTX() *kldeth.Txn {
+	i.replacementsLock.Lock()
+	defer i.replacementsLock.Unlock()
+	if len(i.replacements) > 0 {
+		return i.replacements[len(i.replacements)-1]
+	}
+	return i.tx
+}
+
+func (i *inflightTxn) addReplacement(tx *kldeth.Txn) {
+	i.replacementsLock.Lock()
+	i.replacements = append(i.replacements, tx)
+	i.replacementsLock.Unlock()
+}
+
+// applyReplacements switches to tracking the latest replacement, if there are any.
+// Only called on the goroutine tracking the transaction
+func (i *inflightTxn) applyReplacements() {
+	i.replacementsLock.Lock()
+	defer i.replacementsLock.Unlock()
+	for _, replacement := range i.replacements {
+		log.Infof("Tracking replacement %s for %s", replacement.Hash, i)
+		i.replacedTXs = append(i.replacedTXs, i.tx)
+		i.tx = replacement
+		// The node has not seen the replacement yet
+		i.seenByNode = false
+		i.lastSubmitted = time.Now()
+	}
+	i.replacements = nil
 }
 
 func (i *inflightTxn) nonceNumber() json.Number {
@@ -65,51 +130,262 @@ type msgProcessor struct {
 	inflightTxnDelayer TxnDelayTracker
 	rpc                kldeth.RPCClient
 	conf               *KafkaBridgeConf
+	submitSlots        *submitSlots
+	submitLimiter      *submitLimiter
+	receiptPoller      *receiptPoller
+	droppedTXs         *kldmetrics.Counter
+	contractCodeLock   *sync.Mutex
+	contractCodeExpiry map[common.Address]time.Time
+	txTemplates        *txTemplates
+	localSigners       *localSigners
+	auditLog           *auditLog
+	gasOracle          *gasOracle
+	gasPricing         *gasPricing // nil unless detected
+	failureEvents      *failureEvents
+	gasFactors         *gasFactors
+	handlersLock       sync.RWMutex
+	handlers           map[string]MsgHandler
+	txPool             txPoolCache
+	pause              *consumerPause // shared with the bridge, to stop waiting when the consumer stops
+	chain              *ChainConf               // nil for the default chain
+	chainsLock         sync.RWMutex
+	chains             map[string]*msgProcessor // processors for the additional chains
 }
 
 func newMsgProcessor() *msgProcessor {
-	return &msgProcessor{
+	p := &msgProcessor{
 		inflightTxnsLock:   &sync.Mutex{},
 		inflightTxns:       make(map[string][]*inflightTxn),
 		inflightTxnDelayer: NewTxnDelayTracker(),
 		conf:               &KafkaBridgeConf{},
+		droppedTXs:         newDroppedTXsCounter(),
+		contractCodeLock:   &sync.Mutex{},
+		contractCodeExpiry: make(map[common.Address]time.Time),
+		txTemplates:        newTxTemplates(),
+		localSigners:       newLocalSigners(),
+		auditLog:           newAuditLog(),
+		gasOracle:          newGasOracle(),
+		failureEvents:      newFailureEvents(),
+		gasFactors:         newGasFactors(),
+		handlers:           make(map[string]MsgHandler),
+		txPool:             txPoolCache{sleep: time.Sleep},
+		pause:              newConsumerPause(),
 	}
+	p.registerBuiltinHandlers()
+	return p
+}
+
+// RegisterHandler adds the handler for a message type, replacing any existing
+// handler, so new types of message can be processed
+func (p *msgProcessor) RegisterHandler(msgType string, handler MsgHandler) {
+	p.handlersLock.Lock()
+	p.handlers[msgType] = handler
+	p.handlersLock.Unlock()
+}
+
+// HasHandler returns true if a handler is registered for the message type
+func (p *msgProcessor) HasHandler(msgType string) bool {
+	p.handlersLock.RLock()
+	defer p.handlersLock.RUnlock()
+	_, exists := p.handlers[msgType]
+	return exists
+}
+
+// registerBuiltinHandlers registers the handlers for the message types in kldmessages
+func (p *msgProcessor) registerBuiltinHandlers() {
+	p.RegisterHandler(kldmessages.MsgTypeDeployContract, func(msgContext MsgContext) error {
+		var deployContractMsg kldmessages.DeployContract
+		if err := msgContext.Unmarshal(&deployContractMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnDeployContractMessage(msgContext, &deployContractMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeSendTransaction, func(msgContext MsgContext) error {
+		var sendTransactionMsg kldmessages.SendTransaction
+		if err := msgContext.Unmarshal(&sendTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnSendTransactionMessage(msgContext, &sendTransactionMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeSendRawTransaction, func(msgContext MsgContext) error {
+		var sendRawTransactionMsg kldmessages.SendRawTransaction
+		if err := msgContext.Unmarshal(&sendRawTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnSendRawTransactionMessage(msgContext, &sendRawTransactionMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeReplaceTransaction, func(msgContext MsgContext) error {
+		var replaceTransactionMsg kldmessages.ReplaceTransaction
+		if err := msgContext.Unmarshal(&replaceTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnReplaceTransactionMessage(msgContext, &replaceTransactionMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeGetBalance, func(msgContext MsgContext) error {
+		var getBalanceMsg kldmessages.GetBalance
+		if err := msgContext.Unmarshal(&getBalanceMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnGetBalanceMessage(msgContext, &getBalanceMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeGetEvents, func(msgContext MsgContext) error {
+		var getEventsMsg kldmessages.GetEvents
+		if err := msgContext.Unmarshal(&getEventsMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnGetEventsMessage(msgContext, &getEventsMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeGetTransaction, func(msgContext MsgContext) error {
+		var getTransactionMsg kldmessages.GetTransaction
+		if err := msgContext.Unmarshal(&getTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnGetTransactionMessage(msgContext, &getTransactionMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeTraceTransaction, func(msgContext MsgContext) error {
+		var traceTransactionMsg kldmessages.TraceTransaction
+		if err := msgContext.Unmarshal(&traceTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnTraceTransactionMessage(msgContext, &traceTransactionMsg)
+		return nil
+	})
+	p.RegisterHandler(kldmessages.MsgTypeSimulateTransaction, func(msgContext MsgContext) error {
+		var simulateTransactionMsg kldmessages.SimulateTransaction
+		if err := msgContext.Unmarshal(&simulateTransactionMsg); err != nil {
+			return err
+		}
+		p.forChain(msgContext).OnSimulateTransactionMessage(msgContext, &simulateTransactionMsg)
+		return nil
+	})
+}
+
+func newDroppedTXsCounter() *kldmetrics.Counter {
+	return kldmetrics.NewCounter(
+		"ethconnect_transactions_dropped_total",
+		"Transactions that were dropped by the node before being mined, such as by replacement",
+	)
 }
 
 func (p *msgProcessor) Init(rpc kldeth.RPCClient, maxTXWaitTime int) {
 	p.rpc = rpc
 	p.maxTXWaitTime = time.Duration(maxTXWaitTime) * time.Second
+	if p.conf.MaxConcurrentSubmits > 0 {
+		p.submitSlots = newSubmitSlots(p.conf.MaxConcurrentSubmits, p.conf.PriorityOrdering)
+	}
+	p.submitLimiter = newSubmitLimiter(p.conf.SubmitRate, p.conf.SubmitBurst)
+	p.receiptPoller = newReceiptPoller(rpc, p.conf.ReceiptPollInterval, p.conf.ReceiptBatchSize)
+}
+
+// InitChain adds one of the additional chains, that messages are routed to with
+// the chain header. Each chain has its own JSON/RPC connection, local signers and
+// in-flight transactions, so nonces are assigned independently on each chain
+func (p *msgProcessor) InitChain(name string, rpc kldeth.RPCClient) error {
+	chain := p.conf.Chains[name]
+	cp := &msgProcessor{
+		maxTXWaitTime:      p.maxTXWaitTime,
+		inflightTxnsLock:   &sync.Mutex{},
+		inflightTxns:       make(map[string][]*inflightTxn),
+		inflightTxnDelayer: NewTxnDelayTracker(),
+		rpc:                rpc,
+		conf:               p.conf,
+		submitSlots:        p.submitSlots,
+		submitLimiter:      newSubmitLimiter(p.conf.SubmitRate, p.conf.SubmitBurst),
+		receiptPoller:      newReceiptPoller(rpc, p.conf.ReceiptPollInterval, p.conf.ReceiptBatchSize),
+		droppedTXs:         p.droppedTXs,
+		contractCodeLock:   &sync.Mutex{},
+		contractCodeExpiry: make(map[common.Address]time.Time),
+		txTemplates:        p.txTemplates,
+		localSigners:       newLocalSigners(),
+		auditLog:           p.auditLog,
+		gasOracle:          p.gasOracle.forChain(),
+		failureEvents:      p.failureEvents,
+		gasFactors:         p.gasFactors,
+		txPool:             txPoolCache{sleep: p.txPool.sleep},
+		pause:              p.pause,
+		chain:              chain,
+	}
+	if err := cp.localSigners.load(chain.LocalSigners); err != nil {
+		return fmt.Errorf("Chain '%s': %s", name, err)
+	}
+	p.chainsLock.Lock()
+	if p.chains == nil {
+		p.chains = make(map[string]*msgProcessor)
+	}
+	p.chains[name] = cp
+	p.chainsLock.Unlock()
+	return nil
+}
+
+// getChain returns the processor for one of the additional chains. The chains are
+// also read by the admin HTTP handlers, so are only accessed under the chainsLock
+func (p *msgProcessor) getChain(name string) (*msgProcessor, bool) {
+	p.chainsLock.RLock()
+	defer p.chainsLock.RUnlock()
+	cp, exists := p.chains[name]
+	return cp, exists
+}
+
+// forChain returns the processor for the chain in the headers of the message,
+// which is this processor for messages without a chain header
+func (p *msgProcessor) forChain(msgContext MsgContext) *msgProcessor {
+	if cp, exists := p.getChain(msgContext.Headers().Chain); exists {
+		return cp
+	}
+	return p
+}
+
+// expectedChainID returns the chain ID configured for the chain this processor sends to
+func (p *msgProcessor) expectedChainID() int64 {
+	if p.chain != nil {
+		return p.chain.ExpectedChainID
+	}
+	return p.conf.RPC.ExpectedChainID
+}
+
+// acquireSubmitSlot blocks until there are less than MaxConcurrentSubmits
+// transactions being submitted and tracked to completion
+func (p *msgProcessor) acquireSubmitSlot(msgContext MsgContext, from string) {
+	if p.submitSlots != nil {
+		p.submitSlots.acquire(from, msgContext.Headers().Priority == kldmessages.PriorityHigh)
+	}
+}
+
+// releaseSubmitSlot returns a slot acquired with acquireSubmitSlot
+func (p *msgProcessor) releaseSubmitSlot() {
+	if p.submitSlots != nil {
+		p.submitSlots.release()
+	}
 }
 
-// OnMessage checks the type and dispatches to the correct logic
+// OnMessage checks the type and dispatches to the handler registered for it
 // ** From this point on the processor MUST ensure Reply is called
 //    on msgContext eventually in all scenarios.
 //    It cannot return an error synchronously from this function **
 func (p *msgProcessor) OnMessage(msgContext MsgContext) {
 
-	var unmarshalErr error
 	headers := msgContext.Headers()
-	switch headers.MsgType {
-	case kldmessages.MsgTypeDeployContract:
-		var deployContractMsg kldmessages.DeployContract
-		if unmarshalErr = msgContext.Unmarshal(&deployContractMsg); unmarshalErr != nil {
-			break
-		}
-		p.OnDeployContractMessage(msgContext, &deployContractMsg)
-		break
-	case kldmessages.MsgTypeSendTransaction:
-		var sendTransactionMsg kldmessages.SendTransaction
-		if unmarshalErr = msgContext.Unmarshal(&sendTransactionMsg); unmarshalErr != nil {
-			break
-		}
-		p.OnSendTransactionMessage(msgContext, &sendTransactionMsg)
-		break
-	default:
-		unmarshalErr = fmt.Errorf("Unknown message type '%s'", headers.MsgType)
+	p.handlersLock.RLock()
+	handler, exists := p.handlers[headers.MsgType]
+	p.handlersLock.RUnlock()
+	var err error
+	if _, knownChain := p.getChain(headers.Chain); headers.Chain != "" && !knownChain {
+		err = fmt.Errorf("Unknown chain '%s'", headers.Chain)
+	} else if exists {
+		err = handler(msgContext)
+	} else {
+		err = fmt.Errorf("Unsupported message type '%s'", headers.MsgType)
 	}
 	// We must always send a reply
-	if unmarshalErr != nil {
-		msgContext.SendErrorReply(400, unmarshalErr)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
 	}
 
 }
@@ -150,15 +426,17 @@ func (p *msgProcessor) newInflightWrapper(msgContext MsgContext, suppliedFrom st
 	p.inflightTxnsLock.Lock()
 	if inflightForAddr, exists := p.inflightTxns[inflight.from]; exists {
 		for _, inflight := range inflightForAddr {
-			if inflight.nonce > highestNonce {
+			if inflight.nonce > highestNonce && !inflight.nonceReset {
 				highestNonce = inflight.nonce
 			}
 		}
 	}
 	p.inflightTxnsLock.Unlock()
 
-	// If we found a nonce, return one higher.
-	if highestNonce > 0 {
+	// If we found a nonce, return one higher. Unless the account is also used
+	// outside the bridge, in which case the node might know of later nonces
+	refreshNonce := p.isNonceRefreshAccount(inflight.from)
+	if highestNonce > 0 && !refreshNonce {
 		inflight.nonce = highestNonce + 1
 		return
 	}
@@ -167,7 +445,8 @@ func (p *msgProcessor) newInflightWrapper(msgContext MsgContext, suppliedFrom st
 	// If this is a node-signed transaction, then we can ask the node
 	// to simply use the next available nonce.
 	// We provide an override to force the Go code to always assign the nonce.
-	if !p.conf.PredictNonces {
+	// Locally signed transactions must always have the nonce assigned before signing.
+	if highestNonce == 0 && !p.conf.PredictNonces && p.localSigners.signerFor(inflight.from) == nil {
 		inflight.nodeAssignNonce = true
 	} else {
 		// Alternatively (will be required when we support externally signed tranactions)
@@ -178,10 +457,30 @@ func (p *msgProcessor) newInflightWrapper(msgContext MsgContext, suppliedFrom st
 		// (or if gas price is being varied by the submitter the potential of
 		// overwriting a transcation)
 		inflight.nonce, err = kldeth.GetTransactionCount(p.rpc, &from, "pending")
+		if err == nil && highestNonce > 0 {
+			// The node might not yet have all our in-flight transactions in its pool
+			if inflight.nonce <= highestNonce {
+				inflight.nonce = highestNonce + 1
+			} else if inflight.nonce > highestNonce+1 {
+				log.Infof("Nonce %d for %s from the node is ahead of in-flight nonce %d, due to external transactions", inflight.nonce, inflight.from, highestNonce)
+			}
+		}
 	}
 	return
 }
 
+// isNonceRefreshAccount returns true if the pending transaction count must be
+// queried from the node for every transaction of an account, as it is also
+// used outside the bridge
+func (p *msgProcessor) isNonceRefreshAccount(from string) bool {
+	for _, account := range p.conf.NonceRefreshAccounts {
+		if account == from {
+			return true
+		}
+	}
+	return false
+}
+
 // waitForCompletion is the goroutine to track a transaction through
 // to completion and send the result
 func (p *msgProcessor) waitForCompletion(iTX *inflightTxn, initialWaitDelay time.Duration) {
@@ -193,43 +492,72 @@ func (p *msgProcessor) waitForCompletion(iTX *inflightTxn, initialWaitDelay time
 	replyWaitStart := time.Now()
 	time.Sleep(initialWaitDelay)
 
-	var isMined, timedOut bool
+	var isMined, timedOut, dropped bool
 	var err error
 	var retries int
-	var elapsed time.Duration
-	for !isMined && !timedOut {
+	var elapsed, minedElapsed time.Duration
+	for !isMined && !timedOut && !dropped {
 
-		if isMined, err = iTX.tx.GetTXReceipt(p.rpc); err != nil {
+		iTX.applyReplacements()
+		if isMined, err = p.getTXReceipt(iTX); err != nil {
 			// We wait even on connectivity errors, as we've submitted the transaction and
 			// we want to provide a receipt if connectivity resumes within the timeout
 			log.Infof("Failed to get receipt for %s (retries=%d): %s", iTX, retries, err)
 		}
 
-		elapsed = time.Now().Sub(replyWaitStart)
-		timedOut = elapsed > p.maxTXWaitTime
-		if !isMined && !timedOut {
-			// Need to have the inflight lock to calculate the delay, but not
-			// while we're waiting
-			p.inflightTxnsLock.Lock()
-			delayBeforeRetry := p.inflightTxnDelayer.GetRetryDelay(initialWaitDelay, retries+1)
-			p.inflightTxnsLock.Unlock()
+		if err == nil && !isMined && len(iTX.replacedTXs) > 0 {
+			isMined = p.checkReplacedMined(iTX)
+		}
 
+		elapsed = time.Now().Sub(replyWaitStart)
+		if isMined && minedElapsed == 0 {
+			minedElapsed = elapsed
+		}
+		if iTX.confirmations > 0 && err == nil {
+			isMined = p.checkConfirmations(iTX, isMined, iTX.confirmations)
+		}
+		if !isMined && p.conf.DetectDroppedTXs && err == nil {
+			dropped = p.checkDropped(iTX)
+		}
+		if !isMined && !dropped {
+			timedOut = p.checkTimedOut(iTX, elapsed)
+		}
+		if !isMined && !timedOut && !dropped && err == nil {
+			p.checkGasBump(iTX)
+		}
+		if !isMined && !timedOut && !dropped {
 			log.Infof("Recept not available after %.2fs (retries=%d): %s", elapsed.Seconds(), retries, iTX)
-			time.Sleep(delayBeforeRetry)
+			// The shared poller paces the retries, when receipts are polled together
+			if p.receiptPoller == nil {
+				// Need to have the inflight lock to calculate the delay, but not
+				// while we're waiting
+				p.inflightTxnsLock.Lock()
+				delayBeforeRetry := p.inflightTxnDelayer.GetRetryDelay(initialWaitDelay, retries+1)
+				p.inflightTxnsLock.Unlock()
+				time.Sleep(delayBeforeRetry)
+			}
 			retries++
 		}
 	}
 
-	if timedOut {
+	holdOffset := false
+	if dropped {
+		p.droppedTXs.Inc()
+		iTX.msgContext.SendErrorReplyWithTX(410, fmt.Errorf("Transaction dropped by the node before being mined (replaced or evicted)"), iTX.tx.Hash)
+	} else if timedOut {
 		if err != nil {
 			iTX.msgContext.SendErrorReplyWithTX(500, fmt.Errorf("Error obtaining transaction receipt (%d retries): %s", retries, err), iTX.tx.Hash)
+		} else if iTX.minedBlockHash != nil {
+			iTX.msgContext.SendErrorReplyWithTX(504, fmt.Errorf("Timed out waiting for %d confirmations of transaction mined in block %s", iTX.confirmations, iTX.minedBlockHash.Hex()), iTX.tx.Hash)
+		} else if iTX.seenByNode {
+			iTX.msgContext.SendErrorReplyWithTX(504, fmt.Errorf("Timed out waiting for transaction receipt (transaction still pending)"), iTX.tx.Hash)
 		} else {
-			iTX.msgContext.SendErrorReplyWithTX(408, fmt.Errorf("Timed out waiting for transaction receipt"), iTX.tx.Hash)
+			iTX.msgContext.SendErrorReplyWithTX(504, fmt.Errorf("Timed out waiting for transaction receipt"), iTX.tx.Hash)
 		}
 	} else {
 		// Update the stats
 		p.inflightTxnsLock.Lock()
-		p.inflightTxnDelayer.ReportSuccess(elapsed)
+		p.inflightTxnDelayer.ReportSuccess(minedElapsed)
 		p.inflightTxnsLock.Unlock()
 
 		// Build our reply
@@ -268,12 +596,181 @@ func (p *msgProcessor) waitForCompletion(iTX *inflightTxn, initialWaitDelay time
 		if receipt.TransactionIndex != nil {
 			reply.TransactionIndexStr = strconv.FormatUint(uint64(*receipt.TransactionIndex), 10)
 		}
-		iTX.msgContext.Reply(&reply)
+		if iTX.msgContext.Headers().ReturnTxDetails {
+			reply.Transaction = iTX.tx.Details()
+		}
+		if p.conf.GasBump.Interval > 0 {
+			reply.GasBumps = iTX.gasBumps
+			reply.GasPrice = iTX.tx.EthTX.GasPrice().Text(10)
+		}
+		// The reply must not complete the message, if we are holding the offset
+		// until the transaction has more confirmations
+		if holdOffset = p.conf.CommitConfirmations > iTX.confirmations; holdOffset {
+			iTX.msgContext.HoldOffset()
+		}
+		var failureErr error
+		if reply.Headers.MsgType == kldmessages.MsgTypeTransactionSuccess {
+			failureErr = p.checkFailureEvent(iTX.tx)
+		}
+		if failureErr != nil {
+			iTX.msgContext.SendErrorReplyWithTX(failureEventStatus, failureErr, iTX.tx.Hash)
+		} else {
+			iTX.msgContext.Reply(&reply)
+		}
 	}
 
+	p.releaseSubmitSlot()
+	if holdOffset {
+		p.waitForCommitConfirmations(iTX, initialWaitDelay, replyWaitStart)
+		iTX.msgContext.ReleaseOffset()
+	}
 	iTX.wg.Done()
 }
 
+// waitForCommitConfirmations keeps tracking a transaction after the receipt reply,
+// until it has enough confirmations to commit the offset of the request.
+// If a reorg removes the transaction from the chain, we wait for it to be mined
+// again, so the offset is not committed while the transaction might be lost.
+// We only wait until the same timeout (or deadline block) as for the receipt, then
+// send an error reply for the request, and the offset is committed
+func (p *msgProcessor) waitForCommitConfirmations(iTX *inflightTxn, initialWaitDelay time.Duration, replyWaitStart time.Time) {
+	for retries := 0; ; retries++ {
+		isMined, err := iTX.tx.GetTXReceipt(p.rpc)
+		if err != nil {
+			log.Infof("Failed to get receipt to check confirmations for offset commit (retries=%d): %s", retries, err)
+		} else if p.checkConfirmations(iTX, isMined, p.conf.CommitConfirmations) {
+			log.Infof("Transaction has %d confirmations for offset commit: %s", p.conf.CommitConfirmations, iTX)
+			return
+		}
+		if p.checkTimedOut(iTX, time.Now().Sub(replyWaitStart)) {
+			if err != nil {
+				iTX.msgContext.SendErrorReplyWithTX(500, fmt.Errorf("Error obtaining transaction receipt for offset commit (%d retries): %s", retries, err), iTX.tx.Hash)
+			} else if iTX.minedBlockHash != nil {
+				iTX.msgContext.SendErrorReplyWithTX(504, fmt.Errorf("Timed out waiting for %d confirmations for offset commit of transaction mined in block %s", p.conf.CommitConfirmations, iTX.minedBlockHash.Hex()), iTX.tx.Hash)
+			} else {
+				iTX.msgContext.SendErrorReplyWithTX(504, fmt.Errorf("Timed out waiting for %d confirmations for offset commit of transaction no longer mined (reorg)", p.conf.CommitConfirmations), iTX.tx.Hash)
+			}
+			return
+		}
+		p.inflightTxnsLock.Lock()
+		delayBeforeRetry := p.inflightTxnDelayer.GetRetryDelay(initialWaitDelay, retries+1)
+		p.inflightTxnsLock.Unlock()
+		time.Sleep(delayBeforeRetry)
+	}
+}
+
+// checkReplacedMined checks whether a transaction that was replaced was mined
+// instead of its replacement, in which case we track it to completion
+func (p *msgProcessor) checkReplacedMined(iTX *inflightTxn) bool {
+	for _, replacedTX := range iTX.replacedTXs {
+		if isMined, err := replacedTX.GetTXReceipt(p.rpc); err == nil && isMined {
+			log.Warnf("Replaced transaction %s was mined instead of %s", replacedTX.Hash, iTX)
+			iTX.replacementsLock.Lock()
+			iTX.tx = replacedTX
+			iTX.replacementsLock.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// checkTimedOut determines whether we should stop waiting for a receipt.
+// A block deadline takes precedence over the wall-clock timeout, which is
+// only used if we could not find the current block number from the node
+func (p *msgProcessor) checkTimedOut(iTX *inflightTxn, elapsed time.Duration) bool {
+	if iTX.deadlineBlock > 0 {
+		blockNumber, err := kldeth.GetBlockNumber(p.rpc)
+		if err == nil {
+			return blockNumber > iTX.deadlineBlock
+		}
+		log.Warnf("Failed to get block number to check deadline block %d: %s", iTX.deadlineBlock, err)
+	}
+	return elapsed > p.maxTXWaitTime
+}
+
+// checkDropped determines whether a transaction that is not yet mined has
+// been dropped by the node. We only consider it dropped if the node has reported
+// the transaction previously, as it might not have propagated to the node yet
+func (p *msgProcessor) checkDropped(iTX *inflightTxn) bool {
+	isKnown, err := iTX.tx.IsKnownToNode(p.rpc)
+	if err != nil {
+		log.Infof("Failed to check if transaction is known to the node: %s", err)
+		return false
+	}
+	if isKnown {
+		iTX.seenByNode = true
+		return false
+	}
+	if iTX.seenByNode {
+		log.Warnf("Transaction dropped by the node before being mined: %s", iTX)
+		return true
+	}
+	return false
+}
+
+// checkConfirmations determines whether a mined transaction has the required
+// number of blocks on top of it. The receipt is fetched again on each check, so if
+// a reorg moves the transaction to another block, or un-mines it, we start
+// counting again from the block it is now in
+func (p *msgProcessor) checkConfirmations(iTX *inflightTxn, isMined bool, confirmations int) bool {
+	receipt := &iTX.tx.Receipt
+	if !isMined || receipt.BlockHash == nil {
+		if iTX.minedBlockHash != nil {
+			log.Warnf("Transaction no longer mined in block %s (reorg): %s", iTX.minedBlockHash.Hex(), iTX)
+			iTX.minedBlockHash = nil
+		}
+		return false
+	}
+	if iTX.minedBlockHash != nil && *iTX.minedBlockHash != *receipt.BlockHash {
+		log.Warnf("Transaction moved from block %s to %s (reorg): %s", iTX.minedBlockHash.Hex(), receipt.BlockHash.Hex(), iTX)
+	}
+	iTX.minedBlockHash = receipt.BlockHash
+
+	blockNumber, err := kldeth.GetBlockNumber(p.rpc)
+	if err != nil {
+		log.Infof("Failed to get block number to check confirmations: %s", err)
+		return false
+	}
+	minedBlock := receipt.BlockNumber.ToInt().Uint64()
+	if blockNumber < minedBlock+uint64(confirmations) {
+		log.Infof("Mined in block %d, awaiting %d confirmations at block %d: %s", minedBlock, confirmations, blockNumber, iTX)
+		return false
+	}
+	return true
+}
+
+// confirmations returns the confirmations to wait for before the receipt reply.
+// The message headers can override the bridge default, up to the configured maximum
+func (p *msgProcessor) confirmations(msgContext MsgContext) (int, error) {
+	headerConfirmations := msgContext.Headers().Confirmations
+	if headerConfirmations == nil {
+		return p.conf.Confirmations, nil
+	}
+	confirmations := *headerConfirmations
+	if confirmations < 0 {
+		return 0, fmt.Errorf("Confirmations %d must not be negative", confirmations)
+	}
+	if p.conf.MaxConfirmations > 0 && confirmations > p.conf.MaxConfirmations {
+		log.Infof("Requested confirmations %d reduced to the maximum %d", confirmations, p.conf.MaxConfirmations)
+		confirmations = p.conf.MaxConfirmations
+	}
+	return confirmations, nil
+}
+
+// setDeadlineBlock records the block by which the transaction must be mined,
+// if a block based deadline is configured
+func (p *msgProcessor) setDeadlineBlock(inflight *inflightTxn) {
+	if p.conf.TXBlockDeadline <= 0 {
+		return
+	}
+	blockNumber, err := kldeth.GetBlockNumber(p.rpc)
+	if err != nil {
+		log.Warnf("Failed to get block number at submission, using wall-clock timeout: %s", err)
+		return
+	}
+	inflight.deadlineBlock = blockNumber + uint64(p.conf.TXBlockDeadline)
+}
+
 // addInflight adds a transction to the inflight list, and kick off
 // a goroutine to check for its completion and send the result
 func (p *msgProcessor) addInflight(inflight *inflightTxn, tx *kldeth.Txn) {
@@ -281,6 +778,7 @@ func (p *msgProcessor) addInflight(inflight *inflightTxn, tx *kldeth.Txn) {
 	// Add the inflight transaction to our tracking structure
 	p.inflightTxnsLock.Lock()
 	inflight.tx = tx
+	inflight.lastSubmitted = time.Now()
 	inflightForAddr, exists := p.inflightTxns[inflight.from]
 	if !exists {
 		inflightForAddr = []*inflightTxn{}
@@ -295,6 +793,203 @@ func (p *msgProcessor) addInflight(inflight *inflightTxn, tx *kldeth.Txn) {
 
 }
 
+// checkGasLimit enforces the configured gas limit guardrails on a transaction
+func (p *msgProcessor) checkGasLimit(tx *kldeth.Txn) error {
+	gas := tx.EthTX.Gas()
+	if p.conf.MaxGasLimit > 0 && gas > uint64(p.conf.MaxGasLimit) {
+		return fmt.Errorf("Supplied gas %d exceeds the maximum gas limit %d", gas, p.conf.MaxGasLimit)
+	}
+	if p.conf.MinGasLimit > 0 && gas < uint64(p.conf.MinGasLimit) {
+		return fmt.Errorf("Supplied gas %d is below the minimum gas limit %d", gas, p.conf.MinGasLimit)
+	}
+	return nil
+}
+
+// checkBalance verifies the sender can pay for the transaction, which costs up to
+// the gas limit multiplied by the gas price, plus the value. The pending balance
+// is used, so transactions already sent from the account are accounted for.
+// Returns the status for the error reply, as failing to query the balance is
+// not a problem with the request
+func (p *msgProcessor) checkBalance(tx *kldeth.Txn) (int, error) {
+	required := new(big.Int).SetUint64(tx.EthTX.Gas())
+	required.Mul(required, tx.EthTX.GasPrice())
+	required.Add(required, tx.EthTX.Value())
+	if required.Sign() == 0 {
+		return 0, nil
+	}
+	balance, err := kldeth.GetBalance(p.rpc, &tx.From, "pending")
+	if err != nil {
+		return 500, fmt.Errorf("Failed to check the balance of %s: %s", tx.From.Hex(), err)
+	}
+	if balance.Cmp(required) < 0 {
+		shortfall := new(big.Int).Sub(required, balance)
+		return 400, fmt.Errorf("Insufficient funds in %s - the balance of %s wei is %s wei short of the %s wei required for gas and value",
+			tx.From.Hex(), balance.Text(10), shortfall.Text(10), required.Text(10))
+	}
+	return 0, nil
+}
+
+// setDefaultGas sets the gas limit for requests that do not supply one. The gas
+// configured for the method the transaction calls is used if there is one, otherwise
+// the gas is estimated by the node, and multiplied by the factor for the contract.
+// When estimation fails, for example because the transaction reverts, the configured
+// default gas is used if there is one
+func (p *msgProcessor) setDefaultGas(tx *kldeth.Txn) error {
+	selector := tx.MethodSelector()
+	if gas, exists := p.conf.MethodGas[selector]; exists {
+		log.Debugf("Using configured gas %d for method %s", gas, selector)
+		tx.SetGas(uint64(gas))
+		return nil
+	}
+	gas, err := tx.EstimateGas(p.rpc)
+	if err != nil {
+		if p.conf.DefaultGas <= 0 {
+			return err
+		}
+		log.Warnf("%s - using default gas %d", err, p.conf.DefaultGas)
+		tx.SetGas(uint64(p.conf.DefaultGas))
+		return nil
+	}
+	tx.SetGas(p.gasFactors.apply(tx, gas))
+	return nil
+}
+
+// checkContractCode verifies there is contract code at the address the transaction
+// is sent to. Only addresses confirmed to have code are cached, as code is only
+// removed by a self-destruct, while an address without code might have a contract
+// deployed to it at any time
+func (p *msgProcessor) checkContractCode(tx *kldeth.Txn) error {
+	to := tx.EthTX.To()
+	if to == nil {
+		return nil
+	}
+
+	p.contractCodeLock.Lock()
+	expiry, cached := p.contractCodeExpiry[*to]
+	p.contractCodeLock.Unlock()
+	if cached && time.Now().Before(expiry) {
+		return nil
+	}
+
+	hasCode, err := kldeth.HasCode(p.rpc, to)
+	if err != nil {
+		return fmt.Errorf("Failed to check for contract code at %s: %s", to.Hex(), err)
+	}
+	if !hasCode {
+		return fmt.Errorf("Address %s is not a contract (no code deployed)", to.Hex())
+	}
+
+	p.contractCodeLock.Lock()
+	p.contractCodeExpiry[*to] = time.Now().Add(time.Duration(p.conf.ContractCodeCacheTTL) * time.Second)
+	p.contractCodeLock.Unlock()
+	return nil
+}
+
+// checkAccountQueue rejects a transaction if its account already has the maximum
+// number of transactions in-flight, so one account cannot use all of the in-flight
+// capacity with a long chain of transactions
+func (p *msgProcessor) checkAccountQueue(from string) error {
+	if p.conf.MaxQueuedPerAccount <= 0 {
+		return nil
+	}
+	p.inflightTxnsLock.Lock()
+	queued := len(p.inflightTxns[from])
+	p.inflightTxnsLock.Unlock()
+	if queued >= p.conf.MaxQueuedPerAccount {
+		return fmt.Errorf("Account queue full - %s already has %d transactions in-flight", from, queued)
+	}
+	return nil
+}
+
+// sendTransactionCommon performs the checks and submission that are common to all
+// transaction types, then adds the transaction to the inflight list
+func (p *msgProcessor) sendTransactionCommon(msgContext MsgContext, inflightWrapper *inflightTxn, tx *kldeth.Txn) {
+
+	// Overrides only apply to an eth_call, so would not match the transaction that is sent
+	if len(tx.StateOverrides) > 0 {
+		msgContext.SendErrorReply(400, fmt.Errorf("'stateOverrides' can only be used with a SimulateTransaction or TraceTransaction, as they do not apply to a transaction that is sent"))
+		return
+	}
+
+	if err := p.checkAccountQueue(inflightWrapper.from); err != nil {
+		msgContext.SendErrorReply(429, err)
+		return
+	}
+
+	if err := p.checkGasLimit(tx); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+
+	confirmations, err := p.confirmations(msgContext)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	inflightWrapper.confirmations = confirmations
+
+	if p.conf.CheckBalance {
+		if status, err := p.checkBalance(tx); err != nil {
+			msgContext.SendErrorReply(status, err)
+			return
+		}
+	}
+
+	// Hold up the consumer while the pool is congested, rather than replying, so the
+	// message is not committed. Only if the consumer stops first do we give up, leaving
+	// the message to be redelivered after the restart
+	if err := p.waitTxPool(); err != nil {
+		log.Errorf("%s not sent, as the consumer is stopping: %s", msgContext, err)
+		return
+	}
+
+	// Catch reverts before we spend any gas, if requested
+	simulate := p.conf.SimulateBeforeSend
+	if headerSimulate := msgContext.Headers().SimulateBeforeSend; headerSimulate != nil {
+		simulate = *headerSimulate
+	}
+	if simulate {
+		if err := tx.Simulate(p.rpc); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	if signer := p.localSigners.signerFor(inflightWrapper.from); signer != nil {
+		chainID, err := p.localSigners.getChainID(p.rpc, p.expectedChainID())
+		if err != nil {
+			msgContext.SendErrorReply(500, err)
+			return
+		}
+		if err := tx.SignLocally(signer, chainID); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	// Wait for a slot, if we're limiting the transactions being concurrently
+	// submitted and tracked against the node
+	p.acquireSubmitSlot(msgContext, inflightWrapper.from)
+
+	// Then for the submit rate limit, so a backlog is not sent to the node in one burst
+	if err := p.waitSubmitRate(); err != nil {
+		p.releaseSubmitSlot()
+		msgContext.SendErrorReply(429, err)
+		return
+	}
+
+	p.setDeadlineBlock(inflightWrapper)
+
+	if err := tx.Send(p.rpc); err != nil {
+		p.releaseSubmitSlot()
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	p.auditLog.recordTX(AuditEventSubmitted, msgContext, tx, "")
+
+	p.addInflight(inflightWrapper, tx)
+}
+
 func (p *msgProcessor) OnDeployContractMessage(msgContext MsgContext, msg *kldmessages.DeployContract) {
 
 	inflightWrapper, err := p.newInflightWrapper(msgContext, msg.From, msg.Nonce)
@@ -303,23 +998,57 @@ func (p *msgProcessor) OnDeployContractMessage(msgContext MsgContext, msg *kldme
 		return
 	}
 	msg.Nonce = inflightWrapper.nonceNumber()
+	if msg.GasPrice == "" {
+		if msg.GasPrice, err = p.defaultGasPrice(); err != nil {
+			msgContext.SendErrorReply(500, err)
+			return
+		}
+	}
 
 	tx, err := kldeth.NewContractDeployTxn(msg)
 	if err != nil {
 		msgContext.SendErrorReply(400, err)
 		return
 	}
+	if err := p.checkCalldataSize(tx); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
 	tx.NodeAssignNonce = inflightWrapper.nodeAssignNonce
+	if msg.Gas == "" {
+		if err := p.setDefaultGas(tx); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
 
-	if err = tx.Send(p.rpc); err != nil {
+	p.sendTransactionCommon(msgContext, inflightWrapper, tx)
+}
+
+func (p *msgProcessor) OnSendTransactionMessage(msgContext MsgContext, msg *kldmessages.SendTransaction) {
+
+	if err := p.txTemplates.apply(msg); err != nil {
 		msgContext.SendErrorReply(400, err)
 		return
 	}
 
-	p.addInflight(inflightWrapper, tx)
+	if msg.Split != nil && p.conf.MaxCalldataSize > 0 {
+		parts, err := p.splitCalls(msg)
+		if err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+		if len(parts) > 1 {
+			p.sendSplitTransaction(msgContext, msg, parts)
+			return
+		}
+	}
+
+	p.sendTransaction(msgContext, msg)
 }
 
-func (p *msgProcessor) OnSendTransactionMessage(msgContext MsgContext, msg *kldmessages.SendTransaction) {
+// sendTransaction builds and submits the transaction for a SendTransaction message
+func (p *msgProcessor) sendTransaction(msgContext MsgContext, msg *kldmessages.SendTransaction) {
 
 	inflightWrapper, err := p.newInflightWrapper(msgContext, msg.From, msg.Nonce)
 	if err != nil {
@@ -327,18 +1056,466 @@ func (p *msgProcessor) OnSendTransactionMessage(msgContext MsgContext, msg *kldm
 		return
 	}
 	msg.Nonce = inflightWrapper.nonceNumber()
+	if msg.GasPrice == "" {
+		if msg.GasPrice, err = p.defaultGasPrice(); err != nil {
+			msgContext.SendErrorReply(500, err)
+			return
+		}
+	}
 
 	tx, err := kldeth.NewSendTxn(msg)
 	if err != nil {
 		msgContext.SendErrorReply(400, err)
 		return
 	}
+	if err := p.checkCalldataSize(tx); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
 	tx.NodeAssignNonce = inflightWrapper.nodeAssignNonce
 
-	if err = tx.Send(p.rpc); err != nil {
+	if msg.Gas == "" {
+		if err := p.setDefaultGas(tx); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	if p.conf.CheckContractCode {
+		if err := p.checkContractCode(tx); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	p.sendTransactionCommon(msgContext, inflightWrapper, tx)
+}
+
+// OnSendRawTransactionMessage submits a transaction that was signed by the client.
+// The nonce is part of the signed transaction, so no nonce management is performed,
+// but we still track it in-flight so it is counted when predicting later nonces
+func (p *msgProcessor) OnSendRawTransactionMessage(msgContext MsgContext, msg *kldmessages.SendRawTransaction) {
+
+	tx, err := kldeth.NewRawTxn(msg)
+	if err != nil {
 		msgContext.SendErrorReply(400, err)
 		return
 	}
+	if err = p.checkRawTxnFrom(msg, tx); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	inflightWrapper := &inflightTxn{
+		msgContext: msgContext,
+		from:       strings.ToLower(tx.From.Hex()),
+		nonce:      int64(tx.EthTX.Nonce()),
+	}
 
-	p.addInflight(inflightWrapper, tx)
+	p.sendTransactionCommon(msgContext, inflightWrapper, tx)
+}
+
+// checkRawTxnFrom compares the account that signed a pre-signed transaction with
+// the 'from' account of the request, if supplied. The transaction can only be sent
+// from the account that signed it, so a mismatch is rejected if strict, otherwise
+// we warn and send it from the signing account
+func (p *msgProcessor) checkRawTxnFrom(msg *kldmessages.SendRawTransaction, tx *kldeth.Txn) error {
+	if msg.From == "" {
+		return nil
+	}
+	from, err := kldutils.StrToAddress("from", msg.From)
+	if err != nil {
+		return err
+	}
+	if from == tx.From {
+		return nil
+	}
+	if p.conf.StrictFrom {
+		return fmt.Errorf("Transaction is signed by %s, not the requested 'from' account %s", tx.From.Hex(), from.Hex())
+	}
+	log.Warnf("Pre-signed transaction %s is signed by %s, not the requested 'from' account %s", tx.EthTX.Hash().Hex(), tx.From.Hex(), from.Hex())
+	return nil
+}
+
+// findInflight finds the in-flight transaction submitted for a request
+func (p *msgProcessor) findInflight(from, requestID string) *inflightTxn {
+	p.inflightTxnsLock.Lock()
+	defer p.inflightTxnsLock.Unlock()
+	for _, inflight := range p.inflightTxns[from] {
+		if inflight.msgContext.Headers().ID == requestID {
+			return inflight
+		}
+	}
+	return nil
+}
+
+// replacementGasPrice returns the gas price supplied for a replacement, or the gas
+// price of the transaction being replaced plus replacementGasPriceBump percent.
+// Nodes reject replacements that do not increase the gas price by enough
+func replacementGasPrice(tx *kldeth.Txn, suppliedGasPrice json.Number) (*big.Int, error) {
+	oldGasPrice := tx.EthTX.GasPrice()
+	var gasPrice *big.Int
+	if suppliedGasPrice != "" {
+		var ok bool
+		if gasPrice, ok = new(big.Int).SetString(suppliedGasPrice.String(), 10); !ok {
+			return nil, fmt.Errorf("Converting supplied 'gasPrice' to big integer")
+		}
+	} else {
+		gasPrice = new(big.Int).Mul(oldGasPrice, big.NewInt(100+replacementGasPriceBump))
+		gasPrice.Div(gasPrice, big.NewInt(100))
+	}
+	if gasPrice.Cmp(oldGasPrice) <= 0 {
+		return nil, fmt.Errorf("Gas price %s for the replacement must be higher than the gas price %s of the transaction being replaced", gasPrice.Text(10), oldGasPrice.Text(10))
+	}
+	return gasPrice, nil
+}
+
+// OnReplaceTransactionMessage resubmits the pending transaction of an earlier request
+// with the same nonce and a higher gas price, such as when it is stuck underpriced.
+// The original request gets the receipt of whichever transaction is mined
+func (p *msgProcessor) OnReplaceTransactionMessage(msgContext MsgContext, msg *kldmessages.ReplaceTransaction) {
+
+	from, err := kldutils.StrToAddress("from", msg.From)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	if msg.RequestID == "" {
+		msgContext.SendErrorReply(400, fmt.Errorf("The 'requestId' of the transaction to replace must be supplied"))
+		return
+	}
+	inflight := p.findInflight(strings.ToLower(from.Hex()), msg.RequestID)
+	if inflight == nil {
+		msgContext.SendErrorReply(404, fmt.Errorf("No transaction in-flight from %s for request '%s'", from.Hex(), msg.RequestID))
+		return
+	}
+	tx := inflight.latestTX()
+
+	// Check it's still pending, and get the nonce in case it was assigned by the node
+	nodeTX, err := tx.GetFromNode(p.rpc)
+	if err != nil {
+		msgContext.SendErrorReply(500, fmt.Errorf("Failed to get transaction %s from the node: %s", tx.Hash, err))
+		return
+	}
+	if nodeTX == nil {
+		msgContext.SendErrorReply(410, fmt.Errorf("Transaction %s is no longer known to the node", tx.Hash))
+		return
+	}
+	if nodeTX.BlockNumber != nil {
+		msgContext.SendErrorReply(409, fmt.Errorf("Transaction %s has already been mined", tx.Hash))
+		return
+	}
+
+	gasPrice, err := replacementGasPrice(tx, msg.GasPrice)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	replacement, err := tx.NewReplacement(uint64(nodeTX.Nonce), gasPrice)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	if err := p.waitSubmitRate(); err != nil {
+		msgContext.SendErrorReply(429, err)
+		return
+	}
+	if err := replacement.Send(p.rpc); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	p.auditLog.recordTX(AuditEventReplaced, msgContext, replacement, tx.Hash)
+	inflight.addReplacement(replacement)
+
+	var reply kldmessages.TransactionReplaced
+	reply.Headers.MsgType = kldmessages.MsgTypeTransactionReplaced
+	reply.RequestID = msg.RequestID
+	reply.From = from.Hex()
+	reply.Nonce = strconv.FormatUint(uint64(nodeTX.Nonce), 10)
+	reply.GasPrice = gasPrice.Text(10)
+	reply.OriginalTransactionHash = tx.Hash
+	reply.TransactionHash = replacement.Hash
+	msgContext.Reply(&reply)
+}
+
+// weiToEther formats a wei value as decimal ether, without trailing zeros
+func weiToEther(wei *big.Int) string {
+	ether := new(big.Rat).SetFrac(wei, big.NewInt(params.Ether)).FloatString(18)
+	ether = strings.TrimRight(ether, "0")
+	return strings.TrimSuffix(ether, ".")
+}
+
+// OnGetBalanceMessage is a read-only query, so is answered synchronously
+// without any nonce or in-flight transaction tracking
+func (p *msgProcessor) OnGetBalanceMessage(msgContext MsgContext, msg *kldmessages.GetBalance) {
+
+	addr, err := kldutils.StrToAddress("address", msg.Address)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+
+	blockNumber := msg.BlockNumber
+	if blockNumber == "" {
+		blockNumber = "latest"
+	} else if blockNumber != "latest" && blockNumber != "earliest" && blockNumber != "pending" {
+		var blockNumberInt big.Int
+		if _, ok := blockNumberInt.SetString(blockNumber, 10); !ok || blockNumberInt.Sign() < 0 {
+			msgContext.SendErrorReply(400, fmt.Errorf("Supplied value for 'blockNumber' is not a valid block number or tag: %s", msg.BlockNumber))
+			return
+		}
+		blockNumber = hexutil.EncodeBig(&blockNumberInt)
+	}
+
+	balance, err := kldeth.GetBalance(p.rpc, &addr, blockNumber)
+	if err != nil {
+		msgContext.SendErrorReply(500, err)
+		return
+	}
+
+	var reply kldmessages.Balance
+	reply.Headers.MsgType = kldmessages.MsgTypeBalance
+	reply.Address = addr.Hex()
+	reply.BlockNumber = msg.BlockNumber
+	if reply.BlockNumber == "" {
+		reply.BlockNumber = blockNumber
+	}
+	reply.BalanceStr = balance.Text(10)
+	reply.BalanceHex = (*hexutil.Big)(balance)
+	reply.BalanceEther = weiToEther(balance)
+	msgContext.Reply(&reply)
+}
+
+// parseEventsBlock resolves a block number or tag in a GetEvents request, returning
+// the status for the error reply if it fails. The latest block is only queried
+// from the node if needed
+func (p *msgProcessor) parseEventsBlock(field, block string, latestByDefault bool) (uint64, int, error) {
+	if block == "latest" || (block == "" && latestByDefault) {
+		latest, err := kldeth.GetBlockNumber(p.rpc)
+		if err != nil {
+			return 0, 500, fmt.Errorf("Failed to get the latest block number: %s", err)
+		}
+		return latest, 0, nil
+	}
+	if block == "" || block == "earliest" {
+		return 0, 0, nil
+	}
+	blockNumber, err := strconv.ParseUint(block, 10, 64)
+	if err != nil {
+		return 0, 400, fmt.Errorf("Supplied value for '%s' is not a valid block number or tag: %s", field, block)
+	}
+	return blockNumber, 0, nil
+}
+
+// OnGetEventsMessage is a read-only query, so like GetBalance is answered synchronously
+func (p *msgProcessor) OnGetEventsMessage(msgContext MsgContext, msg *kldmessages.GetEvents) {
+
+	addr, err := kldutils.StrToAddress("address", msg.Address)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+
+	event, err := kldeth.NewEventABI(&msg.Event)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+
+	fromBlock, status, err := p.parseEventsBlock("fromBlock", msg.FromBlock, false)
+	if err != nil {
+		msgContext.SendErrorReply(status, err)
+		return
+	}
+	toBlock, status, err := p.parseEventsBlock("toBlock", msg.ToBlock, true)
+	if err != nil {
+		msgContext.SendErrorReply(status, err)
+		return
+	}
+	if fromBlock > toBlock {
+		msgContext.SendErrorReply(400, fmt.Errorf("Supplied 'fromBlock' %d is after 'toBlock' %d", fromBlock, toBlock))
+		return
+	}
+
+	eventLogs, err := kldeth.GetEvents(p.rpc, &addr, event, fromBlock, toBlock)
+	if err != nil {
+		msgContext.SendErrorReply(500, err)
+		return
+	}
+
+	var reply kldmessages.Events
+	reply.Headers.MsgType = kldmessages.MsgTypeEvents
+	reply.Address = addr.Hex()
+	reply.Event = event.Name
+	reply.FromBlock = strconv.FormatUint(fromBlock, 10)
+	reply.ToBlock = strconv.FormatUint(toBlock, 10)
+	reply.Events = make([]*kldmessages.Event, len(eventLogs))
+	for i, eventLog := range eventLogs {
+		reply.Events[i] = &kldmessages.Event{
+			BlockNumber:      strconv.FormatUint(eventLog.BlockNumber, 10),
+			BlockHash:        eventLog.BlockHash.Hex(),
+			TransactionHash:  eventLog.TxHash.Hex(),
+			TransactionIndex: strconv.FormatUint(uint64(eventLog.TxIndex), 10),
+			LogIndex:         strconv.FormatUint(uint64(eventLog.Index), 10),
+			Data:             eventLog.Data,
+		}
+	}
+	msgContext.Reply(&reply)
+}
+
+// OnGetTransactionMessage is a read-only query, so like GetBalance is answered synchronously.
+// The input is decoded against the ABI supplied, then the methods of any transaction
+// templates for the same contract
+func (p *msgProcessor) OnGetTransactionMessage(msgContext MsgContext, msg *kldmessages.GetTransaction) {
+
+	hash, err := hexutil.Decode(msg.TransactionHash)
+	if err != nil || len(hash) != common.HashLength {
+		msgContext.SendErrorReply(400, fmt.Errorf("Supplied value for 'transactionHash' is not a valid transaction hash: %s", msg.TransactionHash))
+		return
+	}
+
+	methods, err := kldeth.NewMethodABIs(msg.ABI)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+
+	txn, err := kldeth.GetTransactionByHash(p.rpc, common.BytesToHash(hash).Hex())
+	if err != nil {
+		msgContext.SendErrorReply(500, err)
+		return
+	}
+	if txn == nil {
+		msgContext.SendErrorReply(404, fmt.Errorf("Transaction %s not found", common.BytesToHash(hash).Hex()))
+		return
+	}
+
+	var reply kldmessages.Transaction
+	reply.Headers.MsgType = kldmessages.MsgTypeTransaction
+	reply.TransactionHash = common.BytesToHash(hash).Hex()
+	if txn.BlockNumber != nil {
+		reply.BlockNumber = txn.BlockNumber.ToInt().Text(10)
+	}
+	if txn.BlockHash != nil {
+		reply.BlockHash = txn.BlockHash.Hex()
+	}
+	if txn.TransactionIndex != nil {
+		reply.TransactionIndex = strconv.FormatUint(uint64(*txn.TransactionIndex), 10)
+	}
+	reply.From = txn.From.Hex()
+	if txn.To != nil {
+		reply.To = txn.To.Hex()
+		methods = append(methods, p.txTemplates.methodsFor(*txn.To)...)
+	}
+	reply.Nonce = strconv.FormatUint(uint64(txn.Nonce), 10)
+	reply.Value = "0"
+	if txn.Value != nil {
+		reply.Value = txn.Value.ToInt().Text(10)
+	}
+	reply.Gas = strconv.FormatUint(uint64(txn.Gas), 10)
+	reply.GasPrice = "0"
+	if txn.GasPrice != nil {
+		reply.GasPrice = txn.GasPrice.ToInt().Text(10)
+	}
+	reply.Input = hexutil.Encode(txn.Input)
+	reply.DecodedInput = kldeth.DecodeTxnInput(methods, txn.Input)
+	msgContext.Reply(&reply)
+}
+
+// OnTraceTransactionMessage is a read-only query, so like GetBalance is answered synchronously.
+// The transaction is built as for a SendTransaction, then traced on the node rather than sent.
+// Tracing is expensive for the node, so must be enabled in the configuration
+func (p *msgProcessor) OnTraceTransactionMessage(msgContext MsgContext, msg *kldmessages.TraceTransaction) {
+
+	if !p.conf.AllowTracing {
+		msgContext.SendErrorReply(403, fmt.Errorf("Tracing transactions is not enabled on this bridge"))
+		return
+	}
+
+	profile := msg.Profile
+	if profile == "" {
+		profile = kldmessages.GasProfileCalls
+	} else if profile != kldmessages.GasProfileCalls && profile != kldmessages.GasProfileOpcodes {
+		msgContext.SendErrorReply(400, fmt.Errorf("Supplied value for 'profile' must be '%s' or '%s': %s", kldmessages.GasProfileCalls, kldmessages.GasProfileOpcodes, msg.Profile))
+		return
+	}
+
+	if err := p.txTemplates.apply(&msg.SendTransaction); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	var err error
+	if msg.GasPrice == "" {
+		if msg.GasPrice, err = p.defaultGasPrice(); err != nil {
+			msgContext.SendErrorReply(500, err)
+			return
+		}
+	}
+
+	tx, err := kldeth.NewSendTxn(&msg.SendTransaction)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	// The node uses the next nonce of the account, unless one is supplied
+	tx.NodeAssignNonce = msg.Nonce == ""
+	if msg.Gas == "" {
+		if err := p.setDefaultGas(tx); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	reply, err := tx.TraceCall(p.rpc, profile)
+	if err != nil {
+		msgContext.SendErrorReply(500, err)
+		return
+	}
+	reply.Headers.MsgType = kldmessages.MsgTypeGasProfile
+	msgContext.Reply(reply)
+}
+
+// OnSimulateTransactionMessage is a read-only query, so like TraceTransaction is answered
+// synchronously. The transaction is built as for a SendTransaction, then run with eth_call
+// rather than sent, so is the way to simulate "what-if" scenarios with state overrides
+func (p *msgProcessor) OnSimulateTransactionMessage(msgContext MsgContext, msg *kldmessages.SimulateTransaction) {
+
+	if err := p.txTemplates.apply(&msg.SendTransaction); err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	var err error
+	if msg.GasPrice == "" {
+		if msg.GasPrice, err = p.defaultGasPrice(); err != nil {
+			msgContext.SendErrorReply(500, err)
+			return
+		}
+	}
+
+	tx, err := kldeth.NewSendTxn(&msg.SendTransaction)
+	if err != nil {
+		msgContext.SendErrorReply(400, err)
+		return
+	}
+	// The node uses the next nonce of the account, unless one is supplied
+	tx.NodeAssignNonce = msg.Nonce == ""
+	if msg.Gas == "" {
+		if err := p.setDefaultGas(tx); err != nil {
+			msgContext.SendErrorReply(400, err)
+			return
+		}
+	}
+
+	output, err := tx.Call(p.rpc)
+	if err != nil {
+		status := 500
+		if _, reverted := err.(*kldeth.RevertError); reverted {
+			status = 400
+		}
+		msgContext.SendErrorReply(status, err)
+		return
+	}
+	var reply kldmessages.SimulationResult
+	reply.Headers.MsgType = kldmessages.MsgTypeSimulationResult
+	reply.Output = output.String()
+	msgContext.Reply(&reply)
 }
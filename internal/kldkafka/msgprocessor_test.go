@@ -27,6 +27,8 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
 	log "github.com/sirupsen/logrus"
@@ -44,6 +46,9 @@ type testMsgContext struct {
 	badMsgType  string
 	replies     []kldmessages.ReplyWithHeaders
 	errorRepies []*errorReply
+	// Whether the offset was held after the reply, and then released
+	offsetHeld     bool
+	offsetReleased bool
 }
 
 type testRPC struct {
@@ -53,6 +58,32 @@ type testRPC struct {
 	ethGetTransactionCountErr      error
 	ethGetTransactionReceiptResult kldeth.TxnReceipt
 	ethGetTransactionReceiptErr    error
+	ethGetBalanceResult            hexutil.Big
+	ethGetBalanceErr               error
+	ethChainIDResult               hexutil.Big
+	ethChainIDErr                  error
+	ethGasPriceResult              hexutil.Big
+	ethGasPriceErr                 error
+	ethCallResult                  hexutil.Bytes
+	ethCallErr                     error
+	ethEstimateGasResult           hexutil.Uint64
+	ethEstimateGasErr              error
+	ethBlockNumberResult           hexutil.Uint64
+	ethBlockNumberStep             hexutil.Uint64
+	ethBlockNumberErr              error
+	ethGetTransactionByHashKnown   int // number of calls that find the transaction, before it is dropped
+	ethGetTransactionByHashResult  string
+	ethGetCodeResult               hexutil.Bytes
+	ethGetCodeErr                  error
+	ethGetLogsResult               []types.Log
+	ethGetLogsErr                  error
+	netPeerCountResult             hexutil.Uint64
+	netPeerCountErr                error
+	ethSyncingResult               json.RawMessage
+	txPoolStatusResult             kldeth.TxPoolStatus
+	txPoolStatusErr                error
+	debugTraceCallResult           string
+	debugTraceCallErr              error
 	calls                          []string
 }
 
@@ -75,7 +106,7 @@ var goodSendTxnJSON = "{" +
 
 func (r *testRPC) CallContext(ctx context.Context, result interface{}, method string, args ...interface{}) error {
 	r.calls = append(r.calls, method)
-	if method == "eth_sendTransaction" {
+	if method == "eth_sendTransaction" || method == "eth_sendRawTransaction" {
 		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethSendTransactionResult))
 		return r.ethSendTransactionErr
 	} else if method == "eth_getTransactionCount" {
@@ -84,6 +115,55 @@ func (r *testRPC) CallContext(ctx context.Context, result interface{}, method st
 	} else if method == "eth_getTransactionReceipt" {
 		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetTransactionReceiptResult))
 		return r.ethGetTransactionReceiptErr
+	} else if method == "eth_getBalance" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetBalanceResult))
+		return r.ethGetBalanceErr
+	} else if method == "eth_call" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethCallResult))
+		return r.ethCallErr
+	} else if method == "eth_estimateGas" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethEstimateGasResult))
+		return r.ethEstimateGasErr
+	} else if method == "eth_blockNumber" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethBlockNumberResult))
+		r.ethBlockNumberResult += r.ethBlockNumberStep
+		return r.ethBlockNumberErr
+	} else if method == "eth_getTransactionByHash" {
+		txn := "null"
+		if r.ethGetTransactionByHashKnown > 0 {
+			r.ethGetTransactionByHashKnown--
+			txn = `{"hash":"0x0"}`
+			if r.ethGetTransactionByHashResult != "" {
+				txn = r.ethGetTransactionByHashResult
+			}
+		}
+		return json.Unmarshal([]byte(txn), result)
+	} else if method == "eth_getCode" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetCodeResult))
+		return r.ethGetCodeErr
+	} else if method == "eth_getLogs" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGetLogsResult))
+		return r.ethGetLogsErr
+	} else if method == "net_peerCount" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.netPeerCountResult))
+		return r.netPeerCountErr
+	} else if method == "eth_syncing" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethSyncingResult))
+		return nil
+	} else if method == "eth_chainId" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethChainIDResult))
+		return r.ethChainIDErr
+	} else if method == "eth_gasPrice" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.ethGasPriceResult))
+		return r.ethGasPriceErr
+	} else if method == "txpool_status" {
+		reflect.ValueOf(result).Elem().Set(reflect.ValueOf(r.txPoolStatusResult))
+		return r.txPoolStatusErr
+	} else if method == "debug_traceCall" {
+		if r.debugTraceCallErr != nil {
+			return r.debugTraceCallErr
+		}
+		return json.Unmarshal([]byte(r.debugTraceCallResult), result)
 	}
 	panic(fmt.Errorf("method unknown to test: %s", method))
 }
@@ -103,6 +183,10 @@ func (c *testMsgContext) Headers() *kldmessages.CommonHeaders {
 	return &commonMsg.Headers
 }
 
+func (c *testMsgContext) KafkaHeader(key string) string {
+	return ""
+}
+
 func (c *testMsgContext) Unmarshal(msg interface{}) error {
 	log.Infof("Unmarshaling test message: %s", c.jsonMsg)
 	return json.Unmarshal([]byte(c.jsonMsg), msg)
@@ -126,6 +210,14 @@ func (c *testMsgContext) Reply(replyMsg kldmessages.ReplyWithHeaders) {
 	c.replies = append(c.replies, replyMsg)
 }
 
+func (c *testMsgContext) HoldOffset() {
+	c.offsetHeld = true
+}
+
+func (c *testMsgContext) ReleaseOffset() {
+	c.offsetReleased = true
+}
+
 func TestOnMessageBadMessage(t *testing.T) {
 	assert := assert.New(t)
 
@@ -139,7 +231,42 @@ func TestOnMessageBadMessage(t *testing.T) {
 	assert.Empty(testMsgContext.replies)
 	assert.NotEmpty(testMsgContext.errorRepies)
 	assert.Equal(400, testMsgContext.errorRepies[0].status)
-	assert.Regexp("Unknown message type", testMsgContext.errorRepies[0].err.Error())
+	assert.Regexp("Unsupported message type 'badness'", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnMessageCustomHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.RegisterHandler("Custom", func(msgContext MsgContext) error {
+		var reply kldmessages.ReplyCommon
+		reply.Headers.MsgType = "CustomReply"
+		msgContext.Reply(&reply)
+		return nil
+	})
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = `{"headers":{"type":"Custom"}}`
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal("CustomReply", testMsgContext.replies[0].ReplyHeaders().MsgType)
+}
+
+func TestOnMessageHandlerError(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	// Replace a built-in handler
+	msgProcessor.RegisterHandler(kldmessages.MsgTypeGetBalance, func(msgContext MsgContext) error {
+		return fmt.Errorf("pop")
+	})
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = `{"headers":{"type":"GetBalance"}}`
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.replies)
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "pop")
 }
 
 func TestOnDeployContractMessageBadMsg(t *testing.T) {
@@ -427,64 +554,2002 @@ func TestOnSendTransactionMessageTxnTimeout(t *testing.T) {
 
 }
 
-func TestOnSendTransactionMessageFailedTxn(t *testing.T) {
+func TestOnSendTransactionMessageTxnBlockDeadline(t *testing.T) {
 	assert := assert.New(t)
 
+	txHash := "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
 	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.TXBlockDeadline = 2
 	testMsgContext := &testMsgContext{}
 	testMsgContext.jsonMsg = goodSendTxnJSON
 	testRPC := &testRPC{
-		ethSendTransactionErr: fmt.Errorf("pop"),
+		ethSendTransactionResult: txHash,
+		ethBlockNumberResult:     100,
+		ethBlockNumberStep:       1,
 	}
 	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 0 // would time out immediately, if not for the block deadline
 
 	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(uint64(102), inflight.deadlineBlock)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Regexp("Timed out waiting for transaction receipt", testMsgContext.errorRepies[0].err.Error())
 
-	assert.Equal("pop", testMsgContext.errorRepies[0].err.Error())
-	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+	// Submission block 100, then blocks 101 and 102 are within the deadline, and 103 is past it
+	assert.Equal([]string{
+		"eth_blockNumber",
+		"eth_sendTransaction",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+	}, testRPC.calls)
 }
 
-func TestOnSendTransactionMessageFailedToGetNonce(t *testing.T) {
+func TestOnSendTransactionMessageTxnBlockDeadlineFallback(t *testing.T) {
 	assert := assert.New(t)
 
 	msgProcessor := newMsgProcessor()
-	msgProcessor.conf.PredictNonces = true
+	msgProcessor.conf.TXBlockDeadline = 2
 	testMsgContext := &testMsgContext{}
-	testMsgContext.jsonMsg = "{" +
-		"  \"headers\":{\"type\": \"SendTransaction\"}," +
-		"  \"from\":\"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1\"" +
-		"}"
+	testMsgContext.jsonMsg = goodSendTxnJSON
 	testRPC := &testRPC{
-		ethGetTransactionCountErr: fmt.Errorf("poof"),
+		ethSendTransactionResult: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+		ethBlockNumberErr:        fmt.Errorf("pop"),
 	}
 	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
 
 	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(uint64(0), inflight.deadlineBlock)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Regexp("Timed out waiting for transaction receipt", testMsgContext.errorRepies[0].err.Error())
+}
 
-	assert.Equal("poof", testMsgContext.errorRepies[0].err.Error())
-	assert.EqualValues([]string{"eth_getTransactionCount"}, testRPC.calls)
+func TestOnSendTransactionMessageConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Confirmations = 2
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12345 // the block the receipt is in
+	testRPC.ethBlockNumberStep = 1
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 5 * time.Second
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(0, len(testMsgContext.errorRepies))
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.Equal([]string{
+		"eth_sendTransaction",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+	}, testRPC.calls)
 }
 
-func TestOnSendTransactionMessageInflightNonce(t *testing.T) {
+func TestOnSendTransactionMessageConfirmationsTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Confirmations = 2
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12345 // the block the receipt is in, which never advances
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(0, len(testMsgContext.replies))
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(504, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Timed out waiting for 2 confirmations of transaction mined in block 0x", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnSendTransactionMessageHeaderConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Confirmations = 2
+	msgProcessor.conf.MaxConfirmations = 3
+	testMsgContext1 := &testMsgContext{}
+	testMsgContext1.jsonMsg = strings.Replace(goodSendTxnJSON, `"type": "SendTransaction"`, `"type": "SendTransaction","confirmations":0`, 1)
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	// No confirmations are requested, so we reply on the first receipt
+	msgProcessor.OnMessage(testMsgContext1)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(0, inflight.confirmations)
+	assert.Equal(1, len(testMsgContext1.replies))
+	assert.Equal([]string{"eth_sendTransaction", "eth_getTransactionReceipt"}, testRPC.calls)
+
+	// More than the maximum are requested, so we wait for the maximum
+	msgProcessor = newMsgProcessor()
+	msgProcessor.conf.MaxConfirmations = 3
+	testMsgContext2 := &testMsgContext{}
+	testMsgContext2.jsonMsg = strings.Replace(goodSendTxnJSON, `"type": "SendTransaction"`, `"type": "SendTransaction","confirmations":12`, 1)
+	testRPC = goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12345 // the block the receipt is in
+	testRPC.ethBlockNumberStep = 1
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 5 * time.Second
+
+	msgProcessor.OnMessage(testMsgContext2)
+	inflight = msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(3, inflight.confirmations)
+	assert.Equal(1, len(testMsgContext2.replies))
+	assert.Equal([]string{
+		"eth_sendTransaction",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+	}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageNegativeConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = strings.Replace(goodSendTxnJSON, `"type": "SendTransaction"`, `"type": "SendTransaction","confirmations":-1`, 1)
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Confirmations -1 must not be negative")
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnSendTransactionMessageCommitConfirmations(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CommitConfirmations = 2
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12345 // the block the receipt is in
+	testRPC.ethBlockNumberStep = 1
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 5 * time.Second
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(0, len(testMsgContext.errorRepies))
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.True(testMsgContext.offsetHeld)
+	assert.True(testMsgContext.offsetReleased)
+	// The reply is sent on the first receipt, and the offset released after the confirmations
+	assert.Equal([]string{
+		"eth_sendTransaction",
+		"eth_getTransactionReceipt",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+		"eth_getTransactionReceipt", "eth_blockNumber",
+	}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageCommitConfirmationsTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CommitConfirmations = 2
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12345 // the block the receipt is in, which never advances
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	// The receipt reply is followed by an error reply, then the offset is released
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(504, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Timed out waiting for 2 confirmations for offset commit of transaction mined in block 0x", testMsgContext.errorRepies[0].err.Error())
+	assert.True(testMsgContext.offsetReleased)
+}
+
+func TestOnSendTransactionMessageCommitConfirmationsNotAboveReply(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Confirmations = 1
+	msgProcessor.conf.CommitConfirmations = 1
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12346
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0]
+	inflight.wg.Wait()
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.False(testMsgContext.offsetHeld)
+}
+
+func TestCheckConfirmationsReorg(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Confirmations = 1
+	testRPC := goodMessageRPC()
+	testRPC.ethBlockNumberResult = 12346
+	msgProcessor.Init(testRPC, 1)
+	inflight := &inflightTxn{msgContext: &testMsgContext{}}
+	inflight.tx, _ = kldeth.NewSendTxn(&kldmessages.SendTransaction{})
+	inflight.tx.Receipt = testRPC.ethGetTransactionReceiptResult
+	originalBlock := *inflight.tx.Receipt.BlockHash
+
+	// Confirmed in the original block
+	assert.True(msgProcessor.checkConfirmations(inflight, true, 1))
+	assert.Equal(originalBlock, *inflight.minedBlockHash)
+
+	// Un-mined by a reorg
+	inflight.tx.Receipt = kldeth.TxnReceipt{}
+	assert.False(msgProcessor.checkConfirmations(inflight, false, 1))
+	assert.Nil(inflight.minedBlockHash)
+
+	// Re-mined in a later block, so the confirmations start again
+	newBlockHash := common.HexToHash("0x7c6d389b27c57a0f5e4792712f1dd61a733230e3188511a6f59e0559c2c06352")
+	newBlockNumber := hexutil.Big(*big.NewInt(12346))
+	inflight.tx.Receipt.BlockHash = &newBlockHash
+	inflight.tx.Receipt.BlockNumber = &newBlockNumber
+	assert.False(msgProcessor.checkConfirmations(inflight, true, 1))
+	assert.Equal(newBlockHash, *inflight.minedBlockHash)
+
+	testRPC.ethBlockNumberResult = 12347
+	assert.True(msgProcessor.checkConfirmations(inflight, true, 1))
+}
+
+func TestOnSendRawTransactionMessageMined(t *testing.T) {
 	assert := assert.New(t)
 
 	msgProcessor := newMsgProcessor()
-	msgProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"] =
-		[]*inflightTxn{&inflightTxn{nonce: 100}, &inflightTxn{nonce: 101}}
 	testMsgContext := &testMsgContext{}
 	testMsgContext.jsonMsg = "{" +
-		"  \"headers\":{\"type\": \"SendTransaction\"}," +
-		"  \"from\":\"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1\"," +
+		"  \"headers\":{\"type\": \"SendRawTransaction\"}," +
+		"  \"rawTransaction\":\"0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1\"" +
+		"}"
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflight := msgProcessor.inflightTxns["0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"][0]
+	inflight.wg.Wait()
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal([]string{"eth_sendRawTransaction", "eth_getTransactionReceipt"}, testRPC.calls)
+	assert.Equal(int64(5), inflight.nonce)
+	replyMsg := testMsgContext.replies[0].(*kldmessages.TransactionReceipt)
+	assert.Equal("TransactionSuccess", replyMsg.Headers.MsgType)
+	assert.Equal("5", replyMsg.NonceStr)
+	assert.Nil(replyMsg.Transaction)
+}
+
+func TestOnSendRawTransactionMessageReturnTxDetails(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendRawTransaction\", \"returnTxDetails\": true}," +
+		"  \"rawTransaction\":\"0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1\"" +
+		"}"
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns["0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"][0].wg.Wait()
+
+	replyMsg := testMsgContext.replies[0].(*kldmessages.TransactionReceipt)
+	assert.Equal(&kldmessages.TransactionDetails{
+		From:     "0x2c7536E3605D9C16a7a3D7b1898e529396a65c23",
+		To:       "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		Nonce:    "5",
+		Gas:      "21000",
+		GasPrice: "0",
+		Value:    "0",
+		Data:     "0x",
+		Signed:   true,
+	}, replyMsg.Transaction)
+}
+
+func TestOnSendTransactionMessageReturnTxDetails(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"returnTxDetails\": true}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
 		"  \"gas\":\"123\"," +
+		"  \"gasPrice\":\"456\"," +
+		"  \"value\":\"789\"," +
 		"  \"method\":{\"name\":\"test\"}" +
 		"}"
-	testRPC := &testRPC{
-		ethSendTransactionResult: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg.Wait()
+
+	// The nonce was assigned by the node, so is not included
+	replyMsg := testMsgContext.replies[0].(*kldmessages.TransactionReceipt)
+	assert.Equal(&kldmessages.TransactionDetails{
+		From:     testFromAddr,
+		To:       "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		Gas:      "123",
+		GasPrice: "456",
+		Value:    "789",
+		Data:     "0xf8a8fd6d",
+	}, replyMsg.Transaction)
+}
+
+func TestOnSendRawTransactionMessageBadTxn(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendRawTransaction\"}," +
+		"  \"rawTransaction\":\"0x1234\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("not an RLP encoded transaction", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnSendRawTransactionMessageFromMismatch(t *testing.T) {
+	assert := assert.New(t)
+
+	newTestRawTxnMsgContext := func(from string) *testMsgContext {
+		return &testMsgContext{jsonMsg: "{" +
+			"  \"headers\":{\"type\": \"SendRawTransaction\"}," +
+			"  \"from\":\"" + from + "\"," +
+			"  \"rawTransaction\":\"0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1\"" +
+			"}"}
 	}
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StrictFrom = true
+	testRPC := goodMessageRPC()
 	msgProcessor.Init(testRPC, 1)
 
+	testMsgContext := newTestRawTxnMsgContext(testFromAddr)
+	msgProcessor.OnMessage(testMsgContext)
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Transaction is signed by 0x2c7536E3605D9C16a7a3D7b1898e529396a65c23, not the requested 'from' account "+testFromAddr)
+
+	testMsgContext = newTestRawTxnMsgContext("bad")
 	msgProcessor.OnMessage(testMsgContext)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Supplied value for 'from' is not a valid hex address")
+	assert.Empty(testRPC.calls)
 
+	// Without strict matching the transaction is sent from the account that signed it
+	msgProcessor.conf.StrictFrom = false
+	testMsgContext = newTestRawTxnMsgContext(testFromAddr)
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns["0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"][0].wg.Wait()
 	assert.Empty(testMsgContext.errorRepies)
-	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+	assert.Equal("eth_sendRawTransaction", testRPC.calls[0])
+}
+
+func TestOnSendRawTransactionMessageFromMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StrictFrom = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendRawTransaction\"}," +
+		"  \"from\":\"0x2c7536e3605d9c16a7a3d7b1898e529396a65c23\"," +
+		"  \"rawTransaction\":\"0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1\"" +
+		"}"
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns["0x2c7536e3605d9c16a7a3d7b1898e529396a65c23"][0].wg.Wait()
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal("TransactionSuccess", testMsgContext.replies[0].ReplyHeaders().MsgType)
+}
+
+func TestOnSendTransactionMessageTxnDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	txHash := "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.DetectDroppedTXs = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		ethSendTransactionResult:     txHash,
+		ethGetTransactionByHashKnown: 1,
+	}
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 5 * time.Second
+
+	msgProcessor.OnMessage(testMsgContext)
+	txnWG := &msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg
+	txnWG.Wait()
+
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(410, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Transaction dropped by the node before being mined", testMsgContext.errorRepies[0].err.Error())
+	assert.Equal(txHash, testMsgContext.errorRepies[0].txHash)
+	assert.Equal(uint64(1), msgProcessor.droppedTXs.Value())
+	assert.Equal([]string{
+		"eth_sendTransaction",
+		"eth_getTransactionReceipt", "eth_getTransactionByHash",
+		"eth_getTransactionReceipt", "eth_getTransactionByHash",
+	}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageTxnTimeoutStillPending(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.DetectDroppedTXs = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		ethSendTransactionResult:     "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+		ethGetTransactionByHashKnown: 1000,
+	}
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext)
+	txnWG := &msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg
+	txnWG.Wait()
+
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.Equal(504, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Timed out waiting for transaction receipt \\(transaction still pending\\)", testMsgContext.errorRepies[0].err.Error())
+	assert.Equal(uint64(0), msgProcessor.droppedTXs.Value())
+}
+
+func TestOnSendTransactionMessageFailedTxn(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		ethSendTransactionErr: fmt.Errorf("pop"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal("pop", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageFailedToGetNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.PredictNonces = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1\"" +
+		"}"
+	testRPC := &testRPC{
+		ethGetTransactionCountErr: fmt.Errorf("poof"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal("poof", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_getTransactionCount"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageInflightNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"] =
+		[]*inflightTxn{&inflightTxn{nonce: 100}, &inflightTxn{nonce: 101}}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionResult: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestNewInflightWrapperNonceRefreshAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.NonceRefreshAccounts = []string{"0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"}
+	testRPC := &testRPC{
+		ethGetTransactionCountResult: 110,
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	// With nothing in-flight the node can still assign the nonce
+	inflight, err := msgProcessor.newInflightWrapper(&testMsgContext{}, "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", "")
+	assert.NoError(err)
+	assert.True(inflight.nodeAssignNonce)
+	assert.Empty(testRPC.calls)
+
+	// External transactions moved the nonce on beyond those in-flight
+	msgProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"] =
+		[]*inflightTxn{&inflightTxn{nonce: 100}, &inflightTxn{nonce: 101}}
+	inflight, err = msgProcessor.newInflightWrapper(&testMsgContext{}, "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", "")
+	assert.NoError(err)
+	assert.False(inflight.nodeAssignNonce)
+	assert.Equal(int64(110), inflight.nonce)
+	assert.EqualValues([]string{"eth_getTransactionCount"}, testRPC.calls)
+
+	// The node has not yet seen all the transactions in-flight
+	testRPC.ethGetTransactionCountResult = 90
+	inflight, err = msgProcessor.newInflightWrapper(&testMsgContext{}, "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", "")
+	assert.NoError(err)
+	assert.Equal(int64(102), inflight.nonce)
+
+	// Other accounts are predicted from those in-flight
+	msgProcessor.inflightTxns["0x2b8c0ecc76d0759a8f50b2e14a6881367d805832"] = []*inflightTxn{&inflightTxn{nonce: 5}}
+	inflight, err = msgProcessor.newInflightWrapper(&testMsgContext{}, "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", "")
+	assert.NoError(err)
+	assert.Equal(int64(6), inflight.nonce)
+	assert.Equal(2, len(testRPC.calls))
+}
+
+func TestNewInflightWrapperNonceRefreshAccountFailed(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.NonceRefreshAccounts = []string{"0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"}
+	msgProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"] = []*inflightTxn{&inflightTxn{nonce: 100}}
+	testRPC := &testRPC{
+		ethGetTransactionCountErr: fmt.Errorf("poof"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	_, err := msgProcessor.newInflightWrapper(&testMsgContext{}, "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", "")
+	assert.EqualError(err, "poof")
+}
+
+func TestOnSendTransactionMessageExceedsMaxGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxGasLimit = 100
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Supplied gas 123 exceeds the maximum gas limit 100", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnSendTransactionMessageBelowMinGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MinGasLimit = 200
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Supplied gas 123 is below the minimum gas limit 200", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+const noGasSendTxnJSON = "{" +
+	"  \"headers\":{\"type\": \"SendTransaction\"}," +
+	"  \"from\":\"" + testFromAddr + "\"," +
+	"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+	"  \"method\":{\"name\":\"test\"}" +
+	"}"
+
+func TestOnSendTransactionMessageMethodGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MethodGas = map[string]int{"0xf8a8fd6d": 54321}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = noGasSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal(uint64(54321), tx.EthTX.Gas())
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageMethodGasSuppliedGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MethodGas = map[string]int{"0xf8a8fd6d": 54321}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnToContractJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal(uint64(123), tx.EthTX.Gas())
+}
+
+func TestOnSendTransactionMessageMethodGasUnknownMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MethodGas = map[string]int{"0x12345678": 54321}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = noGasSendTxnJSON
+	testRPC := &testRPC{ethEstimateGasResult: 45678}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_estimateGas", "eth_sendTransaction"}, testRPC.calls)
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal(uint64(45678), tx.EthTX.Gas())
+}
+
+func TestOnSendTransactionMessageEstimateGasFactor(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, test := range []struct {
+		contractFactors map[string]float64
+		expected        uint64
+	}{
+		{nil, 60000},
+		{map[string]float64{"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832": 2}, 80000},
+		{map[string]float64{"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1": 2}, 60000},
+	} {
+		msgProcessor := newMsgProcessor()
+		assert.NoError(msgProcessor.gasFactors.init(1.5, test.contractFactors))
+		testMsgContext := &testMsgContext{}
+		testMsgContext.jsonMsg = noGasSendTxnJSON
+		testRPC := &testRPC{ethEstimateGasResult: 40000}
+		msgProcessor.Init(testRPC, 1)
+
+		msgProcessor.OnMessage(testMsgContext)
+
+		assert.Empty(testMsgContext.errorRepies)
+		tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+		assert.Equal(test.expected, tx.EthTX.Gas())
+	}
+}
+
+func TestOnSendTransactionMessageEstimateGasFailsDefaultGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.DefaultGas = 65432
+	msgProcessor.gasFactors.init(2, nil)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = noGasSendTxnJSON
+	testRPC := &testRPC{ethEstimateGasErr: fmt.Errorf("execution reverted")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal(uint64(65432), tx.EthTX.Gas())
+}
+
+func TestOnSendTransactionMessageEstimateGasFailsNoDefaultGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = noGasSendTxnJSON
+	testRPC := &testRPC{ethEstimateGasErr: fmt.Errorf("execution reverted")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Failed to estimate gas: execution reverted")
+	assert.EqualValues([]string{"eth_estimateGas"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageMethodGasBelowMinGas(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MethodGas = map[string]int{"0xf8a8fd6d": 100}
+	msgProcessor.conf.MinGasLimit = 200
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = noGasSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Regexp("Supplied gas 100 is below the minimum gas limit 200", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnSendTransactionMessageStaticGasPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StaticGasPrice = "1000000000"
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal("1000000000", tx.EthTX.GasPrice().String())
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+const fundedSendTxnJSON = "{" +
+	"  \"headers\":{\"type\": \"SendTransaction\"}," +
+	"  \"from\":\"" + testFromAddr + "\"," +
+	"  \"gas\":\"123\"," +
+	"  \"gasPrice\":\"1000\"," +
+	"  \"value\":\"5\"," +
+	"  \"method\":{\"name\":\"test\"}" +
+	"}"
+
+func TestOnSendTransactionMessageCheckBalanceOK(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckBalance = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = fundedSendTxnJSON
+	testRPC := &testRPC{}
+	testRPC.ethGetBalanceResult.ToInt().SetInt64(123005)
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_getBalance", "eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageCheckBalanceInsufficient(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckBalance = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = fundedSendTxnJSON
+	testRPC := &testRPC{}
+	testRPC.ethGetBalanceResult.ToInt().SetInt64(100000)
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Insufficient funds in "+testFromAddr+
+		" - the balance of 100000 wei is 23005 wei short of the 123005 wei required for gas and value")
+	assert.EqualValues([]string{"eth_getBalance"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageCheckBalanceFails(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckBalance = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = fundedSendTxnJSON
+	testRPC := &testRPC{ethGetBalanceErr: fmt.Errorf("pop")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Failed to check the balance of "+testFromAddr+": pop")
+}
+
+func TestOnSendTransactionMessageCheckBalanceFree(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckBalance = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	// No gas price or value, so there is nothing to pay for
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+const goodSendTxnToContractJSON = "{" +
+	"  \"headers\":{\"type\": \"SendTransaction\"}," +
+	"  \"from\":\"" + testFromAddr + "\"," +
+	"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+	"  \"gas\":\"123\"," +
+	"  \"method\":{\"name\":\"test\"}" +
+	"}"
+
+func TestOnSendTransactionMessageCheckContractCodeCached(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckContractCode = true
+	msgProcessor.conf.ContractCodeCacheTTL = 300
+	testRPC := &testRPC{
+		ethGetCodeResult: hexutil.Bytes{0x60, 0x80},
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	for i := 0; i < 2; i++ {
+		testMsgContext := &testMsgContext{}
+		testMsgContext.jsonMsg = goodSendTxnToContractJSON
+		msgProcessor.OnMessage(testMsgContext)
+		assert.Empty(testMsgContext.errorRepies)
+	}
+
+	assert.EqualValues([]string{"eth_getCode", "eth_sendTransaction", "eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageCheckContractCodeExpired(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckContractCode = true
+	testRPC := &testRPC{
+		ethGetCodeResult: hexutil.Bytes{0x60, 0x80},
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	for i := 0; i < 2; i++ {
+		testMsgContext := &testMsgContext{}
+		testMsgContext.jsonMsg = goodSendTxnToContractJSON
+		msgProcessor.OnMessage(testMsgContext)
+		assert.Empty(testMsgContext.errorRepies)
+	}
+
+	assert.EqualValues([]string{"eth_getCode", "eth_sendTransaction", "eth_getCode", "eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageNotAContract(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckContractCode = true
+	msgProcessor.conf.ContractCodeCacheTTL = 300
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnToContractJSON
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Address 0x2b8c0ECc76d0759a8F50b2E14A6881367D805832 is not a contract (no code deployed)", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_getCode"}, testRPC.calls)
+	assert.Empty(msgProcessor.contractCodeExpiry)
+}
+
+func TestOnSendTransactionMessageCheckContractCodeFail(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.CheckContractCode = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnToContractJSON
+	testRPC := &testRPC{
+		ethGetCodeErr: fmt.Errorf("pop"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Failed to check for contract code at 0x2b8c0ECc76d0759a8F50b2E14A6881367D805832: pop", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnSendTransactionMessageGasPriceOverridesStatic(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.StaticGasPrice = "1000000000"
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"gasPrice\":\"0\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	tx := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].tx
+	assert.Equal("0", tx.EthTX.GasPrice().String())
+}
+
+func TestOnSendTransactionMessageSimulateReverts(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.SimulateBeforeSend = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		// Error(string) encoding of "not allowed"
+		ethCallResult: common.FromHex("0x08c379a0" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"000000000000000000000000000000000000000000000000000000000000000b" +
+			"6e6f7420616c6c6f776564000000000000000000000000000000000000000000"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Transaction reverted in simulation: not allowed", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_call"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageSimulateOKThenSend(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"simulateBeforeSend\": true}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionErr: fmt.Errorf("pop"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal("pop", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_call", "eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageSimulateDisabledInHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.SimulateBeforeSend = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"simulateBeforeSend\": false}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionErr: fmt.Errorf("pop"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageStateOverridesRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"simulateBeforeSend\": true}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}," +
+		"  \"stateOverrides\":{\"" + testFromAddr + "\":{\"balance\":\"100\"}}" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("'stateOverrides' can only be used with a SimulateTransaction or TraceTransaction", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnSendTransactionMessageUnknownTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"template\":\"transfer\"," +
+		"  \"templateArgs\":{\"amount\":\"1\"}" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Unknown transaction template 'transfer'", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnSendTransactionMessageAccountQueueFull(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxQueuedPerAccount = 1
+	msgProcessor.inflightTxns[strings.ToLower(testFromAddr)] = []*inflightTxn{{nonce: 10}}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(429, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Account queue full - .* already has 1 transactions in-flight", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestCheckAccountQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.inflightTxns["0x1"] = []*inflightTxn{{}, {}}
+	assert.NoError(msgProcessor.checkAccountQueue("0x1"))
+
+	msgProcessor.conf.MaxQueuedPerAccount = 3
+	assert.NoError(msgProcessor.checkAccountQueue("0x1"))
+	assert.NoError(msgProcessor.checkAccountQueue("0x2"))
+
+	msgProcessor.inflightTxns["0x1"] = append(msgProcessor.inflightTxns["0x1"], &inflightTxn{})
+	assert.Error(msgProcessor.checkAccountQueue("0x1"))
+}
+
+func TestOnGetBalanceMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"" + testFromAddr + "\"" +
+		"}"
+	testRPC := &testRPC{}
+	testRPC.ethGetBalanceResult.ToInt().SetString("1234500000000000000", 10)
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_getBalance"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.Balance)
+	assert.Equal(kldmessages.MsgTypeBalance, reply.Headers.MsgType)
+	assert.Equal(testFromAddr, reply.Address)
+	assert.Equal("latest", reply.BlockNumber)
+	assert.Equal("1234500000000000000", reply.BalanceStr)
+	assert.Equal("1.2345", reply.BalanceEther)
+}
+
+func TestOnGetBalanceMessageAtBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"" + testFromAddr + "\"," +
+		"  \"blockNumber\":\"12345\"" +
+		"}"
+	testRPC := &testRPC{}
+	testRPC.ethGetBalanceResult.ToInt().SetString("2000000000000000000", 10)
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	reply := testMsgContext.replies[0].(*kldmessages.Balance)
+	assert.Equal("12345", reply.BlockNumber)
+	assert.Equal("2", reply.BalanceEther)
+}
+
+func TestOnGetBalanceMessageBadAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"badness\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Supplied value for 'address' is not a valid hex address", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnGetBalanceMessageBadBlockNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"" + testFromAddr + "\"," +
+		"  \"blockNumber\":\"badness\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("not a valid block number or tag", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetBalanceMessageNegativeBlockNumber(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"" + testFromAddr + "\"," +
+		"  \"blockNumber\":\"-1\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Supplied value for 'blockNumber' is not a valid block number or tag: -1", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnGetBalanceMessageRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetBalance\"}," +
+		"  \"address\":\"" + testFromAddr + "\"" +
+		"}"
+	testRPC := &testRPC{ethGetBalanceErr: fmt.Errorf("pop")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Equal("pop", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnSendTransactionMessageMaxConcurrentSubmits(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxConcurrentSubmits = 1
+	testMsgContext1 := &testMsgContext{}
+	testMsgContext1.jsonMsg = goodSendTxnJSON
+	testMsgContext2 := &testMsgContext{}
+	testMsgContext2.jsonMsg = goodSendTxnJSON
+	testRPC := &testRPC{
+		ethSendTransactionResult: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+	}
+	msgProcessor.Init(testRPC, 1)
+	msgProcessor.maxTXWaitTime = 250 * time.Millisecond
+
+	msgProcessor.OnMessage(testMsgContext1)
+	secondSubmitted := make(chan bool)
+	go func() {
+		msgProcessor.OnMessage(testMsgContext2)
+		secondSubmitted <- true
+	}()
+
+	// The second cannot submit until the first completes
+	txnWG := &msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg
+	select {
+	case <-secondSubmitted:
+		assert.Fail("Second transaction submitted while first in-flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	txnWG.Wait()
+	assert.Equal(1, len(testMsgContext1.errorRepies))
+	<-secondSubmitted
+
+	msgProcessor.inflightTxnsLock.Lock()
+	txnWG = &msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][1].wg
+	msgProcessor.inflightTxnsLock.Unlock()
+	txnWG.Wait()
+	assert.Equal(1, len(testMsgContext2.errorRepies))
+	assert.Equal(1, msgProcessor.submitSlots.free)
+}
+
+const testGetEventsABI = "  \"event\":{\"name\":\"Changed\",\"inputs\":[" +
+	"{\"name\":\"by\",\"type\":\"address\",\"indexed\":true}," +
+	"{\"name\":\"value\",\"type\":\"uint256\"}]}"
+
+func testGetEventsJSON(blockRange string) string {
+	return "{" +
+		"  \"headers\":{\"type\": \"GetEvents\"}," +
+		"  \"address\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+		blockRange +
+		testGetEventsABI +
+		"}"
+}
+
+func TestOnGetEventsMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("")
+	eventID := common.BytesToHash(crypto.Keccak256([]byte("Changed(address,uint256)")))
+	testRPC := &testRPC{
+		ethBlockNumberResult: 100,
+		ethGetLogsResult: []types.Log{
+			{
+				Topics:      []common.Hash{eventID, common.BytesToHash(common.HexToAddress(testFromAddr).Bytes())},
+				Data:        common.LeftPadBytes([]byte{0x30, 0x39}, 32),
+				BlockNumber: 42,
+				TxHash:      common.HexToHash("0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"),
+				TxIndex:     3,
+				Index:       7,
+			},
+		},
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_blockNumber", "eth_getLogs"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.Events)
+	assert.Equal(kldmessages.MsgTypeEvents, reply.Headers.MsgType)
+	assert.Equal("Changed", reply.Event)
+	assert.Equal("0", reply.FromBlock)
+	assert.Equal("100", reply.ToBlock)
+	assert.Equal(1, len(reply.Events))
+	assert.Equal("42", reply.Events[0].BlockNumber)
+	assert.Equal("3", reply.Events[0].TransactionIndex)
+	assert.Equal("7", reply.Events[0].LogIndex)
+	assert.Equal(testFromAddr, reply.Events[0].Data["by"])
+	assert.Equal("12345", reply.Events[0].Data["value"])
+}
+
+func TestOnGetEventsMessageBlockRange(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("\"fromBlock\":\"10\",\"toBlock\":\"20\",")
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_getLogs"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.Events)
+	assert.Equal("10", reply.FromBlock)
+	assert.Equal("20", reply.ToBlock)
+	assert.Empty(reply.Events)
+}
+
+func TestOnGetEventsMessageBadAddress(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetEvents\"}," +
+		"  \"address\":\"badness\"" +
+		"}"
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("address", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetEventsMessageMissingEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetEvents\"}," +
+		"  \"address\":\"" + testFromAddr + "\"" +
+		"}"
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Event missing - must provide an ABI in 'event'", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetEventsMessageBadBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("\"fromBlock\":\"pending\",")
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Supplied value for 'fromBlock' is not a valid block number or tag: pending", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetEventsMessageBadRange(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("\"fromBlock\":\"20\",\"toBlock\":\"10\",")
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Supplied 'fromBlock' 20 is after 'toBlock' 10", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetEventsMessageLatestBlockFail(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("\"fromBlock\":\"latest\",")
+	msgProcessor.Init(&testRPC{ethBlockNumberErr: fmt.Errorf("pop")}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Equal("Failed to get the latest block number: pop", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnGetEventsMessageGetLogsFail(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetEventsJSON("\"toBlock\":\"10\",")
+	msgProcessor.Init(&testRPC{ethGetLogsErr: fmt.Errorf("pop")}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Equal("pop", testMsgContext.errorRepies[0].err.Error())
+}
+
+func testGetTransactionJSON(abiJSON string) string {
+	return "{" +
+		"  \"headers\":{\"type\": \"GetTransaction\"}," +
+		abiJSON +
+		"  \"transactionHash\":\"0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b\"" +
+		"}"
+}
+
+func testGetTransactionRPC() *testRPC {
+	input := append(crypto.Keccak256([]byte("set(uint256)"))[0:4], common.LeftPadBytes([]byte{0x30, 0x39}, 32)...)
+	return &testRPC{
+		ethGetTransactionByHashKnown: 1,
+		ethGetTransactionByHashResult: `{` +
+			`"blockHash":"0x1fc3c9bd9cd8d5fa2bd9fbcbb7ad2fdb4cd82edbea1d8ce1ecb56a9ae8e2e0f3",` +
+			`"blockNumber":"0x2a","transactionIndex":"0x3",` +
+			`"from":"` + strings.ToLower(testFromAddr) + `","to":"0x2b8c0ecc76d0759a8f50b2e14a6881367d805832",` +
+			`"nonce":"0x7b","value":"0x0","gas":"0x5208","gasPrice":"0x3e8",` +
+			`"input":"` + hexutil.Encode(input) + `"}`,
+	}
+}
+
+func TestOnGetTransactionMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetTransactionJSON(
+		"\"abi\":[" +
+			"{\"type\":\"event\",\"name\":\"Changed\",\"inputs\":[]}," +
+			"{\"type\":\"function\",\"name\":\"set\",\"inputs\":[{\"name\":\"value\",\"type\":\"uint256\"}],\"outputs\":[]}" +
+			"],")
+	testRPC := testGetTransactionRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_getTransactionByHash"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.Transaction)
+	assert.Equal(kldmessages.MsgTypeTransaction, reply.Headers.MsgType)
+	assert.Equal("0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b", reply.TransactionHash)
+	assert.Equal("42", reply.BlockNumber)
+	assert.Equal("3", reply.TransactionIndex)
+	assert.Equal(testFromAddr, reply.From)
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", reply.To)
+	assert.Equal("123", reply.Nonce)
+	assert.Equal("21000", reply.Gas)
+	assert.Equal("1000", reply.GasPrice)
+	assert.Equal("set", reply.DecodedInput.Method)
+	assert.Equal("set(uint256)", reply.DecodedInput.Signature)
+	assert.Equal("12345", reply.DecodedInput.Params["value"])
+}
+
+func TestOnGetTransactionMessageNoMatchingMethod(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetTransactionJSON("\"abi\":[{\"name\":\"get\",\"inputs\":[],\"outputs\":[]}],")
+	testRPC := testGetTransactionRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	reply := testMsgContext.replies[0].(*kldmessages.Transaction)
+	assert.Nil(reply.DecodedInput)
+	assert.Equal("0x60fe47b1", reply.Input[0:10])
+}
+
+func TestOnGetTransactionMessageTemplateABI(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.txTemplates.templates["setValue"] = &TxTemplate{
+		To: "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832",
+		Method: kldmessages.ABIMethod{
+			Name:   "set",
+			Inputs: []kldmessages.ABIParam{{Name: "newValue", Type: "uint256"}},
+		},
+	}
+	msgProcessor.txTemplates.templates["other"] = &TxTemplate{
+		To: "0xAA8B6b6F0a2f8E6c5e1ab6C6f0a1B4e0B7e1F0c3",
+		Method: kldmessages.ABIMethod{
+			Name:   "set",
+			Inputs: []kldmessages.ABIParam{{Name: "otherValue", Type: "uint256"}},
+		},
+	}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetTransactionJSON("")
+	testRPC := testGetTransactionRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	reply := testMsgContext.replies[0].(*kldmessages.Transaction)
+	assert.Equal("12345", reply.DecodedInput.Params["newValue"])
+}
+
+func TestOnGetTransactionMessageBadHash(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"GetTransaction\"}," +
+		"  \"transactionHash\":\"0x1234\"" +
+		"}"
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Regexp("Supplied value for 'transactionHash' is not a valid transaction hash: 0x1234", testMsgContext.errorRepies[0].err.Error())
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+}
+
+func TestOnGetTransactionMessageBadABI(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetTransactionJSON("\"abi\":[{\"name\":\"set\",\"inputs\":[{\"name\":\"value\",\"type\":\"badness\"}],\"outputs\":[]}],")
+	testRPC := testGetTransactionRPC()
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Regexp("ABI entry 0: ABI input 0: Unable to map value to etherueum type", testMsgContext.errorRepies[0].err.Error())
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnGetTransactionMessageNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testGetTransactionJSON("")
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Regexp("Transaction 0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b not found", testMsgContext.errorRepies[0].err.Error())
+	assert.Equal(404, testMsgContext.errorRepies[0].status)
+}
+
+func testTraceTransactionJSON(extra string) string {
+	return "{" +
+		"  \"headers\":{\"type\": \"TraceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+		extra +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+}
+
+func TestOnTraceTransactionMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.AllowTracing = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testTraceTransactionJSON("\"gas\":\"50000\",")
+	testRPC := &testRPC{debugTraceCallResult: `{"type":"CALL","from":"0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1",` +
+		`"to":"0x2b8c0ecc76d0759a8f50b2e14a6881367d805832","gas":"0xc350","gasUsed":"0x5208","error":"execution reverted"}`}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"debug_traceCall"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.GasProfile)
+	assert.Equal(kldmessages.MsgTypeGasProfile, reply.Headers.MsgType)
+	assert.Equal(kldmessages.GasProfileCalls, reply.Profile)
+	assert.Equal("21000", reply.GasUsed)
+	assert.True(reply.Failed)
+	assert.Equal("execution reverted", reply.Error)
+	assert.Equal("50000", reply.Calls.Gas)
+}
+
+func TestOnTraceTransactionMessageOpcodes(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.AllowTracing = true
+	msgProcessor.conf.MethodGas = map[string]int{"0xf8a8fd6d": 50000}
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testTraceTransactionJSON("\"profile\":\"opcodes\",")
+	testRPC := &testRPC{debugTraceCallResult: `{"gas":21003,"failed":false,"structLogs":[{"op":"PUSH1","gasCost":3}]}`}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	reply := testMsgContext.replies[0].(*kldmessages.GasProfile)
+	assert.Equal(kldmessages.GasProfileOpcodes, reply.Profile)
+	assert.Equal("21003", reply.GasUsed)
+	assert.Equal([]*kldmessages.OpcodeGas{{Op: "PUSH1", Count: 1, Gas: "3"}}, reply.Opcodes)
+}
+
+func TestOnTraceTransactionMessageNotAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testTraceTransactionJSON("\"gas\":\"50000\",")
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testRPC.calls)
+	assert.Equal(403, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Tracing transactions is not enabled on this bridge")
+}
+
+func TestOnTraceTransactionMessageBadRequests(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.AllowTracing = true
+	msgProcessor.Init(&testRPC{ethEstimateGasErr: fmt.Errorf("pop")}, 1)
+
+	msgContext := &testMsgContext{}
+	msgContext.jsonMsg = testTraceTransactionJSON("\"gas\":\"50000\",\"profile\":\"storage\",")
+	msgProcessor.OnMessage(msgContext)
+	assert.Equal(400, msgContext.errorRepies[0].status)
+	assert.EqualError(msgContext.errorRepies[0].err, "Supplied value for 'profile' must be 'calls' or 'opcodes': storage")
+
+	msgContext = &testMsgContext{}
+	msgContext.jsonMsg = testTraceTransactionJSON("")
+	msgProcessor.OnMessage(msgContext)
+	assert.Equal(400, msgContext.errorRepies[0].status)
+	assert.EqualError(msgContext.errorRepies[0].err, "Failed to estimate gas: pop")
+
+	msgContext = &testMsgContext{}
+	msgContext.jsonMsg = testTraceTransactionJSON("\"gas\":\"50000\",\"value\":\"abc\",")
+	msgProcessor.OnMessage(msgContext)
+	assert.Equal(400, msgContext.errorRepies[0].status)
+}
+
+func TestOnTraceTransactionMessageUnsupported(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.AllowTracing = true
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testTraceTransactionJSON("\"gas\":\"50000\",")
+	msgProcessor.Init(&testRPC{debugTraceCallErr: fmt.Errorf("the method debug_traceCall does not exist/is not available")}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.Regexp("The node does not support debug_traceCall", testMsgContext.errorRepies[0].err)
+}
+
+func testSimulateTransactionJSON(extra string) string {
+	return "{" +
+		"  \"headers\":{\"type\": \"SimulateTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"to\":\"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832\"," +
+		"  \"gas\":\"50000\"," +
+		extra +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+}
+
+func TestOnSimulateTransactionMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testSimulateTransactionJSON("\"stateOverrides\":{\"" + testFromAddr + "\":{\"balance\":\"100\"}},")
+	testRPC := &testRPC{ethCallResult: common.FromHex("0x000000000000000000000000000000000000000000000000000000000000002a")}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_call"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.SimulationResult)
+	assert.Equal(kldmessages.MsgTypeSimulationResult, reply.Headers.MsgType)
+	assert.Equal("0x000000000000000000000000000000000000000000000000000000000000002a", reply.Output)
+}
+
+func TestOnSimulateTransactionMessageReverts(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testSimulateTransactionJSON("")
+	testRPC := &testRPC{
+		// Error(string) encoding of "not allowed"
+		ethCallResult: common.FromHex("0x08c379a0" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"000000000000000000000000000000000000000000000000000000000000000b" +
+			"6e6f7420616c6c6f776564000000000000000000000000000000000000000000"),
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Equal("Transaction reverted in simulation: not allowed", testMsgContext.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_call"}, testRPC.calls)
+}
+
+func TestOnSimulateTransactionMessageRPCError(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = testSimulateTransactionJSON("")
+	msgProcessor.Init(&testRPC{ethCallErr: fmt.Errorf("pop")}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(500, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "pop")
+}
+
+func newReplaceTestInflight(assert *assert.Assertions, msgProcessor *msgProcessor) *inflightTxn {
+	var msg kldmessages.SendTransaction
+	msg.From = testFromAddr
+	msg.To = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	msg.MethodName = "test"
+	msg.Parameters = []interface{}{}
+	msg.Gas = "123"
+	msg.GasPrice = "1000"
+	tx, err := kldeth.NewSendTxn(&msg)
+	assert.NoError(err)
+	tx.Hash = "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b"
+	inflight := &inflightTxn{
+		from:       strings.ToLower(testFromAddr),
+		tx:         tx,
+		msgContext: &testMsgContext{jsonMsg: `{"headers":{"id":"req1","type":"SendTransaction"}}`},
+	}
+	msgProcessor.inflightTxns[inflight.from] = []*inflightTxn{inflight}
+	return inflight
+}
+
+func TestOnReplaceTransactionMessage(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	inflight := newReplaceTestInflight(assert, msgProcessor)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"requestId\":\"req1\"" +
+		"}"
+	testRPC := &testRPC{
+		ethSendTransactionResult:      "0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89",
+		ethGetTransactionByHashKnown:  1,
+		ethGetTransactionByHashResult: `{"nonce":"0x7b","blockNumber":null}`,
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal([]string{"eth_getTransactionByHash", "eth_sendTransaction"}, testRPC.calls)
+	reply := testMsgContext.replies[0].(*kldmessages.TransactionReplaced)
+	assert.Equal(kldmessages.MsgTypeTransactionReplaced, reply.Headers.MsgType)
+	assert.Equal("req1", reply.RequestID)
+	assert.Equal("123", reply.Nonce)
+	assert.Equal("1100", reply.GasPrice)
+	assert.Equal("0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b", reply.OriginalTransactionHash)
+	assert.Equal("0xe2215336b09f9b5b82e36e1144ed64f40a42e61b68fdaca82549fd98b8531a89", reply.TransactionHash)
+
+	replacement := inflight.latestTX()
+	assert.Equal(uint64(123), replacement.EthTX.Nonce())
+	inflight.applyReplacements()
+	assert.Equal(replacement, inflight.tx)
+	assert.Equal(1, len(inflight.replacedTXs))
+}
+
+func TestOnReplaceTransactionMessageGasPrice(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	newReplaceTestInflight(assert, msgProcessor)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"requestId\":\"req1\"," +
+		"  \"gasPrice\":\"1000\"" +
+		"}"
+	testRPC := &testRPC{ethGetTransactionByHashKnown: 1}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("Gas price 1000 for the replacement must be higher than the gas price 1000", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnReplaceTransactionMessageNotFound(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	newReplaceTestInflight(assert, msgProcessor)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"requestId\":\"req2\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(404, testMsgContext.errorRepies[0].status)
+	assert.Regexp("No transaction in-flight from .* for request 'req2'", testMsgContext.errorRepies[0].err.Error())
+	assert.Empty(testRPC.calls)
+}
+
+func TestOnReplaceTransactionMessageMined(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	newReplaceTestInflight(assert, msgProcessor)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"requestId\":\"req1\"" +
+		"}"
+	testRPC := &testRPC{
+		ethGetTransactionByHashKnown:  1,
+		ethGetTransactionByHashResult: `{"nonce":"0x7b","blockNumber":"0x10"}`,
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(409, testMsgContext.errorRepies[0].status)
+	assert.Regexp("has already been mined", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnReplaceTransactionMessageDropped(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	newReplaceTestInflight(assert, msgProcessor)
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"requestId\":\"req1\"" +
+		"}"
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(410, testMsgContext.errorRepies[0].status)
+	assert.Regexp("is no longer known to the node", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestOnReplaceTransactionMessageBadMsg(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"ReplaceTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"" +
+		"}"
+	msgProcessor.Init(&testRPC{}, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.Regexp("'requestId' of the transaction to replace must be supplied", testMsgContext.errorRepies[0].err.Error())
+}
+
+func TestCheckReplacedMined(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	inflight := newReplaceTestInflight(assert, msgProcessor)
+	original := inflight.tx
+	replacement, err := original.NewReplacement(1, big.NewInt(2000))
+	assert.NoError(err)
+	inflight.addReplacement(replacement)
+	inflight.applyReplacements()
+	assert.Equal(replacement, inflight.tx)
+
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+	assert.False(msgProcessor.checkReplacedMined(inflight))
+
+	blockNumber := hexutil.Big(*big.NewInt(12345))
+	testRPC.ethGetTransactionReceiptResult.BlockNumber = &blockNumber
+	assert.True(msgProcessor.checkReplacedMined(inflight))
+	assert.Equal(original, inflight.tx)
+}
+
+func TestOnMessageUnknownChain(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.Chains = map[string]*ChainConf{"chain2": {URL: "http://chain2:8545"}}
+	msgProcessor.Init(&testRPC{}, 1)
+	assert.NoError(msgProcessor.InitChain("chain2", &testRPC{}))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = `{"headers":{"type":"GetBalance","chain":"chain3"}}`
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.replies)
+	assert.Equal(400, testMsgContext.errorRepies[0].status)
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Unknown chain 'chain3'")
+}
+
+func TestOnSendTransactionMessageChain(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.PredictNonces = true
+	msgProcessor.conf.Chains = map[string]*ChainConf{"chain2": {URL: "http://chain2:8545"}}
+	defaultRPC := &testRPC{}
+	msgProcessor.Init(defaultRPC, 1)
+	msgProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"] =
+		[]*inflightTxn{&inflightTxn{nonce: 100}}
+	chainRPC := &testRPC{
+		ethSendTransactionResult:     "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+		ethGetTransactionCountResult: 10,
+	}
+	assert.NoError(msgProcessor.InitChain("chain2", chainRPC))
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\", \"chain\": \"chain2\"}," +
+		"  \"from\":\"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1\"," +
+		"  \"gas\":\"123\"," +
+		"  \"method\":{\"name\":\"test\"}" +
+		"}"
+
+	msgProcessor.OnMessage(testMsgContext)
+
+	// The nonce comes from the chain, not the in-flight transactions on the default chain
+	assert.Empty(testMsgContext.errorRepies)
+	assert.EqualValues([]string{"eth_getTransactionCount", "eth_sendTransaction"}, chainRPC.calls)
+	assert.Empty(defaultRPC.calls)
+	chainProcessor := msgProcessor.chains["chain2"]
+	chainProcessor.inflightTxnsLock.Lock()
+	assert.Equal(int64(10), chainProcessor.inflightTxns["0x83dbc8e329b38cba0fc4ed99b1ce9c2a390abdc1"][0].nonce)
+	chainProcessor.inflightTxnsLock.Unlock()
 }
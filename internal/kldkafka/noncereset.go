@@ -0,0 +1,88 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const adminNoncesPath = "/admin/nonces/"
+
+type nonceResetReply struct {
+	Account  string `json:"account"`
+	Chain    string `json:"chain,omitempty"`
+	Inflight int    `json:"inflight"`
+}
+
+// ResetNonce forces the nonce of the next transaction from an account to be
+// queried again, rather than predicted from the transactions in-flight.
+// The in-flight transactions are still tracked to completion, but are ignored
+// when predicting nonces. Returns the number of transactions that are ignored
+func (p *msgProcessor) ResetNonce(account, chain string) (int, error) {
+	from, err := kldutils.StrToAddress("account", account)
+	if err != nil {
+		return 0, err
+	}
+	cp := p
+	if chain != "" {
+		var exists bool
+		if cp, exists = p.getChain(chain); !exists {
+			return 0, fmt.Errorf("Unknown chain '%s'", chain)
+		}
+	}
+	addr := strings.ToLower(from.Hex())
+	reset := 0
+	cp.inflightTxnsLock.Lock()
+	for _, inflight := range cp.inflightTxns[addr] {
+		if !inflight.nonceReset {
+			inflight.nonceReset = true
+			reset++
+		}
+	}
+	cp.inflightTxnsLock.Unlock()
+	log.Warnf("Nonce prediction reset for %s: %d in-flight transactions ignored", addr, reset)
+	return reset, nil
+}
+
+// adminNonceResetHandler accepts POST requests to /admin/nonces/{account}/reset,
+// to recover an account with a wedged nonce without restarting the bridge.
+// An optional chain query parameter selects one of the additional chains
+func (k *KafkaBridge) adminNonceResetHandler(res http.ResponseWriter, req *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, adminNoncesPath), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "reset" {
+		kldutils.AdminErrorReply(res, 404, "Not found")
+		return
+	}
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		res.WriteHeader(405)
+		return
+	}
+	if !kldutils.AdminAuthorized(res, req, k.conf.AdminToken) {
+		return
+	}
+	chain := req.URL.Query().Get("chain")
+	inflight, err := k.processor.ResetNonce(parts[0], chain)
+	if err != nil {
+		kldutils.AdminErrorReply(res, 400, err.Error())
+		return
+	}
+	kldutils.AdminReply(res, 200, &nonceResetReply{Account: parts[0], Chain: chain, Inflight: inflight})
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResetNonce(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.PredictNonces = true
+	testRPC := &testRPC{ethGetTransactionCountResult: 3}
+	msgProcessor.Init(testRPC, 1)
+	from := strings.ToLower(testFromAddr)
+	msgProcessor.inflightTxns[from] = []*inflightTxn{{from: from, nonce: 5}, {from: from, nonce: 6}}
+
+	inflight, err := msgProcessor.newInflightWrapper(&testMsgContext{}, testFromAddr, "")
+	assert.NoError(err)
+	assert.Equal(int64(7), inflight.nonce)
+
+	reset, err := msgProcessor.ResetNonce(testFromAddr, "")
+	assert.NoError(err)
+	assert.Equal(2, reset)
+	inflight, err = msgProcessor.newInflightWrapper(&testMsgContext{}, testFromAddr, "")
+	assert.NoError(err)
+	assert.Equal(int64(3), inflight.nonce)
+	assert.Equal([]string{"eth_getTransactionCount"}, testRPC.calls)
+
+	// Transactions added after the reset are used to predict nonces as usual
+	msgProcessor.inflightTxns[from] = append(msgProcessor.inflightTxns[from], inflight)
+	inflight, err = msgProcessor.newInflightWrapper(&testMsgContext{}, testFromAddr, "")
+	assert.NoError(err)
+	assert.Equal(int64(4), inflight.nonce)
+
+	reset, err = msgProcessor.ResetNonce(testFromAddr, "")
+	assert.NoError(err)
+	assert.Equal(1, reset)
+}
+
+func TestResetNonceErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	_, err := msgProcessor.ResetNonce("bad", "")
+	assert.Regexp("account", err)
+	_, err = msgProcessor.ResetNonce(testFromAddr, "chain1")
+	assert.EqualError(err, "Unknown chain 'chain1'")
+}
+
+func TestAdminNonceResetHandler(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	mp := newMsgProcessor()
+	k.processor = mp
+	k.conf.AdminToken = "secret"
+	from := strings.ToLower(testFromAddr)
+	mp.inflightTxns[from] = []*inflightTxn{{from: from, nonce: 5}}
+
+	res := httptest.NewRecorder()
+	k.adminNonceResetHandler(res, httptest.NewRequest("POST", "/admin/nonces/"+testFromAddr, nil))
+	assert.Equal(404, res.Code)
+
+	res = httptest.NewRecorder()
+	k.adminNonceResetHandler(res, httptest.NewRequest("GET", "/admin/nonces/"+testFromAddr+"/reset", nil))
+	assert.Equal(405, res.Code)
+
+	res = httptest.NewRecorder()
+	k.adminNonceResetHandler(res, httptest.NewRequest("POST", "/admin/nonces/"+testFromAddr+"/reset", nil))
+	assert.Equal(401, res.Code)
+
+	req := httptest.NewRequest("POST", "/admin/nonces/bad/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminNonceResetHandler(res, req)
+	assert.Equal(400, res.Code)
+
+	req = httptest.NewRequest("POST", "/admin/nonces/"+testFromAddr+"/reset", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminNonceResetHandler(res, req)
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"account":"`+testFromAddr+`","inflight":1}`, res.Body.String())
+	assert.True(mp.inflightTxns[from][0].nonceReset)
+}
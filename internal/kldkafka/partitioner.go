@@ -0,0 +1,150 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"strconv"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PartitionerHash hashes the key with FNV-1a (default)
+	PartitionerHash = "hash"
+	// PartitionerReference hashes the key in the same way as the reference Java client did before murmur2
+	PartitionerReference = "reference"
+	// PartitionerCRC32 hashes the key with CRC-32
+	PartitionerCRC32 = "crc32"
+	// PartitionerRandom sends each message to a random partition
+	PartitionerRandom = "random"
+	// PartitionerRoundRobin sends the messages to each partition in turn
+	PartitionerRoundRobin = "roundrobin"
+	// PartitionerManual sends each reply to the partition in one of its fields
+	PartitionerManual = "manual"
+)
+
+// autoPartition marks a message without a manual partition, which is partitioned
+// by its key instead
+const autoPartition int32 = -1
+
+// PartitionerConf selects how the partition is chosen for the messages the
+// producer sends. The field is the dot separated path, with the native field
+// names, of the reply field holding the partition in manual mode
+type PartitionerConf struct {
+	Type  string `json:"type,omitempty"`
+	Field string `json:"field,omitempty"`
+}
+
+// validatePartitionerConf checks the partitioner type, and that a field is set
+// for the manual partitioner
+func (k *kafkaCommon) validatePartitionerConf() error {
+	partitioner := &k.conf.Partitioner
+	switch partitioner.Type {
+	case "":
+		partitioner.Type = PartitionerHash
+	case PartitionerHash, PartitionerReference, PartitionerCRC32, PartitionerRandom, PartitionerRoundRobin, PartitionerManual:
+	default:
+		return fmt.Errorf("Invalid partitioner '%s' (must be '%s', '%s', '%s', '%s', '%s' or '%s')", partitioner.Type,
+			PartitionerHash, PartitionerReference, PartitionerCRC32, PartitionerRandom, PartitionerRoundRobin, PartitionerManual)
+	}
+	if partitioner.Type == PartitionerManual && partitioner.Field == "" {
+		return fmt.Errorf("A reply field is required for the '%s' partitioner", PartitionerManual)
+	}
+	if partitioner.Type != PartitionerManual && partitioner.Field != "" {
+		log.Warnf("Partitioner field has no effect with the '%s' partitioner", partitioner.Type)
+	}
+	return nil
+}
+
+// newPartitioner returns the sarama constructor for the configured partitioner
+func newPartitioner(partitionerType string) sarama.PartitionerConstructor {
+	switch partitionerType {
+	case PartitionerReference:
+		return sarama.NewReferenceHashPartitioner
+	case PartitionerCRC32:
+		return sarama.NewCustomHashPartitioner(crc32.NewIEEE)
+	case PartitionerRandom:
+		return sarama.NewRandomPartitioner
+	case PartitionerRoundRobin:
+		return sarama.NewRoundRobinPartitioner
+	case PartitionerManual:
+		return newManualPartitioner
+	default:
+		return sarama.NewHashPartitioner
+	}
+}
+
+// manualPartitioner uses the partition set on each message, and hashes the key
+// of messages without one, such as audit records. A partition that does not exist
+// on the topic is also hashed by key, as sarama would fail the message, which
+// for a reply stops the bridge
+type manualPartitioner struct {
+	manual sarama.Partitioner
+	hash   sarama.Partitioner
+}
+
+func newManualPartitioner(topic string) sarama.Partitioner {
+	return &manualPartitioner{
+		manual: sarama.NewManualPartitioner(topic),
+		hash:   sarama.NewHashPartitioner(topic),
+	}
+}
+
+func (p *manualPartitioner) Partition(msg *sarama.ProducerMessage, numPartitions int32) (int32, error) {
+	if msg.Partition == autoPartition {
+		return p.hash.Partition(msg, numPartitions)
+	}
+	if msg.Partition < 0 || msg.Partition >= numPartitions {
+		log.Warnf("Partition %d does not exist on topic '%s' with %d partitions - partitioning by key", msg.Partition, msg.Topic, numPartitions)
+		return p.hash.Partition(msg, numPartitions)
+	}
+	return p.manual.Partition(msg, numPartitions)
+}
+
+func (p *manualPartitioner) RequiresConsistency() bool {
+	return true
+}
+
+// replyPartition reads the partition for a reply from the configured field,
+// when using the manual partitioner. Replies without a valid partition are
+// partitioned by their key
+func (k *KafkaBridge) replyPartition(replyBytes []byte) int32 {
+	partitioner := &k.conf.Kafka.Partitioner
+	if partitioner.Type != PartitionerManual {
+		return autoPartition
+	}
+	var reply interface{}
+	decoder := json.NewDecoder(bytes.NewReader(replyBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&reply); err != nil {
+		return autoPartition
+	}
+	val, ok := fieldValue(reply, partitioner.Field)
+	if !ok {
+		log.Warnf("Reply has no partition in field '%s' - partitioning by key", partitioner.Field)
+		return autoPartition
+	}
+	partition, err := strconv.ParseInt(val, 10, 32)
+	if err != nil || partition < 0 {
+		log.Warnf("Reply has an invalid partition '%s' in field '%s' - partitioning by key", val, partitioner.Field)
+		return autoPartition
+	}
+	return int32(partition)
+}
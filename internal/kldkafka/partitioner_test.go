@@ -0,0 +1,132 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"hash/crc32"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteWithPartitioner(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	k, err := execKafkaCommonWithArgs(assert, kcMinWorkingArgs, f)
+	assert.NoError(err)
+	assert.Equal(PartitionerHash, k.conf.Partitioner.Type)
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--partitioner", "crc32"), f)
+	assert.NoError(err)
+	partitioner := f.ClientConf.Producer.Partitioner("topic1")
+	partition, err := partitioner.Partition(&sarama.ProducerMessage{Key: sarama.StringEncoder("key1")}, 10)
+	assert.NoError(err)
+	expected := int32(crc32.ChecksumIEEE([]byte("key1"))) % 10
+	if expected < 0 {
+		expected = -expected
+	}
+	assert.Equal(expected, partition)
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--partitioner", "manual", "--partitioner-field", "headers.ctx.partition"), f)
+	assert.NoError(err)
+	assert.IsType(&manualPartitioner{}, f.ClientConf.Producer.Partitioner("topic1"))
+}
+
+func TestExecuteWithBadPartitioner(t *testing.T) {
+	assert := assert.New(t)
+
+	f := NewMockKafkaFactory()
+	_, err := execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--partitioner", "sticky"), f)
+	assert.EqualError(err, "Invalid partitioner 'sticky' (must be 'hash', 'reference', 'crc32', 'random', 'roundrobin' or 'manual')")
+
+	f = NewMockKafkaFactory()
+	_, err = execKafkaCommonWithArgs(assert, append(kcMinWorkingArgs, "--partitioner", "manual"), f)
+	assert.EqualError(err, "A reply field is required for the 'manual' partitioner")
+}
+
+func TestNewPartitioner(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.IsType(sarama.NewHashPartitioner("topic1"), newPartitioner(PartitionerHash)("topic1"))
+	assert.IsType(sarama.NewReferenceHashPartitioner("topic1"), newPartitioner(PartitionerReference)("topic1"))
+	assert.IsType(sarama.NewRandomPartitioner("topic1"), newPartitioner(PartitionerRandom)("topic1"))
+	assert.IsType(sarama.NewRoundRobinPartitioner("topic1"), newPartitioner(PartitionerRoundRobin)("topic1"))
+}
+
+func TestManualPartitioner(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newManualPartitioner("topic1")
+	assert.True(p.RequiresConsistency())
+
+	partition, err := p.Partition(&sarama.ProducerMessage{Partition: 7}, 10)
+	assert.NoError(err)
+	assert.Equal(int32(7), partition)
+
+	// Messages without a partition are hashed by key, as with the default partitioner
+	msg := &sarama.ProducerMessage{Key: sarama.StringEncoder("key1"), Partition: autoPartition}
+	partition, err = p.Partition(msg, 10)
+	assert.NoError(err)
+	hashed, _ := sarama.NewHashPartitioner("topic1").Partition(msg, 10)
+	assert.Equal(hashed, partition)
+
+	// As are messages with a partition the topic does not have
+	for _, badPartition := range []int32{10, -2} {
+		msg = &sarama.ProducerMessage{Key: sarama.StringEncoder("key1"), Partition: badPartition}
+		partition, err = p.Partition(msg, 10)
+		assert.NoError(err)
+		assert.Equal(hashed, partition)
+	}
+}
+
+func TestReplyPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	assert.Equal(autoPartition, k.replyPartition([]byte(`{"headers":{"ctx":{"partition":3}}}`)))
+
+	k.conf.Kafka.Partitioner.Type = PartitionerManual
+	k.conf.Kafka.Partitioner.Field = "headers.ctx.partition"
+	assert.Equal(int32(3), k.replyPartition([]byte(`{"headers":{"ctx":{"partition":3}}}`)))
+	assert.Equal(int32(4), k.replyPartition([]byte(`{"headers":{"ctx":{"partition":"4"}}}`)))
+	assert.Equal(autoPartition, k.replyPartition([]byte(`{"headers":{"ctx":{"partition":-1}}}`)))
+	assert.Equal(autoPartition, k.replyPartition([]byte(`{"headers":{"ctx":{"partition":"first"}}}`)))
+	assert.Equal(autoPartition, k.replyPartition([]byte(`{"headers":{}}`)))
+	assert.Equal(autoPartition, k.replyPartition([]byte(`!json`)))
+}
+
+func TestReplyProducerMessageManualPartition(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Kafka.Partitioner.Type = PartitionerManual
+	k.conf.Kafka.Partitioner.Field = "headers.ctx.partition"
+	ctx := &msgContext{bridge: k, replyTopic: "replies"}
+
+	reply := &kldmessages.ReplyCommon{}
+	reply.Headers.MsgType = "TestReply"
+	reply.Headers.Context = map[string]interface{}{"partition": 2}
+	ctx.replyBytes = ctx.marshalReply(reply)
+	assert.Equal(int32(2), ctx.replyProducerMessage().Partition)
+
+	// The partition is kept for the reply to be re-sent on redelivery
+	completed := k.newCompletedMsg(ctx, 60)
+	assert.Equal(int32(2), completed.replyPartition)
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminPausePath  = "/admin/pause"
+	adminResumePath = "/admin/resume"
+)
+
+// PauseState is the reply to the pause and resume admin requests. The in-flight
+// count lets an operator wait for the bridge to drain after pausing
+type PauseState struct {
+	Paused      bool       `json:"paused"`
+	PausedSince *time.Time `json:"pausedSince,omitempty"`
+	InFlight    int        `json:"inflight"`
+}
+
+// consumerPause holds the consumer loop before it reads each message while the
+// bridge is paused. Messages already in-flight continue to be processed, and
+// messages that are not yet read stay with the consumer, so their offsets are
+// not committed
+type consumerPause struct {
+	cond     *sync.Cond
+	since    *time.Time
+	stopping bool
+}
+
+func newConsumerPause() *consumerPause {
+	return &consumerPause{
+		cond: sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+// pause stops the consumer loop reading further messages. Returns false if it was already paused
+func (p *consumerPause) pause() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	if p.since != nil {
+		return false
+	}
+	now := time.Now().UTC()
+	p.since = &now
+	return true
+}
+
+// resume releases the consumer loop. Returns false if it was not paused
+func (p *consumerPause) resume() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	if p.since == nil {
+		return false
+	}
+	p.since = nil
+	p.cond.Broadcast()
+	return true
+}
+
+// stop releases the consumer loop for good, as the consumer is closing
+func (p *consumerPause) stop() {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	p.stopping = true
+	p.cond.Broadcast()
+}
+
+// wait blocks while paused. Returns false if the consumer is closing, in which
+// case no further messages should be read
+func (p *consumerPause) wait() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	for p.since != nil && !p.stopping {
+		p.cond.Wait()
+	}
+	return !p.stopping
+}
+
+// isStopping returns whether the consumer is closing
+func (p *consumerPause) isStopping() bool {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.stopping
+}
+
+// pausedSince returns the time the bridge was paused, or nil if it is not
+func (p *consumerPause) pausedSince() *time.Time {
+	p.cond.L.Lock()
+	defer p.cond.L.Unlock()
+	return p.since
+}
+
+// writePrometheus writes whether the bridge is paused, as a gauge
+func (p *consumerPause) writePrometheus(w io.Writer) error {
+	paused := 0
+	if p.pausedSince() != nil {
+		paused = 1
+	}
+	_, err := fmt.Fprintf(w, "# HELP ethconnect_consumer_paused Whether consumption is paused by an admin request\n# TYPE ethconnect_consumer_paused gauge\nethconnect_consumer_paused %d\n", paused)
+	return err
+}
+
+// ConsumerStopping releases the consumer loop if it is paused, so the consumer can
+// close, and sends any summaries of coalesced errors before the producer closes.
+// Tombstones are no longer sent, as the producer input closes during shutdown
+func (k *KafkaBridge) ConsumerStopping() {
+	k.pause.stop()
+	k.errorCoalescer.stop()
+	k.inFlightCond.L.Lock()
+	k.producerClosing = true
+	k.inFlightCond.L.Unlock()
+}
+
+// pauseState returns the current pause state, with the messages still in-flight
+func (k *KafkaBridge) pauseState() *PauseState {
+	k.inFlightCond.L.Lock()
+	inFlight := len(k.inFlight)
+	k.inFlightCond.L.Unlock()
+	since := k.pause.pausedSince()
+	return &PauseState{Paused: since != nil, PausedSince: since, InFlight: inFlight}
+}
+
+// adminPauseHandler accepts POST requests to /admin/pause, to stop admitting new
+// messages while those in-flight complete, such as during node maintenance
+func (k *KafkaBridge) adminPauseHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		res.WriteHeader(405)
+		return
+	}
+	if !kldutils.AdminAuthorized(res, req, k.conf.AdminToken) {
+		return
+	}
+	if k.pause.pause() {
+		log.Warnf("Consumption paused by admin request")
+	}
+	kldutils.AdminReply(res, 200, k.pauseState())
+}
+
+// adminResumeHandler accepts POST requests to /admin/resume, to continue
+// consuming from the offsets reached when the bridge was paused
+func (k *KafkaBridge) adminResumeHandler(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		res.Header().Set("Allow", "POST")
+		res.WriteHeader(405)
+		return
+	}
+	if !kldutils.AdminAuthorized(res, req, k.conf.AdminToken) {
+		return
+	}
+	if k.pause.resume() {
+		log.Warnf("Consumption resumed by admin request")
+	}
+	kldutils.AdminReply(res, 200, k.pauseState())
+}
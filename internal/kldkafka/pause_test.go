@@ -0,0 +1,156 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsumerPauseResume(t *testing.T) {
+	assert := assert.New(t)
+
+	p := newConsumerPause()
+	assert.True(p.wait())
+	assert.Nil(p.pausedSince())
+
+	assert.True(p.pause())
+	assert.False(p.pause())
+	assert.NotNil(p.pausedSince())
+
+	waited := make(chan bool)
+	go func() { waited <- p.wait() }()
+	select {
+	case <-waited:
+		assert.Fail("Returned while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	assert.True(p.resume())
+	assert.True(<-waited)
+	assert.False(p.resume())
+
+	p.pause()
+	go func() { waited <- p.wait() }()
+	p.stop()
+	assert.False(<-waited)
+}
+
+func TestConsumerMessagesLoopPaused(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.pause.pause()
+	k, processor, mockConsumer, mockProducer, wg := startMocks(k)
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestConsumerMessagesLoopPaused"
+	msg1bytes, _ := json.Marshal(&msg1)
+	consumerMsg := &sarama.ConsumerMessage{Topic: "in-topic", Partition: 5, Offset: 500, Value: msg1bytes}
+
+	// The message is left with the consumer while paused
+	select {
+	case mockConsumer.MockMessages <- consumerMsg:
+		assert.Fail("Message read while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	k.pause.resume()
+	mockConsumer.MockMessages <- consumerMsg
+	msgContext1 := <-processor.messages
+	assert.Equal(msg1.Headers.MsgType, msgContext1.Headers().MsgType)
+
+	// In-flight messages complete while paused
+	k.pause.pause()
+	go msgContext1.Reply(&kldmessages.ReplyCommon{})
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	for k.pauseState().InFlight > 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	// Stopping releases the paused loop
+	k.ConsumerStopping()
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(500), mockConsumer.OffsetsByPartition[5])
+}
+
+func TestAdminPauseResumeHandlers(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.AdminToken = "secret"
+
+	res := httptest.NewRecorder()
+	k.adminPauseHandler(res, httptest.NewRequest("GET", "/admin/pause", nil))
+	assert.Equal(405, res.Code)
+	assert.Equal("POST", res.Header().Get("Allow"))
+
+	res = httptest.NewRecorder()
+	k.adminResumeHandler(res, httptest.NewRequest("POST", "/admin/resume", nil))
+	assert.Equal(401, res.Code)
+
+	req := httptest.NewRequest("POST", "/admin/pause", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminPauseHandler(res, req)
+	assert.Equal(200, res.Code)
+	var state PauseState
+	json.Unmarshal(res.Body.Bytes(), &state)
+	assert.True(state.Paused)
+	assert.NotNil(state.PausedSince)
+	assert.Equal(0, state.InFlight)
+
+	res = httptest.NewRecorder()
+	k.metricsHandler(res, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(res.Body.String(), "ethconnect_consumer_paused 1\n")
+
+	req = httptest.NewRequest("POST", "/admin/resume", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res = httptest.NewRecorder()
+	k.adminResumeHandler(res, req)
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"paused":false,"inflight":0}`, res.Body.String())
+
+	res = httptest.NewRecorder()
+	k.metricsHandler(res, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Contains(res.Body.String(), "ethconnect_consumer_paused 0\n")
+}
+
+func TestReadyzPaused(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.statusRPC = &testRPC{ethBlockNumberResult: 12345}
+	k.conf.Readyz.CacheTTL = 60
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.JSONEq(`{"ready":true}`, res.Body.String())
+
+	// The paused state is not cached with the result of the check
+	k.pause.pause()
+	res = httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"ready":true,"paused":true}`, res.Body.String())
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	log "github.com/sirupsen/logrus"
+)
+
+// readyzStatus is the body of the /readyz response
+type readyzStatus struct {
+	Ready      bool               `json:"ready"`
+	Node       *kldeth.NodeStatus `json:"node,omitempty"`
+	GasPricing string             `json:"gasPricing,omitempty"`
+	Paused     bool               `json:"paused,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// readyzCache holds the last readiness check, so frequent probes from
+// monitoring do not each make calls to the node. The lock also guards the
+// status RPC client and gas pricing of the bridge, which are set on connect
+type readyzCache struct {
+	lock   sync.Mutex
+	expiry time.Time
+	code   int
+	status readyzStatus
+}
+
+// checkReady determines whether the bridge can reach the node, including the
+// block height, peer count and sync state of the node if configured. A node that
+// is syncing is still reported as ready, so the status code has the same meaning
+// whether or not the node status is included
+func (k *KafkaBridge) checkReady(statusRPC kldeth.RPCClient, gasPricing string) (int, readyzStatus) {
+	if statusRPC == nil {
+		return 503, readyzStatus{Error: "Not connected to the JSON/RPC node"}
+	}
+	if !k.conf.Readyz.NodeStatus {
+		if _, err := kldeth.GetBlockNumber(statusRPC); err != nil {
+			return 503, readyzStatus{Error: err.Error()}
+		}
+		return 200, readyzStatus{Ready: true, GasPricing: gasPricing}
+	}
+	nodeStatus, err := kldeth.GetNodeStatus(statusRPC)
+	if err != nil {
+		return 503, readyzStatus{Error: err.Error()}
+	}
+	return 200, readyzStatus{Ready: true, Node: nodeStatus, GasPricing: gasPricing}
+}
+
+// setConnected stores the client and gas pricing used by readiness checks
+func (k *KafkaBridge) setConnected(statusRPC kldeth.RPCClient, gasPricing string) {
+	k.readyz.lock.Lock()
+	k.statusRPC = statusRPC
+	k.gasPricing = gasPricing
+	k.readyz.lock.Unlock()
+}
+
+// readyzHandler reports whether the bridge is ready, using the cached result
+// of the last check until it expires
+func (k *KafkaBridge) readyzHandler(res http.ResponseWriter, req *http.Request) {
+	k.readyz.lock.Lock()
+	expired := time.Now().After(k.readyz.expiry)
+	code, status := k.readyz.code, k.readyz.status
+	statusRPC, gasPricing := k.statusRPC, k.gasPricing
+	k.readyz.lock.Unlock()
+
+	// The node is not called with the lock held, so a slow node does not block other probes
+	if expired {
+		code, status = k.checkReady(statusRPC, gasPricing)
+		if code != 200 {
+			log.Warnf("Readiness check failed: %s", status.Error)
+		}
+		k.readyz.lock.Lock()
+		k.readyz.code, k.readyz.status = code, status
+		k.readyz.expiry = time.Now().Add(time.Duration(k.conf.Readyz.CacheTTL) * time.Second)
+		k.readyz.lock.Unlock()
+	}
+	// Pausing is deliberate, so is reported without affecting readiness
+	status.Paused = k.pause.pausedSince() != nil
+
+	statusBytes, _ := json.Marshal(&status)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(code)
+	res.Write(statusBytes)
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadyzNotConnected(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(503, res.Code)
+	assert.JSONEq(`{"ready":false,"error":"Not connected to the JSON/RPC node"}`, res.Body.String())
+}
+
+func TestReadyz(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	rpc := &testRPC{ethBlockNumberResult: 12345}
+	k.setConnected(rpc, "")
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(200, res.Code)
+	assert.Equal("application/json", res.Header().Get("Content-Type"))
+	assert.JSONEq(`{"ready":true}`, res.Body.String())
+	assert.Equal([]string{"eth_blockNumber"}, rpc.calls)
+}
+
+func TestReadyzNodeStatus(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Readyz.NodeStatus = true
+	k.conf.Readyz.CacheTTL = 60
+	rpc := &testRPC{
+		ethBlockNumberResult: 12345,
+		netPeerCountResult:   3,
+		ethSyncingResult:     json.RawMessage(`{"currentBlock":"0x3039","highestBlock":"0x4000"}`),
+	}
+	k.statusRPC = rpc
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"ready":true,"node":{"blockNumber":12345,"peerCount":3,"syncing":true}}`, res.Body.String())
+
+	// The second request is served from the cache
+	res = httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+	assert.Equal(200, res.Code)
+	assert.Equal([]string{"eth_blockNumber", "net_peerCount", "eth_syncing"}, rpc.calls)
+}
+
+func TestReadyzNodeStatusErr(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Readyz.NodeStatus = true
+	k.statusRPC = &testRPC{netPeerCountErr: fmt.Errorf("pop")}
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(503, res.Code)
+	assert.JSONEq(`{"ready":false,"error":"pop"}`, res.Body.String())
+}
+
+func TestReadyzNodeErr(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.statusRPC = &testRPC{ethBlockNumberErr: fmt.Errorf("pop")}
+	res := httptest.NewRecorder()
+	k.readyzHandler(res, httptest.NewRequest("GET", "/readyz", nil))
+
+	assert.Equal(503, res.Code)
+	assert.JSONEq(`{"ready":false,"error":"pop"}`, res.Body.String())
+}
@@ -0,0 +1,127 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultReceiptBatchSize is the maximum number of receipts fetched in a single
+// batch request, when polling for receipts together
+const DefaultReceiptBatchSize = 100
+
+// receiptPoller polls for the receipts of all the transactions waiting on a
+// chain together. On each tick it fetches the receipts requested since the last
+// tick, in batches of up to the configured size, and hands each result back to
+// the goroutine waiting for it. It only runs while transactions are waiting
+type receiptPoller struct {
+	lock      sync.Mutex
+	rpc       kldeth.RPCClient
+	interval  time.Duration
+	batchSize int
+	pending   []*receiptRequest
+	polling   bool
+}
+
+type receiptRequest struct {
+	tx    *kldeth.Txn
+	done  chan bool
+	mined bool
+	err   error
+}
+
+// newReceiptPoller returns a poller, or nil if each transaction polls for its
+// own receipt
+func newReceiptPoller(rpc kldeth.RPCClient, intervalMS, batchSize int) *receiptPoller {
+	if intervalMS <= 0 {
+		return nil
+	}
+	if batchSize <= 0 {
+		batchSize = DefaultReceiptBatchSize
+	}
+	return &receiptPoller{
+		rpc:       rpc,
+		interval:  time.Duration(intervalMS) * time.Millisecond,
+		batchSize: batchSize,
+	}
+}
+
+// getReceipt waits for the next tick, and returns whether the transaction is
+// mined according to the receipt fetched in that tick
+func (r *receiptPoller) getReceipt(tx *kldeth.Txn) (bool, error) {
+	req := &receiptRequest{tx: tx, done: make(chan bool)}
+	r.lock.Lock()
+	r.pending = append(r.pending, req)
+	if !r.polling {
+		r.polling = true
+		go r.pollLoop()
+	}
+	r.lock.Unlock()
+	<-req.done
+	return req.mined, req.err
+}
+
+// pollLoop polls on each tick, until a tick where no receipts were requested
+func (r *receiptPoller) pollLoop() {
+	for {
+		time.Sleep(r.interval)
+		r.lock.Lock()
+		reqs := r.pending
+		r.pending = nil
+		if len(reqs) == 0 {
+			r.polling = false
+			r.lock.Unlock()
+			return
+		}
+		r.lock.Unlock()
+		r.poll(reqs)
+	}
+}
+
+// poll fetches the receipts for the requests in batches. Each request gets the
+// result for its own transaction, so a receipt that is not available, or fails
+// to be fetched, does not affect the others in the batch
+func (r *receiptPoller) poll(reqs []*receiptRequest) {
+	for start := 0; start < len(reqs); start += r.batchSize {
+		end := start + r.batchSize
+		if end > len(reqs) {
+			end = len(reqs)
+		}
+		batch := reqs[start:end]
+		txns := make([]*kldeth.Txn, len(batch))
+		for i, req := range batch {
+			txns[i] = req.tx
+		}
+		log.Debugf("Polling for %d receipts", len(txns))
+		mined, errs := kldeth.GetTXReceipts(r.rpc, txns)
+		for i, req := range batch {
+			req.mined, req.err = mined[i], errs[i]
+			close(req.done)
+		}
+	}
+}
+
+// getTXReceipt gets the receipt for an in-flight transaction, from the shared
+// poller if receipts are polled together, or otherwise directly
+func (p *msgProcessor) getTXReceipt(iTX *inflightTxn) (bool, error) {
+	if p.receiptPoller != nil {
+		return p.receiptPoller.getReceipt(iTX.tx)
+	}
+	return iTX.tx.GetTXReceipt(p.rpc)
+}
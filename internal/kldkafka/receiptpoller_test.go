@@ -0,0 +1,134 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBatchRPC mines the transactions with an even last digit in their hash,
+// and fails to get the receipt for hashes ending in 9
+type testBatchRPC struct {
+	testRPC
+	lock       sync.Mutex
+	batchSizes []int
+}
+
+func (r *testBatchRPC) BatchCallContext(ctx context.Context, b []rpc.BatchElem) error {
+	r.lock.Lock()
+	r.batchSizes = append(r.batchSizes, len(b))
+	r.lock.Unlock()
+	for i := range b {
+		hash := b[i].Args[0].(string)
+		switch hash[len(hash)-1] {
+		case '9':
+			b[i].Error = fmt.Errorf("pop")
+		case '0', '2', '4', '6', '8':
+			blockNumber := hexutil.Big(*big.NewInt(12345))
+			b[i].Result.(*kldeth.TxnReceipt).BlockNumber = &blockNumber
+		}
+	}
+	return nil
+}
+
+func TestNewReceiptPoller(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newReceiptPoller(&testRPC{}, 0, 10))
+	r := newReceiptPoller(&testRPC{}, 50, 0)
+	assert.Equal(DefaultReceiptBatchSize, r.batchSize)
+}
+
+func TestReceiptPollerBatches(t *testing.T) {
+	assert := assert.New(t)
+
+	batchRPC := &testBatchRPC{}
+	r := newReceiptPoller(batchRPC, 50, 4)
+	hashes := []string{"0x10", "0x11", "0x12", "0x13", "0x14", "0x19"}
+	mined := make([]bool, len(hashes))
+	errs := make([]error, len(hashes))
+	wg := &sync.WaitGroup{}
+	for i, hash := range hashes {
+		wg.Add(1)
+		go func(i int, hash string) {
+			defer wg.Done()
+			mined[i], errs[i] = r.getReceipt(&kldeth.Txn{Hash: hash})
+		}(i, hash)
+	}
+	wg.Wait()
+
+	assert.Equal([]bool{true, false, true, false, true, false}, mined)
+	assert.NoError(errs[1])
+	assert.EqualError(errs[5], "pop")
+	batchRPC.lock.Lock()
+	total := 0
+	for _, size := range batchRPC.batchSizes {
+		assert.True(size <= 4)
+		total += size
+	}
+	batchRPC.lock.Unlock()
+	assert.Equal(len(hashes), total)
+}
+
+func TestReceiptPollerStopsWhenIdle(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newReceiptPoller(&testBatchRPC{}, 1, 10)
+	mined, err := r.getReceipt(&kldeth.Txn{Hash: "0x10"})
+	assert.NoError(err)
+	assert.True(mined)
+	for {
+		r.lock.Lock()
+		polling := r.polling
+		r.lock.Unlock()
+		if !polling {
+			break
+		}
+	}
+	mined, err = r.getReceipt(&kldeth.Txn{Hash: "0x11"})
+	assert.NoError(err)
+	assert.False(mined)
+}
+
+func TestOnSendTransactionMessageReceiptPoller(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.ReceiptPollInterval = 10
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = goodSendTxnJSON
+	testRPC := goodMessageRPC()
+	msgProcessor.Init(testRPC, 1)
+	assert.NotNil(msgProcessor.receiptPoller)
+
+	msgProcessor.OnMessage(testMsgContext)
+	msgProcessor.inflightTxns[strings.ToLower(testFromAddr)][0].wg.Wait()
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal(1, len(testMsgContext.replies))
+	assert.Equal(kldmessages.MsgTypeTransactionSuccess, testMsgContext.replies[0].ReplyHeaders().MsgType)
+	assert.Equal("eth_getTransactionReceipt", testRPC.calls[1])
+}
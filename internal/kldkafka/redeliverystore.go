@@ -0,0 +1,186 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// redeliveryStoreMinCompact is the number of entries the store file can hold
+// before it is compacted, so small stores are not rewritten on every reply
+const redeliveryStoreMinCompact = 1000
+
+// storedReply is a completed message as persisted in the redelivery store
+type storedReply struct {
+	ReqOffset      string         `json:"reqOffset"`
+	Key            string         `json:"key,omitempty"`
+	ReplyTopic     string         `json:"replyTopic"`
+	Reply          []byte         `json:"reply"`
+	ReplyHeaders   []storedHeader `json:"replyHeaders,omitempty"`
+	ReplyPartition int32          `json:"replyPartition"`
+	TombstoneKey   string         `json:"tombstoneKey,omitempty"`
+	Expiry         time.Time      `json:"expiry"`
+}
+
+type storedHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// redeliveryStore persists the replies of completed messages to a file, as JSON
+// lines, so a message redelivered after the bridge restarts is recognized within
+// the redelivery grace period. Replies are appended as messages complete, and the
+// file is rewritten with only the unexpired replies once it holds twice as many
+// as are live, so it stays bounded by the grace period
+type redeliveryStore struct {
+	file    string
+	out     *os.File
+	entries int
+}
+
+func newStoredReply(completed *completedMsg) *storedReply {
+	stored := &storedReply{
+		ReqOffset:      completed.reqOffset,
+		Key:            completed.key,
+		ReplyTopic:     completed.replyTopic,
+		Reply:          completed.replyBytes,
+		ReplyPartition: completed.replyPartition,
+		TombstoneKey:   completed.tombstoneKey,
+		Expiry:         completed.expiry,
+	}
+	for _, header := range completed.replyFieldHeaders {
+		stored.ReplyHeaders = append(stored.ReplyHeaders, storedHeader{Key: string(header.Key), Value: string(header.Value)})
+	}
+	return stored
+}
+
+func (s *storedReply) completedMsg() *completedMsg {
+	completed := &completedMsg{
+		reqOffset:      s.ReqOffset,
+		key:            s.Key,
+		replyTopic:     s.ReplyTopic,
+		replyBytes:     s.Reply,
+		replyPartition: s.ReplyPartition,
+		tombstoneKey:   s.TombstoneKey,
+		expiry:         s.Expiry,
+	}
+	for _, header := range s.ReplyHeaders {
+		completed.replyFieldHeaders = append(completed.replyFieldHeaders, sarama.RecordHeader{Key: []byte(header.Key), Value: []byte(header.Value)})
+	}
+	return completed
+}
+
+// loadRedeliveryStore loads the unexpired replies persisted by a previous run of
+// the bridge into the completed messages, then compacts the store file and opens
+// it to append new replies
+func (k *KafkaBridge) loadRedeliveryStore() error {
+	if k.conf.RedeliveryStore == "" {
+		return nil
+	}
+	if k.conf.RedeliveryGracePeriod <= 0 {
+		return fmt.Errorf("A redelivery grace period is required to persist completed replies")
+	}
+	k.inFlightCond.L.Lock()
+	defer k.inFlightCond.L.Unlock()
+	k.redeliveryStore = &redeliveryStore{file: k.conf.RedeliveryStore}
+	b, err := ioutil.ReadFile(k.conf.RedeliveryStore)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed to read redelivery store '%s': %s", k.conf.RedeliveryStore, err)
+	}
+	now := time.Now()
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64*1024), len(b)+1)
+	for line := 1; scanner.Scan(); line++ {
+		var stored storedReply
+		if err := json.Unmarshal(scanner.Bytes(), &stored); err != nil {
+			// The last line is partially written if the bridge stopped during a write
+			log.Warnf("Ignoring invalid entry on line %d of redelivery store '%s': %s", line, k.conf.RedeliveryStore, err)
+			continue
+		}
+		if now.After(stored.Expiry) {
+			continue
+		}
+		completed := stored.completedMsg()
+		k.completed[completed.reqOffset] = completed
+		k.completedLRU = append(k.completedLRU, completed)
+	}
+	// The grace period might have changed since the replies were stored
+	sort.SliceStable(k.completedLRU, func(i, j int) bool {
+		return k.completedLRU[i].expiry.Before(k.completedLRU[j].expiry)
+	})
+	log.Infof("Loaded %d completed replies from redelivery store '%s'", len(k.completed), k.conf.RedeliveryStore)
+	return k.redeliveryStore.compact(k.completedLRU)
+}
+
+// add appends the reply of a completed message to the store, compacting the
+// file once it holds twice as many replies as are live. Failures are logged, as
+// the reply has already been sent
+// * Caller holds the inFlightCond mutex *
+func (s *redeliveryStore) add(completed *completedMsg, live []*completedMsg) {
+	if s.out == nil {
+		return
+	}
+	b, _ := json.Marshal(newStoredReply(completed))
+	if _, err := s.out.Write(append(b, '\n')); err != nil {
+		log.Errorf("Failed to write redelivery store '%s': %s", s.file, err)
+		return
+	}
+	s.entries++
+	if s.entries >= redeliveryStoreMinCompact && s.entries >= 2*len(live) {
+		if err := s.compact(live); err != nil {
+			log.Errorf("%s", err)
+		}
+	}
+}
+
+// compact writes the live replies to a temporary file, then renames it over the
+// store file, so a crash cannot leave a partially written file. The store is
+// then re-opened to append new replies
+// * Caller holds the inFlightCond mutex *
+func (s *redeliveryStore) compact(live []*completedMsg) error {
+	if s.out != nil {
+		s.out.Close()
+		s.out = nil
+	}
+	var buf bytes.Buffer
+	for _, completed := range live {
+		b, _ := json.Marshal(newStoredReply(completed))
+		buf.Write(append(b, '\n'))
+	}
+	tmpFile := s.file + ".tmp"
+	if err := ioutil.WriteFile(tmpFile, buf.Bytes(), 0640); err != nil {
+		return fmt.Errorf("Failed to write redelivery store '%s': %s", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, s.file); err != nil {
+		return fmt.Errorf("Failed to write redelivery store '%s': %s", s.file, err)
+	}
+	out, err := os.OpenFile(s.file, os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("Failed to open redelivery store '%s': %s", s.file, err)
+	}
+	s.out = out
+	s.entries = len(live)
+	return nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRedeliveryStoreBridge(assert *assert.Assertions, storeFile string) *KafkaBridge {
+	k, _ := newTestKafkaBridge()
+	k.conf.RedeliveryGracePeriod = 60
+	k.conf.RedeliveryStore = storeFile
+	assert.NoError(k.loadRedeliveryStore())
+	return k
+}
+
+func TestRedeliveryStoreReloaded(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	storeFile := path.Join(dir, "completed.jsonl")
+
+	k := newTestRedeliveryStoreBridge(assert, storeFile)
+	k.addCompleted(&msgContext{
+		reqOffset:         "in-topic:5:500",
+		key:               "key1",
+		replyTopic:        "replies",
+		replyBytes:        []byte(`{"headers":{"type":"TestReply"}}`),
+		replyFieldHeaders: []sarama.RecordHeader{{Key: []byte("type"), Value: []byte("TestReply")}},
+		replyPartition:    2,
+	})
+	k.addCompleted(&msgContext{reqOffset: "in-topic:5:501", filtered: true})
+
+	// A restarted bridge re-sends the same reply for the completed message
+	k = newTestRedeliveryStoreBridge(assert, storeFile)
+	assert.Equal(1, len(k.completed))
+	assert.Equal(1, len(k.completedLRU))
+	completed := k.completed["in-topic:5:500"]
+	assert.Equal("key1", completed.key)
+	assert.Equal("replies", completed.replyTopic)
+	assert.Equal(`{"headers":{"type":"TestReply"}}`, string(completed.replyBytes))
+	assert.Equal([]sarama.RecordHeader{{Key: []byte("type"), Value: []byte("TestReply")}}, completed.replyFieldHeaders)
+	assert.Equal(int32(2), completed.replyPartition)
+}
+
+func TestRedeliveryStoreSkipsExpiredAndInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	storeFile := path.Join(dir, "completed.jsonl")
+
+	expired, _ := json.Marshal(&storedReply{ReqOffset: "t:0:1", Expiry: time.Now().Add(-1 * time.Second)})
+	later, _ := json.Marshal(&storedReply{ReqOffset: "t:0:2", Expiry: time.Now().Add(20 * time.Second)})
+	earlier, _ := json.Marshal(&storedReply{ReqOffset: "t:0:3", Expiry: time.Now().Add(10 * time.Second)})
+	content := strings.Join([]string{string(expired), string(later), string(earlier), `{"reqOffset":"t:0:4","exp`}, "\n")
+	ioutil.WriteFile(storeFile, []byte(content), 0640)
+
+	k := newTestRedeliveryStoreBridge(assert, storeFile)
+	assert.Equal(2, len(k.completed))
+	assert.Equal("t:0:3", k.completedLRU[0].reqOffset)
+	assert.Equal("t:0:2", k.completedLRU[1].reqOffset)
+
+	// The store is compacted to the live replies on startup
+	b, _ := ioutil.ReadFile(storeFile)
+	assert.Equal(2, strings.Count(string(b), "\n"))
+	assert.NotContains(string(b), "t:0:1")
+	assert.NotContains(string(b), "t:0:4")
+}
+
+func TestRedeliveryStoreCompacted(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	storeFile := path.Join(dir, "completed.jsonl")
+
+	k := newTestRedeliveryStoreBridge(assert, storeFile)
+	for i := 0; i < redeliveryStoreMinCompact-1; i++ {
+		k.addCompleted(&msgContext{reqOffset: fmt.Sprintf("t:0:%d", i)})
+		k.completedLRU[len(k.completedLRU)-1].expiry = time.Now().Add(-1 * time.Second)
+	}
+	k.expireCompleted()
+	assert.Equal(0, len(k.completedLRU))
+	assert.Equal(redeliveryStoreMinCompact-1, k.redeliveryStore.entries)
+
+	k.addCompleted(&msgContext{reqOffset: "t:1:1"})
+	assert.Equal(1, k.redeliveryStore.entries)
+	b, _ := ioutil.ReadFile(storeFile)
+	assert.Equal(1, strings.Count(string(b), "\n"))
+	assert.Contains(string(b), "t:1:1")
+
+	// Appends continue after compaction
+	k.addCompleted(&msgContext{reqOffset: "t:1:2"})
+	b, _ = ioutil.ReadFile(storeFile)
+	assert.Equal(2, strings.Count(string(b), "\n"))
+}
+
+func TestRedeliveryStoreErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.RedeliveryStore = "/missing/completed.jsonl"
+	assert.EqualError(k.loadRedeliveryStore(), "A redelivery grace period is required to persist completed replies")
+
+	k.conf.RedeliveryGracePeriod = 60
+	assert.Regexp("Failed to write redelivery store '/missing/completed.jsonl.tmp'", k.loadRedeliveryStore())
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	k.conf.RedeliveryStore = dir
+	assert.Regexp("Failed to read redelivery store", k.loadRedeliveryStore())
+}
+
+func TestRedeliveryAfterRestart(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	storeFile := path.Join(dir, "completed.jsonl")
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestRedeliveryAfterRestart"
+	msg1bytes, _ := json.Marshal(&msg1)
+	consumerMsg := &sarama.ConsumerMessage{Topic: "in-topic", Partition: 5, Offset: 500, Value: msg1bytes}
+
+	k := newTestRedeliveryStoreBridge(assert, storeFile)
+	k.addCompleted(&msgContext{reqOffset: "in-topic:5:500", key: "key1", replyTopic: "replies", replyBytes: []byte(`{"headers":{"type":"TestReply"}}`)})
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.RedeliveryGracePeriod = 60
+	k.conf.RedeliveryStore = storeFile
+	assert.NoError(k.loadRedeliveryStore())
+
+	// The processor must not see the redelivery, and gets the stored reply
+	mockConsumer.MockMessages <- consumerMsg
+	redeliveryKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- redeliveryKafkaMsg
+	redeliveryBytes, _ := redeliveryKafkaMsg.Value.Encode()
+	assert.Equal(`{"headers":{"type":"TestReply"}}`, string(redeliveryBytes))
+	assert.Equal("replies", redeliveryKafkaMsg.Topic)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(500), mockConsumer.OffsetsByPartition[5])
+	assert.Equal(0, len(processor.messages))
+}
+
+func TestRedeliveryStoreReplyPersistedBeforeCommit(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, _ := ioutil.TempDir("", "redeliverystore")
+	defer os.RemoveAll(dir)
+	storeFile := path.Join(dir, "completed.jsonl")
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.RedeliveryGracePeriod = 60
+	k.conf.RedeliveryStore = storeFile
+	assert.NoError(k.loadRedeliveryStore())
+
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = "TestRedeliveryStoreReplyPersistedBeforeCommit"
+	msgBytes, _ := json.Marshal(&msg)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 200, Value: msgBytes}
+	msgContext1 := <-processor.messages
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 2, Offset: 201, Value: msgBytes}
+	msgContext2 := <-processor.messages
+
+	// The reply to the second message is stored when it is sent, although its
+	// offset cannot be committed until the first message completes
+	reply := kldmessages.ReplyCommon{}
+	reply.Headers.MsgType = "TestReply"
+	go msgContext2.Reply(&reply)
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	for stored := false; !stored; {
+		k.inFlightCond.L.Lock()
+		b, _ := ioutil.ReadFile(storeFile)
+		stored = strings.Contains(string(b), `"reqOffset":":2:201"`)
+		k.inFlightCond.L.Unlock()
+		time.Sleep(1 * time.Millisecond)
+	}
+	assert.Equal(int64(0), mockConsumer.OffsetsByPartition[2])
+
+	go msgContext1.Reply(&reply)
+	replyKafkaMsg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(201), mockConsumer.OffsetsByPartition[2])
+	b, _ := ioutil.ReadFile(storeFile)
+	assert.Equal(2, strings.Count(string(b), "\n"))
+}
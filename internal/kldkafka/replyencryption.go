@@ -0,0 +1,189 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+)
+
+// ReplyEncryptionAlg is the algorithm of the encrypted fields in replies
+const ReplyEncryptionAlg = "AES-256-GCM"
+
+// ReplyEncryptionConf is the set of reply fields to encrypt, by their dot separated
+// paths with the native field names, and the file with the hex encoded 256 bit key.
+// The key ID is included with each encrypted field, to allow the key to be rotated
+type ReplyEncryptionConf struct {
+	Fields  []string `json:"fields,omitempty"`
+	KeyFile string   `json:"keyFile,omitempty"`
+	KeyID   string   `json:"keyID,omitempty"`
+}
+
+// replyEncryption encrypts the configured fields of serialized replies
+type replyEncryption struct {
+	fields []string
+	keyID  string
+	aead   cipher.AEAD
+}
+
+// newReplyEncryption loads the key for the configured fields, returning nil if
+// there are no fields to encrypt. The headers cannot be encrypted, as they are
+// needed to route replies and correlate them with requests
+func newReplyEncryption(conf *ReplyEncryptionConf) (*replyEncryption, error) {
+	if len(conf.Fields) == 0 {
+		return nil, nil
+	}
+	for _, field := range conf.Fields {
+		if field == "" || field == "headers" || strings.HasPrefix(field, "headers.") {
+			return nil, fmt.Errorf("Reply field '%s' cannot be encrypted, as the headers of replies must be in the clear", field)
+		}
+	}
+	if conf.KeyFile == "" {
+		return nil, fmt.Errorf("A key file is required to encrypt reply fields")
+	}
+	keyHex, err := ioutil.ReadFile(conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load reply encryption key from %s: %s", conf.KeyFile, err)
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(keyHex)), "0x"))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Reply encryption key in %s must be 32 bytes, hex encoded", conf.KeyFile)
+	}
+	aead, err := newReplyAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &replyEncryption{
+		fields: conf.Fields,
+		keyID:  conf.KeyID,
+		aead:   aead,
+	}, nil
+}
+
+func newReplyAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt replaces the value of each configured field in a serialized reply with
+// an EncryptedField. Arrays on the path are traversed, so a path such as
+// events.data encrypts the data of every event. The reply is returned as it is
+// if it has none of the fields
+func (e *replyEncryption) encrypt(replyBytes []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(replyBytes))
+	decoder.UseNumber()
+	var reply interface{}
+	if err := decoder.Decode(&reply); err != nil {
+		return nil, err
+	}
+	encrypted := 0
+	for _, field := range e.fields {
+		count, err := e.encryptPath(reply, strings.Split(field, "."), field)
+		if err != nil {
+			return nil, err
+		}
+		encrypted += count
+	}
+	if encrypted == 0 {
+		return replyBytes, nil
+	}
+	return json.Marshal(reply)
+}
+
+func (e *replyEncryption) encryptPath(val interface{}, path []string, field string) (int, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		total := 0
+		for _, child := range v {
+			count, err := e.encryptPath(child, path, field)
+			if err != nil {
+				return 0, err
+			}
+			total += count
+		}
+		return total, nil
+	case map[string]interface{}:
+		child := v[path[0]]
+		if child == nil {
+			return 0, nil
+		}
+		if len(path) > 1 {
+			return e.encryptPath(child, path[1:], field)
+		}
+		sealed, err := e.seal(field, child)
+		if err != nil {
+			return 0, err
+		}
+		v[path[0]] = sealed
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// seal encrypts the JSON of a field value, with a random nonce for each value
+func (e *replyEncryption) seal(field string, val interface{}) (*kldmessages.EncryptedField, error) {
+	plaintext, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, e.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &kldmessages.EncryptedField{
+		Alg:        ReplyEncryptionAlg,
+		KeyID:      e.keyID,
+		Nonce:      base64.StdEncoding.EncodeToString(nonce),
+		Ciphertext: base64.StdEncoding.EncodeToString(e.aead.Seal(nil, nonce, plaintext, []byte(field))),
+	}, nil
+}
+
+// DecryptReplyField decrypts a reply field encrypted by the bridge, returning the
+// JSON of its value. The path is the one configured for the field, such as events.data
+func DecryptReplyField(key []byte, path string, field *kldmessages.EncryptedField) ([]byte, error) {
+	if field.Alg != ReplyEncryptionAlg {
+		return nil, fmt.Errorf("Unsupported encryption algorithm '%s'", field.Alg)
+	}
+	aead, err := newReplyAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(field.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("Invalid nonce for encrypted field '%s'", path)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(field.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ciphertext for encrypted field '%s'", path)
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(path))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt field '%s': %s", path, err)
+	}
+	return plaintext, nil
+}
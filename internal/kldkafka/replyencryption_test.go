@@ -0,0 +1,175 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+var testReplyKey = []byte(strings.Repeat("k", 32))
+
+func newTestReplyEncryption(assert *assert.Assertions, fields ...string) (*replyEncryption, func()) {
+	dir, _ := ioutil.TempDir("", "replyencryption")
+	keyFile := path.Join(dir, "reply.key")
+	ioutil.WriteFile(keyFile, []byte("0x"+hex.EncodeToString(testReplyKey)+"\n"), 0600)
+	e, err := newReplyEncryption(&ReplyEncryptionConf{Fields: fields, KeyFile: keyFile, KeyID: "key1"})
+	assert.NoError(err)
+	return e, func() { os.RemoveAll(dir) }
+}
+
+func decryptTestReplyField(assert *assert.Assertions, path string, val interface{}) interface{} {
+	var field kldmessages.EncryptedField
+	fieldBytes, _ := json.Marshal(val)
+	assert.NoError(json.Unmarshal(fieldBytes, &field))
+	assert.Equal(ReplyEncryptionAlg, field.Alg)
+	assert.Equal("key1", field.KeyID)
+	plaintext, err := DecryptReplyField(testReplyKey, path, &field)
+	assert.NoError(err)
+	var decrypted interface{}
+	json.Unmarshal(plaintext, &decrypted)
+	return decrypted
+}
+
+func TestReplyEncryptionFields(t *testing.T) {
+	assert := assert.New(t)
+
+	e, cleanup := newTestReplyEncryption(assert, "events.data", "address", "missing.field")
+	defer cleanup()
+
+	var reply kldmessages.Events
+	reply.Headers.MsgType = kldmessages.MsgTypeEvents
+	reply.Headers.ReqID = "req1"
+	reply.Address = "0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"
+	reply.Event = "Changed"
+	reply.Events = []*kldmessages.Event{
+		{BlockNumber: "1", Data: map[string]interface{}{"name": "alice"}},
+		{BlockNumber: "2", Data: map[string]interface{}{"name": "bob"}},
+	}
+	replyBytes, _ := json.Marshal(&reply)
+	encrypted, err := e.encrypt(replyBytes)
+	assert.NoError(err)
+	assert.NotContains(string(encrypted), "alice")
+
+	var encryptedReply map[string]interface{}
+	json.Unmarshal(encrypted, &encryptedReply)
+	assert.Equal("req1", encryptedReply["headers"].(map[string]interface{})["requestId"])
+	assert.Equal("Changed", encryptedReply["event"])
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", decryptTestReplyField(assert, "address", encryptedReply["address"]))
+	events := encryptedReply["events"].([]interface{})
+	assert.Equal("2", events[1].(map[string]interface{})["blockNumber"])
+	assert.Equal(map[string]interface{}{"name": "alice"}, decryptTestReplyField(assert, "events.data", events[0].(map[string]interface{})["data"]))
+	assert.Equal(map[string]interface{}{"name": "bob"}, decryptTestReplyField(assert, "events.data", events[1].(map[string]interface{})["data"]))
+}
+
+func TestReplyEncryptionNoMatchingFields(t *testing.T) {
+	assert := assert.New(t)
+
+	e, cleanup := newTestReplyEncryption(assert, "events.data")
+	defer cleanup()
+
+	replyBytes := []byte(`{"headers":{"type":"Balance"},"balance":"10"}`)
+	encrypted, err := e.encrypt(replyBytes)
+	assert.NoError(err)
+	assert.Equal(replyBytes, encrypted)
+
+	_, err = e.encrypt([]byte("!json"))
+	assert.Error(err)
+}
+
+func TestDecryptReplyFieldErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	e, cleanup := newTestReplyEncryption(assert, "data")
+	defer cleanup()
+	field, err := e.seal("data", "secret")
+	assert.NoError(err)
+
+	// The path is authenticated, so a value cannot be moved to another field
+	_, err = DecryptReplyField(testReplyKey, "other", field)
+	assert.Regexp("Failed to decrypt field 'other'", err)
+
+	_, err = DecryptReplyField(testReplyKey, "data", &kldmessages.EncryptedField{Alg: "ROT13"})
+	assert.EqualError(err, "Unsupported encryption algorithm 'ROT13'")
+	_, err = DecryptReplyField(testReplyKey, "data", &kldmessages.EncryptedField{Alg: ReplyEncryptionAlg, Nonce: "!"})
+	assert.EqualError(err, "Invalid nonce for encrypted field 'data'")
+	_, err = DecryptReplyField(testReplyKey, "data", &kldmessages.EncryptedField{Alg: ReplyEncryptionAlg, Nonce: field.Nonce, Ciphertext: "!"})
+	assert.EqualError(err, "Invalid ciphertext for encrypted field 'data'")
+	_, err = DecryptReplyField([]byte("short"), "data", field)
+	assert.Error(err)
+}
+
+func TestNewReplyEncryptionErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	e, err := newReplyEncryption(&ReplyEncryptionConf{})
+	assert.NoError(err)
+	assert.Nil(e)
+
+	_, err = newReplyEncryption(&ReplyEncryptionConf{Fields: []string{"headers.ctx"}, KeyFile: "reply.key"})
+	assert.EqualError(err, "Reply field 'headers.ctx' cannot be encrypted, as the headers of replies must be in the clear")
+
+	_, err = newReplyEncryption(&ReplyEncryptionConf{Fields: []string{"data"}})
+	assert.EqualError(err, "A key file is required to encrypt reply fields")
+
+	_, err = newReplyEncryption(&ReplyEncryptionConf{Fields: []string{"data"}, KeyFile: "/missing/reply.key"})
+	assert.Regexp("Failed to load reply encryption key from /missing/reply.key", err)
+
+	dir, _ := ioutil.TempDir("", "replyencryption")
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "reply.key")
+	ioutil.WriteFile(keyFile, []byte("0x1234"), 0600)
+	_, err = newReplyEncryption(&ReplyEncryptionConf{Fields: []string{"data"}, KeyFile: keyFile})
+	assert.EqualError(err, "Reply encryption key in "+keyFile+" must be 32 bytes, hex encoded")
+}
+
+func TestMarshalReplyEncryptedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	e, cleanup := newTestReplyEncryption(assert, "balance")
+	defer cleanup()
+	k.replyEncryption = e
+	k.conf.KafkaHeaders.ReplyFields = map[string]string{"balance": "balance", "type": "headers.type"}
+	ctx := &msgContext{bridge: k}
+
+	reply := &kldmessages.Balance{BalanceStr: "12345"}
+	reply.Headers.MsgType = kldmessages.MsgTypeBalance
+	replyBytes := ctx.marshalReply(reply)
+	assert.NotContains(string(replyBytes), "12345")
+
+	// Kafka headers from reply fields only see the encrypted values
+	assert.Equal(2, len(ctx.replyFieldHeaders))
+	assert.Equal("balance", string(ctx.replyFieldHeaders[0].Key))
+	assert.NotContains(string(ctx.replyFieldHeaders[0].Value), "12345")
+	assert.Equal(kldmessages.MsgTypeBalance, string(ctx.replyFieldHeaders[1].Value))
+}
+
+func TestExecuteBridgeWithReplyEncryptionNoKey(t *testing.T) {
+	assert := assert.New(t)
+
+	_, kafkaCmd := newTestKafkaBridge()
+	kafkaCmd.SetArgs(append(kbMinWorkingArgs, "--encrypt-reply-field", "data"))
+	err := kafkaCmd.Execute()
+	assert.EqualError(err, "A key file is required to encrypt reply fields")
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+)
+
+const (
+	// ReplyEnvelopeNative sends replies in the native ethconnect format (default)
+	ReplyEnvelopeNative = "native"
+	// ReplyEnvelopeCloudEvents wraps replies in a CloudEvents v1.0 JSON event
+	ReplyEnvelopeCloudEvents = "cloudevents"
+	// DefaultCloudEventsSource is the CloudEvents source used if none is configured
+	DefaultCloudEventsSource = "/ethconnect"
+	// CloudEventsTypePrefix is prepended to the reply type, to give the CloudEvents type
+	CloudEventsTypePrefix = "io.kaleido.ethconnect."
+)
+
+// ReplyEnvelope formats serialized replies for the consumers of the reply topic
+type ReplyEnvelope interface {
+	Wrap(headers *kldmessages.ReplyHeaders, reply []byte) ([]byte, error)
+}
+
+// NewReplyEnvelope returns the reply envelope selected in the configuration
+func NewReplyEnvelope(conf *KafkaBridgeConf) ReplyEnvelope {
+	if conf.ReplyEnvelope == ReplyEnvelopeCloudEvents {
+		source := conf.CloudEventsSource
+		if source == "" {
+			source = DefaultCloudEventsSource
+		}
+		return &cloudEventsReplyEnvelope{source: source}
+	}
+	return &nativeReplyEnvelope{}
+}
+
+type nativeReplyEnvelope struct{}
+
+// Wrap returns the reply unchanged
+func (e *nativeReplyEnvelope) Wrap(headers *kldmessages.ReplyHeaders, reply []byte) ([]byte, error) {
+	return reply, nil
+}
+
+type cloudEventsReplyEnvelope struct {
+	source string
+}
+
+// cloudEvent is the JSON structured content mode of a CloudEvents v1.0 event
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            string          `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// Wrap puts the whole reply in the data of the event. The reply ID is the event ID,
+// and the ID of the request is the subject so consumers can correlate without
+// parsing the data
+func (e *cloudEventsReplyEnvelope) Wrap(headers *kldmessages.ReplyHeaders, reply []byte) ([]byte, error) {
+	return json.Marshal(&cloudEvent{
+		SpecVersion:     "1.0",
+		Type:            CloudEventsTypePrefix + headers.MsgType,
+		Source:          e.source,
+		ID:              headers.ID,
+		Subject:         headers.ReqID,
+		Time:            time.Now().UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            reply,
+	})
+}
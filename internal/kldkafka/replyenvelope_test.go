@@ -0,0 +1,75 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNativeReplyEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	e := NewReplyEnvelope(&KafkaBridgeConf{})
+	reply := []byte(`{"headers":{"type":"TransactionSuccess"}}`)
+	wrapped, err := e.Wrap(&kldmessages.ReplyHeaders{}, reply)
+
+	assert.NoError(err)
+	assert.Equal(reply, wrapped)
+}
+
+func TestCloudEventsReplyEnvelope(t *testing.T) {
+	assert := assert.New(t)
+
+	e := NewReplyEnvelope(&KafkaBridgeConf{
+		ReplyEnvelope:     ReplyEnvelopeCloudEvents,
+		CloudEventsSource: "/my/source",
+	})
+	headers := &kldmessages.ReplyHeaders{ReqID: "req1"}
+	headers.ID = "reply1"
+	headers.MsgType = kldmessages.MsgTypeTransactionSuccess
+	wrapped, err := e.Wrap(headers, []byte(`{"headers":{"type":"TransactionSuccess"}}`))
+	assert.NoError(err)
+
+	var event map[string]interface{}
+	json.Unmarshal(wrapped, &event)
+	assert.Equal("1.0", event["specversion"])
+	assert.Equal("io.kaleido.ethconnect.TransactionSuccess", event["type"])
+	assert.Equal("/my/source", event["source"])
+	assert.Equal("reply1", event["id"])
+	assert.Equal("req1", event["subject"])
+	assert.Equal("application/json", event["datacontenttype"])
+	_, err = time.Parse(time.RFC3339Nano, event["time"].(string))
+	assert.NoError(err)
+	assert.Equal("TransactionSuccess", event["data"].(map[string]interface{})["headers"].(map[string]interface{})["type"])
+}
+
+func TestCloudEventsReplyEnvelopeDefaultSource(t *testing.T) {
+	assert := assert.New(t)
+
+	e := NewReplyEnvelope(&KafkaBridgeConf{ReplyEnvelope: ReplyEnvelopeCloudEvents})
+	wrapped, err := e.Wrap(&kldmessages.ReplyHeaders{}, []byte(`{}`))
+	assert.NoError(err)
+
+	var event map[string]interface{}
+	json.Unmarshal(wrapped, &event)
+	assert.Equal(DefaultCloudEventsSource, event["source"])
+	_, hasSubject := event["subject"]
+	assert.False(hasSubject)
+}
@@ -0,0 +1,103 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+)
+
+// replyLoadWindow is the minimum period the processing rate is measured over
+const replyLoadWindow = 10 * time.Second
+
+// replyLoad tracks the load the bridge reports in the headers of replies. The
+// consumer lag is the messages after the last one consumed from each partition,
+// from the high water marks of the consumer. The processing rate is the replies
+// per second from the message metrics, over the last complete window
+type replyLoad struct {
+	lock        sync.Mutex
+	consumer    KafkaConsumer
+	consumed    map[string]map[int32]int64
+	rate        float64
+	windowStart time.Time
+	windowTotal uint64
+}
+
+func newReplyLoad() *replyLoad {
+	return &replyLoad{
+		consumed:    make(map[string]map[int32]int64),
+		windowStart: time.Now(),
+	}
+}
+
+// consumedMsg records the offset of a message received from the consumer
+func (l *replyLoad) consumedMsg(consumer KafkaConsumer, msg *sarama.ConsumerMessage) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.consumer = consumer
+	partitions, exists := l.consumed[msg.Topic]
+	if !exists {
+		partitions = make(map[int32]int64)
+		l.consumed[msg.Topic] = partitions
+	}
+	partitions[msg.Partition] = msg.Offset
+}
+
+// lag returns the approximate number of messages waiting to be consumed, across
+// the partitions currently assigned to the consumer
+func (l *replyLoad) lag() (lag int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.consumer == nil {
+		return 0
+	}
+	for topic, partitions := range l.consumer.HighWaterMarks() {
+		for partition, highWaterMark := range partitions {
+			if consumed, exists := l.consumed[topic][partition]; exists && highWaterMark > consumed+1 {
+				lag += highWaterMark - consumed - 1
+			}
+		}
+	}
+	return lag
+}
+
+// processingRate returns the replies per second, from the total replies sent,
+// starting a new window once the current one is complete
+func (l *replyLoad) processingRate(total uint64) float64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	if elapsed := now.Sub(l.windowStart); elapsed >= replyLoadWindow {
+		l.rate = float64(total-l.windowTotal) / elapsed.Seconds()
+		l.windowStart = now
+		l.windowTotal = total
+	}
+	return l.rate
+}
+
+// bridgeLoad returns the load to report in a reply
+func (k *KafkaBridge) bridgeLoad() *kldmessages.BridgeLoad {
+	k.inFlightCond.L.Lock()
+	inFlight := len(k.inFlight)
+	k.inFlightCond.L.Unlock()
+	return &kldmessages.BridgeLoad{
+		InFlight:       inFlight,
+		ConsumerLag:    k.replyLoad.lag(),
+		ProcessingRate: k.replyLoad.processingRate(k.msgsTotal.Total()),
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplyLoadLag(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newReplyLoad()
+	assert.Equal(int64(0), l.lag())
+
+	consumer := &MockKafkaConsumer{MockHighWaterMarks: map[string]map[int32]int64{
+		"in-topic": {0: 11, 1: 6, 2: 100},
+	}}
+	l.consumedMsg(consumer, &sarama.ConsumerMessage{Topic: "in-topic", Partition: 0, Offset: 5})
+	l.consumedMsg(consumer, &sarama.ConsumerMessage{Topic: "in-topic", Partition: 1, Offset: 5})
+	// Partition 2 has not been consumed from yet, so its lag is unknown
+	assert.Equal(int64(5), l.lag())
+
+	l.consumedMsg(consumer, &sarama.ConsumerMessage{Topic: "in-topic", Partition: 0, Offset: 10})
+	assert.Equal(int64(0), l.lag())
+}
+
+func TestReplyLoadProcessingRate(t *testing.T) {
+	assert := assert.New(t)
+
+	l := newReplyLoad()
+	assert.Equal(float64(0), l.processingRate(10))
+
+	l.windowStart = time.Now().Add(-20 * time.Second)
+	assert.InDelta(float64(1), l.processingRate(20), 0.01)
+
+	// The rate is kept until the next window is complete
+	assert.InDelta(float64(1), l.processingRate(1000), 0.01)
+	assert.Equal(uint64(20), l.windowTotal)
+}
+
+func TestReplyWithLoad(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.ReplyLoad = true
+	mockConsumer.MockHighWaterMarks = map[string]map[int32]int64{"in-topic": {3: 20}}
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestReplyWithLoad"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Topic: "in-topic", Partition: 3, Offset: 10, Value: msg1bytes}
+
+	msgContext1 := <-processor.messages
+	go func() {
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+
+	var reply kldmessages.ReplyCommon
+	json.Unmarshal(replyBytes, &reply)
+	assert.NotNil(reply.Headers.Load)
+	assert.Equal(1, reply.Headers.Load.InFlight)
+	assert.Equal(int64(9), reply.Headers.Load.ConsumerLag)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxReplyTopics is the number of topics a reply topic template can send to, if not configured
+	DefaultMaxReplyTopics = 100
+)
+
+// Kafka only allows these characters in topic names, up to 249 characters
+var kafkaTopicName = regexp.MustCompile("^[a-zA-Z0-9._-]{1,249}$")
+
+// ReplyTopicConf configures a template for computing the topic of each reply
+// from the headers of the request, such as replies.{account}
+type ReplyTopicConf struct {
+	Template  string `json:"template,omitempty"`
+	Allowed   string `json:"allowed,omitempty"`
+	MaxTopics int    `json:"maxTopics,omitempty"`
+}
+
+// replyTopics computes the topic for each reply from the template, keeping track
+// of the topics used so only a limited number are ever sent to (and created)
+type replyTopics struct {
+	template  string
+	allowed   *regexp.Regexp
+	maxTopics int
+	lock      sync.Mutex
+	used      map[string]bool
+}
+
+// newReplyTopics validates the reply topic configuration. Returns nil if there is no template
+func newReplyTopics(conf *ReplyTopicConf) (t *replyTopics, err error) {
+	if conf.Template == "" {
+		return nil, nil
+	}
+	if unknown := strings.NewReplacer("{account}", "", "{tenant}", "").Replace(conf.Template); strings.ContainsAny(unknown, "{}") {
+		return nil, fmt.Errorf("Reply topic template '%s' can only contain the placeholders {account} and {tenant}", conf.Template)
+	}
+	t = &replyTopics{
+		template:  conf.Template,
+		maxTopics: conf.MaxTopics,
+		used:      make(map[string]bool),
+	}
+	if t.maxTopics <= 0 {
+		t.maxTopics = DefaultMaxReplyTopics
+	}
+	if conf.Allowed != "" {
+		if t.allowed, err = regexp.Compile("^(?:" + conf.Allowed + ")$"); err != nil {
+			return nil, fmt.Errorf("Invalid allowed reply topic pattern '%s': %s", conf.Allowed, err)
+		}
+	}
+	return t, nil
+}
+
+// topicFor computes the reply topic for a request. The default topic is used if
+// a header in the template is empty, or the topic is not allowed, or the maximum
+// number of topics would be exceeded
+func (t *replyTopics) topicFor(headers *kldmessages.CommonHeaders, defaultTopic string) string {
+	if (strings.Contains(t.template, "{account}") && headers.Account == "") ||
+		(strings.Contains(t.template, "{tenant}") && headers.Tenant == "") {
+		return defaultTopic
+	}
+	topic := strings.NewReplacer("{account}", headers.Account, "{tenant}", headers.Tenant).Replace(t.template)
+	if !kafkaTopicName.MatchString(topic) || (t.allowed != nil && !t.allowed.MatchString(topic)) {
+		log.Warnf("Reply topic '%s' is not allowed. Using default topic '%s'", topic, defaultTopic)
+		return defaultTopic
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.used[topic] {
+		if len(t.used) >= t.maxTopics {
+			log.Warnf("Reply topic '%s' would exceed the maximum of %d reply topics. Using default topic '%s'", topic, t.maxTopics, defaultTopic)
+			return defaultTopic
+		}
+		log.Infof("Sending replies to new topic '%s'", topic)
+		t.used[topic] = true
+	}
+	return topic
+}
+
+// replyTopicFor returns the topic for a reply. Dead-lettered messages go to the
+// dead-letter topic if one is configured. Error replies go to the error
+// topic if one is configured, and other replies to the topic from the reply
+// topic template, or the output topic. The template cannot select the request
+// topic, unless in single topic mode
+func (k *KafkaBridge) replyTopicFor(c *msgContext) string {
+	if c.deadLetter && k.conf.DeadLetter.Topic != "" {
+		return k.conf.DeadLetter.Topic
+	}
+	if c.replyType == kldmessages.MsgTypeError && k.conf.ErrorTopicOut != "" {
+		return k.conf.ErrorTopicOut
+	}
+	topic := k.kafka.Conf().TopicOut
+	if k.replyTopics != nil {
+		topic = k.replyTopics.topicFor(&c.requestCommon.Headers, topic)
+		if topic == k.kafka.Conf().TopicIn && !k.conf.SingleTopic {
+			log.Warnf("Reply topic '%s' is the request topic. Using default topic '%s'", topic, k.kafka.Conf().TopicOut)
+			topic = k.kafka.Conf().TopicOut
+		}
+	}
+	return topic
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewReplyTopicsNoTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	topics, err := newReplyTopics(&ReplyTopicConf{})
+	assert.NoError(err)
+	assert.Nil(topics)
+}
+
+func TestNewReplyTopicsBadPlaceholder(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newReplyTopics(&ReplyTopicConf{Template: "replies.{from}"})
+	assert.EqualError(err, "Reply topic template 'replies.{from}' can only contain the placeholders {account} and {tenant}")
+}
+
+func TestNewReplyTopicsBadAllowed(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := newReplyTopics(&ReplyTopicConf{Template: "replies.{tenant}", Allowed: "(("})
+	assert.Regexp("Invalid allowed reply topic pattern", err.Error())
+}
+
+func TestReplyTopicFor(t *testing.T) {
+	assert := assert.New(t)
+
+	topics, err := newReplyTopics(&ReplyTopicConf{
+		Template: "replies.{tenant}.{account}",
+		Allowed:  "replies\\.(tenant1|tenant2)\\..*",
+	})
+	assert.NoError(err)
+	assert.Equal(DefaultMaxReplyTopics, topics.maxTopics)
+
+	headers := &kldmessages.CommonHeaders{Tenant: "tenant1", Account: "acc1"}
+	assert.Equal("replies.tenant1.acc1", topics.topicFor(headers, "default"))
+
+	// Missing header
+	assert.Equal("default", topics.topicFor(&kldmessages.CommonHeaders{Tenant: "tenant1"}, "default"))
+
+	// Not allowed by the pattern
+	headers = &kldmessages.CommonHeaders{Tenant: "tenant3", Account: "acc1"}
+	assert.Equal("default", topics.topicFor(headers, "default"))
+
+	// Not a legal Kafka topic name
+	headers = &kldmessages.CommonHeaders{Tenant: "tenant1", Account: "acc/1"}
+	assert.Equal("default", topics.topicFor(headers, "default"))
+}
+
+func TestReplyTopicForMaxTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	topics, _ := newReplyTopics(&ReplyTopicConf{Template: "replies.{account}", MaxTopics: 2})
+
+	assert.Equal("replies.acc1", topics.topicFor(&kldmessages.CommonHeaders{Account: "acc1"}, "default"))
+	assert.Equal("replies.acc2", topics.topicFor(&kldmessages.CommonHeaders{Account: "acc2"}, "default"))
+	assert.Equal("default", topics.topicFor(&kldmessages.CommonHeaders{Account: "acc3"}, "default"))
+	// Topics already in use continue to be used
+	assert.Equal("replies.acc1", topics.topicFor(&kldmessages.CommonHeaders{Account: "acc1"}, "default"))
+}
+
+func TestReplyTopicTemplate(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.replyTopics, _ = newReplyTopics(&ReplyTopicConf{Template: "replies.{account}"})
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestReplyTopicTemplate"
+	msg1.Headers.Account = "acc1"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msg1bytes}
+
+	msgContext1 := <-processor.messages
+	go func() {
+		msgContext1.Reply(&kldmessages.ReplyCommon{})
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal("replies.acc1", replyKafkaMsg.Topic)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestErrorTopicOut(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.ErrorTopicOut = "errors"
+	k.replyTopics, _ = newReplyTopics(&ReplyTopicConf{Template: "replies.{account}"})
+
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = "TestErrorTopicOut"
+	msg.Headers.Account = "acc1"
+	msgBytes, _ := json.Marshal(&msg)
+
+	// Error replies go to the error topic, ahead of the template
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msgBytes, Offset: 0}
+	msgContext1 := <-processor.messages
+	go func() {
+		msgContext1.SendErrorReply(400, fmt.Errorf("pop"))
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal("errors", replyKafkaMsg.Topic)
+
+	// Other replies are unaffected
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: msgBytes, Offset: 1}
+	msgContext2 := <-processor.messages
+	go func() {
+		msgContext2.Reply(&kldmessages.ReplyCommon{})
+	}()
+	replyKafkaMsg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	assert.Equal("replies.acc1", replyKafkaMsg.Topic)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(1), mockConsumer.OffsetsByPartition[0])
+}
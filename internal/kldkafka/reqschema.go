@@ -0,0 +1,436 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/icza/dyno"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// maxSchemaErrors limits the number of validation errors reported in a reply
+const maxSchemaErrors = 10
+
+// jsonSchema is the subset of JSON Schema we validate requests against.
+// Keywords we do not support are rejected on load, so a schema is never
+// silently weaker than its author intended
+type jsonSchema struct {
+	Type                 schemaTypes            `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *schemaOrBool          `json:"additionalProperties"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *json.Number           `json:"minimum"`
+	Maximum              *json.Number           `json:"maximum"`
+	MinItems             *int                   `json:"minItems"`
+	MaxItems             *int                   `json:"maxItems"`
+	AllOf                []*jsonSchema          `json:"allOf"`
+	AnyOf                []*jsonSchema          `json:"anyOf"`
+	OneOf                []*jsonSchema          `json:"oneOf"`
+	pattern              *regexp.Regexp
+	enumJSON             []string
+}
+
+// schemaTypes is the "type" keyword, which is a single type or a list
+type schemaTypes []string
+
+func (t *schemaTypes) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*t = schemaTypes{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("'type' must be a string or an array of strings")
+	}
+	*t = schemaTypes(list)
+	return nil
+}
+
+// schemaOrBool is the "additionalProperties" keyword, which is a boolean or a schema
+type schemaOrBool struct {
+	allowed bool
+	schema  *jsonSchema
+}
+
+func (s *schemaOrBool) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &s.allowed); err == nil {
+		return nil
+	}
+	s.allowed = true
+	return json.Unmarshal(b, &s.schema)
+}
+
+// schemaKeywords are the keywords of jsonSchema, and the annotations that do not affect validation
+var schemaKeywords = map[string]bool{
+	"type": true, "properties": true, "required": true, "additionalProperties": true, "items": true,
+	"enum": true, "pattern": true, "minLength": true, "maxLength": true, "minimum": true, "maximum": true,
+	"minItems": true, "maxItems": true, "allOf": true, "anyOf": true, "oneOf": true,
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true, "default": true, "examples": true,
+}
+
+var schemaTypeNames = map[string]bool{
+	"object": true, "array": true, "string": true, "number": true, "integer": true, "boolean": true, "null": true,
+}
+
+// requestSchema holds the JSON Schema that the whole of each request must
+// conform to, which can be reloaded while the bridge is running
+type requestSchema struct {
+	lock   sync.RWMutex
+	file   string
+	schema *jsonSchema
+}
+
+func newRequestSchema() *requestSchema {
+	return &requestSchema{}
+}
+
+// load reads and compiles the schema in the file. The existing schema is kept
+// if the file cannot be loaded
+func (r *requestSchema) load(file string) error {
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read request schema from %s: %s", file, err)
+	}
+	// YAML is a superset of JSON, so we handle both
+	yamlSchema := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(fileBytes, &yamlSchema); err != nil {
+		return fmt.Errorf("Failed to parse request schema in %s: %s", file, err)
+	}
+	genericSchema := dyno.ConvertMapI2MapS(yamlSchema)
+	if err = checkKeywords("$", genericSchema); err != nil {
+		return fmt.Errorf("Invalid request schema in %s: %s", file, err)
+	}
+	jsonBytes, _ := json.Marshal(genericSchema)
+	var schema *jsonSchema
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.UseNumber()
+	if err = decoder.Decode(&schema); err != nil {
+		return fmt.Errorf("Failed to parse request schema in %s: %s", file, err)
+	}
+	if err = schema.compile("$"); err != nil {
+		return fmt.Errorf("Invalid request schema in %s: %s", file, err)
+	}
+
+	r.lock.Lock()
+	r.file = file
+	r.schema = schema
+	r.lock.Unlock()
+	log.Infof("Loaded request schema from %s", file)
+	return nil
+}
+
+// reload reads the schema again from the file it was loaded from
+func (r *requestSchema) reload() {
+	r.lock.RLock()
+	file := r.file
+	r.lock.RUnlock()
+	if file == "" {
+		return
+	}
+	if err := r.load(file); err != nil {
+		log.Errorf("Request schema not reloaded: %s", err)
+	}
+}
+
+// validate checks the raw request against the schema, returning an error
+// listing each place the request does not conform. Nil if no schema is loaded
+func (r *requestSchema) validate(msgBytes []byte) error {
+	r.lock.RLock()
+	schema := r.schema
+	r.lock.RUnlock()
+	if schema == nil {
+		return nil
+	}
+	var msg interface{}
+	decoder := json.NewDecoder(bytes.NewReader(msgBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(&msg); err != nil {
+		return fmt.Errorf("Request is not valid JSON: %s", err)
+	}
+	errs := schema.validate("$", msg, nil)
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) > maxSchemaErrors {
+		errs = append(errs[0:maxSchemaErrors], fmt.Sprintf("(%d more)", len(errs)-maxSchemaErrors))
+	}
+	return fmt.Errorf("Request failed schema validation: %s", strings.Join(errs, "; "))
+}
+
+// compile checks the keywords in the schema, and prepares patterns and enums for validation
+func (s *jsonSchema) compile(path string) (err error) {
+	if s == nil {
+		return fmt.Errorf("%s: schema is empty", path)
+	}
+	for _, t := range s.Type {
+		if !schemaTypeNames[t] {
+			return fmt.Errorf("%s: unknown type '%s'", path, t)
+		}
+	}
+	if s.Pattern != "" {
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return fmt.Errorf("%s: invalid pattern: %s", path, err)
+		}
+	}
+	for _, value := range s.Enum {
+		s.enumJSON = append(s.enumJSON, canonicalJSON(value))
+	}
+	for name, property := range s.Properties {
+		if err = property.compile(path + "." + name); err != nil {
+			return
+		}
+	}
+	if s.AdditionalProperties != nil && s.AdditionalProperties.schema != nil {
+		if err = s.AdditionalProperties.schema.compile(path + ".*"); err != nil {
+			return
+		}
+	}
+	if s.Items != nil {
+		if err = s.Items.compile(path + "[]"); err != nil {
+			return
+		}
+	}
+	for keyword, subSchemas := range map[string][]*jsonSchema{"allOf": s.AllOf, "anyOf": s.AnyOf, "oneOf": s.OneOf} {
+		for i, subSchema := range subSchemas {
+			if err = subSchema.compile(fmt.Sprintf("%s.%s[%d]", path, keyword, i)); err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+// checkKeywords walks the schema before it is parsed, as keywords that are
+// not fields of jsonSchema would otherwise be dropped by the JSON decoder
+func checkKeywords(path string, schema interface{}) error {
+	schemaMap, ok := schema.(map[string]interface{})
+	if !ok {
+		// A schema that is not an object fails to parse
+		return nil
+	}
+	keywords := make([]string, 0, len(schemaMap))
+	for keyword := range schemaMap {
+		keywords = append(keywords, keyword)
+	}
+	sort.Strings(keywords)
+	for _, keyword := range keywords {
+		if !schemaKeywords[keyword] {
+			return fmt.Errorf("%s: '%s' is not supported", path, keyword)
+		}
+	}
+	if properties, ok := schemaMap["properties"].(map[string]interface{}); ok {
+		for name, property := range properties {
+			if err := checkKeywords(path+"."+name, property); err != nil {
+				return err
+			}
+		}
+	}
+	if err := checkKeywords(path+".*", schemaMap["additionalProperties"]); err != nil {
+		return err
+	}
+	if err := checkKeywords(path+"[]", schemaMap["items"]); err != nil {
+		return err
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		subSchemas, _ := schemaMap[keyword].([]interface{})
+		for i, subSchema := range subSchemas {
+			if err := checkKeywords(fmt.Sprintf("%s.%s[%d]", path, keyword, i), subSchema); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate appends an error for each way the value does not match the schema
+func (s *jsonSchema) validate(path string, value interface{}, errs []string) []string {
+	if len(s.Type) > 0 && !s.matchesType(value) {
+		return append(errs, fmt.Sprintf("%s: must be of type %s", path, strings.Join(s.Type, " or ")))
+	}
+	if len(s.enumJSON) > 0 {
+		valueJSON := canonicalJSON(value)
+		found := false
+		for _, enumJSON := range s.enumJSON {
+			if enumJSON == valueJSON {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: must be one of %s", path, strings.Join(s.enumJSON, ", ")))
+		}
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		errs = s.validateObject(path, v, errs)
+	case []interface{}:
+		errs = s.validateArray(path, v, errs)
+	case string:
+		errs = s.validateString(path, v, errs)
+	case json.Number:
+		errs = s.validateNumber(path, v, errs)
+	}
+	for _, subSchema := range s.AllOf {
+		errs = subSchema.validate(path, value, errs)
+	}
+	if len(s.AnyOf) > 0 && s.countMatches(s.AnyOf, path, value) == 0 {
+		errs = append(errs, fmt.Sprintf("%s: must match at least one schema in anyOf", path))
+	}
+	if len(s.OneOf) > 0 && s.countMatches(s.OneOf, path, value) != 1 {
+		errs = append(errs, fmt.Sprintf("%s: must match exactly one schema in oneOf", path))
+	}
+	return errs
+}
+
+func (s *jsonSchema) countMatches(subSchemas []*jsonSchema, path string, value interface{}) (matches int) {
+	for _, subSchema := range subSchemas {
+		if len(subSchema.validate(path, value, nil)) == 0 {
+			matches++
+		}
+	}
+	return
+}
+
+func (s *jsonSchema) matchesType(value interface{}) bool {
+	for _, t := range s.Type {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case json.Number:
+			if t == "number" {
+				return true
+			}
+			if f, ok := new(big.Float).SetString(v.String()); t == "integer" && ok && f.IsInt() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (s *jsonSchema) validateObject(path string, obj map[string]interface{}, errs []string) []string {
+	for _, name := range s.Required {
+		if _, exists := obj[name]; !exists {
+			errs = append(errs, fmt.Sprintf("%s.%s: is required", path, name))
+		}
+	}
+	// Sort the names, so the errors are in a consistent order
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if property, exists := s.Properties[name]; exists {
+			errs = property.validate(path+"."+name, obj[name], errs)
+		} else if s.AdditionalProperties != nil {
+			if !s.AdditionalProperties.allowed {
+				errs = append(errs, fmt.Sprintf("%s.%s: is not allowed", path, name))
+			} else if s.AdditionalProperties.schema != nil {
+				errs = s.AdditionalProperties.schema.validate(path+"."+name, obj[name], errs)
+			}
+		}
+	}
+	return errs
+}
+
+func (s *jsonSchema) validateArray(path string, arr []interface{}, errs []string) []string {
+	if s.MinItems != nil && len(arr) < *s.MinItems {
+		errs = append(errs, fmt.Sprintf("%s: must have at least %d items", path, *s.MinItems))
+	}
+	if s.MaxItems != nil && len(arr) > *s.MaxItems {
+		errs = append(errs, fmt.Sprintf("%s: must have at most %d items", path, *s.MaxItems))
+	}
+	if s.Items != nil {
+		for i, item := range arr {
+			errs = s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item, errs)
+		}
+	}
+	return errs
+}
+
+func (s *jsonSchema) validateString(path string, str string, errs []string) []string {
+	length := len([]rune(str))
+	if s.MinLength != nil && length < *s.MinLength {
+		errs = append(errs, fmt.Sprintf("%s: must be at least %d characters", path, *s.MinLength))
+	}
+	if s.MaxLength != nil && length > *s.MaxLength {
+		errs = append(errs, fmt.Sprintf("%s: must be at most %d characters", path, *s.MaxLength))
+	}
+	if s.pattern != nil && !s.pattern.MatchString(str) {
+		errs = append(errs, fmt.Sprintf("%s: must match pattern '%s'", path, s.Pattern))
+	}
+	return errs
+}
+
+func (s *jsonSchema) validateNumber(path string, num json.Number, errs []string) []string {
+	// Compare as big floats, as values such as wei amounts overflow a float64
+	value, ok := new(big.Float).SetString(num.String())
+	if !ok {
+		return errs
+	}
+	if s.Minimum != nil {
+		if minimum, ok := new(big.Float).SetString(s.Minimum.String()); ok && value.Cmp(minimum) < 0 {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %s", path, s.Minimum))
+		}
+	}
+	if s.Maximum != nil {
+		if maximum, ok := new(big.Float).SetString(s.Maximum.String()); ok && value.Cmp(maximum) > 0 {
+			errs = append(errs, fmt.Sprintf("%s: must be at most %s", path, s.Maximum))
+		}
+	}
+	return errs
+}
+
+// canonicalJSON serializes a value for comparison with an enum.
+// Maps are serialized with sorted keys
+func canonicalJSON(value interface{}) string {
+	b, _ := json.Marshal(value)
+	return string(b)
+}
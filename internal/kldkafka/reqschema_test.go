@@ -0,0 +1,206 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testRequestSchemaYAML = `
+type: object
+required: [headers, from]
+properties:
+  headers:
+    type: object
+    required: [type]
+    properties:
+      type:
+        enum: [SendTransaction, DeployContract]
+  from:
+    type: string
+    pattern: '^0x[0-9a-fA-F]{40}$'
+  gas:
+    type: [string, integer]
+    minimum: 21000
+  params:
+    type: array
+    maxItems: 2
+    items:
+      type: string
+      maxLength: 5
+  method:
+    type: object
+    additionalProperties: false
+    properties:
+      name:
+        type: string
+        minLength: 1
+`
+
+func writeTestRequestSchema(content string) string {
+	f, _ := ioutil.TempFile("", "ethconnect-schema")
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func newTestRequestSchema(assert *assert.Assertions, content string) *requestSchema {
+	file := writeTestRequestSchema(content)
+	defer os.Remove(file)
+	schema := newRequestSchema()
+	assert.NoError(schema.load(file))
+	return schema
+}
+
+func TestRequestSchemaValid(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, testRequestSchemaYAML)
+	err := schema.validate([]byte(`{
+		"headers": {"type": "SendTransaction", "id": "abc"},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1",
+		"gas": 100000000000000000000000000000,
+		"params": ["a", "b"],
+		"method": {"name": "set"}
+	}`))
+	assert.NoError(err)
+}
+
+func TestRequestSchemaInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, testRequestSchemaYAML)
+	err := schema.validate([]byte(`{
+		"headers": {"type": "GetBalance"},
+		"from": "0x123",
+		"gas": 100,
+		"params": ["a", "bbbbbb", 3],
+		"method": {"name": "", "inputs": []}
+	}`))
+	assert.EqualError(err, "Request failed schema validation: "+
+		"$.from: must match pattern '^0x[0-9a-fA-F]{40}$'; "+
+		"$.gas: must be at least 21000; "+
+		"$.headers.type: must be one of \"SendTransaction\", \"DeployContract\"; "+
+		"$.method.inputs: is not allowed; "+
+		"$.method.name: must be at least 1 characters; "+
+		"$.params: must have at most 2 items; "+
+		"$.params[1]: must be at most 5 characters; "+
+		"$.params[2]: must be of type string")
+}
+
+func TestRequestSchemaIntegerType(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, testRequestSchemaYAML)
+	err := schema.validate([]byte(`{"headers":{"type":"SendTransaction"},"from":"0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1","gas":21000.5}`))
+	assert.EqualError(err, "Request failed schema validation: $.gas: must be of type string or integer")
+}
+
+func TestRequestSchemaCombinators(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, `
+oneOf:
+  - required: [to]
+  - required: [solidity]
+anyOf:
+  - properties:
+      value: {type: string}
+allOf:
+  - type: object
+`)
+	assert.NoError(schema.validate([]byte(`{"to":"0x1","value":"1"}`)))
+	assert.EqualError(schema.validate([]byte(`{"to":"0x1","solidity":"contract"}`)),
+		"Request failed schema validation: $: must match exactly one schema in oneOf")
+	assert.EqualError(schema.validate([]byte(`{"to":"0x1","value":1}`)),
+		"Request failed schema validation: $: must match at least one schema in anyOf")
+}
+
+func TestRequestSchemaTooManyErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, `
+type: object
+additionalProperties:
+  type: string
+`)
+	err := schema.validate([]byte(`{"a":1,"b":1,"c":1,"d":1,"e":1,"f":1,"g":1,"h":1,"i":1,"j":1,"k":1,"l":1}`))
+	assert.Regexp("\\$.j: must be of type string; \\(2 more\\)$", err.Error())
+}
+
+func TestRequestSchemaNotJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newTestRequestSchema(assert, testRequestSchemaYAML)
+	err := schema.validate([]byte(`!json`))
+	assert.Regexp("Request is not valid JSON", err.Error())
+}
+
+func TestRequestSchemaNoSchema(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.NoError(newRequestSchema().validate([]byte(`!json`)))
+}
+
+func TestRequestSchemaLoadErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	for content, expected := range map[string]string{
+		"!badness":                                 "Failed to parse request schema",
+		"type: 123":                                "Failed to parse request schema",
+		"type: strin":                              "\\$: unknown type 'strin'",
+		"properties: {a: {pattern: '[['}}":         "\\$.a: invalid pattern",
+		"items: {$ref: '#/definitions/a'}":         "\\$\\[\\]: '\\$ref' is not supported",
+		"additionalProperties: {type: x}":          "\\$.\\*: unknown type 'x'",
+		"oneOf: [{type: x}]":                       "\\$.oneOf\\[0\\]: unknown type 'x'",
+		"properties: {a: }":                        "\\$.a: schema is empty",
+		"format: email":                            "\\$: 'format' is not supported",
+		"properties: {a: {exclusiveMinimum: 0}}":   "\\$.a: 'exclusiveMinimum' is not supported",
+		"additionalProperties: {minProperties: 1}": "\\$.\\*: 'minProperties' is not supported",
+		"items: {uniqueItems: true}":               "\\$\\[\\]: 'uniqueItems' is not supported",
+		"anyOf: [{type: string}, {const: 1}]":      "\\$.anyOf\\[1\\]: 'const' is not supported",
+		"{title: t, description: d, not: {}}":      "\\$: 'not' is not supported",
+	} {
+		file := writeTestRequestSchema(content)
+		err := newRequestSchema().load(file)
+		os.Remove(file)
+		assert.Regexp(expected, err.Error(), content)
+	}
+}
+
+func TestRequestSchemaReload(t *testing.T) {
+	assert := assert.New(t)
+
+	schema := newRequestSchema()
+	schema.reload() // no-op without a file
+
+	file := writeTestRequestSchema("required: [from]")
+	defer os.Remove(file)
+	assert.NoError(schema.load(file))
+	assert.Error(schema.validate([]byte(`{}`)))
+
+	// The existing schema is kept if the file becomes invalid
+	ioutil.WriteFile(file, []byte("type: strin"), 0644)
+	schema.reload()
+	assert.Error(schema.validate([]byte(`{}`)))
+
+	ioutil.WriteFile(file, []byte("required: [to]"), 0644)
+	schema.reload()
+	assert.EqualError(schema.validate([]byte(`{"from":"0x1"}`)), "Request failed schema validation: $.to: is required")
+}
@@ -0,0 +1,180 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultRequestHookTimeout is the number of seconds to wait for the request hook to respond
+	DefaultRequestHookTimeout = 10
+	// maxRequestHookResponse limits the size of the request returned by the hook
+	maxRequestHookResponse = 10 * 1024 * 1024
+)
+
+// RequestHookConf configures an external HTTP service that is called with each
+// request before it is processed, to enrich or authorize it
+type RequestHookConf struct {
+	URL      string `json:"url,omitempty"`
+	Timeout  int    `json:"timeout,omitempty"` // seconds
+	FailOpen bool   `json:"failOpen"`
+}
+
+// requestHook POSTs each request to the hook. A 200 response with a JSON object
+// replaces the request, a 204 or an empty body leaves it unmodified, and a 4xx
+// response denies it. The headers of the request cannot be changed by the hook,
+// as the bridge has already used them to route the message and its reply
+type requestHook struct {
+	url      string
+	failOpen bool
+	client   *http.Client
+	sleep    func(time.Duration)
+}
+
+// requestHookError is an error calling the hook, rather than a denial
+type requestHookError struct {
+	msg string
+}
+
+func (e *requestHookError) Error() string {
+	return e.msg
+}
+
+// newRequestHook validates the request hook configuration. Returns nil if there is no URL
+func newRequestHook(conf *RequestHookConf) (*requestHook, error) {
+	if conf.URL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(conf.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid request hook URL '%s'", conf.URL)
+	}
+	if conf.Timeout < 0 {
+		return nil, fmt.Errorf("Request hook timeout %d must not be negative", conf.Timeout)
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = DefaultRequestHookTimeout
+	}
+	return &requestHook{
+		url:      conf.URL,
+		failOpen: conf.FailOpen,
+		client:   &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		sleep:    time.Sleep,
+	}, nil
+}
+
+// call sends the request to the hook, and returns the effective request, or nil
+// if it is unmodified. A denial by the hook is returned with its status
+func (h *requestHook) call(request []byte) ([]byte, int, error) {
+	res, err := h.client.Post(h.url, "application/json", bytes.NewReader(request))
+	if err != nil {
+		return nil, 0, &requestHookError{fmt.Sprintf("Request hook failed: %s", err)}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRequestHookResponse))
+	if err != nil {
+		return nil, 0, &requestHookError{fmt.Sprintf("Request hook failed: %s", err)}
+	}
+	switch {
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		return nil, res.StatusCode, fmt.Errorf("Request denied by the request hook: %s", requestHookErrorMessage(body))
+	case res.StatusCode == http.StatusNoContent:
+		return nil, 0, nil
+	case res.StatusCode != http.StatusOK:
+		return nil, 0, &requestHookError{fmt.Sprintf("Request hook returned [%d]: %s", res.StatusCode, requestHookErrorMessage(body))}
+	case len(bytes.TrimSpace(body)) == 0:
+		return nil, 0, nil
+	}
+	var enriched map[string]json.RawMessage
+	if err = json.Unmarshal(body, &enriched); err != nil || enriched == nil {
+		return nil, 0, &requestHookError{"Request hook returned an invalid request: must be a JSON object"}
+	}
+	return body, 0, nil
+}
+
+// requestHookErrorMessage returns the 'error' field of a JSON response, or the text of the response
+func requestHookErrorMessage(body []byte) string {
+	var errBody struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &errBody) == nil && errBody.Error != "" {
+		return errBody.Error
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// applyRequestHook calls the hook for a message, replacing the request with the
+// one returned by the hook, which must also pass the request schema. If the hook
+// cannot be called, the request is processed unmodified if the hook is configured
+// to fail open. Otherwise the call is retried, holding up the consumer, rather than
+// the message failing. Returns the status of the error reply on failure. If the
+// consumer stops first, the requestHookError is returned, and the message must be
+// neither replied to nor committed
+func (k *KafkaBridge) applyRequestHook(ctx *msgContext) (int, error) {
+	if k.requestHook == nil {
+		return 0, nil
+	}
+	enriched, status, err := k.callRequestHook(ctx)
+	if _, failed := err.(*requestHookError); failed {
+		if k.requestHook.failOpen {
+			log.Warnf("Processing unmodified request %s: %s", ctx, err)
+			return 0, nil
+		}
+		return 0, err
+	} else if err != nil {
+		return status, err
+	}
+	if enriched == nil {
+		return 0, nil
+	}
+	var request map[string]json.RawMessage
+	json.Unmarshal(enriched, &request)
+	request["headers"], _ = json.Marshal(&ctx.requestCommon.Headers)
+	ctx.saramaMsg.Value, _ = json.Marshal(request)
+	k.logPayload("Enriched request", ctx, ctx.saramaMsg.Value)
+	if err = k.requestSchema.validate(ctx.saramaMsg.Value); err != nil {
+		return 400, fmt.Errorf("Enriched request from the request hook: %s", err)
+	}
+	return 0, nil
+}
+
+// callRequestHook calls the hook, retrying with a backoff while it cannot be called,
+// unless the hook is configured to fail open or the consumer is stopping
+func (k *KafkaBridge) callRequestHook(ctx *msgContext) ([]byte, int, error) {
+	delay := kldutils.RetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		enriched, status, err := k.requestHook.call(ctx.saramaMsg.Value)
+		if _, failed := err.(*requestHookError); !failed || k.requestHook.failOpen || k.pause.isStopping() {
+			return enriched, status, err
+		}
+		log.Warnf("%s for %s (attempt %d) - retrying in %.1fs", err, ctx, attempt, delay.Seconds())
+		k.requestHook.sleep(delay)
+		if delay *= 2; delay > kldutils.RetryMaxDelay {
+			delay = kldutils.RetryMaxDelay
+		}
+	}
+}
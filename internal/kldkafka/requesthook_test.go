@@ -0,0 +1,220 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestRequestHookServer(status int, body string) (*httptest.Server, *[]byte) {
+	var received []byte
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		received, _ = ioutil.ReadAll(req.Body)
+		res.WriteHeader(status)
+		res.Write([]byte(body))
+	}))
+	return server, &received
+}
+
+func newTestRequestHookCtx(k *KafkaBridge, request string) *msgContext {
+	ctx := &msgContext{
+		bridge:    k,
+		reqOffset: "in-topic:0:1",
+		saramaMsg: &sarama.ConsumerMessage{Value: []byte(request)},
+	}
+	json.Unmarshal(ctx.saramaMsg.Value, &ctx.requestCommon)
+	return ctx
+}
+
+func TestRequestHookEnrichesRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	server, received := newTestRequestHookServer(200, `{"headers":{"type":"DeployContract"},"from":"0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c"}`)
+	defer server.Close()
+	k, _ := newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+
+	ctx := newTestRequestHookCtx(k, `{"headers":{"type":"SendTransaction","id":"id1"},"from":"alice"}`)
+	status, err := k.applyRequestHook(ctx)
+	assert.NoError(err)
+	assert.Equal(0, status)
+	assert.Equal(`{"headers":{"type":"SendTransaction","id":"id1"},"from":"alice"}`, string(*received))
+
+	// The body is replaced, but the headers of the original request are kept
+	var request kldmessages.SendTransaction
+	assert.NoError(ctx.Unmarshal(&request))
+	assert.Equal("0xAA983AD2a0e0eD8ac639277F37be42F2A5d2618c", request.From)
+	assert.Equal("SendTransaction", request.Headers.MsgType)
+	assert.Equal("id1", request.Headers.ID)
+}
+
+func TestRequestHookUnmodified(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, status := range []int{200, 204} {
+		server, _ := newTestRequestHookServer(status, "")
+		k, _ := newTestKafkaBridge()
+		k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+		ctx := newTestRequestHookCtx(k, `{"headers":{"type":"SendTransaction"},"from":"alice"}`)
+		_, err := k.applyRequestHook(ctx)
+		assert.NoError(err)
+		assert.Equal(`{"headers":{"type":"SendTransaction"},"from":"alice"}`, string(ctx.saramaMsg.Value))
+		server.Close()
+	}
+}
+
+func TestRequestHookDenied(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := newTestRequestHookServer(403, `{"error":"Policy forbids transfers to 0x00"}`)
+	defer server.Close()
+	k, _ := newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL, FailOpen: true})
+
+	status, err := k.applyRequestHook(newTestRequestHookCtx(k, `{"headers":{"type":"SendTransaction"}}`))
+	assert.EqualError(err, "Request denied by the request hook: Policy forbids transfers to 0x00")
+	assert.Equal(403, status)
+}
+
+func TestRequestHookFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	// The call is retried until the consumer stops
+	server, _ := newTestRequestHookServer(500, "pop")
+	k, _ := newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+	var sleeps []time.Duration
+	k.requestHook.sleep = func(d time.Duration) {
+		if sleeps = append(sleeps, d); len(sleeps) == 2 {
+			k.pause.stop()
+		}
+	}
+	status, err := k.applyRequestHook(newTestRequestHookCtx(k, `{}`))
+	assert.EqualError(err, "Request hook returned [500]: pop")
+	assert.IsType(&requestHookError{}, err)
+	assert.Equal(0, status)
+	assert.Equal([]time.Duration{kldutils.RetryInitialDelay, 2 * kldutils.RetryInitialDelay}, sleeps)
+	server.Close()
+
+	server, _ = newTestRequestHookServer(200, `["not","an","object"]`)
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+	_, err = k.applyRequestHook(newTestRequestHookCtx(k, `{}`))
+	assert.EqualError(err, "Request hook returned an invalid request: must be a JSON object")
+	server.Close()
+
+	// The server is closed, so the request fails
+	_, err = k.applyRequestHook(newTestRequestHookCtx(k, `{}`))
+	assert.Regexp("Request hook failed", err)
+
+	// Failing open processes the request unmodified, without retrying
+	k, _ = newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL, FailOpen: true})
+	k.requestHook.sleep = func(d time.Duration) { assert.Fail("retried") }
+	ctx := newTestRequestHookCtx(k, `{"from":"alice"}`)
+	_, err = k.applyRequestHook(ctx)
+	assert.NoError(err)
+	assert.Equal(`{"from":"alice"}`, string(ctx.saramaMsg.Value))
+}
+
+func TestRequestHookRecovers(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if calls++; calls == 1 {
+			res.WriteHeader(503)
+			return
+		}
+		res.WriteHeader(204)
+	}))
+	defer server.Close()
+	k, _ := newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+	k.requestHook.sleep = func(d time.Duration) {}
+
+	_, err := k.applyRequestHook(newTestRequestHookCtx(k, `{}`))
+	assert.NoError(err)
+	assert.Equal(2, calls)
+}
+
+func TestRequestHookEnrichedRequestValidated(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := newTestRequestHookServer(200, `{"from":12345}`)
+	defer server.Close()
+	k, _ := newTestKafkaBridge()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+	k.requestSchema = newTestRequestSchema(assert, "type: object\nproperties:\n  from:\n    type: string\n")
+
+	status, err := k.applyRequestHook(newTestRequestHookCtx(k, `{"from":"alice"}`))
+	assert.Equal(400, status)
+	assert.Regexp("Enriched request from the request hook: Request failed schema validation: \\$.from", err)
+}
+
+func TestNewRequestHookErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := newRequestHook(&RequestHookConf{})
+	assert.NoError(err)
+	assert.Nil(h)
+
+	_, err = newRequestHook(&RequestHookConf{URL: "ftp://hook"})
+	assert.EqualError(err, "Invalid request hook URL 'ftp://hook'")
+
+	_, err = newRequestHook(&RequestHookConf{URL: "http://hook", Timeout: -1})
+	assert.EqualError(err, "Request hook timeout -1 must not be negative")
+
+	h, err = newRequestHook(&RequestHookConf{URL: "http://hook"})
+	assert.NoError(err)
+	assert.Equal(float64(DefaultRequestHookTimeout), h.client.Timeout.Seconds())
+}
+
+func TestDispatchMessageRequestHookDenied(t *testing.T) {
+	assert := assert.New(t)
+
+	server, _ := newTestRequestHookServer(403, "Not allowed")
+	defer server.Close()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.requestHook, _ = newRequestHook(&RequestHookConf{URL: server.URL})
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestDispatchMessageRequestHookDenied"
+	msg1bytes, _ := json.Marshal(&msg1)
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 3, Offset: 10, Value: msg1bytes}
+
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	var errReply kldmessages.ErrorReply
+	json.Unmarshal(replyBytes, &errReply)
+	assert.Equal("Request denied by the request hook: Not allowed", errReply.ErrorMessage)
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(10), mockConsumer.OffsetsByPartition[3])
+	assert.Equal(0, len(processor.messages))
+}
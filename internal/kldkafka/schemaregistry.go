@@ -0,0 +1,270 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultAvroReplySubject names reply subjects after the topic, as the default
+	// TopicNameStrategy of the Confluent serializers does
+	DefaultAvroReplySubject = "{topic}-value"
+	// The Confluent wire format is a zero magic byte and a 4 byte schema ID, before the Avro data
+	avroMagicByte      = 0x00
+	avroWireHeaderSize = 5
+	// Limit on the size of a response we read from the registry
+	maxRegistryResponse = 10 * 1024 * 1024
+)
+
+// SchemaRegistryConf configures a Confluent compatible schema registry, used to
+// decode Avro requests and optionally to encode replies
+type SchemaRegistryConf struct {
+	URL          string `json:"url,omitempty"`
+	AvroReplies  bool   `json:"avroReplies"`
+	ReplySubject string `json:"replySubject,omitempty"`
+}
+
+type registrySchemaResponse struct {
+	ID         int32  `json:"id"`
+	Schema     string `json:"schema"`
+	SchemaType string `json:"schemaType,omitempty"`
+}
+
+type registrySchema struct {
+	id     int32
+	schema *avroSchema
+}
+
+// registryUnavailableError is returned when the registry cannot be reached, or fails
+// with a server error. The request is not at fault, so is retried rather than rejected
+type registryUnavailableError struct {
+	err error
+}
+
+func (e *registryUnavailableError) Error() string {
+	return e.err.Error()
+}
+
+// schemaRegistry fetches and caches Avro schemas from the registry. Schemas are
+// immutable once registered, so are cached by ID indefinitely. The latest schema
+// for each reply subject is cached until the next reload
+type schemaRegistry struct {
+	url          string
+	replySubject string
+	client       *http.Client
+	lock         sync.Mutex
+	byID         map[int32]*avroSchema
+	bySubject    map[string]*registrySchema
+}
+
+// newSchemaRegistry validates the schema registry configuration. Returns nil if there is no URL
+func newSchemaRegistry(conf *SchemaRegistryConf) (*schemaRegistry, error) {
+	if conf.URL == "" {
+		if conf.AvroReplies {
+			return nil, fmt.Errorf("A schema registry URL is required to send Avro replies")
+		}
+		return nil, nil
+	}
+	if u, err := url.Parse(conf.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid schema registry URL '%s'", conf.URL)
+	}
+	replySubject := conf.ReplySubject
+	if replySubject == "" {
+		replySubject = DefaultAvroReplySubject
+	}
+	if unknown := strings.NewReplacer("{topic}", "", "{type}", "").Replace(replySubject); strings.ContainsAny(unknown, "{}") {
+		return nil, fmt.Errorf("Avro reply subject '%s' can only contain the placeholders {topic} and {type}", replySubject)
+	}
+	return &schemaRegistry{
+		url:          strings.TrimSuffix(conf.URL, "/"),
+		replySubject: replySubject,
+		client:       &http.Client{Timeout: 30 * time.Second},
+		byID:         make(map[int32]*avroSchema),
+		bySubject:    make(map[string]*registrySchema),
+	}, nil
+}
+
+// get makes a request to the registry, and parses the JSON response.
+// Credentials in the URL are sent using basic auth
+func (s *schemaRegistry) get(path string, result *registrySchemaResponse) error {
+	req, err := http.NewRequest(http.MethodGet, s.url+path, nil)
+	if err != nil {
+		return fmt.Errorf("Schema registry request failed: %s", err)
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json, application/json")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return &registryUnavailableError{fmt.Errorf("Schema registry request failed: %s", err)}
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, maxRegistryResponse))
+	if err != nil {
+		return &registryUnavailableError{fmt.Errorf("Schema registry request failed: %s", err)}
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		return &registryUnavailableError{fmt.Errorf("Schema registry returned [%d] for %s: %s", res.StatusCode, path, body)}
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Schema registry returned [%d] for %s: %s", res.StatusCode, path, body)
+	}
+	if err = json.Unmarshal(body, result); err != nil {
+		return fmt.Errorf("Failed to parse schema registry response for %s: %s", path, err)
+	}
+	if result.SchemaType != "" && result.SchemaType != "AVRO" {
+		return fmt.Errorf("Schema registry returned a schema of type %s for %s (only AVRO is supported)", result.SchemaType, path)
+	}
+	return nil
+}
+
+// schemaByID returns the schema a request was encoded with. The registry is called
+// without the lock held, so a slow registry does not hold up cached lookups
+func (s *schemaRegistry) schemaByID(id int32) (*avroSchema, error) {
+	s.lock.Lock()
+	schema, ok := s.byID[id]
+	s.lock.Unlock()
+	if ok {
+		return schema, nil
+	}
+	var res registrySchemaResponse
+	if err := s.get(fmt.Sprintf("/schemas/ids/%d", id), &res); err != nil {
+		return nil, err
+	}
+	schema, err := parseAvroSchema(res.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("Schema %d: %s", id, err)
+	}
+	log.Infof("Loaded Avro schema %d from the schema registry", id)
+	s.lock.Lock()
+	s.byID[id] = schema
+	s.lock.Unlock()
+	return schema, nil
+}
+
+// subjectSchema returns the latest schema registered for a subject
+func (s *schemaRegistry) subjectSchema(subject string) (*registrySchema, error) {
+	s.lock.Lock()
+	rs, ok := s.bySubject[subject]
+	s.lock.Unlock()
+	if ok {
+		return rs, nil
+	}
+	var res registrySchemaResponse
+	if err := s.get(fmt.Sprintf("/subjects/%s/versions/latest", url.PathEscape(subject)), &res); err != nil {
+		return nil, err
+	}
+	schema, err := parseAvroSchema(res.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("Schema %d for subject '%s': %s", res.ID, subject, err)
+	}
+	log.Infof("Loaded Avro schema %d for subject '%s' from the schema registry", res.ID, subject)
+	rs = &registrySchema{id: res.ID, schema: schema}
+	s.lock.Lock()
+	s.bySubject[subject] = rs
+	s.lock.Unlock()
+	return rs, nil
+}
+
+// reload discards the cached reply subjects, so new schema versions are used
+func (s *schemaRegistry) reload() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.bySubject = make(map[string]*registrySchema)
+}
+
+// decodeRequest converts a request in the Confluent Avro wire format to JSON,
+// replacing the value of the message. JSON requests are left as they are,
+// as they never start with the zero magic byte
+func (s *schemaRegistry) decodeRequest(msg *sarama.ConsumerMessage) error {
+	if len(msg.Value) < avroWireHeaderSize || msg.Value[0] != avroMagicByte {
+		return nil
+	}
+	id := int32(binary.BigEndian.Uint32(msg.Value[1:avroWireHeaderSize]))
+	schema, err := s.schemaByID(id)
+	if err != nil {
+		return err
+	}
+	val, err := decodeAvro(schema, msg.Value[avroWireHeaderSize:])
+	if err != nil {
+		return fmt.Errorf("Failed to decode Avro request with schema %d: %s", id, err)
+	}
+	jsonBytes, err := json.Marshal(val)
+	if err != nil {
+		return fmt.Errorf("Failed to convert Avro request with schema %d to JSON: %s", id, err)
+	}
+	msg.Value = jsonBytes
+	return nil
+}
+
+// encodeReply converts a JSON reply to the Confluent Avro wire format, using the
+// latest schema for the subject of the reply topic and type
+func (s *schemaRegistry) encodeReply(topic, replyType string, replyBytes []byte) ([]byte, error) {
+	subject := strings.NewReplacer("{topic}", topic, "{type}", replyType).Replace(s.replySubject)
+	rs, err := s.subjectSchema(subject)
+	if err != nil {
+		return nil, err
+	}
+	var reply interface{}
+	decoder := json.NewDecoder(bytes.NewReader(replyBytes))
+	decoder.UseNumber()
+	if err = decoder.Decode(&reply); err != nil {
+		return nil, err
+	}
+	avroBytes, err := encodeAvro(rs.schema, reply)
+	if err != nil {
+		return nil, fmt.Errorf("Reply does not match schema %d for subject '%s': %s", rs.id, subject, err)
+	}
+	wireBytes := make([]byte, avroWireHeaderSize, avroWireHeaderSize+len(avroBytes))
+	wireBytes[0] = avroMagicByte
+	binary.BigEndian.PutUint32(wireBytes[1:], uint32(rs.id))
+	return append(wireBytes, avroBytes...), nil
+}
+
+// decodeRequest converts Avro requests to JSON, if a schema registry is configured.
+// It is called before the message is in-flight, without any locks held. While the
+// registry is unavailable the request is retried, holding up the consumer, rather
+// than rejected. If the consumer stops first, the registryUnavailableError is
+// returned and the message is neither replied to nor committed
+func (k *KafkaBridge) decodeRequest(msg *sarama.ConsumerMessage) error {
+	if k.schemaRegistry == nil {
+		return nil
+	}
+	delay := kldutils.RetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := k.schemaRegistry.decodeRequest(msg)
+		if _, unavailable := err.(*registryUnavailableError); !unavailable || k.pause.isStopping() {
+			return err
+		}
+		log.Warnf("Schema registry unavailable for message %d:%d (attempt %d): %s - retrying in %.1fs", msg.Partition, msg.Offset, attempt, err, delay.Seconds())
+		time.Sleep(delay)
+		if delay *= 2; delay > kldutils.RetryMaxDelay {
+			delay = kldutils.RetryMaxDelay
+		}
+	}
+}
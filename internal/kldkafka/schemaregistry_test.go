@@ -0,0 +1,326 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAvroRequestSchema = `{"type":"record","name":"Request","fields":[
+	{"name":"headers","type":{"type":"record","name":"Headers","fields":[
+		{"name":"type","type":"string"},
+		{"name":"id","type":"string"}
+	]}},
+	{"name":"from","type":"string"}
+]}`
+
+const testAvroReplySchema = `{"type":"record","name":"Reply","fields":[
+	{"name":"headers","type":{"type":"record","name":"Headers","fields":[
+		{"name":"type","type":"string"},
+		{"name":"requestId","type":"string"},
+		{"name":"timeElapsed","type":"double"}
+	]}},
+	{"name":"errorMessage","type":["null","string"]}
+]}`
+
+// testSchemaRegistry serves schemas by ID and subject, counting the requests.
+// The first requests fail with a 503, until the unavailable count is used up
+type testSchemaRegistry struct {
+	server      *httptest.Server
+	requests    []string
+	schemas     map[string]registrySchemaResponse
+	unavailable int
+}
+
+func newTestSchemaRegistry() *testSchemaRegistry {
+	r := &testSchemaRegistry{
+		schemas: map[string]registrySchemaResponse{
+			"/schemas/ids/7": {Schema: testAvroRequestSchema},
+			"/subjects/replies-value/versions/latest":        {ID: 8, Schema: testAvroReplySchema},
+			"/subjects/replies-Error/versions/latest":        {ID: 9, Schema: testAvroReplySchema},
+			"/subjects/protobuf-value/versions/latest":       {ID: 10, Schema: "syntax = \"proto3\";", SchemaType: "PROTOBUF"},
+			"/subjects/bad-value/versions/latest":            {ID: 11, Schema: `"unknown"`},
+			"/subjects/user%2Fexample-value/versions/latest": {ID: 8, Schema: testAvroReplySchema},
+		},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		r.requests = append(r.requests, req.URL.EscapedPath())
+		if r.unavailable > 0 {
+			r.unavailable--
+			res.WriteHeader(503)
+			return
+		}
+		if user, pass, ok := req.BasicAuth(); !ok || user != "user" || pass != "pass" {
+			res.WriteHeader(401)
+			return
+		}
+		if schema, ok := r.schemas[req.URL.EscapedPath()]; ok {
+			json.NewEncoder(res).Encode(&schema)
+		} else if req.URL.Path == "/schemas/ids/99" {
+			res.Write([]byte("!json"))
+		} else {
+			res.WriteHeader(404)
+			res.Write([]byte(`{"error_code":40403,"message":"Schema not found"}`))
+		}
+	}))
+	return r
+}
+
+func (r *testSchemaRegistry) conf() *SchemaRegistryConf {
+	return &SchemaRegistryConf{URL: strings.Replace(r.server.URL, "http://", "http://user:pass@", 1) + "/"}
+}
+
+func testAvroMessage(id byte, avroBytes []byte) []byte {
+	return append([]byte{avroMagicByte, 0, 0, 0, id}, avroBytes...)
+}
+
+func TestSchemaRegistryConf(t *testing.T) {
+	assert := assert.New(t)
+
+	s, err := newSchemaRegistry(&SchemaRegistryConf{})
+	assert.NoError(err)
+	assert.Nil(s)
+
+	_, err = newSchemaRegistry(&SchemaRegistryConf{AvroReplies: true})
+	assert.EqualError(err, "A schema registry URL is required to send Avro replies")
+
+	_, err = newSchemaRegistry(&SchemaRegistryConf{URL: "registry:8081"})
+	assert.EqualError(err, "Invalid schema registry URL 'registry:8081'")
+
+	_, err = newSchemaRegistry(&SchemaRegistryConf{URL: "http://registry:8081", ReplySubject: "{topic}-{account}"})
+	assert.EqualError(err, "Avro reply subject '{topic}-{account}' can only contain the placeholders {topic} and {type}")
+
+	s, err = newSchemaRegistry(&SchemaRegistryConf{URL: "https://registry:8081/"})
+	assert.NoError(err)
+	assert.Equal("https://registry:8081", s.url)
+	assert.Equal(DefaultAvroReplySubject, s.replySubject)
+}
+
+func TestSchemaRegistryDecodeRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	s, err := newSchemaRegistry(r.conf())
+	assert.NoError(err)
+
+	avroBytes, _ := encodeAvro(mustParseAvroSchema(testAvroRequestSchema), decodeTestJSON(`{
+		"headers": {"type": "SendTransaction", "id": "request1"},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"
+	}`))
+	for i := 0; i < 2; i++ {
+		msg := &sarama.ConsumerMessage{Value: testAvroMessage(7, avroBytes)}
+		assert.NoError(s.decodeRequest(msg))
+		assert.JSONEq(`{
+			"headers": {"type": "SendTransaction", "id": "request1"},
+			"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"
+		}`, string(msg.Value))
+	}
+	// Schemas are cached by ID
+	assert.Equal([]string{"/schemas/ids/7"}, r.requests)
+
+	// JSON requests are passed through
+	msg := &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"SendTransaction"}}`)}
+	assert.NoError(s.decodeRequest(msg))
+	assert.Equal(`{"headers":{"type":"SendTransaction"}}`, string(msg.Value))
+}
+
+func TestSchemaRegistryDecodeRequestErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	s, _ := newSchemaRegistry(r.conf())
+
+	err := s.decodeRequest(&sarama.ConsumerMessage{Value: testAvroMessage(8, nil)})
+	assert.Regexp("Schema registry returned \\[404\\] for /schemas/ids/8: .*Schema not found", err.Error())
+
+	err = s.decodeRequest(&sarama.ConsumerMessage{Value: testAvroMessage(99, nil)})
+	assert.Regexp("Failed to parse schema registry response for /schemas/ids/99", err.Error())
+
+	err = s.decodeRequest(&sarama.ConsumerMessage{Value: testAvroMessage(7, []byte{0x02})})
+	assert.Regexp("Failed to decode Avro request with schema 7", err.Error())
+
+	s.url = r.server.URL
+	err = s.decodeRequest(&sarama.ConsumerMessage{Value: testAvroMessage(1, nil)})
+	assert.Regexp("Schema registry returned \\[401\\]", err.Error())
+
+	s.url = "http://localhost:0"
+	err = s.decodeRequest(&sarama.ConsumerMessage{Value: testAvroMessage(1, nil)})
+	assert.Regexp("Schema registry request failed", err.Error())
+}
+
+func TestSchemaRegistryEncodeReply(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	conf := r.conf()
+	conf.ReplySubject = "{topic}-{type}"
+	s, _ := newSchemaRegistry(conf)
+
+	replyBytes := []byte(`{"headers":{"type":"Error","requestId":"request1","timeElapsed":1.25,"id":"reply1"},"errorMessage":"pop"}`)
+	wireBytes, err := s.encodeReply("replies", "Error", replyBytes)
+	assert.NoError(err)
+	assert.Equal([]byte{avroMagicByte, 0, 0, 0, 9}, wireBytes[0:5])
+	val, err := decodeAvro(mustParseAvroSchema(testAvroReplySchema), wireBytes[5:])
+	assert.NoError(err)
+	jsonBytes, _ := json.Marshal(val)
+	assert.JSONEq(`{"headers":{"type":"Error","requestId":"request1","timeElapsed":1.25},"errorMessage":"pop"}`, string(jsonBytes))
+
+	// Subjects are cached until a reload
+	s.encodeReply("replies", "Error", replyBytes)
+	s.reload()
+	s.encodeReply("replies", "Error", replyBytes)
+	assert.Equal([]string{
+		"/subjects/replies-Error/versions/latest",
+		"/subjects/replies-Error/versions/latest",
+	}, r.requests)
+}
+
+func TestSchemaRegistryEncodeReplyErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	s, _ := newSchemaRegistry(r.conf())
+
+	_, err := s.encodeReply("protobuf", "Error", []byte(`{}`))
+	assert.Regexp("only AVRO is supported", err.Error())
+
+	_, err = s.encodeReply("bad", "Error", []byte(`{}`))
+	assert.EqualError(err, "Schema 11 for subject 'bad-value': Unknown Avro type 'unknown'")
+
+	_, err = s.encodeReply("replies", "Error", []byte(`!json`))
+	assert.Error(err)
+
+	_, err = s.encodeReply("replies", "Error", []byte(`{"headers":{"type":"Error"}}`))
+	assert.EqualError(err, "Reply does not match schema 8 for subject 'replies-value': $.headers.requestId: must be a string")
+
+	_, err = s.encodeReply("user/example", "Error", []byte(`{"headers":{"type":"Error","requestId":"a","timeElapsed":0}}`))
+	assert.NoError(err)
+}
+
+func TestAvroRequestAndReply(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.SchemaRegistry = *r.conf()
+	k.conf.SchemaRegistry.AvroReplies = true
+	k.conf.SchemaRegistry.ReplySubject = "replies-value"
+	k.schemaRegistry, _ = newSchemaRegistry(&k.conf.SchemaRegistry)
+
+	avroBytes, _ := encodeAvro(mustParseAvroSchema(testAvroRequestSchema), decodeTestJSON(`{
+		"headers": {"type": "TestAvroRequestAndReply", "id": "request1"},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"
+	}`))
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 0, Offset: 1, Value: testAvroMessage(7, avroBytes)}
+
+	msgContext := <-processor.messages
+	assert.Equal("request1", msgContext.Headers().ID)
+	var request map[string]interface{}
+	assert.NoError(msgContext.Unmarshal(&request))
+	assert.Equal("0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1", request["from"])
+
+	go msgContext.SendErrorReply(400, fmt.Errorf("pop"))
+	replyKafkaMsg := <-mockProducer.MockInput
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	assert.Equal([]byte{avroMagicByte, 0, 0, 0, 8}, replyBytes[0:5])
+	reply, err := decodeAvro(mustParseAvroSchema(testAvroReplySchema), replyBytes[5:])
+	assert.NoError(err)
+	assert.Equal(kldmessages.MsgTypeError, reply.(map[string]interface{})["headers"].(map[string]interface{})["type"])
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestAvroRequestDecodeFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	defer r.server.Close()
+	k, _, mockConsumer, mockProducer, wg := setupMocks()
+	k.schemaRegistry, _ = newSchemaRegistry(r.conf())
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 0, Offset: 1, Value: testAvroMessage(8, nil)}
+	replyKafkaMsg := <-mockProducer.MockInput
+	replyBytes, _ := replyKafkaMsg.Value.Encode()
+	assert.Contains(string(replyBytes), "Schema registry returned [404]")
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestAvroRequestRegistryUnavailableRetried(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	r.unavailable = 1
+	defer r.server.Close()
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.schemaRegistry, _ = newSchemaRegistry(r.conf())
+
+	avroBytes, _ := encodeAvro(mustParseAvroSchema(testAvroRequestSchema), decodeTestJSON(`{
+		"headers": {"type": "TestAvroRequestRegistryUnavailableRetried", "id": "request1"},
+		"from": "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"
+	}`))
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Partition: 0, Offset: 1, Value: testAvroMessage(7, avroBytes)}
+
+	// The request is processed once the registry is available, rather than rejected
+	msgContext := <-processor.messages
+	assert.Equal("request1", msgContext.Headers().ID)
+	assert.Equal([]string{"/schemas/ids/7", "/schemas/ids/7"}, r.requests)
+
+	go msgContext.SendErrorReply(400, fmt.Errorf("pop"))
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+}
+
+func TestAvroRequestRegistryUnavailableWhenStopping(t *testing.T) {
+	assert := assert.New(t)
+
+	r := newTestSchemaRegistry()
+	r.unavailable = 1
+	defer r.server.Close()
+	k, _ := newTestKafkaBridge()
+	k.schemaRegistry, _ = newSchemaRegistry(r.conf())
+	k.ConsumerStopping()
+	f := NewMockKafkaFactory()
+	mockProducer, _ := f.NewProducer(k.kafka)
+
+	// Neither replied to nor in-flight, so the offset is not committed
+	k.processConsumerMessage(&sarama.ConsumerMessage{Partition: 0, Offset: 1, Value: testAvroMessage(7, nil)}, mockProducer)
+	assert.Empty(k.inFlight)
+	assert.Empty(k.directReplies)
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReplyMarkerHeader is the Kafka header set on every reply in single topic mode,
+// so the bridge can recognize and skip its own replies when it consumes them
+const ReplyMarkerHeader = "ethconnect-reply"
+
+// validateTopics refuses reply and error topics that are the request topic, as
+// the bridge would consume its own replies as requests, unless single topic mode
+// is enabled to tag and skip the replies
+func (k *KafkaBridge) validateTopics() error {
+	topicIn := k.kafka.Conf().TopicIn
+	if topicIn == "" {
+		return nil
+	}
+	// Audit records are not marked as replies, so cannot share the request topic in any mode
+	if k.conf.Audit.Topic == topicIn {
+		return fmt.Errorf("Audit topic '%s' is the same as the request topic, so audit records would be consumed as requests", topicIn)
+	}
+	if k.conf.SingleTopic {
+		return nil
+	}
+	if k.kafka.Conf().TopicOut == topicIn {
+		return fmt.Errorf("Reply topic '%s' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)", topicIn)
+	}
+	if k.conf.ErrorTopicOut == topicIn {
+		return fmt.Errorf("Error topic '%s' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)", topicIn)
+	}
+	if k.conf.DeadLetter.Topic == topicIn {
+		return fmt.Errorf("Dead-letter topic '%s' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)", topicIn)
+	}
+	return nil
+}
+
+// markReply sets the reply header on a message in single topic mode
+func (k *KafkaBridge) markReply(msg *sarama.ProducerMessage) {
+	if k.conf.SingleTopic {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{
+			Key:   []byte(ReplyMarkerHeader),
+			Value: []byte("true"),
+		})
+	}
+}
+
+// isReply returns true for a message the bridge sent as a reply, in single topic mode
+func (k *KafkaBridge) isReply(msg *sarama.ConsumerMessage) bool {
+	if !k.conf.SingleTopic {
+		return false
+	}
+	for _, header := range msg.Headers {
+		if header != nil && string(header.Key) == ReplyMarkerHeader {
+			log.Debugf("Skipping reply: Partition=%d Offset=%d", msg.Partition, msg.Offset)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateTopics(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	kafkaConf := &KafkaCommonConf{TopicIn: "requests", TopicOut: "replies"}
+	k.kafka = NewKafkaCommon(NewMockKafkaFactory(), kafkaConf, k)
+	assert.NoError(k.validateTopics())
+
+	kafkaConf.TopicOut = "requests"
+	assert.EqualError(k.validateTopics(), "Reply topic 'requests' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)")
+
+	kafkaConf.TopicOut = "replies"
+	k.conf.ErrorTopicOut = "requests"
+	assert.EqualError(k.validateTopics(), "Error topic 'requests' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)")
+
+	k.conf.ErrorTopicOut = ""
+	k.conf.DeadLetter.Topic = "requests"
+	assert.EqualError(k.validateTopics(), "Dead-letter topic 'requests' is the same as the request topic, so replies would be consumed as requests (enable single-topic mode to allow this)")
+
+	k.conf.SingleTopic = true
+	kafkaConf.TopicOut = "requests"
+	assert.NoError(k.validateTopics())
+
+	k.conf.Audit.Topic = "requests"
+	assert.EqualError(k.validateTopics(), "Audit topic 'requests' is the same as the request topic, so audit records would be consumed as requests")
+}
+
+func TestReplyTopicTemplateNotRequestTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.kafka = NewKafkaCommon(NewMockKafkaFactory(), &KafkaCommonConf{TopicIn: "requests", TopicOut: "replies"}, k)
+	k.replyTopics, _ = newReplyTopics(&ReplyTopicConf{Template: "{tenant}"})
+	ctx := &msgContext{}
+	ctx.requestCommon.Headers.Tenant = "requests"
+	assert.Equal("replies", k.replyTopicFor(ctx))
+
+	k.conf.SingleTopic = true
+	assert.Equal("requests", k.replyTopicFor(ctx))
+}
+
+func TestSingleTopicRepliesSkipped(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.SingleTopic = true
+
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"TestMsg"}}`), Offset: 0}
+	msgContext1 := <-processor.messages
+	go msgContext1.Reply(&kldmessages.ReplyCommon{})
+	replyKafkaMsg := <-mockProducer.MockInput
+	assert.Equal(ReplyMarkerHeader, string(replyKafkaMsg.Headers[len(replyKafkaMsg.Headers)-1].Key))
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	// Our own reply is consumed from the same topic, and skipped
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{
+		Value:   []byte(`{"headers":{"type":"Error"}}`),
+		Offset:  1,
+		Headers: []*sarama.RecordHeader{{Key: []byte(ReplyMarkerHeader), Value: []byte("true")}},
+	}
+	mockConsumer.MockMessages <- &sarama.ConsumerMessage{Value: []byte(`{"headers":{"type":"TestMsg"}}`), Offset: 2}
+	msgContext3 := <-processor.messages
+	assert.Equal(":0:2", msgContext3.(*msgContext).reqOffset)
+	go msgContext3.Reply(&kldmessages.ReplyCommon{})
+	replyKafkaMsg = <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+	assert.Equal(int64(2), mockConsumer.OffsetsByPartition[0])
+	assert.Empty(k.inFlight)
+}
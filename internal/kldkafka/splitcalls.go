@@ -0,0 +1,249 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkCalldataSize rejects a transaction with calldata over the configured
+// limit, as the node would reject it
+func (p *msgProcessor) checkCalldataSize(tx *kldeth.Txn) error {
+	if p.conf.MaxCalldataSize <= 0 {
+		return nil
+	}
+	if size := len(tx.EthTX.Data()); size > p.conf.MaxCalldataSize {
+		return fmt.Errorf("Transaction calldata of %d bytes exceeds the limit of %d bytes", size, p.conf.MaxCalldataSize)
+	}
+	return nil
+}
+
+// splitCalls divides the list of calls in the split param of a message into
+// parts, each of which encodes to calldata within the configured limit.
+// Calls are never reordered, and each part takes as many calls as will fit
+func (p *msgProcessor) splitCalls(msg *kldmessages.SendTransaction) ([][]interface{}, error) {
+	index := msg.Split.Param
+	if msg.Method.Name == "" {
+		return nil, fmt.Errorf("Splitting a transaction requires the method ABI in 'method'")
+	}
+	if index < 0 || index >= len(msg.Method.Inputs) || index >= len(msg.Parameters) {
+		return nil, fmt.Errorf("Split param %d is out of range for method '%s'", index, msg.Method.Name)
+	}
+	input := msg.Method.Inputs[index]
+	inputType, err := abi.NewType(input.Type)
+	if err != nil {
+		return nil, fmt.Errorf("Split param %d: Unable to map %s to etherueum type: %s", index, input.Name, err)
+	}
+	if inputType.T != abi.SliceTy {
+		return nil, fmt.Errorf("Split param %d '%s' of type %s cannot be split, as it is not a dynamic array", index, input.Name, input.Type)
+	}
+	calls, ok := msg.Parameters[index].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Split param %d '%s' must be an array of calls", index, input.Name)
+	}
+
+	var parts [][]interface{}
+	for start := 0; start < len(calls); {
+		size, err := p.splitCalldataSize(msg, calls[start:start+1])
+		if err != nil {
+			return nil, err
+		}
+		if size > p.conf.MaxCalldataSize {
+			return nil, fmt.Errorf("Call %d in split param %d '%s' encodes to %d bytes of calldata on its own, which exceeds the limit of %d bytes", start, index, input.Name, size, p.conf.MaxCalldataSize)
+		}
+		end := start + 1
+		for ; end < len(calls); end++ {
+			if size, err = p.splitCalldataSize(msg, calls[start:end+1]); err != nil {
+				return nil, err
+			}
+			if size > p.conf.MaxCalldataSize {
+				break
+			}
+		}
+		parts = append(parts, calls[start:end])
+		start = end
+	}
+	return parts, nil
+}
+
+// splitCalldataSize returns the size of the calldata for the message with the
+// supplied calls in its split param
+func (p *msgProcessor) splitCalldataSize(msg *kldmessages.SendTransaction, calls []interface{}) (int, error) {
+	partMsg := splitPartMsg(msg, calls)
+	partMsg.Nonce = "0"
+	tx, err := kldeth.NewSendTxn(partMsg)
+	if err != nil {
+		return 0, err
+	}
+	return len(tx.EthTX.Data()), nil
+}
+
+// splitPartMsg copies the message, with the supplied calls in its split param
+func splitPartMsg(msg *kldmessages.SendTransaction, calls []interface{}) *kldmessages.SendTransaction {
+	partMsg := *msg
+	partMsg.Parameters = make([]interface{}, len(msg.Parameters))
+	copy(partMsg.Parameters, msg.Parameters)
+	partMsg.Parameters[msg.Split.Param] = calls
+	return &partMsg
+}
+
+// sendSplitTransaction submits a transaction for each part of the calls, with
+// sequential nonces. The replies are collected into a single batch reply.
+// If a part cannot be submitted, the parts after it are not submitted either,
+// as they could depend on the calls before them
+func (p *msgProcessor) sendSplitTransaction(msgContext MsgContext, msg *kldmessages.SendTransaction, parts [][]interface{}) {
+	log.Infof("Splitting transaction into %d transactions: %s", len(parts), msgContext)
+	batch := newBatchReply(msgContext, parts)
+	var suppliedNonce int64
+	var hasNonce bool
+	if msg.Nonce != "" {
+		if nonce, err := msg.Nonce.Int64(); err == nil {
+			suppliedNonce, hasNonce = nonce, true
+		}
+	}
+	for i, calls := range parts {
+		partMsg := splitPartMsg(msg, calls)
+		if hasNonce {
+			partMsg.Nonce = json.Number(strconv.FormatInt(suppliedNonce+int64(i), 10))
+		}
+		partContext := &batchPartContext{MsgContext: msgContext, batch: batch, index: i}
+		p.sendTransaction(partContext, partMsg)
+		if batch.failed(i) {
+			for j := i + 1; j < len(parts); j++ {
+				batch.setReply(j, kldmessages.NewErrorReply(fmt.Errorf("Not submitted, as transaction %d of the batch could not be submitted", i), []byte{}), true)
+			}
+			return
+		}
+	}
+}
+
+// batchReply collects the replies for the transactions a message was split
+// into, and sends a single TransactionBatch reply once they have all replied
+type batchReply struct {
+	lock       sync.Mutex
+	msgContext MsgContext
+	batch      kldmessages.TransactionBatch
+	errors     []bool
+	pending    int
+	heldParts  int
+}
+
+func newBatchReply(msgContext MsgContext, parts [][]interface{}) *batchReply {
+	b := &batchReply{
+		msgContext: msgContext,
+		errors:     make([]bool, len(parts)),
+		pending:    len(parts),
+	}
+	b.batch.Headers.MsgType = kldmessages.MsgTypeTransactionBatch
+	firstCall := 0
+	for _, calls := range parts {
+		b.batch.Transactions = append(b.batch.Transactions, &kldmessages.BatchTransaction{
+			FirstCall: firstCall,
+			Calls:     len(calls),
+		})
+		firstCall += len(calls)
+	}
+	return b
+}
+
+// setReply records the reply for a part, sending the batch reply if it was the last
+func (b *batchReply) setReply(index int, reply kldmessages.ReplyWithHeaders, isError bool) {
+	b.lock.Lock()
+	if b.batch.Transactions[index].Reply != nil {
+		b.lock.Unlock()
+		return
+	}
+	b.batch.Transactions[index].Reply = reply
+	if isError || reply.ReplyHeaders().MsgType == kldmessages.MsgTypeTransactionFailure {
+		b.errors[index] = true
+		b.batch.Failed++
+	}
+	b.pending--
+	complete := b.pending == 0
+	b.lock.Unlock()
+	if complete {
+		b.msgContext.Reply(&b.batch)
+	}
+}
+
+func (b *batchReply) failed(index int) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.errors[index]
+}
+
+// holdOffset holds the offset of the message while any part is holding its offset
+func (b *batchReply) holdOffset() {
+	b.lock.Lock()
+	b.heldParts++
+	hold := b.heldParts == 1
+	b.lock.Unlock()
+	if hold {
+		b.msgContext.HoldOffset()
+	}
+}
+
+func (b *batchReply) releaseOffset() {
+	b.lock.Lock()
+	b.heldParts--
+	release := b.heldParts == 0
+	b.lock.Unlock()
+	if release {
+		b.msgContext.ReleaseOffset()
+	}
+}
+
+// batchPartContext is the context for one of the transactions a message was
+// split into. Replies are collected into the batch, rather than sent
+type batchPartContext struct {
+	MsgContext
+	batch *batchReply
+	index int
+}
+
+func (c *batchPartContext) SendErrorReply(status int, err error) {
+	c.SendErrorReplyWithTX(status, err, "")
+}
+
+func (c *batchPartContext) SendErrorReplyWithTX(status int, err error, txHash string) {
+	log.Warnf("Transaction %d of batch failed: %s", c.index, err)
+	reply := kldmessages.NewErrorReply(err, []byte{})
+	reply.TXHash = txHash
+	c.batch.setReply(c.index, reply, true)
+}
+
+func (c *batchPartContext) Reply(replyMsg kldmessages.ReplyWithHeaders) {
+	c.batch.setReply(c.index, replyMsg, false)
+}
+
+func (c *batchPartContext) HoldOffset() {
+	c.batch.holdOffset()
+}
+
+func (c *batchPartContext) ReleaseOffset() {
+	c.batch.releaseOffset()
+}
+
+func (c *batchPartContext) String() string {
+	return fmt.Sprintf("%s (transaction %d of batch)", c.MsgContext.String(), c.index)
+}
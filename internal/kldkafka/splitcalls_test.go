@@ -0,0 +1,180 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+// 4 byte selector, the offset of the array and the flag, the length of the
+// array, then 32 bytes for each of 3 calls
+const testSplitCalldataSize = 4 + 32*3 + 32*3
+
+func newTestSplitMsg(assert *assert.Assertions, calls int, extra string) *kldmessages.SendTransaction {
+	callList := make([]string, calls)
+	for i := range callList {
+		callList[i] = fmt.Sprintf(`"%d"`, i)
+	}
+	jsonMsg := `{"headers":{"type":"SendTransaction"},` +
+		`"from":"` + testFromAddr + `","to":"0x2b8c0ECc76d0759a8F50b2E14A6881367D805832","gas":"123",` +
+		`"method":{"name":"multicall","inputs":[{"name":"calls","type":"uint256[]"},{"name":"flag","type":"uint256"}]},` +
+		`"params":[[` + strings.Join(callList, ",") + `],"1"],"split":{"param":0}` + extra + `}`
+	var msg kldmessages.SendTransaction
+	assert.NoError(json.Unmarshal([]byte(jsonMsg), &msg))
+	return &msg
+}
+
+func TestCheckCalldataSize(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxCalldataSize = testSplitCalldataSize
+	testMsgContext := &testMsgContext{}
+	testMsgContext.jsonMsg = "{" +
+		"  \"headers\":{\"type\": \"SendTransaction\"}," +
+		"  \"from\":\"" + testFromAddr + "\"," +
+		"  \"gas\":\"123\"," +
+		"  \"rawData\":\"0x" + strings.Repeat("00", testSplitCalldataSize+1) + "\"" +
+		"}"
+	msgProcessor.Init(goodMessageRPC(), 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	assert.Equal(1, len(testMsgContext.errorRepies))
+	assert.EqualError(testMsgContext.errorRepies[0].err, "Transaction calldata of 197 bytes exceeds the limit of 196 bytes")
+}
+
+func TestSplitCalls(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxCalldataSize = testSplitCalldataSize + 32
+	parts, err := msgProcessor.splitCalls(newTestSplitMsg(assert, 10, ""))
+	assert.NoError(err)
+	assert.Equal(3, len(parts))
+	assert.Equal([]interface{}{"0", "1", "2", "3"}, parts[0])
+	assert.Equal([]interface{}{"8", "9"}, parts[2])
+
+	parts, err = msgProcessor.splitCalls(newTestSplitMsg(assert, 2, ""))
+	assert.NoError(err)
+	assert.Equal(1, len(parts))
+}
+
+func TestSplitCallsInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxCalldataSize = testSplitCalldataSize
+
+	msg := newTestSplitMsg(assert, 1, "")
+	msg.Split.Param = 2
+	_, err := msgProcessor.splitCalls(msg)
+	assert.EqualError(err, "Split param 2 is out of range for method 'multicall'")
+
+	msg.Split.Param = 1
+	_, err = msgProcessor.splitCalls(msg)
+	assert.EqualError(err, "Split param 1 'flag' of type uint256 cannot be split, as it is not a dynamic array")
+
+	msg = newTestSplitMsg(assert, 1, "")
+	msg.Parameters[0] = "0"
+	_, err = msgProcessor.splitCalls(msg)
+	assert.EqualError(err, "Split param 0 'calls' must be an array of calls")
+
+	msg = newTestSplitMsg(assert, 1, "")
+	msg.Method.Name = ""
+	msg.MethodName = "multicall"
+	_, err = msgProcessor.splitCalls(msg)
+	assert.EqualError(err, "Splitting a transaction requires the method ABI in 'method'")
+
+	msgProcessor.conf.MaxCalldataSize = 100
+	_, err = msgProcessor.splitCalls(newTestSplitMsg(assert, 1, ""))
+	assert.EqualError(err, "Call 0 in split param 0 'calls' encodes to 132 bytes of calldata on its own, which exceeds the limit of 100 bytes")
+}
+
+func TestOnSendTransactionMessageSplit(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxCalldataSize = testSplitCalldataSize + 32
+	msg := newTestSplitMsg(assert, 5, `,"nonce":"10"`)
+	msgBytes, _ := json.Marshal(msg)
+	testMsgContext := &testMsgContext{jsonMsg: string(msgBytes)}
+	msgProcessor.Init(goodMessageRPC(), 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	inflightTxns := msgProcessor.inflightTxns[strings.ToLower(testFromAddr)]
+	assert.Equal(2, len(inflightTxns))
+	assert.Equal(int64(10), inflightTxns[0].nonce)
+	assert.Equal(int64(11), inflightTxns[1].nonce)
+	inflightTxns[0].wg.Wait()
+	inflightTxns[1].wg.Wait()
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal(1, len(testMsgContext.replies))
+	batch := testMsgContext.replies[0].(*kldmessages.TransactionBatch)
+	assert.Equal(kldmessages.MsgTypeTransactionBatch, batch.Headers.MsgType)
+	assert.Equal(0, batch.Failed)
+	assert.Equal(2, len(batch.Transactions))
+	assert.Equal(0, batch.Transactions[0].FirstCall)
+	assert.Equal(4, batch.Transactions[0].Calls)
+	assert.Equal(4, batch.Transactions[1].FirstCall)
+	assert.Equal(1, batch.Transactions[1].Calls)
+	assert.Equal(kldmessages.MsgTypeTransactionSuccess, batch.Transactions[1].Reply.ReplyHeaders().MsgType)
+}
+
+func TestOnSendTransactionMessageSplitSendFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.MaxCalldataSize = testSplitCalldataSize
+	msgBytes, _ := json.Marshal(newTestSplitMsg(assert, 7, ""))
+	testMsgContext := &testMsgContext{jsonMsg: string(msgBytes)}
+	testRPC := goodMessageRPC()
+	testRPC.ethSendTransactionErr = fmt.Errorf("pop")
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(testMsgContext)
+	assert.Equal([]string{"eth_sendTransaction"}, testRPC.calls)
+	assert.Equal(1, len(testMsgContext.replies))
+	batch := testMsgContext.replies[0].(*kldmessages.TransactionBatch)
+	assert.Equal(3, batch.Failed)
+	assert.Equal("pop", batch.Transactions[0].Reply.(*kldmessages.ErrorReply).ErrorMessage)
+	assert.Equal("Not submitted, as transaction 0 of the batch could not be submitted", batch.Transactions[2].Reply.(*kldmessages.ErrorReply).ErrorMessage)
+}
+
+func TestBatchReplyHoldsOffset(t *testing.T) {
+	assert := assert.New(t)
+
+	testMsgContext := &testMsgContext{}
+	batch := newBatchReply(testMsgContext, [][]interface{}{{"0"}, {"1"}})
+	part0 := &batchPartContext{MsgContext: testMsgContext, batch: batch, index: 0}
+	part1 := &batchPartContext{MsgContext: testMsgContext, batch: batch, index: 1}
+
+	part0.HoldOffset()
+	part0.Reply(&kldmessages.TransactionReceipt{})
+	part1.HoldOffset()
+	part0.ReleaseOffset()
+	assert.True(testMsgContext.offsetHeld)
+	assert.False(testMsgContext.offsetReleased)
+	part1.Reply(&kldmessages.TransactionReceipt{})
+	assert.Equal(1, len(testMsgContext.replies))
+	part1.ReleaseOffset()
+	assert.True(testMsgContext.offsetReleased)
+}
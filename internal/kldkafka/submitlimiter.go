@@ -0,0 +1,83 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// submitLimiter is a token bucket limiting the rate transactions are submitted
+// to the node. Tokens are added at the configured rate per second, up to the burst
+type submitLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	sleep  func(time.Duration)
+}
+
+// newSubmitLimiter returns a limiter that starts with a full bucket, or nil if
+// the rate is not limited
+func newSubmitLimiter(rate float64, burst int) *submitLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &submitLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		sleep:  time.Sleep,
+	}
+}
+
+// wait takes a token, waiting until it is available if the bucket is empty.
+// Tokens are reserved in the order callers arrive, and a caller that would
+// have to wait longer than maxWait is rejected without taking a token
+func (l *submitLimiter) wait(maxWait time.Duration) error {
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	var delay time.Duration
+	if l.tokens < 1 {
+		delay = time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		if delay > maxWait {
+			l.lock.Unlock()
+			return fmt.Errorf("Transaction submit rate limit of %g per second would delay sending by more than %.0fs", l.rate, maxWait.Seconds())
+		}
+	}
+	l.tokens--
+	l.lock.Unlock()
+	if delay > 0 {
+		l.sleep(delay)
+	}
+	return nil
+}
+
+// waitSubmitRate waits until the transaction can be sent within the configured
+// submit rate, if it is limited, for up to the maximum wait time for a transaction
+func (p *msgProcessor) waitSubmitRate() error {
+	if p.submitLimiter == nil {
+		return nil
+	}
+	return p.submitLimiter.wait(p.maxTXWaitTime)
+}
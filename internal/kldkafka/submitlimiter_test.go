@@ -0,0 +1,82 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitLimiterUnlimited(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newSubmitLimiter(0, 1))
+	msgProcessor := newMsgProcessor()
+	assert.NoError(msgProcessor.waitSubmitRate())
+}
+
+func TestSubmitLimiterBurst(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newSubmitLimiter(10, 2)
+	var sleeps []time.Duration
+	limiter.sleep = func(d time.Duration) { sleeps = append(sleeps, d) }
+
+	// The burst is sent straight away, then each waits for a token
+	for i := 0; i < 4; i++ {
+		assert.NoError(limiter.wait(10 * time.Second))
+	}
+	assert.Equal(2, len(sleeps))
+	assert.InDelta(100*time.Millisecond, sleeps[0], float64(10*time.Millisecond))
+	assert.InDelta(200*time.Millisecond, sleeps[1], float64(10*time.Millisecond))
+}
+
+func TestSubmitLimiterMaxWait(t *testing.T) {
+	assert := assert.New(t)
+
+	limiter := newSubmitLimiter(0.5, 1)
+	limiter.sleep = func(d time.Duration) {}
+
+	assert.NoError(limiter.wait(time.Second))
+	err := limiter.wait(time.Second)
+	assert.EqualError(err, "Transaction submit rate limit of 0.5 per second would delay sending by more than 1s")
+	// A rejected caller does not take a token
+	assert.NoError(limiter.wait(3 * time.Second))
+	assert.True(limiter.tokens < 0)
+}
+
+func TestOnSendTransactionMessageSubmitRateLimited(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.SubmitRate = 0.01
+	msgProcessor.conf.SubmitBurst = 1
+	testRPC := &testRPC{
+		ethSendTransactionResult: "0xac18e98664e160305cdb77e75e5eae32e55447e94ad8ceb0123729589ed09f8b",
+	}
+	msgProcessor.Init(testRPC, 1)
+
+	msgContext1 := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	msgProcessor.OnMessage(msgContext1)
+	assert.Empty(msgContext1.errorRepies)
+
+	msgContext2 := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	msgProcessor.OnMessage(msgContext2)
+	assert.Equal(429, msgContext2.errorRepies[0].status)
+	assert.Regexp("Transaction submit rate limit of 0.01 per second", msgContext2.errorRepies[0].err.Error())
+	assert.EqualValues([]string{"eth_sendTransaction"}, testRPC.calls)
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"sync"
+)
+
+// submitSlots limits the transactions being concurrently submitted and tracked
+// against the node. Transactions waiting for a slot get one in the order they
+// arrived, unless priority ordering is enabled. Then a high priority transaction
+// gets the next slot ahead of waiting transactions from other accounts. The
+// transactions of each account always get slots in the order they arrived, as
+// their nonces have already been assigned
+type submitSlots struct {
+	lock     sync.Mutex
+	free     int
+	priority bool
+	waiting  []*submitWaiter
+}
+
+type submitWaiter struct {
+	from  string
+	high  bool
+	ready chan bool
+}
+
+func newSubmitSlots(max int, priority bool) *submitSlots {
+	return &submitSlots{
+		free:     max,
+		priority: priority,
+	}
+}
+
+// acquire blocks until a slot is available for the transaction
+func (s *submitSlots) acquire(from string, high bool) {
+	s.lock.Lock()
+	if s.free > 0 && len(s.waiting) == 0 {
+		s.free--
+		s.lock.Unlock()
+		return
+	}
+	w := &submitWaiter{from: from, high: high, ready: make(chan bool, 1)}
+	s.waiting = append(s.waiting, w)
+	s.lock.Unlock()
+	<-w.ready
+}
+
+// release passes the slot to the next waiting transaction, or frees it
+func (s *submitSlots) release() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.waiting) == 0 {
+		s.free++
+		return
+	}
+	i := s.next()
+	w := s.waiting[i]
+	s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+	w.ready <- true
+}
+
+// next returns the index of the waiting transaction to pass a released slot to.
+// With priority ordering, this is the first high priority transaction that is
+// not behind another from the same account
+// * Caller holds the lock *
+func (s *submitSlots) next() int {
+	if !s.priority {
+		return 0
+	}
+	accounts := make(map[string]bool)
+	for i, w := range s.waiting {
+		if w.high && !accounts[w.from] {
+			return i
+		}
+		accounts[w.from] = true
+	}
+	return 0
+}
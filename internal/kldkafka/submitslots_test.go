@@ -0,0 +1,94 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// acquireTestSlots queues a waiter for each account in turn, returning the
+// order they are given slots as each is released
+func acquireTestSlots(s *submitSlots, waiters []submitWaiter) chan string {
+	acquired := make(chan string, len(waiters))
+	for i, w := range waiters {
+		go func(from string, high bool) {
+			s.acquire(from, high)
+			acquired <- from
+		}(w.from, w.high)
+		// Wait for each to queue, so they arrive in order
+		for queued := false; !queued; time.Sleep(1 * time.Millisecond) {
+			s.lock.Lock()
+			queued = len(s.waiting) == i+1
+			s.lock.Unlock()
+		}
+	}
+	return acquired
+}
+
+func TestSubmitSlotsInArrivalOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSubmitSlots(1, false)
+	s.acquire("0xaa", false)
+	acquired := acquireTestSlots(s, []submitWaiter{{from: "0xbb"}, {from: "0xcc", high: true}})
+	s.release()
+	assert.Equal("0xbb", <-acquired)
+	s.release()
+	assert.Equal("0xcc", <-acquired)
+	s.release()
+	assert.Equal(1, s.free)
+}
+
+func TestSubmitSlotsPriorityOrdering(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSubmitSlots(1, true)
+	s.acquire("0xaa", false)
+	acquired := acquireTestSlots(s, []submitWaiter{
+		{from: "0xbb"},
+		{from: "0xcc", high: true},
+		{from: "0xdd"},
+		{from: "0xee", high: true},
+	})
+	s.release()
+	assert.Equal("0xcc", <-acquired)
+	s.release()
+	assert.Equal("0xee", <-acquired)
+	s.release()
+	assert.Equal("0xbb", <-acquired)
+	s.release()
+	assert.Equal("0xdd", <-acquired)
+	s.release()
+	assert.Equal(1, s.free)
+}
+
+func TestSubmitSlotsPriorityOrderingSameAccount(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newSubmitSlots(1, true)
+	s.acquire("0xaa", false)
+	// A high priority transaction cannot overtake one from the same account,
+	// which has the earlier nonce
+	acquired := acquireTestSlots(s, []submitWaiter{{from: "0xbb"}, {from: "0xbb", high: true}, {from: "0xcc"}})
+	s.release()
+	assert.Equal("0xbb", <-acquired)
+	s.release()
+	assert.Equal("0xbb", <-acquired)
+	s.release()
+	assert.Equal("0xcc", <-acquired)
+}
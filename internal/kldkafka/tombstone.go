@@ -0,0 +1,73 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// tombstoneMetadata marks tombstones in the producer loops, as unlike
+// replies they are not tied to a message in-flight
+type tombstoneMetadata struct {
+	reqID string
+}
+
+// tombstoneKey returns the key of the reply to send a tombstone for after it,
+// or an empty string if tombstones are not configured for this type of reply.
+// Redelivered replies are followed by a tombstone if the original reply was
+func (k *KafkaBridge) tombstoneKey(c *msgContext) string {
+	if c.cachedReply != nil {
+		return c.cachedReply.tombstoneKey
+	}
+	tombstones := &k.conf.Tombstones
+	if !tombstones.Enabled {
+		return ""
+	}
+	if len(tombstones.ReplyTypes) == 0 {
+		return c.key
+	}
+	for _, replyType := range tombstones.ReplyTypes {
+		if replyType == c.replyType {
+			return c.key
+		}
+	}
+	return ""
+}
+
+// sendTombstone sends a null value with the key of the reply to the reply topic,
+// so a compacted reply topic can remove the reply. We only send it once the reply
+// is delivered, so it cannot be written before the reply.
+// * Caller holds the inFlightCond mutex *
+func (k *KafkaBridge) sendTombstone(ctx *msgContext, producer KafkaProducer) {
+	key := k.tombstoneKey(ctx)
+	if key == "" {
+		return
+	}
+	reqID := ctx.requestCommon.Headers.ID
+	if k.producerClosing {
+		log.Warnf("Tombstone for request %s not sent, as the producer is closing", reqID)
+		return
+	}
+	msg := &sarama.ProducerMessage{
+		Topic:     ctx.replyTopic,
+		Key:       sarama.StringEncoder(key),
+		Partition: ctx.replyPartition,
+		Metadata:  &tombstoneMetadata{reqID: reqID},
+	}
+	k.markReply(msg)
+	log.Debugf("Sending tombstone for request %s to %s", reqID, ctx.replyTopic)
+	producer.Input() <- msg
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+
+	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstoneAfterReply(t *testing.T) {
+	assert := assert.New(t)
+
+	k, processor, mockConsumer, mockProducer, wg := setupMocks()
+	k.conf.Tombstones.Enabled = true
+	k.conf.RedeliveryGracePeriod = 60
+
+	msg1 := kldmessages.RequestCommon{}
+	msg1.Headers.MsgType = "TestTombstoneAfterReply"
+	msg1.Headers.ID = "request1"
+	msg1bytes, _ := json.Marshal(&msg1)
+	consumerMsg := &sarama.ConsumerMessage{Partition: 1, Offset: 100, Value: msg1bytes}
+	mockConsumer.MockMessages <- consumerMsg
+
+	msgContext1 := <-processor.messages
+	go func() {
+		reply1 := kldmessages.ReplyCommon{}
+		reply1.Headers.MsgType = "TestReply"
+		msgContext1.Reply(&reply1)
+	}()
+	replyKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- replyKafkaMsg
+
+	// The tombstone is only sent once the reply is delivered
+	tombstoneMsg := <-mockProducer.MockInput
+	assert.Equal("request1", string(tombstoneMsg.Key.(sarama.StringEncoder)))
+	assert.Nil(tombstoneMsg.Value)
+	assert.Equal(replyKafkaMsg.Topic, tombstoneMsg.Topic)
+	mockProducer.MockSuccesses <- tombstoneMsg
+
+	// A redelivered reply is followed by another tombstone
+	mockConsumer.MockMessages <- consumerMsg
+	redeliveryKafkaMsg := <-mockProducer.MockInput
+	mockProducer.MockSuccesses <- redeliveryKafkaMsg
+	tombstoneMsg = <-mockProducer.MockInput
+	assert.Equal("request1", string(tombstoneMsg.Key.(sarama.StringEncoder)))
+	mockProducer.MockSuccesses <- tombstoneMsg
+
+	mockProducer.AsyncClose()
+	mockConsumer.Close()
+	wg.Wait()
+
+	assert.Equal(int64(100), mockConsumer.OffsetsByPartition[1])
+}
+
+func TestTombstoneKey(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	ctx := &msgContext{replyType: kldmessages.MsgTypeTransactionSuccess, key: "account1"}
+	ctx.requestCommon.Headers.ID = "request1"
+	assert.Equal("", k.tombstoneKey(ctx))
+
+	// The tombstone has the same key as the reply, so compaction removes the reply
+	k.conf.Tombstones.Enabled = true
+	assert.Equal("account1", k.tombstoneKey(ctx))
+
+	k.conf.Tombstones.ReplyTypes = []string{kldmessages.MsgTypeError}
+	assert.Equal("", k.tombstoneKey(ctx))
+	ctx.replyType = kldmessages.MsgTypeError
+	assert.Equal("account1", k.tombstoneKey(ctx))
+
+	ctx.cachedReply = &completedMsg{tombstoneKey: "request2"}
+	assert.Equal("request2", k.tombstoneKey(ctx))
+}
+
+func TestTombstoneNotSentWhenProducerClosing(t *testing.T) {
+	assert := assert.New(t)
+
+	k, _ := newTestKafkaBridge()
+	k.conf.Tombstones.Enabled = true
+	k.ConsumerStopping()
+	f := NewMockKafkaFactory()
+	mockProducer, _ := f.NewProducer(k.kafka)
+
+	// The mock input is unbuffered, so sending would block
+	ctx := &msgContext{key: "request1"}
+	k.inFlightCond.L.Lock()
+	k.sendTombstone(ctx, mockProducer)
+	k.inFlightCond.L.Unlock()
+
+	assert.Empty(mockProducer.(*MockKafkaProducer).MockInput)
+}
+
+func TestTombstoneSendFailure(t *testing.T) {
+	k, _ := newTestKafkaBridge()
+	f := NewMockKafkaFactory()
+	mockConsumer, _ := f.NewConsumer(k.kafka)
+	mockProducer, _ := f.NewProducer(k.kafka)
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go k.ProducerErrorLoop(mockConsumer, mockProducer, wg)
+
+	// Does not panic, as the reply was already delivered
+	producer := mockProducer.(*MockKafkaProducer)
+	producer.MockErrors <- &sarama.ProducerError{
+		Msg: &sarama.ProducerMessage{Metadata: &tombstoneMetadata{reqID: "request1"}},
+		Err: sarama.ErrMessageSizeTooLarge,
+	}
+	producer.AsyncClose()
+	wg.Wait()
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+)
+
+// txPoolCache holds the last transaction pool status of the node, so we do
+// not query the node for every transaction
+type txPoolCache struct {
+	lock   sync.Mutex
+	expiry time.Time
+	status *kldeth.TxPoolStatus // nil if the last query failed
+	sleep  func(time.Duration)
+}
+
+// getTxPoolStatus returns the cached transaction pool status, querying the node
+// if it has expired. Failures are cached too, so a node without the txpool API
+// enabled is not queried for every transaction
+func (p *msgProcessor) getTxPoolStatus() *kldeth.TxPoolStatus {
+	p.txPool.lock.Lock()
+	defer p.txPool.lock.Unlock()
+	if time.Now().After(p.txPool.expiry) {
+		status, err := kldeth.GetTxPoolStatus(p.rpc)
+		if err != nil {
+			log.Warnf("Failed to get transaction pool status, so sending without checking: %s", err)
+		}
+		p.txPool.status = status
+		p.txPool.expiry = time.Now().Add(time.Duration(p.conf.TxPool.CacheTTL) * time.Millisecond)
+	}
+	return p.txPool.status
+}
+
+// checkTxPool returns an error if the transaction pool of the node is over the
+// configured limits, as a full pool might drop a transaction and leave a nonce gap
+func (p *msgProcessor) checkTxPool() error {
+	maxPending, maxQueued := p.conf.TxPool.MaxPending, p.conf.TxPool.MaxQueued
+	if maxPending <= 0 && maxQueued <= 0 {
+		return nil
+	}
+	status := p.getTxPoolStatus()
+	if status == nil {
+		return nil
+	}
+	if maxPending > 0 && uint64(status.Pending) > uint64(maxPending) {
+		return fmt.Errorf("Transaction pool congested - %d pending transactions exceeds the limit %d", status.Pending, maxPending)
+	}
+	if maxQueued > 0 && uint64(status.Queued) > uint64(maxQueued) {
+		return fmt.Errorf("Transaction pool congested - %d queued transactions exceeds the limit %d", status.Queued, maxQueued)
+	}
+	return nil
+}
+
+// waitTxPool waits while the transaction pool of the node is over the configured
+// limits, checking again each time the cached status expires. Returns the error
+// from the last check if the consumer stops while the pool is still congested
+func (p *msgProcessor) waitTxPool() error {
+	delay := time.Duration(p.conf.TxPool.CacheTTL) * time.Millisecond
+	if delay < kldutils.RetryInitialDelay {
+		delay = kldutils.RetryInitialDelay
+	}
+	for attempt := 1; ; attempt++ {
+		err := p.checkTxPool()
+		if err == nil || p.pause.isStopping() {
+			return err
+		}
+		log.Warnf("%s (attempt %d) - waiting %.1fs before sending", err, attempt, delay.Seconds())
+		p.txPool.sleep(delay)
+	}
+}
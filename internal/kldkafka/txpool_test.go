@@ -0,0 +1,127 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnSendTransactionMessageTxPoolCongested(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.TxPool.MaxPending = 100
+	msgProcessor.conf.TxPool.MaxQueued = 10
+	msgProcessor.conf.TxPool.CacheTTL = 60000
+	testRPC := &testRPC{txPoolStatusResult: kldeth.TxPoolStatus{Pending: 101, Queued: 5}}
+	msgProcessor.Init(testRPC, 1)
+
+	// The status is cached, so we wait for it to expire before checking again
+	var sleeps []time.Duration
+	msgProcessor.txPool.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		if len(sleeps) == 1 {
+			testRPC.txPoolStatusResult = kldeth.TxPoolStatus{Pending: 0, Queued: 11}
+		} else {
+			testRPC.txPoolStatusResult = kldeth.TxPoolStatus{Pending: 100, Queued: 10}
+		}
+		msgProcessor.txPool.expiry = time.Now()
+	}
+
+	msgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	msgProcessor.OnMessage(msgContext)
+
+	assert.Empty(msgContext.errorRepies)
+	assert.Equal([]time.Duration{60 * time.Second, 60 * time.Second}, sleeps)
+	assert.Equal([]string{"txpool_status", "txpool_status", "txpool_status", "eth_sendTransaction"}, testRPC.calls)
+	assert.NotNil(msgProcessor.inflightTxns[strings.ToLower(testFromAddr)])
+}
+
+func TestOnSendTransactionMessageTxPoolCongestedConsumerStopping(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.TxPool.MaxQueued = 10
+	testRPC := &testRPC{txPoolStatusResult: kldeth.TxPoolStatus{Queued: 11}}
+	msgProcessor.Init(testRPC, 1)
+
+	var sleeps []time.Duration
+	msgProcessor.txPool.sleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+		msgProcessor.pause.stop()
+	}
+
+	// Neither replied to nor sent, so the offset is not committed
+	msgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	msgProcessor.OnMessage(msgContext)
+
+	assert.Empty(msgContext.errorRepies)
+	assert.Empty(msgContext.replies)
+	assert.Equal([]time.Duration{kldutils.RetryInitialDelay}, sleeps)
+	assert.Equal([]string{"txpool_status", "txpool_status"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageTxPoolOK(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.TxPool.MaxPending = 100
+	testRPC := &testRPC{txPoolStatusResult: kldeth.TxPoolStatus{Pending: 100, Queued: 500}}
+	msgProcessor.Init(testRPC, 1)
+
+	testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+	msgProcessor.OnMessage(testMsgContext)
+
+	assert.Empty(testMsgContext.errorRepies)
+	assert.Equal([]string{"txpool_status", "eth_sendTransaction"}, testRPC.calls)
+	assert.NotNil(msgProcessor.inflightTxns[strings.ToLower(testFromAddr)])
+}
+
+func TestOnSendTransactionMessageTxPoolStatusFails(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	msgProcessor.conf.TxPool.MaxPending = 100
+	msgProcessor.conf.TxPool.CacheTTL = 60000
+	testRPC := &testRPC{txPoolStatusErr: fmt.Errorf("the method txpool_status does not exist")}
+	msgProcessor.Init(testRPC, 1)
+
+	// Transactions are sent without the check, and the failure is cached
+	for i := 0; i < 2; i++ {
+		testMsgContext := &testMsgContext{jsonMsg: goodSendTxnJSON}
+		msgProcessor.OnMessage(testMsgContext)
+		assert.Empty(testMsgContext.errorRepies)
+	}
+	assert.Equal([]string{"txpool_status", "eth_sendTransaction", "eth_sendTransaction"}, testRPC.calls)
+}
+
+func TestOnSendTransactionMessageTxPoolNotChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	msgProcessor := newMsgProcessor()
+	testRPC := &testRPC{}
+	msgProcessor.Init(testRPC, 1)
+
+	msgProcessor.OnMessage(&testMsgContext{jsonMsg: goodSendTxnJSON})
+
+	assert.Equal([]string{"eth_sendTransaction"}, testRPC.calls)
+}
@@ -0,0 +1,213 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/icza/dyno"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldutils"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// templatePlaceholder matches a param in a template that must be supplied in
+// the templateArgs of each message, such as "{{amount}}"
+var templatePlaceholder = regexp.MustCompile(`^\{\{([a-zA-Z0-9_]+)\}\}$`)
+
+// TxTemplate is a SendTransaction registered under a name, so messages only
+// need to supply the args that vary. Any params that are strings of the form
+// "{{name}}" are placeholders, filled from the templateArgs of the message
+type TxTemplate struct {
+	To           string                `json:"to"`
+	Method       kldmessages.ABIMethod `json:"method"`
+	MethodName   string                `json:"methodName,omitempty"`
+	Params       []interface{}         `json:"params"`
+	placeholders map[string]bool
+}
+
+// txTemplates holds the transaction templates loaded from a YAML or JSON file,
+// which can be reloaded while the bridge is running
+type txTemplates struct {
+	lock      sync.RWMutex
+	file      string
+	templates map[string]*TxTemplate
+}
+
+func newTxTemplates() *txTemplates {
+	return &txTemplates{
+		templates: make(map[string]*TxTemplate),
+	}
+}
+
+// load reads and validates the templates in the file. The existing templates
+// are kept if the file cannot be loaded
+func (t *txTemplates) load(file string) error {
+	fileBytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("Failed to read transaction templates from %s: %s", file, err)
+	}
+	// YAML is a superset of JSON, so we handle both
+	yamlTemplates := make(map[interface{}]interface{})
+	if err = yaml.Unmarshal(fileBytes, &yamlTemplates); err != nil {
+		return fmt.Errorf("Failed to parse transaction templates in %s: %s", file, err)
+	}
+	jsonBytes, _ := json.Marshal(dyno.ConvertMapI2MapS(yamlTemplates))
+	templates := make(map[string]*TxTemplate)
+	if err = json.Unmarshal(jsonBytes, &templates); err != nil {
+		return fmt.Errorf("Failed to parse transaction templates in %s: %s", file, err)
+	}
+	for name, template := range templates {
+		if err = template.init(name); err != nil {
+			return err
+		}
+	}
+
+	t.lock.Lock()
+	t.file = file
+	t.templates = templates
+	t.lock.Unlock()
+	log.Infof("Loaded %d transaction templates from %s", len(templates), file)
+	return nil
+}
+
+// reload reads the templates again from the file they were loaded from
+func (t *txTemplates) reload() {
+	t.lock.RLock()
+	file := t.file
+	t.lock.RUnlock()
+	if file == "" {
+		return
+	}
+	if err := t.load(file); err != nil {
+		log.Errorf("Transaction templates not reloaded: %s", err)
+	}
+}
+
+// init validates the template, and records the placeholders in its params
+func (template *TxTemplate) init(name string) error {
+	if template == nil {
+		return fmt.Errorf("Transaction template '%s' is empty", name)
+	}
+	if _, err := kldutils.StrToAddress(fmt.Sprintf("%s.to", name), template.To); err != nil {
+		return fmt.Errorf("Invalid transaction template '%s': %s", name, err)
+	}
+	if template.Method.Name == "" && template.MethodName == "" {
+		return fmt.Errorf("Invalid transaction template '%s': 'method' or 'methodName' must be set", name)
+	}
+	template.placeholders = make(map[string]bool)
+	for _, param := range template.Params {
+		template.findPlaceholders(param)
+	}
+	return nil
+}
+
+func (template *TxTemplate) findPlaceholders(param interface{}) {
+	switch v := param.(type) {
+	case string:
+		if match := templatePlaceholder.FindStringSubmatch(v); match != nil {
+			template.placeholders[match[1]] = true
+		}
+	case []interface{}:
+		for _, entry := range v {
+			template.findPlaceholders(entry)
+		}
+	}
+}
+
+// fillParam returns a copy of the param, with any placeholders replaced
+func fillParam(param interface{}, args map[string]interface{}) interface{} {
+	switch v := param.(type) {
+	case string:
+		if match := templatePlaceholder.FindStringSubmatch(v); match != nil {
+			return args[match[1]]
+		}
+	case []interface{}:
+		filled := make([]interface{}, len(v))
+		for i, entry := range v {
+			filled[i] = fillParam(entry, args)
+		}
+		return filled
+	}
+	return param
+}
+
+// apply merges the template named in a message into it, checking the args
+// supplied fill exactly the placeholders of the template
+func (t *txTemplates) apply(msg *kldmessages.SendTransaction) error {
+	if msg.Template == "" {
+		if msg.TemplateArgs != nil {
+			return fmt.Errorf("'templateArgs' can only be supplied with a 'template'")
+		}
+		return nil
+	}
+	if msg.To != "" || msg.Method.Name != "" || msg.MethodName != "" || len(msg.Parameters) > 0 || msg.RawData != "" {
+		return fmt.Errorf("Supply either a 'template' with 'templateArgs', or 'to', 'method' and 'params', but not both")
+	}
+
+	t.lock.RLock()
+	template, exists := t.templates[msg.Template]
+	t.lock.RUnlock()
+	if !exists {
+		return fmt.Errorf("Unknown transaction template '%s'", msg.Template)
+	}
+	for name := range template.placeholders {
+		if _, supplied := msg.TemplateArgs[name]; !supplied {
+			return fmt.Errorf("Missing argument '%s' for transaction template '%s'", name, msg.Template)
+		}
+	}
+	for name := range msg.TemplateArgs {
+		if !template.placeholders[name] {
+			return fmt.Errorf("Unknown argument '%s' for transaction template '%s'", name, msg.Template)
+		}
+	}
+
+	msg.To = template.To
+	msg.Method = template.Method
+	msg.MethodName = template.MethodName
+	msg.Parameters = make([]interface{}, len(template.Params))
+	for i, param := range template.Params {
+		msg.Parameters[i] = fillParam(param, msg.TemplateArgs)
+	}
+	return nil
+}
+
+// methodsFor returns the methods of the templates that call a contract, to decode
+// the input of its transactions. Templates that only have a 'methodName' are skipped
+func (t *txTemplates) methodsFor(to common.Address) []*abi.Method {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	var methods []*abi.Method
+	for name, template := range t.templates {
+		if template.Method.Name == "" || common.HexToAddress(template.To) != to {
+			continue
+		}
+		templateMethods, err := kldeth.NewMethodABIs([]kldmessages.ABIMethod{template.Method})
+		if err != nil {
+			log.Warnf("Transaction template '%s' cannot be used to decode input: %s", name, err)
+			continue
+		}
+		methods = append(methods, templateMethods...)
+	}
+	return methods
+}
@@ -0,0 +1,146 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldkafka
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTxTemplatesYAML = `
+transfer:
+  to: '0x2b8c0ECc76d0759a8F50b2E14A6881367D805832'
+  method:
+    name: transfer
+    inputs:
+      - name: to
+        type: address
+      - name: amounts
+        type: uint256[]
+  params:
+    - '{{recipient}}'
+    - ['{{amount}}', 100]
+`
+
+func writeTestTxTemplates(content string) string {
+	f, _ := ioutil.TempFile("", "ethconnect-templates")
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestTxTemplatesApply(t *testing.T) {
+	assert := assert.New(t)
+
+	file := writeTestTxTemplates(testTxTemplatesYAML)
+	defer os.Remove(file)
+	templates := newTxTemplates()
+	err := templates.load(file)
+	assert.NoError(err)
+
+	msg := &kldmessages.SendTransaction{
+		Template:     "transfer",
+		TemplateArgs: map[string]interface{}{"recipient": testFromAddr, "amount": "12345"},
+	}
+	err = templates.apply(msg)
+	assert.NoError(err)
+	assert.Equal("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832", msg.To)
+	assert.Equal("transfer", msg.Method.Name)
+	assert.Equal([]interface{}{testFromAddr, []interface{}{"12345", float64(100)}}, msg.Parameters)
+
+	// The template itself is unchanged
+	assert.Equal("{{recipient}}", templates.templates["transfer"].Params[0])
+}
+
+func TestTxTemplatesApplyErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	file := writeTestTxTemplates(testTxTemplatesYAML)
+	defer os.Remove(file)
+	templates := newTxTemplates()
+	templates.load(file)
+
+	err := templates.apply(&kldmessages.SendTransaction{})
+	assert.NoError(err)
+
+	err = templates.apply(&kldmessages.SendTransaction{TemplateArgs: map[string]interface{}{}})
+	assert.EqualError(err, "'templateArgs' can only be supplied with a 'template'")
+
+	msg := &kldmessages.SendTransaction{Template: "transfer", MethodName: "other"}
+	err = templates.apply(msg)
+	assert.Regexp("Supply either a 'template' with 'templateArgs', or 'to', 'method' and 'params', but not both", err.Error())
+
+	err = templates.apply(&kldmessages.SendTransaction{Template: "unknown"})
+	assert.EqualError(err, "Unknown transaction template 'unknown'")
+
+	err = templates.apply(&kldmessages.SendTransaction{
+		Template:     "transfer",
+		TemplateArgs: map[string]interface{}{"recipient": testFromAddr},
+	})
+	assert.EqualError(err, "Missing argument 'amount' for transaction template 'transfer'")
+
+	err = templates.apply(&kldmessages.SendTransaction{
+		Template:     "transfer",
+		TemplateArgs: map[string]interface{}{"recipient": testFromAddr, "amount": "1", "extra": "2"},
+	})
+	assert.EqualError(err, "Unknown argument 'extra' for transaction template 'transfer'")
+}
+
+func TestTxTemplatesLoadErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	templates := newTxTemplates()
+	err := templates.load("/does/not/exist")
+	assert.Regexp("Failed to read transaction templates from /does/not/exist", err.Error())
+
+	for content, errMsg := range map[string]string{
+		"!badness":                         "Failed to parse transaction templates",
+		"t1: [1]":                          "Failed to parse transaction templates",
+		"t1:":                              "Transaction template 't1' is empty",
+		"t1: {to: bad}":                    "Invalid transaction template 't1'.*not a valid hex address",
+		"t1: {to: '" + testFromAddr + "'}": "Invalid transaction template 't1': 'method' or 'methodName' must be set",
+	} {
+		file := writeTestTxTemplates(content)
+		err = templates.load(file)
+		os.Remove(file)
+		assert.Regexp(errMsg, err.Error())
+	}
+}
+
+func TestTxTemplatesReload(t *testing.T) {
+	assert := assert.New(t)
+
+	templates := newTxTemplates()
+	templates.reload() // no-op with no file
+
+	file := writeTestTxTemplates(testTxTemplatesYAML)
+	defer os.Remove(file)
+	err := templates.load(file)
+	assert.NoError(err)
+
+	// A bad file leaves the existing templates in place
+	ioutil.WriteFile(file, []byte("!badness"), 0644)
+	templates.reload()
+	assert.Contains(templates.templates, "transfer")
+
+	ioutil.WriteFile(file, []byte("other: {to: '"+testFromAddr+"', methodName: set}"), 0644)
+	templates.reload()
+	assert.NotContains(templates.templates, "transfer")
+	assert.Contains(templates.templates, "other")
+}
@@ -25,14 +25,53 @@ import (
 const (
 	// MsgTypeError - an error
 	MsgTypeError = "Error"
+	// MsgTypeErrorSummary - errors with the same status code, coalesced into one reply
+	MsgTypeErrorSummary = "ErrorSummary"
 	// MsgTypeDeployContract - deploy a contract
 	MsgTypeDeployContract = "DeployContract"
 	// MsgTypeSendTransaction - send a transaction
 	MsgTypeSendTransaction = "SendTransaction"
+	// MsgTypeSendRawTransaction - send a transaction signed by the client
+	MsgTypeSendRawTransaction = "SendRawTransaction"
 	// MsgTypeTransactionSuccess - a transaction receipt where status is 1
 	MsgTypeTransactionSuccess = "TransactionSuccess"
 	// MsgTypeTransactionFailure - a transaction receipt where status is 0
 	MsgTypeTransactionFailure = "TransactionFailure"
+	// MsgTypeGetBalance - query the balance of an account
+	MsgTypeGetBalance = "GetBalance"
+	// MsgTypeBalance - the balance of an account
+	MsgTypeBalance = "Balance"
+	// MsgTypeGetEvents - query the events emitted by a contract
+	MsgTypeGetEvents = "GetEvents"
+	// MsgTypeEvents - the decoded events emitted by a contract
+	MsgTypeEvents = "Events"
+	// MsgTypeGetTransaction - query a transaction by its hash
+	MsgTypeGetTransaction = "GetTransaction"
+	// MsgTypeTransaction - a transaction, with its input decoded if the method is known
+	MsgTypeTransaction = "Transaction"
+	// MsgTypeReplaceTransaction - replace a pending transaction with a higher gas price
+	MsgTypeReplaceTransaction = "ReplaceTransaction"
+	// MsgTypeTransactionReplaced - a replacement transaction was submitted
+	MsgTypeTransactionReplaced = "TransactionReplaced"
+	// MsgTypeTransactionBatch - the results of a transaction that was split into several
+	MsgTypeTransactionBatch = "TransactionBatch"
+	// MsgTypeTraceTransaction - trace a transaction without sending it, to profile its gas
+	MsgTypeTraceTransaction = "TraceTransaction"
+	// MsgTypeGasProfile - the gas used by a traced transaction
+	MsgTypeGasProfile = "GasProfile"
+	// MsgTypeSimulateTransaction - run a transaction with eth_call, without sending it
+	MsgTypeSimulateTransaction = "SimulateTransaction"
+	// MsgTypeSimulationResult - the output of a simulated transaction
+	MsgTypeSimulationResult = "SimulationResult"
+
+	// GasProfileCalls profiles the gas used by each call frame of a trace
+	GasProfileCalls = "calls"
+	// GasProfileOpcodes profiles the gas used by each opcode of a trace
+	GasProfileOpcodes = "opcodes"
+
+	// PriorityHigh in the headers of a message asks for it to be processed
+	// ahead of other messages that are ready at the same time
+	PriorityHigh = "high"
 )
 
 // ABIMethod is the web3 form for an individual function
@@ -53,12 +92,47 @@ type ABIParam struct {
 	Type string `json:"type"`
 }
 
+// ABIError is the web3 form for a custom error, declared with 'error' in Solidity 0.8.4+
+type ABIError struct {
+	Type   string     `json:"type,omitempty"`
+	Name   string     `json:"name"`
+	Inputs []ABIParam `json:"inputs"`
+}
+
+// ABIEvent is the web3 form for an event
+type ABIEvent struct {
+	Type      string          `json:"type,omitempty"`
+	Name      string          `json:"name"`
+	Anonymous bool            `json:"anonymous,omitempty"`
+	Inputs    []ABIEventParam `json:"inputs"`
+}
+
+// ABIEventParam is an individual parameter of an event, which might be indexed
+type ABIEventParam struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Indexed bool   `json:"indexed,omitempty"`
+}
+
 // CommonHeaders are common to all messages
 type CommonHeaders struct {
-	ID      string      `json:"id,omitempty"`
-	MsgType string      `json:"type"`
-	Account string      `json:"account,omitempty"`
-	Context interface{} `json:"ctx,omitempty"`
+	ID       string      `json:"id,omitempty"`
+	MsgType  string      `json:"type"`
+	Account  string      `json:"account,omitempty"`
+	Tenant   string      `json:"tenant,omitempty"`
+	Priority string      `json:"priority,omitempty"`
+	Chain    string      `json:"chain,omitempty"`
+	Context  interface{} `json:"ctx,omitempty"`
+	// Time the request was sent (RFC3339), used in place of the Kafka timestamp to check its age
+	Timestamp string `json:"timestamp,omitempty"`
+	// Overrides the bridge default for simulating transactions with eth_call before sending
+	SimulateBeforeSend *bool `json:"simulateBeforeSend,omitempty"`
+	// Overrides the bridge default for the blocks to wait for on top of a transaction before replying
+	Confirmations *int `json:"confirmations,omitempty"`
+	// Include the transaction that was submitted in the receipt reply
+	ReturnTxDetails bool `json:"returnTxDetails,omitempty"`
+	// Business-level key, so requests for the same operation with different IDs are only processed once
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
 }
 
 // RequestCommon is a common interface to all requests
@@ -73,6 +147,17 @@ type ReplyHeaders struct {
 	Elapsed   float64 `json:"timeElapsed"`
 	ReqOffset string  `json:"requestOffset"`
 	ReqID     string  `json:"requestId"`
+	Truncated bool    `json:"truncated,omitempty"`
+	// Set if the bridge is configured to report its load on replies
+	Load *BridgeLoad `json:"load,omitempty"`
+}
+
+// BridgeLoad reports how busy the bridge is when a reply is sent, so upstream
+// systems can throttle their requests
+type BridgeLoad struct {
+	InFlight       int     `json:"inFlight"`
+	ConsumerLag    int64   `json:"consumerLag"`
+	ProcessingRate float64 `json:"processingRate"` // replies per second
 }
 
 // ReplyWithHeaders gives common access the reply headers
@@ -80,6 +165,13 @@ type ReplyWithHeaders interface {
 	ReplyHeaders() *ReplyHeaders
 }
 
+// ReplyTruncator is implemented by replies that can drop optional content
+// when they are too large to send. Returns false if there was nothing to drop.
+// It can be called repeatedly, for replies that drop their content in steps
+type ReplyTruncator interface {
+	TruncateReply() bool
+}
+
 // ReplyCommon is a common interface to all replies
 type ReplyCommon struct {
 	Headers ReplyHeaders `json:"headers"`
@@ -90,16 +182,47 @@ func (r *ReplyCommon) ReplyHeaders() *ReplyHeaders {
 	return &r.Headers
 }
 
+// EncryptedField replaces the value of a reply field that is encrypted by the bridge.
+// The ciphertext is the JSON of the value, sealed with AES-256-GCM using the path of
+// the field as additional data. The nonce and ciphertext are base64 encoded
+type EncryptedField struct {
+	Alg        string `json:"alg"`
+	KeyID      string `json:"kid,omitempty"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
+}
+
 // transactionCommon is the common fields from https://github.com/ethereum/wiki/wiki/JavaScript-API#web3ethsendtransaction
 // for sending either contract call or creation transactions
 type transactionCommon struct {
 	RequestCommon
-	Nonce      json.Number   `json:"nonce"`
-	From       string        `json:"from"`
-	Value      json.Number   `json:"value"`
-	Gas        json.Number   `json:"gas"`
-	GasPrice   json.Number   `json:"gasPrice"`
-	Parameters []interface{} `json:"params"`
+	Nonce            json.Number              `json:"nonce"`
+	From             string                   `json:"from"`
+	Value            json.Number              `json:"value"`
+	Gas              json.Number              `json:"gas"`
+	GasPrice         json.Number              `json:"gasPrice"`
+	Parameters       []interface{}            `json:"params"`
+	AccessList       []AccessTuple            `json:"accessList,omitempty"`
+	CreateAccessList bool                     `json:"createAccessList,omitempty"`
+	Errors           []ABIError               `json:"errors,omitempty"`
+	StateOverrides   map[string]StateOverride `json:"stateOverrides,omitempty"`
+}
+
+// StateOverride replaces parts of the state of an account, for the eth_call
+// used to simulate a transaction only
+type StateOverride struct {
+	Balance   string            `json:"balance,omitempty"`
+	Nonce     string            `json:"nonce,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	State     map[string]string `json:"state,omitempty"`
+	StateDiff map[string]string `json:"stateDiff,omitempty"`
+}
+
+// AccessTuple is an entry in an EIP-2930 access list, declaring an address
+// and the storage keys within it that the transaction will access
+type AccessTuple struct {
+	Address     string   `json:"address"`
+	StorageKeys []string `json:"storageKeys"`
 }
 
 // SendTransaction message instructs the bridge to install a contract
@@ -108,6 +231,29 @@ type SendTransaction struct {
 	To         string    `json:"to"`
 	Method     ABIMethod `json:"method"`
 	MethodName string    `json:"methodName,omitempty"`
+	RawData    string    `json:"rawData,omitempty"`
+	// Template names a transaction template configured on the bridge, that
+	// supplies the target, method and fixed params. TemplateArgs fills its placeholders
+	Template     string                 `json:"template,omitempty"`
+	TemplateArgs map[string]interface{} `json:"templateArgs,omitempty"`
+	// Split allows the bridge to split the list of calls in a param across
+	// several transactions, if the calldata exceeds its limit
+	Split *SplitCalls `json:"split,omitempty"`
+}
+
+// SplitCalls declares the param of a multicall-style method that holds the list
+// of calls. Each item is encoded with the type of the param in the method ABI
+type SplitCalls struct {
+	Param int `json:"param"`
+}
+
+// SendRawTransaction message instructs the bridge to submit a transaction
+// that has already been signed, supplied as RLP encoded hex
+type SendRawTransaction struct {
+	RequestCommon
+	RawTransaction string `json:"rawTransaction"`
+	// Optional account that is expected to have signed the transaction
+	From string `json:"from,omitempty"`
 }
 
 // DeployContract message instructs the bridge to install a contract
@@ -117,36 +263,326 @@ type DeployContract struct {
 	ContractName string `json:"contractName,omitempty"`
 }
 
+// ReplaceTransaction message asks for the pending transaction submitted for an earlier
+// request to be replaced, with the same nonce and a higher gas price (default=10% higher).
+// The 'from' of the original is required, to route the message to the same partition
+type ReplaceTransaction struct {
+	RequestCommon
+	From      string      `json:"from"`
+	RequestID string      `json:"requestId"`
+	GasPrice  json.Number `json:"gasPrice,omitempty"`
+}
+
+// TransactionReplaced is the reply to a ReplaceTransaction request, sent when the
+// replacement has been submitted. The receipt is sent in reply to the original request
+type TransactionReplaced struct {
+	ReplyCommon
+	RequestID               string `json:"requestId"`
+	From                    string `json:"from"`
+	Nonce                   string `json:"nonce"`
+	GasPrice                string `json:"gasPrice"`
+	OriginalTransactionHash string `json:"originalTransactionHash"`
+	TransactionHash         string `json:"transactionHash"`
+}
+
+// TransactionBatch is the reply to a SendTransaction that was split into several
+// transactions, with the reply for each of them in nonce order
+type TransactionBatch struct {
+	ReplyCommon
+	Failed       int                 `json:"failed"`
+	Transactions []*BatchTransaction `json:"transactions"`
+}
+
+// BatchTransaction is the reply for one of the transactions in a batch, which
+// made the calls starting at FirstCall in the list that was split
+type BatchTransaction struct {
+	FirstCall int              `json:"firstCall"`
+	Calls     int              `json:"calls"`
+	Reply     ReplyWithHeaders `json:"reply"`
+}
+
+// TraceTransaction message asks for a transaction to be traced with debug_traceCall
+// against the pending block, without sending it, to profile the gas it uses.
+// The profile is by call frame (default), or by opcode
+type TraceTransaction struct {
+	SendTransaction
+	Profile string `json:"profile,omitempty"`
+}
+
+// SimulateTransaction message asks for a transaction to be run with eth_call
+// against the pending block, without sending it. It is the only message that
+// accepts StateOverrides other than TraceTransaction, as neither is submitted
+type SimulateTransaction struct {
+	SendTransaction
+}
+
+// SimulationResult is the reply to a SimulateTransaction request that did not revert
+type SimulationResult struct {
+	ReplyCommon
+	Output string `json:"output"`
+}
+
+// GasProfile is the reply to a TraceTransaction request. Calls is set for a call
+// frame profile, and Opcodes for an opcode profile, with the most gas first
+type GasProfile struct {
+	ReplyCommon
+	Profile string        `json:"profile"`
+	GasUsed string        `json:"gasUsed"`
+	Failed  bool          `json:"failed"`
+	Error   string        `json:"error,omitempty"`
+	Calls   *CallFrameGas `json:"calls,omitempty"`
+	Opcodes []*OpcodeGas  `json:"opcodes,omitempty"`
+}
+
+// CallFrameGas is the gas used by a call frame, including the frames it called
+type CallFrameGas struct {
+	Type    string          `json:"type"`
+	From    string          `json:"from"`
+	To      string          `json:"to,omitempty"`
+	Gas     string          `json:"gas"`
+	GasUsed string          `json:"gasUsed"`
+	Error   string          `json:"error,omitempty"`
+	Calls   []*CallFrameGas `json:"calls,omitempty"`
+}
+
+// OpcodeGas is the gas charged for an opcode, over all the times it was executed
+type OpcodeGas struct {
+	Op    string `json:"op"`
+	Count int    `json:"count"`
+	Gas   string `json:"gas"`
+}
+
+// GetBalance message requests the balance of an address, at a block
+// (a number, or one of the tags latest/earliest/pending - default=latest)
+type GetBalance struct {
+	RequestCommon
+	Address     string `json:"address"`
+	BlockNumber string `json:"blockNumber,omitempty"`
+}
+
+// Balance is the reply to a GetBalance request.
+// The balance is in wei, with a formatted ether version for convenience
+type Balance struct {
+	ReplyCommon
+	Address      string       `json:"address"`
+	BlockNumber  string       `json:"blockNumber"`
+	BalanceStr   string       `json:"balance"`
+	BalanceHex   *hexutil.Big `json:"balanceHex"`
+	BalanceEther string       `json:"balanceEther"`
+}
+
+// GetEvents message requests the events of one type emitted by a contract,
+// over a range of blocks (numbers, or the tags earliest/latest - default=all blocks)
+type GetEvents struct {
+	RequestCommon
+	Address   string   `json:"address"`
+	Event     ABIEvent `json:"event"`
+	FromBlock string   `json:"fromBlock,omitempty"`
+	ToBlock   string   `json:"toBlock,omitempty"`
+}
+
+// Event is an individual event in an Events reply, with its decoded parameters
+type Event struct {
+	BlockNumber      string                 `json:"blockNumber"`
+	BlockHash        string                 `json:"blockHash"`
+	TransactionHash  string                 `json:"transactionHash"`
+	TransactionIndex string                 `json:"transactionIndex"`
+	LogIndex         string                 `json:"logIndex"`
+	Data             map[string]interface{} `json:"data"`
+}
+
+// Events is the reply to a GetEvents request, with the events in the order
+// they were emitted. The block range is the one queried, with any tags resolved
+type Events struct {
+	ReplyCommon
+	Address   string   `json:"address"`
+	Event     string   `json:"event"`
+	FromBlock string   `json:"fromBlock"`
+	ToBlock   string   `json:"toBlock"`
+	Events    []*Event `json:"events"`
+}
+
+// GetTransaction message requests a transaction by its hash. The input is
+// decoded if it matches the selector of a function in the ABI supplied
+type GetTransaction struct {
+	RequestCommon
+	TransactionHash string      `json:"transactionHash"`
+	ABI             []ABIMethod `json:"abi,omitempty"`
+}
+
+// DecodedInput is the method a transaction called, with its decoded parameters
+type DecodedInput struct {
+	Method    string                 `json:"method"`
+	Signature string                 `json:"signature"`
+	Params    map[string]interface{} `json:"params"`
+}
+
+// Transaction is the reply to a GetTransaction request. The block fields are empty
+// while the transaction is pending. The input is always included as hex
+type Transaction struct {
+	ReplyCommon
+	TransactionHash  string        `json:"transactionHash"`
+	BlockNumber      string        `json:"blockNumber,omitempty"`
+	BlockHash        string        `json:"blockHash,omitempty"`
+	TransactionIndex string        `json:"transactionIndex,omitempty"`
+	From             string        `json:"from"`
+	To               string        `json:"to,omitempty"`
+	Nonce            string        `json:"nonce"`
+	Value            string        `json:"value"`
+	Gas              string        `json:"gas"`
+	GasPrice         string        `json:"gasPrice"`
+	Input            string        `json:"input"`
+	DecodedInput     *DecodedInput `json:"decodedInput,omitempty"`
+}
+
 // TransactionReceipt is sent when a transaction has been successfully mined
 // For the big numbers, we pass a simple string as well as a full
 // ethereum hex encoding version
 type TransactionReceipt struct {
 	ReplyCommon
-	BlockHash            *common.Hash    `json:"blockHash"`
-	BlockNumberStr       string          `json:"blockNumber"`
-	BlockNumberHex       *hexutil.Big    `json:"blockNumberHex"`
-	ContractAddress      *common.Address `json:"contractAddress,omitempty"`
-	CumulativeGasUsedStr string          `json:"cumulativeGasUsed"`
-	CumulativeGasUsedHex *hexutil.Big    `json:"cumulativeGasUsedHex"`
-	From                 *common.Address `json:"from"`
-	GasUsedStr           string          `json:"gasUsed"`
-	GasUsedHex           *hexutil.Big    `json:"gasUsedHex"`
-	NonceStr             string          `json:"nonce"`
-	NonceHex             *hexutil.Uint64 `json:"nonceHex"`
-	StatusStr            string          `json:"status"`
-	StatusHex            *hexutil.Big    `json:"statusHex"`
-	To                   *common.Address `json:"to"`
-	TransactionHash      *common.Hash    `json:"transactionHash"`
-	TransactionIndexStr  string          `json:"transactionIndex"`
-	TransactionIndexHex  *hexutil.Uint   `json:"transactionIndexHex"`
+	BlockHash            *common.Hash        `json:"blockHash"`
+	BlockNumberStr       string              `json:"blockNumber"`
+	BlockNumberHex       *hexutil.Big        `json:"blockNumberHex"`
+	ContractAddress      *common.Address     `json:"contractAddress,omitempty"`
+	CumulativeGasUsedStr string              `json:"cumulativeGasUsed"`
+	CumulativeGasUsedHex *hexutil.Big        `json:"cumulativeGasUsedHex"`
+	From                 *common.Address     `json:"from"`
+	GasUsedStr           string              `json:"gasUsed"`
+	GasUsedHex           *hexutil.Big        `json:"gasUsedHex"`
+	NonceStr             string              `json:"nonce"`
+	NonceHex             *hexutil.Uint64     `json:"nonceHex"`
+	StatusStr            string              `json:"status"`
+	StatusHex            *hexutil.Big        `json:"statusHex"`
+	To                   *common.Address     `json:"to"`
+	TransactionHash      *common.Hash        `json:"transactionHash"`
+	TransactionIndexStr  string              `json:"transactionIndex"`
+	TransactionIndexHex  *hexutil.Uint       `json:"transactionIndexHex"`
+	Transaction          *TransactionDetails `json:"transaction,omitempty"`
+	// Set if the bridge is configured to bump the gas price of pending transactions
+	GasBumps int    `json:"gasBumps,omitempty"`
+	GasPrice string `json:"gasPrice,omitempty"`
+}
+
+// TransactionDetails are the fields of the transaction that was submitted, as
+// built by the bridge (or decoded from a pre-signed transaction).
+// The nonce is omitted if it was assigned by the node
+type TransactionDetails struct {
+	From     string `json:"from"`
+	To       string `json:"to,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Gas      string `json:"gas"`
+	GasPrice string `json:"gasPrice"`
+	Value    string `json:"value"`
+	Data     string `json:"data"`
+	Signed   bool   `json:"signed"`
 }
 
 // ErrorReply is
 type ErrorReply struct {
 	ReplyCommon
-	ErrorMessage    string `json:"errorMessage,omitempty"`
-	OriginalMessage string `json:"requestPayload,omitempty"`
-	TXHash          string `json:"transactionHash,omitempty"`
+	ErrorMessage    string        `json:"errorMessage,omitempty"`
+	OriginalMessage string        `json:"requestPayload,omitempty"`
+	TXHash          string        `json:"transactionHash,omitempty"`
+	Revert          *RevertError  `json:"revert,omitempty"`
+	FailureEvent    *FailureEvent `json:"failureEvent,omitempty"`
+	FailureHistory  []string      `json:"failureHistory,omitempty"`
+}
+
+// ErrorSummary replaces the error replies for requests that failed with the same
+// status code within a window, after the first which is replied to as normal.
+// The count includes every request, but only the first of their IDs are listed
+type ErrorSummary struct {
+	ReplyCommon
+	ErrorCode    int      `json:"errorCode"`
+	ErrorMessage string   `json:"errorMessage"` // of the last request in the window
+	Count        int      `json:"count"`
+	RequestIDs   []string `json:"requestIds"`
+	WindowStart  string   `json:"windowStart"`
+	WindowEnd    string   `json:"windowEnd"`
+}
+
+// RevertError is the data a transaction reverted with, decoded if it matches one of
+// the errors in the ABI of the request. The data is always included as hex
+type RevertError struct {
+	Name   string                 `json:"name,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Data   string                 `json:"data"`
+}
+
+// ErrorWithRevert is implemented by errors that carry the data a transaction reverted with
+type ErrorWithRevert interface {
+	error
+	RevertDetail() *RevertError
+}
+
+// FailureEvent is an event a contract emitted to report a logical failure, in a
+// transaction that was mined successfully. The parameters are keyed by index
+type FailureEvent struct {
+	Name        string                 `json:"name"`
+	Params      map[string]interface{} `json:"params"`
+	BlockNumber string                 `json:"blockNumber"`
+}
+
+// ErrorWithFailureEvent is implemented by errors for transactions that emitted a failure event
+type ErrorWithFailureEvent interface {
+	error
+	FailureEventDetail() *FailureEvent
+}
+
+// ErrorWithFailureHistory is implemented by errors for messages that failed
+// to be processed on previous attempts
+type ErrorWithFailureHistory interface {
+	error
+	FailureHistory() []string
+}
+
+// TruncateReply drops the details of the transaction submitted, including its data
+func (r *TransactionReceipt) TruncateReply() bool {
+	if r.Transaction == nil {
+		return false
+	}
+	r.Transaction = nil
+	return true
+}
+
+// TruncateReply drops the input of the transaction, and its decoded version
+func (r *Transaction) TruncateReply() bool {
+	if r.Input == "" && r.DecodedInput == nil {
+		return false
+	}
+	r.Input = ""
+	r.DecodedInput = nil
+	return true
+}
+
+// TruncateReply drops half of the remaining events, keeping the earliest
+func (r *Events) TruncateReply() bool {
+	if len(r.Events) == 0 {
+		return false
+	}
+	r.Events = r.Events[:len(r.Events)/2]
+	return true
+}
+
+// TruncateReply drops the frames called by the top level call, and the opcodes
+func (r *GasProfile) TruncateReply() bool {
+	if (r.Calls == nil || len(r.Calls.Calls) == 0) && len(r.Opcodes) == 0 {
+		return false
+	}
+	if r.Calls != nil {
+		r.Calls.Calls = nil
+	}
+	r.Opcodes = nil
+	return true
+}
+
+// TruncateReply drops the copy of the original request payload
+func (r *ErrorReply) TruncateReply() bool {
+	if r.OriginalMessage == "" {
+		return false
+	}
+	r.OriginalMessage = ""
+	return true
 }
 
 // NewErrorReply is a helper to construct an error message
@@ -155,6 +591,15 @@ func NewErrorReply(err error, origMsg interface{}) *ErrorReply {
 	errMsg.Headers.MsgType = MsgTypeError
 	if err != nil {
 		errMsg.ErrorMessage = err.Error()
+		if revertErr, ok := err.(ErrorWithRevert); ok {
+			errMsg.Revert = revertErr.RevertDetail()
+		}
+		if failureErr, ok := err.(ErrorWithFailureEvent); ok {
+			errMsg.FailureEvent = failureErr.FailureEventDetail()
+		}
+		if historyErr, ok := err.(ErrorWithFailureHistory); ok {
+			errMsg.FailureHistory = historyErr.FailureHistory()
+		}
 	}
 	if reflect.TypeOf(origMsg).Kind() == reflect.Slice {
 		errMsg.OriginalMessage = string(origMsg.([]byte))
@@ -89,3 +89,90 @@ func TestErrorMessageForUnparsableBinaryData(t *testing.T) {
 	assert.Equal("pop", unmarshaledErrMsg.ErrorMessage)
 	assert.Equal("\u0000\ufffd\ufffd\ufffd\ufffd", unmarshaledErrMsg.OriginalMessage)
 }
+
+func TestErrorReplyTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	errMsg := NewErrorReply(fmt.Errorf("pop"), []byte("payload"))
+	assert.True(errMsg.TruncateReply())
+	assert.Equal("", errMsg.OriginalMessage)
+	assert.False(errMsg.TruncateReply())
+}
+
+func TestTransactionReceiptTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	receipt := &TransactionReceipt{Transaction: &TransactionDetails{Data: "0x1234"}}
+	assert.True(receipt.TruncateReply())
+	assert.Nil(receipt.Transaction)
+	assert.False(receipt.TruncateReply())
+}
+
+func TestTransactionTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	tx := &Transaction{Input: "0x1234", DecodedInput: &DecodedInput{Method: "set"}}
+	assert.True(tx.TruncateReply())
+	assert.Equal("", tx.Input)
+	assert.Nil(tx.DecodedInput)
+	assert.False(tx.TruncateReply())
+}
+
+func TestEventsTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	events := &Events{Events: []*Event{&Event{LogIndex: "0"}, &Event{LogIndex: "1"}, &Event{LogIndex: "2"}}}
+	assert.True(events.TruncateReply())
+	assert.Equal(1, len(events.Events))
+	assert.Equal("0", events.Events[0].LogIndex)
+	assert.True(events.TruncateReply())
+	assert.Empty(events.Events)
+	assert.False(events.TruncateReply())
+}
+
+func TestGasProfileTruncate(t *testing.T) {
+	assert := assert.New(t)
+
+	profile := &GasProfile{Calls: &CallFrameGas{GasUsed: "100", Calls: []*CallFrameGas{&CallFrameGas{}}}}
+	assert.True(profile.TruncateReply())
+	assert.Equal("100", profile.Calls.GasUsed)
+	assert.Empty(profile.Calls.Calls)
+	assert.False(profile.TruncateReply())
+
+	profile = &GasProfile{Opcodes: []*OpcodeGas{&OpcodeGas{Op: "SSTORE"}}}
+	assert.True(profile.TruncateReply())
+	assert.Empty(profile.Opcodes)
+	assert.False(profile.TruncateReply())
+}
+
+type testRevertError struct {
+	detail *RevertError
+}
+
+func (e *testRevertError) Error() string {
+	return "reverted"
+}
+
+func (e *testRevertError) RevertDetail() *RevertError {
+	return e.detail
+}
+
+func TestErrorMessageWithRevert(t *testing.T) {
+	assert := assert.New(t)
+
+	exampleErrMsg := NewErrorReply(&testRevertError{detail: &RevertError{
+		Name:   "InsufficientBalance",
+		Params: map[string]interface{}{"available": "10"},
+		Data:   "0xcf479181",
+	}}, []byte{})
+	marshaledErrMsg, _ := json.Marshal(&exampleErrMsg)
+	var unmarshaledErrMsg ErrorReply
+	json.Unmarshal(marshaledErrMsg, &unmarshaledErrMsg)
+	assert.Equal("reverted", unmarshaledErrMsg.ErrorMessage)
+	assert.Equal("InsufficientBalance", unmarshaledErrMsg.Revert.Name)
+	assert.Equal("10", unmarshaledErrMsg.Revert.Params["available"])
+	assert.Equal("0xcf479181", unmarshaledErrMsg.Revert.Data)
+
+	exampleErrMsg = NewErrorReply(fmt.Errorf("pop"), []byte{})
+	assert.Nil(exampleErrMsg.Revert)
+}
@@ -0,0 +1,52 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Counter is a single value that only increases, in the style of a Prometheus counter
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+// NewCounter constructs a Counter
+func NewCounter(name, help string) *Counter {
+	return &Counter{
+		name: name,
+		help: help,
+	}
+}
+
+// Inc adds one to the counter
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// WritePrometheus writes the counter in the Prometheus text exposition format
+func (c *Counter) WritePrometheus(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+	return err
+}
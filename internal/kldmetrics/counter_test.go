@@ -0,0 +1,36 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	c := NewCounter("test_total", "Test counter")
+	c.Inc()
+	c.Inc()
+	assert.Equal(uint64(2), c.Value())
+
+	var b bytes.Buffer
+	err := c.WritePrometheus(&b)
+	assert.Nil(err)
+	assert.Equal("# HELP test_total Test counter\n# TYPE test_total counter\ntest_total 2\n", b.String())
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CounterVec is a set of counters, partitioned by the values of one or more labels
+type CounterVec struct {
+	name        string
+	help        string
+	labels      []string
+	lock        sync.RWMutex
+	counters    map[string]*Counter
+	labelValues map[string][]string
+}
+
+// NewCounterVec constructs a CounterVec
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{
+		name:        name,
+		help:        help,
+		labels:      labels,
+		counters:    make(map[string]*Counter),
+		labelValues: make(map[string][]string),
+	}
+}
+
+// WithLabels gets the counter for a set of label values, in the order the labels
+// were declared, creating it on first use
+func (v *CounterVec) WithLabels(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Errorf("Counter %s requires %d label values, but %d were supplied", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\x00")
+	v.lock.RLock()
+	c, exists := v.counters[key]
+	v.lock.RUnlock()
+	if exists {
+		return c
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if c, exists = v.counters[key]; !exists {
+		c = &Counter{name: v.name, help: v.help}
+		v.counters[key] = c
+		v.labelValues[key] = append([]string{}, values...)
+	}
+	return c
+}
+
+// Total returns the sum of all the counters
+func (v *CounterVec) Total() (total uint64) {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	for _, c := range v.counters {
+		total += c.Value()
+	}
+	return
+}
+
+// WritePrometheus writes all the counters in the Prometheus text exposition format
+func (v *CounterVec) WritePrometheus(w io.Writer) (err error) {
+	v.lock.RLock()
+	keys := make([]string, 0, len(v.counters))
+	for key := range v.counters {
+		keys = append(keys, key)
+	}
+	v.lock.RUnlock()
+	sort.Strings(keys)
+
+	if _, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name); err != nil {
+		return
+	}
+	for _, key := range keys {
+		v.lock.RLock()
+		c := v.counters[key]
+		values := v.labelValues[key]
+		v.lock.RUnlock()
+		labels := make([]string, len(v.labels))
+		for i, label := range v.labels {
+			labels[i] = fmt.Sprintf("%s=%s", label, strconv.Quote(values[i]))
+		}
+		if _, err = fmt.Fprintf(w, "%s{%s} %d\n", v.name, strings.Join(labels, ","), c.Value()); err != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,50 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewCounterVec("test_total", "Test counters", "type", "code")
+	v.WithLabels("t2", "400").Inc()
+	v.WithLabels("t1", "500").Inc()
+	v.WithLabels("t1", "500").Inc()
+	assert.Equal(uint64(2), v.WithLabels("t1", "500").Value())
+	assert.Equal(uint64(3), v.Total())
+
+	var b bytes.Buffer
+	err := v.WritePrometheus(&b)
+	assert.Nil(err)
+	assert.Equal("# HELP test_total Test counters\n"+
+		"# TYPE test_total counter\n"+
+		"test_total{type=\"t1\",code=\"500\"} 2\n"+
+		"test_total{type=\"t2\",code=\"400\"} 1\n", b.String())
+}
+
+func TestCounterVecWrongLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewCounterVec("test_total", "Test counters", "type")
+	assert.Panics(func() {
+		v.WithLabels("t1", "extra")
+	})
+}
@@ -0,0 +1,141 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultLatencyBuckets are the upper bounds (in seconds) for latency histograms
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Histogram counts observations into buckets, in the style of a Prometheus histogram.
+// Observations only use atomic operations, so are safe and cheap from any goroutine
+type Histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sumBits uint64
+}
+
+// Observe records a single value
+func (h *Histogram) Observe(v float64) {
+	// Buckets are cumulative when written, so we only count the first match here
+	i := sort.SearchFloat64s(h.buckets, v)
+	if i < len(h.counts) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		oldBits := atomic.LoadUint64(&h.sumBits)
+		newBits := math.Float64bits(math.Float64frombits(oldBits) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, oldBits, newBits) {
+			return
+		}
+	}
+}
+
+// Count returns the total number of observations
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+// Sum returns the total of all observations
+func (h *Histogram) Sum() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&h.sumBits))
+}
+
+// HistogramVec is a set of histograms, partitioned by the value of a single label
+type HistogramVec struct {
+	name       string
+	help       string
+	label      string
+	buckets    []float64
+	lock       sync.RWMutex
+	histograms map[string]*Histogram
+}
+
+// NewHistogramVec constructs a HistogramVec, with the buckets sorted in ascending order
+func NewHistogramVec(name, help, label string, buckets []float64) *HistogramVec {
+	sortedBuckets := append([]float64{}, buckets...)
+	sort.Float64s(sortedBuckets)
+	return &HistogramVec{
+		name:       name,
+		help:       help,
+		label:      label,
+		buckets:    sortedBuckets,
+		histograms: make(map[string]*Histogram),
+	}
+}
+
+// WithLabel gets the histogram for a label value, creating it on first use
+func (v *HistogramVec) WithLabel(value string) *Histogram {
+	v.lock.RLock()
+	h, exists := v.histograms[value]
+	v.lock.RUnlock()
+	if exists {
+		return h
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if h, exists = v.histograms[value]; !exists {
+		h = &Histogram{
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+		v.histograms[value] = h
+	}
+	return h
+}
+
+// WritePrometheus writes all the histograms in the Prometheus text exposition format
+func (v *HistogramVec) WritePrometheus(w io.Writer) (err error) {
+	v.lock.RLock()
+	labelValues := make([]string, 0, len(v.histograms))
+	for labelValue := range v.histograms {
+		labelValues = append(labelValues, labelValue)
+	}
+	v.lock.RUnlock()
+	sort.Strings(labelValues)
+
+	if _, err = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", v.name, v.help, v.name); err != nil {
+		return
+	}
+	for _, labelValue := range labelValues {
+		h := v.WithLabel(labelValue)
+		labels := fmt.Sprintf("%s=%s", v.label, strconv.Quote(labelValue))
+		var cumulative uint64
+		for i, bucket := range v.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			if _, err = fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", v.name, labels, strconv.FormatFloat(bucket, 'g', -1, 64), cumulative); err != nil {
+				return
+			}
+		}
+		count := h.Count()
+		if _, err = fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n%s_sum{%s} %s\n%s_count{%s} %d\n",
+			v.name, labels, count,
+			v.name, labels, strconv.FormatFloat(h.Sum(), 'g', -1, 64),
+			v.name, labels, count); err != nil {
+			return
+		}
+	}
+	return
+}
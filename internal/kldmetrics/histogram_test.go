@@ -0,0 +1,62 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldmetrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramObserve(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewHistogramVec("test_seconds", "Test histogram", "method", []float64{1, 0.1})
+	h := v.WithLabel("m1")
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	assert.Equal(h, v.WithLabel("m1"))
+	assert.Equal(uint64(4), h.Count())
+	assert.Equal(5.65, h.Sum())
+	assert.Equal([]uint64{2, 1}, h.counts)
+}
+
+func TestHistogramWritePrometheus(t *testing.T) {
+	assert := assert.New(t)
+
+	v := NewHistogramVec("test_seconds", "Test histogram", "method", []float64{0.1, 1})
+	v.WithLabel("m2").Observe(2)
+	v.WithLabel("m1").Observe(0.5)
+
+	var b bytes.Buffer
+	err := v.WritePrometheus(&b)
+	assert.Nil(err)
+	assert.Equal("# HELP test_seconds Test histogram\n"+
+		"# TYPE test_seconds histogram\n"+
+		"test_seconds_bucket{method=\"m1\",le=\"0.1\"} 0\n"+
+		"test_seconds_bucket{method=\"m1\",le=\"1\"} 1\n"+
+		"test_seconds_bucket{method=\"m1\",le=\"+Inf\"} 1\n"+
+		"test_seconds_sum{method=\"m1\"} 0.5\n"+
+		"test_seconds_count{method=\"m1\"} 1\n"+
+		"test_seconds_bucket{method=\"m2\",le=\"0.1\"} 0\n"+
+		"test_seconds_bucket{method=\"m2\",le=\"1\"} 0\n"+
+		"test_seconds_bucket{method=\"m2\",le=\"+Inf\"} 1\n"+
+		"test_seconds_sum{method=\"m2\"} 2\n"+
+		"test_seconds_count{method=\"m2\"} 1\n", b.String())
+}
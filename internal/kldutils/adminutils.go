@@ -0,0 +1,102 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type logLevelMsg struct {
+	Level interface{} `json:"level"`
+}
+
+type adminErrMsg struct {
+	Message string `json:"error"`
+}
+
+// ParseLogLevel parses a log level name such as "debug", or one of the numeric
+// levels of the --debug option (0=error, 1=info, 2=debug)
+func ParseLogLevel(level interface{}) (log.Level, error) {
+	switch v := level.(type) {
+	case float64:
+		switch v {
+		case 0:
+			return log.ErrorLevel, nil
+		case 1:
+			return log.InfoLevel, nil
+		case 2:
+			return log.DebugLevel, nil
+		}
+	case string:
+		if parsed, err := log.ParseLevel(v); err == nil {
+			return parsed, nil
+		}
+	}
+	return log.InfoLevel, fmt.Errorf("Invalid log level '%v' (must be error, info, debug, or 0-2)", level)
+}
+
+// AdminReply writes the JSON reply to a request to an admin endpoint
+func AdminReply(res http.ResponseWriter, status int, reply interface{}) {
+	replyBytes, _ := json.Marshal(reply)
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	res.Write(replyBytes)
+}
+
+// AdminErrorReply writes an error reply to a request to an admin endpoint
+func AdminErrorReply(res http.ResponseWriter, status int, message string) {
+	AdminReply(res, status, &adminErrMsg{Message: message})
+}
+
+// AdminAuthorized checks a request supplies the admin token as a bearer token,
+// sending a 401 reply if not. All requests are refused if no token is configured
+func AdminAuthorized(res http.ResponseWriter, req *http.Request, adminToken string) bool {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		AdminErrorReply(res, 401, "Unauthorized")
+		return false
+	}
+	return true
+}
+
+// LogLevelHandler changes the log level of the process at runtime, with a JSON
+// body such as {"level":"debug"}. Requests must supply the admin token as a
+// bearer token, and the handler refuses all requests if no token is configured
+func LogLevelHandler(adminToken string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		if !AdminAuthorized(res, req, adminToken) {
+			return
+		}
+		var msg logLevelMsg
+		if err := json.NewDecoder(req.Body).Decode(&msg); err != nil {
+			AdminErrorReply(res, 400, fmt.Sprintf("Unable to parse request: %s", err))
+			return
+		}
+		level, err := ParseLogLevel(msg.Level)
+		if err != nil {
+			AdminErrorReply(res, 400, err.Error())
+			return
+		}
+		log.SetLevel(level)
+		log.Warnf("Log level changed to %s", level)
+		AdminReply(res, 200, &logLevelMsg{Level: level.String()})
+	}
+}
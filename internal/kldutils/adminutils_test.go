@@ -0,0 +1,89 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	for level, expected := range map[interface{}]log.Level{
+		"error":    log.ErrorLevel,
+		"info":     log.InfoLevel,
+		"debug":    log.DebugLevel,
+		"warn":     log.WarnLevel,
+		float64(0): log.ErrorLevel,
+		float64(1): log.InfoLevel,
+		float64(2): log.DebugLevel,
+	} {
+		parsed, err := ParseLogLevel(level)
+		assert.NoError(err)
+		assert.Equal(expected, parsed)
+	}
+
+	for _, level := range []interface{}{"loud", float64(3), true, nil} {
+		_, err := ParseLogLevel(level)
+		assert.Regexp("Invalid log level", err.Error())
+	}
+}
+
+func sendTestLogLevel(handlerToken, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "/admin/loglevel", bytes.NewReader([]byte(body)))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res := httptest.NewRecorder()
+	LogLevelHandler(handlerToken)(res, req)
+	return res
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	assert := assert.New(t)
+	defer log.SetLevel(log.GetLevel())
+
+	res := sendTestLogLevel("secret", "secret", `{"level":"error"}`)
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"level":"error"}`, res.Body.String())
+	assert.Equal(log.ErrorLevel, log.GetLevel())
+
+	res = sendTestLogLevel("secret", "secret", `{"level":2}`)
+	assert.Equal(200, res.Code)
+	assert.JSONEq(`{"level":"debug"}`, res.Body.String())
+	assert.Equal(log.DebugLevel, log.GetLevel())
+}
+
+func TestLogLevelHandlerErrors(t *testing.T) {
+	assert := assert.New(t)
+	defer log.SetLevel(log.GetLevel())
+
+	assert.Equal(401, sendTestLogLevel("", "", `{"level":"debug"}`).Code)
+	assert.Equal(401, sendTestLogLevel("secret", "", `{"level":"debug"}`).Code)
+	assert.Equal(401, sendTestLogLevel("secret", "wrong", `{"level":"debug"}`).Code)
+
+	res := sendTestLogLevel("secret", "secret", `!json`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Unable to parse request", res.Body.String())
+
+	res = sendTestLogLevel("secret", "secret", `{"level":"loud"}`)
+	assert.Equal(400, res.Code)
+	assert.Regexp("Invalid log level 'loud'", res.Body.String())
+}
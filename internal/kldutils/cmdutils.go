@@ -52,6 +52,20 @@ func DefInt(envVarName string, defValue int) int {
 	return int(parsedInt)
 }
 
+// DefFloat defaults a float to a value in an Env var, and if not the default float provided
+func DefFloat(envVarName string, defValue float64) float64 {
+	defStr := os.Getenv(envVarName)
+	if defStr == "" {
+		return defValue
+	}
+	parsedFloat, err := strconv.ParseFloat(defStr, 64)
+	if err != nil {
+		log.Errorf("Invalid string in env var %s", envVarName)
+		return defValue
+	}
+	return parsedFloat
+}
+
 // MarshalToYAML marshals a JSON annotated structure into YAML, by first going to JSON
 func MarshalToYAML(conf interface{}) (yamlBytes []byte, err error) {
 	var jsonBytes []byte
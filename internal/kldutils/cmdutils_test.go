@@ -52,6 +52,26 @@ func TestDefInt(t *testing.T) {
 
 }
 
+func TestDefFloat(t *testing.T) {
+
+	assert := assert.New(t)
+
+	os.Unsetenv("SOME_ENV_VAR")
+
+	val := DefFloat("SOME_ENV_VAR", 1.5)
+	assert.Equal(1.5, val)
+
+	os.Setenv("SOME_ENV_VAR", "not a number!")
+
+	val = DefFloat("SOME_ENV_VAR", 1.5)
+	assert.Equal(1.5, val)
+
+	os.Setenv("SOME_ENV_VAR", "0.25")
+	val = DefFloat("SOME_ENV_VAR", 1.5)
+	assert.Equal(0.25, val)
+
+}
+
 func TestMarshalToYAML(t *testing.T) {
 	assert := assert.New(t)
 
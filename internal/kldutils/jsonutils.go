@@ -0,0 +1,115 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"unicode"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ToSnakeCase converts a camelCase name to snake_case, keeping acronyms
+// together so that "requestID" becomes "request_id"
+func ToSnakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				prev := runes[i-1]
+				nextIsLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+				if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextIsLower) {
+					b.WriteRune('_')
+				}
+			}
+			b.WriteRune(unicode.ToLower(r))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// SnakeCaseJSONKeys re-writes every object key in a JSON payload to snake_case.
+// The values of any opaque keys, such as application supplied context, are left
+// exactly as they are. Numbers are preserved without conversion to float.
+func SnakeCaseJSONKeys(payload []byte, opaqueKeys ...string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(snakeCaseValue(parsed, opaqueKeys))
+}
+
+func snakeCaseValue(val interface{}, opaqueKeys []string) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			if matchesField(key, opaqueKeys) {
+				converted[ToSnakeCase(key)] = child
+			} else {
+				converted[ToSnakeCase(key)] = snakeCaseValue(child, opaqueKeys)
+			}
+		}
+		return converted
+	case []interface{}:
+		for i, child := range v {
+			v[i] = snakeCaseValue(child, opaqueKeys)
+		}
+	}
+	return val
+}
+
+// ChecksumJSONAddresses re-writes the string values of the address keys in a JSON
+// payload, at any depth, in the EIP-55 mixed case checksum format. Values that are
+// not hex addresses, and everything under any opaque keys, are left as they are
+func ChecksumJSONAddresses(payload []byte, addressKeys []string, opaqueKeys ...string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+	var parsed interface{}
+	if err := decoder.Decode(&parsed); err != nil {
+		return nil, err
+	}
+	return json.Marshal(checksumValue(parsed, addressKeys, opaqueKeys))
+}
+
+func checksumValue(val interface{}, addressKeys, opaqueKeys []string) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if matchesField(key, opaqueKeys) {
+				continue
+			}
+			if str, isStr := child.(string); isStr && matchesField(key, addressKeys) {
+				if len(str) == 42 && strings.HasPrefix(str, "0x") && common.IsHexAddress(str) {
+					v[key] = common.HexToAddress(str).Hex()
+				}
+			} else {
+				v[key] = checksumValue(child, addressKeys, opaqueKeys)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = checksumValue(child, addressKeys, opaqueKeys)
+		}
+	}
+	return val
+}
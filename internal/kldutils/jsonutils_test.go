@@ -0,0 +1,68 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToSnakeCase(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("block_number_hex", ToSnakeCase("blockNumberHex"))
+	assert.Equal("request_id", ToSnakeCase("requestId"))
+	assert.Equal("request_id_header", ToSnakeCase("requestIDHeader"))
+	assert.Equal("tx_hash", ToSnakeCase("TXHash"))
+	assert.Equal("erc20_address", ToSnakeCase("erc20Address"))
+	assert.Equal("already_snake", ToSnakeCase("already_snake"))
+	assert.Equal("id", ToSnakeCase("id"))
+}
+
+func TestSnakeCaseJSONKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	converted, err := SnakeCaseJSONKeys([]byte(`{"headers":{"requestId":"r1","timeElapsed":0.5,"ctx":{"myKey":"v"}},"blockNumber":"12345678901234567890","logs":[{"logIndex":1}]}`), "ctx")
+	assert.Nil(err)
+	assert.Equal(`{"block_number":"12345678901234567890","headers":{"ctx":{"myKey":"v"},"request_id":"r1","time_elapsed":0.5},"logs":[{"log_index":1}]}`, string(converted))
+}
+
+func TestSnakeCaseJSONKeysInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := SnakeCaseJSONKeys([]byte("badness"))
+	assert.NotNil(err)
+}
+
+func TestChecksumJSONAddresses(t *testing.T) {
+	assert := assert.New(t)
+
+	converted, err := ChecksumJSONAddresses([]byte(`{"from":"0xd15ad5d4a0853585d655b30819c16baaed412fff","to":null,"address":"0x123",`+
+		`"transaction":{"to":"0xd15ad5d4a0853585d655b30819c16baaed412fff"},"gasUsed":12345678901234567890,`+
+		`"headers":{"ctx":{"from":"0xd15ad5d4a0853585d655b30819c16baaed412fff"}}}`),
+		[]string{"from", "to", "address"}, "ctx")
+	assert.Nil(err)
+	assert.Equal(`{"address":"0x123","from":"0xd15aD5D4a0853585d655B30819C16bAAed412FFf","gasUsed":12345678901234567890,`+
+		`"headers":{"ctx":{"from":"0xd15ad5d4a0853585d655b30819c16baaed412fff"}},`+
+		`"to":null,"transaction":{"to":"0xd15aD5D4a0853585d655B30819C16bAAed412FFf"}}`, string(converted))
+}
+
+func TestChecksumJSONAddressesInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := ChecksumJSONAddresses([]byte("badness"), []string{"from"})
+	assert.NotNil(err)
+}
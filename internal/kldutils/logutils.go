@@ -0,0 +1,65 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// RedactedValue replaces the value of redacted fields
+const RedactedValue = "***"
+
+// RedactJSON returns a JSON payload as a string for logging, with the value of any
+// field that matches one of the supplied names (case insensitive) replaced at
+// any depth. Payloads that are not valid JSON are returned unchanged.
+func RedactJSON(payload []byte, fields []string) string {
+	if len(fields) == 0 {
+		return string(payload)
+	}
+	var parsed interface{}
+	if err := json.Unmarshal(payload, &parsed); err != nil {
+		return string(payload)
+	}
+	redactValue(parsed, fields)
+	redacted, _ := json.Marshal(parsed)
+	return string(redacted)
+}
+
+func redactValue(val interface{}, fields []string) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if matchesField(key, fields) {
+				v[key] = RedactedValue
+			} else {
+				redactValue(child, fields)
+			}
+		}
+	case []interface{}:
+		for _, child := range v {
+			redactValue(child, fields)
+		}
+	}
+}
+
+func matchesField(key string, fields []string) bool {
+	for _, field := range fields {
+		if strings.EqualFold(key, field) {
+			return true
+		}
+	}
+	return false
+}
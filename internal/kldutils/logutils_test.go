@@ -0,0 +1,40 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactJSON(t *testing.T) {
+	assert := assert.New(t)
+
+	redacted := RedactJSON([]byte(`{"headers":{"type":"SendTransaction","privateKey":"secret"},"params":[{"PrivateKey":"secret2","value":1}]}`), []string{"privateKey"})
+	assert.Equal(`{"headers":{"privateKey":"***","type":"SendTransaction"},"params":[{"PrivateKey":"***","value":1}]}`, redacted)
+}
+
+func TestRedactJSONNoFields(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(`{"b":1,  "a":2}`, RedactJSON([]byte(`{"b":1,  "a":2}`), nil))
+}
+
+func TestRedactJSONInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal("badness", RedactJSON([]byte("badness"), []string{"privateKey"}))
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RetryInitialDelay is the delay before the first retry in RetryUntil
+	RetryInitialDelay = 1 * time.Second
+	// RetryMaxDelay caps the exponential backoff between retries in RetryUntil
+	RetryMaxDelay = 30 * time.Second
+)
+
+// RetryUntil calls fn until it succeeds, backing off exponentially between attempts,
+// for up to maxWait in total. With a maxWait of zero fn is only called once.
+// The description is used in logging, and in the error returned after giving up
+func RetryUntil(desc string, maxWait time.Duration, fn func() error) error {
+	deadline := time.Now().Add(maxWait)
+	delay := RetryInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				log.Infof("%s ready after %d attempts", desc, attempt)
+			}
+			return nil
+		}
+		if maxWait <= 0 {
+			return err
+		}
+		remaining := deadline.Sub(time.Now())
+		if remaining <= 0 {
+			return fmt.Errorf("%s not ready after %s: %s", desc, maxWait, err)
+		}
+		if delay > remaining {
+			delay = remaining
+		}
+		log.Infof("%s not ready (attempt %d): %s - retrying in %.1fs", desc, attempt, err, delay.Seconds())
+		time.Sleep(delay)
+		if delay *= 2; delay > RetryMaxDelay {
+			delay = RetryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldutils
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryUntilNoWait(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	err := RetryUntil("Thing", 0, func() error {
+		calls++
+		return fmt.Errorf("pop")
+	})
+
+	assert.EqualError(err, "pop")
+	assert.Equal(1, calls)
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	err := RetryUntil("Thing", 5*time.Second, func() error {
+		if calls++; calls < 2 {
+			return fmt.Errorf("pop")
+		}
+		return nil
+	})
+
+	assert.NoError(err)
+	assert.Equal(2, calls)
+}
+
+func TestRetryUntilGiveUp(t *testing.T) {
+	assert := assert.New(t)
+
+	calls := 0
+	start := time.Now()
+	err := RetryUntil("Thing", 500*time.Millisecond, func() error {
+		calls++
+		return fmt.Errorf("pop")
+	})
+
+	assert.EqualError(err, "Thing not ready after 500ms: pop")
+	assert.Equal(2, calls)
+	assert.True(time.Now().Sub(start) >= 500*time.Millisecond)
+}
@@ -19,6 +19,9 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -48,13 +51,13 @@ func CreateTLSConfiguration(tlsConfig *TLSConfig) (t *tls.Config, err error) {
 	}
 
 	var clientCerts []tls.Certificate
+	var reloader *certReloader
 	if mutualAuth {
-		var cert tls.Certificate
-		if cert, err = tls.LoadX509KeyPair(tlsConfig.ClientCertsFile, tlsConfig.ClientKeyFile); err != nil {
+		if reloader, err = newCertReloader(tlsConfig.ClientCertsFile, tlsConfig.ClientKeyFile); err != nil {
 			log.Errorf("Unable to load client key/certificate: %s", err)
 			return
 		}
-		clientCerts = append(clientCerts, cert)
+		clientCerts = append(clientCerts, *reloader.cert)
 	}
 
 	var caCertPool *x509.CertPool
@@ -73,5 +76,75 @@ func CreateTLSConfiguration(tlsConfig *TLSConfig) (t *tls.Config, err error) {
 		RootCAs:            caCertPool,
 		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
 	}
+	if reloader != nil {
+		// Takes precedence over Certificates, so new connections use the latest certificate
+		t.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return reloader.certificate(), nil
+		}
+	}
+	return
+}
+
+// certReloader holds a key pair loaded from files, and reloads it on the next
+// handshake after either file changes. This allows client certificates to be
+// rotated without a restart. Existing connections are unaffected
+type certReloader struct {
+	certFile string
+	keyFile  string
+	lock     sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) fileModTimes() (modTimes [2]time.Time, err error) {
+	for i, file := range []string{r.certFile, r.keyFile} {
+		var info os.FileInfo
+		if info, err = os.Stat(file); err != nil {
+			return
+		}
+		modTimes[i] = info.ModTime()
+	}
 	return
 }
+
+func (r *certReloader) load() error {
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+// certificate returns the current key pair, reloading it first if the files
+// have changed. If the files cannot be loaded, for example because only one of
+// them has been replaced so far, the previous key pair is returned and the load
+// is attempted again on the next handshake
+func (r *certReloader) certificate() *tls.Certificate {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if modTimes, err := r.fileModTimes(); err == nil && modTimes != r.modTimes {
+		if err = r.load(); err != nil {
+			log.Warnf("Unable to reload client key/certificate, using the previous certificate: %s", err)
+		} else {
+			log.Infof("Reloaded client key/certificate from %s", r.certFile)
+		}
+	}
+	return r.cert
+}
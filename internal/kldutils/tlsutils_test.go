@@ -15,9 +15,19 @@
 package kldutils
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
+	"math/big"
+	"os"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -135,3 +145,57 @@ func TestCreateTLSConfigurationWithSelfSignedMutualAuth(t *testing.T) {
 	tlsConfig, err = CreateTLSConfiguration(&tlsConfigOptions)
 	assert.Regexp("no such file or directory", err.Error())
 }
+
+func writeTestKeyPair(assert *assert.Assertions, certFile, keyFile, commonName string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(err)
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0644)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func TestCreateTLSConfigurationReloadsClientCert(t *testing.T) {
+	assert := assert.New(t)
+
+	testCertFile, _ := ioutil.TempFile("", "testcert")
+	defer syscall.Unlink(testCertFile.Name())
+	testKeyFile, _ := ioutil.TempFile("", "testkey")
+	defer syscall.Unlink(testKeyFile.Name())
+	modTime := time.Now().Add(-1 * time.Hour)
+	writeTestKeyPair(assert, testCertFile.Name(), testKeyFile.Name(), "cert1", modTime)
+
+	tlsConfig, err := CreateTLSConfiguration(&TLSConfig{
+		Enabled:         true,
+		ClientCertsFile: testCertFile.Name(),
+		ClientKeyFile:   testKeyFile.Name(),
+	})
+	assert.NoError(err)
+	commonName := func() string {
+		cert, err := tlsConfig.GetClientCertificate(&tls.CertificateRequestInfo{})
+		assert.NoError(err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		assert.NoError(err)
+		return leaf.Subject.CommonName
+	}
+	assert.Equal("cert1", commonName())
+
+	writeTestKeyPair(assert, testCertFile.Name(), testKeyFile.Name(), "cert2", modTime.Add(time.Minute))
+	assert.Equal("cert2", commonName())
+
+	// A partially replaced key pair is ignored until it is complete
+	ioutil.WriteFile(testKeyFile.Name(), []byte("bad"), 0644)
+	assert.Equal("cert2", commonName())
+	writeTestKeyPair(assert, testCertFile.Name(), testKeyFile.Name(), "cert3", modTime.Add(2*time.Minute))
+	assert.Equal("cert3", commonName())
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldwebhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	log "github.com/sirupsen/logrus"
+)
+
+// ackFields are the fields that can be included in the response to a request
+// that was accepted. The partition and offset are only known once Kafka has
+// acknowledged the message, so are omitted from the response on /fasthook
+var ackFields = []string{"sent", "id", "msg", "received", "topic", "partition", "offset"}
+
+// AckResponseConf shapes the response to a request that was accepted, for
+// clients that need a specific contract. The default is the sentMsg response
+type AckResponseConf struct {
+	Fields   []string `json:"fields,omitempty"`
+	Status   int      `json:"status,omitempty"`
+	Location string   `json:"location,omitempty"`
+}
+
+type sentMsg struct {
+	Sent    bool   `json:"sent"`
+	Request string `json:"id"`
+	Msg     string `json:"msg,omitempty"`
+}
+
+// validateAckResponse checks the configured fields are known, and the status is a success
+func (w *WebhooksBridge) validateAckResponse() error {
+	ackConf := &w.conf.Ack
+	for _, field := range ackConf.Fields {
+		known := false
+		for _, ackField := range ackFields {
+			known = known || field == ackField
+		}
+		if !known {
+			return fmt.Errorf("Unknown ack response field '%s' (must be one of %s)", field, strings.Join(ackFields, ","))
+		}
+	}
+	if ackConf.Status == 0 {
+		ackConf.Status = 200
+	} else if ackConf.Status < 200 || ackConf.Status > 299 {
+		return fmt.Errorf("Ack response status %d must be a success status (2xx)", ackConf.Status)
+	}
+	return nil
+}
+
+// msgSentReply sends the response for a request that was accepted, on both
+// /hook, once Kafka has acknowledged the message, and /fasthook. A Location
+// header is added if configured, with {id} replaced by the request ID
+func (w *WebhooksBridge) msgSentReply(res http.ResponseWriter, ack bool, msg *sarama.ProducerMessage, received time.Time) {
+	ackConf := &w.conf.Ack
+	replyMsg := sentMsg{
+		Sent:    true,
+		Request: msg.Metadata.(string),
+	}
+	if ack {
+		replyMsg.Msg = fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+	var reply []byte
+	if len(ackConf.Fields) == 0 {
+		reply, _ = json.Marshal(&replyMsg)
+	} else {
+		available := map[string]interface{}{
+			"sent":     replyMsg.Sent,
+			"id":       replyMsg.Request,
+			"received": received.UTC().Format(time.RFC3339Nano),
+			"topic":    msg.Topic,
+		}
+		if ack {
+			available["msg"] = replyMsg.Msg
+			available["partition"] = msg.Partition
+			available["offset"] = msg.Offset
+		}
+		shaped := make(map[string]interface{}, len(ackConf.Fields))
+		for _, field := range ackConf.Fields {
+			if val, exists := available[field]; exists {
+				shaped[field] = val
+			}
+		}
+		reply, _ = json.Marshal(shaped)
+	}
+	if ackConf.Location != "" {
+		res.Header().Set("Location", strings.Replace(ackConf.Location, "{id}", replyMsg.Request, -1))
+	}
+	status := ackConf.Status
+	if status == 0 {
+		status = 200
+	}
+	log.Infof("Sending %d to HTTP webhook. Request=%s Msg=%s", status, replyMsg.Request, replyMsg.Msg)
+	res.WriteHeader(status)
+	res.Write(reply)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 Kaleido, a ConsenSys business
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldwebhooks
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfAckResponse(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+
+	w := NewWebhooksBridge(&printYAML)
+	assert.NoError(w.ValidateConf())
+	assert.Equal(200, w.conf.Ack.Status)
+
+	w = NewWebhooksBridge(&printYAML)
+	w.conf.Ack.Fields = []string{"id", "estimate"}
+	assert.EqualError(w.ValidateConf(), "Unknown ack response field 'estimate' (must be one of sent,id,msg,received,topic,partition,offset)")
+
+	w = NewWebhooksBridge(&printYAML)
+	w.conf.Ack.Status = 302
+	assert.EqualError(w.ValidateConf(), "Ack response status 302 must be a success status (2xx)")
+}
+
+func TestMsgSentReplyDefault(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+
+	msg := &sarama.ProducerMessage{Topic: "requests", Partition: 1, Offset: 10, Metadata: "id1"}
+	res := httptest.NewRecorder()
+	w.msgSentReply(res, true, msg, time.Now())
+	assert.Equal(200, res.Code)
+	assert.Equal(`{"sent":true,"id":"id1","msg":"requests:1:10"}`, res.Body.String())
+	assert.Empty(res.Header().Get("Location"))
+
+	res = httptest.NewRecorder()
+	w.msgSentReply(res, false, msg, time.Now())
+	assert.Equal(`{"sent":true,"id":"id1"}`, res.Body.String())
+}
+
+func TestMsgSentReplyShaped(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.Ack = AckResponseConf{
+		Fields:   []string{"id", "received", "topic", "partition", "offset"},
+		Status:   202,
+		Location: "/reply/{id}",
+	}
+	received := time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	msg := &sarama.ProducerMessage{Topic: "requests", Partition: 1, Offset: 10, Metadata: "id1"}
+	res := httptest.NewRecorder()
+	w.msgSentReply(res, true, msg, received)
+	assert.Equal(202, res.Code)
+	assert.JSONEq(`{"id":"id1","received":"2019-01-02T03:04:05Z","topic":"requests","partition":1,"offset":10}`, res.Body.String())
+	assert.Equal("/reply/id1", res.Header().Get("Location"))
+
+	// The partition and offset are not known without waiting for Kafka
+	res = httptest.NewRecorder()
+	w.msgSentReply(res, false, msg, received)
+	assert.JSONEq(`{"id":"id1","received":"2019-01-02T03:04:05Z","topic":"requests"}`, res.Body.String())
+}
@@ -56,6 +56,7 @@ type MongoCollection interface {
 	Create(info *mgo.CollectionInfo) error
 	EnsureIndex(index mgo.Index) error
 	Find(query interface{}) MongoQuery
+	RemoveAll(selector interface{}) (*mgo.ChangeInfo, error)
 }
 
 type collWrapper struct {
@@ -78,6 +79,10 @@ func (m *collWrapper) Find(query interface{}) MongoQuery {
 	return m.coll.Find(query)
 }
 
+func (m *collWrapper) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	return m.coll.RemoveAll(selector)
+}
+
 type errMsg struct {
 	Message string `json:"error"`
 }
@@ -132,6 +137,66 @@ func (w *WebhooksBridge) connectMongoDB(mongo MongoDatabase) (err error) {
 	return
 }
 
+// startReceiptJanitor periodically prunes the receipt store, if a retention policy
+// is configured, until the returned function is called
+func (w *WebhooksBridge) startReceiptJanitor() func() {
+	retention := &w.conf.MongoDB.Retention
+	if w.mongo == nil || (retention.MaxAge <= 0 && retention.MaxCount <= 0) {
+		return func() {}
+	}
+	log.Infof("Pruning receipts every %ds: MaxAge=%ds MaxCount=%d", retention.Interval, retention.MaxAge, retention.MaxCount)
+	ticker := time.NewTicker(time.Duration(retention.Interval) * time.Second)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				w.pruneReceipts()
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(done)
+	}
+}
+
+// pruneReceipts deletes the receipts that are older than the maximum age, and
+// those beyond the maximum count, oldest first. receivedAt is a number rather than
+// a date, so a MongoDB TTL index cannot be used to expire them
+func (w *WebhooksBridge) pruneReceipts() {
+	retention := &w.conf.MongoDB.Retention
+	if retention.MaxAge > 0 {
+		cutoff := time.Now().Add(-time.Duration(retention.MaxAge)*time.Second).UnixNano() / int64(time.Millisecond)
+		w.removeReceipts(bson.M{"receivedAt": bson.M{"$lt": cutoff}}, "older than the maximum age")
+	}
+	if retention.MaxCount > 0 {
+		// Find the newest receipt beyond the count, and remove it along with all older ones
+		query := w.mongo.Find(bson.M{})
+		query.Sort("-receivedAt")
+		query.Skip(retention.MaxCount)
+		var newestExcess map[string]interface{}
+		if err := query.One(&newestExcess); err == mgo.ErrNotFound {
+			return
+		} else if err != nil {
+			log.Errorf("Failed to query receipts to prune: %s", err)
+			return
+		}
+		w.removeReceipts(bson.M{"receivedAt": bson.M{"$lte": newestExcess["receivedAt"]}}, "beyond the maximum count")
+	}
+}
+
+func (w *WebhooksBridge) removeReceipts(selector bson.M, reason string) {
+	info, err := w.mongo.RemoveAll(selector)
+	if err != nil {
+		log.Errorf("Failed to prune receipts %s: %s", reason, err)
+	} else if info != nil && info.Removed > 0 {
+		log.Infof("Pruned %d receipts %s", info.Removed, reason)
+	}
+}
+
 // getString is a helper to safely extract strings from generic interface maps
 func getString(genericMap map[string]interface{}, key string) string {
 	if val, exists := genericMap[key]; exists {
@@ -20,10 +20,12 @@ import (
 	"net/http"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Shopify/sarama"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 
@@ -52,6 +54,8 @@ type mockCollection struct {
 	collErr        error
 	ensureIndexErr error
 	mockQuery      mockQuery
+	removed        []interface{}
+	removeErr      error
 }
 
 func (m *mockCollection) Insert(payloads ...interface{}) error {
@@ -72,6 +76,11 @@ func (m *mockCollection) EnsureIndex(index mgo.Index) error {
 	return m.ensureIndexErr
 }
 
+func (m *mockCollection) RemoveAll(selector interface{}) (*mgo.ChangeInfo, error) {
+	m.removed = append(m.removed, selector)
+	return &mgo.ChangeInfo{Removed: 1}, m.removeErr
+}
+
 type mockQuery struct {
 	allErr        error
 	oneErr        error
@@ -405,3 +414,104 @@ func TestConsumerMessagesLoopCallsReplyProcessorWithEmptyPayload(t *testing.T) {
 	assert.Equal(int64(12345), consumer.(*kldkafka.MockKafkaConsumer).OffsetsByPartition[3])
 
 }
+
+func TestPruneReceiptsMaxAge(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	mockCollection := &mockCollection{}
+	w.mongo = mockCollection
+	w.conf.MongoDB.Retention.MaxAge = 3600
+
+	before := time.Now().Add(-1*time.Hour).UnixNano() / int64(time.Millisecond)
+	w.pruneReceipts()
+
+	assert.Equal(1, len(mockCollection.removed))
+	cutoff := mockCollection.removed[0].(bson.M)["receivedAt"].(bson.M)["$lt"].(int64)
+	assert.True(cutoff >= before && cutoff < before+1000)
+}
+
+func TestPruneReceiptsMaxCount(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	mockCollection := &mockCollection{}
+	mockCollection.mockQuery.resultWranger = func(result interface{}) {
+		*(result.(*map[string]interface{})) = map[string]interface{}{"receivedAt": int64(12345)}
+	}
+	w.mongo = mockCollection
+	w.conf.MongoDB.Retention.MaxCount = 1000
+
+	w.pruneReceipts()
+
+	assert.Equal(1000, mockCollection.mockQuery.skip)
+	assert.Equal([]interface{}{bson.M{"receivedAt": bson.M{"$lte": int64(12345)}}}, mockCollection.removed)
+}
+
+func TestPruneReceiptsMaxCountNotReached(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	mockCollection := &mockCollection{}
+	mockCollection.mockQuery.oneErr = mgo.ErrNotFound
+	w.mongo = mockCollection
+	w.conf.MongoDB.Retention.MaxCount = 1000
+
+	w.pruneReceipts()
+	assert.Empty(mockCollection.removed)
+
+	mockCollection.mockQuery.oneErr = fmt.Errorf("pop")
+	w.pruneReceipts()
+	assert.Empty(mockCollection.removed)
+}
+
+func TestPruneReceiptsRemoveErr(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	mockCollection := &mockCollection{removeErr: fmt.Errorf("pop")}
+	w.mongo = mockCollection
+	w.conf.MongoDB.Retention.MaxAge = 60
+
+	w.pruneReceipts()
+	assert.Equal(1, len(mockCollection.removed))
+}
+
+func TestReceiptJanitor(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.startReceiptJanitor()() // no-op without a receipt store
+
+	mockCollection := &mockCollection{}
+	w.mongo = mockCollection
+	w.startReceiptJanitor()() // no-op without a retention policy
+
+	w.conf.MongoDB.Retention.MaxAge = 60
+	w.conf.MongoDB.Retention.Interval = 1
+	stop := w.startReceiptJanitor()
+	time.Sleep(1500 * time.Millisecond)
+	stop()
+	assert.Equal(1, len(mockCollection.removed))
+}
+
+func TestValidateRetention(t *testing.T) {
+	assert := assert.New(t)
+
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	assert.NoError(w.validateRetention())
+	assert.Equal(60, w.conf.MongoDB.Retention.Interval)
+
+	w.conf.MongoDB.Retention.MaxCount = -1
+	assert.EqualError(w.validateRetention(), "Receipt retention maximum age and count must not be negative")
+
+	w.conf.MongoDB.Retention.MaxCount = 1000
+	w.conf.MongoDB.MaxDocs = 1000
+	assert.EqualError(w.validateRetention(), "Receipt retention cannot be used with a capped receipt store collection")
+}
@@ -16,12 +16,15 @@ package kldwebhooks
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,6 +34,7 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/icza/dyno"
 	"github.com/julienschmidt/httprouter"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldkafka"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
 	"github.com/kaleido-io/ethconnect/internal/kldutils"
@@ -47,19 +51,50 @@ const (
 
 // WebhooksBridgeConf defines the YAML config structure for a webhooks bridge instance
 type WebhooksBridgeConf struct {
-	Kafka   kldkafka.KafkaCommonConf `json:"kafka"`
-	MongoDB struct {
+	// KafkaBridge names a Kafka->Ethereum bridge in the same server config, to
+	// take the Kafka settings from, so the two share the request and reply topics
+	KafkaBridge string                   `json:"kafkaBridge,omitempty"`
+	Kafka       kldkafka.KafkaCommonConf `json:"kafka"`
+	MongoDB     struct {
 		URL        string `json:"url"`
 		Database   string `json:"database"`
 		Collection string `json:"collection"`
 		MaxDocs    int    `json:"maxDocs"`
 		QueryLimit int    `json:"queryLimit"`
+		Retention  struct {
+			MaxAge   int `json:"maxAge"`
+			MaxCount int `json:"maxCount"`
+			Interval int `json:"interval"`
+		} `json:"retention"`
 	} `json:"mongodb"`
 	HTTP struct {
-		LocalAddr string             `json:"localAddr"`
-		Port      int                `json:"port"`
-		TLS       kldutils.TLSConfig `json:"tls"`
+		LocalAddr       string             `json:"localAddr"`
+		Port            int                `json:"port"`
+		TLS             kldutils.TLSConfig `json:"tls"`
+		Headers         map[string]string  `json:"headers,omitempty"`
+		RequestIDHeader string             `json:"requestIDHeader,omitempty"`
+		AdminToken      string             `json:"adminToken,omitempty"`
+		// Timeouts and keep-alive periods in seconds, with zero for the Go defaults
+		ReadTimeout       int  `json:"readTimeout"`
+		ReadHeaderTimeout int  `json:"readHeaderTimeout"`
+		WriteTimeout      int  `json:"writeTimeout"`
+		IdleTimeout       int  `json:"idleTimeout"`
+		MaxHeaderBytes    int  `json:"maxHeaderBytes"`
+		HTTP2             bool `json:"http2"`
+		DisableKeepAlives bool `json:"disableKeepAlives"`
+		TCPKeepAlive      int  `json:"tcpKeepAlive"`
 	} `json:"http"`
+	Backpressure struct {
+		MaxPending int `json:"maxPending"`
+		RetryAfter int `json:"retryAfter"`
+	} `json:"backpressure"`
+	// Retries of a request that fails to be delivered to Kafka, with the backoff
+	// in milliseconds doubling after each attempt
+	ProduceRetry struct {
+		Max     int `json:"max"`
+		Backoff int `json:"backoff"`
+	} `json:"produceRetry"`
+	Ack AckResponseConf `json:"ack"`
 }
 
 // WebhooksBridge receives messages over HTTP POST and sends them to Kafka
@@ -72,6 +107,7 @@ type WebhooksBridge struct {
 	pendingMsgs map[string]bool
 	successMsgs map[string]*sarama.ProducerMessage
 	failedMsgs  map[string]error
+	unackedMsgs int // sent to the producer, without a success or error yet
 	mongo       MongoCollection
 }
 
@@ -94,9 +130,107 @@ func (w *WebhooksBridge) ValidateConf() (err error) {
 	if w.conf.MongoDB.QueryLimit < 1 {
 		w.conf.MongoDB.QueryLimit = 100
 	}
+	if err = w.validateRetention(); err != nil {
+		return
+	}
+	if w.conf.HTTP.RequestIDHeader == "" {
+		w.conf.HTTP.RequestIDHeader = "X-Request-ID"
+	}
+	if err = w.validateHTTPServer(); err != nil {
+		return
+	}
+	if w.conf.Backpressure.MaxPending < 0 {
+		err = fmt.Errorf("Maximum pending messages %d must not be negative", w.conf.Backpressure.MaxPending)
+		return
+	}
+	if w.conf.Backpressure.RetryAfter < 1 {
+		w.conf.Backpressure.RetryAfter = 5
+	}
+	if w.conf.ProduceRetry.Max < 0 || w.conf.ProduceRetry.Backoff < 0 {
+		err = fmt.Errorf("Produce retries and backoff must not be negative")
+		return
+	} else if w.conf.ProduceRetry.Backoff == 0 {
+		w.conf.ProduceRetry.Backoff = 500
+	}
+	if w.conf.Kafka.Partitioner.Type == kldkafka.PartitionerManual {
+		// Requests are not parsed, so there is no field to read the partition from
+		err = fmt.Errorf("The '%s' partitioner is only supported for replies", kldkafka.PartitionerManual)
+		return
+	}
+	err = w.validateAckResponse()
 	return
 }
 
+// validateRetention checks the receipt retention policy, which cannot be used with
+// a capped collection as MongoDB does not allow documents to be removed from one
+func (w *WebhooksBridge) validateRetention() error {
+	retention := &w.conf.MongoDB.Retention
+	if retention.MaxAge < 0 || retention.MaxCount < 0 {
+		return fmt.Errorf("Receipt retention maximum age and count must not be negative")
+	}
+	if (retention.MaxAge > 0 || retention.MaxCount > 0) && w.conf.MongoDB.MaxDocs > 0 {
+		return fmt.Errorf("Receipt retention cannot be used with a capped receipt store collection")
+	}
+	if retention.Interval < 1 {
+		retention.Interval = 60
+	}
+	return nil
+}
+
+// validateHTTPServer checks the tuning of the HTTP server
+func (w *WebhooksBridge) validateHTTPServer() error {
+	httpConf := &w.conf.HTTP
+	for name, val := range map[string]int{
+		"read timeout":        httpConf.ReadTimeout,
+		"read header timeout": httpConf.ReadHeaderTimeout,
+		"write timeout":       httpConf.WriteTimeout,
+		"idle timeout":        httpConf.IdleTimeout,
+		"maximum header size": httpConf.MaxHeaderBytes,
+		"TCP keep-alive":      httpConf.TCPKeepAlive,
+	} {
+		if val < 0 {
+			return fmt.Errorf("HTTP %s %d must not be negative", name, val)
+		}
+	}
+	if httpConf.MaxHeaderBytes == 0 {
+		httpConf.MaxHeaderBytes = MaxHeaderSize
+	}
+	return nil
+}
+
+// newHTTPServer builds the server with the configured timeouts and protocols.
+// HTTP/2 is only negotiated with TLS clients when enabled
+func (w *WebhooksBridge) newHTTPServer(handler http.Handler, tlsConfig *tls.Config) *http.Server {
+	httpConf := &w.conf.HTTP
+	srv := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", httpConf.LocalAddr, httpConf.Port),
+		TLSConfig:         tlsConfig,
+		Handler:           handler,
+		MaxHeaderBytes:    httpConf.MaxHeaderBytes,
+		ReadTimeout:       time.Duration(httpConf.ReadTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(httpConf.ReadHeaderTimeout) * time.Second,
+		WriteTimeout:      time.Duration(httpConf.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(httpConf.IdleTimeout) * time.Second,
+	}
+	if !httpConf.HTTP2 {
+		// A non-nil empty map stops the server offering HTTP/2 over TLS
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	srv.SetKeepAlivesEnabled(!httpConf.DisableKeepAlives)
+	return srv
+}
+
+// listenAndServe listens with the configured TCP keep-alive period,
+// which http.Server.ListenAndServe does not allow to be set
+func (w *WebhooksBridge) listenAndServe() error {
+	lc := net.ListenConfig{KeepAlive: time.Duration(w.conf.HTTP.TCPKeepAlive) * time.Second}
+	listener, err := lc.Listen(context.Background(), "tcp", w.srv.Addr)
+	if err != nil {
+		return err
+	}
+	return w.srv.Serve(listener)
+}
+
 // NewWebhooksBridge constructor
 func NewWebhooksBridge(printYAML *bool) (w *WebhooksBridge) {
 	w = &WebhooksBridge{
@@ -137,14 +271,67 @@ func (w *WebhooksBridge) CobraInit() (cmd *cobra.Command) {
 	w.kafka.CobraInit(cmd)
 	cmd.Flags().StringVarP(&w.conf.HTTP.LocalAddr, "listen-addr", "L", os.Getenv("WEBHOOKS_LISTEN_ADDR"), "Local address to listen on")
 	cmd.Flags().IntVarP(&w.conf.HTTP.Port, "listen-port", "l", kldutils.DefInt("WEBHOOKS_LISTEN_PORT", 8080), "Port to listen on")
+	cmd.Flags().StringToStringVar(&w.conf.HTTP.Headers, "response-header", nil, "Header to add to every HTTP response, as name=value (repeatable)")
+	cmd.Flags().StringVar(&w.conf.HTTP.RequestIDHeader, "request-id-header", os.Getenv("WEBHOOKS_REQUEST_ID_HEADER"), "Request header echoed back on the HTTP response, for correlation (default=X-Request-ID)")
+	cmd.Flags().IntVar(&w.conf.Backpressure.MaxPending, "max-pending", kldutils.DefInt("WEBHOOKS_MAX_PENDING", 0), "Maximum messages waiting to be delivered to Kafka, before rejecting requests with 503 (0=unlimited)")
+	cmd.Flags().IntVar(&w.conf.Backpressure.RetryAfter, "retry-after", kldutils.DefInt("WEBHOOKS_RETRY_AFTER", 5), "Seconds returned in Retry-After when rejecting requests due to backpressure")
+	cmd.Flags().IntVar(&w.conf.ProduceRetry.Max, "produce-retries", kldutils.DefInt("WEBHOOKS_PRODUCE_RETRIES", 0), "Times to retry delivering an acknowledged request to Kafka, before rejecting it with 503")
+	cmd.Flags().IntVar(&w.conf.ProduceRetry.Backoff, "produce-retry-backoff", kldutils.DefInt("WEBHOOKS_PRODUCE_RETRY_BACKOFF", 0), "Time to wait before the first retry of a delivery to Kafka, doubling after each attempt (ms, default=500)")
+	cmd.Flags().StringSliceVar(&w.conf.Ack.Fields, "ack-fields", nil, "Fields to include in the response to an accepted request, from sent,id,msg,received,topic,partition,offset (default=sent,id,msg)")
+	cmd.Flags().IntVar(&w.conf.Ack.Status, "ack-status", kldutils.DefInt("WEBHOOKS_ACK_STATUS", 0), "HTTP status of the response to an accepted request (default=200)")
+	cmd.Flags().StringVar(&w.conf.Ack.Location, "ack-location", os.Getenv("WEBHOOKS_ACK_LOCATION"), "Location header for the response to an accepted request, with {id} replaced by the request ID, such as /reply/{id}")
+	cmd.Flags().IntVar(&w.conf.HTTP.ReadTimeout, "http-read-timeout", kldutils.DefInt("WEBHOOKS_HTTP_READ_TIMEOUT", 0), "Maximum time to read a request, including the body (seconds, 0=no limit)")
+	cmd.Flags().IntVar(&w.conf.HTTP.ReadHeaderTimeout, "http-read-header-timeout", kldutils.DefInt("WEBHOOKS_HTTP_READ_HEADER_TIMEOUT", 0), "Maximum time to read the headers of a request (seconds, default=http-read-timeout)")
+	cmd.Flags().IntVar(&w.conf.HTTP.WriteTimeout, "http-write-timeout", kldutils.DefInt("WEBHOOKS_HTTP_WRITE_TIMEOUT", 0), "Maximum time to process a request and write the response (seconds, 0=no limit)")
+	cmd.Flags().IntVar(&w.conf.HTTP.IdleTimeout, "http-idle-timeout", kldutils.DefInt("WEBHOOKS_HTTP_IDLE_TIMEOUT", 0), "Maximum time to keep an idle connection open for the next request (seconds, default=http-read-timeout)")
+	cmd.Flags().IntVar(&w.conf.HTTP.MaxHeaderBytes, "http-max-header-bytes", kldutils.DefInt("WEBHOOKS_HTTP_MAX_HEADER_BYTES", 0), "Maximum size of the headers of a request (default=16384)")
+	cmd.Flags().BoolVar(&w.conf.HTTP.HTTP2, "http2", false, "Negotiate HTTP/2 with TLS clients, as well as HTTP/1.1")
+	cmd.Flags().BoolVar(&w.conf.HTTP.DisableKeepAlives, "http-disable-keepalives", false, "Close each connection after one request, rather than keeping it open for reuse")
+	cmd.Flags().IntVar(&w.conf.HTTP.TCPKeepAlive, "http-tcp-keepalive", kldutils.DefInt("WEBHOOKS_HTTP_TCP_KEEPALIVE", 0), "Period of TCP keep-alive probes on connections (seconds, default=15)")
+	cmd.Flags().StringVar(&w.conf.HTTP.AdminToken, "admin-token", os.Getenv("WEBHOOKS_ADMIN_TOKEN"), "Bearer token required for the admin endpoints, which are disabled if not set")
 	cmd.Flags().StringVarP(&w.conf.MongoDB.URL, "mongodb-url", "m", os.Getenv("MONGODB_URL"), "MongoDB URL for a receipt store")
 	cmd.Flags().StringVarP(&w.conf.MongoDB.Database, "mongodb-database", "D", os.Getenv("MONGODB_DATABASE"), "MongoDB receipt store database")
 	cmd.Flags().StringVarP(&w.conf.MongoDB.Collection, "mongodb-receipt-collection", "r", os.Getenv("MONGODB_COLLECTION"), "MongoDB receipt store collection")
 	cmd.Flags().IntVarP(&w.conf.MongoDB.MaxDocs, "mongodb-receipt-maxdocs", "x", kldutils.DefInt("MONGODB_MAXDOCS", 0), "Receipt store capped size (new collections only)")
+	cmd.Flags().IntVar(&w.conf.MongoDB.Retention.MaxAge, "mongodb-receipt-maxage", kldutils.DefInt("MONGODB_RECEIPT_MAXAGE", 0), "Delete receipts older than this (seconds, 0=keep forever)")
+	cmd.Flags().IntVar(&w.conf.MongoDB.Retention.MaxCount, "mongodb-receipt-maxcount", kldutils.DefInt("MONGODB_RECEIPT_MAXCOUNT", 0), "Delete the oldest receipts beyond this number (0=no limit)")
+	cmd.Flags().IntVar(&w.conf.MongoDB.Retention.Interval, "mongodb-prune-interval", kldutils.DefInt("MONGODB_PRUNE_INTERVAL", 0), "Interval between deleting receipts beyond the maximum age or count (seconds, default=60)")
 	cmd.Flags().IntVarP(&w.conf.MongoDB.QueryLimit, "mongodb-query-limit", "q", kldutils.DefInt("MONGODB_MAXDOCS", 0), "Maximum docs to return on a rest call (cap on limit)")
 	return
 }
 
+// addressKey normalizes an address used as the Kafka key of a message, so all the
+// messages for an account are in the same partition whatever case it is supplied in.
+// In particular the sender recovered from a pre-signed transaction is checksummed
+func addressKey(address string) string {
+	return strings.ToLower(address)
+}
+
+// checkBackpressure rejects the request if too many messages are still waiting
+// to be delivered to Kafka, so the caller slows down rather than building a backlog
+func (w *WebhooksBridge) checkBackpressure(res http.ResponseWriter) bool {
+	maxPending := w.conf.Backpressure.MaxPending
+	if maxPending <= 0 {
+		return true
+	}
+	w.sendCond.L.Lock()
+	unacked := w.unackedMsgs
+	w.sendCond.L.Unlock()
+	if unacked < maxPending {
+		return true
+	}
+	log.Warnf("Rejecting request with %d messages waiting to be delivered to Kafka", unacked)
+	res.Header().Set("Retry-After", strconv.Itoa(w.conf.Backpressure.RetryAfter))
+	hookErrReply(res, fmt.Errorf("Too many messages waiting to be delivered to Kafka - retry later"), 503)
+	return false
+}
+
+func (w *WebhooksBridge) setMsgSending() {
+	w.sendCond.L.Lock()
+	w.unackedMsgs++
+	w.sendCond.L.Unlock()
+}
+
 func (w *WebhooksBridge) setMsgPending(msgID string) {
 	w.sendCond.L.Lock()
 	w.pendingMsgs[msgID] = true
@@ -178,6 +365,7 @@ func (w *WebhooksBridge) ProducerErrorLoop(consumer kldkafka.KafkaConsumer, prod
 		}
 		msgID := err.Msg.Metadata.(string)
 		w.sendCond.L.Lock()
+		w.unackedMsgs--
 		if _, found := w.pendingMsgs[msgID]; found {
 			delete(w.pendingMsgs, msgID)
 			w.failedMsgs[msgID] = err
@@ -199,6 +387,7 @@ func (w *WebhooksBridge) ProducerSuccessLoop(consumer kldkafka.KafkaConsumer, pr
 		}
 		msgID := msg.Metadata.(string)
 		w.sendCond.L.Lock()
+		w.unackedMsgs--
 		if _, found := w.pendingMsgs[msgID]; found {
 			delete(w.pendingMsgs, msgID)
 			w.successMsgs[msgID] = msg
@@ -209,6 +398,9 @@ func (w *WebhooksBridge) ProducerSuccessLoop(consumer kldkafka.KafkaConsumer, pr
 	wg.Done()
 }
 
+// ConsumerStopping - nothing to release, as the reply consumer is never paused
+func (w *WebhooksBridge) ConsumerStopping() {}
+
 type hookErrMsg struct {
 	Sent    bool   `json:"sent"`
 	Message string `json:"error"`
@@ -232,29 +424,6 @@ func okReply(res http.ResponseWriter) {
 	return
 }
 
-type sentMsg struct {
-	Sent    bool   `json:"sent"`
-	Request string `json:"id"`
-	Msg     string `json:"msg,omitempty"`
-}
-
-func msgSentReply(res http.ResponseWriter, ack bool, msg *sarama.ProducerMessage) {
-	msgAck := ""
-	if ack {
-		msgAck = fmt.Sprintf("%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
-	}
-	replyMsg := sentMsg{
-		Sent:    true,
-		Request: msg.Metadata.(string),
-		Msg:     msgAck,
-	}
-	reply, _ := json.Marshal(&replyMsg)
-	log.Infof("Sending 200 OK to HTTP webhook. Request=%s Msg=%s", replyMsg.Request, replyMsg.Msg)
-	res.WriteHeader(200)
-	res.Write(reply)
-	return
-}
-
 func (w *WebhooksBridge) webhookHandlerWithAck(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	w.webhookHandler(res, req, true)
 }
@@ -265,6 +434,10 @@ func (w *WebhooksBridge) webhookHandlerNoAck(res http.ResponseWriter, req *http.
 
 func (w *WebhooksBridge) webhookHandler(res http.ResponseWriter, req *http.Request, ack bool) {
 
+	received := time.Now()
+	if !w.checkBackpressure(res) {
+		return
+	}
 	if req.ContentLength > MaxPayloadSize {
 		hookErrReply(res, fmt.Errorf("Message exceeds maximum allowable size"), 400)
 		return
@@ -319,13 +492,43 @@ func (w *WebhooksBridge) webhookHandler(res http.ResponseWriter, req *http.Reque
 	}
 	var key string
 	switch msgType {
-	case kldmessages.MsgTypeDeployContract, kldmessages.MsgTypeSendTransaction:
+	case kldmessages.MsgTypeDeployContract, kldmessages.MsgTypeSendTransaction, kldmessages.MsgTypeReplaceTransaction:
 		from, exists := genericPayload["from"]
 		if !exists || reflect.TypeOf(from).Kind() != reflect.String {
 			hookErrReply(res, fmt.Errorf("Invalid message - missing 'from' (or not a string)"), 400)
 			return
 		}
-		key = from.(string)
+		key = addressKey(from.(string))
+		break
+	case kldmessages.MsgTypeSendRawTransaction:
+		// The sender is only available by recovering it from the signature
+		rawTX, exists := genericPayload["rawTransaction"]
+		if !exists || reflect.TypeOf(rawTX).Kind() != reflect.String {
+			hookErrReply(res, fmt.Errorf("Invalid message - missing 'rawTransaction' (or not a string)"), 400)
+			return
+		}
+		tx, err := kldeth.NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: rawTX.(string)})
+		if err != nil {
+			hookErrReply(res, fmt.Errorf("Invalid message - %s", err), 400)
+			return
+		}
+		key = addressKey(tx.From.Hex())
+		break
+	case kldmessages.MsgTypeGetBalance, kldmessages.MsgTypeGetEvents:
+		address, exists := genericPayload["address"]
+		if !exists || reflect.TypeOf(address).Kind() != reflect.String {
+			hookErrReply(res, fmt.Errorf("Invalid message - missing 'address' (or not a string)"), 400)
+			return
+		}
+		key = addressKey(address.(string))
+		break
+	case kldmessages.MsgTypeGetTransaction:
+		txHash, exists := genericPayload["transactionHash"]
+		if !exists || reflect.TypeOf(txHash).Kind() != reflect.String {
+			hookErrReply(res, fmt.Errorf("Invalid message - missing 'transactionHash' (or not a string)"), 400)
+			return
+		}
+		key = txHash.(string)
 		break
 	default:
 		hookErrReply(res, fmt.Errorf("Invalid message type: %s", msgType), 400)
@@ -353,20 +556,66 @@ func (w *WebhooksBridge) webhookHandler(res http.ResponseWriter, req *http.Reque
 		Value:    sarama.ByteEncoder(payloadToForward),
 		Metadata: msgID,
 	}
-	w.kafka.Producer().Input() <- sentMsg
-
 	if ack {
-		successMsg, err := w.waitForSend(msgID)
-		if err != nil {
+		successMsg, err := w.sendWithRetry(sentMsg)
+		if err != nil && w.conf.ProduceRetry.Max > 0 {
+			res.Header().Set("Retry-After", strconv.Itoa(w.conf.Backpressure.RetryAfter))
+			hookErrReply(res, fmt.Errorf("Failed to deliver message to Kafka after %d attempts: %s", w.conf.ProduceRetry.Max+1, err), 503)
+			return
+		} else if err != nil {
 			hookErrReply(res, fmt.Errorf("Failed to deliver message to Kafka: %s", err), 502)
 			return
 		}
-		msgSentReply(res, ack, successMsg)
+		w.msgSentReply(res, ack, successMsg, received)
 	} else {
-		msgSentReply(res, ack, sentMsg)
+		w.setMsgSending()
+		w.kafka.Producer().Input() <- sentMsg
+		w.msgSentReply(res, ack, sentMsg, received)
 	}
 }
 
+// sendWithRetry sends a message to Kafka and waits for it to be delivered. If
+// delivery fails, such as while a broker is unavailable, it is retried after the
+// backoff up to the configured number of times
+func (w *WebhooksBridge) sendWithRetry(msg *sarama.ProducerMessage) (*sarama.ProducerMessage, error) {
+	msgID := msg.Metadata.(string)
+	backoff := time.Duration(w.conf.ProduceRetry.Backoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		w.setMsgSending()
+		// A new message each attempt, as the producer records its own retries on the message
+		w.kafka.Producer().Input() <- &sarama.ProducerMessage{
+			Topic:    msg.Topic,
+			Key:      msg.Key,
+			Value:    msg.Value,
+			Metadata: msgID,
+		}
+		successMsg, err := w.waitForSend(msgID)
+		if err == nil || attempt >= w.conf.ProduceRetry.Max {
+			return successMsg, err
+		}
+		log.Warnf("Retrying delivery of message %s to Kafka in %s (retry %d of %d): %s", msgID, backoff, attempt+1, w.conf.ProduceRetry.Max, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		w.setMsgPending(msgID)
+	}
+}
+
+// responseHeaders wraps a handler to add the configured headers to every response,
+// success or error, and to echo back the request ID header if the client sent one
+func (w *WebhooksBridge) responseHeaders(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		for name, value := range w.conf.HTTP.Headers {
+			res.Header().Set(name, value)
+		}
+		if reqIDHeader := w.conf.HTTP.RequestIDHeader; reqIDHeader != "" {
+			if reqID := req.Header.Get(reqIDHeader); reqID != "" {
+				res.Header().Set(reqIDHeader, reqID)
+			}
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
 func (w *WebhooksBridge) statusHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	okReply(res)
 }
@@ -388,6 +637,9 @@ func (w *WebhooksBridge) Start() (err error) {
 	router.GET("/replies", w.getReplies)
 	router.GET("/replies/:id", w.getReply)
 	router.GET("/reply/:id", w.getReply)
+	if w.conf.HTTP.AdminToken != "" {
+		router.Handler("PUT", "/admin/loglevel", kldutils.LogLevelHandler(w.conf.HTTP.AdminToken))
+	}
 
 	tlsConfig, err := kldutils.CreateTLSConfiguration(&w.conf.HTTP.TLS)
 	if err != nil {
@@ -397,13 +649,10 @@ func (w *WebhooksBridge) Start() (err error) {
 	if err = w.connectMongoDB(&mgoWrapper{}); err != nil {
 		return
 	}
+	stopJanitor := w.startReceiptJanitor()
+	defer stopJanitor()
 
-	w.srv = &http.Server{
-		Addr:           fmt.Sprintf("%s:%d", w.conf.HTTP.LocalAddr, w.conf.HTTP.Port),
-		TLSConfig:      tlsConfig,
-		Handler:        router,
-		MaxHeaderBytes: MaxHeaderSize,
-	}
+	w.srv = w.newHTTPServer(w.responseHeaders(router), tlsConfig)
 
 	// Wait until Kafka is up before we listen
 	running := true
@@ -415,7 +664,7 @@ func (w *WebhooksBridge) Start() (err error) {
 		}
 		if running {
 			log.Printf("Listening on %s", w.srv.Addr)
-			if err := w.srv.ListenAndServe(); err != nil {
+			if err := w.listenAndServe(); err != nil {
 				log.Errorf("Listening ended with: %s", err)
 			}
 		}
@@ -22,15 +22,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/kaleido-io/ethconnect/internal/kldeth"
 	"github.com/kaleido-io/ethconnect/internal/kldkafka"
 	"github.com/kaleido-io/ethconnect/internal/kldmessages"
+	"github.com/kaleido-io/ethconnect/internal/kldmetrics"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
@@ -86,6 +90,14 @@ func (k *testKafkaCommon) Producer() kldkafka.KafkaProducer {
 	return producer
 }
 
+func (k *testKafkaCommon) ConsumerErrors() *kldmetrics.CounterVec {
+	return nil
+}
+
+func (k *testKafkaCommon) Assignment() *kldkafka.ConsumerAssignment {
+	return nil
+}
+
 var webhookExecuteError atomic.Value
 
 var lastPort = 9000
@@ -160,6 +172,177 @@ func TestValidateConfInvalidArgs(t *testing.T) {
 	assert.Regexp("MongoDB URL, Database and Collection name must be specified to enable the receipt store", err.Error())
 }
 
+func TestValidateConfNegativeMaxPending(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.Backpressure.MaxPending = -1
+	err := w.ValidateConf()
+	assert.Regexp("Maximum pending messages -1 must not be negative", err.Error())
+}
+
+func TestValidateConfManualPartitioner(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.Kafka.Partitioner.Type = kldkafka.PartitionerManual
+	err := w.ValidateConf()
+	assert.EqualError(err, "The 'manual' partitioner is only supported for replies")
+}
+
+func TestValidateConfNegativeHTTPTimeout(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.HTTP.IdleTimeout = -1
+	err := w.ValidateConf()
+	assert.EqualError(err, "HTTP idle timeout -1 must not be negative")
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.HTTP.Port = 8080
+	w.conf.HTTP.ReadTimeout = 10
+	w.conf.HTTP.WriteTimeout = 30
+	w.conf.HTTP.IdleTimeout = 120
+	assert.NoError(w.ValidateConf())
+
+	srv := w.newHTTPServer(http.NotFoundHandler(), nil)
+	assert.Equal(":8080", srv.Addr)
+	assert.Equal(MaxHeaderSize, srv.MaxHeaderBytes)
+	assert.Equal(10*time.Second, srv.ReadTimeout)
+	assert.Equal(time.Duration(0), srv.ReadHeaderTimeout)
+	assert.Equal(30*time.Second, srv.WriteTimeout)
+	assert.Equal(120*time.Second, srv.IdleTimeout)
+	assert.NotNil(srv.TLSNextProto)
+	assert.Empty(srv.TLSNextProto)
+
+	w.conf.HTTP.HTTP2 = true
+	srv = w.newHTTPServer(http.NotFoundHandler(), nil)
+	assert.Nil(srv.TLSNextProto)
+}
+
+func TestHTTPWithoutKeepAlives(t *testing.T) {
+	assert := assert.New(t)
+
+	k := newTestKafkaComon()
+	port := lastPort
+	lastPort++
+	_, err := startTestWebhooks([]string{
+		"-l", strconv.Itoa(port),
+		"--http-disable-keepalives",
+		"--http-max-header-bytes", "4096",
+		"--http-tcp-keepalive", "30",
+	}, k)
+	assert.Nil(err)
+
+	// Each connection is closed after the response
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/status", port))
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal(1, resp.ProtoMajor)
+	assert.True(resp.Close)
+
+	k.stop <- true
+}
+
+func TestWebhookHandlerBackpressure(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.Backpressure.MaxPending = 2
+	err := w.ValidateConf()
+	assert.Nil(err)
+	assert.Equal(5, w.conf.Backpressure.RetryAfter)
+
+	w.unackedMsgs = 2
+	res := httptest.NewRecorder()
+	w.webhookHandler(res, httptest.NewRequest("POST", "/hook", bytes.NewReader([]byte("{}"))), true)
+	assert.Equal(503, res.Code)
+	assert.Equal("5", res.Header().Get("Retry-After"))
+	assert.Regexp("Too many messages waiting to be delivered to Kafka", res.Body.String())
+
+	// Below the threshold the request is processed as normal
+	w.unackedMsgs = 1
+	res = httptest.NewRecorder()
+	w.webhookHandler(res, httptest.NewRequest("POST", "/hook", bytes.NewReader([]byte("{}"))), true)
+	assert.Equal(400, res.Code)
+	assert.Equal("", res.Header().Get("Retry-After"))
+}
+
+func TestResponseHeaders(t *testing.T) {
+	assert := assert.New(t)
+
+	k := newTestKafkaComon()
+	port := lastPort
+	lastPort++
+	_, err := startTestWebhooks([]string{
+		"-l", strconv.Itoa(port),
+		"--response-header", "Cache-Control=no-store",
+		"--response-header", "X-Test=value",
+	}, k)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/status", port), nil)
+	req.Header.Set("X-Request-ID", "req1")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal("no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal("value", resp.Header.Get("X-Test"))
+	assert.Equal("req1", resp.Header.Get("X-Request-ID"))
+
+	// Applied to errors too, and no request ID is returned if none was supplied
+	resp, err = http.Post(fmt.Sprintf("http://localhost:%d/hook", port), "application/json", bytes.NewReader([]byte("{}")))
+	assert.Nil(err)
+	assert.Equal(400, resp.StatusCode)
+	assert.Equal("no-store", resp.Header.Get("Cache-Control"))
+	assert.Equal("", resp.Header.Get("X-Request-ID"))
+
+	k.stop <- true
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	assert := assert.New(t)
+	defer log.SetLevel(log.GetLevel())
+
+	k := newTestKafkaComon()
+	port := lastPort
+	lastPort++
+	_, err := startTestWebhooks([]string{
+		"-l", strconv.Itoa(port),
+		"--admin-token", "secret",
+	}, k)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("http://localhost:%d/admin/loglevel", port), bytes.NewReader([]byte(`{"level":"info"}`)))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(200, resp.StatusCode)
+	assert.Equal(log.InfoLevel, log.GetLevel())
+
+	k.stop <- true
+}
+
+func TestAdminLogLevelDisabled(t *testing.T) {
+	assert := assert.New(t)
+
+	k := newTestKafkaComon()
+	port := lastPort
+	_, err := startTestWebhooks(nil, k)
+	assert.Nil(err)
+
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("http://localhost:%d/admin/loglevel", port), bytes.NewReader([]byte(`{"level":"info"}`)))
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(err)
+	assert.Equal(404, resp.StatusCode)
+
+	k.stop <- true
+}
+
 func TestStartStopDefaultArgs(t *testing.T) {
 	assert := assert.New(t)
 
@@ -274,11 +457,20 @@ func assertErrResp(assert *assert.Assertions, resp *http.Response, status int, m
 }
 
 func sendTestTransaction(assert *assert.Assertions, msgBytes []byte, contentType string, sendErr error, ack bool) (*http.Response, [][]byte) {
+	failures := 0
+	if sendErr != nil {
+		failures = -1
+	}
+	return sendTestTransactionWithArgs(assert, nil, msgBytes, contentType, sendErr, failures, ack)
+}
+
+// sendTestTransactionWithArgs fails the first sends to Kafka with sendErr, or all of them if failures is -1
+func sendTestTransactionWithArgs(assert *assert.Assertions, testArgs []string, msgBytes []byte, contentType string, sendErr error, failures int, ack bool) (*http.Response, [][]byte) {
 
 	log.SetLevel(log.DebugLevel)
 
 	k := newTestKafkaComon()
-	w, err := startTestWebhooks(nil, k)
+	w, err := startTestWebhooks(testArgs, k)
 	assert.Nil(err)
 
 	wg := &sync.WaitGroup{}
@@ -292,7 +484,8 @@ func sendTestTransaction(assert *assert.Assertions, msgBytes []byte, contentType
 			// Send an ack or an err
 			k.kafkaFactory.Producer.CloseSync.Lock()
 			if !k.kafkaFactory.Producer.Closed {
-				if sendErr != nil {
+				if failures != 0 {
+					failures--
 					k.kafkaFactory.Producer.MockErrors <- &sarama.ProducerError{
 						Msg: msg,
 						Err: sendErr,
@@ -360,6 +553,24 @@ func TestWebhookHandlerJSONSendTransactionNoAck(t *testing.T) {
 	assert.Equal(kldmessages.MsgTypeSendTransaction, forwardedMessage.Headers.MsgType)
 }
 
+func TestWebhookHandlerJSONReplaceTransaction(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := kldmessages.ReplaceTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeReplaceTransaction
+	msg.From = "0x83dBC8e329b38cBA0Fc4ed99b1Ce9c2a390ABdC1"
+	msg.RequestID = "req1"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := kldmessages.ReplaceTransaction{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal(kldmessages.MsgTypeReplaceTransaction, forwardedMessage.Headers.MsgType)
+	assert.Equal("req1", forwardedMessage.RequestID)
+}
+
 func TestWebhookHandlerJSONSendFailedToKafka(t *testing.T) {
 
 	assert := assert.New(t)
@@ -371,6 +582,43 @@ func TestWebhookHandlerJSONSendFailedToKafka(t *testing.T) {
 	assertErrResp(assert, resp, 502, "Failed to deliver message to Kafka.*pop")
 }
 
+func TestWebhookHandlerJSONSendRetriedToKafka(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := kldmessages.SendTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeSendTransaction
+	msgBytes, _ := json.Marshal(&msg)
+	args := []string{"-l", strconv.Itoa(lastPort), "--produce-retries", "2", "--produce-retry-backoff", "1"}
+	lastPort++
+	resp, replyMsgs := sendTestTransactionWithArgs(assert, args, msgBytes, "application/json", fmt.Errorf("pop"), 2, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(3, len(replyMsgs))
+	assert.Equal(replyMsgs[0], replyMsgs[2])
+}
+
+func TestWebhookHandlerJSONSendRetriesExhausted(t *testing.T) {
+	assert := assert.New(t)
+
+	msg := kldmessages.SendTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeSendTransaction
+	msgBytes, _ := json.Marshal(&msg)
+	args := []string{"-l", strconv.Itoa(lastPort), "--produce-retries", "1", "--produce-retry-backoff", "1"}
+	lastPort++
+	resp, replyMsgs := sendTestTransactionWithArgs(assert, args, msgBytes, "application/json", fmt.Errorf("pop"), -1, true)
+	assert.Equal("5", resp.Header.Get("Retry-After"))
+	assertErrResp(assert, resp, 503, "Failed to deliver message to Kafka after 2 attempts: .*pop")
+	assert.Equal(2, len(replyMsgs))
+}
+
+func TestValidateConfNegativeProduceRetries(t *testing.T) {
+	assert := assert.New(t)
+	var printYAML = false
+	w := NewWebhooksBridge(&printYAML)
+	w.conf.ProduceRetry.Max = -1
+	err := w.ValidateConf()
+	assert.EqualError(err, "Produce retries and backoff must not be negative")
+}
+
 func TestWebhookHandlerJSONSendFailedToKafkaNoAck(t *testing.T) {
 
 	assert := assert.New(t)
@@ -454,6 +702,122 @@ func TestWebhookHandlerJSONDeployContract(t *testing.T) {
 	assert.Equal(kldmessages.MsgTypeDeployContract, forwardedMessage.Headers.MsgType)
 }
 
+func TestWebhookHandlerJSONGetBalance(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.GetBalance{}
+	msg.Headers.MsgType = kldmessages.MsgTypeGetBalance
+	msg.Address = "any string"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := kldmessages.GetBalance{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal(kldmessages.MsgTypeGetBalance, forwardedMessage.Headers.MsgType)
+}
+
+func TestWebhookHandlerJSONGetBalanceMissingAddress(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = kldmessages.MsgTypeGetBalance
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertErrResp(assert, resp, 400, "Invalid message - missing 'address' \\(or not a string\\)")
+	assert.Equal(0, len(replyMsgs))
+}
+
+func TestWebhookHandlerJSONGetEvents(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.GetEvents{}
+	msg.Headers.MsgType = kldmessages.MsgTypeGetEvents
+	msg.Address = "any string"
+	msg.Event.Name = "Changed"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := kldmessages.GetEvents{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal(kldmessages.MsgTypeGetEvents, forwardedMessage.Headers.MsgType)
+	assert.Equal("Changed", forwardedMessage.Event.Name)
+}
+
+func TestWebhookHandlerJSONGetTransaction(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.GetTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeGetTransaction
+	msg.TransactionHash = "any string"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := kldmessages.GetTransaction{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal(kldmessages.MsgTypeGetTransaction, forwardedMessage.Headers.MsgType)
+}
+
+func TestWebhookHandlerJSONGetTransactionMissingHash(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.RequestCommon{}
+	msg.Headers.MsgType = kldmessages.MsgTypeGetTransaction
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertErrResp(assert, resp, 400, "Invalid message - missing 'transactionHash' \\(or not a string\\)")
+	assert.Equal(0, len(replyMsgs))
+}
+
+func TestWebhookHandlerJSONSendRawTransaction(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.SendRawTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeSendRawTransaction
+	msg.RawTransaction = "0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertSentResp(assert, resp, true)
+	assert.Equal(1, len(replyMsgs))
+
+	forwardedMessage := kldmessages.SendRawTransaction{}
+	json.Unmarshal(replyMsgs[0], &forwardedMessage)
+	assert.Equal(kldmessages.MsgTypeSendRawTransaction, forwardedMessage.Headers.MsgType)
+	assert.Equal(msg.RawTransaction, forwardedMessage.RawTransaction)
+}
+
+func TestAddressKey(t *testing.T) {
+	assert := assert.New(t)
+
+	tx, _ := kldeth.NewRawTxn(&kldmessages.SendRawTransaction{RawTransaction: "0xf8610580825208942b8c0ecc76d0759a8f50b2e14a6881367d8058328080826095a0d5838a576e18c3ba5822f097467a8d983fdf03ecbf80011cc9b876ecedce9278a0421a8a755ef835b09f8c77af81ef077c9878a71fa240aa0f3bae60a6dd27e2d1"})
+	assert.Equal(addressKey(strings.ToLower(tx.From.Hex())), addressKey(tx.From.Hex()))
+	assert.Equal("0x2b8c0ecc76d0759a8f50b2e14a6881367d805832", addressKey("0x2b8c0ECc76d0759a8F50b2E14A6881367D805832"))
+}
+
+func TestWebhookHandlerJSONSendRawTransactionBadTxn(t *testing.T) {
+
+	assert := assert.New(t)
+
+	msg := kldmessages.SendRawTransaction{}
+	msg.Headers.MsgType = kldmessages.MsgTypeSendRawTransaction
+	msg.RawTransaction = "0x1234"
+	msgBytes, _ := json.Marshal(&msg)
+	resp, replyMsgs := sendTestTransaction(assert, msgBytes, "application/json", nil, true)
+	assertErrResp(assert, resp, 400, "Invalid message - Supplied value for 'rawTransaction' is not an RLP encoded transaction")
+	assert.Equal(0, len(replyMsgs))
+}
+
 func TestWebhookHandlerYAMLDeployContract(t *testing.T) {
 
 	assert := assert.New(t)